@@ -0,0 +1,38 @@
+package main
+
+import (
+	in "Utils"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+var authToken = flag.String("token", os.Getenv("GOEXPOSE_TOKEN"), "Pre-shared token or JWT to authenticate with if there is no client certificate, or $GOEXPOSE_TOKEN")
+
+// authenticate presents the token to the server as the first frame of a control connection without client
+// certificate, see in.CTRLAUTH, and returns the name the server knows the client by.
+func authenticate(conn net.Conn) (string, error) {
+	if len(*authToken) > in.MAXAUTHTOKEN {
+		return "", errors.New("token longer than " + strconv.Itoa(in.MAXAUTHTOKEN) + " bytes")
+	}
+	err := in.WriteFrame(conn, in.NewCTRLFrame(in.CTRLAUTH, []string{*authToken}))
+	if err != nil {
+		return "", err
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(DIALTIMEOUT))
+	defer conn.SetReadDeadline(time.Time{})
+	fr, err := in.ReadFrame(conn)
+	if err != nil {
+		return "", err
+	}
+	if fr.Typ == in.CTRLERROR && len(fr.Data) >= 3 {
+		return "", errors.New(fr.Data[2])
+	}
+	if fr.Typ != in.CTRLAUTH || len(fr.Data) < 1 {
+		return "", errors.New("unexpected answer to the token")
+	}
+	return fr.Data[0], nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	in "Utils"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Renewal of the client certificate over the control connection, see in.CTRLCERT.
+const (
+	// CERTRENEWBEFORE is how long before it expires the client asks the server to renew its certificate, the
+	// server allows it 30 days before
+	CERTRENEWBEFORE = 14 * 24 * time.Hour
+	// CERTRENEWRETRY is how long the client waits before asking again after a failed renewal
+	CERTRENEWRETRY = time.Hour
+)
+
+// certificate is the certificate presented to the server, replaced when it is renewed. It is nil if the client
+// authenticates with a token.
+var certificate atomic.Pointer[tls.Certificate]
+
+// certPaths returns the paths of the certificate and the key of the client in the certs directory of the home
+// directory.
+func certPaths() (string, string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(homeDir, "certs", "tower.test.crt"), filepath.Join(homeDir, "certs", "tower.test.key"), nil
+}
+
+// loadCertificate loads the key pair of the client with its parsed leaf.
+func loadCertificate(crtPath string, keyPath string) (*tls.Certificate, error) {
+	cer, err := tls.LoadX509KeyPair(crtPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	cer.Leaf, err = x509.ParseCertificate(cer.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &cer, nil
+}
+
+// getClientCertificate is the tls.Config.GetClientCertificate of the client, so a renewed certificate is presented
+// on the next connection.
+func getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if cer := certificate.Load(); cer != nil {
+		return cer, nil
+	}
+	// no certificate, the client authenticates with a token
+	return &tls.Certificate{}, nil
+}
+
+// renewCertificate asks the server for a new certificate if the current one expires within CERTRENEWBEFORE. A new
+// key is created for it, which is kept until the server answers.
+func (p *Proxy) renewCertificate() {
+	cer := certificate.Load()
+	if cer == nil || time.Until(cer.Leaf.NotAfter) > CERTRENEWBEFORE || time.Since(p.renewalAt) < CERTRENEWRETRY {
+		return
+	}
+	p.renewalAt = time.Now()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		logger.Error("Error creating key for certificate renewal", "Error", err)
+		return
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cer.Leaf.Subject.CommonName}}, key)
+	if err != nil {
+		logger.Error("Error creating certificate request", "Error", err)
+		return
+	}
+	err = p.writeFrame(in.NewCTRLFrame(in.CTRLCERT, []string{base64.StdEncoding.EncodeToString(csr)}))
+	if err != nil {
+		logger.Error("Error sending certificate request", "Error", err)
+		return
+	}
+	p.renewalKey = key
+	p.renewalChunks = nil
+	logger.Info("Requested renewal of the client certificate", "Expires", cer.Leaf.NotAfter)
+}
+
+// certResult collects the chunks of the renewed certificate. Once complete, the certificate and its key replace
+// the files of the client and are presented on the next connection.
+func (p *Proxy) certResult(fr *in.CTRLFrame) {
+	if len(fr.Data) < 2 || p.renewalKey == nil {
+		logger.Error("Unexpected certificate renewal frame", "Frame", fr.String())
+		return
+	}
+	if fr.Data[0] == "" {
+		reason := "refused by server"
+		if len(fr.Data) > 2 {
+			reason = fr.Data[2]
+		}
+		fmt.Println("[ERROR] Client certificate not renewed: " + reason)
+		p.renewalKey = nil
+		return
+	}
+	p.renewalChunks = append(p.renewalChunks, fr.Data[0])
+	if fr.Data[1] != "0" {
+		return
+	}
+	key := p.renewalKey
+	p.renewalKey = nil
+	err := saveCertificate(strings.Join(p.renewalChunks, ""), key)
+	if err != nil {
+		fmt.Println("[ERROR] Renewed client certificate not saved!")
+		logger.Error("Error saving renewed certificate", "Error", err)
+		return
+	}
+	fmt.Println("[INFO] Client certificate renewed, valid until " + certificate.Load().Leaf.NotAfter.Format(time.DateOnly))
+}
+
+// saveCertificate checks that the base64 encoded certificate is for the key, writes both over the files of the
+// client and presents the certificate from now on.
+func saveCertificate(encoded string, key *ecdsa.PrivateKey) error {
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	if !key.PublicKey.Equal(leaf.PublicKey) {
+		return errors.New("renewed certificate not for the requested key")
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	crtPath, keyPath, err := certPaths()
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(crtPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if err != nil {
+		return err
+	}
+	certificate.Store(&tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf})
+	return nil
+}
+
+// writeFileAtomic replaces the file with the data readable by the owner only, so it is never seen half written.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	in "Utils"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// clientCertificate creates a self-signed certificate of the client for the key, valid for the duration.
+func clientCertificate(t *testing.T, key *ecdsa.PrivateKey, valid time.Duration) []byte {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "alice"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(valid),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// certHome sets the home directory to a temporary one with a certs directory, and forgets the certificate after the
+// test.
+func certHome(t *testing.T) string {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	err := os.Mkdir(filepath.Join(home, "certs"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		certificate.Store(nil)
+	})
+	return home
+}
+
+func TestRenewCertificate(t *testing.T) {
+	certHome(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der := clientCertificate(t, key, 24*time.Hour)
+	leaf, _ := x509.ParseCertificate(der)
+	certificate.Store(&tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf})
+
+	ctrl, server := net.Pipe()
+	defer ctrl.Close()
+	defer server.Close()
+	p := &Proxy{ctrlConn: ctrl}
+	frames := make(chan *in.CTRLFrame, 1)
+	go func() {
+		_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		fr, _ := in.ReadFrame(server)
+		frames <- fr
+	}()
+	p.renewCertificate()
+	fr := <-frames
+	if fr == nil || fr.Typ != in.CTRLCERT || p.renewalKey == nil {
+		t.Fatal("Expected a certificate request, got", fr)
+	}
+	csrDER, _ := base64.StdEncoding.DecodeString(fr.Data[0])
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil || csr.Subject.CommonName != "alice" || csr.CheckSignature() != nil {
+		t.Fatal("Expected a signed request for the name of the client, got", csr, err)
+	}
+	renewalAt := p.renewalAt
+
+	// no second request until CERTRENEWRETRY passed
+	p.renewCertificate()
+	if p.renewalAt != renewalAt {
+		t.Error("Expected no second request right away")
+	}
+
+	// the answer comes in chunks
+	renewed := base64.StdEncoding.EncodeToString(clientCertificate(t, p.renewalKey, 90*24*time.Hour))
+	half := len(renewed) / 2
+	p.certResult(in.NewCTRLFrame(in.CTRLCERT, []string{renewed[:half], "1"}))
+	if certificate.Load().Leaf != leaf {
+		t.Fatal("Expected the certificate to be kept until the last chunk")
+	}
+	p.certResult(in.NewCTRLFrame(in.CTRLCERT, []string{renewed[half:], "0"}))
+	if time.Until(certificate.Load().Leaf.NotAfter) < 80*24*time.Hour || p.renewalKey != nil {
+		t.Fatal("Expected the renewed certificate to be presented")
+	}
+	crtPath, keyPath, _ := certPaths()
+	loaded, err := loadCertificate(crtPath, keyPath)
+	if err != nil || !loaded.Leaf.Equal(certificate.Load().Leaf) {
+		t.Error("Expected the renewed certificate to be saved, got", err)
+	}
+	if info, err := os.Stat(keyPath); err != nil || info.Mode().Perm() != 0600 {
+		t.Error("Expected the key to be readable by the owner only, got", info, err)
+	}
+
+	// a certificate far from expiring isn't renewed
+	p.renewalAt = time.Time{}
+	p.renewCertificate()
+	if !p.renewalAt.IsZero() {
+		t.Error("Expected no renewal of a fresh certificate")
+	}
+}
+
+func TestCertResultRefused(t *testing.T) {
+	certHome(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p := &Proxy{renewalKey: key}
+	p.certResult(in.NewCTRLFrame(in.CTRLCERT, []string{"", "0", "not allowed"}))
+	if p.renewalKey != nil || certificate.Load() != nil {
+		t.Error("Expected the renewal to end without certificate")
+	}
+}
+
+func TestSaveCertificateOfOtherKey(t *testing.T) {
+	home := certHome(t)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	err := saveCertificate(base64.StdEncoding.EncodeToString(clientCertificate(t, other, time.Hour)), key)
+	if err == nil {
+		t.Fatal("Expected a certificate of another key to be rejected")
+	}
+	if err = saveCertificate("no base64!", key); err == nil {
+		t.Error("Expected malformed certificates to be rejected")
+	}
+	entries, _ := os.ReadDir(filepath.Join(home, "certs"))
+	if len(entries) != 0 || certificate.Load() != nil {
+		t.Error("Expected nothing to be saved, got", entries)
+	}
+}
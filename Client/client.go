@@ -1,12 +1,11 @@
 package main
 
 import (
+	in "Utils"
 	"context"
 	"crypto/tls"
 	"fmt"
-	"net"
-	"os"
-	"path/filepath"
+	"strings"
 )
 
 const (
@@ -16,6 +15,7 @@ const (
 type Client struct {
 	proxy       *Proxy
 	proxyCancel context.CancelFunc
+	exposures   *in.Exposures
 
 	ctx       context.Context
 	tlsConfig *tls.Config
@@ -23,84 +23,98 @@ type Client struct {
 
 func NewClient(context context.Context) *Client {
 	return &Client{
-		proxy: nil,
-		ctx:   context,
+		proxy:     nil,
+		ctx:       context,
+		exposures: in.NewExposures(),
 	}
 }
 
+// Exposures returns the lifecycle states of the exposed ports, for applications embedding the client.
+func (c *Client) Exposures() *in.Exposures {
+	return c.exposures
+}
+
 func (c *Client) run(input chan []string) {
 	defer wg.Done()
 	c.tlsConfig = c.prepareTlsConfig()
 	if c.tlsConfig == nil {
-		logger.Error("Error preparing TLS config: ", nil)
+		logger.Error("Error preparing TLS config")
+		return
+	}
+	if _, err := parseUpstreamProxy(*upstreamProxy); err != nil {
+		logger.Error("Error parsing proxy", "Error", err)
 		return
 	}
-	logger.Log("Client started")
+	logger.Info("Client started")
 
 	for {
 		select {
 		case <-c.ctx.Done():
 			return
 		case cmd := <-input:
-			logger.Log("Command received: " + fmt.Sprintf("Command received: %v", cmd))
+			logger.Debug("Command received", "Command", fmt.Sprintf("%v", cmd))
 			c.handleCommand(cmd)
-			logger.Log("Command handled")
+			logger.Debug("Command handled")
 		}
 	}
 }
 
 func (c *Client) prepareTlsConfig() *tls.Config {
-	homeDir, err := os.UserHomeDir()
+	crtPath, keyPath, err := certPaths()
 	if err != nil {
-		logger.Error("Error getting home directory:", err)
+		logger.Error("Error getting home directory", "Error", err)
 		return nil
 	}
-	keyPath := filepath.Join(homeDir, "certs", "tower.test.key")
-	crtPath := filepath.Join(homeDir, "certs", "tower.test.crt")
-	cer, err := tls.LoadX509KeyPair(crtPath, keyPath)
+	config := &tls.Config{
+		InsecureSkipVerify:   true, // The servers certificate is self-signed, the clients is signed by the server. This should be adjusted in the future
+		GetClientCertificate: getClientCertificate,
+	}
+	// without verification of the chain, pinning the fingerprint is what authenticates the server
+	config.VerifyPeerCertificate, err = verifyServer(*serverFingerprints)
 	if err != nil {
-		logger.Error("Error loading key pair:", err)
+		logger.Error("Error parsing server fingerprint", "Error", err)
 		return nil
 	}
-
-	config := &tls.Config{
-		Certificates:       []tls.Certificate{cer},
-		InsecureSkipVerify: true, // The servers certificate is self-signed, the clients is signed by the server. This should be adjusted in the future
+	cer, err := loadCertificate(crtPath, keyPath)
+	if err != nil {
+		if *authToken == "" && *noiseServerKey == "" {
+			logger.Error("Error loading key pair", "Error", err)
+			return nil
+		}
+		// the server accepts the token or the Noise key instead of a certificate
+		logger.Info("No client certificate, authenticating with token or Noise key", "Error", err)
+	} else {
+		certificate.Store(cer)
 	}
-	logger.Log("TLS config prepared")
+	logger.Debug("TLS config prepared")
 	return config
 }
 
 func (c *Client) handleCommand(cmd []string) {
 	switch cmd[0] {
 	case "pair":
-		if len(cmd) != 2 {
-			fmt.Println("[ERROR] Usage: pair <server>")
+		if len(cmd) < 2 {
+			fmt.Println("[ERROR] Usage: pair <server>[:port]|wss://<server>[:port][/path]|noise://<server>:<port> [<fallback server>[:port] ...]")
 			return
 		}
 		if c.proxy != nil {
 			fmt.Println("[ERROR] Proxy already paired with server")
 			return
 		}
-		ip := net.ParseIP(cmd[1])
-		if ip == nil {
-			i, err := net.ResolveIPAddr("ip4", cmd[1])
-			ip = i.IP
-			if err != nil {
-				fmt.Println("[ERROR] Invalid server address")
-				logger.Error("Error resolving domain name: ", err)
-				return
-			}
+		servers, err := parseServerAddrs(cmd[1:])
+		if err != nil {
+			fmt.Println("[ERROR] Invalid server address")
+			logger.Error("Error parsing server addresses", "Error", err)
+			return
 		}
-		ct := context.WithValue(c.ctx, "ip", ip)
 		/*
 			The pairingContext is live for the duration of the client being paired to a server.
 		*/
-		pairingCtx, cancel := context.WithCancel(ct)
+		pairingCtx, cancel := context.WithCancel(c.ctx)
 		c.proxyCancel = cancel
-		c.proxy = NewProxy(pairingCtx, cancel, c.tlsConfig)
+		c.proxy = NewProxy(pairingCtx, cancel, c.tlsConfig, servers, c.exposures)
 		if !c.proxy.connectToServer() {
-			logger.Error("Error connecting to server", nil)
+			logger.Error("Error connecting to server")
 			c.proxyCancel()
 			c.proxy = nil
 		}
@@ -111,27 +125,92 @@ func (c *Client) handleCommand(cmd []string) {
 		}
 		c.proxyCancel()
 		c.proxy = nil
-	case "expose":
+	case "expose", "exposeudp":
+		if c.proxy == nil {
+			fmt.Println("[ERROR] Proxy not paired with server")
+			return
+		}
+		if len(cmd) < 2 {
+			fmt.Println("[ERROR] Usage: " + cmd[0] + " <port|first-last> [pool=<warm connections, default 2>] [timeout=<udp session seconds>] [mtu=<bytes>] [oversize=drop|fragment] [affinity=addr|quic] [transport=proxy|inline] [public=<port>|any] [name=<name>] [host=<hostname>] [path=<prefix>] [strip=on|off] [header=<name>:<value>|-<name>] [respheader=<name>:<value>|-<name>] [forwarded=on|off] [basicauth=<user>:<password>] [oidc=<email>|@<domain>|*] [errors=auto|html|json] [inspect=on|off] [cache=on|off] [proxyprotocol=v1|v2|off] [socket=<unix socket path>] [allow=<ip|cidr>] [deny=<ip|cidr>] [allowcountry=<code>] [denycountry=<code>] [peerconns=<n>] [compress=flate|json|http|mqtt|off]")
+			return
+		}
+		c.proxy.expose(commandNetwork(cmd[0]), cmd[1], cmd[2:])
+	case "hide", "hideudp":
 		if c.proxy == nil {
 			fmt.Println("[ERROR] Proxy not paired with server")
 			return
 		}
 		if len(cmd) != 2 {
-			fmt.Println("[ERROR] Usage: expose <port>")
+			fmt.Println("[ERROR] Usage: " + cmd[0] + " <port|first-last|name>")
 			return
 		}
-		c.proxy.expose(cmd[1])
-	case "hide":
+		c.proxy.hide(commandNetwork(cmd[0]), cmd[1])
+	case "stats":
+		if c.proxy == nil {
+			fmt.Println("[ERROR] Proxy not paired with server")
+			return
+		}
+		switch len(cmd) {
+		case 1:
+			c.proxy.stats()
+		case 2:
+			c.proxy.subscribeStats(cmd[1])
+		default:
+			fmt.Println("[ERROR] Usage: stats [interval seconds, 0 to unsubscribe]")
+		}
+	case "history", "historyudp":
+		if c.proxy == nil {
+			fmt.Println("[ERROR] Proxy not paired with server")
+			return
+		}
+		if len(cmd) < 2 || len(cmd) > 3 || (len(cmd) == 3 && cmd[2] != "hours") {
+			fmt.Println("[ERROR] Usage: " + cmd[0] + " <port|name> [hours]")
+			return
+		}
+		c.proxy.history(commandNetwork(cmd[0]), cmd[1], len(cmd) == 3)
+	case "inspect":
+		if c.proxy == nil {
+			fmt.Println("[ERROR] Proxy not paired with server")
+			return
+		}
+		if len(cmd) != 2 {
+			fmt.Println("[ERROR] Usage: inspect <port|name>")
+			return
+		}
+		c.proxy.inspect(cmd[1])
+	case "socks":
 		if c.proxy == nil {
 			fmt.Println("[ERROR] Proxy not paired with server")
 			return
 		}
 		if len(cmd) != 2 {
-			fmt.Println("[ERROR] Usage: hide <port>")
+			fmt.Println("[ERROR] Usage: socks <listen address, e.g. 127.0.0.1:1080>|off")
 			return
 		}
-		c.proxy.hide(cmd[1])
+		c.proxy.socks(cmd[1])
+	case "adopt":
+		if c.proxy == nil {
+			fmt.Println("[ERROR] Proxy not paired with server")
+			return
+		}
+		if len(cmd) != 2 {
+			fmt.Println("[ERROR] Usage: adopt <certificate CN of the other client>")
+			return
+		}
+		c.proxy.adopt(cmd[1])
+	case "status":
+		for _, exp := range c.exposures.Snapshot() {
+			fmt.Println("[STATUS] " + exp.String())
+		}
 	default:
-		fmt.Println("[ERROR] Unknown command: ", cmd[0], " use 'pair', 'unpair', 'expose' or 'hide'.")
+		fmt.Println("[ERROR] Unknown command: ", cmd[0], " use 'pair', 'unpair', 'expose', 'exposeudp', 'hide', 'hideudp', 'stats', 'history', 'historyudp', 'inspect', 'socks', 'adopt' or 'status'.")
+	}
+}
+
+// commandNetwork returns the network of an expose or hide command.
+func commandNetwork(cmd string) string {
+	if strings.HasSuffix(cmd, "udp") {
+		return "udp"
 	}
+	return "tcp"
 }
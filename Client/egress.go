@@ -0,0 +1,234 @@
+package main
+
+import (
+	in "Utils"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+// SOCKS5 replies of RFC 1928 the SOCKS5 listener answers with.
+const (
+	socksSucceeded       = 0x00
+	socksFailure         = 0x01
+	socksNotAllowed      = 0x02
+	socksHostUnreachable = 0x04
+	socksNotSupported    = 0x07
+)
+
+// socks starts a SOCKS5 listener on the address, whose connections are carried through the server into its network,
+// e.g. for admins reaching the services next to the server. The server has to allow the client egress, see
+// in.CTRLEGRESS. "off" stops the listener, it is stopped as well when the pairing ends.
+func (p *Proxy) socks(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if addr == "off" {
+		if p.socksListener == nil {
+			fmt.Println("[ERROR] No SOCKS5 listener running")
+			return
+		}
+		_ = p.socksListener.Close()
+		p.socksListener = nil
+		return
+	}
+	if p.socksListener != nil {
+		fmt.Println("[ERROR] SOCKS5 listener already running on " + p.socksListener.Addr().String())
+		return
+	}
+	if p.ctrlConn == nil {
+		fmt.Println("[ERROR] Not connected to server, reconnecting...")
+		return
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		fmt.Println("[ERROR] Error listening on " + addr)
+		logger.Error("Error starting SOCKS5 listener", "Address", addr, "Error", err)
+		return
+	}
+	err = in.WriteFrame(p.ctrlConn, in.NewCTRLFrame(in.CTRLEGRESS, nil))
+	if err != nil {
+		_ = l.Close()
+		fmt.Println("[ERROR] Error sending egress request!")
+		logger.Error("Error sending egress request", "Error", err)
+		return
+	}
+	p.socksListener = l
+	context.AfterFunc(p.ctx, func() {
+		_ = l.Close()
+	})
+	wg.Add(1)
+	go p.acceptSocks(l)
+}
+
+// egressResult takes the answer of the server to a CTRLEGRESS frame. The egress streams of the SOCKS5 listener are
+// opened on the inline session, which is started if the server doesn't carry inline relays yet.
+func (p *Proxy) egressResult(fr *in.CTRLFrame) {
+	if fr.Typ == in.CTRLERROR {
+		fmt.Println("[ERROR] Server refused egress: " + fr.Data[2])
+		p.mu.Lock()
+		if p.socksListener != nil {
+			_ = p.socksListener.Close()
+			p.socksListener = nil
+		}
+		p.mu.Unlock()
+		return
+	}
+	session := p.inlineSession()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.egress = session
+	if p.socksListener != nil {
+		fmt.Println("[INFO] SOCKS5 listener on " + p.socksListener.Addr().String() + " reaches the network of the server")
+	}
+}
+
+// acceptSocks serves the connections of the SOCKS5 listener until it is closed.
+func (p *Proxy) acceptSocks(l net.Listener) {
+	defer wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				logger.Error("Error accepting SOCKS5 connection", "Error", err)
+			}
+			return
+		}
+		wg.Add(1)
+		go p.serveSocks(conn)
+	}
+}
+
+// serveSocks reads the CONNECT request of a SOCKS5 connection, without authentication, and relays the connection
+// through an egress stream to the destination.
+func (p *Proxy) serveSocks(conn net.Conn) {
+	defer wg.Done()
+	_ = conn.SetDeadline(time.Now().Add(DIALTIMEOUT))
+	address, err := readSocksRequest(conn)
+	if err != nil {
+		logger.Error("Error reading SOCKS5 request", "Error", err)
+		_ = conn.Close()
+		return
+	}
+	p.mu.Lock()
+	session := p.egress
+	p.mu.Unlock()
+	if session == nil {
+		logger.Error("No egress through the server", "Destination", address)
+		writeSocksReply(conn, socksFailure)
+		_ = conn.Close()
+		return
+	}
+	st, err := session.Open()
+	if err != nil {
+		logger.Error("Error opening egress stream", "Destination", address, "Error", err)
+		writeSocksReply(conn, socksFailure)
+		_ = conn.Close()
+		return
+	}
+	// the server connects within DIALTIMEOUT as well
+	_ = st.SetReadDeadline(time.Now().Add(2 * DIALTIMEOUT))
+	answer := make([]byte, 1)
+	err = in.WriteEgressHeader(st, address)
+	if err == nil {
+		_, err = io.ReadFull(st, answer)
+	}
+	_ = st.SetReadDeadline(time.Time{})
+	if err != nil || answer[0] != in.EGRESSOK {
+		logger.Error("Server didn't connect egress stream", "Destination", address, "Answer", answer[0], "Error", err)
+		reply := byte(socksHostUnreachable)
+		if answer[0] == in.EGRESSDENIED {
+			reply = socksNotAllowed
+		}
+		writeSocksReply(conn, reply)
+		_ = st.Close()
+		_ = conn.Close()
+		return
+	}
+	writeSocksReply(conn, socksSucceeded)
+	_ = conn.SetDeadline(time.Time{})
+	logger.Debug("Relaying SOCKS5 connection through the server", "Destination", address)
+	wg.Add(2)
+	go p.relayConn(conn, st, p.ctx)
+	go p.relayConn(st, conn, p.ctx)
+}
+
+// readSocksRequest negotiates no authentication and reads a CONNECT request, RFC 1928. It returns the destination,
+// host:port, host names are resolved by the server. Other commands are answered as not supported.
+func readSocksRequest(conn net.Conn) (string, error) {
+	head := make([]byte, 2)
+	_, err := io.ReadFull(conn, head)
+	if err != nil {
+		return "", err
+	}
+	methods := make([]byte, head[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return "", err
+	}
+	if head[0] != 0x05 {
+		return "", errors.New("no SOCKS5 request")
+	}
+	noAuth := false
+	for _, method := range methods {
+		noAuth = noAuth || method == 0x00
+	}
+	if !noAuth {
+		_, _ = conn.Write([]byte{0x05, 0xff})
+		return "", errors.New("SOCKS5 client requires authentication")
+	}
+	_, err = conn.Write([]byte{0x05, 0x00})
+	if err != nil {
+		return "", err
+	}
+	req := make([]byte, 4)
+	_, err = io.ReadFull(conn, req)
+	if err != nil {
+		return "", err
+	}
+	var host string
+	switch req[3] {
+	case 0x01, 0x04:
+		ip := make([]byte, 4)
+		if req[3] == 0x04 {
+			ip = make([]byte, 16)
+		}
+		_, err = io.ReadFull(conn, ip)
+		addr, _ := netip.AddrFromSlice(ip)
+		host = addr.String()
+	case 0x03:
+		length := make([]byte, 1)
+		_, err = io.ReadFull(conn, length)
+		if err == nil {
+			name := make([]byte, length[0])
+			_, err = io.ReadFull(conn, name)
+			host = string(name)
+		}
+	default:
+		writeSocksReply(conn, socksNotSupported)
+		return "", errors.New("unsupported SOCKS5 address type")
+	}
+	if err != nil {
+		return "", err
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(conn, port)
+	if err != nil {
+		return "", err
+	}
+	if req[1] != 0x01 {
+		writeSocksReply(conn, socksNotSupported)
+		return "", errors.New("unsupported SOCKS5 command")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// writeSocksReply answers a SOCKS5 request, the bound address is left empty.
+func writeSocksReply(conn net.Conn, reply byte) {
+	_, _ = conn.Write([]byte{0x05, reply, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a TCP connection over the loopback, so writes don't wait for the peer to read.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return a, b
+}
+
+func TestReadSocksRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		address string
+		// answer is what the listener answers before the reply of the request
+		answer []byte
+	}{
+		{"IPv4", []byte{5, 1, 0, 5, 1, 0, 1, 192, 0, 2, 1, 0, 80}, "192.0.2.1:80", []byte{5, 0}},
+		{"IPv6", append(append([]byte{5, 2, 2, 0, 5, 1, 0, 4}, net.ParseIP("2001:db8::1")...), 1, 187), "[2001:db8::1]:443", []byte{5, 0}},
+		{"host name", append([]byte{5, 1, 0, 5, 1, 0, 3, 8}, "db.local\x15\x38"...), "db.local:5432", []byte{5, 0}},
+		{"authentication only", []byte{5, 1, 2}, "", []byte{5, 0xff}},
+		{"no SOCKS5", []byte{4, 1, 0}, "", nil},
+		{"BIND", []byte{5, 1, 0, 5, 2, 0, 1, 192, 0, 2, 1, 0, 80}, "", []byte{5, 0, 5, socksNotSupported}},
+		{"unknown address type", []byte{5, 1, 0, 5, 1, 0, 9}, "", []byte{5, 0, 5, socksNotSupported}},
+		{"cut short", []byte{5, 1, 0, 5, 1, 0, 1, 192, 0}, "", []byte{5, 0}},
+	}
+	for _, test := range tests {
+		client, listener := tcpPair(t)
+		_, _ = client.Write(test.request)
+		if test.name == "cut short" {
+			_ = client.(*net.TCPConn).CloseWrite()
+		}
+		address, err := readSocksRequest(listener)
+		if test.address == "" && err == nil {
+			t.Error(test.name+": expected an error, got", address)
+		}
+		if test.address != "" && (err != nil || address != test.address) {
+			t.Error(test.name+": expected", test.address, "got", address, err)
+		}
+		_ = listener.Close()
+		_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		answer, _ := io.ReadAll(client)
+		if !bytes.HasPrefix(answer, test.answer) || len(test.answer) == 0 && len(answer) != 0 {
+			t.Error(test.name+": expected the answer", test.answer, "got", answer)
+		}
+	}
+}
+
+func TestServeSocksWithoutEgress(t *testing.T) {
+	client, listener := tcpPair(t)
+	p := &Proxy{}
+	_, _ = client.Write([]byte{5, 1, 0, 5, 1, 0, 1, 192, 0, 2, 1, 0, 80})
+	wg.Add(1)
+	p.serveSocks(listener)
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	answer, _ := io.ReadAll(client)
+	if !bytes.Equal(answer, []byte{5, 0, 5, socksFailure, 0, 1, 0, 0, 0, 0, 0, 0}) {
+		t.Error("Expected the request to fail without egress, got", answer)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	in "Utils"
+)
+
+// inlineData passes a CTRLDATA frame to the inline session. The server starts the session with the first port
+// exposed with transport=inline, the client starts its side with the first frame and serves the streams like
+// those of the data connection.
+func (p *Proxy) inlineData(fr *in.CTRLFrame) {
+	p.inlineSession()
+	err := p.inlineConn.Deliver(fr)
+	if err != nil {
+		logger.Error("Error passing data frame to inline session", "Error", err)
+	}
+}
+
+// inlineSession returns the inline session, started if there is none yet. It is started by the first CTRLDATA
+// frame, or by the server accepting egress streams, see egressResult.
+func (p *Proxy) inlineSession() *in.MuxSession {
+	if p.inlineConn == nil {
+		p.inlineConn = in.NewFrameConn(p.writeFrame, p.ctrlConn.LocalAddr(), p.ctrlConn.RemoteAddr())
+		p.inline = in.NewMuxSession(p.inlineConn, true)
+		logger.Info("Server carries inline relays on the control connection")
+		wg.Add(1)
+		go p.acceptStreams(p.inline)
+	}
+	return p.inline
+}
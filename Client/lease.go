@@ -0,0 +1,27 @@
+package main
+
+import (
+	in "Utils"
+	"strconv"
+	"time"
+)
+
+// renewLeases renews the leases of all exposed ports with a CTRLRENEW frame each, once a third of the lease time
+// passed since the last renewal. It is called by the goroutine serving the control connection.
+func (p *Proxy) renewLeases() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.leaseTime == 0 || p.ctrlConn == nil || time.Since(p.renewedAt) < p.leaseTime/3 {
+		return
+	}
+	p.renewedAt = time.Now()
+	for _, network := range []string{"tcp", "udp"} {
+		for port := range p.ports(network) {
+			err := in.WriteFrame(p.ctrlConn, in.NewCTRLFrame(in.CTRLRENEW, []string{network, strconv.Itoa(port)}))
+			if err != nil {
+				logger.Error("Error renewing lease", "Port", port, "Error", err)
+				return
+			}
+		}
+	}
+}
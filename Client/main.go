@@ -1,14 +1,22 @@
 package main
 
 import (
+	"Utils"
 	"context"
-	mylog "example.com/reverseproxy/pkg/logger"
+	"flag"
+	"log/slog"
 	"sync"
 )
 
+const (
+	logpath = "/var/log/goexpose"
+)
+
 var wg sync.WaitGroup
-var logger *mylog.Logger
-var loglevel = mylog.DEBUG
+var logger *slog.Logger
+var loglevel = new(slog.LevelVar)
+var consoleLogging = flag.Bool("consolelog", false, "Enable console logging")
+var useMux = flag.Bool("mux", false, "Multiplex all relayed connections over a single data connection instead of a proxy port per exposed port")
 
 /*
 	STATUS:
@@ -17,21 +25,21 @@ var loglevel = mylog.DEBUG
 */
 
 func main() {
-	var err error
-	logger, err = mylog.NewLogger("Client")
-	logger.SetLogLevel(loglevel)
-	if err != nil {
-		panic(err)
-	}
+	flag.Parse()
+	loglevel.Set(slog.LevelDebug)
+	writer := Utils.SetupLoggerWriter(logpath, "client", *consoleLogging)
+	logger = slog.New(slog.NewTextHandler(writer, &slog.HandlerOptions{
+		Level: loglevel,
+	}))
 
 	ctx, cancel := context.WithCancel(context.Background())
 	input := make(chan []string, 100)
 
-	go internal.InputHandler(cancel, input)
+	go Utils.InputHandler(cancel, input)
 	client := NewClient(ctx)
 	wg.Add(1)
 	go client.run(input)
 
 	wg.Wait()
-	logger.Log("Client stopped")
+	logger.Info("Client stopped")
 }
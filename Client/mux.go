@@ -0,0 +1,107 @@
+package main
+
+import (
+	in "Utils"
+	"context"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"time"
+)
+
+// startMux asks the server for a multiplexed data connection and accepts the streams the server opens on it.
+// It is called right after connecting, before any port is exposed. If the server refuses or the data connection
+// can't be established, the client keeps using a proxy connection per relayed connection.
+func (p *Proxy) startMux() {
+	err := in.WriteFrame(p.ctrlConn, in.NewCTRLFrame(in.CTRLMUX, nil))
+	if err != nil {
+		logger.Error("Error requesting multiplexing", "Error", err)
+		return
+	}
+	_ = p.ctrlConn.SetReadDeadline(time.Now().Add(DIALTIMEOUT))
+	fr, err := in.ReadFrame(p.ctrlConn)
+	_ = p.ctrlConn.SetReadDeadline(time.Time{})
+	if err != nil {
+		logger.Error("Error reading multiplexing answer", "Error", err)
+		return
+	}
+	if fr.Typ != in.CTRLMUX || len(fr.Data) < 3 {
+		logger.Error("Server refused multiplexing, using proxy connections", "Frame", fr.String())
+		return
+	}
+	port, err := strconv.Atoi(fr.Data[0])
+	if err != nil {
+		logger.Error("Error converting data port number", "Error", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(p.ctx, DIALTIMEOUT)
+	defer cancel()
+	conn, err := dialUpstream(ctx, net.JoinHostPort(p.serverHost, strconv.Itoa(port)))
+	if err != nil {
+		logger.Error("Error dialing data connection, using proxy connections", "Error", err)
+		return
+	}
+	if fr.Data[2] == "tls" {
+		conn = tls.Client(conn, p.config)
+	}
+	// the token is written with the TLS handshake, and bounded by the deadline as well
+	_ = conn.SetDeadline(time.Now().Add(DIALTIMEOUT))
+	err = in.WriteProxyToken(conn, fr.Data[1])
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		logger.Error("Error presenting data connection token, using proxy connections", "Error", err)
+		_ = conn.Close()
+		return
+	}
+
+	session := in.NewMuxSession(conn, true)
+	p.mu.Lock()
+	p.mux = session
+	p.mu.Unlock()
+	logger.Info("Multiplexing relayed connections over the data connection", "Port", port)
+	wg.Add(1)
+	go p.acceptStreams(session)
+}
+
+// acceptStreams serves the streams of the data connection, or of the inline session, until it is closed. The server disconnects clients
+// that lose their data connection, so the control connection is closed as well, which makes the client reconnect.
+func (p *Proxy) acceptStreams(session *in.MuxSession) {
+	defer wg.Done()
+	for {
+		st, err := session.Accept()
+		if err != nil {
+			p.mu.Lock()
+			if p.mux == session && p.ctrlConn != nil {
+				logger.Error("Data connection lost", "Error", err)
+				_ = p.ctrlConn.Close()
+			}
+			p.mu.Unlock()
+			return
+		}
+		wg.Add(1)
+		go p.serveStream(st)
+	}
+}
+
+// serveStream reads the header of a stream opened by the server and connects it to the local port it names.
+func (p *Proxy) serveStream(st *in.MuxStream) {
+	defer wg.Done()
+	_ = st.SetReadDeadline(time.Now().Add(DIALTIMEOUT))
+	network, lPort, err := in.ReadStreamHeader(st)
+	_ = st.SetReadDeadline(time.Time{})
+	if err != nil {
+		logger.Error("Error reading stream header", "Error", err)
+		_ = st.Close()
+		return
+	}
+	p.mu.Lock()
+	ctx := p.ports(network)[lPort].Ctx
+	p.mu.Unlock()
+	if ctx == nil {
+		logger.Error("Error stream for port not exposed", "Port", lPort)
+		_ = st.Close()
+		return
+	}
+	p.connectLocal(ctx, network, st, lPort)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	in "Utils"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var noiseKeyFile = flag.String("noisekey", "", "File with the private Noise key of the client for noise:// servers, created if missing, ~/certs/noise.key if empty")
+var noiseServerKey = flag.String("noiseserverkey", os.Getenv("GOEXPOSE_NOISE_SERVER_KEY"), "Public Noise key of the server in base64 for noise:// servers, or $GOEXPOSE_NOISE_SERVER_KEY")
+
+// noiseTransport connects to the Noise listener of the server, through the proxy of -proxy if set. The listener has
+// no default port. The Noise handshake takes the place of the TLS handshake of the control connection, see
+// noiseHandshake, so the client needs no certificate.
+type noiseTransport struct{}
+
+func (noiseTransport) Dial(ctx context.Context, addr *url.URL, _ *tls.Config) (net.Conn, error) {
+	if addr.Port() == "" {
+		return nil, errors.New("Noise address without port")
+	}
+	return dialUpstream(ctx, addr.Host)
+}
+
+// noiseHandshake secures the connection with in.NOISEPROTOCOL, with the key of the client and the one of the server
+// of -noiseserverkey, within the deadline of ctx.
+func noiseHandshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	key, err := loadNoiseKey()
+	if err != nil {
+		return nil, err
+	}
+	server, err := in.DecodeNoiseKey(*noiseServerKey)
+	if err != nil {
+		return nil, errors.New("invalid Noise key of the server: " + err.Error())
+	}
+	noiseConn := in.NoiseClient(conn, key, server)
+	deadline, _ := ctx.Deadline()
+	_ = noiseConn.SetDeadline(deadline)
+	err = noiseConn.Handshake()
+	_ = noiseConn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return noiseConn, nil
+}
+
+// loadNoiseKey loads the private Noise key of -noisekey, and creates it if there is none yet. Its public key is
+// logged, the server has to know it, see -noiseclients of the server.
+func loadNoiseKey() ([]byte, error) {
+	path := *noiseKeyFile
+	if path == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(homeDir, "certs", "noise.key")
+	}
+	key, err := in.LoadNoiseKey(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err = in.GenerateNoiseKey()
+		if err == nil {
+			err = in.WriteNoiseKey(path, key)
+		}
+		if err == nil {
+			logger.Info("Created Noise key", "Path", path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	public, err := in.NoisePublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Authenticating with Noise key", "PublicKey", in.EncodeNoiseKey(public))
+	return key, nil
+}
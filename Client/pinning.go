@@ -0,0 +1,34 @@
+package main
+
+import (
+	in "Utils"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"os"
+	"strings"
+)
+
+var serverFingerprints = flag.String("serverfingerprint", os.Getenv("GOEXPOSE_SERVER_FINGERPRINT"), "SHA-256 fingerprints of the server certificate to accept, fp,fp, or $GOEXPOSE_SERVER_FINGERPRINT")
+
+// verifyServer returns a tls.Config.VerifyPeerCertificate accepting only server certificates with one of the
+// fingerprints, several allow the server to rotate its certificate. It returns nil if no fingerprint is set.
+func verifyServer(fingerprints string) (func([][]byte, [][]*x509.Certificate) error, error) {
+	if fingerprints == "" {
+		return nil, nil
+	}
+	pinned := make(map[string]bool)
+	for _, s := range strings.Split(fingerprints, ",") {
+		fp, err := in.ParseFingerprint(s)
+		if err != nil {
+			return nil, err
+		}
+		pinned[fp] = true
+	}
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 || !pinned[in.Fingerprint(rawCerts[0])] {
+			return errors.New("server certificate doesn't match the pinned fingerprint")
+		}
+		return nil
+	}, nil
+}
@@ -1,79 +1,156 @@
 package main
 
 import (
+	in "Utils"
+	"bufio"
 	"context"
+	"crypto/ecdsa"
 	"crypto/tls"
 	"errors"
-	in "example.com/reverseproxy/cmd/Utils"
 	"fmt"
+	"io"
 	"net"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// exposedPort holds the context of an exposed port. Relays of the port are terminated when it is cancelled.
+// Options are sent again when the port is exposed on a new control connection.
+type exposedPort struct {
+	Ctx     context.Context
+	Cancel  context.CancelFunc
+	Options []string
+	// Socket is the Unix socket relayed connections are connected to instead of the local port, see localSocket
+	Socket string
+}
+
 type Proxy struct {
 	ctx      context.Context
 	config   *tls.Config
 	ctxClose context.CancelFunc
 
-	exposedPorts   map[int]in.ContextWithCancel
-	exposedPortsNr int
-	ctrlConn       *tls.Conn
+	// servers are the addresses of the paired server, current is the index of the one connected last
+	servers []*serverAddr
+	current int
+	// serverHost is the IP of the server connected last, or its name if a proxy resolves it
+	serverHost  string
+	connectedAt time.Time
+
+	// mu guards the control connection and the exposed ports, which are used by the command input and the server connection
+	mu              sync.Mutex
+	exposedPorts    map[int]exposedPort
+	exposedUdpPorts map[int]exposedPort
+	exposedPortsNr  int
+	statsInterval   string
+	ctrlConn        net.Conn
+	// inlineOnly is set while the control connection is carried by a transport other than tcp, ports are then
+	// relayed inline
+	inlineOnly bool
+	// mux is the multiplexed data connection, nil if proxy connections are used
+	mux *in.MuxSession
+	// socksListener is the SOCKS5 listener of the socks command, nil if it isn't running. egress is the inline
+	// session its connections are carried on, nil until the server accepted egress on the control connection.
+	socksListener net.Listener
+	egress        *in.MuxSession
+	// leaseTime is the lease time of exposed ports the server announced, 0 if it doesn't lease them
+	leaseTime time.Duration
+	renewedAt time.Time
+
+	// inline is the mux session the server carries in CTRLDATA frames on the control connection, nil until the
+	// first frame. Both are only used by the goroutine serving the control connection.
+	inline     *in.MuxSession
+	inlineConn *in.FrameConn
+	// resumeToken resumes the session on the server after reconnecting, empty if the server doesn't keep sessions.
+	// It is only used by the goroutine serving the control connection.
+	resumeToken string
+	// renewalKey is the key of the certificate requested from the server, nil if none is requested. renewalChunks
+	// collect the certificate and renewalAt is when it was requested last. They are only used by the goroutine
+	// serving the control connection.
+	renewalKey    *ecdsa.PrivateKey
+	renewalChunks []string
+	renewalAt     time.Time
+
+	exposures *in.Exposures
 }
 
-func NewProxy(context context.Context, cancel context.CancelFunc, cfg *tls.Config) *Proxy {
+func NewProxy(context context.Context, cancel context.CancelFunc, cfg *tls.Config, servers []*serverAddr, exposures *in.Exposures) *Proxy {
 	return &Proxy{
-		ctx:      context,
-		ctxClose: cancel,
-		config:   cfg,
+		ctx:       context,
+		ctxClose:  cancel,
+		config:    cfg,
+		servers:   servers,
+		exposures: exposures,
 
-		exposedPorts:   make(map[int]in.ContextWithCancel),
-		exposedPortsNr: 0,
-		ctrlConn:       nil,
+		exposedPorts:    make(map[int]exposedPort),
+		exposedUdpPorts: make(map[int]exposedPort),
+		exposedPortsNr:  0,
+		ctrlConn:        nil,
 	}
 }
 
+// ports returns the exposed ports of the network, "tcp" or "udp".
+func (p *Proxy) ports(network string) map[int]exposedPort {
+	if network == "udp" {
+		return p.exposedUdpPorts
+	}
+	return p.exposedPorts
+}
+
 func (p *Proxy) setConfig(config *tls.Config) {
 	p.config = config
 }
 
+// connectToServer dials the addresses of the server once each and starts handling the first connection established.
 func (p *Proxy) connectToServer() bool {
-	ip := p.ctx.Value("ip").(net.IP)
-	logger.Log("Connecting to: " + ip.String() + ":" + CTRLPORT)
-	conn, err := tls.Dial("tcp", ip.String()+":"+CTRLPORT, p.config)
-	if err != nil {
-		logger.Error("Error connecting to server: ", err)
+	ok, _ := p.dialServer()
+	if !ok {
 		return false
 	}
-	logger.Log("Connected!")
 	// spin off a goroutine to handle the connection
 	wg.Add(1)
-	p.ctrlConn = conn
 	go p.handleServerConnection()
 	return true
 }
 
+// handleServerConnection serves the control connection. When the connection is lost, the server is redialled,
+// rotating through its addresses, until the pairing ends.
 func (p *Proxy) handleServerConnection() {
 	defer wg.Done()
-	defer func() {
-		if p.ctrlConn != nil {
-			err := p.ctrlConn.Close()
-			if err != nil {
-				logger.Error("Error closing connection in defer: ", err)
-			}
-			p.ctrlConn = nil
-			p.ctxClose()
+	defer p.ctxClose()
+	defer p.setStates(in.StateHidden, "")
+	for {
+		lost := p.serveConnection()
+		p.closeCtrlConn()
+		if !lost {
+			return
 		}
-	}()
+		p.servers[p.current].dropped(time.Since(p.connectedAt))
+		logger.Info("Connection to server lost, reconnecting")
+		p.setStates(in.StateDegraded, "control connection lost")
+		if !p.reconnect() {
+			return
+		}
+	}
+}
+
+// serveConnection reads frames from the control connection until the pairing ends or the connection fails.
+// It returns true if the connection was lost.
+func (p *Proxy) serveConnection() bool {
 	for {
 		select {
 		case <-p.ctx.Done():
-			return
+			return false
 		default:
-			err := p.ctrlConn.SetDeadline(time.Now().Add(1 * time.Second))
+			p.renewLeases()
+			p.renewCertificate()
+			// only the read deadline, frames are written from other goroutines as well
+			err := p.ctrlConn.SetReadDeadline(time.Now().Add(1 * time.Second))
 			if err != nil {
-				logger.Error("Error setting deadline: ", err)
-				return
+				logger.Error("Error setting deadline", "Error", err)
+				return true
 			}
 			fr, err := in.ReadFrame(p.ctrlConn)
 			if err != nil {
@@ -81,61 +158,316 @@ func (p *Proxy) handleServerConnection() {
 				if errors.As(err, &netErr) && netErr.Timeout() {
 					continue
 				} else {
-					logger.Error("Error reading frame from server: ", err)
-					return
+					logger.Error("Error reading frame from server", "Error", err)
+					return true
 				}
 			}
-			logger.Log("Received frame from server: " + strconv.Itoa(int(fr.Typ)))
+			logger.Debug("Received frame from server", "Frame", fr.String())
 			switch fr.Typ {
 			case in.CTRLUNPAIR:
-				return
+				if len(fr.Data) > 0 && fr.Data[0] != "" {
+					fmt.Println("[INFO] Disconnected by the server: " + fr.Data[0])
+				}
+				return false
 			case in.CTRLCONNECT:
 				p.startProxy(fr)
+			case in.CTRLSTATS:
+				printStats(fr)
+			case in.CTRLHISTORY:
+				printHistory(fr)
+			case in.CTRLINSPECT:
+				printInspected(fr)
+			case in.CTRLEXPOSED, in.CTRLERROR:
+				if fr.Typ == in.CTRLERROR && len(fr.Data) > 3 && fr.Data[1] == "" && fr.Data[3] == in.ERRFORBIDDEN {
+					p.egressResult(fr)
+					continue
+				}
+				p.exposeResult(fr)
+			case in.CTRLEGRESS:
+				p.egressResult(fr)
+			case in.CTRLDATA:
+				p.inlineData(fr)
+			case in.CTRLRESUME:
+				p.resumeResult(fr)
+			case in.CTRLADOPT:
+				adoptResult(fr)
+			case in.CTRLCERT:
+				p.certResult(fr)
 			}
 		}
+	}
+}
+
+func (p *Proxy) closeCtrlConn() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	err := p.ctrlConn.Close()
+	if err != nil {
+		logger.Debug("Error closing control connection", "Error", err)
+	}
+	p.ctrlConn = nil
+	if p.mux != nil {
+		_ = p.mux.Close()
+		p.mux = nil
+	}
+	if p.inline != nil {
+		_ = p.inline.Close()
+		p.inline = nil
+		p.inlineConn = nil
+	}
+	p.egress = nil
+}
 
+// writeFrame sends a frame on the control connection, it fails while the server is being redialled.
+func (p *Proxy) writeFrame(fr *in.CTRLFrame) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ctrlConn == nil {
+		return errors.New("not connected to server")
 	}
+	return in.WriteFrame(p.ctrlConn, fr)
 }
 
+// startProxy opens the proxy connection requested by a CTRLCONNECT frame in the background, see openProxyConn.
 func (p *Proxy) startProxy(fr *in.CTRLFrame) {
 	lPort, err := strconv.Atoi(fr.Data[0])
 	if err != nil {
-		logger.Error("Error startProxy converting lPort number: ", err)
+		logger.Error("Error startProxy converting lPort number", "Error", err)
 		return
 	}
 	pPort, err := strconv.Atoi(fr.Data[1])
 	if err != nil {
-		logger.Error("Error startProxy converting pPort number: ", err)
+		logger.Error("Error startProxy converting pPort number", "Error", err)
 		return
 	}
 
-	// Dial remote server on proxy port
-	pConn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: p.ctx.Value("ip").(net.IP), Port: pPort})
+	network := "tcp"
+	if len(fr.Data) > 2 {
+		network = fr.Data[2]
+	}
+	token := ""
+	if len(fr.Data) > 3 {
+		token = fr.Data[3]
+	}
+	useTls := len(fr.Data) > 4 && fr.Data[4] == "tls"
+
+	// get the correct context for the port
+	p.mu.Lock()
+	ctx := p.ports(network)[lPort].Ctx
+	p.mu.Unlock()
+	if ctx == nil {
+		logger.Error("Error startProxy port not exposed", "Port", lPort)
+		return
+	}
+
+	wg.Add(1)
+	go p.openProxyConn(ctx, network, lPort, net.JoinHostPort(p.serverHost, strconv.Itoa(pPort)), token, useTls)
+}
+
+// openProxyConn connects to the proxy port of the server, completes the TLS handshake if the server asked for it and
+// presents the token of the request. The connection is then kept idle until the server assigns it to an external
+// connection, see awaitStart.
+func (p *Proxy) openProxyConn(ctx context.Context, network string, lPort int, addr string, token string, useTls bool) {
+	defer wg.Done()
+	dialCtx, cancel := context.WithTimeout(ctx, DIALTIMEOUT)
+	defer cancel()
+	conn, err := dialUpstream(dialCtx, addr)
 	if err != nil {
-		logger.Error("Error startProxy dialing remote:", err)
+		logger.Error("Error startProxy dialing remote", "Error", err)
+		p.exposures.Set(network, lPort, in.StateDegraded, "proxy connection failed")
 		return
 	}
+	pConn := conn
+	if useTls {
+		// proxy connections authenticate with the certificate of the control connection
+		tlsConn := tls.Client(conn, p.config)
+		err = tlsConn.HandshakeContext(dialCtx)
+		if err != nil {
+			logger.Error("Error startProxy TLS handshake", "Error", err)
+			p.exposures.Set(network, lPort, in.StateDegraded, "proxy TLS handshake failed")
+			_ = conn.Close()
+			return
+		}
+		pConn = tlsConn
+	}
+	// the server only accepts proxy connections presenting the token of the request
+	if token != "" {
+		err = in.WriteProxyToken(pConn, token)
+		if err != nil {
+			logger.Error("Error startProxy presenting proxy token", "Error", err)
+			_ = pConn.Close()
+			return
+		}
+	}
+	p.awaitStart(ctx, network, pConn, lPort)
+}
+
+// awaitStart keeps a proxy connection idle until the server writes in.DATASTART on it, or the port is hidden.
+func (p *Proxy) awaitStart(ctx context.Context, network string, pConn net.Conn, lPort int) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = pConn.Close()
+	})
+	buf := make([]byte, 1)
+	_, err := pConn.Read(buf)
+	if !stop() {
+		// the port was hidden while waiting
+		return
+	}
+	if err != nil || buf[0] != in.DATASTART {
+		logger.Debug("Proxy connection closed before start", "Port", lPort, "Error", err)
+		_ = pConn.Close()
+		return
+	}
+	p.connectLocal(ctx, network, pConn, lPort)
+}
 
+// connectLocal dials the local port, or the Unix socket the port was exposed with, and relays it to the proxy
+// connection. For UDP, the datagrams are framed on the proxy connection, see relayDatagramsOut and relayDatagramsIn.
+func (p *Proxy) connectLocal(ctx context.Context, network string, pConn net.Conn, lPort int) {
+	p.mu.Lock()
+	socket := p.ports(network)[lPort].Socket
+	preset := compression(p.ports(network)[lPort].Options)
+	p.mu.Unlock()
+	if dict, ok := in.CompressionDictionary(preset); ok && network == "tcp" {
+		pConn = in.NewCompressedConn(pConn, dict, nil, nil)
+	}
 	// Dial local server
-	lConn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: lPort})
+	var lConn net.Conn
+	var err error
+	if socket != "" {
+		lConn, err = net.Dial("unix", socket)
+	} else {
+		lConn, err = net.Dial(network, net.JoinHostPort("127.0.0.1", strconv.Itoa(lPort)))
+	}
 	if err != nil {
-		logger.Error("Error startProxy dialing local:", err)
+		logger.Error("Error startProxy dialing local", "Error", err)
+		p.exposures.Set(network, lPort, in.StateDegraded, "local service unreachable")
+		_ = pConn.Close()
 		return
 	}
+	p.exposures.SetIf(network, lPort, in.StateDegraded, in.StateReady, "")
 
-	// spin off goroutines with the correct context for the port
-	ctx := p.exposedPorts[lPort].Ctx
+	// spin off goroutines with the context of the port
 	wg.Add(2)
-	go p.relayTcp(pConn, lConn, ctx)
-	go p.relayTcp(lConn, pConn, ctx)
+	if network == "udp" {
+		p.mu.Lock()
+		framing := newDatagramFraming(p.exposedUdpPorts[lPort].Options)
+		p.mu.Unlock()
+		stop := context.AfterFunc(ctx, func() {
+			_ = pConn.Close()
+			_ = lConn.Close()
+		})
+		go p.relayDatagramsOut(lConn, pConn, framing, stop)
+		go p.relayDatagramsIn(pConn, lConn, framing, stop)
+		return
+	}
+	go p.relayConn(pConn, lConn, ctx)
+	go p.relayConn(lConn, pConn, ctx)
 }
 
-func (p *Proxy) relayTcp(conn1, conn2 *net.TCPConn, ctx context.Context) {
+// relayDatagramsOut reads datagrams of the local service and writes them framed to the proxy connection.
+// Both connections are closed when either side fails. stop releases the context hook closing the connections.
+func (p *Proxy) relayDatagramsOut(lConn net.Conn, pConn net.Conn, framing datagramFraming, stop func() bool) {
+	defer wg.Done()
+	defer stop()
+	defer func() {
+		_ = pConn.Close()
+		_ = lConn.Close()
+	}()
+	buf := make([]byte, in.MAXDATAGRAM)
+	for {
+		n, err := lConn.Read(buf)
+		if err != nil {
+			logger.Debug("Error relay reading datagram from local", "Error", err)
+			return
+		}
+		if framing.oversized(n) {
+			logger.Debug("Dropping datagram larger than the MTU", "Size", n, "MTU", framing.mtu)
+			continue
+		}
+		err = framing.write(pConn, buf[:n])
+		if err != nil {
+			logger.Debug("Error relay writing datagram to proxy connection", "Error", err)
+			return
+		}
+	}
+}
+
+// relayDatagramsIn reads framed datagrams from the proxy connection and sends them to the local service.
+func (p *Proxy) relayDatagramsIn(pConn net.Conn, lConn net.Conn, framing datagramFraming, stop func() bool) {
+	defer wg.Done()
+	defer stop()
+	defer func() {
+		_ = pConn.Close()
+		_ = lConn.Close()
+	}()
+	buf := make([]byte, in.MAXDATAGRAM)
+	reader := bufio.NewReader(pConn)
+	for {
+		n, err := framing.read(reader, buf)
+		if errors.Is(err, in.ErrDatagramTooLarge) {
+			logger.Debug("Dropping datagram larger than the relay buffer")
+			continue
+		}
+		if err != nil {
+			logger.Debug("Error relay reading datagram from proxy connection", "Error", err)
+			return
+		}
+		_, err = lConn.Write(buf[:n])
+		if err != nil {
+			logger.Debug("Error relay writing datagram to local", "Error", err)
+			return
+		}
+	}
+}
+
+// datagramFraming is how the datagrams of a UDP proxy connection are framed, taken from the mtu and oversize options
+// the port was exposed with. It has to match the framing the server chose for the session, see the RelayConfig of the server.
+type datagramFraming struct {
+	mtu      int
+	fragment bool
+}
+
+func newDatagramFraming(options []string) datagramFraming {
+	var framing datagramFraming
+	for _, opt := range options {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "mtu":
+			framing.mtu, _ = strconv.Atoi(value)
+		case "oversize":
+			framing.fragment = value == "fragment"
+		}
+	}
+	return framing
+}
+
+// oversized reports whether a datagram of length n exceeds the MTU without being fragmented.
+func (f datagramFraming) oversized(n int) bool {
+	return f.mtu > 0 && n > f.mtu && !f.fragment
+}
+
+func (f datagramFraming) write(w io.Writer, datagram []byte) error {
+	if f.fragment && f.mtu > 0 {
+		return in.WriteFragmented(w, datagram, f.mtu)
+	}
+	return in.WriteDatagram(w, datagram)
+}
+
+func (f datagramFraming) read(r io.Reader, buf []byte) (int, error) {
+	if f.fragment && f.mtu > 0 {
+		return in.ReadFragmented(r, buf)
+	}
+	return in.ReadDatagram(r, buf)
+}
+
+// relayConn copies from conn1 to conn2 until conn1 is closed or the context is cancelled.
+func (p *Proxy) relayConn(conn1, conn2 net.Conn, ctx context.Context) {
 	defer wg.Done()
 	defer func() {
 		err := conn1.Close()
 		if err != nil {
-			logger.Error("Error relay closing conn1: ", err)
+			logger.Error("Error relay closing conn1", "Error", err)
 			return
 		}
 	}()
@@ -145,70 +477,508 @@ func (p *Proxy) relayTcp(conn1, conn2 *net.TCPConn, ctx context.Context) {
 			return
 		default:
 			err := conn1.SetDeadline(time.Now().Add(1 * time.Second))
+			if err != nil {
+				logger.Error("Error relay setting deadline", "Error", err)
+				return
+			}
 			buf := make([]byte, 1024)
 			n, err := conn1.Read(buf)
 			if err != nil {
-				if err.(net.Error).Timeout() {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
 					continue
 				} else {
-					logger.Error("Error relay reading from external connection:", err)
+					logger.Error("Error relay reading from external connection", "Error", err)
 					return
 				}
 			}
 			_, err = conn2.Write(buf[:n])
 			if err != nil {
-				logger.Error("Error relay writing to proxy connection:", err)
+				logger.Error("Error relay writing to proxy connection", "Error", err)
 				return
 			}
 		}
 	}
 }
 
-func (p *Proxy) expose(portStr string) {
+// expose asks the server to expose the local port of the network, "tcp" or "udp". options are passed to the server
+// as key=value pairs, e.g. pool=4. Exposing an already exposed port again updates its options without dropping its connections.
+// portStr can be a range of ports, e.g. 27015-27020, which the server exposes on a contiguous range of public ports,
+// or not at all. The ports of a range are tracked, renewed and exposed again after reconnecting on their own.
+func (p *Proxy) expose(network string, portStr string, options []string) {
+	first, last, err := parsePorts(portStr)
+	if err != nil {
+		fmt.Println("[ERROR] Invalid port number!")
+		return
+	}
+	socket, options, err := localSocket(network, first != last, options)
+	if err != nil {
+		fmt.Println("[ERROR] " + err.Error())
+		return
+	}
+	typ := in.CTRLEXPOSETCP
+	if network == "udp" {
+		typ = in.CTRLEXPOSEUDP
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ctrlConn == nil {
+		fmt.Println("[ERROR] Not connected to server, reconnecting...")
+		return
+	}
+	if p.inlineOnly && !slices.ContainsFunc(options, func(opt string) bool { return strings.HasPrefix(opt, "transport=") }) {
+		// proxy ports aren't reachable from where only the transport gets through
+		options = append(options, "transport=inline")
+	}
+	data := append([]string{portStr}, options...)
+	ports := p.ports(network)
+	if first != last {
+		// the server exposes ranges as a whole, exposed ports have to be reconfigured on their own
+		for port := first; port <= last; port++ {
+			if ports[port].Ctx != nil {
+				fmt.Println("[ERROR] Port " + strconv.Itoa(port) + " already exposed!")
+				return
+			}
+		}
+	}
+	for port := first; port <= last; port++ {
+		if ports[port].Ctx != nil && compression(ports[port].Options) != compression(options) {
+			// the proxy connections of the port have to be compressed alike on both ends
+			fmt.Println("[ERROR] Compression of port " + strconv.Itoa(port) + " can't be changed, hide it first!")
+			return
+		}
+	}
 	// send the CTRLEXPOSE with the port to the server
-	fr := in.NewCTRLFrame(in.CTRLEXPOSETCP, []string{portStr})
-	bytes, err := in.ToByteArray(fr)
+	err = in.WriteFrame(p.ctrlConn, in.NewCTRLFrame(typ, data))
+	if err != nil {
+		fmt.Println("[ERROR] Error sending expose request!")
+		logger.Error("Error sending expose request", "Error", err)
+		return
+	}
+	for port := first; port <= last; port++ {
+		p.exposures.Set(network, port, in.StateRequested, "")
+		portOptions := rangeOptions(options, port-first)
+		if ep := ports[port]; ep.Ctx != nil {
+			// the port is only reconfigured, keep its context
+			ep.Options = portOptions
+			ep.Socket = socket
+			ports[port] = ep
+			continue
+		}
+		ct := context.WithValue(p.ctx, "port", strconv.Itoa(port))
+		ctx, cancel := context.WithCancel(ct)
+		ports[port] = exposedPort{Ctx: ctx, Cancel: cancel, Options: portOptions, Socket: socket}
+		p.exposedPortsNr++
+	}
+}
+
+// compression returns the preset of the compress=<preset> option of an exposed port, empty if it is uncompressed.
+// The server compresses the proxy connections of the port with it, the client decompresses them in connectLocal.
+func compression(options []string) string {
+	preset := ""
+	for _, opt := range options {
+		if value, ok := strings.CutPrefix(opt, "compress="); ok {
+			preset = value
+		}
+	}
+	if preset == "off" {
+		return ""
+	}
+	return preset
+}
+
+// localSocket takes the socket=<path> option out of the options of an expose command, the option is only known to
+// the client. Connections relayed for the port are then connected to the Unix socket of the path instead of the local
+// port, which only names the tunnel, e.g. expose 2375 socket=/var/run/docker.sock. Only single TCP ports can be
+// relayed to a socket.
+func localSocket(network string, isRange bool, options []string) (string, []string, error) {
+	socket := ""
+	remaining := make([]string, 0, len(options))
+	for _, opt := range options {
+		key, value, _ := strings.Cut(opt, "=")
+		if key != "socket" {
+			remaining = append(remaining, opt)
+			continue
+		}
+		if value == "" {
+			return "", nil, errors.New("empty socket path")
+		}
+		socket = value
+	}
+	if socket != "" && (network != "tcp" || isRange) {
+		return "", nil, errors.New("only single TCP ports can be relayed to a socket")
+	}
+	return socket, remaining, nil
+}
+
+// parsePorts parses a port, or a range of ports in the form first-last.
+func parsePorts(portStr string) (int, int, error) {
+	firstStr, lastStr, isRange := strings.Cut(portStr, "-")
+	if !isRange {
+		lastStr = firstStr
+	}
+	first, err := strconv.Atoi(firstStr)
 	if err != nil {
-		fmt.Println("[ERROR] Error creating CTRLFrame!")
+		return 0, 0, err
+	}
+	last, err := strconv.Atoi(lastStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, errors.New("invalid port range " + portStr)
+	}
+	return first, last, nil
+}
+
+// rangeOptions returns the options of the port at offset of an exposed range. The public port of the range is the
+// first one, the port at offset is exposed on the public port at the same offset.
+func rangeOptions(options []string, offset int) []string {
+	if offset == 0 {
+		return options
+	}
+	portOptions := make([]string, len(options))
+	for i, opt := range options {
+		portOptions[i] = opt
+		key, value, _ := strings.Cut(opt, "=")
+		if public, err := strconv.Atoi(value); key == "public" && err == nil {
+			portOptions[i] = "public=" + strconv.Itoa(public+offset)
+		}
+	}
+	return portOptions
+}
+
+// hide asks the server to hide the local port of the network, or a range of ports. portStr can also be the name
+// the port was exposed with, the server looks the port up by it.
+func (p *Proxy) hide(network string, portStr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ports := p.ports(network)
+	first, last, err := parsePorts(portStr)
+	if err != nil {
+		port := namedPort(ports, portStr)
+		if port == 0 {
+			fmt.Println("[ERROR] Invalid port number or name!")
+			return
+		}
+		first, last = port, port
+	}
+	for port := first; port <= last; port++ {
+		if ports[port].Ctx == nil {
+			fmt.Println("[ERROR] Port " + strconv.Itoa(port) + " not exposed!")
+			return
+		}
+	}
+	typ := in.CTRLHIDETCP
+	if network == "udp" {
+		typ = in.CTRLHIDEUDP
+	}
+	// send the CTRLHIDE with the port to the server. While reconnecting, the port is only forgotten and not exposed again.
+	if p.ctrlConn != nil {
+		err = in.WriteFrame(p.ctrlConn, in.NewCTRLFrame(typ, []string{portStr}))
+		if err != nil {
+			fmt.Println("[ERROR] Error sending hide request!")
+			logger.Error("Error sending hide request", "Error", err)
+			return
+		}
+	}
+	for port := first; port <= last; port++ {
+		ports[port].Cancel()
+		delete(ports, port)
+		p.exposedPortsNr--
+		p.exposures.Set(network, port, in.StateHidden, "")
+	}
+}
+
+// namedPort returns the port exposed with the name option, or 0 if there is none.
+func namedPort(ports map[int]exposedPort, name string) int {
+	for port, ep := range ports {
+		if slices.Contains(ep.Options, "name="+name) {
+			return port
+		}
+	}
+	return 0
+}
+
+// exposeResult handles the answer of the server to an EXPOSE frame. A port the server rejected is forgotten,
+// unless it was exposed before and only its reconfiguration failed. The server rejects ranges as a whole.
+func (p *Proxy) exposeResult(fr *in.CTRLFrame) {
+	if len(fr.Data) < 2 {
+		logger.Error("Malformed expose result", "Frame", fr.String())
+		return
+	}
+	if fr.Typ == in.CTRLERROR && len(fr.Data) > 3 && fr.Data[3] == in.ERRDUPLICATE {
+		fmt.Println("[ERROR] Server refused the connection: " + fr.Data[2])
 		return
 	}
-	_, err = p.ctrlConn.Write(bytes)
+	network := fr.Data[0]
+	first, last, err := parsePorts(fr.Data[1])
 	if err != nil {
+		logger.Error("Error converting port number of expose result", "Error", err)
 		return
 	}
-	port, err := strconv.Atoi(portStr)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ports := p.ports(network)
+	if fr.Typ == in.CTRLEXPOSED {
+		if _, ok := ports[first]; !ok {
+			// the port was hidden in the meantime
+			return
+		}
+		p.exposures.Set(network, first, in.StateReady, "")
+		families := ""
+		if len(fr.Data) > 5 {
+			families = fr.Data[5]
+		}
+		if len(fr.Data) > 4 && fr.Data[4] != "" {
+			// exposed under a host, without public port
+			fmt.Println("[INFO] Port " + fr.Data[1] + "/" + network + " exposed on " + fr.Data[4])
+			p.exposures.SetPublic(network, first, 0, fr.Data[4], families)
+		} else if len(fr.Data) > 2 {
+			publicPort, err := strconv.Atoi(fr.Data[2])
+			if err == nil && publicPort != first {
+				fmt.Println("[INFO] Port " + fr.Data[1] + "/" + network + " exposed on public port " + fr.Data[2])
+			}
+			p.exposures.SetPublic(network, first, publicPort, "", families)
+		}
+		if len(fr.Data) > 3 {
+			seconds, err := strconv.Atoi(fr.Data[3])
+			if err == nil {
+				p.leaseTime = time.Duration(seconds) * time.Second
+			}
+		}
+		return
+	}
+	reason := "rejected by server"
+	if len(fr.Data) > 2 {
+		reason = fr.Data[2]
+	}
+	fmt.Println("[ERROR] Port " + fr.Data[1] + "/" + network + " not exposed: " + reason)
+	for port := first; port <= last; port++ {
+		ep, ok := ports[port]
+		if !ok {
+			continue
+		}
+		if p.exposures.State(network, port) == in.StateRequested {
+			ep.Cancel()
+			delete(ports, port)
+			p.exposedPortsNr--
+		}
+		p.exposures.Set(network, port, in.StateError, reason)
+	}
+}
+
+// setStates sets the state of all exposed ports.
+func (p *Proxy) setStates(state in.ExposureState, reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, network := range []string{"tcp", "udp"} {
+		for port := range p.ports(network) {
+			p.exposures.Set(network, port, state, reason)
+		}
+	}
+}
+
+// stats asks the server for a snapshot of the stats of all exposed ports.
+func (p *Proxy) stats() {
+	err := p.writeFrame(in.NewCTRLFrame(in.CTRLSTATS, nil))
 	if err != nil {
-		fmt.Println("[ERROR] Invalid port number!")
+		fmt.Println("[ERROR] Error sending stats request!")
+		logger.Error("Error sending stats request", "Error", err)
+	}
+}
+
+// subscribeStats asks the server to send the stats of all exposed ports every intervalStr seconds. An interval of 0 unsubscribes.
+func (p *Proxy) subscribeStats(intervalStr string) {
+	interval, err := strconv.Atoi(intervalStr)
+	if err != nil || interval < 0 {
+		fmt.Println("[ERROR] Invalid interval!")
 		return
 	}
-	ct := context.WithValue(p.ctx, "port", portStr)
-	ctx, cancel := context.WithCancel(ct)
-	p.exposedPorts[port] = in.ContextWithCancel{Ctx: ctx, Cancel: cancel}
-	p.exposedPortsNr++
+	err = p.writeFrame(in.NewCTRLFrame(in.CTRLSTATSSUB, []string{intervalStr}))
+	if err != nil {
+		fmt.Println("[ERROR] Error sending stats subscription!")
+		logger.Error("Error sending stats subscription", "Error", err)
+		return
+	}
+	p.mu.Lock()
+	p.statsInterval = intervalStr
+	p.mu.Unlock()
 }
 
-func (p *Proxy) hide(portStr string) {
+// history asks the server for the traffic history of the exposed port of the network, by port or name, by the
+// minute for the last hour or with hours by the hour for the last day.
+func (p *Proxy) history(network string, portStr string, hours bool) {
+	resolution := in.HISTORYMINUTES
+	if hours {
+		resolution = in.HISTORYHOURS
+	}
+	p.mu.Lock()
 	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		fmt.Println("[ERROR] Invalid port number!")
+		port = namedPort(p.ports(network), portStr)
+	}
+	p.mu.Unlock()
+	if port == 0 {
+		fmt.Println("[ERROR] Invalid port number or name!")
 		return
 	}
-	if p.exposedPorts[port].Ctx == nil {
-		fmt.Println("[ERROR] Port not exposed!")
+	err = p.writeFrame(in.NewCTRLFrame(in.CTRLHISTORY, []string{network, strconv.Itoa(port), resolution}))
+	if err != nil {
+		fmt.Println("[ERROR] Error sending history request!")
+		logger.Error("Error sending history request", "Error", err)
+	}
+}
+
+// printHistory prints the buckets with traffic of a CTRLHISTORY frame received from the server to the console.
+func printHistory(fr *in.CTRLFrame) {
+	if len(fr.Data) < 4 {
+		logger.Error("Malformed history frame", "Frame", fr.String())
 		return
 	}
-	// send the CTRLHIDE with the port to the server
-	fr := in.NewCTRLFrame(in.CTRLHIDETCP, []string{portStr})
-	bytes, err := in.ToByteArray(fr)
+	port := fr.Data[1] + "/" + fr.Data[0]
+	if fr.Data[3] == "0" && len(fr.Data) == 4 {
+		fmt.Println("[ERROR] Port " + port + " has no traffic history, it is not exposed")
+		return
+	}
+	layout := "15:04"
+	if fr.Data[2] == in.HISTORYHOURS {
+		layout = "Jan 2 15:00"
+	}
+	for _, bucket := range fr.Data[4:] {
+		fields := strings.Split(bucket, ":")
+		if len(fields) != 4 {
+			logger.Error("Malformed history bucket", "Bucket", bucket)
+			continue
+		}
+		start, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			logger.Error("Malformed history bucket", "Bucket", bucket)
+			continue
+		}
+		if fields[1] == "0" && fields[2] == "0" && fields[3] == "0" {
+			continue
+		}
+		fmt.Printf("[HISTORY] Port %s %s: %s bytes in, %s bytes out, %s connections\n",
+			port, time.Unix(start, 0).Format(layout), fields[1], fields[2], fields[3])
+	}
+	if fr.Data[3] == "0" {
+		fmt.Println("[HISTORY] End of the history of port " + port + ", minutes and hours without traffic are left out")
+	}
+}
+
+// inspect asks the server for the recent requests of the tcp port exposed under a host, by port or name.
+func (p *Proxy) inspect(portStr string) {
+	p.mu.Lock()
+	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		fmt.Println("[ERROR] Error creating CTRLFrame!")
+		port = namedPort(p.ports("tcp"), portStr)
+	}
+	p.mu.Unlock()
+	if port == 0 {
+		fmt.Println("[ERROR] Invalid port number or name!")
 		return
 	}
-	_, err = p.ctrlConn.Write(bytes)
+	err = p.writeFrame(in.NewCTRLFrame(in.CTRLINSPECT, []string{"tcp", strconv.Itoa(port)}))
 	if err != nil {
+		fmt.Println("[ERROR] Error sending inspect request!")
+		logger.Error("Error sending inspect request", "Error", err)
+	}
+}
+
+// printInspected prints the requests of a CTRLINSPECT frame received from the server to the console.
+func printInspected(fr *in.CTRLFrame) {
+	if len(fr.Data) < 3 {
+		logger.Error("Malformed inspect frame", "Frame", fr.String())
 		return
 	}
-	p.exposedPorts[port].Cancel()
-	p.exposedPorts[port] = in.ContextWithCancel{}
-	p.exposedPortsNr--
+	port := fr.Data[1] + "/" + fr.Data[0]
+	if fr.Data[2] == "0" && len(fr.Data) == 3 {
+		fmt.Println("[ERROR] Port " + port + " has no inspected requests, it is not exposed with inspect=on or had no requests yet")
+		return
+	}
+	for _, request := range fr.Data[3:] {
+		fields := strings.SplitN(request, ":", 7)
+		if len(fields) != 7 {
+			logger.Error("Malformed inspected request", "Request", request)
+			continue
+		}
+		millis, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			logger.Error("Malformed inspected request", "Request", request)
+			continue
+		}
+		fmt.Printf("[INSPECT] Port %s %s %s %s -> %s in %sms, %s bytes in, %s bytes out\n",
+			port, time.UnixMilli(millis).Format("15:04:05.000"), fields[1], fields[6], fields[2], fields[3], fields[4], fields[5])
+	}
+	if fr.Data[2] == "0" {
+		fmt.Println("[INSPECT] End of the requests of port " + port)
+	}
+}
+
+// adopt asks the server to take over the exposed ports of the client with the certificate CN, e.g. the ports of the
+// host this client replaces. They keep their public ports if they are exposed again before the server closes them.
+func (p *Proxy) adopt(cn string) {
+	err := p.writeFrame(in.NewCTRLFrame(in.CTRLADOPT, []string{cn}))
+	if err != nil {
+		fmt.Println("[ERROR] Error sending adopt request!")
+		logger.Error("Error sending adopt request", "Error", err)
+	}
+}
+
+// adoptResult prints the answer of the server to an adopt request.
+func adoptResult(fr *in.CTRLFrame) {
+	if len(fr.Data) < 2 {
+		logger.Error("Malformed adopt result", "Frame", fr.String())
+		return
+	}
+	if fr.Data[1] != "" {
+		fmt.Println("[ERROR] Ports of " + fr.Data[0] + " not adopted: " + fr.Data[1])
+		return
+	}
+	if len(fr.Data) == 2 {
+		fmt.Println("[INFO] Client " + fr.Data[0] + " had no exposed ports to adopt")
+		return
+	}
+	fmt.Println("[INFO] Adopted the ports of " + fr.Data[0] + ", expose them again to keep their public ports: " + strings.Join(fr.Data[2:], " "))
+}
+
+// printStats prints a CTRLSTATS frame received from the server to the console.
+func printStats(fr *in.CTRLFrame) {
+	if len(fr.Data) < 10 {
+		logger.Error("Malformed stats frame", "Frame", fr.String())
+		return
+	}
+	port := fr.Data[1] + "/" + fr.Data[0]
+	if len(fr.Data) > 10 && fr.Data[10] != "" {
+		port += " (" + fr.Data[10] + ")"
+	}
+	rejected := "0"
+	if len(fr.Data) > 11 {
+		rejected = fr.Data[11]
+	}
+	blocked := "0"
+	if len(fr.Data) > 12 {
+		blocked = fr.Data[12]
+	}
+	compressed := ""
+	if len(fr.Data) > 14 && (fr.Data[13] != "0" || fr.Data[14] != "0") {
+		compressed = ", compressed to " + fr.Data[13] + " bytes in" + savings(fr.Data[2], fr.Data[13]) + " and " +
+			fr.Data[14] + " bytes out" + savings(fr.Data[3], fr.Data[14])
+	}
+	fmt.Printf("[STATS] Port %s: %s bytes in, %s bytes out, %s connections accepted, %s active, %s half-closed, %s force-closed, %s evicted, %s oversized, %s rejected, %s blocked%s\n",
+		port, fr.Data[2], fr.Data[3], fr.Data[4], fr.Data[5], fr.Data[6], fr.Data[7], fr.Data[8], fr.Data[9], rejected, blocked, compressed)
+}
+
+// savings returns the share of the relayed bytes compression saved as " (n% saved)", empty if nothing was relayed.
+func savings(relayed string, compressed string) string {
+	r, err := strconv.ParseUint(relayed, 10, 64)
+	if err != nil || r == 0 {
+		return ""
+	}
+	c, err := strconv.ParseUint(compressed, 10, 64)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf(" (%d%% saved)", (int64(r)-int64(c))*100/int64(r))
 }
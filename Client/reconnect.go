@@ -0,0 +1,256 @@
+package main
+
+import (
+	in "Utils"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MINBACKOFF  = 1 * time.Second
+	MAXBACKOFF  = 1 * time.Minute
+	DIALTIMEOUT = 10 * time.Second
+)
+
+// serverAddr is one address of the paired server, e.g. its control port and a fallback on 443.
+// Each address backs off on its own, so an address blocked by a firewall does not delay attempts on the others.
+type serverAddr struct {
+	addr      *url.URL
+	transport Transport
+	backoff   time.Duration
+	retryAt   time.Time
+}
+
+// parseServerAddrs parses the addresses of a pair command, "host" or "host:port". CTRLPORT is used if the port is omitted.
+// Addresses of the form scheme://host[:port][/path] are dialled with the transport of the scheme, e.g.
+// wss://host through a WebSocket, see Transport.
+func parseServerAddrs(args []string) ([]*serverAddr, error) {
+	addrs := make([]*serverAddr, 0, len(args))
+	for _, arg := range args {
+		var u *url.URL
+		var port string
+		if strings.Contains(arg, "://") {
+			var err error
+			u, err = url.Parse(arg)
+			if err != nil || u.Hostname() == "" {
+				return nil, errors.New("missing host in " + arg)
+			}
+			port = u.Port()
+		} else {
+			var host string
+			var err error
+			host, port, err = net.SplitHostPort(arg)
+			if err != nil {
+				// no port given
+				host, port = strings.Trim(arg, "[]"), CTRLPORT
+			}
+			if host == "" {
+				return nil, errors.New("missing host in " + arg)
+			}
+			u = &url.URL{Scheme: "tcp", Host: net.JoinHostPort(host, port)}
+		}
+		// url.URL.Port leaves out ports that aren't numeric, so the port is checked as given
+		if _, err := strconv.ParseUint(port, 10, 16); port != "" && err != nil {
+			return nil, errors.New("invalid port in " + arg)
+		}
+		transport, err := transportOf(u.Scheme)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, &serverAddr{addr: u, transport: transport})
+	}
+	return addrs, nil
+}
+
+func (a *serverAddr) String() string {
+	if a.addr.Scheme == "tcp" {
+		return a.addr.Host
+	}
+	return a.addr.String()
+}
+
+// ready reports whether the address may be dialled again.
+func (a *serverAddr) ready(now time.Time) bool {
+	return !now.Before(a.retryAt)
+}
+
+// failed doubles the backoff of the address, starting at MINBACKOFF and capped at MAXBACKOFF.
+func (a *serverAddr) failed(now time.Time) {
+	a.backoff = min(max(2*a.backoff, MINBACKOFF), MAXBACKOFF)
+	a.retryAt = now.Add(a.backoff)
+}
+
+// dropped is called when an established control connection of the address is lost. Connections lost shortly after
+// being established count as failed attempts, so a server dropping every connection is not redialled in a loop.
+func (a *serverAddr) dropped(connected time.Duration) {
+	if connected < MAXBACKOFF {
+		a.failed(time.Now())
+		return
+	}
+	a.backoff = 0
+	a.retryAt = time.Time{}
+}
+
+// dial opens a control connection to the address with its transport. It returns the host the data and proxy
+// connections go to as well, the IP the control port was reached on, so a server changing its address is found
+// again, or the name of the server if a proxy or another transport resolves it.
+func (a *serverAddr) dial(config *tls.Config) (net.Conn, string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DIALTIMEOUT)
+	defer cancel()
+	raw, err := a.transport.Dial(ctx, a.addr, config)
+	if err != nil {
+		return nil, "", err
+	}
+	host := a.addr.Hostname()
+	if a.addr.Scheme == "noise" {
+		conn, err := noiseHandshake(ctx, raw)
+		if err != nil {
+			_ = raw.Close()
+			return nil, "", err
+		}
+		return conn, host, nil
+	}
+	conn := tls.Client(raw, config)
+	err = conn.HandshakeContext(ctx)
+	if err != nil {
+		_ = raw.Close()
+		return nil, "", err
+	}
+	if tcpAddr, ok := raw.RemoteAddr().(*net.TCPAddr); ok && a.addr.Scheme == "tcp" && *upstreamProxy == "" {
+		host = tcpAddr.IP.String()
+	}
+	if certificate.Load() == nil && *authToken != "" {
+		name, err := authenticate(conn)
+		if err != nil {
+			_ = conn.Close()
+			return nil, "", err
+		}
+		logger.Info("Authenticated with token", "Name", name)
+	}
+	return conn, host, nil
+}
+
+// dialServer tries every address of the server once, starting with the one connected last. Addresses still backing
+// off are skipped. If no address could be connected, it returns the earliest time an address may be dialled again.
+func (p *Proxy) dialServer() (bool, time.Time) {
+	var next time.Time
+	for i := range p.servers {
+		idx := (p.current + i) % len(p.servers)
+		addr := p.servers[idx]
+		if !addr.ready(time.Now()) {
+			if next.IsZero() || addr.retryAt.Before(next) {
+				next = addr.retryAt
+			}
+			continue
+		}
+		logger.Info("Connecting to server", "Address", addr.String())
+		conn, host, err := addr.dial(p.config)
+		if err != nil {
+			addr.failed(time.Now())
+			logger.Error("Error connecting to server", "Address", addr.String(), "Backoff", addr.backoff, "Error", err)
+			if next.IsZero() || addr.retryAt.Before(next) {
+				next = addr.retryAt
+			}
+			continue
+		}
+		p.mu.Lock()
+		p.ctrlConn = conn
+		p.serverHost = host
+		p.inlineOnly = addr.addr.Scheme != "tcp"
+		p.mu.Unlock()
+		p.current = idx
+		p.connectedAt = time.Now()
+		logger.Info("Connected!", "Address", addr.String())
+		if *useMux {
+			p.startMux()
+		}
+		return true, time.Time{}
+	}
+	return false, next
+}
+
+// reconnect dials the addresses of the server until one of them connects or the pairing is cancelled.
+// The exposed ports are requested again on the new connection.
+func (p *Proxy) reconnect() bool {
+	for {
+		ok, next := p.dialServer()
+		if ok {
+			p.reexpose()
+			return true
+		}
+		logger.Debug("No server address reachable", "Retry", time.Until(next))
+		select {
+		case <-p.ctx.Done():
+			return false
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// reexpose sends an EXPOSE frame for every exposed port, with the options it was last exposed with, and renews the
+// stats subscription. If the server keeps sessions, the session is resumed first, which takes the EXPOSE frames as
+// reconfigurations of the ports it still exposes.
+func (p *Proxy) reexpose() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// a multiplexing client set up its data connection with the new session already
+	if p.resumeToken != "" && !*useMux {
+		err := in.WriteFrame(p.ctrlConn, in.NewCTRLFrame(in.CTRLRESUME, []string{p.resumeToken}))
+		if err != nil {
+			logger.Error("Error resuming session", "Error", err)
+			return
+		}
+	}
+	for _, network := range []string{"tcp", "udp"} {
+		typ := in.CTRLEXPOSETCP
+		if network == "udp" {
+			typ = in.CTRLEXPOSEUDP
+		}
+		for port, ep := range p.ports(network) {
+			data := append([]string{strconv.Itoa(port)}, ep.Options...)
+			err := in.WriteFrame(p.ctrlConn, in.NewCTRLFrame(typ, data))
+			if err != nil {
+				logger.Error("Error exposing port again", "Network", network, "Port", port, "Error", err)
+				return
+			}
+			p.exposures.Set(network, port, in.StateRequested, "")
+		}
+	}
+	if p.socksListener != nil {
+		err := in.WriteFrame(p.ctrlConn, in.NewCTRLFrame(in.CTRLEGRESS, nil))
+		if err != nil {
+			logger.Error("Error requesting egress again", "Error", err)
+		}
+	}
+	if p.statsInterval != "" && p.statsInterval != "0" {
+		err := in.WriteFrame(p.ctrlConn, in.NewCTRLFrame(in.CTRLSTATSSUB, []string{p.statsInterval}))
+		if err != nil {
+			logger.Error("Error renewing stats subscription", "Error", err)
+		}
+	}
+}
+
+// resumeResult stores the resume token the server announced for the session, and tells whether a reconnect
+// resumed the session.
+func (p *Proxy) resumeResult(fr *in.CTRLFrame) {
+	if len(fr.Data) < 2 {
+		logger.Error("Malformed resume frame", "Frame", fr.String())
+		return
+	}
+	p.resumeToken = fr.Data[0]
+	if len(fr.Data) < 3 {
+		return
+	}
+	switch fr.Data[2] {
+	case in.RESUMED:
+		logger.Info("Session resumed, established connections were kept")
+	case in.EXPIRED:
+		logger.Info("Session expired, the ports are exposed again")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	in "Utils"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseServerAddrs(t *testing.T) {
+	tests := []struct {
+		arg    string
+		scheme string
+		host   string
+		str    string
+	}{
+		{"example.com", "tcp", "example.com:" + CTRLPORT, "example.com:" + CTRLPORT},
+		{"example.com:443", "tcp", "example.com:443", "example.com:443"},
+		{"192.0.2.1", "tcp", "192.0.2.1:" + CTRLPORT, "192.0.2.1:" + CTRLPORT},
+		{"::1", "tcp", "[::1]:" + CTRLPORT, "[::1]:" + CTRLPORT},
+		{"[2001:db8::1]", "tcp", "[2001:db8::1]:" + CTRLPORT, "[2001:db8::1]:" + CTRLPORT},
+		{"[2001:db8::1]:8443", "tcp", "[2001:db8::1]:8443", "[2001:db8::1]:8443"},
+		{"wss://example.com/tunnel", "wss", "example.com", "wss://example.com/tunnel"},
+		{"wss://[2001:db8::1]:8443", "wss", "[2001:db8::1]:8443", "wss://[2001:db8::1]:8443"},
+		{"noise://example.com:9000", "noise", "example.com:9000", "noise://example.com:9000"},
+	}
+	for _, test := range tests {
+		addrs, err := parseServerAddrs([]string{test.arg})
+		if err != nil {
+			t.Error("Expected", test.arg, "to be parsed, got", err)
+			continue
+		}
+		a := addrs[0]
+		if a.addr.Scheme != test.scheme || a.addr.Host != test.host || a.String() != test.str {
+			t.Error("Expected", test.arg, "as", test.scheme, test.host, test.str, "got", a.addr.Scheme, a.addr.Host, a.String())
+		}
+		if a.transport == nil {
+			t.Error("Expected a transport for", test.arg)
+		}
+	}
+
+	for _, arg := range []string{
+		":8080",
+		"[]:8080",
+		"example.com:70000",
+		"example.com:-1",
+		"example.com:http",
+		"wss://",
+		"wss://example.com:99999",
+		"quic://example.com:443",
+	} {
+		if _, err := parseServerAddrs([]string{arg}); err == nil {
+			t.Error("Expected an error for", arg)
+		}
+	}
+
+	addrs, err := parseServerAddrs([]string{"a.example.com", "wss://b.example.com", "c.example.com:443"})
+	if err != nil || len(addrs) != 3 || addrs[0].String() != "a.example.com:"+CTRLPORT || addrs[2].String() != "c.example.com:443" {
+		t.Error("Expected the addresses in order, got", addrs, err)
+	}
+}
+
+func TestServerAddrBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		step    func(a *serverAddr, now time.Time)
+		backoff time.Duration
+	}{
+		{"first failure", func(a *serverAddr, now time.Time) { a.failed(now) }, MINBACKOFF},
+		{"second failure", func(a *serverAddr, now time.Time) { a.failed(now) }, 2 * MINBACKOFF},
+		{"third failure", func(a *serverAddr, now time.Time) { a.failed(now) }, 4 * MINBACKOFF},
+		{"dropped right away", func(a *serverAddr, _ time.Time) { a.dropped(time.Second) }, 8 * MINBACKOFF},
+		{"dropped before MAXBACKOFF", func(a *serverAddr, _ time.Time) { a.dropped(MAXBACKOFF - time.Second) }, 16 * MINBACKOFF},
+		{"fifth failure", func(a *serverAddr, now time.Time) { a.failed(now) }, 32 * MINBACKOFF},
+		{"capped", func(a *serverAddr, now time.Time) { a.failed(now) }, MAXBACKOFF},
+		{"still capped", func(a *serverAddr, now time.Time) { a.failed(now) }, MAXBACKOFF},
+		{"dropped after a while", func(a *serverAddr, _ time.Time) { a.dropped(MAXBACKOFF) }, 0},
+		{"failure after reset", func(a *serverAddr, now time.Time) { a.failed(now) }, MINBACKOFF},
+	}
+	a := &serverAddr{}
+	now := time.Now()
+	if !a.ready(now) {
+		t.Fatal("Expected a new address to be ready")
+	}
+	for _, test := range tests {
+		test.step(a, now)
+		if a.backoff != test.backoff {
+			t.Error(test.name+": expected a backoff of", test.backoff, "got", a.backoff)
+		}
+		if test.backoff == 0 {
+			if !a.ready(now) {
+				t.Error(test.name + ": expected the address to be ready")
+			}
+			continue
+		}
+		if a.ready(now) {
+			t.Error(test.name + ": expected the address to back off")
+		}
+		// dropped measures from the current time
+		if !a.ready(time.Now().Add(test.backoff)) {
+			t.Error(test.name+": expected the address to be ready after", test.backoff)
+		}
+	}
+}
+
+// tlsListener listens with a self-signed certificate and reads every connection until the client closes it.
+func tlsListener(t *testing.T) net.Listener {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "server"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "server"}}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(io.Discard, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+// closedAddr returns an address nothing listens on.
+func closedAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+	return addr
+}
+
+func TestDialServerFallback(t *testing.T) {
+	server := tlsListener(t)
+	addrs, err := parseServerAddrs([]string{closedAddr(t), server.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked, fallback := addrs[0], addrs[1]
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := NewProxy(ctx, cancel, &tls.Config{InsecureSkipVerify: true}, addrs, in.NewExposures())
+
+	ok, _ := p.dialServer()
+	if !ok || p.current != 1 || p.serverHost != "127.0.0.1" {
+		t.Fatal("Expected the fallback to be connected, got", ok, p.current, p.serverHost)
+	}
+	if blocked.backoff != MINBACKOFF || blocked.ready(time.Now()) {
+		t.Error("Expected the blocked address to back off, got", blocked.backoff)
+	}
+	if fallback.backoff != 0 {
+		t.Error("Expected the fallback not to back off, got", fallback.backoff)
+	}
+	_ = p.ctrlConn.Close()
+
+	// the address connected last is dialled first, the blocked one isn't tried while it backs off
+	retryAt := blocked.retryAt
+	ok, _ = p.dialServer()
+	if !ok || p.current != 1 || blocked.retryAt != retryAt {
+		t.Fatal("Expected the fallback to be connected again first, got", ok, p.current)
+	}
+	_ = p.ctrlConn.Close()
+
+	// a connection dropped right away counts as failure of the address
+	fallback.dropped(time.Since(p.connectedAt))
+	ok, next := p.dialServer()
+	if ok {
+		t.Fatal("Expected both addresses to back off")
+	}
+	if next != blocked.retryAt || !next.Before(fallback.retryAt) {
+		t.Error("Expected to retry when the first address is ready, got", next, blocked.retryAt, fallback.retryAt)
+	}
+
+	// once the backoff passed, the blocked address fails again and the fallback is dialled after it
+	blocked.retryAt, fallback.retryAt = time.Time{}, time.Time{}
+	p.current = 0
+	ok, _ = p.dialServer()
+	if !ok || p.current != 1 || blocked.backoff != 2*MINBACKOFF {
+		t.Fatal("Expected the fallback after the blocked address, got", ok, p.current, blocked.backoff)
+	}
+	_ = p.ctrlConn.Close()
+
+	// a connection kept for long resets the backoff
+	fallback.dropped(MAXBACKOFF)
+	if fallback.backoff != 0 || !fallback.ready(time.Now()) {
+		t.Error("Expected the backoff to be reset, got", fallback.backoff)
+	}
+}
+
+func TestResumeResult(t *testing.T) {
+	p := &Proxy{resumeToken: "old"}
+	p.resumeResult(in.NewCTRLFrame(in.CTRLRESUME, []string{"malformed"}))
+	if p.resumeToken != "old" {
+		t.Error("Expected a malformed frame to be ignored, got", p.resumeToken)
+	}
+	for _, data := range [][]string{{"token1", "60"}, {"token2", "60", in.RESUMED}, {"token3", "60", in.EXPIRED}} {
+		p.resumeResult(in.NewCTRLFrame(in.CTRLRESUME, data))
+		if p.resumeToken != data[0] {
+			t.Error("Expected the token of the session to be kept, got", p.resumeToken)
+		}
+	}
+}
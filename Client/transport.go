@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+)
+
+// Transport carries the control connection to the server. The client runs the TLS handshake of the control
+// connection on the connection it dials, so the server authenticates the client alike on every transport, except
+// for noise:// addresses, whose Noise handshake takes its place, see noiseHandshake. Ports of
+// a control connection of a transport other than tcp are relayed with transport=inline, as proxy ports and the data
+// port can't be expected to be reachable where the control port isn't.
+//
+// The transport of a server address of the pair command is chosen by its scheme, scheme://host[:port][/path].
+// Addresses without scheme are of the tcp transport. There is no QUIC transport, it is declined as the standard
+// library has none. An application bringing a QUIC implementation registers it with RegisterTransport, dialling a
+// stream per control connection.
+type Transport interface {
+	// Dial connects to the server at the address. config is the TLS config of the control connection, for transports
+	// authenticating the server on their own.
+	Dial(ctx context.Context, addr *url.URL, config *tls.Config) (net.Conn, error)
+}
+
+// transports are the transports by scheme, transportsMu guards them.
+var (
+	transportsMu sync.Mutex
+	transports   = map[string]Transport{
+		"tcp":   tcpTransport{},
+		"wss":   webSocketTransport{},
+		"noise": noiseTransport{},
+	}
+)
+
+// RegisterTransport adds the transport of the scheme, for applications embedding the client. It replaces a transport
+// registered before with the scheme.
+func RegisterTransport(scheme string, transport Transport) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	transports[scheme] = transport
+}
+
+// transportOf returns the transport of the scheme.
+func transportOf(scheme string) (Transport, error) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	transport, ok := transports[scheme]
+	if !ok {
+		return nil, errors.New("unknown transport " + scheme)
+	}
+	return transport, nil
+}
+
+// tcpTransport connects to the control port, through the proxy of -proxy if set. The port defaults to CTRLPORT.
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(ctx context.Context, addr *url.URL, _ *tls.Config) (net.Conn, error) {
+	port := addr.Port()
+	if port == "" {
+		port = CTRLPORT
+	}
+	return dialUpstream(ctx, net.JoinHostPort(addr.Hostname(), port))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	in "Utils"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+	"testing"
+)
+
+// fixedTransport dials the same address whatever the server address is, and records the address it was asked for.
+type fixedTransport struct {
+	target string
+	dialed chan *url.URL
+}
+
+func (f fixedTransport) Dial(ctx context.Context, addr *url.URL, _ *tls.Config) (net.Conn, error) {
+	f.dialed <- addr
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", f.target)
+}
+
+func TestRegisterTransport(t *testing.T) {
+	server := tlsListener(t)
+	transport := fixedTransport{target: server.Addr().String(), dialed: make(chan *url.URL, 1)}
+	RegisterTransport("fixed", transport)
+	t.Cleanup(func() {
+		transportsMu.Lock()
+		delete(transports, "fixed")
+		transportsMu.Unlock()
+	})
+
+	addrs, err := parseServerAddrs([]string{"fixed://server.example.com/tunnel"})
+	if err != nil {
+		t.Fatal("Expected the registered scheme to be known, got", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := NewProxy(ctx, cancel, &tls.Config{InsecureSkipVerify: true}, addrs, in.NewExposures())
+	ok, _ := p.dialServer()
+	if !ok {
+		t.Fatal("Expected to connect through the registered transport")
+	}
+	defer p.ctrlConn.Close()
+	if addr := <-transport.dialed; addr.Host != "server.example.com" || addr.Path != "/tunnel" {
+		t.Error("Expected the transport to get the server address, got", addr)
+	}
+	// the name is kept, as the transport resolves it, and ports are relayed inline
+	if p.serverHost != "server.example.com" || !p.inlineOnly {
+		t.Error("Expected the name of the server and inline relays, got", p.serverHost, p.inlineOnly)
+	}
+}
+
+func TestBuiltinTransports(t *testing.T) {
+	for _, scheme := range []string{"tcp", "wss", "noise"} {
+		if _, err := transportOf(scheme); err != nil {
+			t.Error("Expected the transport", scheme, "got", err)
+		}
+	}
+	if _, err := transportOf("quic"); err == nil {
+		t.Error("Expected no QUIC transport")
+	}
+	addrs, err := parseServerAddrs([]string{"noise://server.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = addrs[0].transport.Dial(context.Background(), addrs[0].addr, nil)
+	if err == nil {
+		t.Error("Expected a Noise address without port to be refused")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+var upstreamProxy = flag.String("proxy", os.Getenv("GOEXPOSE_PROXY"), "Proxy to connect to the server through, http://, https:// or socks5://[user:password@]host:port, or $GOEXPOSE_PROXY")
+
+// parseUpstreamProxy parses the URL of -proxy, nil if it is empty.
+func parseUpstreamProxy(proxy string) (*url.URL, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Hostname() == "" {
+		return nil, errors.New("invalid proxy " + proxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, errors.New("unsupported proxy scheme " + u.Scheme)
+}
+
+// dialUpstream connects to the address of the server, host:port, through the proxy of -proxy, or directly if there
+// is none. Control, data and proxy connections are dialled with it.
+func dialUpstream(ctx context.Context, address string) (net.Conn, error) {
+	proxy, err := parseUpstreamProxy(*upstreamProxy)
+	if err != nil {
+		return nil, err
+	}
+	return dialThroughProxy(ctx, proxy, address)
+}
+
+// dialThroughProxy connects to the address through the proxy, directly if it is nil. The proxy resolves host names,
+// so the client needs no DNS of its own behind it.
+func dialThroughProxy(ctx context.Context, proxy *url.URL, address string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: DIALTIMEOUT}
+	if proxy == nil {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		port := "1080"
+		switch proxy.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), port)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DIALTIMEOUT)
+	}
+	_ = conn.SetDeadline(deadline)
+	if proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+	}
+	if proxy.Scheme == "socks5" || proxy.Scheme == "socks5h" {
+		err = socks5Connect(conn, proxy.User, address)
+	} else {
+		err = httpConnect(conn, proxy.User, address)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.New("proxy " + proxyAddr + ": " + err.Error())
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// httpConnect asks an HTTP proxy for a tunnel to the address with a CONNECT request, with basic authentication if
+// user is set.
+func httpConnect(conn net.Conn, user *url.Userinfo, address string) error {
+	req := "CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n"
+	if user != nil {
+		password, _ := user.Password()
+		req += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)) + "\r\n"
+	}
+	_, err := conn.Write([]byte(req + "\r\n"))
+	if err != nil {
+		return err
+	}
+	// the server sends nothing before the client, so nothing past the response is buffered
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("CONNECT refused: " + resp.Status)
+	}
+	return nil
+}
+
+// socks5Connect asks a SOCKS5 proxy for a connection to the address, RFC 1928, with username and password
+// authentication of RFC 1929 if user is set.
+func socks5Connect(conn net.Conn, user *url.Userinfo, address string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return err
+	}
+	// no authentication, or username and password
+	method := byte(0x00)
+	if user != nil {
+		method = 0x02
+	}
+	_, err = conn.Write([]byte{0x05, 0x01, method})
+	if err != nil {
+		return err
+	}
+	answer := make([]byte, 2)
+	_, err = io.ReadFull(conn, answer)
+	if err != nil {
+		return err
+	}
+	if answer[0] != 0x05 || answer[1] != method {
+		return errors.New("SOCKS5 authentication method refused")
+	}
+	if user != nil {
+		password, _ := user.Password()
+		if len(user.Username()) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 credentials too long")
+		}
+		auth := append([]byte{0x01, byte(len(user.Username()))}, user.Username()...)
+		auth = append(append(auth, byte(len(password))), password...)
+		_, err = conn.Write(auth)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, answer)
+		if err != nil {
+			return err
+		}
+		if answer[1] != 0x00 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	}
+	req := []byte{0x05, 0x01, 0x00}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Unmap().Is4() {
+			req = append(req, 0x01)
+		} else {
+			req = append(req, 0x04)
+		}
+		req = append(req, ip.Unmap().AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return errors.New("SOCKS5 host name too long")
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	_, err = conn.Write(req)
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 4)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[1] != 0x00 {
+		return errors.New("SOCKS5 connect failed with code " + strconv.Itoa(int(reply[1])))
+	}
+	// the bound address and port of the proxy are of no use
+	var skip int
+	switch reply[3] {
+	case 0x01:
+		skip = 4 + 2
+	case 0x04:
+		skip = 16 + 2
+	case 0x03:
+		length := make([]byte, 1)
+		_, err = io.ReadFull(conn, length)
+		if err != nil {
+			return err
+		}
+		skip = int(length[0]) + 2
+	default:
+		return errors.New("malformed SOCKS5 reply")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	in "Utils"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// WEBSOCKETPORT is the port of wss:// server addresses without port.
+const WEBSOCKETPORT = "443"
+
+// webSocketTransport carries the control connection in a WebSocket, for networks that only let HTTPS out. The port
+// defaults to WEBSOCKETPORT and the path to Utils.WEBSOCKETPATH. The connection goes through the proxy of -proxy, or
+// of $HTTPS_PROXY if there is none. The outer TLS connection is authenticated like the control connection inside,
+// by the pinned fingerprint, but without the client certificate, which is presented inside.
+type webSocketTransport struct{}
+
+func (webSocketTransport) Dial(ctx context.Context, addr *url.URL, config *tls.Config) (net.Conn, error) {
+	port, path := addr.Port(), addr.Path
+	if port == "" {
+		port = WEBSOCKETPORT
+	}
+	if path == "" {
+		path = in.WEBSOCKETPATH
+	}
+	target := net.JoinHostPort(addr.Hostname(), port)
+	proxy, err := parseUpstreamProxy(*upstreamProxy)
+	if proxy == nil && err == nil {
+		proxy, err = http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: target}})
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialThroughProxy(ctx, proxy, target)
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(DIALTIMEOUT)
+	}
+	_ = conn.SetDeadline(deadline)
+	outerConfig := config.Clone()
+	outerConfig.GetClientCertificate = nil
+	outerConfig.ServerName = addr.Hostname()
+	outerConfig.NextProtos = []string{"http/1.1"}
+	ws, err := in.ClientWebSocket(tls.Client(conn, outerConfig), target, path)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return ws, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	srv "Server"
+	"Utils"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// runCA runs the ca subcommand, which creates the CA of the server and issues the certificates of the server and
+// the clients, or creates the Noise keys of the server and clients that go without certificates, and returns the
+// exit code:
+//
+//	ca init -hosts example.com,203.0.113.7 [-dir ~/certs] [-days 825] [-force]
+//	ca issue-client -cn name [-ou team] [-dir ~/certs] [-out ./name] [-days 365]
+//	ca noise-key [-out noise.key]
+func runCA(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: ca init|issue-client|noise-key [flags]")
+		return 2
+	}
+	defaultDir, err := srv.DefaultCertDir()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error getting home directory:", err)
+		return 1
+	}
+	flags := flag.NewFlagSet("ca "+args[0], flag.ContinueOnError)
+	dir := flags.String("dir", defaultDir, "Directory of the CA and the server certificate")
+	switch args[0] {
+	case "init":
+		hosts := flags.String("hosts", "", "DNS names and IP addresses clients reach the server by, host,host")
+		days := flags.Int("days", 825, "Days the server certificate is valid")
+		force := flags.Bool("force", false, "Replace an existing CA, the certificates it issued become invalid")
+		if flags.Parse(args[1:]) != nil {
+			return 2
+		}
+		if *hosts == "" {
+			fmt.Fprintln(os.Stderr, "Missing -hosts")
+			return 2
+		}
+		err = srv.InitCA(*dir, strings.Split(*hosts, ","), time.Duration(*days)*24*time.Hour, *force)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating CA:", err)
+			return 1
+		}
+		fmt.Println("Created CA and server certificate in", *dir)
+	case "issue-client":
+		cn := flags.String("cn", "", "Name of the client, the policies of the server are keyed by it")
+		ou := flags.String("ou", "", "Organizational units of the client, one may name its tenant, ou,ou")
+		out := flags.String("out", "", "Directory to write the client certificate to, ./<cn> if empty")
+		days := flags.Int("days", 365, "Days the client certificate is valid")
+		if flags.Parse(args[1:]) != nil {
+			return 2
+		}
+		if *cn == "" {
+			fmt.Fprintln(os.Stderr, "Missing -cn")
+			return 2
+		}
+		if *out == "" {
+			*out = *cn
+		}
+		var ous []string
+		if *ou != "" {
+			ous = strings.Split(*ou, ",")
+		}
+		err = srv.IssueClient(*dir, *out, *cn, ous, time.Duration(*days)*24*time.Hour)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error issuing client certificate:", err)
+			return 1
+		}
+		fmt.Println("Issued client certificate in", *out+", copy", srv.CLIENTCERTFILE, "and", srv.CLIENTKEYFILE,
+			"to ~/certs of the client")
+	case "noise-key":
+		out := flags.String("out", "noise.key", "File to write the private key to")
+		if flags.Parse(args[1:]) != nil {
+			return 2
+		}
+		key, err := Utils.GenerateNoiseKey()
+		if err == nil {
+			err = Utils.WriteNoiseKey(*out, key)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error creating Noise key:", err)
+			return 1
+		}
+		public, _ := Utils.NoisePublicKey(key)
+		fmt.Println("Created Noise key in", *out+", public key", Utils.EncodeNoiseKey(public))
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown ca command", args[0])
+		return 2
+	}
+	return 0
+}
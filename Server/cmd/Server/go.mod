@@ -1,3 +1,3 @@
-module main
+module GoExposeServer
 
 go 1.22
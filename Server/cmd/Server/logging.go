@@ -0,0 +1,96 @@
+package main
+
+import (
+	"Utils"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// Formats and outputs of the log, see -logformat and -logoutput.
+const (
+	LOGTEXT   = "text"
+	LOGJSON   = "json"
+	LOGSTDERR = "stderr"
+	LOGSTDOUT = "stdout"
+)
+
+// newLogWriter returns the writer of the log output: a new file in logpath if output is empty, stderr or stdout, or
+// the file at the path of output, which is appended to. Log files are rotated as set by rotation, server.log in
+// logpath takes the place of a new file then. With console, the log is written to stdout as well.
+func newLogWriter(output string, console bool, rotation Utils.LogRotation) (io.Writer, error) {
+	rotated := rotation != Utils.LogRotation{}
+	var w io.Writer
+	switch output {
+	case "":
+		if !rotated {
+			return Utils.SetupLoggerWriter(logpath, "server", console), nil
+		}
+		err := os.MkdirAll(logpath, 0755)
+		if err != nil {
+			return nil, err
+		}
+		return newLogWriter(filepath.Join(logpath, "server.log"), console, rotation)
+	case LOGSTDOUT, LOGSTDERR:
+		if rotated {
+			return nil, errors.New("log rotation needs a log file, not " + output)
+		}
+		if output == LOGSTDOUT {
+			return os.Stdout, nil
+		}
+		w = os.Stderr
+	default:
+		file, err := Utils.OpenRotatingFile(output, rotation)
+		if err != nil {
+			return nil, err
+		}
+		w = file
+	}
+	if console {
+		return io.MultiWriter(w, os.Stdout), nil
+	}
+	return w, nil
+}
+
+// newLogHandler returns the slog handler of the format writing to w, with the level of level.
+func newLogHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case LOGTEXT:
+		return slog.NewTextHandler(w, opts), nil
+	case LOGJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	default:
+		return nil, errors.New("unknown log format " + format)
+	}
+}
+
+// newAccessLogger returns the logger of the access log written to output, stderr, stdout or a file rotated as set by
+// rotation, in the format of the log. Its records are written whatever the log level, the peer IPs in them are
+// redacted with privacy and salt like in the log.
+func newAccessLogger(output string, format string, rotation Utils.LogRotation, privacy string, salt []byte) (*slog.Logger, error) {
+	w, err := newLogWriter(output, false, rotation)
+	if err != nil {
+		return nil, err
+	}
+	formatted, err := newLogHandler(w, format, slog.LevelInfo)
+	if err != nil {
+		return nil, err
+	}
+	handler, err := Utils.NewRedactingHandler(formatted, privacy, salt)
+	if err != nil {
+		return nil, err
+	}
+	return slog.New(handler), nil
+}
+
+// stepLogLevel makes the log one level more verbose for a negative step, or less verbose for a positive one, between
+// debug and error, and returns the new level.
+func stepLogLevel(level *slog.LevelVar, step int) slog.Level {
+	next := level.Level() + slog.Level(4*step)
+	next = max(slog.LevelDebug, min(slog.LevelError, next))
+	level.Set(next)
+	return next
+}
@@ -2,12 +2,21 @@ package main
 
 import (
 	srv "Server"
+	configfile "Server/config"
+	"Utils"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 const (
@@ -15,7 +24,119 @@ const (
 )
 
 var loglevel = new(slog.LevelVar)
+var configFile = flag.String("config", "", "TOML config file with settings named like these flags, which take precedence, or $GOEXPOSE_CONFIG")
+var validateConfig = flag.Bool("validateconfig", false, "Check the config, the certificate files it names and the port ranges, print every problem and exit, non-zero if there are any")
+var logLevelName = flag.String("loglevel", "info", "Lowest level of the messages logged: debug, info, warn or error")
 var consoleLogging = flag.Bool("consolelog", false, "Enable console logging")
+var logFormat = flag.String("logformat", LOGTEXT, "Format of the log: text or json")
+var logOutput = flag.String("logoutput", "", "Where the log is written: stderr, stdout or a file appended to, a new file in "+logpath+" if empty, or server.log there if rotated")
+var logMaxSize = flag.Int("logmaxsize", 0, "Size in MB at which the log file is rotated, 0 for unlimited")
+var logMaxAge = flag.Int("logmaxage", 0, "Days rotated log files are kept, 0 for unlimited")
+var logMaxBackups = flag.Int("logmaxbackups", 0, "Number of rotated log files kept, 0 for unlimited")
+var logCompress = flag.Bool("logcompress", false, "Compress rotated log files with gzip")
+var accessLogOutput = flag.String("accesslog", "", "Where the access log of relayed connections and UDP sessions is written, a record per connection in the format of the log: stderr, stdout or a file appended to and rotated like the log, disabled if empty")
+var peerPrivacy = flag.String("peerprivacy", Utils.REDACTOFF, "Redaction of external peer IPs in logs: off, truncate or hash")
+var peerSalt = flag.String("peersalt", "", "Salt for hashing peer IPs, a random salt is used if empty")
+var maxUdpSessions = flag.Int("maxudpsessions", srv.DefaultConfig().MaxUdpSessions, "Maximum amount of sessions per UDP relay, 0 for unlimited")
+var maxConns = flag.Int("maxconns", 0, "Maximum amount of relayed connections and UDP sessions of all clients, 0 for unlimited")
+var maxClientConns = flag.Int("maxclientconns", 0, "Maximum amount of relayed connections and UDP sessions per client, 0 for unlimited")
+var connRate = flag.Int("connrate", 0, "Maximum amount of new relayed connections and UDP sessions per second of all ports, 0 for unlimited")
+var connRatePerIP = flag.Int("connrateperip", 0, "Maximum amount of new relayed connections and UDP sessions per second of an external IP, 0 for unlimited")
+var ctrlRate = flag.Int("ctrlrate", 0, "Maximum amount of new control connections per second, 0 for unlimited")
+var ctrlRatePerIP = flag.Int("ctrlrateperip", 0, "Maximum amount of new control connections per second of an IP, 0 for unlimited")
+var handshakeFailures = flag.Int("handshakefailures", 0, "Failed handshakes of control connections of an IP within a minute after which its control connections are refused for the rest of the minute, 0 disables throttling")
+var banThreshold = flag.Int("banthreshold", 0, "Failures of a source IP within -banwindow after which it is banned for -banduration, 0 disables bans")
+var banWindow = flag.Int("banwindow", int(srv.DEFAULTBANWINDOW/time.Second), "Seconds failures of a source IP are counted over for a ban")
+var banDuration = flag.Int("banduration", int(srv.DEFAULTBANDURATION/time.Second), "Seconds a source IP is banned for")
+var plaintextData = flag.Bool("plaintextdata", false, "Disable TLS on proxy connections, only for trusted networks")
+var ctrlPort = flag.Int("ctrlport", srv.CTRLPORT, "Port of the control connections")
+var dataPort = flag.Int("dataport", srv.DATAPORT, "Port of the multiplexed data connections")
+var ctrlAddr = flag.String("ctrladdr", "", "IP address the control port is bound to, all interfaces if empty")
+var dataAddr = flag.String("dataaddr", "", "IP address the data and proxy ports are bound to, that of -ctrladdr if empty")
+var publicAddr = flag.String("publicaddr", "", "IP address the exposed ports are bound to, all interfaces if empty")
+var addressFamily = flag.String("addressfamily", srv.FAMILYDUAL, "Address family the control, data, proxy and exposed ports are bound to: dual, ipv4 or ipv6")
+var geoIPFile = flag.String("geoipfile", "", "MaxMind DB file, e.g. GeoLite2-Country.mmdb, the countries of the allowcountry and denycountry options of exposed ports and of profiles are looked up in")
+var proxyProtocolFrom = flag.String("proxyprotocolfrom", "", "Addresses and prefixes of load balancers whose connections to the exposed ports and the HTTP front start with a PROXY header, addr,prefix")
+var metricsAddr = flag.String("metricsaddr", "", "Address, host:port, of the HTTP listener serving Prometheus metrics on "+srv.METRICSPATH+" and health checks on "+srv.HEALTHPATH+" and "+srv.READYPATH+", disabled if empty")
+var pprofAddr = flag.String("pprofaddr", "", "Loopback address, host:port, of the HTTP listener serving the profiles of net/http/pprof on "+srv.PPROFPATH+", disabled if empty")
+var adminAddr = flag.String("adminaddr", "", "Address, host:port, of the HTTPS listener serving the admin API on "+srv.ADMINPATH+" and as gRPC service "+srv.GRPCSERVICE+", disabled if empty")
+var adminToken = flag.String("admintoken", "", "Bearer token requests to the admin API have to carry, it may do everything")
+var adminKeysFile = flag.String("adminkeys", "", "JSON file with the API keys of the admin API and their roles, [{\"Name\": name, \"Key\": key, \"Role\": \"read\"|\"operator\"|\"admin\"}]")
+var httpAddr = flag.String("httpaddr", "", "Address, host:port, of the HTTP front passing requests on to the clients that exposed a port under their host, disabled if empty")
+var webSocketAddr = flag.String("websocketaddr", "", "Address, host:port, of the HTTPS listener accepting control connections in a WebSocket on "+Utils.WEBSOCKETPATH+" for clients behind restrictive networks, disabled if empty")
+var noiseAddr = flag.String("noiseaddr", "", "Address, host:port, of the listener accepting control connections with a "+Utils.NOISEPROTOCOL+" handshake in place of TLS, for clients authenticated by static key, disabled if empty")
+var noiseKeyFile = flag.String("noisekeyfile", "", "File with the private Noise key of the server, created with ca noise-key")
+var noiseClients = flag.String("noiseclients", "", "Public Noise keys of the clients of -noiseaddr in base64 by the CN the policies are keyed by, cn=key,cn=key")
+var httpsAddr = flag.String("httpsaddr", "", "Address, host:port, of the HTTPS front passing requests on to the clients that exposed a port under their host, disabled if empty")
+var httpCertFile = flag.String("httpcertfile", "", "Certificate of the HTTPS front, e.g. a wildcard certificate of -httpdomains, that of the server if empty")
+var httpKeyFile = flag.String("httpkeyfile", "", "Key of the certificate of the HTTPS front")
+var httpDomains = flag.String("httpdomains", "", "Domains clients may expose ports under subdomains of with host=<hostname>, domain,domain")
+var httpOidcIssuer = flag.String("httpoidcissuer", "", "Issuer URL of the OpenID Connect provider visitors of ports exposed with oidc=<email>|@<domain>|* log in with")
+var httpOidcClientId = flag.String("httpoidcclientid", "", "Client ID of the HTTP front at the OpenID Connect provider")
+var httpOidcClientSecret = flag.String("httpoidcclientsecret", "", "Client secret of the HTTP front at the OpenID Connect provider")
+var httpErrorPage = flag.String("httperrorpage", "", "html/template file of the error pages of the HTTP front, with .Status, .Title, .Message, .Host and .Path")
+var httpCacheSize = flag.Int("httpcachesize", 0, "Memory in MB the HTTP front caches the GET responses of ports exposed with cache=on in, 0 disables the cache")
+var httpAcme = flag.Bool("httpacme", false, "Obtain the certificates of the HTTPS front from the ACME CA of -acmedirectory, with dns-01 a wildcard certificate per domain of -httpdomains, with http-01 one per exposed host")
+var webhooksFile = flag.String("webhooks", "", "JSON file with the webhooks the events of clients and tunnels are posted to, [{\"URL\": url, \"Secret\": secret, \"Kinds\": [kind, ...]}]")
+var otlpEndpoint = flag.String("otlpendpoint", "", "URL of the OTLP/HTTP traces endpoint spans of control operations and relayed connections are sent to, e.g. http://localhost:4318/v1/traces, or $OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+var proxyPorts = flag.String("proxyports", srv.DefaultConfig().ProxyPorts.String(), "Range of the proxy ports, first-last, one is used per exposed port")
+var exposedPorts = flag.String("exposedports", srv.DefaultConfig().ExposedPorts.String(), "Range of the ports clients may expose, first-last")
+var anyPorts = flag.String("anyports", srv.DefaultConfig().AnyPorts.String(), "Range the public ports of clients exposing with public=any are chosen from randomly, first-last")
+var randomPorts = flag.Bool("randomports", false, "Assign proxy ports in random order instead of sequentially")
+var defaultQuota = flag.String("quota", srv.DefaultConfig().DefaultQuota.String(), "Maximum amount of exposed ports per client, tcp/udp, 0 for unlimited")
+var clientQuotas = flag.String("clientquotas", "", "Quotas of single clients by certificate CN, cn=tcp/udp,cn=tcp/udp")
+var deniedPorts = flag.String("deniedports", "", "Ports that are never exposed nor used as proxy ports, first-last,port,...")
+var reservedPorts = flag.String("reservedports", "", "Ports only the client with the certificate CN may expose, port=cn,port=cn")
+var privilegedClients = flag.String("privilegedclients", "", "Certificate CNs of the clients that may expose ports up to 1023 if exposedports includes them, cn,cn")
+var egressClients = flag.String("egressclients", "", "Certificate CNs of the clients that may reach the network of the server through their tunnel, cn,cn")
+var egressNetworks = flag.String("egressnetworks", "", "Addresses and prefixes egress clients may connect to, any if empty, addr,prefix")
+var profilesFile = flag.String("profiles", "", "JSON file with the profiles of single clients: allowed public ports, UDP, bandwidth caps and quota by certificate CN")
+var caFile = flag.String("cafile", "", "PEM file of the CA client certificates are verified with, ~/certs/myCA.pem if empty, or $GOEXPOSE_CA_FILE")
+var certFile = flag.String("certfile", "", "Certificate of the server, ~/certs/server.crt if empty, or $GOEXPOSE_CERT_FILE")
+var keyFile = flag.String("keyfile", "", "Key of the server, ~/certs/server.key if empty, or $GOEXPOSE_KEY_FILE")
+var caKeyFile = flag.String("cakeyfile", "", "Key of the CA, lets clients renew their certificates over the control connection if set")
+var clientCertDays = flag.Int("clientcertdays", 365, "Days renewed client certificates are valid")
+var systemCAs = flag.Bool("systemcas", false, "Accept client certificates issued by the CAs of the system as well, cafile is then only read if set, or $GOEXPOSE_SYSTEM_CAS")
+var tokensFile = flag.String("tokens", "", "JSON file with pre-shared tokens clients without certificate may authenticate with, [{\"CN\": cn, \"Token\": token}]")
+var jwtSecretFile = flag.String("jwtsecret", "", "File with the secret of HS256 JWTs clients without certificate may authenticate with")
+var jwtPublicKey = flag.String("jwtpublickey", "", "PEM file with the public key of ES256 or RS256 JWTs clients without certificate may authenticate with")
+var jwtIssuer = flag.String("jwtissuer", "", "Issuer JWTs have to be from, if set")
+var jwtAudience = flag.String("jwtaudience", "", "Audience JWTs have to be for, if set")
+var tlsMinVersion = flag.String("tlsmin", "1.2", "Lowest TLS version of control and data connections, 1.2 or 1.3")
+var cipherSuites = flag.String("ciphersuites", "", "TLS 1.2 cipher suites to allow, by Go name, suite,suite, all secure ones if empty")
+var ctrlALPN = flag.String("ctrlalpn", "", "ALPN protocol IDs of control connections, id,id")
+var dataALPN = flag.String("dataalpn", "", "ALPN protocol IDs of data connections, id,id")
+var clientFingerprints = flag.String("clientfingerprints", "", "JSON file with the SHA-256 fingerprints of the only client certificates to accept")
+var crlFile = flag.String("crlfile", "", "CRL of the CA in PEM or DER, client certificates it lists are refused, reloaded on SIGHUP")
+var ocspResponder = flag.String("ocspresponder", "", "URL of the OCSP responder client certificates are checked with")
+var ocspSoftFail = flag.Bool("ocspsoftfail", false, "Accept clients if the OCSP responder can't be asked, instead of refusing them")
+var acmeDomains = flag.String("acmedomains", "", "Obtain the server certificate for these domains from an ACME CA and renew it, instead of certfile and keyfile, domain,domain")
+var acmeDirectory = flag.String("acmedirectory", srv.LETSENCRYPTDIRECTORY, "Directory URL of the ACME CA")
+var acmeEmail = flag.String("acmeemail", "", "Contact email of the ACME account")
+var acmeDir = flag.String("acmedir", "", "Directory the ACME account key and certificate are kept in, ~/certs/acme if empty")
+var acmeChallenge = flag.String("acmechallenge", srv.ACMEHTTP01, "ACME challenge: http-01, answered on acmehttpport, or dns-01, answered by acmednshook")
+var acmeHttpPort = flag.Int("acmehttpport", srv.ACMEHTTPPORT, "Port of the web server answering ACME HTTP-01 challenges")
+var acmeDnsHook = flag.String("acmednshook", "", "Command setting the TXT records of ACME DNS-01 challenges, run as hook present|cleanup name value")
+var authzFile = flag.String("authz", "", "JSON file with the rules allowing or denying clients public ports and networks, first match decides")
+var tenantsFile = flag.String("tenants", "", "JSON file with the tenants grouping clients by certificate OU or profile, with ports, proxy ports, quota, bandwidth and connection limits of their own")
+var duplicateSessions = flag.String("duplicatesessions", srv.DUPLICATEALLOW, "Policy for a client connecting while its old session is alive: allow, refuse, or replace to take over its ports")
+var resumeGrace = flag.Int("resumegrace", 0, "Seconds a client can resume its session after losing the control connection, keeping its exposed ports and connections, 0 disables resumption")
+var historyFile = flag.String("historyfile", "", "File to save the per minute and per hour traffic history of the exposed ports in, so it survives a restart")
+var assignmentsFile = flag.String("assignments", "", "File to save the public ports assigned to clients in, so they get them back after a restart")
+var storeFile = flag.String("store", "", "File of the store keeping the changes of the admin API, the port assignments and the traffic history, in place of -assignments and -historyfile")
+var storeDriver = flag.String("storedriver", srv.DefaultConfig().StoreDriver, "Driver of the store, one of "+strings.Join(srv.StoreDrivers(), ", "))
+var portLease = flag.Int("portlease", int(srv.DEFAULTPORTLEASE/time.Second), "Seconds after which exposed ports the client doesn't renew are hidden, 0 disables leases")
+
+// envFlags are the environment variables of the flags not named GOEXPOSE_ and the flag in upper case, see
+// configfile.EnvName. Every flag can be set by its environment variable, which takes precedence over the config file.
+var envFlags = map[string]string{
+	"cafile":    "GOEXPOSE_CA_FILE",
+	"certfile":  "GOEXPOSE_CERT_FILE",
+	"keyfile":   "GOEXPOSE_KEY_FILE",
+	"systemcas": "GOEXPOSE_SYSTEM_CAS",
+	// the variable of the OpenTelemetry SDKs
+	"otlpendpoint": "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT",
+}
 
 /*
 	STATUS:
@@ -23,11 +144,57 @@ var consoleLogging = flag.Bool("consolelog", false, "Enable console logging")
 */
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		os.Exit(runCA(os.Args[2:]))
+	}
+	err := configfile.Flags(flag.CommandLine, os.Args[1:], envFlags, "config")
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		panic(err)
+	}
+	if *validateConfig {
+		os.Exit(checkConfig())
+	}
+
 	// Setup logger
-	writer := Utils.SetupLoggerWriter(logpath, "server", *consoleLogging)
-	logger := slog.New(slog.NewTextHandler(writer, &slog.HandlerOptions{
-		Level: loglevel,
-	}))
+	err = loglevel.UnmarshalText([]byte(*logLevelName))
+	if err != nil {
+		panic(err)
+	}
+	rotation := Utils.LogRotation{
+		MaxSize:    int64(*logMaxSize) << 20,
+		MaxAge:     time.Duration(*logMaxAge) * 24 * time.Hour,
+		MaxBackups: *logMaxBackups,
+		Compress:   *logCompress,
+	}
+	writer, err := newLogWriter(*logOutput, *consoleLogging, rotation)
+	if err != nil {
+		panic(err)
+	}
+	salt := []byte(*peerSalt)
+	if len(salt) == 0 {
+		// hashes are only stable for the lifetime of the process without a configured salt
+		salt = make([]byte, 32)
+		_, _ = rand.Read(salt)
+	}
+	formatted, err := newLogHandler(writer, *logFormat, loglevel)
+	if err != nil {
+		panic(err)
+	}
+	handler, err := Utils.NewRedactingHandler(formatted, *peerPrivacy, salt)
+	if err != nil {
+		panic(err)
+	}
+	logger := slog.New(handler)
+	var accessLog *slog.Logger
+	if *accessLogOutput != "" {
+		accessLog, err = newAccessLogger(*accessLogOutput, *logFormat, rotation, *peerPrivacy, salt)
+		if err != nil {
+			panic(err)
+		}
+	}
 
 	// GoExpose Server uses a root context to manage shutting down all goroutines
 	ctx, cancel := context.WithCancel(context.Background())
@@ -36,19 +203,270 @@ func main() {
 
 	// Start the server
 	logger.Info("Starting server", "Func", "main")
+	config, err := buildConfig()
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		panic(err)
+	}
 	server := srv.Server{
-		Logger: logger,
+		Config:    config,
+		Logger:    logger,
+		LogLevel:  loglevel,
+		AccessLog: accessLog,
 	}
-	go server.Run(ctx)
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		server.Run(ctx)
+	}()
 
-	// Wait for signals or context termination
-	select {
-	case <-signals:
-		logger.Info("Received SIGINT/SIGTERM. Closing context and waiting for srv to stop...", "Func", "main")
-		cancel()
-		break
-	case <-ctx.Done():
-		break
+	// Wait for signals or context termination, SIGHUP reloads the config and the certificates, see levelSignals for
+	// those changing the log level
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	levels := make(chan os.Signal, 1)
+	for sig := range levelSignals {
+		signal.Notify(levels, sig)
 	}
+	for running := true; running; {
+		select {
+		case <-reload:
+			logger.Info("Received SIGHUP. Reloading config and certificates...", "Func", "main")
+			err := reloadConfig(&server, logger)
+			if err != nil {
+				logger.Error("Error reloading config", "Func", "main", "Error", err)
+			}
+		case sig := <-levels:
+			level := stepLogLevel(loglevel, levelSignals[sig])
+			logger.Log(ctx, max(level, slog.LevelInfo), "Changed log level", "Func", "main", "Level", level.String())
+		case <-signals:
+			logger.Info("Received SIGINT/SIGTERM. Closing context and waiting for srv to stop...", "Func", "main")
+			cancel()
+			running = false
+		case <-ctx.Done():
+			running = false
+		}
+	}
+	// Run saves the traffic history once its clients are gone
+	<-stopped
 	logger.Info("Server stopped", "Func", "main")
 }
+
+// buildConfig builds the config of the server from the flags, it is not validated yet.
+func buildConfig() (srv.Config, error) {
+	var err error
+	config := srv.DefaultConfig()
+	config.MaxUdpSessions = *maxUdpSessions
+	config.MaxConns = *maxConns
+	config.MaxClientConns = *maxClientConns
+	config.ConnRate = *connRate
+	config.ConnRatePerIP = *connRatePerIP
+	config.CtrlRate = *ctrlRate
+	config.CtrlRatePerIP = *ctrlRatePerIP
+	config.HandshakeFailures = *handshakeFailures
+	config.BanThreshold = *banThreshold
+	config.BanWindow = time.Duration(*banWindow) * time.Second
+	config.BanDuration = time.Duration(*banDuration) * time.Second
+	config.PlaintextData = *plaintextData
+	config.CtrlPort = *ctrlPort
+	config.DataPort = *dataPort
+	config.CtrlAddr = *ctrlAddr
+	config.DataAddr = *dataAddr
+	config.PublicAddr = *publicAddr
+	config.AddressFamily = *addressFamily
+	if *proxyProtocolFrom != "" {
+		config.ProxyProtocolFrom = strings.Split(*proxyProtocolFrom, ",")
+	}
+	config.GeoIPFile = *geoIPFile
+	config.MetricsAddr = *metricsAddr
+	config.PprofAddr = *pprofAddr
+	config.OTLPEndpoint = *otlpEndpoint
+	config.AdminAddr = *adminAddr
+	config.WebSocketAddr = *webSocketAddr
+	config.NoiseAddr = *noiseAddr
+	config.NoiseKeyFile = *noiseKeyFile
+	config.NoiseClients, err = srv.ParseNoiseClients(*noiseClients)
+	if err != nil {
+		return config, err
+	}
+	config.AdminToken = *adminToken
+	config.HTTPAddr = *httpAddr
+	config.HTTPSAddr = *httpsAddr
+	config.HTTPCertFile = *httpCertFile
+	config.HTTPKeyFile = *httpKeyFile
+	if *httpDomains != "" {
+		config.HTTPDomains = strings.Split(*httpDomains, ",")
+	}
+	config.HTTPACME = *httpAcme
+	config.HTTPOIDC = srv.OIDCConfig{Issuer: *httpOidcIssuer, ClientID: *httpOidcClientId, ClientSecret: *httpOidcClientSecret}
+	config.HTTPErrorPage = *httpErrorPage
+	config.HTTPCacheSize = *httpCacheSize
+	config.ProxyPorts, err = srv.ParsePortRange(*proxyPorts)
+	if err != nil {
+		return config, err
+	}
+	config.ExposedPorts, err = srv.ParsePortRange(*exposedPorts)
+	if err != nil {
+		return config, err
+	}
+	config.PortLease = time.Duration(*portLease) * time.Second
+	config.DefaultQuota, err = srv.ParseQuota(*defaultQuota)
+	if err != nil {
+		return config, err
+	}
+	config.ClientQuotas, err = srv.ParseClientQuotas(*clientQuotas)
+	if err != nil {
+		return config, err
+	}
+	config.AssignmentsFile = *assignmentsFile
+	config.HistoryFile = *historyFile
+	config.StoreDriver = *storeDriver
+	config.StoreFile = *storeFile
+	config.DeniedPorts, err = srv.ParsePortRanges(*deniedPorts)
+	if err != nil {
+		return config, err
+	}
+	config.ReservedPorts, err = srv.ParseReservedPorts(*reservedPorts)
+	if err != nil {
+		return config, err
+	}
+	if *egressClients != "" {
+		config.EgressClients = strings.Split(*egressClients, ",")
+	}
+	if *egressNetworks != "" {
+		config.EgressNetworks = strings.Split(*egressNetworks, ",")
+	}
+	config.PrivilegedClients, err = srv.ParsePrivilegedClients(*privilegedClients)
+	if err != nil {
+		return config, err
+	}
+	config.Profiles, err = srv.LoadProfiles(*profilesFile)
+	if err != nil {
+		return config, err
+	}
+	config.AuthzRules, err = srv.LoadAuthzRules(*authzFile)
+	if err != nil {
+		return config, err
+	}
+	config.Tenants, err = srv.LoadTenants(*tenantsFile)
+	if err != nil {
+		return config, err
+	}
+	config.CAFile = *caFile
+	config.CertFile = *certFile
+	config.CAKeyFile = *caKeyFile
+	config.ClientCertValidity = time.Duration(*clientCertDays) * 24 * time.Hour
+	config.KeyFile = *keyFile
+	config.SystemCAs = *systemCAs
+	config.AdminKeys, err = srv.LoadAdminKeys(*adminKeysFile)
+	if err != nil {
+		return config, err
+	}
+	config.Webhooks, err = srv.LoadWebhooks(*webhooksFile)
+	if err != nil {
+		return config, err
+	}
+	config.AuthTokens, err = srv.LoadTokens(*tokensFile)
+	if err != nil {
+		return config, err
+	}
+	if *jwtSecretFile != "" {
+		secret, err := os.ReadFile(*jwtSecretFile)
+		if err != nil {
+			return config, err
+		}
+		config.JWT.Secret = bytes.TrimSpace(secret)
+	}
+	if *jwtPublicKey != "" {
+		config.JWT.PublicKey, err = srv.LoadJWTPublicKey(*jwtPublicKey)
+		if err != nil {
+			return config, err
+		}
+	}
+	config.JWT.Issuer = *jwtIssuer
+	config.JWT.Audience = *jwtAudience
+	config.TLSMinVersion, err = srv.ParseTLSVersion(*tlsMinVersion)
+	if err != nil {
+		return config, err
+	}
+	config.CipherSuites, err = srv.ParseCipherSuites(*cipherSuites)
+	if err != nil {
+		return config, err
+	}
+	config.CtrlALPN = srv.ParseALPN(*ctrlALPN)
+	config.DataALPN = srv.ParseALPN(*dataALPN)
+	config.ClientFingerprints, err = srv.LoadFingerprints(*clientFingerprints)
+	if err != nil {
+		return config, err
+	}
+	config.CRLFile = *crlFile
+	config.OCSPResponder = *ocspResponder
+	config.OCSPSoftFail = *ocspSoftFail
+	if *acmeDomains != "" {
+		config.ACME.Domains = strings.Split(*acmeDomains, ",")
+	}
+	config.ACME.Directory = *acmeDirectory
+	config.ACME.Email = *acmeEmail
+	config.ACME.Dir = *acmeDir
+	config.ACME.Challenge = *acmeChallenge
+	config.ACME.HTTPPort = *acmeHttpPort
+	config.ACME.DNSHook = *acmeDnsHook
+	config.AnyPorts, err = srv.ParsePortRange(*anyPorts)
+	if err != nil {
+		return config, err
+	}
+	config.RandomPorts = *randomPorts
+	config.DuplicateSessions = *duplicateSessions
+	config.ResumeGrace = time.Duration(*resumeGrace) * time.Second
+	return config, nil
+}
+
+// checkConfig prints the problems of the config to stderr and returns the exit status, 1 if there are any.
+func checkConfig() int {
+	config, err := buildConfig()
+	errs := []error{err}
+	if err == nil {
+		errs = config.Check()
+	}
+	status := 0
+	for _, err := range errs {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "config: "+err.Error())
+			status = 1
+		}
+	}
+	if status == 0 {
+		fmt.Println("config ok")
+	}
+	return status
+}
+
+// reloadConfig reads the flags, their environment variables and the config file again and applies the log level and
+// the config to the running server. Settings that need a restart are logged and otherwise ignored.
+func reloadConfig(server *srv.Server, logger *slog.Logger) error {
+	logging := []string{strconv.FormatBool(*consoleLogging), *logFormat, *logOutput, strconv.Itoa(*logMaxSize),
+		strconv.Itoa(*logMaxAge), strconv.Itoa(*logMaxBackups), strconv.FormatBool(*logCompress), *accessLogOutput, *peerPrivacy,
+		*peerSalt}
+	err := configfile.Flags(flag.CommandLine, os.Args[1:], envFlags, "config")
+	if err != nil {
+		return err
+	}
+	for i, name := range []string{"consolelog", "logformat", "logoutput", "logmaxsize", "logmaxage", "logmaxbackups", "logcompress",
+		"accesslog", "peerprivacy", "peersalt"} {
+		if flag.Lookup(name).Value.String() != logging[i] {
+			logger.Warn("Setting changed, it takes effect after a restart", "Func", "reloadConfig", "Setting", name)
+		}
+	}
+	err = loglevel.UnmarshalText([]byte(*logLevelName))
+	if err != nil {
+		return err
+	}
+	config, err := buildConfig()
+	if err != nil {
+		return err
+	}
+	_, err = server.ReloadConfig(config)
+	return err
+}
@@ -1 +1,95 @@
 package main
+
+import (
+	srv "Server"
+	configfile "Server/config"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	handler, err := newLogHandler(&buf, LOGJSON, slog.LevelInfo)
+	if err != nil {
+		t.Fatal("Expected the JSON format to be known", err)
+	}
+	logger := slog.New(handler)
+	logger.Debug("hidden")
+	logger.Info("shown", "Func", "test")
+	var record map[string]any
+	err = json.Unmarshal(buf.Bytes(), &record)
+	if err != nil || record["msg"] != "shown" || record["Func"] != "test" {
+		t.Error("Expected a single JSON record, got", buf.String(), err)
+	}
+	_, err = newLogHandler(&buf, "xml", slog.LevelInfo)
+	if err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestStepLogLevel(t *testing.T) {
+	level := new(slog.LevelVar)
+	if stepLogLevel(level, -1) != slog.LevelDebug || stepLogLevel(level, -1) != slog.LevelDebug {
+		t.Error("Expected the level to stop at debug")
+	}
+	stepLogLevel(level, 1)
+	stepLogLevel(level, 1)
+	if stepLogLevel(level, 1) != slog.LevelError || stepLogLevel(level, 1) != slog.LevelError {
+		t.Error("Expected the level to stop at error")
+	}
+}
+
+func TestReloadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goexpose.toml")
+	write := func(content string) {
+		err := os.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the flags of the command line again, once the config file is gone from the environment
+	t.Cleanup(func() {
+		_ = configfile.Flags(flag.CommandLine, os.Args[1:], envFlags, "config")
+		loglevel.Set(slog.LevelInfo)
+	})
+	t.Setenv("GOEXPOSE_CONFIG", path)
+
+	write("maxconns = 10\nmaxclientconns = 5\n")
+	err := configfile.Flags(flag.CommandLine, os.Args[1:], envFlags, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := buildConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	server := srv.Server{Config: config, Logger: logger, LogLevel: loglevel}
+
+	write("maxconns = 20\nmaxclientconns = 2\nloglevel = \"debug\"\n")
+	err = reloadConfig(&server, logger)
+	if err != nil {
+		t.Fatal("Error reloading the changed file", err)
+	}
+	if settings := server.Settings(); settings.MaxConns != 20 || settings.MaxClientConns != 2 || settings.LogLevel != "debug" {
+		t.Error("Expected the settings of the changed file, got", settings)
+	}
+
+	// a file that can't be applied leaves the config in effect
+	for _, invalid := range []string{"maxconns = 30\nexposedports = \"9000-100\"\n", "maxconns = 30\nmaxconz = 1\n", "maxconns = \"many\"\n"} {
+		write(invalid)
+		err = reloadConfig(&server, logger)
+		if err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+		if settings := server.Settings(); settings.MaxConns != 20 || settings.MaxClientConns != 2 {
+			t.Errorf("Expected the config in effect to be kept after %q, got %v", invalid, settings)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// levelSignals change the log level of the running server by the step of the signal, there are none on systems
+// without SIGUSR1 and SIGUSR2.
+var levelSignals = map[os.Signal]int{}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// levelSignals change the log level of the running server by the step of the signal, see stepLogLevel. SIGUSR1
+// makes the log more verbose, SIGUSR2 less, SIGHUP restores -loglevel.
+var levelSignals = map[os.Signal]int{
+	syscall.SIGUSR1: -1,
+	syscall.SIGUSR2: 1,
+}
@@ -0,0 +1,3 @@
+module goexposectl
+
+go 1.22
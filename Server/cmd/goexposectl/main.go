@@ -0,0 +1,284 @@
+// goexposectl manages a running server through its admin API, see the -adminaddr flag of the server:
+//
+//	goexposectl [flags] clients                          lists the connected clients
+//	goexposectl [flags] tunnels                          lists the exposed ports of all clients
+//	goexposectl [flags] kick <client>                    disconnects the client
+//	goexposectl [flags] hide <client> [tcp/|udp/]<port>  hides the exposed port of the client
+//
+// kick and hide tell the client the reason given with -reason.
+// A client is named by its ID or, if only one of them is connected, by its certificate CN.
+package main
+
+import (
+	srv "Server"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var addr = flag.String("addr", envOr("GOEXPOSE_ADMIN_ADDR", "localhost:8443"), "Address, host:port, of the admin API of the server, or $GOEXPOSE_ADMIN_ADDR")
+var token = flag.String("token", os.Getenv("GOEXPOSE_ADMIN_TOKEN"), "Admin token of the server, or $GOEXPOSE_ADMIN_TOKEN")
+var caFile = flag.String("cafile", "", "CA certificate the certificate of the server is verified with, "+srv.CAFILE+" in the certs directory if empty")
+var serverName = flag.String("servername", "", "Name the certificate of the server is verified for, the host of -addr if empty")
+var jsonOutput = flag.Bool("json", false, "Print JSON instead of tables")
+var reason = flag.String("reason", "", "Reason told to the client by kick and hide, a default of the server if empty")
+
+func envOr(key string, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: goexposectl [flags] clients|tunnels|kick <client>|hide <client> [tcp/|udp/]<port>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	os.Exit(run(flag.Args(), os.Stdout))
+}
+
+// run runs the command and returns the exit code.
+func run(args []string, out io.Writer) int {
+	if len(args) == 0 {
+		flag.Usage()
+		return 2
+	}
+	if *token == "" {
+		fmt.Fprintln(os.Stderr, "Missing -token")
+		return 2
+	}
+	api, err := newAdminAPI(*addr, *token, *caFile, *serverName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	switch {
+	case args[0] == "clients" && len(args) == 1:
+		err = api.printClients(out, *jsonOutput)
+	case args[0] == "tunnels" && len(args) == 1:
+		err = api.printTunnels(out, *jsonOutput)
+	case args[0] == "kick" && len(args) == 2:
+		err = api.kick(args[1], *reason)
+		if err == nil {
+			fmt.Fprintln(out, "Disconnected client", args[1])
+		}
+	case args[0] == "hide" && len(args) == 3:
+		err = api.hide(args[1], args[2], *reason)
+		if err == nil {
+			fmt.Fprintln(out, "Hid port", args[2], "of client", args[1])
+		}
+	default:
+		flag.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// adminAPI calls the REST admin API of a server, see srv.ADMINPATH.
+type adminAPI struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// newAdminAPI returns the admin API at the address, verifying the certificate of the server with the CA of the file.
+func newAdminAPI(addr string, token string, caFile string, serverName string) (*adminAPI, error) {
+	if caFile == "" {
+		dir, err := srv.DefaultCertDir()
+		if err != nil {
+			return nil, err
+		}
+		caFile = filepath.Join(dir, srv.CAFILE)
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate in " + caFile)
+	}
+	if serverName == "" {
+		serverName, _, err = net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: serverName, MinVersion: tls.VersionTLS12}}
+	return &adminAPI{
+		base:   "https://" + addr + srv.ADMINPATH,
+		token:  token,
+		client: &http.Client{Transport: transport, Timeout: 10 * time.Second},
+	}, nil
+}
+
+// call sends a request to the path below srv.ADMINPATH and decodes the answer into v, if not nil.
+func (a *adminAPI) call(method string, path string, v any) error {
+	req, err := http.NewRequest(method, a.base+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var answer struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&answer) != nil || answer.Error == "" {
+			return errors.New(resp.Status)
+		}
+		return errors.New(answer.Error)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (a *adminAPI) clients() ([]srv.AdminClient, error) {
+	var clients []srv.AdminClient
+	err := a.call(http.MethodGet, "clients", &clients)
+	return clients, err
+}
+
+// resolve returns the ID of the client named by its ID or its certificate CN.
+func (a *adminAPI) resolve(client string) (uint64, error) {
+	clients, err := a.clients()
+	if err != nil {
+		return 0, err
+	}
+	id, idErr := strconv.ParseUint(client, 10, 64)
+	var found []uint64
+	for _, c := range clients {
+		if (idErr == nil && c.ID == id) || c.CN == client {
+			found = append(found, c.ID)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return 0, errors.New("no client " + client + " connected")
+	case 1:
+		return found[0], nil
+	default:
+		return 0, errors.New(strconv.Itoa(len(found)) + " clients " + client + " connected, name one by its ID")
+	}
+}
+
+// kick disconnects the client, telling it the reason if not empty.
+func (a *adminAPI) kick(client string, reason string) error {
+	id, err := a.resolve(client)
+	if err != nil {
+		return err
+	}
+	return a.call(http.MethodDelete, "clients/"+strconv.FormatUint(id, 10)+reasonQuery(reason), nil)
+}
+
+// hide hides the port, given as port, tcp/port or udp/port, of the client, telling it the reason if not empty.
+func (a *adminAPI) hide(client string, port string, reason string) error {
+	network, p, found := strings.Cut(port, "/")
+	if !found {
+		network, p = "tcp", port
+	}
+	if _, err := strconv.Atoi(p); err != nil || (network != "tcp" && network != "udp") {
+		return errors.New("invalid port " + port + ", expected port, tcp/port or udp/port")
+	}
+	id, err := a.resolve(client)
+	if err != nil {
+		return err
+	}
+	return a.call(http.MethodDelete, "clients/"+strconv.FormatUint(id, 10)+"/tunnels/"+network+"/"+p+reasonQuery(reason), nil)
+}
+
+func reasonQuery(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return "?reason=" + url.QueryEscape(reason)
+}
+
+func (a *adminAPI) printClients(out io.Writer, asJSON bool) error {
+	clients, err := a.clients()
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(out, clients)
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tCN\tTENANT\tADDRESS\tCONNECTED\tSTATE\tTUNNELS")
+	for _, c := range clients {
+		state := "connected"
+		if c.Suspended {
+			state = "suspended"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%d\n", c.ID, c.CN, orDash(c.Tenant), c.Address,
+			c.Connected.Local().Format(time.DateTime), state, len(c.Tunnels))
+	}
+	return w.Flush()
+}
+
+// tunnelRow is an exposed port with the client exposing it, for the JSON output of tunnels.
+type tunnelRow struct {
+	ClientID uint64 `json:"clientId"`
+	CN       string `json:"cn"`
+	srv.AdminTunnel
+}
+
+func (a *adminAPI) printTunnels(out io.Writer, asJSON bool) error {
+	clients, err := a.clients()
+	if err != nil {
+		return err
+	}
+	rows := []tunnelRow{}
+	for _, c := range clients {
+		for _, t := range c.Tunnels {
+			rows = append(rows, tunnelRow{ClientID: c.ID, CN: c.CN, AdminTunnel: t})
+		}
+	}
+	if asJSON {
+		return printJSON(out, rows)
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT\tCN\tPORT\tPUBLIC\tNAME\tACTIVE\tACCEPTED\tBYTES IN\tBYTES OUT")
+	for _, r := range rows {
+		fmt.Fprintf(w, "%d\t%s\t%s/%d\t%d\t%s\t%d\t%d\t%d\t%d\n", r.ClientID, r.CN, r.Network, r.Port, r.PublicPort,
+			orDash(r.Name), r.ActiveConns, r.Accepted, r.BytesIn, r.BytesOut)
+	}
+	return w.Flush()
+}
+
+func printJSON(out io.Writer, v any) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
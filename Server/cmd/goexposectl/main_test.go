@@ -0,0 +1,94 @@
+package main
+
+import (
+	srv "Server"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeAdminAPI serves the clients on the admin API and records the DELETE requests.
+func fakeAdminAPI(t *testing.T, clients []srv.AdminClient) (*adminAPI, *[]string) {
+	var deleted []string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == srv.ADMINPATH+"clients":
+			_ = json.NewEncoder(w).Encode(clients)
+		case r.Method == http.MethodDelete && strings.HasSuffix(r.URL.Path, "/tunnels/tcp/9999"):
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"port not exposed"}`))
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, strings.TrimPrefix(r.URL.RequestURI(), srv.ADMINPATH))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return &adminAPI{base: ts.URL + srv.ADMINPATH, token: "secret", client: ts.Client()}, &deleted
+}
+
+func TestKickAndHide(t *testing.T) {
+	api, deleted := fakeAdminAPI(t, []srv.AdminClient{{ID: 1, CN: "alice"}, {ID: 2, CN: "bob"}, {ID: 3, CN: "bob"}})
+	err := api.kick("alice", "")
+	if err != nil {
+		t.Error("Expected alice to be kicked by CN", err)
+	}
+	err = api.kick("bob", "")
+	if err == nil {
+		t.Error("Expected an error for a CN of two clients")
+	}
+	err = api.kick("3", "maintenance window")
+	if err != nil {
+		t.Error("Expected a client to be kicked by ID", err)
+	}
+	err = api.hide("alice", "udp/5353", "")
+	if err != nil {
+		t.Error("Expected the UDP port to be hidden", err)
+	}
+	err = api.hide("alice", "sctp/80", "")
+	if err == nil {
+		t.Error("Expected an error for an unknown network")
+	}
+	err = api.hide("alice", "9999", "")
+	if err == nil || err.Error() != "port not exposed" {
+		t.Error("Expected the error of the server, got", err)
+	}
+	expected := []string{"clients/1", "clients/3?reason=maintenance+window", "clients/1/tunnels/udp/5353"}
+	if strings.Join(*deleted, " ") != strings.Join(expected, " ") {
+		t.Error("Expected the requests", expected, "got", *deleted)
+	}
+
+	api.token = "wrong"
+	err = api.kick("alice", "")
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Error("Expected the status for an answer without error, got", err)
+	}
+}
+
+func TestPrintTunnels(t *testing.T) {
+	api, _ := fakeAdminAPI(t, []srv.AdminClient{{ID: 1, CN: "alice", Tunnels: []srv.AdminTunnel{
+		{Network: "tcp", Port: 8080, PublicPort: 28080, Name: "web", BytesIn: 10},
+		{Network: "udp", Port: 53, PublicPort: 53},
+	}}})
+	var out bytes.Buffer
+	err := api.printTunnels(&out, false)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if err != nil || len(lines) != 3 || !strings.Contains(lines[1], "tcp/8080") || !strings.Contains(lines[2], "udp/53") {
+		t.Error("Expected a header and a row per tunnel, got", out.String(), err)
+	}
+
+	out.Reset()
+	err = api.printTunnels(&out, true)
+	var rows []map[string]any
+	if err != nil || json.Unmarshal(out.Bytes(), &rows) != nil || len(rows) != 2 || rows[0]["cn"] != "alice" || rows[0]["publicPort"] != 28080.0 {
+		t.Error("Expected the tunnels with their client as JSON, got", out.String(), err)
+	}
+}
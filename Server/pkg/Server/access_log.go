@@ -0,0 +1,57 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// Reasons a relayed connection or UDP session ended, as written to the access log, see Server.AccessLog.
+const (
+	// CLOSEDONE is a connection both sides finished sending on, or a UDP session the client ended
+	CLOSEDONE = "done"
+	// CLOSEERROR is a connection or session that failed relaying data
+	CLOSEERROR = "error"
+	// CLOSESTOPPED is a connection or session closed as its port was hidden or the client disconnected
+	CLOSESTOPPED = "stopped"
+	// CLOSESTUCK is a connection closed by the stuck connection detector
+	CLOSESTUCK = "stuck"
+	// CLOSEUNPAIRED is a connection or session the client provided no proxy connection for
+	CLOSEUNPAIRED = "unpaired"
+	// CLOSEREJECTED is a connection refused because a connection limit or rate was reached
+	CLOSEREJECTED = "rejected"
+	// CLOSEBLOCKED is a connection refused by the allow and deny lists of its port or a ban of its peer
+	CLOSEBLOCKED = "blocked"
+	// CLOSEEXPIRED is a UDP session without traffic for longer than its timeout, CLOSEEVICTED one making room for a new session
+	CLOSEEXPIRED = "expired"
+	CLOSEEVICTED = "evicted"
+)
+
+// logAccess writes the record of a relayed connection or UDP session of the external peer to the access log, if the
+// relay has one. BytesIn were sent by the peer, BytesOut to it, the duration counts from the accept or first datagram.
+func (r *Relay) logAccess(peer net.Addr, bytesIn uint64, bytesOut uint64, started time.Time, reason string) {
+	if r.accessLog == nil {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("Network", r.network),
+		slog.Int("Port", r.externalPort),
+		slog.Int("PublicPort", r.publicPort),
+	}
+	if name := r.config.Load().Name; name != "" {
+		attrs = append(attrs, slog.String("Tunnel", name))
+	}
+	if config := r.config.Load(); config.Host != "" {
+		attrs = append(attrs, slog.String("Host", config.Host), slog.String("Path", config.Path))
+	}
+	attrs = append(attrs,
+		slog.String(Utils.PEERKEY, peer.String()),
+		slog.Uint64("BytesIn", bytesIn),
+		slog.Uint64("BytesOut", bytesOut),
+		slog.Duration("Duration", time.Since(started)),
+		slog.String("Reason", reason),
+	)
+	r.accessLog.LogAttrs(context.Background(), slog.LevelInfo, "access", attrs...)
+}
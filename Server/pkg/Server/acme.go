@@ -0,0 +1,446 @@
+package Server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings of the ACME client, RFC 8555.
+const (
+	// ACMEPOLLINTERVAL is how often the state of authorizations and orders is checked while the CA validates them,
+	// ACMEPOLLTIMEOUT how long the CA has to do so
+	ACMEPOLLINTERVAL = 2 * time.Second
+	ACMEPOLLTIMEOUT  = 2 * time.Minute
+	// ACMENONCERETRIES is how often a request rejected for a bad nonce is repeated with a fresh one
+	ACMENONCERETRIES = 3
+	// ACMEMAXRESPONSE is the maximum size of a response of the CA, certificate chains included
+	ACMEMAXRESPONSE = 1 << 20
+	// ACMECHALLENGEPATH is the path the CA requests the key authorizations of HTTP-01 challenges from
+	ACMECHALLENGEPATH = "/.well-known/acme-challenge/"
+)
+
+// acmeProblem is an error reported by the CA, RFC 8555 section 6.7.
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"-"`
+}
+
+func (p *acmeProblem) Error() string {
+	return "acme: " + strconv.Itoa(p.Status) + " " + p.Type + ": " + p.Detail
+}
+
+// acmeClient obtains certificates from an ACME CA with the account of its key. It is not safe for concurrent use.
+type acmeClient struct {
+	directoryURL string
+	key          *ecdsa.PrivateKey
+	http         *http.Client
+	logger       *slog.Logger
+	directory    struct {
+		NewNonce   string `json:"newNonce"`
+		NewAccount string `json:"newAccount"`
+		NewOrder   string `json:"newOrder"`
+	}
+	nonce string
+	// kid is the URL of the account, set by register
+	kid string
+}
+
+// acmeOrder is an order of a certificate, acmeAuthorization the proof of control of one of its domains.
+type acmeOrder struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []struct {
+		Type  string `json:"type"`
+		URL   string `json:"url"`
+		Token string `json:"token"`
+	} `json:"challenges"`
+}
+
+// acmeSolver proves control of domains for a challenge type, "http-01" or "dns-01".
+type acmeSolver interface {
+	typ() string
+	// present makes the key authorization of the token available to the CA, cleanup removes it again
+	present(domain string, token string, keyAuth string) error
+	cleanup(domain string, token string, keyAuth string)
+	close()
+}
+
+func newAcmeClient(directoryURL string, key *ecdsa.PrivateKey, logger *slog.Logger) *acmeClient {
+	return &acmeClient{
+		directoryURL: directoryURL,
+		key:          key,
+		http:         &http.Client{Timeout: 30 * time.Second},
+		logger:       logger,
+	}
+}
+
+// obtain registers the account, or finds it if it exists, and orders a certificate for the domains, solving the
+// challenges with solver. It returns the PEM encoded certificate chain and private key.
+func (a *acmeClient) obtain(ctx context.Context, domains []string, email string, solver acmeSolver) ([]byte, []byte, error) {
+	err := a.fetchDirectory()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = a.register(email)
+	if err != nil {
+		return nil, nil, err
+	}
+	identifiers := make([]map[string]string, 0, len(domains))
+	for _, domain := range domains {
+		identifiers = append(identifiers, map[string]string{"type": "dns", "value": domain})
+	}
+	resp, data, err := a.post(a.directory.NewOrder, map[string]any{"identifiers": identifiers})
+	if err != nil {
+		return nil, nil, err
+	}
+	orderURL := resp.Header.Get("Location")
+	var order acmeOrder
+	err = json.Unmarshal(data, &order)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, authzURL := range order.Authorizations {
+		err = a.authorize(ctx, authzURL, solver)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: domains[0]},
+		DNSNames: domains,
+	}, certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, _, err = a.post(order.Finalize, map[string]string{"csr": b64(csr)})
+	if err != nil {
+		return nil, nil, err
+	}
+	err = a.poll(ctx, orderURL, &order, func() string { return order.Status })
+	if err != nil {
+		return nil, nil, err
+	}
+	_, chain, err := a.post(order.Certificate, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// authorize proves control of the domain of the authorization, unless the CA still remembers an earlier proof.
+func (a *acmeClient) authorize(ctx context.Context, authzURL string, solver acmeSolver) error {
+	var authz acmeAuthorization
+	_, data, err := a.post(authzURL, nil)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, &authz)
+	if err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+	domain := authz.Identifier.Value
+	for _, challenge := range authz.Challenges {
+		if challenge.Type != solver.typ() {
+			continue
+		}
+		keyAuth := challenge.Token + "." + a.thumbprint()
+		err = solver.present(domain, challenge.Token, keyAuth)
+		if err != nil {
+			return err
+		}
+		defer solver.cleanup(domain, challenge.Token, keyAuth)
+		a.logger.Info("Solving ACME challenge", slog.String("Func", "authorize"), slog.String("Domain", domain), slog.String("Type", challenge.Type))
+		_, _, err = a.post(challenge.URL, struct{}{})
+		if err != nil {
+			return err
+		}
+		return a.poll(ctx, authzURL, &authz, func() string { return authz.Status })
+	}
+	return errors.New("acme: no " + solver.typ() + " challenge for " + domain)
+}
+
+// poll fetches the object at url into v until status reports it valid or invalid, or ACMEPOLLTIMEOUT passed.
+func (a *acmeClient) poll(ctx context.Context, url string, v any, status func() string) error {
+	deadline := time.Now().Add(ACMEPOLLTIMEOUT)
+	for {
+		switch status() {
+		case "valid":
+			return nil
+		case "invalid":
+			return errors.New("acme: " + url + " is invalid")
+		}
+		if time.Now().After(deadline) {
+			return errors.New("acme: timeout waiting for " + url)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(ACMEPOLLINTERVAL):
+		}
+		_, data, err := a.post(url, nil)
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(data, v)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (a *acmeClient) fetchDirectory() error {
+	resp, err := a.http.Get(a.directoryURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("acme: fetching directory: " + resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, ACMEMAXRESPONSE)).Decode(&a.directory)
+}
+
+// register creates the account of the key, or looks it up if it exists already.
+func (a *acmeClient) register(email string) error {
+	payload := map[string]any{"termsOfServiceAgreed": true}
+	if email != "" {
+		payload["contact"] = []string{"mailto:" + email}
+	}
+	resp, _, err := a.post(a.directory.NewAccount, payload)
+	if err != nil {
+		return err
+	}
+	a.kid = resp.Header.Get("Location")
+	if a.kid == "" {
+		return errors.New("acme: account without URL")
+	}
+	return nil
+}
+
+// post sends the payload signed by the account key and returns the response with its body. A nil payload is a
+// POST-as-GET request, RFC 8555 section 6.3.
+func (a *acmeClient) post(url string, payload any) (*http.Response, []byte, error) {
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		signed, err := a.sign(url, body)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := a.http.Post(url, "application/jose+json", bytes.NewReader(signed))
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, ACMEMAXRESPONSE))
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		a.nonce = resp.Header.Get("Replay-Nonce")
+		if resp.StatusCode >= http.StatusBadRequest {
+			problem := &acmeProblem{Status: resp.StatusCode}
+			_ = json.Unmarshal(data, problem)
+			if problem.Type == "urn:ietf:params:acme:error:badNonce" && attempt < ACMENONCERETRIES {
+				continue
+			}
+			return nil, nil, problem
+		}
+		return resp, data, nil
+	}
+}
+
+// sign creates the flattened JWS of the payload for url, RFC 8555 section 6.2. Until the account is registered,
+// the key itself is sent instead of the account URL.
+func (a *acmeClient) sign(url string, payload []byte) ([]byte, error) {
+	if a.nonce == "" {
+		resp, err := a.http.Head(a.directory.NewNonce)
+		if err != nil {
+			return nil, err
+		}
+		_ = resp.Body.Close()
+		a.nonce = resp.Header.Get("Replay-Nonce")
+		if a.nonce == "" {
+			return nil, errors.New("acme: no nonce")
+		}
+	}
+	header := map[string]any{"alg": "ES256", "nonce": a.nonce, "url": url}
+	if a.kid != "" {
+		header["kid"] = a.kid
+	} else {
+		header["jwk"] = json.RawMessage(a.jwk())
+	}
+	a.nonce = ""
+	protected, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	input := b64(protected) + "." + b64(payload)
+	hash := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return json.Marshal(map[string]string{"protected": b64(protected), "payload": b64(payload), "signature": b64(signature)})
+}
+
+// jwk returns the public account key as JSON Web Key, with the members in the order of its thumbprint, RFC 7638.
+func (a *acmeClient) jwk() string {
+	pub, err := a.key.PublicKey.ECDH()
+	if err != nil {
+		return ""
+	}
+	// uncompressed point, 0x04 followed by x and y
+	point := pub.Bytes()
+	return `{"crv":"P-256","kty":"EC","x":"` + b64(point[1:33]) + `","y":"` + b64(point[33:]) + `"}`
+}
+
+// thumbprint returns the thumbprint of the account key that key authorizations end with.
+func (a *acmeClient) thumbprint() string {
+	hash := sha256.Sum256([]byte(a.jwk()))
+	return b64(hash[:])
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// httpSolver answers HTTP-01 challenges with a web server of its own, which has to be reachable on port 80 of the
+// domains, or as handler of the HTTP front.
+type httpSolver struct {
+	mu     sync.Mutex
+	tokens map[string]string
+	server *http.Server
+}
+
+// newHTTPSolver starts the web server of the challenges on port.
+func newHTTPSolver(port int) (*httpSolver, error) {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return nil, err
+	}
+	s := &httpSolver{tokens: make(map[string]string)}
+	s.server = &http.Server{Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		_ = s.server.Serve(l)
+	}()
+	return s, nil
+}
+
+func (s *httpSolver) typ() string {
+	return ACMEHTTP01
+}
+
+func (s *httpSolver) present(_ string, token string, keyAuth string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token] = keyAuth
+	return nil
+}
+
+func (s *httpSolver) cleanup(_ string, token string, _ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, token)
+}
+
+// close stops the web server of the challenges, if the solver has one of its own.
+func (s *httpSolver) close() {
+	if s.server != nil {
+		_ = s.server.Close()
+	}
+}
+
+func (s *httpSolver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.URL.Path, ACMECHALLENGEPATH)
+	s.mu.Lock()
+	keyAuth, known := s.tokens[token]
+	s.mu.Unlock()
+	if !ok || !known {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	_, _ = w.Write([]byte(keyAuth))
+}
+
+// dnsSolver answers DNS-01 challenges by running a hook of the operator that manages the DNS records, as
+// "hook present _acme-challenge.example.com value" and "hook cleanup _acme-challenge.example.com value".
+// The hook has to return once the TXT record is visible to the CA.
+type dnsSolver struct {
+	hook string
+}
+
+func (s *dnsSolver) typ() string {
+	return ACMEDNS01
+}
+
+func (s *dnsSolver) present(domain string, _ string, keyAuth string) error {
+	return s.run("present", domain, keyAuth)
+}
+
+func (s *dnsSolver) cleanup(domain string, _ string, keyAuth string) {
+	_ = s.run("cleanup", domain, keyAuth)
+}
+
+func (s *dnsSolver) close() {}
+
+// run runs the hook with the name and value of the TXT record of the domain.
+func (s *dnsSolver) run(action string, domain string, keyAuth string) error {
+	hash := sha256.Sum256([]byte(keyAuth))
+	record := "_acme-challenge." + strings.TrimPrefix(domain, "*.")
+	output, err := exec.Command(s.hook, action, record, b64(hash[:])).CombinedOutput()
+	if err != nil {
+		return errors.New("acme: dns hook " + action + " " + record + ": " + err.Error() + ": " + strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package Server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Defaults of the ACME integration, see ACMEConfig.
+const (
+	LETSENCRYPTDIRECTORY = "https://acme-v02.api.letsencrypt.org/directory"
+	ACMEHTTP01           = "http-01"
+	ACMEDNS01            = "dns-01"
+	ACMEHTTPPORT         = 80
+	// ACMERENEWBEFORE is how long before it expires the certificate is renewed, checked every ACMECHECKINTERVAL
+	ACMERENEWBEFORE   = 30 * 24 * time.Hour
+	ACMECHECKINTERVAL = 12 * time.Hour
+)
+
+// ACMEConfig lets the server obtain its certificate from an ACME CA like Let's Encrypt and renew it, instead of
+// reading Config.CertFile and Config.KeyFile. Client certificates are still verified with the private CA of
+// Config.CAFile, the ACME certificate only replaces the one the server presents.
+type ACMEConfig struct {
+	// Domains are the DNS names of the certificate, ACME is disabled if empty
+	Domains []string
+	// Directory is the directory URL of the CA, Let's Encrypt if empty
+	Directory string
+	// Email is the contact of the account, optional
+	Email string
+	// Dir is where the account key, the certificate and its key are kept, so restarts reuse them.
+	// Empty is the acme directory in the certs directory of the home directory.
+	Dir string
+	// Challenge is ACMEHTTP01, answered on HTTPPort, or ACMEDNS01, answered by DNSHook, see dnsSolver
+	Challenge string
+	HTTPPort  int
+	DNSHook   string
+}
+
+func (a *ACMEConfig) enabled() bool {
+	return len(a.Domains) > 0
+}
+
+// validate checks the challenge settings, if ACME is enabled.
+func (a *ACMEConfig) validate() error {
+	if !a.enabled() {
+		return nil
+	}
+	if slices.Contains(a.Domains, "") {
+		return errors.New("empty ACME domain")
+	}
+	switch a.Challenge {
+	case ACMEHTTP01:
+		if !validPort(a.HTTPPort) {
+			return errors.New("invalid ACME HTTP port")
+		}
+	case ACMEDNS01:
+		if a.DNSHook == "" {
+			return errors.New("ACME DNS challenge without hook")
+		}
+	default:
+		return errors.New("invalid ACME challenge " + a.Challenge)
+	}
+	return nil
+}
+
+// acmeDir returns the directory of the ACME account and certificate, see ACMEConfig.Dir.
+func (c *Config) acmeDir() (string, error) {
+	if c.ACME.Dir != "" {
+		return c.ACME.Dir, nil
+	}
+	dir, err := DefaultCertDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "acme"), nil
+}
+
+// renewAcmeCertificate obtains a certificate for the ACME domains unless the stored one covers them and is valid
+// for longer than ACMERENEWBEFORE. It reports whether a new certificate was stored.
+func (s *Server) renewAcmeCertificate(ctx context.Context) (bool, error) {
+	dir, err := s.Config.acmeDir()
+	if err != nil {
+		return false, err
+	}
+	crtPath, keyPath := filepath.Join(dir, SERVERCERTFILE), filepath.Join(dir, SERVERKEYFILE)
+	if leaf, err := loadLeaf(crtPath, keyPath); err == nil && time.Until(leaf.NotAfter) > ACMERENEWBEFORE && coversDomains(leaf, s.Config.ACME.Domains) {
+		return false, nil
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return false, err
+	}
+	accountKey, err := loadAccountKey(filepath.Join(dir, "account.key"))
+	if err != nil {
+		return false, err
+	}
+	var solver acmeSolver
+	if s.Config.ACME.Challenge == ACMEDNS01 {
+		solver = &dnsSolver{hook: s.Config.ACME.DNSHook}
+	} else if s.challenges != nil && s.Config.frontPort() == s.Config.ACME.HTTPPort {
+		// the HTTP front holds the port already
+		solver = s.challenges
+	} else {
+		solver, err = newHTTPSolver(s.Config.ACME.HTTPPort)
+		if err != nil {
+			return false, err
+		}
+	}
+	defer solver.close()
+	directory := s.Config.ACME.Directory
+	if directory == "" {
+		directory = LETSENCRYPTDIRECTORY
+	}
+	s.Logger.Info("Obtaining ACME certificate", slog.String("Func", "renewAcmeCertificate"), slog.Any("Domains", s.Config.ACME.Domains))
+	client := newAcmeClient(directory, accountKey, s.Logger)
+	chain, key, err := client.obtain(ctx, s.Config.ACME.Domains, s.Config.ACME.Email, solver)
+	if err != nil {
+		return false, err
+	}
+	// the key first, a reload between both writes fails on the mismatch and keeps the old pair
+	err = writeFileAtomic(keyPath, key)
+	if err != nil {
+		return false, err
+	}
+	err = writeFileAtomic(crtPath, chain)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// acmeLoop renews the ACME certificate when it is due and reloads it, until the context is cancelled.
+func (s *Server) acmeLoop(ctx context.Context) {
+	ticker := time.NewTicker(ACMECHECKINTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		renewed, err := s.renewAcmeCertificate(ctx)
+		if err != nil {
+			s.Logger.Error("Error renewing ACME certificate", slog.String("Func", "acmeLoop"), "Error", err)
+			continue
+		}
+		if renewed {
+			_ = s.ReloadCertificates()
+		}
+	}
+}
+
+// loadLeaf returns the certificate of the key pair, checking that the key belongs to it.
+func loadLeaf(crtPath string, keyPath string) (*x509.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(crtPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(pair.Certificate[0])
+}
+
+// coversDomains reports whether the certificate is valid for all domains.
+func coversDomains(cert *x509.Certificate, domains []string) bool {
+	for _, domain := range domains {
+		if !slices.Contains(cert.DNSNames, domain) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadAccountKey loads the key of the ACME account from path, or creates and stores a new one if there is none.
+func loadAccountKey(path string) (*ecdsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("invalid ACME account key " + path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+}
+
+// writeFileAtomic replaces the file at path with data, readers see either the old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	err := os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,67 @@
+package Server
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// Address families the listeners of the server are bound to, see Config.AddressFamily.
+const (
+	// FAMILYDUAL binds IPv4 and IPv6, listeners on all interfaces accept both
+	FAMILYDUAL = "dual"
+	// FAMILYIPV4 binds IPv4 only
+	FAMILYIPV4 = "ipv4"
+	// FAMILYIPV6 binds IPv6 only
+	FAMILYIPV6 = "ipv6"
+)
+
+// familyNetwork returns the network to listen on for the base network, tcp or udp, in the address family, e.g. tcp6
+// for FAMILYIPV6. A dual-stack listener on all interfaces accepts IPv4 as IPv4-mapped addresses.
+func familyNetwork(network string, family string) string {
+	switch family {
+	case FAMILYIPV4:
+		return network + "4"
+	case FAMILYIPV6:
+		return network + "6"
+	}
+	return network
+}
+
+// listenNetwork returns the network the listeners of the server listen on for tcp or udp.
+func (c *Config) listenNetwork(network string) string {
+	return familyNetwork(network, c.AddressFamily)
+}
+
+// listenFamilies returns the address families a listener bound to ip is reachable over, comma-separated, ip being
+// nil or unspecified for all interfaces.
+func (c *Config) listenFamilies(ip net.IP) string {
+	switch {
+	case ip != nil && !ip.IsUnspecified() && ip.To4() != nil:
+		return FAMILYIPV4
+	case ip != nil && !ip.IsUnspecified():
+		return FAMILYIPV6
+	case c.AddressFamily == FAMILYDUAL:
+		return strings.Join([]string{FAMILYIPV4, FAMILYIPV6}, ",")
+	}
+	return c.AddressFamily
+}
+
+// validateAddressFamily checks the address family and that the bind addresses belong to it.
+func (c *Config) validateAddressFamily() error {
+	switch c.AddressFamily {
+	case FAMILYDUAL, FAMILYIPV4, FAMILYIPV6:
+	default:
+		return errors.New("invalid address family " + c.AddressFamily)
+	}
+	for _, addr := range []string{c.CtrlAddr, c.DataAddr, c.PublicAddr} {
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.IsUnspecified() || c.AddressFamily == FAMILYDUAL {
+			continue
+		}
+		if (ip.To4() != nil) != (c.AddressFamily == FAMILYIPV4) {
+			return errors.New("bind address " + addr + " outside address family " + c.AddressFamily)
+		}
+	}
+	return nil
+}
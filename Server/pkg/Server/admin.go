@@ -0,0 +1,560 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ADMINPATH is the path below which the admin API is served, see Config.AdminAddr:
+//
+//	GET    /api/v1/status                                        AdminStatus of the server
+//	GET    /api/v1/clients                                       AdminClient of every connected client
+//	GET    /api/v1/clients/{id}                                  AdminClient of the client
+//	DELETE /api/v1/clients/{id}                                  disconnects the client, ?reason= is told to it
+//	DELETE /api/v1/clients/{id}/tunnels/{network}/{port}         hides the exposed port, ?reason= is told to the client
+//	GET    /api/v1/clients/{id}/tunnels/{network}/{port}/history TrafficBucket of the last hour, ?resolution=hours
+//	                                                             of the last day
+//	GET    /api/v1/clients/{id}/tunnels/{network}/{port}/requests InspectedRequest of the recent requests of a port
+//	                                                             exposed with inspect=on, oldest first
+//	GET    /api/v1/events                                        AdminEvent of the last RECENTEVENTS events, oldest first
+//	GET    /api/v1/events/stream                                 AdminEvent of every event from now on as server-sent
+//	                                                             events, ?kind= limits them to the kinds given
+//	GET    /api/v1/settings                                      AdminSettings in effect
+//	PATCH  /api/v1/settings                                      changes the settings of an AdminSettingsUpdate and
+//	                                                             answers the AdminSettings in effect
+//	GET    /api/v1/profiles                                      Profile of every client with one, by CN
+//	PUT    /api/v1/profiles/{cn}                                 sets the Profile of the client
+//	DELETE /api/v1/profiles/{cn}                                 removes the Profile set for the client
+//	GET    /api/v1/reserved                                      CN of the client of every reserved port, by port
+//	PUT    /api/v1/reserved/{port}                               reserves the port for the client of the cn field
+//	DELETE /api/v1/reserved/{port}                               removes the reservation set for the port
+//	GET    /api/v1/bans                                          Ban of every source IP banned, see Config.BanThreshold
+//	DELETE /api/v1/bans/{ip}                                     lifts the ban of the IP
+//
+// The settings, profiles and reservations changed are kept in the store of the server, see Config.StoreFile.
+//
+// Requests have to carry Config.AdminToken or one of Config.AdminKeys with a role allowing them as bearer token, see
+// ADMINROLEREAD. Errors are answered with an object with an error field. The operations on clients and tunnels and a
+// stream of events are served over gRPC as well, see GRPCSERVICE.
+const ADMINPATH = "/api/v1/"
+
+// ADMINKEEPALIVE is the interval of the comments sent on an idle event stream, which keep proxies from closing it.
+const ADMINKEEPALIVE = 15 * time.Second
+
+// ADMINMAXBODY is the maximum size of the body of a request to the admin API.
+const ADMINMAXBODY = 64 << 10
+
+var (
+	// ErrNoClient is returned for a client that is not connected
+	ErrNoClient = errors.New("client not connected")
+	// ErrNoTunnel is returned for a port the client does not expose
+	ErrNoTunnel = errors.New("port not exposed")
+	// ErrNoHistory is returned for a port without traffic history
+	ErrNoHistory = errors.New("no traffic history")
+)
+
+// AdminStatus sums up the server for the admin API.
+type AdminStatus struct {
+	Clients     int    `json:"clients"`
+	Tunnels     int    `json:"tunnels"`
+	ActiveConns int    `json:"activeConns"`
+	Accepted    uint64 `json:"accepted"`
+	BytesIn     uint64 `json:"bytesIn"`
+	BytesOut    uint64 `json:"bytesOut"`
+}
+
+// AdminClient is a connected client in the admin API.
+type AdminClient struct {
+	ID        uint64        `json:"id"`
+	CN        string        `json:"cn"`
+	Tenant    string        `json:"tenant,omitempty"`
+	Address   string        `json:"address"`
+	Connected time.Time     `json:"connected"`
+	Suspended bool          `json:"suspended"`
+	Tunnels   []AdminTunnel `json:"tunnels"`
+}
+
+// AdminTunnel is an exposed port in the admin API, with its relayed connections at the moment and its traffic.
+// HalfClosed are the relayed connections with one direction done, ForceClosed those closed by the stuck connection
+// detector so far, StuckStacks the goroutine stacks of the pipes of both, see stuckStacks.
+type AdminTunnel struct {
+	Network     string   `json:"network"`
+	Port        int      `json:"port"`
+	PublicPort  int      `json:"publicPort"`
+	Name        string   `json:"name,omitempty"`
+	Host        string   `json:"host,omitempty"`
+	Path        string   `json:"path,omitempty"`
+	ActiveConns int64    `json:"activeConns"`
+	Accepted    uint64   `json:"accepted"`
+	BytesIn     uint64   `json:"bytesIn"`
+	BytesOut    uint64   `json:"bytesOut"`
+	HalfClosed  int      `json:"halfClosed"`
+	ForceClosed uint64   `json:"forceClosed"`
+	StuckStacks []string `json:"stuckStacks,omitempty"`
+}
+
+// AdminEvent is an Event in the admin API. Traffic samples are left out of the recent events, see recentEvents.
+type AdminEvent struct {
+	Kind     string       `json:"kind"`
+	Time     time.Time    `json:"time"`
+	ClientID uint64       `json:"clientId"`
+	CN       string       `json:"cn"`
+	Tenant   string       `json:"tenant,omitempty"`
+	Address  string       `json:"address"`
+	Tunnel   *AdminTunnel `json:"tunnel,omitempty"`
+	Reason   string       `json:"reason,omitempty"`
+	// BytesIn, BytesOut and Conns are the traffic of traffic samples
+	BytesIn  uint64 `json:"bytesIn,omitempty"`
+	BytesOut uint64 `json:"bytesOut,omitempty"`
+	Conns    uint64 `json:"conns,omitempty"`
+}
+
+func newAdminEvent(event Event) AdminEvent {
+	e := AdminEvent{Kind: event.Kind, Time: event.Time, ClientID: event.ClientID, CN: event.Client.CN, Tenant: event.Client.Tenant,
+		Address: event.Address, Reason: event.Reason, BytesIn: event.BytesIn, BytesOut: event.BytesOut, Conns: event.Conns}
+	if event.Tunnel.Network != "" {
+		e.Tunnel = &AdminTunnel{Network: event.Tunnel.Network, Port: event.Tunnel.Port, PublicPort: event.Tunnel.PublicPort, Name: event.Tunnel.Name,
+			Host: event.Tunnel.Host, Path: event.Tunnel.Path}
+	}
+	return e
+}
+
+func newAdminClient(info ClientInfo) AdminClient {
+	client := AdminClient{
+		ID:        info.ID,
+		CN:        info.Identity.CN,
+		Tenant:    info.Identity.Tenant,
+		Address:   info.Address,
+		Connected: info.Connected,
+		Suspended: info.Suspended,
+		Tunnels:   make([]AdminTunnel, 0, len(info.Tunnels)),
+	}
+	for _, t := range info.Tunnels {
+		tunnel := AdminTunnel{Network: t.Network, Port: t.Port, PublicPort: t.PublicPort, Name: t.Name, Host: t.Host, Path: t.Path}
+		if t.stats != nil {
+			tunnel.ActiveConns = max(t.stats.Active.Load(), 0)
+			tunnel.Accepted = t.stats.Accepted.Load()
+			tunnel.BytesIn = t.stats.BytesIn.Load()
+			tunnel.BytesOut = t.stats.BytesOut.Load()
+			tunnel.ForceClosed = t.stats.ForceClosed.Load()
+		}
+		if t.relay != nil {
+			tunnel.HalfClosed = t.relay.halfClosedConns()
+			if tunnel.HalfClosed > 0 || tunnel.ForceClosed > 0 {
+				tunnel.StuckStacks = t.relay.stuckStacks()
+			}
+		}
+		client.Tunnels = append(client.Tunnels, tunnel)
+	}
+	return client
+}
+
+// adminRequest asks the session of a client to hide the port of the network, or to end if both are empty. The reason
+// is passed on to the client. The session answers on reply.
+type adminRequest struct {
+	network string
+	port    int
+	reason  string
+	reply   chan error
+}
+
+// Reasons of admin requests that don't give one. ADMINMAXREASON is the longest reason accepted, it has to fit into a
+// frame.
+const (
+	ADMINDISCONNECTREASON = "disconnected by an admin"
+	ADMINHIDEREASON       = "hidden by an admin"
+	ADMINMAXREASON        = 200
+)
+
+// handleAdmin carries out the request of an admin in the handle loop and reports whether the session ends.
+func (c *ClientHandler) handleAdmin(ctx context.Context, req adminRequest, toclient chan *Utils.CTRLFrame) bool {
+	if req.network == "" {
+		c.logger.Info("Disconnected by an admin", slog.String("Func", "handleAdmin"), slog.String("Reason", req.reason))
+		if c.graceTimer == nil {
+			// the client stops instead of reconnecting
+			_ = Utils.WriteFrame(c.Conn, Utils.NewCTRLFrame(Utils.CTRLUNPAIR, []string{req.reason}))
+		}
+		c.endReason = req.reason
+		req.reply <- nil
+		return true
+	}
+	if c.tunnels.get(req.network, req.port) == nil {
+		req.reply <- ErrNoTunnel
+		return false
+	}
+	c.logger.Info("Port hidden by an admin", slog.String("Func", "handleAdmin"), slog.String("Network", req.network), slog.Int("Port", req.port), slog.String("Reason", req.reason))
+	c.hide(req.network, req.port)
+	// the public port is released like for a port the client hid, so it doesn't stay reserved for the client
+	err := c.assignments.Remove(c.clientCN(), req.network, req.port)
+	if err != nil {
+		c.logger.Error("Error saving port assignments", slog.String("Func", "handleAdmin"), "Error", err)
+	}
+	c.reject(ctx, toclient, req.network, strconv.Itoa(req.port), Utils.ERRADMIN, req.reason)
+	req.reply <- nil
+	return false
+}
+
+// Disconnect ends the session of the connected client with the ID, its relays are stopped and their ports released.
+// A client that is connected is told the reason, ADMINDISCONNECTREASON if empty, and stops instead of reconnecting.
+func (s *Server) Disconnect(id uint64, reason string) error {
+	if len(reason) > ADMINMAXREASON {
+		return errors.New("reason longer than " + strconv.Itoa(ADMINMAXREASON) + " bytes")
+	}
+	if reason == "" {
+		reason = ADMINDISCONNECTREASON
+	}
+	return s.registry.request(id, adminRequest{reason: reason})
+}
+
+// HideTunnel hides the port of the network exposed by the client with the ID, its relayed connections are closed and
+// its public port released. The client is told with a CTRLERROR of Utils.ERRADMIN carrying the reason,
+// ADMINHIDEREASON if empty.
+func (s *Server) HideTunnel(id uint64, network string, port int, reason string) error {
+	if network != "tcp" && network != "udp" {
+		return errors.New("unknown network " + network)
+	}
+	if len(reason) > ADMINMAXREASON {
+		return errors.New("reason longer than " + strconv.Itoa(ADMINMAXREASON) + " bytes")
+	}
+	if reason == "" {
+		reason = ADMINHIDEREASON
+	}
+	return s.registry.request(id, adminRequest{network: network, port: port, reason: reason})
+}
+
+// Status sums up the clients, their exposed ports and the traffic relayed since the server started.
+func (s *Server) Status() AdminStatus {
+	clients := s.registry.Clients()
+	totals := s.registry.totals()
+	status := AdminStatus{Clients: len(clients), Accepted: totals.accepted, BytesIn: totals.bytesIn, BytesOut: totals.bytesOut}
+	for _, client := range clients {
+		status.Tunnels += len(client.Tunnels)
+	}
+	if s.poolsReady.Load() {
+		status.ActiveConns = s.ActiveConns()
+	}
+	return status
+}
+
+// serveAdmin serves the admin API on Config.AdminAddr with TLS and the certificate of the server until the context is
+// cancelled. If it can't listen, the server runs without.
+func (s *Server) serveAdmin(ctx context.Context) {
+	l, err := net.Listen("tcp", s.Config.AdminAddr)
+	if err != nil {
+		s.Logger.Error("Error listening for the admin API", slog.String("Func", "serveAdmin"), slog.String("Address", s.Config.AdminAddr), "Error", err)
+		return
+	}
+	tlsConfig := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := s.tlsConfig.Load()
+			if config == nil {
+				return nil, errors.New("no certificate")
+			}
+			// admins authenticate with the token, not with a client certificate
+			config = config.Clone()
+			config.ClientAuth = tls.NoClientCert
+			config.VerifyPeerCertificate = nil
+			// HTTP/2 is needed by the gRPC service
+			config.NextProtos = []string{"h2", "http/1.1"}
+			return config, nil
+		},
+	}
+	server := &http.Server{Handler: s.adminHandler(), ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		_ = server.Serve(tls.NewListener(l, tlsConfig))
+	}()
+	s.Logger.Info("Serving admin API", slog.String("Func", "serveAdmin"), slog.String("Address", l.Addr().String()))
+}
+
+// adminHandler routes the requests of the admin API, see ADMINPATH, once they are authenticated, and serves the
+// dashboard.
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+ADMINPATH+"status", s.requireRole(ADMINROLEREAD, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, s.Status())
+	}))
+	mux.HandleFunc("GET "+ADMINPATH+"clients", s.requireRole(ADMINROLEREAD, func(w http.ResponseWriter, r *http.Request) {
+		clients := s.registry.Clients()
+		list := make([]AdminClient, 0, len(clients))
+		for _, client := range clients {
+			list = append(list, newAdminClient(client))
+		}
+		writeAdminJSON(w, http.StatusOK, list)
+	}))
+	mux.HandleFunc("GET "+ADMINPATH+"clients/{id}", s.requireRole(ADMINROLEREAD, func(w http.ResponseWriter, r *http.Request) {
+		client, err := s.adminClient(r.PathValue("id"))
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, newAdminClient(client))
+	}))
+	mux.HandleFunc("DELETE "+ADMINPATH+"clients/{id}", s.requireRole(ADMINROLEADMIN, func(w http.ResponseWriter, r *http.Request) {
+		client, err := s.adminClient(r.PathValue("id"))
+		if err == nil {
+			err = s.Disconnect(client.ID, r.URL.Query().Get("reason"))
+		}
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		s.Logger.Info("Admin disconnected client", slog.String("Func", "adminHandler"), slog.String("Admin", requestAdminKey(r).Name),
+			slog.Uint64("ClientID", client.ID), slog.String("Client", client.Identity.CN))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("DELETE "+ADMINPATH+"clients/{id}/tunnels/{network}/{port}", s.requireRole(ADMINROLEOPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		client, err := s.adminClient(r.PathValue("id"))
+		port, portErr := strconv.Atoi(r.PathValue("port"))
+		if err == nil && portErr != nil {
+			err = ErrNoTunnel
+		}
+		if err == nil {
+			err = s.HideTunnel(client.ID, r.PathValue("network"), port, r.URL.Query().Get("reason"))
+		}
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("GET "+ADMINPATH+"clients/{id}/tunnels/{network}/{port}/history", s.requireRole(ADMINROLEREAD, func(w http.ResponseWriter, r *http.Request) {
+		client, err := s.adminClient(r.PathValue("id"))
+		port, portErr := strconv.Atoi(r.PathValue("port"))
+		if err == nil && portErr != nil {
+			err = ErrNoTunnel
+		}
+		resolution := r.URL.Query().Get("resolution")
+		if err == nil && resolution != "" && resolution != Utils.HISTORYMINUTES && resolution != Utils.HISTORYHOURS {
+			writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": "unknown resolution " + resolution})
+			return
+		}
+		var buckets []TrafficBucket
+		if err == nil {
+			buckets, err = s.TrafficHistory(client.Identity.CN, r.PathValue("network"), port, resolution == Utils.HISTORYHOURS)
+		}
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, buckets)
+	}))
+	mux.HandleFunc("GET "+ADMINPATH+"clients/{id}/tunnels/{network}/{port}/requests", s.requireRole(ADMINROLEREAD, func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+		if err != nil {
+			writeAdminError(w, ErrNoClient)
+			return
+		}
+		port, err := strconv.Atoi(r.PathValue("port"))
+		if err != nil {
+			writeAdminError(w, ErrNoTunnel)
+			return
+		}
+		requests, err := s.InspectedRequests(id, r.PathValue("network"), port)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, requests)
+	}))
+	mux.HandleFunc("GET "+ADMINPATH+"events", s.requireRole(ADMINROLEREAD, func(w http.ResponseWriter, r *http.Request) {
+		events := s.recentEvents.snapshot()
+		list := make([]AdminEvent, 0, len(events))
+		for _, event := range events {
+			list = append(list, newAdminEvent(event))
+		}
+		writeAdminJSON(w, http.StatusOK, list)
+	}))
+	mux.HandleFunc("GET "+ADMINPATH+"events/stream", s.requireRole(ADMINROLEREAD, func(w http.ResponseWriter, r *http.Request) {
+		kinds := r.URL.Query()["kind"]
+		for _, kind := range kinds {
+			if !slices.Contains(EVENTKINDS, kind) {
+				writeAdminJSON(w, http.StatusBadRequest, map[string]string{"error": "unknown event kind " + kind})
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		s.followEvents(w, r, kinds, ADMINKEEPALIVE, func() {
+			_, _ = io.WriteString(w, ": keep-alive\n\n")
+		}, func(event Event) {
+			data, _ := json.Marshal(newAdminEvent(event))
+			_, _ = io.WriteString(w, "event: "+event.Kind+"\ndata: "+string(data)+"\n\n")
+		})
+	}))
+	mux.HandleFunc("GET "+ADMINPATH+"settings", s.requireRole(ADMINROLEREAD, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, s.Settings())
+	}))
+	mux.HandleFunc("PATCH "+ADMINPATH+"settings", s.requireRole(ADMINROLEADMIN, func(w http.ResponseWriter, r *http.Request) {
+		var update AdminSettingsUpdate
+		err := decodeAdminJSON(w, r, &update)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		settings, err := s.UpdateSettings(update)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, settings)
+	}))
+	mux.HandleFunc("GET "+ADMINPATH+"profiles", s.requireRole(ADMINROLEREAD, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, s.Profiles())
+	}))
+	mux.HandleFunc("PUT "+ADMINPATH+"profiles/{cn}", s.requireRole(ADMINROLEADMIN, func(w http.ResponseWriter, r *http.Request) {
+		var p Profile
+		err := decodeAdminJSON(w, r, &p)
+		if err == nil && p.CN != "" && p.CN != r.PathValue("cn") {
+			err = errors.New("CN of the profile isn't the one of the path")
+		}
+		if err == nil {
+			p.CN = r.PathValue("cn")
+			err = s.SetProfile(p)
+		}
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, p)
+	}))
+	mux.HandleFunc("DELETE "+ADMINPATH+"profiles/{cn}", s.requireRole(ADMINROLEADMIN, func(w http.ResponseWriter, r *http.Request) {
+		err := s.RemoveProfile(r.PathValue("cn"))
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("GET "+ADMINPATH+"reserved", s.requireRole(ADMINROLEREAD, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, s.ReservedPorts())
+	}))
+	mux.HandleFunc("PUT "+ADMINPATH+"reserved/{port}", s.requireRole(ADMINROLEADMIN, func(w http.ResponseWriter, r *http.Request) {
+		var reservation struct {
+			CN string `json:"cn"`
+		}
+		port, err := strconv.Atoi(r.PathValue("port"))
+		if err == nil {
+			err = decodeAdminJSON(w, r, &reservation)
+		}
+		if err == nil {
+			err = s.ReservePort(port, reservation.CN)
+		}
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("DELETE "+ADMINPATH+"reserved/{port}", s.requireRole(ADMINROLEADMIN, func(w http.ResponseWriter, r *http.Request) {
+		port, err := strconv.Atoi(r.PathValue("port"))
+		if err == nil {
+			err = s.UnreservePort(port)
+		}
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("GET "+ADMINPATH+"bans", s.requireRole(ADMINROLEREAD, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, s.Bans())
+	}))
+	mux.HandleFunc("DELETE "+ADMINPATH+"bans/{ip}", s.requireRole(ADMINROLEOPERATOR, func(w http.ResponseWriter, r *http.Request) {
+		err := s.Unban(r.PathValue("ip"))
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	mux.HandleFunc("POST /"+GRPCSERVICE+"/{method}", s.serveGRPC)
+	// the dashboard holds no data, it asks for the token and calls the API, so it is served without
+	root := http.NewServeMux()
+	root.HandleFunc("GET "+DASHBOARDPATH+"{$}", serveDashboard)
+	root.Handle("/", s.adminAuth(mux))
+	return root
+}
+
+// adminAuth lets the requests carrying Config.AdminToken or one of Config.AdminKeys as bearer token through to next,
+// with the key they were authenticated with, see requireRole.
+func (s *Server) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		var k AdminKey
+		if ok {
+			k, ok = s.adminKey(token)
+		}
+		if !ok {
+			s.Logger.Warn("Unauthorized admin request", slog.String("Func", "adminAuth"), slog.String("Address", r.RemoteAddr), slog.String("Path", r.URL.Path))
+			if isGRPC(r) {
+				w.Header().Set("Content-Type", "application/grpc+proto")
+				w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+				w.WriteHeader(http.StatusOK)
+				writeGRPCStatus(w, grpcUnauthenticated, "unauthorized")
+				return
+			}
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdminJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, withAdminKey(r, k))
+	})
+}
+
+// adminClient returns the connected client with the ID of the path.
+func (s *Server) adminClient(id string) (ClientInfo, error) {
+	n, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return ClientInfo{}, ErrNoClient
+	}
+	for _, client := range s.registry.Clients() {
+		if client.ID == n {
+			return client, nil
+		}
+	}
+	return ClientInfo{}, ErrNoClient
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// decodeAdminJSON decodes the JSON body of the request into v, refusing unknown fields and bodies larger than
+// ADMINMAXBODY.
+func decodeAdminJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, ADMINMAXBODY))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err != nil {
+		return errors.New("invalid body: " + err.Error())
+	}
+	return nil
+}
+
+// writeAdminError answers with the error, not found for clients, ports and state that don't exist.
+func writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	if errors.Is(err, ErrNoClient) || errors.Is(err, ErrNoTunnel) || errors.Is(err, ErrNoHistory) || errors.Is(err, ErrNotStored) ||
+		errors.Is(err, ErrNotInspected) || errors.Is(err, ErrNotBanned) {
+		status = http.StatusNotFound
+	}
+	writeAdminJSON(w, status, map[string]string{"error": err.Error()})
+}
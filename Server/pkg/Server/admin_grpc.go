@@ -0,0 +1,432 @@
+package Server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GRPCSERVICE is the gRPC service of the admin API, served next to the REST API on Config.AdminAddr over HTTP/2 and
+// described in admin.proto. Calls have to carry Config.AdminToken as bearer token in the authorization metadata.
+const GRPCSERVICE = "goexpose.admin.v1.Admin"
+
+// GRPCMAXMESSAGE is the largest request message accepted.
+const GRPCMAXMESSAGE = 64 * 1024
+
+// gRPC status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcOK               = 0
+	grpcInvalidArgument  = 3
+	grpcNotFound         = 5
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcUnauthenticated  = 16
+)
+
+// isGRPC reports whether the request is a gRPC call.
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// serveGRPC answers a call of a method of GRPCSERVICE. The messages are encoded by hand, see protoMessage, as the
+// server has no dependencies besides the standard library.
+func (s *Server) serveGRPC(w http.ResponseWriter, r *http.Request) {
+	if !isGRPC(r) {
+		writeAdminJSON(w, http.StatusUnsupportedMediaType, map[string]string{"error": "gRPC calls need HTTP/2 and application/grpc"})
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc+proto")
+	// the status is always sent in the trailers
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+	req, err := readGRPCMessage(r.Body)
+	if err != nil {
+		writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	fields, err := parseProto(req)
+	if err != nil {
+		writeGRPCStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	role := ADMINROLEREAD
+	switch r.PathValue("method") {
+	case "Disconnect":
+		role = ADMINROLEADMIN
+	case "HideTunnel":
+		role = ADMINROLEOPERATOR
+	}
+	if !s.authorize(w, r, role) {
+		return
+	}
+	switch r.PathValue("method") {
+	case "Status":
+		writeGRPCMessage(w, statusMessage(s.Status()))
+		writeGRPCStatus(w, grpcOK, "")
+	case "ListClients":
+		var resp protoMessage
+		for _, client := range s.registry.Clients() {
+			resp.message(1, clientMessage(newAdminClient(client)))
+		}
+		writeGRPCMessage(w, resp)
+		writeGRPCStatus(w, grpcOK, "")
+	case "Disconnect":
+		err = s.Disconnect(fields.uint(1), fields.str(2))
+		if err != nil {
+			writeGRPCError(w, err)
+			return
+		}
+		s.Logger.Info("Admin disconnected client", slog.String("Func", "serveGRPC"), slog.String("Admin", requestAdminKey(r).Name),
+			slog.Uint64("ClientID", fields.uint(1)))
+		writeGRPCMessage(w, nil)
+		writeGRPCStatus(w, grpcOK, "")
+	case "HideTunnel":
+		err = s.HideTunnel(fields.uint(1), fields.str(2), int(fields.uint(3)), fields.str(4))
+		if err != nil {
+			writeGRPCError(w, err)
+			return
+		}
+		writeGRPCMessage(w, nil)
+		writeGRPCStatus(w, grpcOK, "")
+	case "TrafficHistory":
+		client, err := s.adminClient(strconv.FormatUint(fields.uint(1), 10))
+		var buckets []TrafficBucket
+		if err == nil {
+			buckets, err = s.TrafficHistory(client.Identity.CN, fields.str(2), int(fields.uint(3)), fields.uint(4) != 0)
+		}
+		if err != nil {
+			writeGRPCError(w, err)
+			return
+		}
+		var resp protoMessage
+		for _, b := range buckets {
+			var bucket protoMessage
+			bucket.int(1, b.Start.Unix())
+			bucket.uint(2, b.BytesIn)
+			bucket.uint(3, b.BytesOut)
+			bucket.uint(4, b.Conns)
+			resp.message(1, bucket)
+		}
+		writeGRPCMessage(w, resp)
+		writeGRPCStatus(w, grpcOK, "")
+	case "InspectedRequests":
+		requests, err := s.InspectedRequests(fields.uint(1), fields.str(2), int(fields.uint(3)))
+		if err != nil {
+			writeGRPCError(w, err)
+			return
+		}
+		var resp protoMessage
+		for _, r := range requests {
+			var request protoMessage
+			request.int(1, r.Time.UnixMilli())
+			request.str(2, r.Method)
+			request.str(3, r.Path)
+			request.uint(4, uint64(r.Status))
+			request.uint(5, uint64(r.Latency.Milliseconds()))
+			request.uint(6, uint64(r.BytesIn))
+			request.uint(7, uint64(r.BytesOut))
+			resp.message(1, request)
+		}
+		writeGRPCMessage(w, resp)
+		writeGRPCStatus(w, grpcOK, "")
+	case "WatchEvents":
+		s.watchEvents(w, r, fields.strs(1))
+	default:
+		writeGRPCStatus(w, grpcUnimplemented, "unknown method "+r.PathValue("method"))
+	}
+}
+
+// eventStream passes the events of the server to a WatchEvents call until done is closed.
+type eventStream struct {
+	events chan Event
+	done   chan struct{}
+}
+
+func (e *eventStream) HandleEvent(event Event) {
+	select {
+	case e.events <- event:
+	case <-e.done:
+	}
+}
+
+// watchEvents streams the events of the kinds, or of all kinds if none are given, until the call is cancelled or the
+// server stops.
+func (s *Server) watchEvents(w http.ResponseWriter, r *http.Request, kinds []string) {
+	s.followEvents(w, r, kinds, 0, nil, func(event Event) {
+		writeGRPCMessage(w, eventMessage(event))
+	})
+}
+
+// followEvents passes the events of the kinds, or of all kinds if none are given, to send until the request is
+// cancelled, flushing the response after each, and calls idle if no event was sent for the interval. Events are dropped
+// if the caller doesn't keep up, see EventBus.
+func (s *Server) followEvents(w http.ResponseWriter, r *http.Request, kinds []string, interval time.Duration, idle func(), send func(Event)) {
+	stream := &eventStream{events: make(chan Event), done: make(chan struct{})}
+	unsubscribe := s.Subscribe(stream)
+	defer unsubscribe()
+	defer close(stream.done)
+	// the headers are sent right away, so the caller knows it is subscribed
+	_ = http.NewResponseController(w).Flush()
+	var tick <-chan time.Time
+	if idle != nil {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-tick:
+			idle()
+		case event := <-stream.events:
+			if len(kinds) > 0 && !slices.Contains(kinds, event.Kind) {
+				continue
+			}
+			send(event)
+		}
+		err := http.NewResponseController(w).Flush()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readGRPCMessage reads the single length-prefixed message of a unary or server streaming call.
+func readGRPCMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	_, err := io.ReadFull(body, prefix[:])
+	if err != nil {
+		return nil, errors.New("missing request message")
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > GRPCMAXMESSAGE {
+		return nil, errors.New("request message too large")
+	}
+	msg := make([]byte, size)
+	_, err = io.ReadFull(body, msg)
+	if err != nil {
+		return nil, errors.New("truncated request message")
+	}
+	return msg, nil
+}
+
+func writeGRPCMessage(w http.ResponseWriter, msg protoMessage) {
+	prefix := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	_, _ = w.Write(append(prefix, msg...))
+}
+
+// writeGRPCStatus ends the call with the status in the trailers.
+func writeGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set("Grpc-Message", grpcEscape(message))
+	}
+}
+
+// writeGRPCError ends the call with the status matching the error, see writeAdminError.
+func writeGRPCError(w http.ResponseWriter, err error) {
+	code := grpcInvalidArgument
+	if errors.Is(err, ErrNoClient) || errors.Is(err, ErrNoTunnel) || errors.Is(err, ErrNoHistory) || errors.Is(err, ErrNotInspected) {
+		code = grpcNotFound
+	}
+	writeGRPCStatus(w, code, err.Error())
+}
+
+// grpcEscape percent-encodes the message of a status like gRPC requires.
+func grpcEscape(message string) string {
+	var b strings.Builder
+	for i := 0; i < len(message); i++ {
+		c := message[i]
+		if c < ' ' || c > '~' || c == '%' {
+			b.WriteString("%" + strings.ToUpper(strconv.FormatUint(uint64(c)|0x100, 16)[1:]))
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func statusMessage(status AdminStatus) protoMessage {
+	var msg protoMessage
+	msg.uint(1, uint64(status.Clients))
+	msg.uint(2, uint64(status.Tunnels))
+	msg.uint(3, uint64(status.ActiveConns))
+	msg.uint(4, status.Accepted)
+	msg.uint(5, status.BytesIn)
+	msg.uint(6, status.BytesOut)
+	return msg
+}
+
+func clientMessage(client AdminClient) protoMessage {
+	var msg protoMessage
+	msg.uint(1, client.ID)
+	msg.str(2, client.CN)
+	msg.str(3, client.Tenant)
+	msg.str(4, client.Address)
+	msg.int(5, client.Connected.Unix())
+	if client.Suspended {
+		msg.uint(6, 1)
+	}
+	for _, tunnel := range client.Tunnels {
+		msg.message(7, tunnelMessage(tunnel))
+	}
+	return msg
+}
+
+func tunnelMessage(tunnel AdminTunnel) protoMessage {
+	var msg protoMessage
+	msg.str(1, tunnel.Network)
+	msg.uint(2, uint64(tunnel.Port))
+	msg.uint(3, uint64(tunnel.PublicPort))
+	msg.str(4, tunnel.Name)
+	msg.uint(5, uint64(tunnel.ActiveConns))
+	msg.uint(6, tunnel.Accepted)
+	msg.uint(7, tunnel.BytesIn)
+	msg.uint(8, tunnel.BytesOut)
+	msg.str(9, tunnel.Host)
+	msg.str(10, tunnel.Path)
+	msg.uint(11, uint64(tunnel.HalfClosed))
+	msg.uint(12, tunnel.ForceClosed)
+	for _, stack := range tunnel.StuckStacks {
+		msg.str(13, stack)
+	}
+	return msg
+}
+
+func eventMessage(event Event) protoMessage {
+	var msg protoMessage
+	msg.str(1, event.Kind)
+	msg.int(2, event.Time.UnixNano())
+	msg.uint(3, event.ClientID)
+	msg.str(4, event.Client.CN)
+	msg.str(5, event.Client.Tenant)
+	msg.str(6, event.Address)
+	if event.Tunnel.Network != "" {
+		msg.message(7, tunnelMessage(AdminTunnel{Network: event.Tunnel.Network, Port: event.Tunnel.Port, PublicPort: event.Tunnel.PublicPort, Name: event.Tunnel.Name, Host: event.Tunnel.Host, Path: event.Tunnel.Path}))
+	}
+	msg.str(8, event.Reason)
+	msg.uint(9, event.BytesIn)
+	msg.uint(10, event.BytesOut)
+	msg.uint(11, event.Conns)
+	return msg
+}
+
+// protoMessage is a protobuf message in wire format. Fields with their zero value are left out, like proto3 does.
+type protoMessage []byte
+
+// Wire types of protobuf fields.
+const (
+	protoVarint = 0
+	protoBytes  = 2
+)
+
+func (m *protoMessage) uint(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	*m = binary.AppendUvarint(*m, uint64(field)<<3|protoVarint)
+	*m = binary.AppendUvarint(*m, v)
+}
+
+// int adds an int64 field, negative values take ten bytes like in protobuf.
+func (m *protoMessage) int(field int, v int64) {
+	m.uint(field, uint64(v))
+}
+
+func (m *protoMessage) str(field int, v string) {
+	if v == "" {
+		return
+	}
+	m.bytes(field, []byte(v))
+}
+
+func (m *protoMessage) message(field int, v protoMessage) {
+	m.bytes(field, v)
+}
+
+func (m *protoMessage) bytes(field int, v []byte) {
+	*m = binary.AppendUvarint(*m, uint64(field)<<3|protoBytes)
+	*m = binary.AppendUvarint(*m, uint64(len(v)))
+	*m = append(*m, v...)
+}
+
+// protoFields are the varint and length-delimited fields of a parsed message by number, the last value of a field
+// that is not repeated counts.
+type protoFields struct {
+	varints map[int]uint64
+	bytes   map[int][][]byte
+}
+
+// parseProto parses a message in wire format. Fixed size fields are skipped, as the requests have none.
+func parseProto(data []byte) (protoFields, error) {
+	fields := protoFields{varints: make(map[int]uint64), bytes: make(map[int][][]byte)}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fields, errors.New("invalid field key")
+		}
+		data = data[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case protoVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fields, errors.New("invalid varint field " + strconv.Itoa(field))
+			}
+			fields.varints[field] = v
+			data = data[n:]
+		case protoBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return fields, errors.New("invalid length-delimited field " + strconv.Itoa(field))
+			}
+			fields.bytes[field] = append(fields.bytes[field], data[n:n+int(size)])
+			data = data[n+int(size):]
+		case 1:
+			if len(data) < 8 {
+				return fields, errors.New("truncated field " + strconv.Itoa(field))
+			}
+			data = data[8:]
+		case 5:
+			if len(data) < 4 {
+				return fields, errors.New("truncated field " + strconv.Itoa(field))
+			}
+			data = data[4:]
+		default:
+			return fields, errors.New("unsupported wire type of field " + strconv.Itoa(field))
+		}
+	}
+	return fields, nil
+}
+
+func (f protoFields) uint(field int) uint64 {
+	return f.varints[field]
+}
+
+func (f protoFields) str(field int) string {
+	values := f.bytes[field]
+	if len(values) == 0 {
+		return ""
+	}
+	return string(values[len(values)-1])
+}
+
+// strs returns the values of a repeated string field.
+func (f protoFields) strs(field int) []string {
+	values := make([]string, 0, len(f.bytes[field]))
+	for _, v := range f.bytes[field] {
+		values = append(values, string(v))
+	}
+	return values
+}
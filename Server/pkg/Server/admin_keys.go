@@ -0,0 +1,150 @@
+package Server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Roles of admin API keys, each one may do what the ones before it may:
+//
+//	read      read the state of the server, its clients, tunnels, traffic and events
+//	operator  hide the exposed ports of clients
+//	admin     disconnect clients and change the settings, profiles and reserved ports of the server
+const (
+	ADMINROLEREAD     = "read"
+	ADMINROLEOPERATOR = "operator"
+	ADMINROLEADMIN    = "admin"
+)
+
+var adminRoleRanks = map[string]int{ADMINROLEREAD: 1, ADMINROLEOPERATOR: 2, ADMINROLEADMIN: 3}
+
+// ADMINTOKENNAME is the name the requests with Config.AdminToken are audited with, it has the admin role.
+const ADMINTOKENNAME = "token"
+
+// AdminKey is an API key of the admin API. The Name of the key is logged with the changes made with it.
+type AdminKey struct {
+	Name string
+	Key  string
+	Role string
+}
+
+// LoadAdminKeys loads the API keys of the admin API from a JSON file holding a list of AdminKey, and returns them by
+// key. An empty path loads no keys.
+func LoadAdminKeys(path string) (map[string]AdminKey, error) {
+	keys := make(map[string]AdminKey)
+	if path == "" {
+		return keys, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []AdminKey
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range list {
+		if _, ok := keys[k.Key]; ok {
+			return nil, errors.New("duplicate admin key " + k.Name)
+		}
+		keys[k.Key] = k
+	}
+	return keys, nil
+}
+
+// validateAdminKeys checks that the admin API keys are named, long enough and have a known role.
+func (c *Config) validateAdminKeys() error {
+	for key, k := range c.AdminKeys {
+		if k.Name == "" {
+			return errors.New("admin key without name")
+		}
+		if len(key) < MINTOKENLENGTH {
+			return errors.New("admin key " + k.Name + " shorter than " + strconv.Itoa(MINTOKENLENGTH) + " bytes")
+		}
+		if adminRoleRanks[k.Role] == 0 {
+			return errors.New("unknown role " + k.Role + " of admin key " + k.Name)
+		}
+	}
+	return nil
+}
+
+// adminKeyContext is the context key of the AdminKey a request was authenticated with.
+type adminKeyContext struct{}
+
+// requestAdminKey returns the key the request was authenticated with by adminAuth.
+func requestAdminKey(r *http.Request) AdminKey {
+	k, _ := r.Context().Value(adminKeyContext{}).(AdminKey)
+	return k
+}
+
+// allows reports whether the key has the role or one that may do more.
+func (k AdminKey) allows(role string) bool {
+	return adminRoleRanks[k.Role] >= adminRoleRanks[role]
+}
+
+// requireRole lets the requests authenticated with a key of the role, or one that may do more, through to next, and
+// logs those changing something with the name of the key.
+func (s *Server) requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorize(w, r, role) {
+			return
+		}
+		next(w, r)
+	}
+}
+
+// authorize reports whether the key of the request has the role. Otherwise the request is answered as forbidden.
+// Allowed requests needing more than the read role are logged for auditing.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, role string) bool {
+	k := requestAdminKey(r)
+	if !k.allows(role) {
+		s.Logger.Warn("Forbidden admin request", slog.String("Func", "authorize"), slog.String("Admin", k.Name),
+			slog.String("Role", k.Role), slog.String("Path", r.URL.Path))
+		if isGRPC(r) {
+			writeGRPCStatus(w, grpcPermissionDenied, "forbidden, needs the "+role+" role")
+			return false
+		}
+		writeAdminJSON(w, http.StatusForbidden, map[string]string{"error": "forbidden, needs the " + role + " role"})
+		return false
+	}
+	if role != ADMINROLEREAD {
+		s.Logger.Info("Admin request", slog.String("Func", "authorize"), slog.String("Admin", k.Name), slog.String("Role", k.Role),
+			slog.String("Method", r.Method), slog.String("Path", r.URL.RequestURI()), slog.String("Address", r.RemoteAddr))
+	}
+	return true
+}
+
+// adminKey returns the key of the bearer token, Config.AdminToken standing for a key of the admin role.
+func (s *Server) adminKey(token string) (AdminKey, bool) {
+	config := s.current()
+	// compare the hashes, so the time taken tells nothing about the keys
+	hash := sha256.Sum256([]byte(token))
+	var found AdminKey
+	ok := false
+	if config.AdminToken != "" {
+		known := sha256.Sum256([]byte(config.AdminToken))
+		if subtle.ConstantTimeCompare(hash[:], known[:]) == 1 {
+			found, ok = AdminKey{Name: ADMINTOKENNAME, Role: ADMINROLEADMIN}, true
+		}
+	}
+	for key, k := range config.AdminKeys {
+		known := sha256.Sum256([]byte(key))
+		if subtle.ConstantTimeCompare(hash[:], known[:]) == 1 {
+			found, ok = k, true
+		}
+	}
+	return found, ok
+}
+
+// withAdminKey returns the request with the key it was authenticated with.
+func withAdminKey(r *http.Request, k AdminKey) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), adminKeyContext{}, k))
+}
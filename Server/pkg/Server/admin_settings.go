@@ -0,0 +1,191 @@
+package Server
+
+import (
+	"errors"
+	"log/slog"
+	"maps"
+	"strconv"
+	"strings"
+)
+
+// AdminSettings are the settings of the server that can be changed through the admin API while it runs, see
+// Server.UpdateSettings. Quotas are in the form of ParseQuota, LogLevel is empty if Server.LogLevel isn't set.
+type AdminSettings struct {
+	LogLevel       string            `json:"logLevel,omitempty"`
+	MaxConns       int               `json:"maxConns"`
+	MaxClientConns int               `json:"maxClientConns"`
+	DefaultQuota   string            `json:"defaultQuota"`
+	ClientQuotas   map[string]string `json:"clientQuotas"`
+}
+
+// AdminSettingsUpdate changes the settings that are set. ClientQuotas only changes the quotas of the CNs it holds,
+// an empty quota removes the quota of the CN.
+type AdminSettingsUpdate struct {
+	LogLevel       *string           `json:"logLevel,omitempty"`
+	MaxConns       *int              `json:"maxConns,omitempty"`
+	MaxClientConns *int              `json:"maxClientConns,omitempty"`
+	DefaultQuota   *string           `json:"defaultQuota,omitempty"`
+	ClientQuotas   map[string]string `json:"clientQuotas,omitempty"`
+}
+
+// Settings returns the settings in effect that UpdateSettings changes.
+func (s *Server) Settings() AdminSettings {
+	config := s.current()
+	settings := AdminSettings{
+		MaxConns:       config.MaxConns,
+		MaxClientConns: config.MaxClientConns,
+		DefaultQuota:   config.DefaultQuota.String(),
+		ClientQuotas:   make(map[string]string, len(config.ClientQuotas)),
+		LogLevel:       logLevelName(s.LogLevel),
+	}
+	for cn, q := range config.ClientQuotas {
+		settings.ClientQuotas[cn] = q.String()
+	}
+	return settings
+}
+
+// UpdateSettings changes the log level, the caps of relayed connections and the quotas while the server runs, and
+// returns the settings in effect. The caps apply to the next relayed connection, the quotas to the next port a
+// client exposes. An invalid update changes nothing. The changes are kept in the store of the server, so they outlive
+// reloading the config and, with Config.StoreFile, restarts.
+func (s *Server) UpdateSettings(update AdminSettingsUpdate) (AdminSettings, error) {
+	err := s.updateState(func(st *state) error {
+		st.settings.merge(update)
+		return nil
+	})
+	if err != nil {
+		return AdminSettings{}, err
+	}
+	settings := s.Settings()
+	s.Logger.Info("Changed settings", slog.String("Func", "UpdateSettings"), slog.Int("MaxConns", settings.MaxConns),
+		slog.Int("MaxClientConns", settings.MaxClientConns), slog.String("DefaultQuota", settings.DefaultQuota),
+		slog.Int("ClientQuotas", len(settings.ClientQuotas)), slog.String("LogLevel", settings.LogLevel))
+	return settings, nil
+}
+
+// merge sets the settings that next sets, and merges the client quotas.
+func (u *AdminSettingsUpdate) merge(next AdminSettingsUpdate) {
+	if next.LogLevel != nil {
+		u.LogLevel = next.LogLevel
+	}
+	if next.MaxConns != nil {
+		u.MaxConns = next.MaxConns
+	}
+	if next.MaxClientConns != nil {
+		u.MaxClientConns = next.MaxClientConns
+	}
+	if next.DefaultQuota != nil {
+		u.DefaultQuota = next.DefaultQuota
+	}
+	if len(next.ClientQuotas) > 0 && u.ClientQuotas == nil {
+		u.ClientQuotas = make(map[string]string)
+	}
+	// removed quotas are kept empty, so they stay removed from the config
+	maps.Copy(u.ClientQuotas, next.ClientQuotas)
+}
+
+// applyTo changes the settings of the config that the update sets, besides the log level.
+func (u *AdminSettingsUpdate) applyTo(config *Config) error {
+	if u.MaxConns != nil {
+		config.MaxConns = *u.MaxConns
+	}
+	if u.MaxClientConns != nil {
+		config.MaxClientConns = *u.MaxClientConns
+	}
+	if u.DefaultQuota != nil {
+		q, err := ParseQuota(*u.DefaultQuota)
+		if err != nil {
+			return err
+		}
+		config.DefaultQuota = q
+	}
+	if len(u.ClientQuotas) > 0 {
+		// the map is shared with the config in effect
+		config.ClientQuotas = maps.Clone(config.ClientQuotas)
+		if config.ClientQuotas == nil {
+			config.ClientQuotas = make(map[string]Quota)
+		}
+		for cn, quota := range u.ClientQuotas {
+			if cn == "" {
+				return errors.New("client quota without CN")
+			}
+			if quota == "" {
+				delete(config.ClientQuotas, cn)
+				continue
+			}
+			q, err := ParseQuota(quota)
+			if err != nil {
+				return err
+			}
+			config.ClientQuotas[cn] = q
+		}
+	}
+	return nil
+}
+
+// logLevelName returns the name of the level in the form of the -loglevel flag, empty for nil.
+func logLevelName(level *slog.LevelVar) string {
+	if level == nil {
+		return ""
+	}
+	return strings.ToLower(level.Level().String())
+}
+
+// Profiles returns the profiles in effect by CN, those of the config and those set by SetProfile.
+func (s *Server) Profiles() map[string]Profile {
+	return maps.Clone(s.current().Profiles)
+}
+
+// SetProfile sets the profile of the client with the CN of the profile, in place of the one of the config. It applies
+// from the next request of the client, its connection limit at once.
+func (s *Server) SetProfile(p Profile) error {
+	return s.updateState(func(st *state) error {
+		st.profiles[p.CN] = p
+		return nil
+	})
+}
+
+// RemoveProfile removes the profile set by SetProfile for the client with the CN, the one of the config applies
+// again. ErrNotStored is returned if none was set.
+func (s *Server) RemoveProfile(cn string) error {
+	return s.updateState(func(st *state) error {
+		if _, ok := st.profiles[cn]; !ok {
+			return ErrNotStored
+		}
+		delete(st.profiles, cn)
+		return nil
+	})
+}
+
+// ReservedPorts returns the reserved ports in effect with the CN of the client that may expose them, those of the
+// config and those set by ReservePort.
+func (s *Server) ReservedPorts() map[int]string {
+	return maps.Clone(s.current().ReservedPorts)
+}
+
+// ReservePort reserves the public port for the client with the CN, in place of an owner the config sets. Clients
+// exposing it already keep it until they hide it.
+func (s *Server) ReservePort(port int, cn string) error {
+	if !validPort(port) {
+		return errors.New("invalid port " + strconv.Itoa(port))
+	}
+	if cn == "" {
+		return errors.New("reserved port without CN")
+	}
+	return s.updateState(func(st *state) error {
+		st.reserved[port] = cn
+		return nil
+	})
+}
+
+// UnreservePort removes the reservation of the port set by ReservePort, one of the config applies again.
+// ErrNotStored is returned if none was set.
+func (s *Server) UnreservePort(port int) error {
+	return s.updateState(func(st *state) error {
+		if _, ok := st.reserved[port]; !ok {
+			return ErrNotStored
+		}
+		delete(st.reserved, port)
+		return nil
+	})
+}
@@ -0,0 +1,191 @@
+package Server
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Assignment is the public port the server assigned to an exposed port of a client.
+type Assignment struct {
+	CN         string
+	Network    string
+	Port       int
+	PublicPort int
+}
+
+// Assignments remembers the public ports assigned to the exposed ports of clients, so a client exposing its port with
+// public=any gets the same public port back after reconnecting, and published URLs stay stable. If a path or a store
+// is set, the assignments are saved to a JSON file or to STOREASSIGNMENTS on every change and survive restarts of the
+// server.
+//
+// Proxy ports are not remembered, clients learn them with every CTRLCONNECT frame. A nil *Assignments remembers nothing.
+type Assignments struct {
+	mu    sync.Mutex
+	path  string
+	store Store
+	ports map[string]Assignment
+}
+
+// LoadAssignments loads the assignments saved at path. A missing file is no error, the server starts without
+// assignments then. An empty path keeps the assignments in memory only.
+func LoadAssignments(path string) (*Assignments, error) {
+	a := &Assignments{path: path, ports: make(map[string]Assignment)}
+	if path == "" {
+		return a, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return a, nil
+	}
+	if err != nil {
+		return a, err
+	}
+	var list []Assignment
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return a, err
+	}
+	for _, as := range list {
+		a.ports[assignmentKey(as.CN, as.Network, as.Port)] = as
+	}
+	return a, nil
+}
+
+// loadStoredAssignments loads the assignments saved in the store, and saves them there.
+func loadStoredAssignments(store Store) (*Assignments, error) {
+	a := &Assignments{store: store, ports: make(map[string]Assignment)}
+	stored, err := store.List(STOREASSIGNMENTS)
+	if err != nil {
+		return a, err
+	}
+	for key, data := range stored {
+		var as Assignment
+		err = json.Unmarshal(data, &as)
+		if err != nil {
+			return a, errors.New("invalid stored assignment " + key + ": " + err.Error())
+		}
+		a.ports[key] = as
+	}
+	return a, nil
+}
+
+// Get returns the public port assigned to the port of the client with the certificate CN.
+func (a *Assignments) Get(cn string, network string, port int) (int, bool) {
+	if a == nil {
+		return 0, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	as, ok := a.ports[assignmentKey(cn, network, port)]
+	return as.PublicPort, ok
+}
+
+// Set assigns the public port to the port of the client and saves the assignments.
+func (a *Assignments) Set(cn string, network string, port int, publicPort int) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := assignmentKey(cn, network, port)
+	if a.ports[key].PublicPort == publicPort {
+		return nil
+	}
+	a.ports[key] = Assignment{CN: cn, Network: network, Port: port, PublicPort: publicPort}
+	return a.save(key)
+}
+
+// Remove forgets the assignment of the port of the client and saves the assignments.
+func (a *Assignments) Remove(cn string, network string, port int) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := assignmentKey(cn, network, port)
+	if _, ok := a.ports[key]; !ok {
+		return nil
+	}
+	delete(a.ports, key)
+	return a.save(key)
+}
+
+// Transfer moves the assignments of the client with the certificate CN from to the client with the CN to, replacing
+// those of to for the same ports, and saves the assignments.
+func (a *Assignments) Transfer(from string, to string) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var moved []string
+	for key, as := range a.ports {
+		if as.CN != from {
+			continue
+		}
+		delete(a.ports, key)
+		as.CN = to
+		a.ports[assignmentKey(to, as.Network, as.Port)] = as
+		moved = append(moved, key, assignmentKey(to, as.Network, as.Port))
+	}
+	if len(moved) == 0 {
+		return nil
+	}
+	return a.save(moved...)
+}
+
+// save saves the assignments of the changed keys to the store, if one is set. Otherwise it writes all assignments to
+// a temporary file and renames it, so a crash never leaves a partial file behind. a.mu must be held.
+func (a *Assignments) save(changed ...string) error {
+	if a.store != nil {
+		for _, key := range changed {
+			as, ok := a.ports[key]
+			if !ok {
+				err := a.store.Delete(STOREASSIGNMENTS, key)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			data, err := json.Marshal(as)
+			if err != nil {
+				return err
+			}
+			err = a.store.Put(STOREASSIGNMENTS, key, data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if a.path == "" {
+		return nil
+	}
+	list := make([]Assignment, 0, len(a.ports))
+	for _, as := range a.ports {
+		list = append(list, as)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(a.path), 0700)
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
+
+func assignmentKey(cn string, network string, port int) string {
+	return cn + "/" + network + "/" + strconv.Itoa(port)
+}
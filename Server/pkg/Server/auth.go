@@ -0,0 +1,138 @@
+package Server
+
+import (
+	"Utils"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Token authentication of clients without certificate, see Utils.CTRLAUTH.
+const (
+	// AUTHTIMEOUT is how long a client without certificate has to send its CTRLAUTH frame
+	AUTHTIMEOUT = 10 * time.Second
+	// MINTOKENLENGTH is the minimum length of pre-shared tokens, so they can't be guessed
+	MINTOKENLENGTH = 16
+)
+
+// How a client authenticated, see ClientIdentity.Auth.
+const (
+	AUTHCERT  = "cert"
+	AUTHTOKEN = "token"
+	AUTHJWT   = "jwt"
+	AUTHNOISE = "noise"
+)
+
+// ClientToken is a pre-shared token of a client. The CN takes the place of the certificate CN in the policies of the
+// server for the client presenting the token.
+type ClientToken struct {
+	CN    string
+	Token string
+}
+
+// LoadTokens loads the pre-shared tokens of the clients from a JSON file holding a list of ClientToken, and returns
+// the CNs by token. An empty path loads no tokens.
+func LoadTokens(path string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	if path == "" {
+		return tokens, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []ClientToken
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range list {
+		if _, ok := tokens[t.Token]; ok {
+			return nil, errors.New("duplicate token of client " + t.CN)
+		}
+		tokens[t.Token] = t.CN
+	}
+	return tokens, nil
+}
+
+// tokenAuth reports whether clients may authenticate with tokens instead of certificates.
+func (c *Config) tokenAuth() bool {
+	return len(c.AuthTokens) > 0 || c.JWT.enabled()
+}
+
+// validateTokens checks that the pre-shared tokens are long enough and name a client.
+func (c *Config) validateTokens() error {
+	for token, cn := range c.AuthTokens {
+		if cn == "" {
+			return errors.New("token without CN")
+		}
+		if len(token) < MINTOKENLENGTH || len(token) > Utils.MAXAUTHTOKEN {
+			return errors.New("token of client " + cn + " shorter than " + strconv.Itoa(MINTOKENLENGTH) + " or longer than " + strconv.Itoa(Utils.MAXAUTHTOKEN) + " bytes")
+		}
+	}
+	return c.JWT.validate()
+}
+
+// authenticate lets a client without certificate authenticate with a token, if the server accepts tokens. It reads
+// the CTRLAUTH frame of the client, answers it and returns the identity the token stands for. Clients with
+// certificate or Noise key keep their identity.
+func (c *Config) authenticate(conn net.Conn, identity ClientIdentity) (ClientIdentity, error) {
+	if identity.Auth == AUTHNOISE {
+		return identity, nil
+	}
+	if identity.CN != "" {
+		identity.Auth = AUTHCERT
+		return identity, nil
+	}
+	if !c.tokenAuth() {
+		return identity, nil
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(AUTHTIMEOUT))
+	fr, err := Utils.ReadFrame(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return identity, err
+	}
+	if fr.Typ != Utils.CTRLAUTH || len(fr.Data) != 1 {
+		return identity, errors.New("client neither presented a certificate nor a token")
+	}
+	cn, method, err := c.verifyToken(fr.Data[0])
+	if err != nil {
+		return identity, err
+	}
+	identity.CN = cn
+	identity.Auth = method
+	return identity, Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLAUTH, []string{cn}))
+}
+
+// verifyToken returns the CN the token stands for and whether it is a pre-shared token or a JWT.
+func (c *Config) verifyToken(token string) (string, string, error) {
+	if c.JWT.enabled() && strings.Count(token, ".") == 2 {
+		cn, err := c.JWT.verify(token, time.Now())
+		return cn, AUTHJWT, err
+	}
+	// compare the hashes, so the time taken tells nothing about the tokens
+	hash := sha256.Sum256([]byte(token))
+	cn := ""
+	for known, knownCN := range c.AuthTokens {
+		knownHash := sha256.Sum256([]byte(known))
+		if subtle.ConstantTimeCompare(hash[:], knownHash[:]) == 1 {
+			cn = knownCN
+		}
+	}
+	if cn == "" {
+		return "", "", errors.New("unknown token")
+	}
+	return cn, AUTHTOKEN, nil
+}
+
+// refuseAuth tells a client that failed to authenticate why, before its connection is closed.
+func refuseAuth(conn net.Conn, err error) {
+	_ = Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLERROR, []string{"", "", "authentication failed: " + err.Error(), Utils.ERRAUTH}))
+}
@@ -0,0 +1,120 @@
+package Server
+
+import (
+	"Utils"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+)
+
+// AuthzRule allows or denies clients to expose public ports. Before every EXPOSE the rules are consulted in order,
+// the first rule matching the client, the network and the port decides. If there are rules, ports no rule matches
+// are denied.
+type AuthzRule struct {
+	// Name identifies the rule in the errors sent to clients it denies
+	Name string
+	// CN is a pattern of path.Match the certificate CN of the client has to match, empty matches every client
+	CN string
+	// Tenant is the tenant of the client, empty matches every client
+	Tenant string
+	// Networks are "tcp" and "udp", empty matches both
+	Networks []string
+	// Ports are the public ports, empty matches every port
+	Ports []PortRange
+	// Deny denies the ports, instead of allowing them
+	Deny bool
+}
+
+// LoadAuthzRules loads the authorization rules from a JSON file holding a list of rules, in the order they are
+// consulted. An empty path loads no rules, which allows every port the other settings allow.
+func LoadAuthzRules(path string) ([]AuthzRule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var rules []AuthzRule
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// validate checks the pattern, the networks and the ports of the rule.
+func (r *AuthzRule) validate() error {
+	if r.Name == "" {
+		return errors.New("authorization rule without name")
+	}
+	if _, err := path.Match(r.CN, ""); err != nil {
+		return errors.New("invalid CN pattern in authorization rule " + r.Name)
+	}
+	for _, network := range r.Networks {
+		if network != "tcp" && network != "udp" {
+			return errors.New("invalid network " + network + " in authorization rule " + r.Name)
+		}
+	}
+	for _, ports := range r.Ports {
+		if !ports.valid() {
+			return errors.New("invalid port range in authorization rule " + r.Name)
+		}
+	}
+	return nil
+}
+
+// matches reports whether the rule applies to the port of the network exposed by the client with the certificate
+// CN of the tenant.
+func (r *AuthzRule) matches(port int, network string, cn string, tenant string) bool {
+	if r.CN != "" {
+		if ok, _ := path.Match(r.CN, cn); !ok {
+			return false
+		}
+	}
+	if r.Tenant != "" && r.Tenant != tenant {
+		return false
+	}
+	if len(r.Networks) > 0 && !slices.Contains(r.Networks, network) {
+		return false
+	}
+	return len(r.Ports) == 0 || inRanges(port, r.Ports)
+}
+
+// validateAuthzRules checks the rules and that their names are unique.
+func (c *Config) validateAuthzRules() error {
+	names := make(map[string]bool)
+	for i := range c.AuthzRules {
+		r := &c.AuthzRules[i]
+		if err := r.validate(); err != nil {
+			return err
+		}
+		if names[r.Name] {
+			return errors.New("duplicate authorization rule " + r.Name)
+		}
+		names[r.Name] = true
+	}
+	return nil
+}
+
+// checkAuthz returns ERRFORBIDDEN and the reason naming the deciding rule if the rules deny the client with the
+// certificate CN of the tenant the public port of the network, or empty strings if they allow it.
+func (c *Config) checkAuthz(port int, network string, cn string, tenant string) (string, string) {
+	if len(c.AuthzRules) == 0 {
+		return "", ""
+	}
+	target := strconv.Itoa(port) + "/" + network
+	for _, r := range c.AuthzRules {
+		if !r.matches(port, network, cn, tenant) {
+			continue
+		}
+		if r.Deny {
+			return Utils.ERRFORBIDDEN, "port " + target + " denied by rule " + r.Name
+		}
+		return "", ""
+	}
+	return Utils.ERRFORBIDDEN, "port " + target + " not allowed by any rule"
+}
@@ -0,0 +1,203 @@
+package Server
+
+import (
+	"Utils"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DEFAULTBANWINDOW is the default time failures of a source IP are counted over, DEFAULTBANDURATION the default time
+// it is banned for, see Config.BanThreshold.
+const (
+	DEFAULTBANWINDOW   = time.Minute
+	DEFAULTBANDURATION = 15 * time.Minute
+)
+
+// BANIMMEDIATE is the time within which an external connection closed without sending anything counts as a failure.
+const BANIMMEDIATE = time.Second
+
+// MAXBANSOURCES is the maximum amount of source IPs the ban list keeps failures and bans of. Once reached, failures
+// of further sources are not counted until older ones expire.
+const MAXBANSOURCES = 4096
+
+// Failure signals counted towards a ban, as reported by Ban.Reason.
+const (
+	// FAILBLOCKED is a connection, UDP session or request refused by the allow and deny lists of a port
+	FAILBLOCKED = "blocked"
+	// FAILDISCONNECT is an external connection the visitor closed or reset within BANIMMEDIATE without sending
+	// anything, before the service closed it
+	FAILDISCONNECT = "disconnect"
+	// FAILAUTH is a request to the HTTP front with wrong credentials of basicauth
+	FAILAUTH = "auth"
+	// FAILHANDSHAKE is a control connection failing its TLS or Noise handshake
+	FAILHANDSHAKE = "handshake"
+)
+
+// ErrNotBanned is returned for an IP that is not banned
+var ErrNotBanned = errors.New("IP not banned")
+
+// Ban is a source IP banned in the admin API.
+type Ban struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"`
+	Until  time.Time `json:"until"`
+}
+
+// banRecord counts the failures of a source IP since the start of its window.
+type banRecord struct {
+	failures int
+	since    time.Time
+}
+
+// banList bans the source IPs with Config.BanThreshold failures within Config.BanWindow for Config.BanDuration.
+// Banned IPs are refused on the control listener, the exposed ports and the HTTP front. The zero value is ready to
+// use and bans nobody until setPolicy is called. A nil banList bans nobody.
+type banList struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+	records   map[netip.Addr]*banRecord
+	bans      map[netip.Addr]Ban
+	logger    *slog.Logger
+}
+
+// setPolicy changes the threshold, window and duration of bans, bans in effect are kept.
+func (b *banList) setPolicy(config *Config, logger *slog.Logger) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.threshold = config.BanThreshold
+	b.window = config.BanWindow
+	b.duration = config.BanDuration
+	b.logger = logger
+	if b.threshold == 0 {
+		clear(b.records)
+	}
+}
+
+// banned reports whether the IP of the peer is banned at the moment.
+func (b *banList) banned(peer net.Addr) bool {
+	ip, ok := peerIP(peer)
+	if b == nil || !ok {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ban, ok := b.bans[ip]
+	if ok && !time.Now().Before(ban.Until) {
+		delete(b.bans, ip)
+		return false
+	}
+	return ok
+}
+
+// fail counts a failure signal of the peer, and bans its IP once it reaches the threshold within the window.
+func (b *banList) fail(peer net.Addr, reason string) {
+	ip, ok := peerIP(peer)
+	if b == nil || !ok {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold == 0 {
+		return
+	}
+	now := time.Now()
+	if _, ok := b.bans[ip]; ok {
+		return
+	}
+	record := b.records[ip]
+	if record == nil || now.Sub(record.since) > b.window {
+		if len(b.records)+len(b.bans) >= MAXBANSOURCES {
+			b.expire(now)
+		}
+		if len(b.records)+len(b.bans) >= MAXBANSOURCES {
+			return
+		}
+		if b.records == nil {
+			b.records = make(map[netip.Addr]*banRecord)
+		}
+		record = &banRecord{since: now}
+		b.records[ip] = record
+	}
+	record.failures++
+	if record.failures < b.threshold {
+		return
+	}
+	delete(b.records, ip)
+	if b.bans == nil {
+		b.bans = make(map[netip.Addr]Ban)
+	}
+	b.bans[ip] = Ban{IP: ip.String(), Reason: reason, Until: now.Add(b.duration)}
+	if b.logger != nil {
+		b.logger.Warn("Banned source IP", slog.String("Func", "fail"), slog.String(Utils.PEERKEY, ip.String()),
+			slog.String("Reason", reason), slog.Duration("Duration", b.duration))
+	}
+}
+
+// expire drops the records whose window passed and the bans that ended.
+func (b *banList) expire(now time.Time) {
+	for ip, record := range b.records {
+		if now.Sub(record.since) > b.window {
+			delete(b.records, ip)
+		}
+	}
+	for ip, ban := range b.bans {
+		if !now.Before(ban.Until) {
+			delete(b.bans, ip)
+		}
+	}
+}
+
+// list returns the bans in effect, ordered by IP.
+func (b *banList) list() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.expire(time.Now())
+	ips := make([]netip.Addr, 0, len(b.bans))
+	for ip := range b.bans {
+		ips = append(ips, ip)
+	}
+	slices.SortFunc(ips, netip.Addr.Compare)
+	bans := make([]Ban, 0, len(ips))
+	for _, ip := range ips {
+		bans = append(bans, b.bans[ip])
+	}
+	return bans
+}
+
+// unban lifts the ban of the IP, and forgets its failures.
+func (b *banList) unban(ip netip.Addr) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ban, ok := b.bans[ip]
+	if !ok || !time.Now().Before(ban.Until) {
+		return ErrNotBanned
+	}
+	delete(b.bans, ip)
+	delete(b.records, ip)
+	return nil
+}
+
+// Bans returns the source IPs banned at the moment, see Config.BanThreshold.
+func (s *Server) Bans() []Ban {
+	return s.bans.list()
+}
+
+// Unban lifts the ban of the source IP before it ends. ErrNotBanned is returned if it is not banned.
+func (s *Server) Unban(ip string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return errors.New("invalid IP " + ip)
+	}
+	err = s.bans.unban(addr.Unmap())
+	if err == nil {
+		s.Logger.Info("Lifted ban", slog.String("Func", "Unban"), slog.String(Utils.PEERKEY, addr.Unmap().String()))
+	}
+	return err
+}
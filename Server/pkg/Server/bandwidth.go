@@ -0,0 +1,64 @@
+package Server
+
+import (
+	"sync"
+	"time"
+)
+
+// BANDWIDTHBURST is how much unused bandwidth a limiter saves up, so traffic after a pause isn't throttled right away.
+const BANDWIDTHBURST = time.Second
+
+// bandwidthLimiter caps the bytes per second relayed in one direction for all relays of a client, see
+// Profile.BandwidthIn. A nil limiter doesn't limit.
+type bandwidthLimiter struct {
+	rate int64
+
+	mu sync.Mutex
+	// paid is when the bytes relayed so far are within the rate, it is in the past while bandwidth is unused
+	paid time.Time
+}
+
+// newBandwidthLimiter creates a limiter for rate bytes per second, or returns nil if rate is 0.
+func newBandwidthLimiter(rate int64) *bandwidthLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &bandwidthLimiter{rate: rate}
+}
+
+// wait accounts n relayed bytes and blocks until they are within the rate.
+func (l *bandwidthLimiter) wait(n int) {
+	if delay := l.reserve(n); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// reserve accounts n relayed bytes and returns how long to wait until they are within the rate.
+func (l *bandwidthLimiter) reserve(n int) time.Duration {
+	if l == nil || n <= 0 {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.paid.Before(now.Add(-BANDWIDTHBURST)) {
+		l.paid = now.Add(-BANDWIDTHBURST)
+	}
+	l.paid = l.paid.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	return l.paid.Sub(now)
+}
+
+// bandwidthLimits are the limiters a relay is capped by in one direction, those of its client and of the tenant of the
+// client. Nil limiters in it don't limit.
+type bandwidthLimits []*bandwidthLimiter
+
+// wait accounts n relayed bytes with every limiter and blocks until they are within the rates of all of them.
+func (ls bandwidthLimits) wait(n int) {
+	var delay time.Duration
+	for _, l := range ls {
+		delay = max(delay, l.reserve(n))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
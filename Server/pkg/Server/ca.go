@@ -0,0 +1,194 @@
+package Server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Files of the built-in CA. The server reads CAFILE, SERVERCERTFILE and SERVERKEYFILE from the certs directory of
+// the home directory by default, the client CLIENTCERTFILE and CLIENTKEYFILE.
+const (
+	CAFILE         = "myCA.pem"
+	CAKEYFILE      = "myCA.key"
+	SERVERCERTFILE = "server.crt"
+	SERVERKEYFILE  = "server.key"
+	CLIENTCERTFILE = "tower.test.crt"
+	CLIENTKEYFILE  = "tower.test.key"
+	// CAVALIDITY is how long the CA is valid, certificates it issues are valid for the validity asked for
+	CAVALIDITY = 10 * 365 * 24 * time.Hour
+)
+
+// DefaultCertDir returns the certs directory of the home directory, where the server and the client look for their
+// certificates by default.
+func DefaultCertDir() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, "certs"), nil
+}
+
+// InitCA creates a CA and a server certificate it issued for the hosts, DNS names or IP addresses, in dir. An
+// existing CA is only replaced with force, as the certificates of all clients are issued by it.
+func InitCA(dir string, hosts []string, validity time.Duration, force bool) error {
+	if len(hosts) == 0 {
+		return errors.New("no host for the server certificate")
+	}
+	if _, err := os.Stat(filepath.Join(dir, CAKEYFILE)); err == nil && !force {
+		return errors.New("CA exists already in " + dir)
+	}
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template, err := certTemplate("GoExpose CA", CAVALIDITY)
+	if err != nil {
+		return err
+	}
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	err = writeKeyPair(filepath.Join(dir, CAFILE), filepath.Join(dir, CAKEYFILE), der, caKey)
+	if err != nil {
+		return err
+	}
+	return IssueServer(dir, ca, caKey, hosts, validity)
+}
+
+// IssueServer issues the server certificate for the hosts, DNS names or IP addresses, and writes it to dir.
+func IssueServer(dir string, ca *x509.Certificate, caKey crypto.Signer, hosts []string, validity time.Duration) error {
+	template, err := certTemplate(hosts[0], validity)
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	return issue(dir, SERVERCERTFILE, SERVERKEYFILE, template, ca, caKey)
+}
+
+// IssueClient issues a client certificate with the CN, which the policies of the server are keyed by, and the
+// organizational units, which may name its tenant, see Tenant. The certificate is written to outDir with the names
+// the client expects, the CA is read from caDir.
+func IssueClient(caDir string, outDir string, cn string, ous []string, validity time.Duration) error {
+	if cn == "" {
+		return errors.New("client certificate without CN")
+	}
+	ca, caKey, err := LoadCA(caDir)
+	if err != nil {
+		return err
+	}
+	template, err := certTemplate(cn, validity)
+	if err != nil {
+		return err
+	}
+	template.Subject.OrganizationalUnit = ous
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	err = os.MkdirAll(outDir, 0700)
+	if err != nil {
+		return err
+	}
+	return issue(outDir, CLIENTCERTFILE, CLIENTKEYFILE, template, ca, caKey)
+}
+
+// LoadCA loads the certificate and the key of the CA created by InitCA in dir.
+func LoadCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	return loadCAFiles(filepath.Join(dir, CAFILE), filepath.Join(dir, CAKEYFILE))
+}
+
+// loadCAFiles loads the PEM encoded certificate and EC key of a CA.
+func loadCAFiles(certPath string, keyPath string) (*x509.Certificate, crypto.Signer, error) {
+	certData, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyData, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certData)
+	keyBlock, _ := pem.Decode(keyData)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("no PEM data in " + certPath + " or " + keyPath)
+	}
+	ca, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, key, nil
+}
+
+// certTemplate returns the template of a certificate for the CN, valid from now on with a random serial.
+func certTemplate(cn string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		// tolerate clocks running a little behind
+		NotBefore: now.Add(-time.Hour),
+		NotAfter:  now.Add(validity),
+		KeyUsage:  x509.KeyUsageDigitalSignature,
+	}, nil
+}
+
+// issue creates a key, lets the CA sign the certificate of the template for it and writes both to dir.
+func issue(dir string, certFile string, keyFile string, template *x509.Certificate, ca *x509.Certificate, caKey crypto.Signer) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	return writeKeyPair(filepath.Join(dir, certFile), filepath.Join(dir, keyFile), der, key)
+}
+
+// writeKeyPair writes the certificate and the key PEM encoded, the key readable by the owner only.
+func writeKeyPair(certPath string, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
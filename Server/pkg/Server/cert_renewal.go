@@ -0,0 +1,109 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// Renewal of client certificates over the control connection, see Utils.CTRLCERT.
+const (
+	// CERTRENEWWINDOW is how long before it expires a client may renew its certificate
+	CERTRENEWWINDOW = 30 * 24 * time.Hour
+	// CLIENTCERTVALIDITY is how long renewed client certificates are valid by default
+	CLIENTCERTVALIDITY = 365 * 24 * time.Hour
+)
+
+// renewCertificate answers the CTRLCERT frame of the client with a new certificate for the key of the CSR, signed
+// by the CA. The certificate keeps the CN and the organizational units of the current one, so renewing can't change
+// the policies that apply to the client.
+func (c *ClientHandler) renewCertificate(ctx context.Context, csrData string, toclient chan *Utils.CTRLFrame) {
+	der, err := c.config().issueRenewal(c.identity, csrData, time.Now())
+	if err != nil {
+		c.logger.Error("Certificate renewal refused", slog.String("Func", "renewCertificate"), "Error", err)
+		c.respond(ctx, toclient, Utils.NewCTRLFrame(Utils.CTRLCERT, []string{"", "0", err.Error()}))
+		return
+	}
+	c.logger.Info("Renewed client certificate", slog.String("Func", "renewCertificate"), slog.String("Fingerprint", Utils.Fingerprint(der)))
+	encoded := base64.StdEncoding.EncodeToString(der)
+	var frames []*Utils.CTRLFrame
+	for len(encoded) > 0 {
+		chunk := encoded[:min(len(encoded), Utils.CERTCHUNK)]
+		encoded = encoded[len(chunk):]
+		frames = append(frames, Utils.NewCTRLFrame(Utils.CTRLCERT, []string{chunk, ""}))
+	}
+	for i, fr := range frames {
+		fr.Data[1] = strconv.Itoa(len(frames) - i - 1)
+	}
+	// a single goroutine, so the chunks arrive in order
+	go func() {
+		for _, fr := range frames {
+			select {
+			case toclient <- fr:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// issueRenewal checks that the client with the identity may renew its certificate at now and returns the DER of the
+// certificate issued for the base64 encoded CSR.
+func (c *Config) issueRenewal(identity ClientIdentity, csrData string, now time.Time) ([]byte, error) {
+	if c.CAKeyFile == "" {
+		return nil, errors.New("certificate renewal disabled")
+	}
+	if identity.Auth != AUTHCERT {
+		return nil, errors.New("only clients authenticated with a certificate can renew it")
+	}
+	if len(c.ClientFingerprints) > 0 {
+		return nil, errors.New("client certificates are pinned, renewed ones would be refused")
+	}
+	if identity.NotAfter.Sub(now) > CERTRENEWWINDOW {
+		return nil, errors.New("certificate not due for renewal before " + identity.NotAfter.Add(-CERTRENEWWINDOW).Format(time.DateOnly))
+	}
+	if len(csrData) > Utils.MAXCSR {
+		return nil, errors.New("CSR longer than " + strconv.Itoa(Utils.MAXCSR) + " bytes")
+	}
+	raw, err := base64.StdEncoding.DecodeString(csrData)
+	if err != nil {
+		return nil, errors.New("malformed CSR")
+	}
+	csr, err := x509.ParseCertificateRequest(raw)
+	if err != nil {
+		return nil, errors.New("malformed CSR")
+	}
+	err = csr.CheckSignature()
+	if err != nil {
+		return nil, errors.New("invalid CSR signature")
+	}
+	if csr.Subject.CommonName != identity.CN {
+		return nil, errors.New("CSR for another CN")
+	}
+
+	caPath, _, _, err := c.certPaths()
+	if err != nil {
+		return nil, err
+	}
+	ca, caKey, err := loadCAFiles(caPath, c.CAKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	validity := c.ClientCertValidity
+	if validity == 0 {
+		validity = CLIENTCERTVALIDITY
+	}
+	template, err := certTemplate(identity.CN, validity)
+	if err != nil {
+		return nil, err
+	}
+	template.Subject.OrganizationalUnit = identity.OU
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	return x509.CreateCertificate(rand.Reader, template, ca, csr.PublicKey, caKey)
+}
@@ -0,0 +1,118 @@
+package Server
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/fs"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Check validates the config like Validate and reads the files it names, the CA, the certificate and key of the
+// server, the CRL and the CA key. It returns every problem found instead of only the first, so a config can be
+// checked in full before it is deployed.
+func (c *Config) Check() []error {
+	var errs []error
+	if err := c.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, c.checkPorts()...)
+	return append(errs, c.checkFiles()...)
+}
+
+// checkPorts finds settings that are valid on their own, but can't work together.
+func (c *Config) checkPorts() []error {
+	var errs []error
+	for port, cn := range c.ReservedPorts {
+		if c.serverPort(port) || inRanges(port, c.DeniedPorts) || !c.ExposedPorts.Contains(port) {
+			errs = append(errs, errors.New("port "+strconv.Itoa(port)+" reserved for client "+cn+" can never be exposed"))
+		}
+	}
+	for _, p := range c.Profiles {
+		for _, r := range p.Ports {
+			if r.First < c.ExposedPorts.First || r.Last > c.ExposedPorts.Last {
+				errs = append(errs, errors.New("ports "+r.String()+" of the profile of client "+p.CN+" out of the exposed range "+c.ExposedPorts.String()))
+			}
+		}
+	}
+	for _, t := range c.Tenants {
+		for _, r := range t.Ports {
+			if r.First < c.ExposedPorts.First || r.Last > c.ExposedPorts.Last {
+				errs = append(errs, errors.New("ports "+r.String()+" of tenant "+t.Name+" out of the exposed range "+c.ExposedPorts.String()))
+			}
+		}
+	}
+	free := false
+	for port := c.ProxyPorts.First; port <= c.ProxyPorts.Last && !free; port++ {
+		free = !inRanges(port, c.DeniedPorts)
+	}
+	if !free {
+		errs = append(errs, errors.New("all proxy ports "+c.ProxyPorts.String()+" are denied"))
+	}
+	if c.ACME.enabled() && c.ACME.Challenge == ACMEHTTP01 && c.serverPort(c.ACME.HTTPPort) {
+		errs = append(errs, errors.New("ACME HTTP port "+strconv.Itoa(c.ACME.HTTPPort)+" is used by the server itself"))
+	}
+	return errs
+}
+
+// checkFiles reads the certificates, keys and the CRL the server loads when it starts.
+func (c *Config) checkFiles() []error {
+	caPath, crtPath, keyPath, err := c.certPaths()
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	var ca *x509.Certificate
+	if caPath != "" {
+		ca, err = readCertificate(caPath)
+		if err != nil {
+			errs = append(errs, errors.New("CA file "+caPath+": "+err.Error()))
+		}
+	}
+	leaf, err := loadLeaf(crtPath, keyPath)
+	switch {
+	case err != nil && c.ACME.enabled() && errors.Is(err, fs.ErrNotExist):
+		// obtained when the server starts
+	case err != nil:
+		errs = append(errs, errors.New("server certificate "+crtPath+" or key "+keyPath+": "+err.Error()))
+	case time.Now().After(leaf.NotAfter):
+		errs = append(errs, errors.New("server certificate "+crtPath+" expired on "+leaf.NotAfter.Format(time.DateOnly)))
+	}
+	if c.CRLFile != "" {
+		data, err := os.ReadFile(c.CRLFile)
+		if err == nil {
+			if block, _ := pem.Decode(data); block != nil {
+				data = block.Bytes
+			}
+			_, err = x509.ParseRevocationList(data)
+		}
+		if err != nil {
+			errs = append(errs, errors.New("CRL "+c.CRLFile+": "+err.Error()))
+		}
+	}
+	if c.CAKeyFile != "" && ca != nil {
+		_, key, err := loadCAFiles(caPath, c.CAKeyFile)
+		if err != nil {
+			errs = append(errs, errors.New("CA key "+c.CAKeyFile+": "+err.Error()))
+		} else if !key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(ca.PublicKey) {
+			errs = append(errs, errors.New("CA key "+c.CAKeyFile+" doesn't belong to the CA of "+caPath))
+		}
+	}
+	return errs
+}
+
+// readCertificate reads the first certificate of a PEM file.
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
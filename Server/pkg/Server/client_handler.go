@@ -3,63 +3,298 @@ package Server
 import (
 	"Utils"
 	"context"
+	"crypto/tls"
 	"errors"
 	"log/slog"
 	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // ClientHandler is a struct that handles a GoExpose client
 type ClientHandler struct {
 	Conn net.Conn
 
-	exposedTcpPorts map[int]Relay
-	exposedUdpPorts map[int]Relay
-	proxyPorts      *Portqueue
+	// tunnels holds the relays of the exposed ports, see tunnelTable
+	tunnels    *tunnelTable
+	proxyPorts *Portqueue
 
+	// statsTicker is set while the client is subscribed to relay stats
+	statsTicker *time.Ticker
+	// leaseTicker checks the leases of the exposed ports, it is nil if the server doesn't lease ports
+	leaseTicker *time.Ticker
+
+	// configs holds the config in effect, see config
+	configs *atomic.Pointer[Config]
+	// dataTLS secures the proxy connections of the client, nil if they are plaintext
+	dataTLS *tls.Config
+	// data accepts the multiplexed data connection of the client
+	data *dataListener
+	// mux is the multiplexed data connection of the client, nil if the client uses a proxy port per exposed port
+	mux *Utils.MuxSession
+	// inline is the mux session carried on the control connection, nil until a port is exposed with transport=inline
+	inline     *Utils.MuxSession
+	inlineConn *Utils.FrameConn
+	// egress is set once the client was allowed to open egress streams on the inline session, see startEgress
+	egress bool
+	// assignments remembers the public ports of the client across reconnects
+	assignments *Assignments
+	// identity is taken from the client certificate, the client is known to the registry by clientID
+	identity ClientIdentity
+	registry *Registry
+	clientID uint64
+	// takeover receives the request of a new session of the client to hand over the public ports, see DUPLICATEREPLACE,
+	// or of a client adopting them. held are the ports taken over from another session, until heldTimer closes those
+	// not exposed again.
+	takeover  chan takeoverRequest
+	held      map[string]*heldPort
+	heldTimer *time.Timer
+	// admin receives the requests of admins to disconnect the client or hide a port, see Server.Disconnect.
+	// endReason is why the session ended, if an admin ended it.
+	admin     chan adminRequest
+	endReason string
+	// connDone is closed when the control connection is lost, connCnl stops reading from it and readDone is closed
+	// once reading stopped, see startReading
+	connDone <-chan struct{}
+	connCnl  context.CancelFunc
+	readDone chan struct{}
+	// resumeToken lets the client resume the session after its control connection was lost, the new connection is
+	// received on resume. graceTimer ends a suspended session that isn't resumed in time, see Config.ResumeGrace.
+	// handedOff is set once the control connection was handed over to the session the client resumed.
+	resumeToken string
+	resume      chan resumption
+	graceTimer  *time.Timer
+	handedOff   bool
+	// limitIn and limitOut cap the bandwidth of all relays of the client, nil if its profile doesn't
+	limitIn  *bandwidthLimiter
+	limitOut *bandwidthLimiter
+	// conns caps the relayed connections of the client, serverConns those of all clients, see Config.MaxConns
+	conns       *connLimit
+	serverConns *connLimit
+	// tenantLimits cap the bandwidth and the relayed connections of all clients of the tenant, nil without tenant
+	tenantLimits *tenantLimits
+	// connRate caps the new relayed connections of all clients per second, see Config.ConnRate
+	connRate *rateLimit
+	// bans keeps the source IPs banned for their failures, nil if unused, see Config.BanThreshold
+	bans *banList
+	// geoip looks up the countries of external peers, nil without Config.GeoIPFile
+	geoip *GeoIP
+	// frameErrors counts the control connections lost to malformed frames for the metrics of the server, nil if unused
+	frameErrors *atomic.Uint64
+	// tracer traces the control operations of the client and the relayed connections of its relays, nil if unused
+	tracer *tracer
+	// accessLog receives a record per relayed connection and UDP session of the relays, nil if unused
+	accessLog *slog.Logger
+	// histories keeps the traffic history of the exposed ports of the relays, nil if unused
+	histories *trafficHistories
+	// events receives the events of the client and its tunnels, nil if unused
+	events *EventBus
+	// hosts routes the requests of the HTTP front to the relays of the ports exposed under a host, nil if the server
+	// has no HTTP front
+	hosts  *hostRouter
 	logger *slog.Logger
 }
 
 // HandleClient is a function that handles a client connection. It creates a new ClientHandler and calls its handle function (blocking).
-func HandleClient(ctx context.Context, conn net.Conn, logger *slog.Logger) {
+// dataTLS is the TLS config of the proxy connections, which reuse the certificates of the control connection. If nil, proxy connections are plaintext.
+// assignments are the public ports assigned to the clients of the server, see Assignments.
+// The client gets proxy ports, those of its tenant if it has its own, a data port listener and a server-wide connection limit of its own, the Server shares
+// them between its clients instead.
+func HandleClient(ctx context.Context, conn net.Conn, config *Config, dataTLS *tls.Config, assignments *Assignments, logger *slog.Logger) {
+	data := newDataListener(config.listenNetwork("tcp"), config.dataAddr(), config.DataPort, dataTLS, logger)
+	identity, err := identify(conn, config)
+	if err != nil {
+		logger.Error("Error in handshake", slog.String("Func", "HandleClient"), "Error", err)
+		_ = conn.Close()
+		return
+	}
+	identity, err = config.authenticate(conn, identity)
+	if err != nil {
+		logger.Error("Error authenticating client", slog.String("Func", "HandleClient"), "Error", err)
+		refuseAuth(conn, err)
+		_ = conn.Close()
+		return
+	}
+	identity.Tenant = config.tenantOf(identity)
+	proxyPorts := NewPortqueue(config.ProxyPorts, config.DeniedPorts...)
+	if t, ok := config.Tenants[identity.Tenant]; ok && t.hasProxyPorts() {
+		proxyPorts = NewPortqueue(t.ProxyPorts, config.DeniedPorts...)
+	}
+	proxyPorts.SetRandom(config.RandomPorts)
+	configs := new(atomic.Pointer[Config])
+	configs.Store(config)
+	ch := newClientHandler(conn, configs, dataTLS, proxyPorts, data, assignments, logger)
+	ch.identity = identity
+	ch.serverConns = newConnLimit(config.MaxConns)
+	if t, ok := config.Tenants[identity.Tenant]; ok {
+		ch.tenantLimits = newTenantLimits(t)
+	}
+	ch.connRate = newRateLimit(config.ConnRate, config.ConnRatePerIP)
+	if config.GeoIPFile != "" {
+		ch.geoip, err = OpenGeoIP(config.GeoIPFile)
+		if err != nil {
+			logger.Error("Error opening GeoIP database", slog.String("Func", "HandleClient"), "Error", err)
+		}
+	}
+	// handle is a blocking function that handles the client connection
+	ch.handle(ctx)
+}
+
+// newClientHandler creates the ClientHandler of a client connection, proxy ports are taken from proxyPorts and
+// multiplexed data connections are accepted through data. configs holds the config in effect, the Server replaces
+// it when reloading its config.
+func newClientHandler(conn net.Conn, configs *atomic.Pointer[Config], dataTLS *tls.Config, proxyPorts *Portqueue, data *dataListener, assignments *Assignments, logger *slog.Logger) *ClientHandler {
 	ch := new(ClientHandler)
 	ch.Conn = conn
-	ch.exposedTcpPorts = make(map[int]Relay)
-	ch.exposedUdpPorts = make(map[int]Relay)
-	ch.proxyPorts = NewPortqueue()
+	ch.tunnels = newTunnelTable(ch.tunnelAdded, ch.tunnelRemoved)
+	ch.proxyPorts = proxyPorts
+	ch.configs = configs
+	ch.dataTLS = dataTLS
+	ch.data = data
+	ch.assignments = assignments
 	ch.logger = logger
-	// handle is a blocking function that handles the client connection
-	ch.handle(ctx)
+	return ch
+}
+
+// config returns the config in effect. Settings are read from it when used, so a reloaded config applies to
+// connected clients as well.
+func (c *ClientHandler) config() *Config {
+	return c.configs.Load()
 }
 
 // handle is the actual loop that handles a client connection. The server calls this and blocks until the client disconnects.
 // It reads frames from the client, digests them, and sends responses back to the client.
-// The client connection is closed when the function returns.
+// The client connection is closed when the function returns, unless it was handed over to a resumed session.
 // The function creates a child context of root, which is used to synchronize all proxy operations with the GoExpose client that is handled here.
+// If the session is resumable, it is suspended when the connection is lost instead, see suspend.
 func (c *ClientHandler) handle(ctx context.Context) {
 	defer func() {
-		_ = c.Conn.Close()
+		if !c.handedOff {
+			_ = c.Conn.Close()
+		}
 	}()
 	// reqChan receives requests from the client as input through a helper goroutine
 	reqChan := make(chan *Utils.CTRLFrame, 10)
 	// respChan receives responses generated by this client handler as input through the digestFrame function
+	// The channels are not closed, relay goroutines may still try to send on respChan while the handler shuts down.
 	respChan := make(chan *Utils.CTRLFrame, 10)
-	defer close(reqChan)
-	defer close(respChan)
 
-	// clientctx gets terminated once the client connection is closed
+	// clientctx gets terminated once the session ends
 	clientctx, cnl := context.WithCancel(ctx)
+	defer cnl()
+	defer c.hideAll()
+	defer c.releaseHeld()
+	defer c.stopStats()
+	if c.config().PortLease > 0 {
+		c.leaseTicker = time.NewTicker(LEASECHECKINTERVAL)
+		defer c.leaseTicker.Stop()
+	}
+
+	if p := c.config().profile(c.clientCN()); p != nil {
+		c.limitIn = newBandwidthLimiter(p.BandwidthIn)
+		c.limitOut = newBandwidthLimiter(p.BandwidthOut)
+	}
+	c.conns = newConnLimit(c.config().maxConns(c.clientCN()))
+	c.registry.setConns(c.clientID, c.conns)
 
-	go c.readFrames(clientctx, reqChan, cnl)
+	c.startReading(clientctx, reqChan)
+	if c.resumeToken != "" {
+		c.respond(clientctx, respChan, c.resumeFrame(""))
+	}
 
 	for {
+		// statsC is nil, and therefore never selected, while the client is not subscribed to stats
+		var statsC <-chan time.Time
+		if c.statsTicker != nil {
+			statsC = c.statsTicker.C
+		}
+		var leaseC <-chan time.Time
+		if c.leaseTicker != nil {
+			leaseC = c.leaseTicker.C
+		}
+		var heldC <-chan time.Time
+		if c.heldTimer != nil {
+			heldC = c.heldTimer.C
+		}
+		// while the session is suspended, the client can't renew its leases, and the connection is lost already
+		connDone := c.connDone
+		var graceC <-chan time.Time
+		var resumeC chan resumption
+		if c.graceTimer != nil {
+			connDone = nil
+			leaseC = nil
+			graceC = c.graceTimer.C
+			resumeC = c.resume
+		}
+
 		select {
 		case <-clientctx.Done():
 			return
+		case <-connDone:
+			if clientctx.Err() != nil || !c.resumable() {
+				return
+			}
+			c.suspend()
+		case <-graceC:
+			if c.registry.expire(c.clientID) {
+				c.logger.Info("Session not resumed in time", slog.String("Func", "handle"))
+				return
+			}
+			// a new connection claimed the session just now and hands itself over
+			select {
+			case r := <-c.resume:
+				for _, msg := range c.resumed(clientctx, r, reqChan) {
+					c.digestFrame(clientctx, msg, respChan, cnl)
+				}
+			case <-clientctx.Done():
+				return
+			}
+		case r := <-resumeC:
+			for _, msg := range c.resumed(clientctx, r, reqChan) {
+				c.digestFrame(clientctx, msg, respChan, cnl)
+			}
+		case <-statsC:
+			c.sendStats(clientctx, respChan)
+		case now := <-leaseC:
+			c.expireLeases(clientctx, now, respChan)
+		case <-heldC:
+			c.logger.Info("Closing the taken over ports not exposed again", slog.String("Func", "handle"), slog.Int("Ports", len(c.held)))
+			c.releaseHeld()
+		case req := <-c.admin:
+			if c.handleAdmin(clientctx, req, respChan) {
+				return
+			}
+		case req := <-c.takeover:
+			if req.adopted {
+				c.logger.Info("Ports adopted by another client", slog.String("Func", "handle"))
+				if c.graceTimer == nil {
+					// the client stops instead of reconnecting and exposing the ports again
+					_ = Utils.WriteFrame(c.Conn, Utils.NewCTRLFrame(Utils.CTRLUNPAIR, nil))
+				}
+			} else {
+				c.logger.Info("Session replaced by a new connection of the client", slog.String("Func", "handle"))
+			}
+			req.reply <- c.handOver()
+			return
 		case msg := <-reqChan:
-			// digest the request from the
+			// digest the request from the client
 			c.logger.Debug("Received frame from client", slog.String("Func", "handle"), "Frame", msg.String())
-			c.digestFrame(msg, respChan, cnl)
+			if msg.Typ == Utils.CTRLRESUME {
+				// the connection may belong to another session, it is handled here instead of in digestFrame
+				if c.resumeSession(msg, reqChan) {
+					return
+				}
+				continue
+			}
+			c.digestFrame(clientctx, msg, respChan, cnl)
 		case msg := <-respChan:
+			if c.graceTimer != nil {
+				c.logger.Debug("Dropping frame for suspended session", slog.String("Func", "handle"), "Frame", msg.String())
+				continue
+			}
 			// send the response to the client
 			c.logger.Debug("Sending response to client", slog.String("Func", "handle"), "Frame", msg.String())
 			by, err := Utils.ToByteArray(msg)
@@ -71,8 +306,8 @@ func (c *ClientHandler) handle(ctx context.Context) {
 			if err != nil {
 				if errors.Is(err, net.ErrClosed) {
 					c.logger.Debug("Client connection closed", slog.String("Func", "handle"))
-					cnl()
-					return
+					c.connCnl()
+					continue
 				}
 				c.logger.Debug("Error writing frame to client", slog.String("Func", "handle"), "Error", err)
 			}
@@ -80,9 +315,9 @@ func (c *ClientHandler) handle(ctx context.Context) {
 	}
 }
 
-// readFrames is a helper goroutine that reads frames from the client and passes them to the fromclient channel.
-// The function returns when the client connection is closed or the context is cancelled.
-func (c *ClientHandler) readFrames(ctx context.Context, fromclient chan *Utils.CTRLFrame, cnl context.CancelFunc) {
+// readFrames is a helper goroutine that reads frames from the client connection and passes them to the fromclient channel.
+// The function returns when the connection is closed, its read deadline passed or the context is cancelled.
+func (c *ClientHandler) readFrames(ctx context.Context, conn net.Conn, fromclient chan *Utils.CTRLFrame, cnl context.CancelFunc) {
 	defer cnl()
 	for {
 		select {
@@ -90,38 +325,536 @@ func (c *ClientHandler) readFrames(ctx context.Context, fromclient chan *Utils.C
 			return
 		default:
 			// read frames from the client and pass them to the fromclient channel
-			fr, err := Utils.ReadFrame(c.Conn)
+			fr, err := Utils.ReadFrame(conn)
 			if err != nil {
 				if errors.Is(err, net.ErrClosed) {
 					c.logger.Debug("Client connection closed", slog.String("Func", "readFrames"))
 					return
+				} else if errors.Is(err, os.ErrDeadlineExceeded) {
+					c.logger.Debug("Stopped reading frames", slog.String("Func", "readFrames"))
+					return
 				} else {
 					c.logger.Error("Error reading frame from client", slog.String("Func", "readFrames"), "Error", err)
+					if c.frameErrors != nil {
+						c.frameErrors.Add(1)
+					}
 					return
 				}
 			}
-			fromclient <- fr
+			select {
+			case fromclient <- fr:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}
 }
 
 // digestFrame is a function that processes a frame from the client and sends a response to the client.
 // It contains the logic to handle the different types of frames that the client can send.
-//
-// TODO: continue the rewrite here
-func (c *ClientHandler) digestFrame(msg *Utils.CTRLFrame, toclient chan *Utils.CTRLFrame, cnl context.CancelFunc) {
+// ctx is the context of the client connection, relays started here are terminated with it.
+func (c *ClientHandler) digestFrame(ctx context.Context, msg *Utils.CTRLFrame, toclient chan *Utils.CTRLFrame, cnl context.CancelFunc) {
+	// every control operation is a trace of its own, the chunks of inline data connections are not traced
+	if msg.Typ != Utils.CTRLDATA {
+		var span *span
+		ctx, span = c.tracer.start(ctx, "digestFrame", slog.Int("Frame", int(msg.Typ)), slog.String("Client", c.clientCN()))
+		defer span.finish(nil)
+	}
 	switch msg.Typ {
 	case Utils.CTRLUNPAIR:
 		// unpair the client by cancelling the context of this ClientHandler
 		cnl()
 		return
-	case Utils.CTRLEXPOSETCP:
-		// Expose the tcp port
-	case Utils.CTRLHIDETCP:
-		// Hide the tcp port
-	case Utils.CTRLEXPOSEUDP:
-		// Expose the udp port
-	case Utils.CTRLHIDEUDP:
-		// Hide the udp port
+	case Utils.CTRLEXPOSETCP, Utils.CTRLEXPOSEUDP:
+		// Expose the port, or update the config of an already exposed port. A range of ports is exposed as a whole.
+		if code, reason := c.config().checkProfile(c.clientCN(), frameNetwork(msg)); code != "" {
+			c.logger.Error("Expose denied by profile", slog.String("Func", "digestFrame"), slog.String("Network", frameNetwork(msg)), slog.String("Reason", reason))
+			c.reject(ctx, toclient, frameNetwork(msg), firstData(msg), code, reason)
+			return
+		}
+		ports, err := ParsePortRange(firstData(msg))
+		if err != nil {
+			c.logger.Error("Invalid port in expose frame", slog.String("Func", "digestFrame"), "Error", err)
+			c.reject(ctx, toclient, frameNetwork(msg), firstData(msg), Utils.ERRINVALID, "invalid port")
+			return
+		}
+		config, err := parseRelayConfig(msg.Data[1:])
+		if err != nil {
+			c.logger.Error("Invalid options in expose frame", slog.String("Func", "digestFrame"), "Error", err)
+			c.reject(ctx, toclient, frameNetwork(msg), msg.Data[0], Utils.ERRINVALID, err.Error())
+			return
+		}
+		config.MaxSessions = c.config().MaxUdpSessions
+		if ports.Size() > 1 {
+			c.exposeRange(ctx, frameNetwork(msg), ports, config, toclient)
+			return
+		}
+		c.expose(ctx, frameNetwork(msg), ports.First, config, toclient)
+	case Utils.CTRLHIDETCP, Utils.CTRLHIDEUDP:
+		// Hide the port, all ports of a range, or the port with the name
+		ports, err := ParsePortRange(firstData(msg))
+		if err != nil {
+			relay := c.namedRelay(frameNetwork(msg), firstData(msg))
+			if relay == nil {
+				c.logger.Error("Invalid port or unknown name in hide frame", slog.String("Func", "digestFrame"), "Error", err)
+				return
+			}
+			ports = PortRange{First: relay.externalPort, Last: relay.externalPort}
+		}
+		for port := ports.First; port <= ports.Last; port++ {
+			c.hide(frameNetwork(msg), port)
+			// a port hidden by the client gives up its public port, unlike one that expired
+			err = c.assignments.Remove(c.clientCN(), frameNetwork(msg), port)
+			if err != nil {
+				c.logger.Error("Error saving port assignments", slog.String("Func", "digestFrame"), "Error", err)
+			}
+		}
+	case Utils.CTRLADOPT:
+		// Take over the ports of another client
+		c.adopt(ctx, firstData(msg), toclient)
+	case Utils.CTRLCERT:
+		// Issue a renewed certificate for the CSR
+		c.renewCertificate(ctx, firstData(msg), toclient)
+	case Utils.CTRLMUX:
+		// Open the multiplexed data connection, ports exposed afterwards use it instead of proxy ports
+		c.enableMux(ctx, cnl)
+	case Utils.CTRLRENEW:
+		// Renew the lease of an exposed port
+		port, err := frameInt(msg, 1)
+		if err != nil {
+			c.logger.Error("Invalid port in renewal frame", slog.String("Func", "digestFrame"), "Error", err)
+			return
+		}
+		c.renewLease(msg.Data[0], port)
+	case Utils.CTRLDATA:
+		// Pass the chunk to the inline data connection
+		c.inlineData(msg)
+	case Utils.CTRLSTATS:
+		// Send a snapshot of the relay counters
+		c.sendStats(ctx, toclient)
+	case Utils.CTRLHISTORY:
+		// Send the traffic history of an exposed port
+		c.sendHistory(ctx, msg, toclient)
+	case Utils.CTRLINSPECT:
+		// Send the recent requests of a port exposed under a host
+		c.sendInspected(ctx, msg, toclient)
+	case Utils.CTRLEGRESS:
+		// Accept the egress streams of the client on the inline session
+		c.startEgress(ctx, toclient)
+	case Utils.CTRLSTATSSUB:
+		// Subscribe to periodic relay stats, an interval of 0 seconds unsubscribes
+		seconds, err := frameInt(msg, 0)
+		if err != nil || seconds < 0 {
+			c.logger.Error("Invalid interval in stats subscription frame", slog.String("Func", "digestFrame"), "Error", err)
+			return
+		}
+		c.stopStats()
+		if seconds > 0 {
+			c.statsTicker = time.NewTicker(time.Duration(seconds) * time.Second)
+		}
+	}
+}
+
+// tunnelAdded records an exposed port in the registry and publishes its creation.
+func (c *ClientHandler) tunnelAdded(relay *Relay) {
+	c.registry.addTunnel(c.clientID, relay.tunnel())
+	c.publish(EVENTTUNNELCREATED, relay.tunnel(), "")
+}
+
+// tunnelRemoved forgets a port that is no longer exposed in the registry and the HTTP front, and publishes its
+// destruction.
+func (c *ClientHandler) tunnelRemoved(relay *Relay) {
+	if config := relay.config.Load(); config.Host != "" {
+		c.hosts.release(config.Host, config.Path, relay)
+	}
+	c.registry.removeTunnel(c.clientID, relay.network, relay.externalPort)
+	c.publish(EVENTTUNNELDESTROYED, relay.tunnel(), "")
+}
+
+// expose checks if the port is valid, assigns a proxy port and starts a Relay for it. The relay listens on the port
+// of the client, or on the public port the client asked for, see RelayConfig.PublicPort.
+// If the port is already exposed, the config of its relay is replaced instead, keeping the established connections.
+// The client is answered with CTRLEXPOSED carrying the public port, or CTRLERROR if the port could not be exposed.
+func (c *ClientHandler) expose(ctx context.Context, network string, externalPort int, config *RelayConfig, toclient chan *Utils.CTRLFrame) {
+	port := strconv.Itoa(externalPort)
+	logger := c.tunnelLogger(network, externalPort, config.Name)
+	if !validPort(externalPort) {
+		logger.Error("Invalid port", slog.String("Func", "expose"))
+		c.reject(ctx, toclient, network, port, Utils.ERRINVALID, "invalid port")
+		return
+	}
+	if len(config.OIDC) > 0 && !c.config().HTTPOIDC.enabled() {
+		logger.Error("OIDC without provider", slog.String("Func", "expose"))
+		c.reject(ctx, toclient, network, port, Utils.ERRINVALID, "server has no OIDC provider")
+		return
+	}
+	if config.ProxyProtocol != "" && network != "tcp" {
+		logger.Error("PROXY header for non-tcp port", slog.String("Func", "expose"))
+		c.reject(ctx, toclient, network, port, Utils.ERRINVALID, "only tcp ports send PROXY headers")
+		return
+	}
+	if config.Compress != "" && network != "tcp" {
+		logger.Error("Compression for non-tcp port", slog.String("Func", "expose"))
+		c.reject(ctx, toclient, network, port, Utils.ERRINVALID, "only tcp ports are compressed")
+		return
+	}
+	if config.Cache && c.config().HTTPCacheSize == 0 {
+		logger.Error("Cache without cache size", slog.String("Func", "expose"))
+		c.reject(ctx, toclient, network, port, Utils.ERRINVALID, "server has no HTTP cache")
+		return
+	}
+	if (len(config.AllowCountries) > 0 || len(config.DenyCountries) > 0) && c.geoip == nil {
+		logger.Error("Country lists without GeoIP database", slog.String("Func", "expose"))
+		c.reject(ctx, toclient, network, port, Utils.ERRINVALID, "server has no GeoIP database")
+		return
+	}
+	if relay := c.tunnels.get(network, externalPort); relay != nil {
+		if relay.config.Load().Inline != config.Inline {
+			relay.logger.Error("Transport of exposed port can't be changed", slog.String("Func", "expose"))
+			c.reject(ctx, toclient, network, port, Utils.ERRIMMUTABLE, "transport can't be changed")
+			return
+		}
+		if relay.config.Load().Compress != config.Compress {
+			relay.logger.Error("Compression of exposed port can't be changed", slog.String("Func", "expose"))
+			c.reject(ctx, toclient, network, port, Utils.ERRIMMUTABLE, "compression can't be changed")
+			return
+		}
+		if config.PublicPort != 0 && config.PublicPort != relay.publicPort {
+			relay.logger.Error("Public port of exposed port can't be changed", slog.String("Func", "expose"))
+			c.reject(ctx, toclient, network, port, Utils.ERRIMMUTABLE, "public port can't be changed")
+			return
+		}
+		name := relay.config.Load().Name
+		if config.Name != "" && config.Name != name {
+			relay.logger.Error("Name of exposed port can't be changed", slog.String("Func", "expose"))
+			c.reject(ctx, toclient, network, port, Utils.ERRIMMUTABLE, "name can't be changed")
+			return
+		}
+		host := relay.config.Load().Host
+		if config.Host != "" && config.Host != host {
+			relay.logger.Error("Host of exposed port can't be changed", slog.String("Func", "expose"))
+			c.reject(ctx, toclient, network, port, Utils.ERRIMMUTABLE, "host can't be changed")
+			return
+		}
+		path := relay.config.Load().Path
+		if config.Path != "" && config.Path != path {
+			relay.logger.Error("Path of exposed port can't be changed", slog.String("Func", "expose"))
+			c.reject(ctx, toclient, network, port, Utils.ERRIMMUTABLE, "path can't be changed")
+			return
+		}
+		// the name, the host and the path are kept if the client leaves them out
+		config.Name = name
+		config.Host = host
+		config.Path = path
+		relay.reconfigure(config)
+		c.renewLease(network, externalPort)
+		relay.logger.Info("Reconfigured exposed port", slog.String("Func", "expose"))
+		c.respond(ctx, toclient, c.exposedFrame(relay))
+		return
+	}
+	if config.Name != "" && c.nameTaken(network, externalPort, config.Name) {
+		logger.Error("Name already in use", slog.String("Func", "expose"))
+		c.reject(ctx, toclient, network, port, Utils.ERRNAME, "name "+config.Name+" already in use")
+		return
+	}
+	if config.Host != "" {
+		if code, reason := c.checkHost(network, config.Host); code != "" {
+			logger.Error("Host denied", slog.String("Func", "expose"), slog.String("Host", config.Host), slog.String("Reason", reason))
+			c.reject(ctx, toclient, network, port, code, reason)
+			return
+		}
+		if config.Path == "" {
+			config.Path = "/"
+		}
+	}
+	cn := c.clientCN()
+	quota := c.config().quota(cn).limit(network)
+	if quota > 0 && c.tunnels.count(network) >= quota {
+		logger.Error("Port quota reached", slog.String("Func", "expose"), slog.Int("Quota", quota))
+		c.reject(ctx, toclient, network, port, Utils.ERRQUOTA, "quota of "+strconv.Itoa(quota)+" "+network+" ports reached")
+		return
+	}
+	if quota, exceeded := c.tenantQuotaExceeded(network, 1); exceeded {
+		logger.Error("Tenant port quota reached", slog.String("Func", "expose"), slog.Int("Quota", quota))
+		c.reject(ctx, toclient, network, port, Utils.ERRQUOTA, "quota of "+strconv.Itoa(quota)+" "+network+" ports of the tenant reached")
+		return
+	}
+	publicPort := externalPort
+	if config.AnyPort || config.Host != "" {
+		publicPort = 0
+	} else if config.PublicPort != 0 {
+		publicPort = config.PublicPort
+	}
+	relay, code, reason := c.prepareRelay(ctx, network, externalPort, publicPort, cn, config, toclient)
+	if relay == nil {
+		c.reject(ctx, toclient, network, port, code, reason)
+		return
+	}
+	if config.Host != "" && !c.hosts.claim(config.Host, config.Path, relay) {
+		logger.Error("Host already in use", slog.String("Func", "expose"), slog.String("Host", config.Host), slog.String("Path", config.Path))
+		c.discardRelay(relay)
+		c.reject(ctx, toclient, network, port, Utils.ERRUNAVAILABLE, "path "+config.Path+" of host "+config.Host+" already in use")
+		return
+	}
+	c.startRelay(ctx, relay, cn, toclient)
+}
+
+// prepareRelay checks if the client may expose the public port, assigns a proxy port and creates a Relay listening on it.
+// A publicPort of 0 lets the relay listen on any port, see listenAny. If the relay can't be created, the error code
+// and the reason for the client are returned instead.
+func (c *ClientHandler) prepareRelay(ctx context.Context, network string, externalPort int, publicPort int, cn string, config *RelayConfig, toclient chan *Utils.CTRLFrame) (*Relay, string, string) {
+	logger := c.tunnelLogger(network, externalPort, config.Name)
+	ctx, span := c.tracer.start(ctx, "prepareRelay", slog.String("Network", network), slog.Int("Port", externalPort), slog.Int("PublicPort", publicPort))
+	defer span.finish(nil)
+	if publicPort != 0 {
+		if code, reason := c.config().checkPort(publicPort, network, cn, c.identity.Tenant); code != "" {
+			logger.Error("Port denied by policy", slog.String("Func", "prepareRelay"), slog.Int("PublicPort", publicPort), slog.String("Reason", reason))
+			span.fail(reason)
+			return nil, code, reason
+		}
+	}
+	// relays of a multiplexing client open streams instead of using a proxy port, as do inline relays
+	mux := c.mux
+	if config.Inline {
+		mux = c.inlineMux(ctx, toclient)
+	}
+	proxyPort := 0
+	if mux == nil {
+		proxyPort = c.proxyPorts.GetPort()
+		if proxyPort == 0 {
+			logger.Error("No proxy port available", slog.String("Func", "prepareRelay"))
+			span.fail("no proxy port available")
+			return nil, Utils.ERRUNAVAILABLE, "no proxy port available"
+		}
+	}
+
+	relay := NewRelay(network, externalPort, proxyPort, config, logger)
+	relay.mux = mux
+	relay.tracer = c.tracer
+	relay.accessLog = c.accessLog
+	relay.history = c.histories.get(cn, network, externalPort)
+	relay.onError = func(err error) {
+		c.publish(EVENTRELAYERROR, relay.tunnel(), err.Error())
+	}
+	relay.onSample = func(bytesIn uint64, bytesOut uint64, conns uint64) {
+		c.events.publish(Event{Kind: EVENTTRAFFICSAMPLE, ClientID: c.clientID, Client: c.identity, Address: c.Conn.RemoteAddr().String(),
+			Tunnel: relay.tunnel(), BytesIn: bytesIn, BytesOut: bytesOut, Conns: conns})
+	}
+	relay.publicIP = net.ParseIP(c.config().PublicAddr)
+	relay.proxyFrom, _ = c.config().proxyPrefixes()
+	relay.proxyIP = c.config().dataAddr()
+	relay.family = c.config().AddressFamily
+	relay.limitIn = bandwidthLimits{c.limitIn}
+	relay.limitOut = bandwidthLimits{c.limitOut}
+	relay.connLimits = []*connLimit{c.serverConns, c.conns}
+	if t := c.tenantLimits; t != nil {
+		relay.limitIn = append(relay.limitIn, t.limitIn)
+		relay.limitOut = append(relay.limitOut, t.limitOut)
+		relay.connLimits = append(relay.connLimits, t.conns)
+	}
+	relay.rateLimit = c.connRate
+	relay.bans = c.bans
+	relay.geoip = c.geoip
+	relay.countries = func() ([]string, []string) {
+		if p := c.config().profile(cn); p != nil {
+			return p.AllowCountries, p.DenyCountries
+		}
+		return nil, nil
+	}
+	var err error
+	if config.Host != "" {
+		relay.publicPort = 0
+		err = relay.listen()
+	} else if held := c.takeHeld(network, externalPort, publicPort); held != nil {
+		relay.adopt(held)
+		err = relay.listen()
+	} else if publicPort == 0 {
+		err = c.listenAny(relay, cn)
+	} else {
+		relay.publicPort = publicPort
+		err = relay.listen()
+	}
+	if err != nil {
+		logger.Error("Error listening on external port", slog.String("Func", "prepareRelay"), slog.Int("PublicPort", relay.publicPort), "Error", err)
+		c.returnProxyPort(proxyPort)
+		span.finish(err)
+		return nil, Utils.ERRUNAVAILABLE, "port unavailable"
+	}
+	span.set(slog.Int("PublicPort", relay.publicPort), slog.Int("ProxyPort", proxyPort))
+	return relay, "", ""
+}
+
+// tunnelLogger derives the logger of an exposed port from the one of the client, so the records of a single tunnel
+// can be filtered by network, port and name. Relays log with it.
+func (c *ClientHandler) tunnelLogger(network string, externalPort int, name string) *slog.Logger {
+	logger := c.logger.With(slog.String("Network", network), slog.Int("Port", externalPort))
+	if name != "" {
+		logger = logger.With(slog.String("Tunnel", name))
+	}
+	return logger
+}
+
+// discardRelay closes a relay created by prepareRelay that is not started after all.
+func (c *ClientHandler) discardRelay(relay *Relay) {
+	relay.closeListeners()
+	c.returnProxyPort(relay.proxyPort)
+}
+
+// startRelay registers a relay created by prepareRelay, starts it and answers the client with CTRLEXPOSED.
+func (c *ClientHandler) startRelay(ctx context.Context, relay *Relay, cn string, toclient chan *Utils.CTRLFrame) {
+	_, span := c.tracer.start(ctx, "startRelay", slog.String("Network", relay.network), slog.Int("Port", relay.externalPort))
+	defer span.finish(nil)
+	ctrlIP, _, _ := net.SplitHostPort(c.Conn.RemoteAddr().String())
+	c.tunnels.add(relay)
+	if relay.publicPort != 0 {
+		err := c.assignments.Set(cn, relay.network, relay.externalPort, relay.publicPort)
+		if err != nil {
+			relay.logger.Error("Error saving port assignments", slog.String("Func", "startRelay"), "Error", err)
+		}
+	}
+	c.renewLease(relay.network, relay.externalPort)
+	relay.logger.Info("Exposing port", slog.String("Func", "startRelay"), slog.Int("PublicPort", relay.publicPort), slog.Int("ProxyPort", relay.proxyPort))
+	relay.start(ctx, ctrlIP, c.dataTLS, toclient)
+	c.respond(ctx, toclient, c.exposedFrame(relay))
+}
+
+// exposedFrame creates the CTRLEXPOSED answer for the relay.
+func (c *ClientHandler) exposedFrame(relay *Relay) *Utils.CTRLFrame {
+	data := []string{relay.network, strconv.Itoa(relay.externalPort), strconv.Itoa(relay.publicPort), "0", ""}
+	if c.config().PortLease > 0 {
+		data[3] = strconv.Itoa(int(c.config().PortLease / time.Second))
+	}
+	families := ""
+	if config := relay.config.Load(); config.Host != "" {
+		data[4] = c.config().hostURL(config.Host) + strings.TrimSuffix(config.Path, "/")
+	} else {
+		families = c.config().listenFamilies(relay.publicIP)
+	}
+	return Utils.NewCTRLFrame(Utils.CTRLEXPOSED, append(data, families))
+}
+
+// ANYPORTATTEMPTS is the amount of random ports tried for an EXPOSE with public=any.
+const ANYPORTATTEMPTS = 32
+
+// listenAny lets the relay listen on the public port assigned to the port before, or on a random free port of the
+// range for public=any, or of the ports of its tenant. Reserved ports are skipped, even those of the client, they are
+// only exposed if asked for explicitly.
+func (c *ClientHandler) listenAny(relay *Relay, cn string) error {
+	if port, ok := c.assignments.Get(cn, relay.network, relay.externalPort); ok && c.config().mayExpose(port, relay.network, cn, c.identity.Tenant) {
+		relay.publicPort = port
+		if relay.listen() == nil {
+			return nil
+		}
+	}
+	ranges := c.anyRanges()
+	err := errors.New("no free port in the range for public=any")
+	for i := 0; i < ANYPORTATTEMPTS; i++ {
+		port, ok := randomPort(ranges, 1)
+		if !ok {
+			break
+		}
+		if _, reserved := c.config().ReservedPorts[port]; reserved || !c.config().mayExpose(port, relay.network, cn, c.identity.Tenant) {
+			continue
+		}
+		relay.publicPort = port
+		err = relay.listen()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// returnProxyPort returns the proxy port of a relay to the queue, relays of a multiplexing client have none.
+func (c *ClientHandler) returnProxyPort(proxyPort int) {
+	if proxyPort != 0 {
+		c.proxyPorts.ReturnPort(proxyPort)
+	}
+}
+
+// reject answers an EXPOSE frame with a CTRLERROR carrying the reason and its error code, one of the Utils.ERR codes.
+func (c *ClientHandler) reject(ctx context.Context, toclient chan *Utils.CTRLFrame, network string, port string, code string, reason string) {
+	spanFrom(ctx).fail(code + ": " + reason)
+	c.respond(ctx, toclient, Utils.NewCTRLFrame(Utils.CTRLERROR, []string{network, port, reason, code}))
+}
+
+// respond sends a frame to the client from a helper goroutine, as the handle loop is the one reading from toclient.
+func (c *ClientHandler) respond(ctx context.Context, toclient chan *Utils.CTRLFrame, fr *Utils.CTRLFrame) {
+	go func() {
+		select {
+		case toclient <- fr:
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// hide stops the Relay of the port and returns its proxy port to the queue.
+func (c *ClientHandler) hide(network string, externalPort int) {
+	relay := c.tunnels.remove(network, externalPort)
+	if relay == nil {
+		c.logger.Error("Port not exposed", slog.String("Func", "hide"), slog.String("Network", network), slog.Int("Port", externalPort))
+		return
+	}
+	relay.cancel()
+	relay.sampleHistory(time.Now())
+	c.returnProxyPort(relay.proxyPort)
+	relay.logger.Info("Hid port", slog.String("Func", "hide"))
+}
+
+// hideAll hides the ports of a client that disconnected, so their proxy ports return to the queue the clients
+// of the server share.
+func (c *ClientHandler) hideAll() {
+	for _, relay := range c.tunnels.all() {
+		c.hide(relay.network, relay.externalPort)
+	}
+}
+
+// sendStats sends one CTRLSTATS frame per exposed port to the client. The frames are created here, but sent from
+// a helper goroutine, as the handle loop is the one reading from toclient.
+func (c *ClientHandler) sendStats(ctx context.Context, toclient chan *Utils.CTRLFrame) {
+	relays := c.tunnels.all()
+	frames := make([]*Utils.CTRLFrame, 0, len(relays))
+	for _, relay := range relays {
+		frames = append(frames, relay.statsFrame())
+	}
+	go func() {
+		for _, fr := range frames {
+			select {
+			case toclient <- fr:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (c *ClientHandler) stopStats() {
+	if c.statsTicker != nil {
+		c.statsTicker.Stop()
+		c.statsTicker = nil
+	}
+}
+
+// frameNetwork returns the network an EXPOSE or HIDE frame refers to.
+func frameNetwork(fr *Utils.CTRLFrame) string {
+	if fr.Typ == Utils.CTRLEXPOSEUDP || fr.Typ == Utils.CTRLHIDEUDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// firstData returns the first data field of the frame, or an empty string if it has none.
+func firstData(fr *Utils.CTRLFrame) string {
+	if len(fr.Data) == 0 {
+		return ""
+	}
+	return fr.Data[0]
+}
+
+// frameInt parses the data field at index i of the frame as an int.
+func frameInt(fr *Utils.CTRLFrame, i int) (int, error) {
+	if len(fr.Data) <= i {
+		return 0, errors.New("missing frame data at index " + strconv.Itoa(i))
 	}
+	return strconv.Atoi(fr.Data[i])
 }
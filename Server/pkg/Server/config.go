@@ -0,0 +1,477 @@
+package Server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of the server that the operator can choose.
+type Config struct {
+	// MaxUdpSessions is the maximum amount of sessions a single UDP relay tracks, 0 means unlimited.
+	// If the limit is reached, the least recently used session is evicted.
+	MaxUdpSessions int
+	// MaxConns caps the relayed connections and UDP sessions of all clients at a time, MaxClientConns those of
+	// a single client, unless its profile sets another cap. 0 means unlimited. Connections beyond are refused.
+	MaxConns       int
+	MaxClientConns int
+	// ConnRate caps the new relayed connections and UDP sessions per second of all exposed ports, ConnRatePerIP those
+	// of a single external peer. CtrlRate and CtrlRatePerIP cap the new control connections per second alike. Up to a
+	// second worth of connections passes at once. 0 means unlimited. Connections beyond are refused before they get a
+	// proxy connection or a TLS handshake.
+	ConnRate      int
+	ConnRatePerIP int
+	CtrlRate      int
+	CtrlRatePerIP int
+	// HandshakeFailures is the amount of failed TLS or Noise handshakes of control connections of a source IP within
+	// HANDSHAKEWINDOW after which its control connections are refused until the window passed. Only the first failure
+	// of a window and the throttling are logged as errors then. 0 disables throttling.
+	HandshakeFailures int
+	// BanThreshold is the amount of failures within BanWindow after which a source IP is banned for BanDuration from
+	// the control listener, the exposed ports and the HTTP front. Failures are connections refused by the allow and
+	// deny lists of a port, external connections the visitor closes without sending anything right away, wrong
+	// credentials for the HTTP front and failed handshakes of control connections. 0 disables bans.
+	BanThreshold int
+	BanWindow    time.Duration
+	BanDuration  time.Duration
+	// PlaintextData disables TLS on the proxy connections of the clients. Relayed data is then sent unencrypted
+	// between client and server, which is only acceptable on trusted networks.
+	PlaintextData bool
+	// CtrlPort is the port of the control connections, DataPort the one of the multiplexed data connections
+	CtrlPort int
+	DataPort int
+	// CtrlAddr is the IP address the control port is bound to, DataAddr the one of the data port and the proxy ports,
+	// CtrlAddr if empty, as clients connect to them at the address of the server they control it by. PublicAddr is
+	// the IP address of the exposed ports. Empty binds all interfaces, so the control plane can be kept on a private
+	// network while the exposed ports are public.
+	CtrlAddr   string
+	DataAddr   string
+	PublicAddr string
+	// AddressFamily is the address family the control, data, proxy and exposed ports are bound to, FAMILYDUAL for
+	// IPv4 and IPv6, FAMILYIPV4 or FAMILYIPV6. Bind addresses have to belong to it.
+	AddressFamily string
+	// ProxyProtocolFrom are the IP addresses and prefixes of the load balancers in front of the exposed ports and the
+	// HTTP front. Their connections have to start with a PROXY header of version 1 or 2, the addresses it announces
+	// take the place of the ones of the connection, see acceptProxied.
+	ProxyProtocolFrom []string
+	// GeoIPFile is the MaxMind DB file, e.g. GeoLite2-Country.mmdb, the countries of external peers are looked up in
+	// for the country lists of exposed ports and profiles, see RelayConfig.AllowCountries. Empty refuses these lists.
+	GeoIPFile string
+	// MetricsAddr is the address, host:port, of the HTTP listener serving the Prometheus metrics of the server on
+	// METRICSPATH and its health checks on HEALTHPATH and READYPATH. Empty disables it.
+	MetricsAddr string
+	// PprofAddr is the address, host:port, of the HTTP listener serving the profiles of net/http/pprof below
+	// PPROFPATH. It has to be a loopback address, as the profiles reveal the internals of the server. Empty disables it.
+	PprofAddr string
+	// OTLPEndpoint is the URL of the OTLP/HTTP traces endpoint of an OpenTelemetry collector, e.g.
+	// http://localhost:4318/v1/traces. Control operations and the pairing of relayed connections are traced to it, if
+	// set.
+	OTLPEndpoint string
+	// AdminAddr is the address, host:port, of the HTTPS listener serving the admin API below ADMINPATH and as
+	// GRPCSERVICE, and the dashboard on DASHBOARDPATH, with the certificate of the server. Requests have to carry
+	// AdminToken, which has the admin role, or one of AdminKeys as bearer token. Empty disables it.
+	AdminAddr  string
+	AdminToken string
+	// AdminKeys are the API keys of the admin API by key, each with the role it has, see ADMINROLEREAD
+	AdminKeys map[string]AdminKey
+	// WebSocketAddr is the address, host:port, of the HTTPS listener accepting control connections carried in a
+	// WebSocket on Utils.WEBSOCKETPATH, with the certificate of the server, for clients that can only reach HTTPS
+	// ports, e.g. through a proxy. These clients relay their ports with transport=inline. Empty disables it.
+	WebSocketAddr string
+	// NoiseAddr is the address, host:port, of the listener accepting control connections secured with
+	// Utils.NOISEPROTOCOL in place of TLS, with the private key of NoiseKeyFile, for embedded clients where managing
+	// certificates is overkill. NoiseClients are the public keys of these clients in base64 by the CN the policies
+	// are keyed by, other keys are refused. These clients relay their ports with transport=inline. Empty disables it.
+	NoiseAddr    string
+	NoiseKeyFile string
+	NoiseClients map[string]string
+	// HTTPAddr is the address, host:port, of the HTTP front, which passes requests on to the service of the client
+	// that exposed a port under their hostname with the host=<hostname> option, HTTPSAddr the one of the HTTPS front.
+	// The HTTPS front presents the certificate of HTTPCertFile and HTTPKeyFile, e.g. a wildcard certificate of the
+	// domains, or the one of the server if empty. Clients may expose ports under subdomains of HTTPDomains only.
+	// Empty addresses disable the fronts.
+	HTTPAddr     string
+	HTTPSAddr    string
+	HTTPCertFile string
+	HTTPKeyFile  string
+	HTTPDomains  []string
+	// HTTPACME lets the HTTPS front obtain its certificates from the ACME CA of ACME and renew them, instead of
+	// HTTPCertFile. With ACMEDNS01 it obtains a wildcard certificate for each of HTTPDomains, with ACMEHTTP01 one for
+	// each hostname once a client exposes a port under it, answering the challenges on HTTPAddr.
+	HTTPACME bool
+	// HTTPOIDC is the OpenID Connect provider visitors of ports exposed with the oidc option log in with, see OIDCConfig
+	HTTPOIDC OIDCConfig
+	// HTTPErrorPage is the html/template file of the error pages of the HTTP front, see frontError for its data. The
+	// front has a page of its own if empty or the file can't be parsed.
+	HTTPErrorPage string
+	// HTTPCacheSize is the memory in MB the HTTP front keeps the responses of ports exposed with cache=on in, see
+	// responseCache. 0 disables the cache.
+	HTTPCacheSize int
+	// Webhooks are posted the events of the clients and their tunnels, see Webhook
+	Webhooks []Webhook
+	// ProxyPorts are assigned to exposed ports for the proxy connections of the client, one per exposed port
+	ProxyPorts PortRange
+	// ExposedPorts are the ports clients may expose
+	ExposedPorts PortRange
+	// AnyPorts are the ports the server chooses from for clients exposing a port with public=any,
+	// the dynamic ports of IANA by default. Only those that are also in ExposedPorts are used.
+	AnyPorts PortRange
+	// RandomPorts hands out proxy ports in random order instead of sequentially, so they are harder to predict
+	RandomPorts bool
+	// PortLease is the time after which an exposed port is hidden if the client doesn't renew it, 0 disables leases.
+	// It reclaims the ports of clients that vanished without closing their control connection.
+	PortLease time.Duration
+	// DefaultQuota limits the ports every client can expose, ClientQuotas replaces it for the clients with the
+	// certificate CN of the key
+	DefaultQuota Quota
+	ClientQuotas map[string]Quota
+	// DeniedPorts are never exposed nor used as proxy ports, e.g. the well-known ports of services of the host
+	DeniedPorts []PortRange
+	// ReservedPorts can only be exposed by the client with the certificate CN of the value
+	ReservedPorts map[int]string
+	// PrivilegedClients are the certificate CNs of the clients that may expose privileged ports, those up to
+	// MAXPRIVILEGEDPORT. ExposedPorts has to include them as well.
+	PrivilegedClients map[string]bool
+	// EgressClients are the certificate CNs of the clients that may reach the network of the server through their
+	// tunnel, e.g. with the SOCKS5 listener of the client, see Utils.CTRLEGRESS. EgressNetworks are the IP addresses
+	// and prefixes they may connect to, any if empty.
+	EgressClients  []string
+	EgressNetworks []string
+	// Profiles hold the settings of single clients by certificate CN, see Profile. The ports of a profile only
+	// restrict public=any if they overlap AnyPorts.
+	Profiles map[string]Profile
+	// AuthzRules allow or deny clients public ports and networks, in addition to the settings above, see AuthzRule
+	AuthzRules []AuthzRule
+	// Tenants group the clients of teams by name and keep their ports apart, see Tenant
+	Tenants map[string]Tenant
+	// DuplicateSessions is the policy for a client connecting while a session with the same certificate CN is
+	// still alive, one of DUPLICATEALLOW, DUPLICATEREFUSE and DUPLICATEREPLACE
+	DuplicateSessions string
+	// ResumeGrace is how long the session of a client outlives its control connection, so the client can resume it
+	// with established connections and exposed ports after a brief outage. 0 ends sessions with their connection.
+	ResumeGrace time.Duration
+	// CAFile is the PEM file of the CA client certificates are verified with, CertFile and KeyFile are the certificate
+	// and key of the server. Empty paths default to myCA.pem, server.crt and server.key in the certs directory of the
+	// home directory of the user, see certPaths.
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	// SystemCAs verifies client certificates with the CA pool of the system as well. CAFile is then only read if set.
+	SystemCAs bool
+	// CAKeyFile is the key of the CA of CAFile, it lets clients renew their certificates before they expire, see
+	// Utils.CTRLCERT. Renewed certificates are valid for ClientCertValidity, CLIENTCERTVALIDITY if 0. Empty disables
+	// renewal.
+	CAKeyFile          string
+	ClientCertValidity time.Duration
+	// ClientFingerprints are the SHA-256 fingerprints of the only client certificates accepted, in addition to being
+	// issued by the CA. Empty accepts every certificate of the CA.
+	ClientFingerprints map[string]bool
+	// TLSMinVersion is the lowest TLS version of control and data connections, tls.VersionTLS13 accepts TLS 1.3 only.
+	// CipherSuites restricts the cipher suites of TLS 1.2, empty allows the secure defaults of Go. The suites of
+	// TLS 1.3 can't be restricted.
+	TLSMinVersion uint16
+	CipherSuites  []uint16
+	// CtrlALPN and DataALPN are the ALPN protocol IDs of control and data connections. If set, a client offering
+	// ALPN has to offer one of them.
+	CtrlALPN []string
+	DataALPN []string
+	// AuthTokens are the CNs of the clients by pre-shared token, JWT verifies signed tokens. If either is set, clients
+	// may connect without certificate and authenticate with a token instead, see Utils.CTRLAUTH.
+	AuthTokens map[string]string
+	JWT        JWTConfig
+	// CRLFile is a CRL of the CA in PEM or DER form, client certificates it lists are refused. OCSPResponder is the URL
+	// of an OCSP responder client certificates are checked with, if set. If it can't be asked, clients are refused
+	// unless OCSPSoftFail is set. Both apply to new connections, a CRL is read again by Server.ReloadCertificates.
+	CRLFile       string
+	OCSPResponder string
+	OCSPSoftFail  bool
+	// ACME obtains the certificate of the server from an ACME CA instead of CertFile and KeyFile, see ACMEConfig
+	ACME ACMEConfig
+	// AssignmentsFile is where the public ports assigned to the clients are saved, see Assignments.
+	// If empty, they are forgotten when the server stops.
+	AssignmentsFile string
+	// HistoryFile is where the traffic history of the exposed ports is saved, see Server.TrafficHistory. If empty, it
+	// is forgotten when the server stops.
+	HistoryFile string
+	// StoreFile is the file of the Store of the driver StoreDriver, which keeps the settings, profiles and reserved
+	// ports changed through the admin API, and the port assignments and traffic history instead of AssignmentsFile
+	// and HistoryFile. If empty, the changes of the admin API are forgotten when the server stops.
+	StoreDriver string
+	StoreFile   string
+}
+
+// DefaultConfig returns the default settings of the server.
+func DefaultConfig() Config {
+	return Config{
+		MaxUdpSessions:    1024,
+		CtrlPort:          CTRLPORT,
+		DataPort:          DATAPORT,
+		ProxyPorts:        PortRange{First: TCPPROXYBASE, Last: TCPPROXYBASE + TCPPROXYAMOUNT - 1},
+		ExposedPorts:      PortRange{First: 1024, Last: 65535},
+		AnyPorts:          PortRange{First: 49152, Last: 65535},
+		PortLease:         DEFAULTPORTLEASE,
+		DuplicateSessions: DUPLICATEALLOW,
+		AddressFamily:     FAMILYDUAL,
+		BanWindow:         DEFAULTBANWINDOW,
+		BanDuration:       DEFAULTBANDURATION,
+		TLSMinVersion:     tls.VersionTLS12,
+		ACME:              ACMEConfig{Challenge: ACMEHTTP01, HTTPPort: ACMEHTTPPORT},
+		StoreDriver:       STOREJSON,
+	}
+}
+
+// Validate checks that the ports of the config are valid and that the server ports don't collide.
+func (c *Config) Validate() error {
+	if !validPort(c.CtrlPort) || !validPort(c.DataPort) {
+		return errors.New("invalid control or data port")
+	}
+	if c.CtrlPort == c.DataPort {
+		return errors.New("control and data port are the same")
+	}
+	if !c.ProxyPorts.valid() || !c.ExposedPorts.valid() || !c.AnyPorts.valid() {
+		return errors.New("invalid port range")
+	}
+	if !c.anyPorts().valid() {
+		return errors.New("no port for public=any in the exposed range")
+	}
+	for _, addr := range []string{c.CtrlAddr, c.DataAddr, c.PublicAddr} {
+		if addr != "" && net.ParseIP(addr) == nil {
+			return errors.New("invalid bind address " + addr)
+		}
+	}
+	if err := c.validateAddressFamily(); err != nil {
+		return err
+	}
+	if _, err := c.egressPrefixes(); err != nil {
+		return err
+	}
+	if slices.Contains(c.EgressClients, "") {
+		return errors.New("empty egress client")
+	}
+	if _, err := c.proxyPrefixes(); err != nil {
+		return err
+	}
+	if _, _, err := net.SplitHostPort(c.MetricsAddr); c.MetricsAddr != "" && err != nil {
+		return errors.New("invalid metrics address " + c.MetricsAddr)
+	}
+	if c.PprofAddr != "" && !isLoopbackAddr(c.PprofAddr) {
+		return errors.New("pprof address is no loopback address " + c.PprofAddr)
+	}
+	if _, _, err := net.SplitHostPort(c.AdminAddr); c.AdminAddr != "" && err != nil {
+		return errors.New("invalid admin address " + c.AdminAddr)
+	}
+	if _, _, err := net.SplitHostPort(c.WebSocketAddr); c.WebSocketAddr != "" && err != nil {
+		return errors.New("invalid WebSocket address " + c.WebSocketAddr)
+	}
+	if c.AdminAddr != "" && c.AdminToken == "" && len(c.AdminKeys) == 0 {
+		return errors.New("admin API without token or keys")
+	}
+	if err := c.validateAdminKeys(); err != nil {
+		return err
+	}
+	if err := c.validateHTTPFront(); err != nil {
+		return err
+	}
+	if _, ok := storeDrivers[c.StoreDriver]; c.StoreFile != "" && !ok {
+		return errors.New("unknown store driver " + c.StoreDriver)
+	}
+	if c.StoreFile != "" && (c.AssignmentsFile != "" || c.HistoryFile != "") {
+		return errors.New("assignments and history files are replaced by the store")
+	}
+	for _, w := range c.Webhooks {
+		if err := w.validate(); err != nil {
+			return err
+		}
+	}
+	if u, err := url.Parse(c.OTLPEndpoint); c.OTLPEndpoint != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https")) {
+		return errors.New("invalid OTLP endpoint " + c.OTLPEndpoint)
+	}
+	if c.ProxyPorts.Contains(c.CtrlPort) || c.ProxyPorts.Contains(c.DataPort) {
+		return errors.New("proxy port range contains the control or data port")
+	}
+	if c.PortLease < 0 || (c.PortLease > 0 && c.PortLease < MINPORTLEASE) {
+		return errors.New("port lease shorter than " + MINPORTLEASE.String())
+	}
+	if c.ClientCertValidity < 0 {
+		return errors.New("negative validity of client certificates")
+	}
+	for cn, p := range c.Profiles {
+		if err := p.validate(); err != nil {
+			return err
+		}
+		if (len(p.AllowCountries) > 0 || len(p.DenyCountries) > 0) && c.GeoIPFile == "" {
+			return errors.New("country lists in profile of client " + p.CN + " without GeoIP database")
+		}
+		if cn != p.CN {
+			return errors.New("profile of client " + p.CN + " stored as " + cn)
+		}
+	}
+	if err := c.validateTenants(); err != nil {
+		return err
+	}
+	if err := c.validateAuthzRules(); err != nil {
+		return err
+	}
+	if err := c.validateTLSPolicy(); err != nil {
+		return err
+	}
+	if err := c.validateNoise(); err != nil {
+		return err
+	}
+	if err := c.validateTokens(); err != nil {
+		return err
+	}
+	if err := c.ACME.validate(); err != nil {
+		return err
+	}
+	if c.MaxConns < 0 || c.MaxClientConns < 0 {
+		return errors.New("negative connection limit")
+	}
+	if c.ConnRate < 0 || c.ConnRatePerIP < 0 || c.CtrlRate < 0 || c.CtrlRatePerIP < 0 || c.HandshakeFailures < 0 {
+		return errors.New("negative connection rate")
+	}
+	if c.BanThreshold < 0 {
+		return errors.New("negative ban threshold")
+	}
+	if c.BanThreshold > 0 && (c.BanWindow <= 0 || c.BanDuration <= 0) {
+		return errors.New("bans without window or duration")
+	}
+	if c.HTTPCacheSize < 0 {
+		return errors.New("negative HTTP cache size")
+	}
+	if c.ResumeGrace < 0 {
+		return errors.New("negative resume grace window")
+	}
+	switch c.DuplicateSessions {
+	case DUPLICATEALLOW, DUPLICATEREFUSE, DUPLICATEREPLACE:
+	default:
+		return errors.New("invalid duplicate session policy " + c.DuplicateSessions)
+	}
+	return nil
+}
+
+// dataAddr returns the IP address the data port and the proxy ports are bound to, nil for all interfaces.
+func (c *Config) dataAddr() net.IP {
+	if c.DataAddr == "" {
+		return net.ParseIP(c.CtrlAddr)
+	}
+	return net.ParseIP(c.DataAddr)
+}
+
+// certPaths returns the paths of the CA file, the certificate and the key of the server, defaulting the empty ones to
+// the certs directory of the home directory. The CA file is empty if only the CA pool of the system is used.
+// With ACME, the certificate and key are those in the ACME directory.
+func (c *Config) certPaths() (string, string, string, error) {
+	ca, cert, key := c.CAFile, c.CertFile, c.KeyFile
+	if c.ACME.enabled() {
+		dir, err := c.acmeDir()
+		if err != nil {
+			return "", "", "", err
+		}
+		cert, key = filepath.Join(dir, SERVERCERTFILE), filepath.Join(dir, SERVERKEYFILE)
+	}
+	if (ca == "" && !c.SystemCAs) || cert == "" || key == "" {
+		dir, err := DefaultCertDir()
+		if err != nil {
+			return "", "", "", err
+		}
+		if ca == "" && !c.SystemCAs {
+			ca = filepath.Join(dir, CAFILE)
+		}
+		if cert == "" {
+			cert = filepath.Join(dir, SERVERCERTFILE)
+		}
+		if key == "" {
+			key = filepath.Join(dir, SERVERKEYFILE)
+		}
+	}
+	return ca, cert, key, nil
+}
+
+// serverPort reports whether port is used by the server itself, and therefore can't be exposed.
+func (c *Config) serverPort(port int) bool {
+	return port == c.CtrlPort || port == c.DataPort || c.ProxyPorts.Contains(port)
+}
+
+// anyPorts returns the ports of AnyPorts that are also in ExposedPorts. The range is invalid if there are none.
+func (c *Config) anyPorts() PortRange {
+	return PortRange{First: max(c.AnyPorts.First, c.ExposedPorts.First), Last: min(c.AnyPorts.Last, c.ExposedPorts.Last)}
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	First int
+	Last  int
+}
+
+// ParsePortRange parses a range in the form "first-last", or a single port.
+func ParsePortRange(s string) (PortRange, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	if !isRange {
+		last = first
+	}
+	var r PortRange
+	var err error
+	r.First, err = strconv.Atoi(first)
+	if err != nil {
+		return PortRange{}, errors.New("invalid port range " + s)
+	}
+	r.Last, err = strconv.Atoi(last)
+	if err != nil || !r.valid() {
+		return PortRange{}, errors.New("invalid port range " + s)
+	}
+	return r, nil
+}
+
+// ParsePortRanges parses a comma separated list of ranges, see ParsePortRange. An empty string is an empty list.
+func ParsePortRanges(s string) ([]PortRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var ranges []PortRange
+	for _, part := range strings.Split(s, ",") {
+		r, err := ParsePortRange(part)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, nil
+}
+
+func (r PortRange) Contains(port int) bool {
+	return port >= r.First && port <= r.Last
+}
+
+// Size returns the amount of ports in the range.
+func (r PortRange) Size() int {
+	return r.Last - r.First + 1
+}
+
+func (r PortRange) String() string {
+	return strconv.Itoa(r.First) + "-" + strconv.Itoa(r.Last)
+}
+
+// inRanges reports whether one of the ranges contains port.
+func inRanges(port int, ranges []PortRange) bool {
+	for _, r := range ranges {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r PortRange) valid() bool {
+	return validPort(r.First) && validPort(r.Last) && r.First <= r.Last
+}
+
+func validPort(port int) bool {
+	return port >= 1 && port <= 65535
+}
@@ -0,0 +1,266 @@
+// Package config loads the config file of the server. The file is TOML, of which the subset needed for settings is
+// supported: tables, and keys with strings, integers, booleans and single line arrays as values. Keys are named
+// like the flags of the server and may be grouped in tables, which only serve readability, e.g.
+//
+//	# goexpose.toml
+//	loglevel = "info"
+//
+//	[ports]
+//	ctrlport = 47921
+//	proxyports = "47923-47932"
+//	deniedports = ["22", "3306"]
+//
+//	[tls]
+//	cafile = "/etc/goexpose/myCA.pem"
+//	tlsmin = "1.3"
+//
+// Arrays are joined with commas, the form lists take on the command line.
+//
+// Every flag can be set by an environment variable as well, GOEXPOSE_ and the name of the flag in upper case unless
+// named otherwise, see EnvName, so the server runs in a container without a config file. Flags given on the command
+// line take precedence over environment variables, which take precedence over the config file, which takes
+// precedence over the defaults of the flags.
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// File holds the settings of a config file by key. Keys of tables are prefixed with the name of the table and a dot.
+type File map[string]string
+
+// Load reads and parses the config file at path.
+func Load(path string) (File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses the TOML subset of a config file.
+func Parse(data []byte) (File, error) {
+	f := make(File)
+	table := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		lineErr := func(msg string) error {
+			return errors.New("config: line " + strconv.Itoa(i+1) + ": " + msg)
+		}
+		if strings.HasPrefix(line, "[") {
+			name, ok := strings.CutSuffix(line[1:], "]")
+			name = strings.TrimSpace(name)
+			if !ok || !validKey(name) {
+				return nil, lineErr("invalid table " + line)
+			}
+			table = name + "."
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !validKey(key) {
+			return nil, lineErr("expected key = value")
+		}
+		parsed, err := parseValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, lineErr(err.Error())
+		}
+		if _, ok := f[table+key]; ok {
+			return nil, lineErr("duplicate key " + table + key)
+		}
+		f[table+key] = parsed
+	}
+	return f, nil
+}
+
+// Flags sets the flags of fs from the command line args, their environment variables and the config file the flag
+// named configFlag points to, in this order of precedence. It can be called again to read changed settings, the
+// flags are reset to their defaults first.
+func Flags(fs *flag.FlagSet, args []string, env map[string]string, configFlag string) error {
+	// a fresh set sharing the values, as fs remembers which flags were set before
+	fresh := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	fresh.SetOutput(fs.Output())
+	fs.VisitAll(func(fl *flag.Flag) {
+		_ = fl.Value.Set(fl.DefValue)
+		fresh.Var(fl.Value, fl.Name, fl.Usage)
+	})
+	err := fresh.Parse(args)
+	if err != nil {
+		return err
+	}
+	err = ApplyEnv(fresh, env)
+	if err != nil {
+		return err
+	}
+	path := fresh.Lookup(configFlag)
+	if path == nil || path.Value.String() == "" {
+		return nil
+	}
+	file, err := Load(path.Value.String())
+	if err != nil {
+		return err
+	}
+	return file.Apply(fresh, env)
+}
+
+// ENVPREFIX prefixes the names of the environment variables of flags.
+const ENVPREFIX = "GOEXPOSE_"
+
+// EnvName returns the name of the environment variable of the flag, the one env holds for it or else ENVPREFIX and
+// the name of the flag in upper case.
+func EnvName(name string, env map[string]string) string {
+	if variable, ok := env[name]; ok {
+		return variable
+	}
+	return ENVPREFIX + strings.ToUpper(name)
+}
+
+// ApplyEnv sets the flags of fs not given on the command line from their environment variables, see EnvName.
+// Variables that are empty or not set are ignored.
+func ApplyEnv(fs *flag.FlagSet, env map[string]string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		given[fl.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(fl *flag.Flag) {
+		variable := EnvName(fl.Name, env)
+		value := os.Getenv(variable)
+		if err != nil || given[fl.Name] || value == "" {
+			return
+		}
+		if setErr := fs.Set(fl.Name, value); setErr != nil {
+			err = errors.New("config: invalid value of " + variable + ": " + setErr.Error())
+		}
+	})
+	return err
+}
+
+// Apply sets the flags of fs named like the keys of the file, unless they were given on the command line or by
+// their environment variable, see EnvName. Keys naming no flag are an error, so typos don't go unnoticed.
+func (f File) Apply(fs *flag.FlagSet, env map[string]string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		given[fl.Name] = true
+	})
+	for key, value := range f {
+		name := key[strings.LastIndex(key, ".")+1:]
+		if fs.Lookup(name) == nil {
+			return errors.New("config: unknown setting " + key)
+		}
+		if given[name] {
+			continue
+		}
+		if os.Getenv(EnvName(name, env)) != "" {
+			continue
+		}
+		err := fs.Set(name, value)
+		if err != nil {
+			return errors.New("config: invalid value of " + key + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// stripComment cuts off a comment, a # outside of strings.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseValue returns a value in the form the flag takes it.
+func parseValue(value string) (string, error) {
+	if strings.HasPrefix(value, "[") {
+		inner, ok := strings.CutSuffix(value[1:], "]")
+		if !ok {
+			return "", errors.New("arrays have to end on the same line")
+		}
+		var elems []string
+		for _, elem := range splitArray(inner) {
+			elem = strings.TrimSpace(elem)
+			// a trailing comma is allowed
+			if elem == "" {
+				continue
+			}
+			parsed, err := parseValue(elem)
+			if err != nil {
+				return "", err
+			}
+			elems = append(elems, parsed)
+		}
+		return strings.Join(elems, ","), nil
+	}
+	switch {
+	case strings.HasPrefix(value, "\""):
+		s, err := strconv.Unquote(value)
+		if err != nil {
+			return "", errors.New("invalid string " + value)
+		}
+		return s, nil
+	case strings.HasPrefix(value, "'"):
+		s, ok := strings.CutSuffix(value[1:], "'")
+		if !ok || strings.Contains(s, "'") {
+			return "", errors.New("invalid string " + value)
+		}
+		return s, nil
+	case value == "true" || value == "false":
+		return value, nil
+	}
+	n, err := strconv.ParseInt(strings.ReplaceAll(value, "_", ""), 10, 64)
+	if err != nil {
+		return "", errors.New("invalid value " + value)
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+// splitArray splits the elements of an array at the commas outside of strings.
+func splitArray(s string) []string {
+	var elems []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ',':
+			elems = append(elems, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(elems, s[start:])
+}
@@ -0,0 +1,111 @@
+package Server
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+)
+
+// connLimit counts the simultaneous relayed connections of the relays sharing it, TCP connections and UDP sessions
+// alike, and caps them at max, so a single busy port can't use up the file descriptors of the server.
+// A max of 0 only counts. A nil connLimit counts nothing.
+type connLimit struct {
+	max    atomic.Int64
+	active atomic.Int64
+}
+
+func newConnLimit(max int) *connLimit {
+	l := new(connLimit)
+	l.max.Store(int64(max))
+	return l
+}
+
+// setMax changes the cap, connections above a lowered cap are kept but no new ones are counted until they end.
+func (l *connLimit) setMax(max int) {
+	l.max.Store(int64(max))
+}
+
+// acquire counts a new connection and reports whether it is within the limit. Only acquired connections are released.
+func (l *connLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+	if n, max := l.active.Add(1), l.max.Load(); max > 0 && n > max {
+		l.active.Add(-1)
+		return false
+	}
+	return true
+}
+
+func (l *connLimit) release() {
+	if l != nil {
+		l.active.Add(-1)
+	}
+}
+
+// count returns the amount of connections counted at the moment.
+func (l *connLimit) count() int {
+	if l == nil {
+		return 0
+	}
+	return int(l.active.Load())
+}
+
+// acquireConn counts a new relayed connection with every limit of the relay. If one of them is reached, the
+// connection is counted as rejected and false is returned.
+func (r *Relay) acquireConn() bool {
+	for i, l := range r.connLimits {
+		if !l.acquire() {
+			for _, acquired := range r.connLimits[:i] {
+				acquired.release()
+			}
+			r.stats.Rejected.Add(1)
+			return false
+		}
+	}
+	return true
+}
+
+// releaseConn releases a connection acquired with acquireConn.
+func (r *Relay) releaseConn() {
+	for _, l := range r.connLimits {
+		l.release()
+	}
+}
+
+// acquirePeer counts a new relayed connection of the public peer, and reports whether its IP holds no more than
+// RelayConfig.PeerConns connections of the relay with it. If it would, the connection is counted as rejected and
+// false is returned. Peers without IP are not capped.
+func (r *Relay) acquirePeer(peer net.Addr) bool {
+	ip, ok := peerIP(peer)
+	if !ok {
+		return true
+	}
+	max := r.config.Load().PeerConns
+	r.peerConnsMu.Lock()
+	defer r.peerConnsMu.Unlock()
+	if max > 0 && r.peerConns[ip] >= max {
+		r.stats.Rejected.Add(1)
+		return false
+	}
+	if r.peerConns == nil {
+		r.peerConns = make(map[netip.Addr]int)
+	}
+	r.peerConns[ip]++
+	return true
+}
+
+// releasePeer releases a connection acquired with acquirePeer.
+func (r *Relay) releasePeer(peer net.Addr) {
+	ip, ok := peerIP(peer)
+	if !ok {
+		return
+	}
+	r.peerConnsMu.Lock()
+	defer r.peerConnsMu.Unlock()
+	if r.peerConns[ip] <= 1 {
+		delete(r.peerConns, ip)
+		return
+	}
+	r.peerConns[ip]--
+}
@@ -0,0 +1,24 @@
+package Server
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// DASHBOARDPATH is the path the dashboard is served on by the admin listener, see Config.AdminAddr. The dashboard
+// shows the clients, their tunnels with graphs of their throughput and the recent events, and disconnects clients and
+// hides ports. It asks for Config.AdminToken or one of Config.AdminKeys, polls the admin API with it and follows
+// its event stream.
+const DASHBOARDPATH = "/"
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+func serveDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// the page only talks to the admin API it was served by
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = w.Write(dashboardPage)
+}
@@ -0,0 +1,148 @@
+package Server
+
+import (
+	"Utils"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// dataListener listens on the data port while clients wait for their multiplexed data connection, and hands every
+// data connection to the client whose token it presents. The clients of a Server share one, so several of them
+// can set up multiplexing at the same time.
+type dataListener struct {
+	// network is tcp, tcp4 or tcp6, see Config.AddressFamily
+	network string
+	ip      net.IP
+	port    int
+	tls     *tls.Config
+	logger  *slog.Logger
+
+	mu       sync.Mutex
+	listener *net.TCPListener
+	// pending holds the clients waiting for their data connection by token
+	pending map[string]*pendingData
+}
+
+// pendingData is a client waiting for its data connection, which has to come from the IP of its control connection.
+type pendingData struct {
+	ctrlIP string
+	conns  chan net.Conn
+}
+
+// newDataListener creates a dataListener for the port of the IP address, all interfaces if nil, on the network. If
+// tlsConfig is nil, data connections are plaintext.
+func newDataListener(network string, ip net.IP, port int, tlsConfig *tls.Config, logger *slog.Logger) *dataListener {
+	return &dataListener{
+		network: network,
+		ip:      ip,
+		port:    port,
+		tls:     tlsConfig,
+		logger:  logger,
+		pending: make(map[string]*pendingData),
+	}
+}
+
+// expect registers the token of a client and listens on the data port, unless it already does for another client.
+// The data connection presenting the token is sent on the returned channel. done has to be called once the client
+// stops waiting.
+func (d *dataListener) expect(token string, ctrlIP string) (<-chan net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.listener == nil {
+		l, err := net.ListenTCP(d.network, &net.TCPAddr{IP: d.ip, Port: d.port})
+		if err != nil {
+			return nil, err
+		}
+		d.listener = l
+		go d.accept(l)
+	}
+	p := &pendingData{ctrlIP: ctrlIP, conns: make(chan net.Conn, 1)}
+	d.pending[token] = p
+	return p.conns, nil
+}
+
+// done unregisters the token and closes a data connection that arrived after the client stopped waiting.
+// The data port is closed once no client waits anymore.
+func (d *dataListener) done(token string, conns <-chan net.Conn) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.pending, token)
+	select {
+	case conn := <-conns:
+		_ = conn.Close()
+	default:
+	}
+	if len(d.pending) == 0 && d.listener != nil {
+		_ = d.listener.Close()
+		d.listener = nil
+	}
+}
+
+// accept admits data connections until the listener is closed.
+func (d *dataListener) accept(l *net.TCPListener) {
+	for {
+		tcpConn, err := l.AcceptTCP()
+		if err != nil {
+			d.logger.Debug("Data port closed", slog.String("Func", "accept"), "Error", err)
+			return
+		}
+		go d.admit(tcpConn)
+	}
+}
+
+// admit reads the token of a data connection and hands the connection to the client waiting for it. Connections
+// that don't come from the IP of a waiting client, or don't present a valid token within MUXACCEPTTIMEOUT, are closed.
+func (d *dataListener) admit(tcpConn *net.TCPConn) {
+	ip, _, _ := net.SplitHostPort(tcpConn.RemoteAddr().String())
+	if !d.waiting(ip) {
+		d.logger.Error("Rejected data connection", slog.String("Func", "admit"), "Error", errors.New("no client waits for a data connection from "+ip))
+		_ = tcpConn.Close()
+		return
+	}
+	var conn net.Conn = tcpConn
+	if d.tls != nil {
+		conn = tls.Server(tcpConn, d.tls)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(MUXACCEPTTIMEOUT))
+	presented, err := Utils.ReadProxyToken(conn)
+	if err != nil {
+		d.logger.Error("Error reading data connection token", slog.String("Func", "admit"), "Error", err)
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for token, p := range d.pending {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			continue
+		}
+		if err := checkProxyIP(tcpConn, p.ctrlIP); err != nil {
+			break
+		}
+		// a token is redeemed only once
+		delete(d.pending, token)
+		p.conns <- conn
+		return
+	}
+	d.logger.Error("Rejected data connection with invalid token", slog.String("Func", "admit"))
+	_ = conn.Close()
+}
+
+// waiting reports whether a client with the control connection IP waits for its data connection.
+func (d *dataListener) waiting(ip string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, p := range d.pending {
+		if p.ctrlIP == ip {
+			return true
+		}
+	}
+	return false
+}
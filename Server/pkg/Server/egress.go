@@ -0,0 +1,121 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// EGRESSDIALTIMEOUT is how long the server tries to connect an egress stream to its destination.
+const EGRESSDIALTIMEOUT = 10 * time.Second
+
+// errEgressDenied is returned for destinations outside Config.EgressNetworks
+var errEgressDenied = errors.New("egress destination not allowed")
+
+// egressPrefixes returns the prefixes of Config.EgressNetworks.
+func (c *Config) egressPrefixes() ([]netip.Prefix, error) {
+	return parsePrefixes(c.EgressNetworks, "egress network")
+}
+
+// startEgress answers a CTRLEGRESS frame. Clients of Config.EgressClients get the inline session started, the
+// egress streams they open on it are connected to their destination in the network of the server, see
+// Utils.WriteEgressHeader.
+func (c *ClientHandler) startEgress(ctx context.Context, toclient chan *Utils.CTRLFrame) {
+	if !slices.Contains(c.config().EgressClients, c.identity.CN) {
+		c.logger.Info("Refused egress", slog.String("Func", "startEgress"))
+		c.respond(ctx, toclient, Utils.NewCTRLFrame(Utils.CTRLERROR, []string{"", "", "egress not allowed", Utils.ERRFORBIDDEN}))
+		return
+	}
+	if !c.egress {
+		c.egress = true
+		go c.acceptEgress(ctx, c.inlineMux(ctx, toclient))
+		c.logger.Info("Accepting egress streams", slog.String("Func", "startEgress"))
+	}
+	c.respond(ctx, toclient, Utils.NewCTRLFrame(Utils.CTRLEGRESS, nil))
+}
+
+// acceptEgress serves the egress streams the client opens on the session until it is closed.
+func (c *ClientHandler) acceptEgress(ctx context.Context, session *Utils.MuxSession) {
+	for {
+		st, err := session.Accept()
+		if err != nil {
+			return
+		}
+		go c.serveEgress(ctx, st)
+	}
+}
+
+// serveEgress connects an egress stream to its destination and relays it until both sides are done. The client has
+// to be one of Config.EgressClients still and the destination within Config.EgressNetworks, checked on the address
+// connected to, so host names can't resolve around them.
+func (c *ClientHandler) serveEgress(ctx context.Context, st *Utils.MuxStream) {
+	defer st.Close()
+	_ = st.SetReadDeadline(time.Now().Add(EGRESSDIALTIMEOUT))
+	address, err := Utils.ReadEgressHeader(st)
+	_ = st.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.logger.Error("Error reading egress header", slog.String("Func", "serveEgress"), "Error", err)
+		return
+	}
+	logger := c.logger.With(slog.String("Destination", address))
+	config := c.config()
+	prefixes, _ := config.egressPrefixes()
+	if !slices.Contains(config.EgressClients, c.identity.CN) {
+		logger.Info("Refused egress stream of a client no longer allowed", slog.String("Func", "serveEgress"))
+		_, _ = st.Write([]byte{Utils.EGRESSDENIED})
+		return
+	}
+	if !c.serverConns.acquire() {
+		logger.Info("Refused egress stream, too many connections", slog.String("Func", "serveEgress"))
+		_, _ = st.Write([]byte{Utils.EGRESSFAILED})
+		return
+	}
+	defer c.serverConns.release()
+	dialer := &net.Dialer{
+		Timeout: EGRESSDIALTIMEOUT,
+		ControlContext: func(_ context.Context, _ string, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if len(prefixes) > 0 && !slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(addrPort.Addr().Unmap()) }) {
+				return errEgressDenied
+			}
+			return nil
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		logger.Info("Error connecting egress stream", slog.String("Func", "serveEgress"), "Error", err)
+		if errors.Is(err, errEgressDenied) {
+			_, _ = st.Write([]byte{Utils.EGRESSDENIED})
+		} else {
+			_, _ = st.Write([]byte{Utils.EGRESSFAILED})
+		}
+		return
+	}
+	defer conn.Close()
+	_, err = st.Write([]byte{Utils.EGRESSOK})
+	if err != nil {
+		return
+	}
+	logger.Debug("Connected egress stream", slog.String("Func", "serveEgress"))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(conn, st)
+		_ = conn.(*net.TCPConn).CloseWrite()
+	}()
+	_, _ = io.Copy(st, conn)
+	_ = st.CloseWrite()
+	wg.Wait()
+}
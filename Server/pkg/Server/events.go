@@ -0,0 +1,191 @@
+package Server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kinds of Event.
+const (
+	EVENTCLIENTCONNECTED    = "client_connected"
+	EVENTCLIENTDISCONNECTED = "client_disconnected"
+	EVENTTUNNELCREATED      = "tunnel_created"
+	EVENTTUNNELDESTROYED    = "tunnel_destroyed"
+	EVENTRELAYERROR         = "relay_error"
+	EVENTTRAFFICSAMPLE      = "traffic_sample"
+)
+
+// EVENTKINDS are all kinds of Event.
+var EVENTKINDS = []string{EVENTCLIENTCONNECTED, EVENTCLIENTDISCONNECTED, EVENTTUNNELCREATED, EVENTTUNNELDESTROYED, EVENTRELAYERROR, EVENTTRAFFICSAMPLE}
+
+// EVENTQUEUE is the amount of events queued per subscriber, further events are dropped until it caught up.
+const EVENTQUEUE = 256
+
+// Event is something that happened to a client or one of its tunnels.
+type Event struct {
+	Kind string
+	Time time.Time
+	// ClientID and Client are the session and the identity of the client, Address the address of its control connection
+	ClientID uint64
+	Client   ClientIdentity
+	Address  string
+	// Tunnel is the exposed port of tunnel events and relay errors
+	Tunnel Tunnel
+	// Reason is the error of a relay error, or why a session ended if it was not the client disconnecting
+	Reason string
+	// BytesIn, BytesOut and Conns are the traffic of the tunnel since its previous traffic sample, see
+	// HISTORYSAMPLEINTERVAL. Tunnels without traffic publish no samples.
+	BytesIn  uint64
+	BytesOut uint64
+	Conns    uint64
+}
+
+// Subscriber receives the events of a Server, see Server.Subscribe. HandleEvent is called from a goroutine of the
+// subscriber, one event after the other.
+type Subscriber interface {
+	HandleEvent(Event)
+}
+
+// EventBus delivers events to its subscribers. Every subscriber has a queue of its own, so a slow one doesn't hold up
+// the server or the other subscribers. The zero value has no subscribers, a nil EventBus drops all events. It is safe
+// for concurrent use.
+type EventBus struct {
+	mu   sync.RWMutex
+	subs map[*subscription]struct{}
+}
+
+type subscription struct {
+	queue   chan Event
+	dropped atomic.Uint64
+}
+
+// Subscribe starts delivering events to the subscriber until the returned function is called.
+func (b *EventBus) Subscribe(subscriber Subscriber) (unsubscribe func()) {
+	sub := &subscription{queue: make(chan Event, EVENTQUEUE)}
+	b.mu.Lock()
+	if b.subs == nil {
+		b.subs = make(map[*subscription]struct{})
+	}
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	go func() {
+		for event := range sub.queue {
+			subscriber.HandleEvent(event)
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, sub)
+			b.mu.Unlock()
+			close(sub.queue)
+		})
+	}
+}
+
+// publish queues the event for all subscribers, stamped with the current time if it has none.
+func (b *EventBus) publish(event Event) {
+	if b == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		select {
+		case sub.queue <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// Dropped returns the amount of events dropped because the queue of a subscriber was full.
+func (b *EventBus) Dropped() uint64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var dropped uint64
+	for sub := range b.subs {
+		dropped += sub.dropped.Load()
+	}
+	return dropped
+}
+
+// eventCounts counts the events by kind for the metrics of the server.
+type eventCounts struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func (e *eventCounts) HandleEvent(event Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.counts == nil {
+		e.counts = make(map[string]uint64)
+	}
+	e.counts[event.Kind]++
+}
+
+// snapshot returns the counts of the kinds of events.
+func (e *eventCounts) snapshot() map[string]uint64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	counts := make(map[string]uint64, len(e.counts))
+	for kind, n := range e.counts {
+		counts[kind] = n
+	}
+	return counts
+}
+
+// RECENTEVENTS is the amount of recent events kept for the admin API, see recentEvents.
+const RECENTEVENTS = 100
+
+// recentEvents keeps the last RECENTEVENTS events besides traffic samples, which would crowd out the others.
+type recentEvents struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (e *recentEvents) HandleEvent(event Event) {
+	if event.Kind == EVENTTRAFFICSAMPLE {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.events) == RECENTEVENTS {
+		copy(e.events, e.events[1:])
+		e.events = e.events[:RECENTEVENTS-1]
+	}
+	e.events = append(e.events, event)
+}
+
+// snapshot returns the recent events, oldest first.
+func (e *recentEvents) snapshot() []Event {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]Event(nil), e.events...)
+}
+
+// publish publishes an event of the client with the tunnel, if the handler has an event bus.
+func (c *ClientHandler) publish(kind string, tunnel Tunnel, reason string) {
+	c.events.publish(Event{
+		Kind:     kind,
+		ClientID: c.clientID,
+		Client:   c.identity,
+		Address:  c.Conn.RemoteAddr().String(),
+		Tunnel:   tunnel,
+		Reason:   reason,
+	})
+}
+
+// Subscribe starts delivering the events of the server to the subscriber until the returned function is called.
+func (s *Server) Subscribe(subscriber Subscriber) (unsubscribe func()) {
+	return s.events.Subscribe(subscriber)
+}
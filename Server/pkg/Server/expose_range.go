@@ -0,0 +1,101 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"log/slog"
+	"strconv"
+)
+
+// MAXEXPOSERANGE is the largest range of ports a single EXPOSE frame can expose.
+const MAXEXPOSERANGE = 256
+
+// exposeRange exposes a range of ports of the client on a contiguous range of public ports, e.g. the ports of a game
+// server. The public range starts at the public port the client asked for, or at a random port for public=any, and at
+// the first port of the range otherwise. Either every port is exposed, or none is: if one of them fails, the relays
+// created so far are discarded and the client is answered with a single CTRLERROR for the range.
+// Every exposed port is answered with its own CTRLEXPOSED, and can be reconfigured, renewed and hidden on its own.
+func (c *ClientHandler) exposeRange(ctx context.Context, network string, ports PortRange, config *RelayConfig, toclient chan *Utils.CTRLFrame) {
+	rangeStr := ports.String()
+	if ports.Size() > MAXEXPOSERANGE {
+		c.logger.Error("Port range too large", slog.String("Func", "exposeRange"), slog.String("Network", network), slog.String("Ports", rangeStr))
+		c.reject(ctx, toclient, network, rangeStr, Utils.ERRINVALID, "port range larger than "+strconv.Itoa(MAXEXPOSERANGE))
+		return
+	}
+	if config.Name != "" || config.Host != "" {
+		c.logger.Error("Port range can't be named or exposed under a host", slog.String("Func", "exposeRange"), slog.String("Network", network), slog.String("Ports", rangeStr))
+		c.reject(ctx, toclient, network, rangeStr, Utils.ERRINVALID, "a port range can't be named or exposed under a host")
+		return
+	}
+	for port := ports.First; port <= ports.Last; port++ {
+		if c.tunnels.get(network, port) != nil {
+			c.logger.Error("Port of range already exposed", slog.String("Func", "exposeRange"), slog.String("Network", network), slog.Int("Port", port))
+			c.reject(ctx, toclient, network, rangeStr, Utils.ERRUNAVAILABLE, "port "+strconv.Itoa(port)+" already exposed")
+			return
+		}
+	}
+	cn := c.clientCN()
+	quota := c.config().quota(cn).limit(network)
+	if quota > 0 && c.tunnels.count(network)+ports.Size() > quota {
+		c.logger.Error("Port quota reached", slog.String("Func", "exposeRange"), slog.String("Network", network), slog.String("Ports", rangeStr), slog.Int("Quota", quota))
+		c.reject(ctx, toclient, network, rangeStr, Utils.ERRQUOTA, "quota of "+strconv.Itoa(quota)+" "+network+" ports reached")
+		return
+	}
+	if quota, exceeded := c.tenantQuotaExceeded(network, ports.Size()); exceeded {
+		c.logger.Error("Tenant port quota reached", slog.String("Func", "exposeRange"), slog.String("Network", network), slog.String("Ports", rangeStr), slog.Int("Quota", quota))
+		c.reject(ctx, toclient, network, rangeStr, Utils.ERRQUOTA, "quota of "+strconv.Itoa(quota)+" "+network+" ports of the tenant reached")
+		return
+	}
+
+	var prepared []*Relay
+	code, reason := Utils.ERRUNAVAILABLE, "no free port range for public=any"
+	if config.AnyPort {
+		ranges := c.anyRanges()
+		for i := 0; i < ANYPORTATTEMPTS; i++ {
+			first, ok := randomPort(ranges, ports.Size())
+			if !ok {
+				break
+			}
+			if c.config().hasReserved(PortRange{First: first, Last: first + ports.Size() - 1}) {
+				continue
+			}
+			prepared, code, reason = c.prepareRange(ctx, network, ports, first, cn, config, toclient)
+			if prepared != nil {
+				break
+			}
+		}
+	} else {
+		first := ports.First
+		if config.PublicPort != 0 {
+			first = config.PublicPort
+		}
+		prepared, code, reason = nil, Utils.ERRRANGE, "port out of range"
+		if validPort(first + ports.Size() - 1) {
+			prepared, code, reason = c.prepareRange(ctx, network, ports, first, cn, config, toclient)
+		}
+	}
+	if prepared == nil {
+		c.reject(ctx, toclient, network, rangeStr, code, reason)
+		return
+	}
+	for _, relay := range prepared {
+		c.startRelay(ctx, relay, cn, toclient)
+	}
+}
+
+// prepareRange prepares a relay for every port of the range, listening on the public ports starting at first.
+// If one of them fails, the others are discarded and the error code and reason of the failure are returned.
+func (c *ClientHandler) prepareRange(ctx context.Context, network string, ports PortRange, first int, cn string, config *RelayConfig, toclient chan *Utils.CTRLFrame) ([]*Relay, string, string) {
+	prepared := make([]*Relay, 0, ports.Size())
+	for port := ports.First; port <= ports.Last; port++ {
+		relay, code, reason := c.prepareRelay(ctx, network, port, first+port-ports.First, cn, config, toclient)
+		if relay == nil {
+			for _, r := range prepared {
+				c.discardRelay(r)
+			}
+			return nil, code, reason
+		}
+		prepared = append(prepared, relay)
+	}
+	return prepared, "", ""
+}
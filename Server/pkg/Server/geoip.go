@@ -0,0 +1,274 @@
+package Server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+)
+
+// MMDBMETADATA marks the start of the metadata of a MaxMind DB file, see GeoIP.
+const MMDBMETADATA = "\xAB\xCD\xEFMaxMind.com"
+
+// MMDBDATAGAP is the gap of zero bytes between the search tree and the data section of a MaxMind DB file.
+const MMDBDATAGAP = 16
+
+// Types of the data section of a MaxMind DB file, types beyond 7 are extended types.
+const (
+	mmdbPointer = 1
+	mmdbString  = 2
+	mmdbDouble  = 3
+	mmdbBytes   = 4
+	mmdbUint16  = 5
+	mmdbUint32  = 6
+	mmdbMap     = 7
+	mmdbInt32   = 8
+	mmdbUint64  = 9
+	mmdbUint128 = 10
+	mmdbArray   = 11
+	mmdbBoolean = 14
+	mmdbFloat   = 15
+)
+
+// GeoIP looks up the countries of IP addresses in a MaxMind DB file, e.g. GeoLite2-Country.mmdb, see
+// Config.GeoIPFile. The file is read into memory once.
+type GeoIP struct {
+	db         []byte
+	nodeCount  uint64
+	recordSize uint64
+	ipVersion  uint64
+	// data is the start of the data section pointers are relative to, ipv4Node the node of ::/96 in the tree of an
+	// IPv6 database
+	data     uint64
+	ipv4Node uint64
+}
+
+// OpenGeoIP reads the MaxMind DB file at path.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	db, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseGeoIP(db)
+}
+
+func parseGeoIP(db []byte) (*GeoIP, error) {
+	start := bytes.LastIndex(db, []byte(MMDBMETADATA))
+	if start < 0 {
+		return nil, errors.New("no MaxMind DB metadata")
+	}
+	meta := &GeoIP{db: db[start+len(MMDBMETADATA):]}
+	metadata, _, err := meta.decode(0)
+	if err != nil {
+		return nil, errors.New("invalid MaxMind DB metadata: " + err.Error())
+	}
+	fields, _ := metadata.(map[string]any)
+	g := &GeoIP{db: db[:start]}
+	g.nodeCount, _ = fields["node_count"].(uint64)
+	g.recordSize, _ = fields["record_size"].(uint64)
+	g.ipVersion, _ = fields["ip_version"].(uint64)
+	if g.recordSize != 24 && g.recordSize != 28 && g.recordSize != 32 {
+		return nil, errors.New("unsupported MaxMind DB record size")
+	}
+	if g.ipVersion != 4 && g.ipVersion != 6 {
+		return nil, errors.New("unsupported MaxMind DB IP version")
+	}
+	g.data = g.nodeCount*g.recordSize/4 + MMDBDATAGAP
+	if g.data > uint64(len(g.db)) {
+		return nil, errors.New("truncated MaxMind DB search tree")
+	}
+	if g.ipVersion == 6 {
+		for i := 0; i < 96 && g.ipv4Node < g.nodeCount; i++ {
+			g.ipv4Node = g.record(g.ipv4Node, 0)
+		}
+	}
+	return g, nil
+}
+
+// Country returns the ISO 3166 code of the country of the IP, the registered country if the database knows no
+// other, and an empty string for IPs it doesn't know. A nil GeoIP knows no IP.
+func (g *GeoIP) Country(ip netip.Addr) string {
+	if g == nil {
+		return ""
+	}
+	ip = ip.Unmap()
+	if ip.Is6() && g.ipVersion == 4 {
+		return ""
+	}
+	node := uint64(0)
+	if ip.Is4() && g.ipVersion == 6 {
+		node = g.ipv4Node
+	}
+	addr := ip.AsSlice()
+	for i := 0; i < len(addr)*8 && node < g.nodeCount; i++ {
+		node = g.record(node, addr[i/8]>>(7-i%8)&1)
+	}
+	if node <= g.nodeCount {
+		return ""
+	}
+	value, _, err := g.decode(g.data + node - g.nodeCount - MMDBDATAGAP)
+	if err != nil {
+		return ""
+	}
+	record, _ := value.(map[string]any)
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := record[key].(map[string]any)
+		if code, ok := country["iso_code"].(string); ok {
+			return strings.ToUpper(code)
+		}
+	}
+	return ""
+}
+
+// record returns the left or right record of the node of the search tree, nodeCount for records out of the file.
+func (g *GeoIP) record(node uint64, bit byte) uint64 {
+	size := g.recordSize / 4
+	off := node * size
+	if off+size > uint64(len(g.db)) {
+		return g.nodeCount
+	}
+	b := g.db[off : off+size]
+	switch g.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		if bit == 0 {
+			return uint64(b[3]&0xF0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0F)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	}
+	return uint64(binary.BigEndian.Uint32(b[bit*4:]))
+}
+
+// decode decodes the value at the offset of the file, and returns it with the offset after it. Maps are decoded as
+// map[string]any, arrays as []any, unsigned integers as uint64.
+func (g *GeoIP) decode(off uint64) (any, uint64, error) {
+	return g.decodeDepth(off, 0)
+}
+
+func (g *GeoIP) decodeDepth(off uint64, depth int) (any, uint64, error) {
+	if depth > 32 {
+		return nil, 0, errors.New("nested too deep")
+	}
+	b, off, err := g.read(off, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	typ := uint64(ctrl >> 5)
+	if typ == mmdbPointer {
+		n := uint64(ctrl>>3&3) + 1
+		b, next, err := g.read(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		pointer := uint64(ctrl & 7)
+		if n == 4 {
+			pointer = 0
+		}
+		for _, c := range b {
+			pointer = pointer<<8 | uint64(c)
+		}
+		pointer += []uint64{0, 2048, 526336, 0}[n-1]
+		value, _, err := g.decodeDepth(g.data+pointer, depth+1)
+		return value, next, err
+	}
+	if typ == 0 {
+		b, off, err = g.read(off, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint64(b[0])
+	}
+	size := uint64(ctrl & 0x1F)
+	if size >= 29 {
+		n := size - 28
+		b, off, err = g.read(off, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		size = 0
+		for _, c := range b {
+			size = size<<8 | uint64(c)
+		}
+		size += []uint64{29, 285, 65821}[n-1]
+	}
+	switch typ {
+	case mmdbMap:
+		m := make(map[string]any, min(size, 64))
+		for range size {
+			var key, value any
+			key, off, err = g.decodeDepth(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			value, off, err = g.decodeDepth(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is no string")
+			}
+			m[k] = value
+		}
+		return m, off, nil
+	case mmdbArray:
+		a := make([]any, 0, min(size, 64))
+		for range size {
+			var value any
+			value, off, err = g.decodeDepth(off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, off, nil
+	case mmdbBoolean:
+		return size != 0, off, nil
+	}
+	b, off, err = g.read(off, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch typ {
+	case mmdbString:
+		return string(b), off, nil
+	case mmdbBytes:
+		return slices.Clone(b), off, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	case mmdbUint16, mmdbUint32, mmdbInt32, mmdbUint64, mmdbUint128:
+		if size > 8 {
+			// beyond uint64, only the low bytes are kept
+			b = b[size-8:]
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, off, nil
+	}
+	return nil, 0, errors.New("unknown type")
+}
+
+// read returns the n bytes at the offset of the file and the offset after them.
+func (g *GeoIP) read(off uint64, n uint64) ([]byte, uint64, error) {
+	if off > uint64(len(g.db)) || n > uint64(len(g.db))-off {
+		return nil, 0, errors.New("value beyond the end of the file")
+	}
+	return g.db[off : off+n], off + n, nil
+}
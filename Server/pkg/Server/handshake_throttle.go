@@ -0,0 +1,84 @@
+package Server
+
+import (
+	"log/slog"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// HANDSHAKEWINDOW is the time the failed handshakes of a source IP on the control listener are counted over, see
+// Config.HandshakeFailures.
+const HANDSHAKEWINDOW = time.Minute
+
+// handshakeThrottle counts the failed handshakes of control connections per source IP, and throttles the IPs that
+// failed Config.HandshakeFailures times within HANDSHAKEWINDOW until it passed, so scanners and certificate guessing
+// neither take up handshakes nor flood the log. The zero value is ready to use.
+type handshakeThrottle struct {
+	mu       sync.Mutex
+	failures map[netip.Addr]*banRecord
+}
+
+// fail counts a failed handshake of the peer and returns the failures of its IP within the window, 0 if it has none.
+func (h *handshakeThrottle) fail(peer net.Addr) int {
+	ip, ok := peerIP(peer)
+	if !ok {
+		return 0
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	record := h.failures[ip]
+	if record == nil || now.Sub(record.since) > HANDSHAKEWINDOW {
+		if len(h.failures) >= MAXBANSOURCES {
+			for ip, record := range h.failures {
+				if now.Sub(record.since) > HANDSHAKEWINDOW {
+					delete(h.failures, ip)
+				}
+			}
+		}
+		if len(h.failures) >= MAXBANSOURCES {
+			return 0
+		}
+		if h.failures == nil {
+			h.failures = make(map[netip.Addr]*banRecord)
+		}
+		record = &banRecord{since: now}
+		h.failures[ip] = record
+	}
+	record.failures++
+	return record.failures
+}
+
+// throttled reports whether the IP of the peer failed limit handshakes within the window, never for a limit of 0.
+func (h *handshakeThrottle) throttled(peer net.Addr, limit int) bool {
+	ip, ok := peerIP(peer)
+	if limit == 0 || !ok {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	record := h.failures[ip]
+	return record != nil && time.Since(record.since) <= HANDSHAKEWINDOW && record.failures >= limit
+}
+
+// failHandshake counts the failed handshake of a control connection of the peer towards its throttling and a ban,
+// and logs it. Once the IP is throttled, only the first failure of the window and the throttling are errors.
+func (s *Server) failHandshake(peer net.Addr, config *Config, err error) {
+	s.bans.fail(peer, FAILHANDSHAKE)
+	address := peer.String()
+	if config.HandshakeFailures == 0 {
+		s.Logger.Error("Error in handshake", slog.String("Func", "serveClient"), slog.String("Address", address), "Error", err)
+		return
+	}
+	switch failures := s.handshakes.fail(peer); {
+	case failures == config.HandshakeFailures:
+		s.Logger.Error("Throttling control connections after failed handshakes", slog.String("Func", "serveClient"),
+			slog.String("Address", address), slog.Int("Failures", failures), slog.Duration("Window", HANDSHAKEWINDOW), "Error", err)
+	case failures <= 1:
+		s.Logger.Error("Error in handshake", slog.String("Func", "serveClient"), slog.String("Address", address), "Error", err)
+	default:
+		s.Logger.Debug("Error in handshake", slog.String("Func", "serveClient"), slog.String("Address", address), "Error", err)
+	}
+}
@@ -0,0 +1,53 @@
+package Server
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Paths of the health checks, served next to the metrics, see Config.MetricsAddr. HEALTHPATH fails once the server
+// stopped, READYPATH until it accepts clients.
+const (
+	HEALTHPATH = "/healthz"
+	READYPATH  = "/readyz"
+)
+
+// Healthy returns an error once Run returned, after it failed to start or was stopped.
+func (s *Server) Healthy() error {
+	if s.stopped.Load() {
+		return errors.New("server stopped")
+	}
+	return nil
+}
+
+// Ready returns the reasons the server doesn't accept clients yet, or nil if it does: the control listener has to be
+// up, the TLS config loaded and the proxy ports initialized.
+func (s *Server) Ready() error {
+	var errs []error
+	if err := s.Healthy(); err != nil {
+		errs = append(errs, err)
+	}
+	if s.tlsConfig.Load() == nil {
+		errs = append(errs, errors.New("TLS config not loaded"))
+	}
+	if !s.poolsReady.Load() {
+		errs = append(errs, errors.New("proxy ports not initialized"))
+	}
+	if !s.ctrlUp.Load() {
+		errs = append(errs, errors.New("control listener down"))
+	}
+	return errors.Join(errs...)
+}
+
+// healthHandler answers a health check with 200 and ok, or 503 and the reasons the check failed.
+func healthHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if err := check(); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte(err.Error() + "\n"))
+			return
+		}
+		_, _ = w.Write([]byte("ok\n"))
+	}
+}
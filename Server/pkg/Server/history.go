@@ -0,0 +1,369 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Traffic history of the exposed ports, kept by the minute for the last hour and by the hour for the last day.
+const (
+	MINUTEBUCKETS = 60
+	HOURBUCKETS   = 24
+	// HISTORYSAMPLEINTERVAL is how often a relay adds its traffic to its history
+	HISTORYSAMPLEINTERVAL = 10 * time.Second
+	// HISTORYSAVEINTERVAL is how often the histories are saved to Config.HistoryFile
+	HISTORYSAVEINTERVAL = time.Minute
+)
+
+// TrafficBucket is the traffic of an exposed port in the minute or hour starting at Start. BytesIn were sent by
+// external peers, BytesOut to them, Conns counts the accepted connections or UDP sessions.
+type TrafficBucket struct {
+	Start    time.Time
+	BytesIn  uint64
+	BytesOut uint64
+	Conns    uint64
+}
+
+// trafficHistory is the traffic of an exposed port in ring buffers of minute and hour buckets. Buckets are placed by
+// their start, so those of an earlier lap, e.g. after the port was hidden for a while, count as empty. A nil
+// trafficHistory records nothing.
+type trafficHistory struct {
+	// cn, network and port name the exposed port, see trafficHistories
+	cn      string
+	network string
+	port    int
+
+	mu      sync.Mutex
+	minutes [MINUTEBUCKETS]TrafficBucket
+	hours   [HOURBUCKETS]TrafficBucket
+}
+
+// add adds traffic to the minute and the hour of now.
+func (h *trafficHistory) add(now time.Time, bytesIn uint64, bytesOut uint64, conns uint64) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, b := range []*TrafficBucket{bucketOf(h.minutes[:], now, time.Minute), bucketOf(h.hours[:], now, time.Hour)} {
+		b.BytesIn += bytesIn
+		b.BytesOut += bytesOut
+		b.Conns += conns
+	}
+}
+
+// bucketOf returns the bucket of the ring the time falls in, emptied if it held an earlier lap.
+func bucketOf(ring []TrafficBucket, t time.Time, step time.Duration) *TrafficBucket {
+	start := t.Truncate(step)
+	b := &ring[int(start.Unix()/int64(step.Seconds()))%len(ring)]
+	if !b.Start.Equal(start) {
+		*b = TrafficBucket{Start: start}
+	}
+	return b
+}
+
+// buckets returns the buckets of the last hour up to now by minute, or of the last day by hour, oldest first. Minutes
+// and hours without traffic are empty buckets.
+func (h *trafficHistory) buckets(now time.Time, hours bool) []TrafficBucket {
+	ring, step := h.minutes[:], time.Minute
+	if hours {
+		ring, step = h.hours[:], time.Hour
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	current := now.Truncate(step)
+	buckets := make([]TrafficBucket, 0, len(ring))
+	for i := len(ring) - 1; i >= 0; i-- {
+		start := current.Add(-time.Duration(i) * step)
+		b := ring[int(start.Unix()/int64(step.Seconds()))%len(ring)]
+		if !b.Start.Equal(start) {
+			b = TrafficBucket{Start: start}
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// lastSampled returns the start of the newest hour sampled, the zero time if there is none.
+func (h *trafficHistory) lastSampled() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var last time.Time
+	for _, b := range h.hours {
+		if b.Start.After(last) {
+			last = b.Start
+		}
+	}
+	return last
+}
+
+// trafficHistories holds the histories of the exposed ports of all clients, keyed like the assignments by the
+// certificate CN of the client, the network and the port, so a history continues when its port is exposed again. If
+// a path or a store is set, they are saved to a JSON file or to STOREHISTORY every HISTORYSAVEINTERVAL and survive
+// restarts of the server. A nil *trafficHistories keeps no history.
+type trafficHistories struct {
+	mu        sync.Mutex
+	path      string
+	store     Store
+	histories map[string]*trafficHistory
+}
+
+// savedHistory is the JSON form of a history, without the empty buckets.
+type savedHistory struct {
+	CN      string
+	Network string
+	Port    int
+	Minutes []TrafficBucket
+	Hours   []TrafficBucket
+}
+
+// loadHistories loads the histories saved at path. A missing file is no error, the server starts without history
+// then. An empty path keeps the histories in memory only.
+func loadHistories(path string) (*trafficHistories, error) {
+	hs := &trafficHistories{path: path, histories: make(map[string]*trafficHistory)}
+	if path == "" {
+		return hs, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return hs, nil
+	}
+	if err != nil {
+		return hs, err
+	}
+	var list []savedHistory
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return hs, err
+	}
+	hs.restore(list)
+	return hs, nil
+}
+
+// loadStoredHistories loads the histories saved in the store, and saves them there.
+func loadStoredHistories(store Store) (*trafficHistories, error) {
+	hs := &trafficHistories{store: store, histories: make(map[string]*trafficHistory)}
+	stored, err := store.List(STOREHISTORY)
+	if err != nil {
+		return hs, err
+	}
+	list := make([]savedHistory, 0, len(stored))
+	for key, data := range stored {
+		var saved savedHistory
+		err = json.Unmarshal(data, &saved)
+		if err != nil {
+			return hs, errors.New("invalid stored history " + key + ": " + err.Error())
+		}
+		list = append(list, saved)
+	}
+	hs.restore(list)
+	return hs, nil
+}
+
+// restore fills the histories with the saved ones.
+func (hs *trafficHistories) restore(list []savedHistory) {
+	for _, saved := range list {
+		h := hs.get(saved.CN, saved.Network, saved.Port)
+		for _, b := range saved.Minutes {
+			*bucketOf(h.minutes[:], b.Start, time.Minute) = b
+		}
+		for _, b := range saved.Hours {
+			*bucketOf(h.hours[:], b.Start, time.Hour) = b
+		}
+	}
+}
+
+// get returns the history of the port of the client with the certificate CN, a new one if it has none.
+func (hs *trafficHistories) get(cn string, network string, port int) *trafficHistory {
+	if hs == nil {
+		return nil
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	key := assignmentKey(cn, network, port)
+	h := hs.histories[key]
+	if h == nil {
+		h = &trafficHistory{cn: cn, network: network, port: port}
+		hs.histories[key] = h
+	}
+	return h
+}
+
+// lookup returns the history of the port of the client with the certificate CN, nil if it has none.
+func (hs *trafficHistories) lookup(cn string, network string, port int) *trafficHistory {
+	if hs == nil {
+		return nil
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.histories[assignmentKey(cn, network, port)]
+}
+
+// run saves the histories every HISTORYSAVEINTERVAL until the context is cancelled, if a path or a store is set.
+func (hs *trafficHistories) run(ctx context.Context, logger *slog.Logger) {
+	if hs == nil || (hs.path == "" && hs.store == nil) {
+		return
+	}
+	ticker := time.NewTicker(HISTORYSAVEINTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := hs.save(time.Now())
+			if err != nil {
+				logger.Error("Error saving traffic history", slog.String("Func", "run"), "Error", err)
+			}
+		}
+	}
+}
+
+// save writes the histories to the store or the file at the path, if one is set. Histories of ports not exposed in
+// the last HOURBUCKETS hours are forgotten.
+func (hs *trafficHistories) save(now time.Time) error {
+	if hs == nil || (hs.path == "" && hs.store == nil) {
+		return nil
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	list := make([]savedHistory, 0, len(hs.histories))
+	for key, h := range hs.histories {
+		if now.Sub(h.lastSampled()) > HOURBUCKETS*time.Hour {
+			delete(hs.histories, key)
+			continue
+		}
+		saved := savedHistory{CN: h.cn, Network: h.network, Port: h.port}
+		h.mu.Lock()
+		for _, b := range h.minutes {
+			if !b.Start.IsZero() {
+				saved.Minutes = append(saved.Minutes, b)
+			}
+		}
+		for _, b := range h.hours {
+			if !b.Start.IsZero() {
+				saved.Hours = append(saved.Hours, b)
+			}
+		}
+		h.mu.Unlock()
+		list = append(list, saved)
+	}
+	if hs.store != nil {
+		stored := make(map[string][]byte, len(list))
+		for _, saved := range list {
+			data, err := json.Marshal(saved)
+			if err != nil {
+				return err
+			}
+			stored[assignmentKey(saved.CN, saved.Network, saved.Port)] = data
+		}
+		return hs.store.Replace(STOREHISTORY, stored)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(hs.path), 0700)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(hs.path, data)
+}
+
+// sampleHistory adds the traffic of the relay since the previous sample to its history and passes it to onSample.
+func (r *Relay) sampleHistory(now time.Time) {
+	if r.history == nil && r.onSample == nil {
+		return
+	}
+	var totals relayTotals
+	totals.add(&r.stats)
+	r.sampledMu.Lock()
+	defer r.sampledMu.Unlock()
+	bytesIn, bytesOut, conns := totals.bytesIn-r.sampled.bytesIn, totals.bytesOut-r.sampled.bytesOut, totals.accepted-r.sampled.accepted
+	r.sampled = totals
+	r.history.add(now, bytesIn, bytesOut, conns)
+	if r.onSample != nil && (bytesIn > 0 || bytesOut > 0 || conns > 0) {
+		r.onSample(bytesIn, bytesOut, conns)
+	}
+}
+
+// runHistory samples the traffic of the relay every HISTORYSAMPLEINTERVAL until the context is cancelled. The last
+// sample is taken by hide.
+func (r *Relay) runHistory(ctx context.Context) {
+	if r.history == nil && r.onSample == nil {
+		return
+	}
+	ticker := time.NewTicker(HISTORYSAMPLEINTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.sampleHistory(now)
+		}
+	}
+}
+
+// sendHistory answers a CTRLHISTORY frame with the history of the exposed port it names, see Utils.CTRLHISTORY. The
+// frames are created here, but sent from a helper goroutine, as the handle loop is the one reading from toclient.
+func (c *ClientHandler) sendHistory(ctx context.Context, msg *Utils.CTRLFrame, toclient chan *Utils.CTRLFrame) {
+	port, err := frameInt(msg, 1)
+	if err != nil || len(msg.Data) < 3 || (msg.Data[2] != Utils.HISTORYMINUTES && msg.Data[2] != Utils.HISTORYHOURS) {
+		c.logger.Error("Invalid history frame", slog.String("Func", "sendHistory"), slog.String("Frame", msg.String()))
+		return
+	}
+	network, resolution := msg.Data[0], msg.Data[2]
+	var buckets []TrafficBucket
+	if relay := c.tunnels.get(network, port); relay != nil && relay.history != nil {
+		now := time.Now()
+		relay.sampleHistory(now)
+		buckets = relay.history.buckets(now, resolution == Utils.HISTORYHOURS)
+	}
+	frames := historyFrames(network, port, resolution, buckets)
+	go func() {
+		for _, fr := range frames {
+			select {
+			case toclient <- fr:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// historyFrames splits the buckets into CTRLHISTORY frames of up to HISTORYCHUNK buckets each, at least one frame.
+func historyFrames(network string, port int, resolution string, buckets []TrafficBucket) []*Utils.CTRLFrame {
+	count := max(1, (len(buckets)+Utils.HISTORYCHUNK-1)/Utils.HISTORYCHUNK)
+	frames := make([]*Utils.CTRLFrame, 0, count)
+	for i := range count {
+		data := []string{network, strconv.Itoa(port), resolution, strconv.Itoa(count - 1 - i)}
+		for _, b := range buckets[min(len(buckets), i*Utils.HISTORYCHUNK):min(len(buckets), (i+1)*Utils.HISTORYCHUNK)] {
+			data = append(data, strconv.FormatInt(b.Start.Unix(), 10)+":"+strconv.FormatUint(b.BytesIn, 10)+":"+
+				strconv.FormatUint(b.BytesOut, 10)+":"+strconv.FormatUint(b.Conns, 10))
+		}
+		frames = append(frames, Utils.NewCTRLFrame(Utils.CTRLHISTORY, data))
+	}
+	return frames
+}
+
+// TrafficHistory returns the traffic of the port of the network exposed by the client with the certificate CN, by
+// the minute for the last hour or by the hour for the last day, oldest first. Traffic of the last
+// HISTORYSAMPLEINTERVAL may be missing. The history continues over reconnects, and restarts with Config.HistoryFile.
+// It fails with ErrNoHistory if the port has none.
+func (s *Server) TrafficHistory(cn string, network string, port int, hours bool) ([]TrafficBucket, error) {
+	h := s.histories.lookup(cn, network, port)
+	if h == nil {
+		return nil, ErrNoHistory
+	}
+	return h.buckets(time.Now(), hours), nil
+}
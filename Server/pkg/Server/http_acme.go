@@ -0,0 +1,212 @@
+package Server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// frontACME obtains the certificates of the HTTPS front from the ACME CA and renews them, see Config.HTTPACME.
+// Certificates are kept in the front directory of the ACME directory, named by the name they are issued for with
+// '*' replaced by '_'. It is safe for concurrent use.
+type frontACME struct {
+	ctx    context.Context
+	server *Server
+	// solver answers the challenges, the HTTP front for ACMEHTTP01
+	solver acmeSolver
+	mu     sync.Mutex
+	certs  map[string]*tls.Certificate
+	// pending are the names a certificate is being obtained for
+	pending map[string]bool
+}
+
+func newFrontACME(ctx context.Context, s *Server) *frontACME {
+	a := &frontACME{
+		ctx:     ctx,
+		server:  s,
+		certs:   make(map[string]*tls.Certificate),
+		pending: make(map[string]bool),
+	}
+	if s.Config.ACME.Challenge == ACMEDNS01 {
+		a.solver = &dnsSolver{hook: s.Config.ACME.DNSHook}
+	} else {
+		a.solver = s.challenges
+	}
+	return a
+}
+
+// certName returns the name of the certificate that covers the host. With ACMEDNS01, hosts right below a domain of
+// Config.HTTPDomains are covered by the wildcard certificate of the domain, other hosts get one of their own.
+func (a *frontACME) certName(host string) string {
+	if a.server.Config.ACME.Challenge != ACMEDNS01 {
+		return host
+	}
+	if _, domain, ok := strings.Cut(host, "."); ok && a.server.Config.hasHTTPDomain(domain) {
+		return "*." + domain
+	}
+	return host
+}
+
+// certificate returns the certificate for the server name of a handshake, nil if none was obtained yet.
+func (a *frontACME) certificate(serverName string) *tls.Certificate {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.certs[a.certName(strings.ToLower(serverName))]
+}
+
+// ensure obtains the certificate that covers the host in the background, unless a stored one is valid for longer than
+// ACMERENEWBEFORE or it is being obtained already.
+func (a *frontACME) ensure(host string) {
+	name := a.certName(host)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pending[name] || !certificateDue(a.certs[name]) {
+		return
+	}
+	dir, err := a.dir()
+	if err != nil {
+		a.server.Logger.Error("Error getting ACME directory", slog.String("Func", "ensure"), "Error", err)
+		return
+	}
+	crtPath, keyPath := a.paths(dir, name)
+	if pair, err := loadFrontPair(crtPath, keyPath); err == nil {
+		a.certs[name] = pair
+		if !certificateDue(pair) {
+			return
+		}
+	}
+	a.pending[name] = true
+	go func() {
+		err := a.obtain(dir, name)
+		if err != nil {
+			a.server.Logger.Error("Error obtaining ACME certificate of the HTTPS front", slog.String("Func", "ensure"), slog.String("Name", name), "Error", err)
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		delete(a.pending, name)
+	}()
+}
+
+// obtain orders the certificate of the name from the CA and stores it.
+func (a *frontACME) obtain(dir string, name string) error {
+	err := os.MkdirAll(filepath.Join(dir, "front"), 0700)
+	if err != nil {
+		return err
+	}
+	accountKey, err := loadAccountKey(filepath.Join(dir, "account.key"))
+	if err != nil {
+		return err
+	}
+	config := a.server.Config.ACME
+	directory := config.Directory
+	if directory == "" {
+		directory = LETSENCRYPTDIRECTORY
+	}
+	a.server.Logger.Info("Obtaining ACME certificate of the HTTPS front", slog.String("Func", "obtain"), slog.String("Name", name))
+	chain, key, err := newAcmeClient(directory, accountKey, a.server.Logger).obtain(a.ctx, []string{name}, config.Email, a.solver)
+	if err != nil {
+		return err
+	}
+	crtPath, keyPath := a.paths(dir, name)
+	// the key first, like renewAcmeCertificate
+	err = writeFileAtomic(keyPath, key)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(crtPath, chain)
+	if err != nil {
+		return err
+	}
+	pair, err := loadFrontPair(crtPath, keyPath)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.certs[name] = pair
+	return nil
+}
+
+// run obtains the certificates of the routed hosts, or the wildcard certificates of the domains, and renews them
+// every ACMECHECKINTERVAL until the context is cancelled. Certificates of hosts no longer routed aren't renewed.
+func (a *frontACME) run() {
+	ticker := time.NewTicker(ACMECHECKINTERVAL)
+	defer ticker.Stop()
+	for {
+		if a.server.Config.ACME.Challenge == ACMEDNS01 {
+			for _, domain := range a.server.Config.HTTPDomains {
+				a.ensure("*." + domain)
+			}
+		}
+		for _, host := range a.server.hosts.names() {
+			a.ensure(host)
+		}
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// dir returns the ACME directory, see ACMEConfig.Dir.
+func (a *frontACME) dir() (string, error) {
+	return a.server.Config.acmeDir()
+}
+
+// paths returns the paths of the certificate and the key of the name.
+func (a *frontACME) paths(dir string, name string) (string, string) {
+	base := filepath.Join(dir, "front", strings.ReplaceAll(name, "*", "_"))
+	return base + ".crt", base + ".key"
+}
+
+// loadFrontPair loads a key pair with its parsed leaf.
+func loadFrontPair(crtPath string, keyPath string) (*tls.Certificate, error) {
+	pair, err := tls.LoadX509KeyPair(crtPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &pair, nil
+}
+
+// certificateDue reports whether the certificate is missing or expires within ACMERENEWBEFORE.
+func certificateDue(cert *tls.Certificate) bool {
+	return cert == nil || cert.Leaf == nil || time.Until(cert.Leaf.NotAfter) < ACMERENEWBEFORE
+}
+
+// validateHTTPACME checks the settings of the certificates of the HTTPS front, if they are obtained via ACME.
+func (c *Config) validateHTTPACME() error {
+	if !c.HTTPACME {
+		return nil
+	}
+	if c.HTTPSAddr == "" {
+		return errors.New("ACME certificates of the HTTP front without HTTPS address")
+	}
+	if c.HTTPCertFile != "" {
+		return errors.New("ACME certificates of the HTTP front and a certificate file")
+	}
+	switch c.ACME.Challenge {
+	case ACMEHTTP01:
+		if c.HTTPAddr == "" {
+			return errors.New("ACME HTTP challenges of the HTTP front without HTTP address")
+		}
+	case ACMEDNS01:
+		if c.ACME.DNSHook == "" {
+			return errors.New("ACME DNS challenge without hook")
+		}
+	default:
+		return errors.New("invalid ACME challenge " + c.ACME.Challenge)
+	}
+	return nil
+}
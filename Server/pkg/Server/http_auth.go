@@ -0,0 +1,402 @@
+package Server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings of the authentication of the HTTP front.
+const (
+	// MAXAUTHRULES is the maximum amount of basicauth and of oidc options of a port exposed under a hostname
+	MAXAUTHRULES = 8
+	// FRONTPATH is the path below which the HTTP front serves its own pages on the hosts that require a login
+	FRONTPATH     = "/.goexpose/"
+	OIDCCALLBACK  = FRONTPATH + "oidc/callback"
+	SESSIONCOOKIE = "goexpose_session"
+	STATECOOKIE   = "goexpose_state"
+	// FRONTSESSIONTTL is how long a visitor stays logged in, OIDCLOGINTIMEOUT how long a login may take
+	FRONTSESSIONTTL  = 12 * time.Hour
+	OIDCLOGINTIMEOUT = 10 * time.Minute
+)
+
+// OIDCConfig is the OpenID Connect provider the HTTP front logs in the visitors of ports that require it with, see
+// RelayConfig.OIDC. The front is a confidential client of the provider using the authorization code flow, the
+// provider has to accept <scheme>://<hostname>/.goexpose/oidc/callback as redirect URI of every exposed hostname.
+type OIDCConfig struct {
+	// Issuer is the URL of the provider, its discovery document is read from Issuer/.well-known/openid-configuration
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+}
+
+func (o *OIDCConfig) enabled() bool {
+	return o.Issuer != ""
+}
+
+// validate checks the issuer URL and the client, if OIDC is enabled.
+func (o *OIDCConfig) validate() error {
+	if !o.enabled() {
+		return nil
+	}
+	if u, err := url.Parse(o.Issuer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid OIDC issuer " + o.Issuer)
+	}
+	if o.ClientID == "" {
+		return errors.New("OIDC issuer without client ID")
+	}
+	return nil
+}
+
+// BasicCredential is a user that may visit a port exposed under a hostname with basic authentication. Only the
+// SHA-256 hash of the password is kept.
+type BasicCredential struct {
+	User         string
+	PasswordHash [sha256.Size]byte
+}
+
+// parseBasicCredential parses the value of a basicauth option, user:password.
+func parseBasicCredential(value string) (BasicCredential, error) {
+	user, password, ok := strings.Cut(value, ":")
+	if !ok || user == "" || password == "" {
+		return BasicCredential{}, errors.New("malformed basic auth credential")
+	}
+	return BasicCredential{User: user, PasswordHash: sha256.Sum256([]byte(password))}, nil
+}
+
+// validOIDCRule reports whether the value of an oidc option names visitors: an email address, @domain for all
+// addresses of the domain or * for every visitor the provider logs in.
+func validOIDCRule(rule string) bool {
+	if rule == "*" {
+		return true
+	}
+	local, domain, ok := strings.Cut(rule, "@")
+	return ok && validHostname(domain) && !strings.ContainsAny(local, "@ ")
+}
+
+// oidcAllows reports whether one of the rules names the email address.
+func oidcAllows(rules []string, email string) bool {
+	email = strings.ToLower(email)
+	_, domain, _ := strings.Cut(email, "@")
+	for _, rule := range rules {
+		if rule == "*" || rule == email || (strings.HasPrefix(rule, "@") && rule[1:] == domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// frontAuth authenticates the visitors of the ports that require it on the HTTP front. Sessions and login states
+// are signed with a key of the process, restarting the server logs out all visitors.
+type frontAuth struct {
+	key    []byte
+	oidc   OIDCConfig
+	http   *http.Client
+	logger *slog.Logger
+	// mu guards the endpoints of the provider, read from its discovery document on the first login
+	mu        sync.Mutex
+	endpoints *oidcEndpoints
+}
+
+type oidcEndpoints struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// frontSession is the content of the session cookie, frontState the one of the state of a login.
+type frontSession struct {
+	Host    string `json:"host"`
+	Email   string `json:"email"`
+	Expires int64  `json:"exp"`
+}
+
+type frontState struct {
+	Host    string `json:"host"`
+	Nonce   string `json:"nonce"`
+	Return  string `json:"return"`
+	Expires int64  `json:"exp"`
+}
+
+func newFrontAuth(oidc OIDCConfig, logger *slog.Logger) (*frontAuth, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+	return &frontAuth{key: key, oidc: oidc, http: &http.Client{Timeout: 10 * time.Second}, logger: logger}, nil
+}
+
+// authorize checks the request of a visitor against the basic auth credentials and the OIDC rules of the port and
+// reports whether it may be passed on. The credentials and the session are removed from an authorized request,
+// an unauthorized one is answered with a login or an error.
+func (a *frontAuth) authorize(w http.ResponseWriter, r *http.Request, config *RelayConfig) bool {
+	if len(config.BasicAuth) == 0 && len(config.OIDC) == 0 {
+		return true
+	}
+	host := requestHost(r)
+	if r.URL.Path == OIDCCALLBACK && len(config.OIDC) > 0 {
+		a.callback(w, r, host, config)
+		return false
+	}
+	if user, password, ok := r.BasicAuth(); ok && checkBasicAuth(config.BasicAuth, user, password) {
+		r.Header.Del("Authorization")
+		return true
+	}
+	if len(config.OIDC) > 0 {
+		var session frontSession
+		if cookie, err := r.Cookie(SESSIONCOOKIE); err == nil && a.open(cookie.Value, &session) == nil &&
+			session.Host == host && time.Now().Unix() < session.Expires && oidcAllows(config.OIDC, session.Email) {
+			removeCookie(r, SESSIONCOOKIE)
+			return true
+		}
+		a.login(w, r, host)
+		return false
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+host+`", charset="UTF-8"`)
+	http.Error(w, "authentication required", http.StatusUnauthorized)
+	return false
+}
+
+// loginPath returns the path a login that completes with the request started on, the path of the request if its
+// state is invalid.
+func (a *frontAuth) loginPath(r *http.Request) string {
+	var state frontState
+	if a.open(r.URL.Query().Get("state"), &state) != nil {
+		return r.URL.Path
+	}
+	path, _, _ := strings.Cut(returnPath(state.Return), "?")
+	return path
+}
+
+// returnPath returns the URI a login returns to if it is a path on the host of the port, otherwise the root. A URI
+// starting with // or /\ is taken as another host by browsers, as is one with control characters they strip.
+func returnPath(uri string) string {
+	if !strings.HasPrefix(uri, "/") || strings.HasPrefix(uri, "//") || strings.HasPrefix(uri, "/\\") ||
+		strings.ContainsFunc(uri, func(c rune) bool { return c < ' ' || c == 0x7f }) {
+		return "/"
+	}
+	return uri
+}
+
+// checkBasicAuth reports whether the user and password match one of the credentials, in constant time.
+func checkBasicAuth(credentials []BasicCredential, user string, password string) bool {
+	hash := sha256.Sum256([]byte(password))
+	match := 0
+	for _, c := range credentials {
+		match |= subtle.ConstantTimeCompare([]byte(c.User), []byte(user)) & subtle.ConstantTimeCompare(c.PasswordHash[:], hash[:])
+	}
+	return match == 1
+}
+
+// login redirects the visitor to the provider, the state cookie binds the login to the browser.
+func (a *frontAuth) login(w http.ResponseWriter, r *http.Request, host string) {
+	endpoints, err := a.discover()
+	if err != nil {
+		a.logger.Error("Error discovering OIDC provider", slog.String("Func", "login"), "Error", err)
+		http.Error(w, "login unavailable", http.StatusBadGateway)
+		return
+	}
+	nonce := make([]byte, 16)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		http.Error(w, "login unavailable", http.StatusInternalServerError)
+		return
+	}
+	state := frontState{Host: host, Nonce: b64(nonce), Return: returnPath(r.URL.RequestURI()), Expires: time.Now().Add(OIDCLOGINTIMEOUT).Unix()}
+	signed, err := a.seal(state)
+	if err != nil {
+		http.Error(w, "login unavailable", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: STATECOOKIE, Value: state.Nonce, Path: OIDCCALLBACK, MaxAge: int(OIDCLOGINTIMEOUT / time.Second),
+		HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {a.oidc.ClientID},
+		"redirect_uri":  {callbackURL(r)},
+		"scope":         {"openid email"},
+		"state":         {signed},
+		"nonce":         {state.Nonce},
+	}
+	http.Redirect(w, r, endpoints.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+}
+
+// callback completes a login: it redeems the code of the provider for the ID token of the visitor and starts a
+// session if the port allows its email address.
+func (a *frontAuth) callback(w http.ResponseWriter, r *http.Request, host string, config *RelayConfig) {
+	var state frontState
+	cookie, err := r.Cookie(STATECOOKIE)
+	if err != nil || a.open(r.URL.Query().Get("state"), &state) != nil || state.Host != host ||
+		time.Now().Unix() >= state.Expires || cookie.Value != state.Nonce {
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+	email, err := a.redeem(r.URL.Query().Get("code"), callbackURL(r), state.Nonce)
+	if err != nil {
+		a.logger.Info("OIDC login failed", slog.String("Func", "callback"), slog.String("Host", host), "Error", err)
+		http.Error(w, "login failed", http.StatusForbidden)
+		return
+	}
+	if !oidcAllows(config.OIDC, email) {
+		a.logger.Info("OIDC login denied", slog.String("Func", "callback"), slog.String("Host", host), slog.String("Email", email))
+		http.Error(w, email+" may not visit "+host, http.StatusForbidden)
+		return
+	}
+	signed, err := a.seal(frontSession{Host: host, Email: email, Expires: time.Now().Add(FRONTSESSIONTTL).Unix()})
+	if err != nil {
+		http.Error(w, "login failed", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: STATECOOKIE, Path: OIDCCALLBACK, MaxAge: -1})
+	http.SetCookie(w, &http.Cookie{Name: SESSIONCOOKIE, Value: signed, Path: "/", MaxAge: int(FRONTSESSIONTTL / time.Second),
+		HttpOnly: true, Secure: r.TLS != nil, SameSite: http.SameSiteLaxMode})
+	a.logger.Info("OIDC login", slog.String("Func", "callback"), slog.String("Host", host), slog.String("Email", email))
+	http.Redirect(w, r, returnPath(state.Return), http.StatusFound)
+}
+
+// redeem exchanges the code for the ID token at the token endpoint and returns the verified email address of the
+// visitor. The ID token comes from the provider directly over TLS, its claims are checked, but not its signature,
+// OpenID Connect Core 1.0 section 3.1.3.7.
+func (a *frontAuth) redeem(code string, redirectURI string, nonce string) (string, error) {
+	endpoints, err := a.discover()
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.http.PostForm(endpoints.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURI},
+		"client_id":     {a.oidc.ClientID},
+		"client_secret": {a.oidc.ClientSecret},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("token endpoint: " + resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(tokens.IDToken, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed ID token")
+	}
+	var claims struct {
+		jwtClaims
+		Nonce         string `json:"nonce"`
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+	}
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case claims.Issuer != endpoints.Issuer:
+		return "", errors.New("ID token of another issuer")
+	case !audienceContains(claims.Audience, a.oidc.ClientID):
+		return "", errors.New("ID token for another audience")
+	case time.Now().After(time.Unix(int64(claims.Expires), 0).Add(JWTLEEWAY)):
+		return "", errors.New("ID token expired")
+	case claims.Nonce != nonce:
+		return "", errors.New("ID token of another login")
+	case claims.Email == "" || (claims.EmailVerified != nil && !*claims.EmailVerified):
+		return "", errors.New("ID token without verified email")
+	}
+	return strings.ToLower(claims.Email), nil
+}
+
+// discover reads the endpoints of the provider from its discovery document, once it could be read.
+func (a *frontAuth) discover() (*oidcEndpoints, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.endpoints != nil {
+		return a.endpoints, nil
+	}
+	resp, err := a.http.Get(strings.TrimSuffix(a.oidc.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("OIDC discovery: " + resp.Status)
+	}
+	var endpoints oidcEndpoints
+	err = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&endpoints)
+	if err != nil {
+		return nil, err
+	}
+	if endpoints.AuthorizationEndpoint == "" || endpoints.TokenEndpoint == "" {
+		return nil, errors.New("OIDC discovery without endpoints")
+	}
+	a.endpoints = &endpoints
+	return a.endpoints, nil
+}
+
+// seal returns v as JSON with its HMAC, base64 encoded, open checks the HMAC and decodes it again.
+func (a *frontAuth) seal(v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(data)
+	return b64(data) + "." + b64(mac.Sum(nil)), nil
+}
+
+func (a *frontAuth) open(sealed string, v any) error {
+	payload, signed, ok := strings.Cut(sealed, ".")
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if !ok || err != nil {
+		return errors.New("malformed seal")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(signed)
+	if err != nil {
+		return errors.New("malformed seal")
+	}
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return errors.New("invalid seal")
+	}
+	return json.Unmarshal(data, v)
+}
+
+// callbackURL returns the redirect URI of logins on the host of the request.
+func callbackURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + OIDCCALLBACK
+}
+
+// removeCookie removes the cookie from the request, keeping the others.
+func removeCookie(r *http.Request, name string) {
+	cookies := slices.DeleteFunc(r.Cookies(), func(c *http.Cookie) bool {
+		return c.Name == name
+	})
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+}
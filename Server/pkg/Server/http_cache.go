@@ -0,0 +1,244 @@
+package Server
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MAXCACHEDBODY is the largest response body the cache of the HTTP front keeps.
+const MAXCACHEDBODY = 1 << 20
+
+// cachedStatuses are the statuses of the responses the cache of the HTTP front keeps.
+var cachedStatuses = []int{http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent, http.StatusMovedPermanently,
+	http.StatusPermanentRedirect, http.StatusNotFound, http.StatusGone}
+
+// responseCache keeps the GET responses of ports exposed with cache=on in memory, as a shared cache of RFC 9111, see
+// Config.HTTPCacheSize. Only responses with an explicit freshness lifetime are kept, until it runs out or the least
+// recently used responses make room for new ones. It is safe for concurrent use.
+type responseCache struct {
+	mu   sync.Mutex
+	max  int
+	size int
+	// entries are the elements of lru by key, lru orders the responses from the most to the least recently used
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// cachedResponse is a response of the cache. vary are the values of the request headers the response varies by.
+type cachedResponse struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	vary    map[string]string
+	stored  time.Time
+	expires time.Time
+	// age is the Age of the response when it was stored
+	age time.Duration
+}
+
+func newResponseCache(maxBytes int) *responseCache {
+	return &responseCache{max: maxBytes, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// cacheKey returns the key of the request on the route, routes of other relays never share responses.
+func cacheKey(route hostRoute, r *http.Request) string {
+	return route.key + " " + r.URL.RequestURI()
+}
+
+// lookup returns the fresh response of the request, nil if there is none or the request asks not to be served from
+// the cache.
+func (c *responseCache) lookup(key string, r *http.Request) *cachedResponse {
+	if r.Method != http.MethodGet || !cacheableRequest(r) {
+		return nil
+	}
+	directives := cacheDirectives(r.Header)
+	if _, ok := directives["no-cache"]; ok || r.Header.Get("Pragma") == "no-cache" {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cachedResponse)
+	if time.Now().After(entry.expires) {
+		c.remove(element)
+		return nil
+	}
+	if maxAge, ok := directives["max-age"]; ok {
+		if seconds, err := strconv.Atoi(maxAge); err == nil && entry.currentAge() > time.Duration(seconds)*time.Second {
+			return nil
+		}
+	}
+	for name, value := range entry.vary {
+		if r.Header.Get(name) != value {
+			return nil
+		}
+	}
+	c.lru.MoveToFront(element)
+	return entry
+}
+
+// store keeps the response to the request with its body, if it may be cached and fits.
+func (c *responseCache) store(key string, r *http.Request, resp *http.Response, body []byte) {
+	entry := newCachedResponse(key, r, resp, body)
+	if entry == nil || len(body) > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += len(body)
+	for c.size > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops the response of the element.
+func (c *responseCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cachedResponse)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.body)
+}
+
+// newCachedResponse returns the cached form of the response to the request of the visitor, nil if a shared cache may
+// not keep it: responses that are private, carry cookies, vary by every header or have no explicit freshness
+// lifetime, and responses of requests with credentials that aren't public.
+func newCachedResponse(key string, req *http.Request, resp *http.Response, body []byte) *cachedResponse {
+	if req.Method != http.MethodGet || !cacheableRequest(req) || !slices.Contains(cachedStatuses, resp.StatusCode) || resp.Header.Get("Set-Cookie") != "" {
+		return nil
+	}
+	directives := cacheDirectives(resp.Header)
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[directive]; ok {
+			return nil
+		}
+	}
+	if _, public := directives["public"]; req.Header.Get("Authorization") != "" && !public {
+		return nil
+	}
+	var lifetime time.Duration
+	if seconds, ok := directives["s-maxage"]; ok {
+		lifetime = parseSeconds(seconds)
+	} else if seconds, ok := directives["max-age"]; ok {
+		lifetime = parseSeconds(seconds)
+	} else if expires, err := http.ParseTime(resp.Header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		lifetime = expires.Sub(date)
+	}
+	age := parseSeconds(resp.Header.Get("Age"))
+	if lifetime <= age {
+		return nil
+	}
+	entry := &cachedResponse{key: key, status: resp.StatusCode, header: resp.Header.Clone(), body: body, stored: time.Now(), age: age}
+	entry.expires = entry.stored.Add(lifetime - age)
+	entry.header.Del("Age")
+	for _, name := range resp.Header.Values("Vary") {
+		for _, name := range strings.Split(name, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil
+			}
+			if name == "" {
+				continue
+			}
+			if entry.vary == nil {
+				entry.vary = make(map[string]string)
+			}
+			entry.vary[name] = req.Header.Get(name)
+		}
+	}
+	return entry
+}
+
+// currentAge returns the age of the response.
+func (e *cachedResponse) currentAge() time.Duration {
+	return e.age + time.Since(e.stored)
+}
+
+// serve writes the response with its Age.
+func (e *cachedResponse) serve(w http.ResponseWriter) {
+	for name, values := range e.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Age", strconv.Itoa(int(e.currentAge()/time.Second)))
+	w.Header().Set("X-Cache", "HIT")
+	w.WriteHeader(e.status)
+	_, _ = w.Write(e.body)
+}
+
+// cacheableRequest reports whether the response of the request may be served from or stored in the cache.
+func cacheableRequest(r *http.Request) bool {
+	_, noStore := cacheDirectives(r.Header)["no-store"]
+	return !noStore && r.Header.Get("Range") == "" && r.Header.Get("Upgrade") == ""
+}
+
+// cacheDirectives returns the directives of the Cache-Control headers in lower case, with their unquoted arguments.
+func cacheDirectives(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, argument, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			if name != "" {
+				directives[strings.ToLower(name)] = strings.Trim(argument, `"`)
+			}
+		}
+	}
+	return directives
+}
+
+// parseSeconds parses a delta-seconds value, 0 if it is invalid.
+func parseSeconds(value string) time.Duration {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return time.Duration(min(seconds, int64(365*24*time.Hour/time.Second))) * time.Second
+}
+
+// cacheBody passes the body of a response on and stores the response once it was read completely, unless it turns
+// out larger than MAXCACHEDBODY. req is the request of the visitor, before the header rules were applied.
+type cacheBody struct {
+	io.ReadCloser
+	cache *responseCache
+	key   string
+	req   *http.Request
+	resp  *http.Response
+	buf   bytes.Buffer
+	// skip is set once the body exceeded MAXCACHEDBODY or failed
+	skip bool
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.skip {
+		if b.buf.Len()+n > MAXCACHEDBODY {
+			b.skip = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.skip {
+		b.skip = true
+		b.cache.store(b.key, b.req, b.resp, b.buf.Bytes())
+	} else if err != nil {
+		b.skip = true
+	}
+	return n, err
+}
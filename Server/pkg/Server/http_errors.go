@@ -0,0 +1,98 @@
+package Server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of the error responses of the HTTP front, see RelayConfig.Errors. ERRORSAUTO answers with JSON if the
+// request accepts JSON but no HTML, as API clients do, with HTML otherwise.
+const (
+	ERRORSAUTO = "auto"
+	ERRORSHTML = "html"
+	ERRORSJSON = "json"
+)
+
+// OFFLINEROUTETTL is how long the HTTP front answers the requests of a route whose port is no longer exposed with
+// 503 instead of 404, so visitors learn that the service is offline, not gone. OFFLINERETRY is the Retry-After of
+// those answers.
+const (
+	OFFLINEROUTETTL = time.Hour
+	OFFLINERETRY    = 30 * time.Second
+)
+
+// errTunnelOffline is returned for requests of a route whose client can't be reached, see frontHandler.
+var errTunnelOffline = errors.New("tunnel offline")
+
+//go:embed error_page.html
+var defaultErrorPage string
+
+// frontError is an error response of the HTTP front, the data of the template of Config.HTTPErrorPage.
+type frontError struct {
+	Status  int    `json:"status"`
+	Title   string `json:"error"`
+	Message string `json:"message"`
+	Host    string `json:"host"`
+	Path    string `json:"path"`
+}
+
+// loadErrorPage parses the template of the error pages of the HTTP front, Config.HTTPErrorPage or the default page.
+func (s *Server) loadErrorPage() error {
+	page := template.New("error")
+	if s.Config.HTTPErrorPage == "" {
+		s.errorPage = template.Must(page.Parse(defaultErrorPage))
+		return nil
+	}
+	page, err := page.ParseFiles(s.Config.HTTPErrorPage)
+	if err != nil {
+		s.errorPage = template.Must(template.New("error").Parse(defaultErrorPage))
+		return err
+	}
+	// ParseFiles names the template by the file
+	s.errorPage = page.Lookup(page.Templates()[0].Name())
+	return nil
+}
+
+// writeFrontError answers the request with the status, as HTML page or JSON depending on the format, see ERRORSAUTO.
+// Answers for offline tunnels carry a Retry-After header.
+func (s *Server) writeFrontError(w http.ResponseWriter, r *http.Request, status int, message string, format string) {
+	e := frontError{Status: status, Title: http.StatusText(status), Message: message, Host: requestHost(r), Path: r.URL.Path}
+	w.Header().Set("Cache-Control", "no-store")
+	if status == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", strconv.Itoa(int(OFFLINERETRY/time.Second)))
+	}
+	if format == ERRORSJSON || (format != ERRORSHTML && prefersJSON(r)) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(e)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	_ = s.errorPage.Execute(w, e)
+}
+
+// prefersJSON reports whether the request accepts JSON, but no HTML.
+func prefersJSON(r *http.Request) bool {
+	json, html := false, false
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		switch {
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			json = true
+		case mediaType == "text/html" || mediaType == "*/*":
+			html = true
+		}
+	}
+	return json && !html
+}
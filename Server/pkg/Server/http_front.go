@@ -0,0 +1,681 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPFRONTIDLE is how long the HTTP front keeps idle connections, those of browsers as well as those to the
+// services of the clients, for further requests.
+const HTTPFRONTIDLE = 90 * time.Second
+
+// MAXHOSTNAME is the longest hostname a client can expose a port under.
+const MAXHOSTNAME = 253
+
+// MAXHEADERRULES is the maximum amount of header rules of a port exposed under a hostname.
+const MAXHEADERRULES = 8
+
+// HeaderRule changes a header of the requests or the responses the HTTP front passes on for a port exposed under a
+// hostname. A rule with a value sets the header, replacing the values it had, one without removes it.
+// Hop-by-hop headers are never passed on, rules can't change them nor the headers that frame the message.
+type HeaderRule struct {
+	// Response applies the rule to the responses of the service instead of the requests
+	Response bool
+	Name     string
+	Value    string
+}
+
+// protectedHeaders can't be changed by header rules, in canonical form.
+var protectedHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "Proxy-Authorization",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length", "Host"}
+
+// parseHeaderRule parses the value of a header option, Name:Value to set the header or -Name to remove it.
+func parseHeaderRule(value string, response bool) (HeaderRule, error) {
+	rule := HeaderRule{Response: response}
+	if name, ok := strings.CutPrefix(value, "-"); ok {
+		rule.Name = name
+	} else {
+		name, headerValue, ok := strings.Cut(value, ":")
+		if !ok || headerValue == "" {
+			return rule, errors.New("malformed header rule " + value)
+		}
+		rule.Name, rule.Value = name, strings.TrimSpace(headerValue)
+	}
+	if !validHeaderName(rule.Name) || strings.ContainsAny(rule.Value, "\r\n\x00") {
+		return rule, errors.New("invalid header rule " + value)
+	}
+	rule.Name = http.CanonicalHeaderKey(rule.Name)
+	if slices.Contains(protectedHeaders, rule.Name) {
+		return rule, errors.New("header " + rule.Name + " can't be changed")
+	}
+	return rule, nil
+}
+
+// validHeaderName reports whether name is a token of RFC 9110.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, ch := range name {
+		if !(ch >= 'a' && ch <= 'z') && !(ch >= 'A' && ch <= 'Z') && !(ch >= '0' && ch <= '9') && !strings.ContainsRune("!#$%&'*+-.^_`|~", ch) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyHeaderRules applies the rules of the requests, or of the responses, to the header.
+func applyHeaderRules(header http.Header, rules []HeaderRule, response bool) {
+	for _, rule := range rules {
+		if rule.Response != response {
+			continue
+		}
+		if rule.Value == "" {
+			header.Del(rule.Name)
+		} else {
+			header.Set(rule.Name, rule.Value)
+		}
+	}
+}
+
+// MAXROUTEPATH is the longest path prefix a client can expose a port under.
+const MAXROUTEPATH = 200
+
+// hostRouter routes the requests of the HTTP front by hostname and path to the relays of the ports exposed under them,
+// see Config.HTTPAddr. Each path prefix of a hostname is routed to a single relay, the one that claimed it first, a
+// request goes to the relay of the longest prefix of its path. Released prefixes are remembered as offline for
+// OFFLINEROUTETTL, until they are claimed again. It is safe for concurrent use.
+type hostRouter struct {
+	mu sync.RWMutex
+	// routes are the routes of the hostnames, longest path first
+	routes map[string][]hostRoute
+	// offline are the released routes of the hostnames
+	offline map[string][]offlineRoute
+	// keys are the relays by the key of their route, lastKey numbers the routes
+	keys    map[string]*Relay
+	lastKey uint64
+	// claimed is called with the hostnames claimed, if set, see frontACME
+	claimed func(host string)
+}
+
+// hostRoute routes a path prefix of a hostname to a relay. The key identifies the route in the URLs of the
+// connection pool of the front, so connections of a relay are never reused for another one.
+type hostRoute struct {
+	path  string
+	relay *Relay
+	key   string
+}
+
+// offlineRoute is a path prefix of a hostname whose port was hidden, with the format of its error responses, see
+// RelayConfig.Errors.
+type offlineRoute struct {
+	path   string
+	errors string
+	until  time.Time
+}
+
+// claim routes the path prefix of the hostname to the relay, unless another relay claimed it already.
+func (h *hostRouter) claim(host string, path string, relay *Relay) bool {
+	h.mu.Lock()
+	routes := h.routes[host]
+	for _, route := range routes {
+		if route.path == path {
+			h.mu.Unlock()
+			return route.relay == relay
+		}
+	}
+	if h.routes == nil {
+		h.routes = make(map[string][]hostRoute)
+		h.keys = make(map[string]*Relay)
+	}
+	h.lastKey++
+	key := strconv.FormatUint(h.lastKey, 10) + ".route"
+	routes = append(routes, hostRoute{path: path, relay: relay, key: key})
+	slices.SortFunc(routes, func(a, b hostRoute) int {
+		return len(b.path) - len(a.path)
+	})
+	h.routes[host] = routes
+	h.keys[key] = relay
+	if offline, ok := h.offline[host]; ok {
+		offline = slices.DeleteFunc(offline, func(offline offlineRoute) bool {
+			return offline.path == path
+		})
+		if len(offline) == 0 {
+			delete(h.offline, host)
+		} else {
+			h.offline[host] = offline
+		}
+	}
+	claimed := h.claimed
+	h.mu.Unlock()
+	if claimed != nil {
+		claimed(host)
+	}
+	return true
+}
+
+// release stops routing the path prefix of the hostname to the relay and remembers it as offline, a prefix claimed by
+// another relay is kept. Offline routes past OFFLINEROUTETTL are dropped.
+func (h *hostRouter) release(host string, path string, relay *Relay) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for name, offline := range h.offline {
+		offline = slices.DeleteFunc(offline, func(offline offlineRoute) bool {
+			return now.After(offline.until)
+		})
+		if len(offline) == 0 {
+			delete(h.offline, name)
+		} else {
+			h.offline[name] = offline
+		}
+	}
+	routes := slices.DeleteFunc(slices.Clone(h.routes[host]), func(route hostRoute) bool {
+		if route.path == path && route.relay == relay {
+			delete(h.keys, route.key)
+			if h.offline == nil {
+				h.offline = make(map[string][]offlineRoute)
+			}
+			h.offline[host] = append(h.offline[host], offlineRoute{path: path, errors: relay.config.Load().Errors, until: now.Add(OFFLINEROUTETTL)})
+			return true
+		}
+		return false
+	})
+	if len(routes) == 0 {
+		delete(h.routes, host)
+		return
+	}
+	h.routes[host] = routes
+}
+
+// route returns the route of the longest prefix of the path on the hostname, false if there is none.
+func (h *hostRouter) route(host string, path string) (hostRoute, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, route := range h.routes[host] {
+		if pathHasPrefix(path, route.path) {
+			return route, true
+		}
+	}
+	return hostRoute{}, false
+}
+
+// wentOffline returns the offline route of the longest prefix of the path on the hostname, false if there is none.
+func (h *hostRouter) wentOffline(host string, path string) (offlineRoute, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	var found offlineRoute
+	for _, offline := range h.offline[host] {
+		if pathHasPrefix(path, offline.path) && len(offline.path) > len(found.path) && time.Now().Before(offline.until) {
+			found = offline
+		}
+	}
+	return found, found.path != ""
+}
+
+// get returns the relay of the route with the key, nil if there is none.
+func (h *hostRouter) get(key string) *Relay {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.keys[key]
+}
+
+// names returns the routed hostnames.
+func (h *hostRouter) names() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	names := make([]string, 0, len(h.routes))
+	for host := range h.routes {
+		names = append(names, host)
+	}
+	return names
+}
+
+// pathHasPrefix reports whether the path is the prefix or below it, /api matches /api and /api/users, not /apis.
+func pathHasPrefix(path string, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+	rest, ok := strings.CutPrefix(path, prefix)
+	return ok && (rest == "" || rest[0] == '/')
+}
+
+// validRoutePath reports whether path is a path prefix a port can be exposed under: "/" or segments of unreserved
+// characters, without trailing slash.
+func validRoutePath(path string) bool {
+	if path == "/" {
+		return true
+	}
+	if !strings.HasPrefix(path, "/") || len(path) > MAXROUTEPATH {
+		return false
+	}
+	for _, segment := range strings.Split(path[1:], "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+		for _, ch := range segment {
+			if !(ch >= 'a' && ch <= 'z') && !(ch >= 'A' && ch <= 'Z') && !(ch >= '0' && ch <= '9') && !strings.ContainsRune("-._~", ch) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validHostname reports whether name is a hostname in lower case, of labels of letters, digits and '-' that neither
+// start nor end with '-'.
+func validHostname(name string) bool {
+	if name == "" || len(name) > MAXHOSTNAME {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			if !(ch >= 'a' && ch <= 'z') && !(ch >= '0' && ch <= '9') && ch != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// routesHosts reports whether the server routes requests by hostname, see HTTPAddr.
+func (c *Config) routesHosts() bool {
+	return c.HTTPAddr != "" || c.HTTPSAddr != ""
+}
+
+// hostAllowed reports whether clients may expose ports under the hostname, which has to be a subdomain of one of
+// HTTPDomains.
+func (c *Config) hostAllowed(host string) bool {
+	for _, domain := range c.HTTPDomains {
+		if strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasHTTPDomain reports whether the domain is one of HTTPDomains.
+func (c *Config) hasHTTPDomain(domain string) bool {
+	return slices.Contains(c.HTTPDomains, domain)
+}
+
+// frontPort returns the port of the HTTP front, 0 if there is none.
+func (c *Config) frontPort() int {
+	_, port, err := net.SplitHostPort(c.HTTPAddr)
+	if err != nil {
+		return 0
+	}
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// hostURL returns the URL a port exposed under the hostname is reachable at, on the HTTPS front if there is one.
+func (c *Config) hostURL(host string) string {
+	scheme, addr, port := "https", c.HTTPSAddr, "443"
+	if addr == "" {
+		scheme, addr, port = "http", c.HTTPAddr, "80"
+	}
+	if _, p, err := net.SplitHostPort(addr); err == nil && p != port {
+		host = net.JoinHostPort(host, p)
+	}
+	return scheme + "://" + host
+}
+
+// validateHTTPFront checks the settings of the HTTP front.
+func (c *Config) validateHTTPFront() error {
+	for _, addr := range []string{c.HTTPAddr, c.HTTPSAddr} {
+		if _, _, err := net.SplitHostPort(addr); addr != "" && err != nil {
+			return errors.New("invalid HTTP front address " + addr)
+		}
+	}
+	if c.routesHosts() && len(c.HTTPDomains) == 0 {
+		return errors.New("HTTP front without domains")
+	}
+	for _, domain := range c.HTTPDomains {
+		if !validHostname(domain) {
+			return errors.New("invalid HTTP domain " + domain)
+		}
+	}
+	if (c.HTTPCertFile == "") != (c.HTTPKeyFile == "") {
+		return errors.New("HTTP front certificate without key or key without certificate")
+	}
+	if err := c.HTTPOIDC.validate(); err != nil {
+		return err
+	}
+	return c.validateHTTPACME()
+}
+
+// checkHost returns the error code and the reason why the client can't expose a port of the network under the host,
+// or empty strings if it can. Whether another port is exposed under the host already is checked by claiming it.
+func (c *ClientHandler) checkHost(network string, host string) (string, string) {
+	switch {
+	case c.hosts == nil || !c.config().routesHosts():
+		return Utils.ERRINVALID, "server routes no hosts"
+	case network != "tcp":
+		return Utils.ERRINVALID, "only tcp ports can be exposed under a host"
+	case !c.config().hostAllowed(host):
+		return Utils.ERRRANGE, "host " + host + " not below a domain of the server"
+	}
+	return "", ""
+}
+
+// frontPeerKey is the context key of the address of the peer of a request of the HTTP front, see dialHTTP,
+// frontTargetKey the one of the frontTarget of the request.
+type frontPeerKey struct{}
+type frontTargetKey struct{}
+
+// frontTarget is the route a request of the HTTP front is passed on by, with the config of its relay. in is the
+// request of the visitor and cacheKey its key in the response cache, empty if its response isn't cached.
+type frontTarget struct {
+	route    hostRoute
+	config   *RelayConfig
+	in       *http.Request
+	cacheKey string
+}
+
+// serveHTTPFront serves the HTTP front on Config.HTTPAddr and, with TLS, on Config.HTTPSAddr until the context is
+// cancelled. Requests are passed on to the service of the client that exposed a port under their hostname, with the
+// X-Forwarded headers set. A front that can't listen is left out. The fronts answer the HTTP-01 challenges of the
+// ACME CA, with Config.HTTPACME the certificates of the HTTPS front are obtained and renewed while it serves.
+func (s *Server) serveHTTPFront(ctx context.Context) {
+	err := s.loadFrontCertificate()
+	if err != nil {
+		s.Logger.Error("Error loading HTTP front certificate", slog.String("Func", "serveHTTPFront"), "Error", err)
+		return
+	}
+	err = s.loadErrorPage()
+	if err != nil {
+		s.Logger.Error("Error loading HTTP front error page, using the default", slog.String("Func", "serveHTTPFront"), "Error", err)
+	}
+	if s.Config.HTTPCacheSize > 0 {
+		s.frontCache = newResponseCache(s.Config.HTTPCacheSize << 20)
+	}
+	s.challenges = &httpSolver{tokens: make(map[string]string)}
+	s.frontAuth, err = newFrontAuth(s.Config.HTTPOIDC, s.Logger)
+	if err != nil {
+		s.Logger.Error("Error creating the session key of the HTTP front", slog.String("Func", "serveHTTPFront"), "Error", err)
+		return
+	}
+	if s.Config.HTTPACME {
+		s.frontACME = newFrontACME(ctx, s)
+		s.hosts.mu.Lock()
+		s.hosts.claimed = s.frontACME.ensure
+		s.hosts.mu.Unlock()
+		go s.frontACME.run()
+	}
+	handler := s.frontHandler()
+	for _, addr := range []string{s.Config.HTTPAddr, s.Config.HTTPSAddr} {
+		if addr == "" {
+			continue
+		}
+		l, err := net.Listen(s.Config.listenNetwork("tcp"), addr)
+		if err != nil {
+			s.Logger.Error("Error listening for the HTTP front", slog.String("Func", "serveHTTPFront"), slog.String("Address", addr), "Error", err)
+			continue
+		}
+		l = &proxiedListener{Listener: l, from: func() []netip.Prefix {
+			prefixes, _ := s.config.Load().proxyPrefixes()
+			return prefixes
+		}}
+		if addr == s.Config.HTTPSAddr {
+			l = tls.NewListener(l, s.frontTLSConfig())
+		}
+		server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second, IdleTimeout: HTTPFRONTIDLE}
+		go func() {
+			<-ctx.Done()
+			_ = server.Close()
+		}()
+		go func() {
+			_ = server.Serve(l)
+		}()
+		s.Logger.Info("Serving HTTP front", slog.String("Func", "serveHTTPFront"), slog.String("Address", l.Addr().String()))
+	}
+}
+
+// loadFrontCertificate reads the certificate of the HTTPS front, if Config.HTTPCertFile is set.
+func (s *Server) loadFrontCertificate() error {
+	if s.Config.HTTPCertFile == "" {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.Config.HTTPCertFile, s.Config.HTTPKeyFile)
+	if err != nil {
+		return err
+	}
+	s.frontCert.Store(&cert)
+	return nil
+}
+
+// frontTLSConfig returns the TLS config of the HTTPS front, with the ACME certificate of the server name, the
+// certificate of Config.HTTPCertFile or the one of the server, as loaded last.
+func (s *Server) frontTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			config := s.tlsConfig.Load()
+			if config == nil {
+				return nil, errors.New("no certificate")
+			}
+			config = config.Clone()
+			if cert := s.frontCert.Load(); cert != nil {
+				config.Certificates = []tls.Certificate{*cert}
+			}
+			if s.frontACME != nil {
+				if cert := s.frontACME.certificate(hello.ServerName); cert != nil {
+					config.Certificates = []tls.Certificate{*cert}
+				}
+			}
+			// visitors of the services have no client certificate
+			config.ClientAuth = tls.NoClientCert
+			config.ClientCAs = nil
+			config.VerifyPeerCertificate = nil
+			config.NextProtos = []string{"h2", "http/1.1"}
+			return config, nil
+		},
+	}
+}
+
+// frontHandler passes the requests on to the relays of the routes of their hostnames and paths. The connections to
+// the services are kept for further requests of the same route, so one relayed connection carries many requests.
+// The path prefix of the route is removed from the requests of ports exposed with strip=on.
+// Upgrade requests, e.g. of WebSockets, keep their Upgrade and Connection headers. Once the service switches
+// protocols, the connection of the visitor is piped to the relayed connection as is, until either side closes it.
+// Responses are flushed as they are written, so server-sent events and other streamed responses aren't held back.
+// Hop-by-hop headers are removed, then the header rules of the port are applied, see RelayConfig.Headers. Visitors
+// of ports that require authentication are authenticated first, see frontAuth. The requests of ports exposed with
+// inspect=on are recorded, see requestInspector. GET responses of ports exposed with cache=on are served from the
+// response cache while they are fresh, see responseCache.
+// Requests the front can't pass on are answered with an error page instead, see writeFrontError: 503 if the client
+// of the route can't be reached or hid the port, 502 if its service doesn't answer.
+func (s *Server) frontHandler() http.Handler {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			key, _, _ := net.SplitHostPort(addr)
+			relay := s.hosts.get(key)
+			if relay == nil {
+				return nil, errors.Join(errTunnelOffline, errors.New("no tunnel for route "+key))
+			}
+			peer, _ := ctx.Value(frontPeerKey{}).(net.Addr)
+			return relay.dialHTTP(ctx, peer)
+		},
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     HTTPFRONTIDLE,
+	}
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			// the Host header is kept, the transport picks the relay by the route key in the URL
+			target := r.In.Context().Value(frontTargetKey{}).(frontTarget)
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = target.route.key
+			if target.config.StripPath {
+				r.Out.URL.Path = stripRoutePath(r.Out.URL.Path, target.route.path)
+				r.Out.URL.RawPath = stripRoutePath(r.Out.URL.RawPath, target.route.path)
+			}
+			if !target.config.NoForwarded {
+				r.SetXForwarded()
+			}
+			applyHeaderRules(r.Out.Header, target.config.Headers, false)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			target := resp.Request.Context().Value(frontTargetKey{}).(frontTarget)
+			applyHeaderRules(resp.Header, target.config.Headers, true)
+			if target.cacheKey != "" {
+				resp.Header.Set("X-Cache", "MISS")
+				resp.Body = &cacheBody{ReadCloser: resp.Body, cache: s.frontCache, key: target.cacheKey, req: target.in, resp: resp}
+			}
+			return nil
+		},
+		Transport: transport,
+		// flush right away, also responses of a known length that are written slowly
+		FlushInterval: -1,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			s.Logger.Debug("Error passing on request", slog.String("Func", "frontHandler"), slog.String("Host", requestHost(r)), "Error", err)
+			target := r.Context().Value(frontTargetKey{}).(frontTarget)
+			if errors.Is(err, errTunnelOffline) {
+				s.writeFrontError(w, r, http.StatusServiceUnavailable, "The tunnel of this site is offline.", target.config.Errors)
+				return
+			}
+			s.writeFrontError(w, r, http.StatusBadGateway, "The service behind the tunnel of this site is unreachable.", target.config.Errors)
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, ACMECHALLENGEPATH) {
+			s.challenges.ServeHTTP(w, r)
+			return
+		}
+		host, path := requestHost(r), r.URL.Path
+		if path == OIDCCALLBACK {
+			// logins complete on the route they started on
+			path = s.frontAuth.loginPath(r)
+		}
+		route, ok := s.hosts.route(host, path)
+		if !ok {
+			if offline, ok := s.hosts.wentOffline(host, path); ok {
+				s.writeFrontError(w, r, http.StatusServiceUnavailable, "The tunnel of this site is offline.", offline.errors)
+				return
+			}
+			s.writeFrontError(w, r, http.StatusNotFound, "No tunnel serves this site.", ERRORSAUTO)
+			return
+		}
+		config := route.relay.config.Load()
+		serve := func(w http.ResponseWriter, r *http.Request) {
+			var peer net.Addr
+			if addr, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+				peer = net.TCPAddrFromAddrPort(addr)
+			}
+			if !route.relay.admitPeer(peer) {
+				s.writeFrontError(w, r, http.StatusForbidden, "Your address may not visit this site.", config.Errors)
+				return
+			}
+			if !s.frontAuth.authorize(w, r, config) {
+				// credentials the visitor sent were wrong, a missing one only asks for them
+				if _, _, ok := r.BasicAuth(); ok && len(config.BasicAuth) > 0 {
+					route.relay.bans.fail(peer, FAILAUTH)
+				}
+				return
+			}
+			target := frontTarget{route: route, config: config, in: r}
+			if config.Cache && s.frontCache != nil && r.Method == http.MethodGet {
+				target.cacheKey = cacheKey(route, r)
+				if cached := s.frontCache.lookup(target.cacheKey, r); cached != nil {
+					cached.serve(w)
+					return
+				}
+			}
+			ctx := context.WithValue(r.Context(), frontPeerKey{}, peer)
+			ctx = context.WithValue(ctx, frontTargetKey{}, target)
+			proxy.ServeHTTP(w, r.WithContext(ctx))
+		}
+		if config.Inspect && route.relay.inspector != nil {
+			route.relay.inspector.inspect(w, r, serve)
+			return
+		}
+		serve(w, r)
+	})
+}
+
+// stripRoutePath removes the path prefix of a route from the path, which keeps its leading slash.
+func stripRoutePath(path string, prefix string) string {
+	if path == "" || prefix == "/" {
+		return path
+	}
+	path = strings.TrimPrefix(path, prefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// requestHost returns the hostname of the request in lower case, without port.
+func requestHost(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// frontConn is the end of the pipe between the HTTP front and a proxy connection that the relay pipes, see dialHTTP.
+// Its remote address is the one of the peer of the request it was opened for.
+type frontConn struct {
+	net.Conn
+	peer net.Addr
+}
+
+func (c *frontConn) RemoteAddr() net.Addr {
+	if c.peer == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.peer
+}
+
+// dialHTTP pairs a connection of the HTTP front with a proxy connection of the client, like run does for an accepted
+// external connection, and returns the end of the front. ctx bounds the pairing, peer is the peer of the request the
+// connection is opened for.
+func (r *Relay) dialHTTP(ctx context.Context, peer net.Addr) (net.Conn, error) {
+	if !r.started.Load() {
+		return nil, errors.New("tunnel not started yet")
+	}
+	front, ext := net.Pipe()
+	extConn := &frontConn{Conn: ext, peer: peer}
+	accepted := time.Now()
+	if !r.acquireConn() {
+		r.logAccess(extConn.RemoteAddr(), 0, 0, accepted, CLOSEREJECTED)
+		return nil, errors.New("connection limit reached")
+	}
+	if !r.acquirePeer(peer) {
+		r.releaseConn()
+		r.logAccess(extConn.RemoteAddr(), 0, 0, accepted, CLOSEREJECTED)
+		return nil, errors.New("connection limit of peer reached")
+	}
+	r.stats.Accepted.Add(1)
+	proxConn, err := r.takeProxyConn(ctx)
+	if err != nil {
+		r.releaseConn()
+		r.releasePeer(peer)
+		r.logger.Error("Error pairing proxy connection", slog.String("Func", "dialHTTP"), "Error", err)
+		r.reportError(err)
+		r.logAccess(extConn.RemoteAddr(), 0, 0, accepted, CLOSEUNPAIRED)
+		// the client doesn't answer, it is disconnected or suspended
+		return nil, errors.Join(errTunnelOffline, err)
+	}
+	go func() {
+		defer r.releaseConn()
+		defer r.releasePeer(peer)
+		r.relayConns(r.ctx, extConn, proxConn, accepted)
+	}()
+	return front, nil
+}
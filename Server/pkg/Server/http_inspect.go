@@ -0,0 +1,201 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MAXINSPECTED is the number of recent requests kept per port exposed with inspect=on.
+const MAXINSPECTED = 100
+
+// MAXINSPECTMETHOD is the longest method kept of an inspected request.
+const MAXINSPECTMETHOD = 16
+
+// ErrNotInspected is returned for a port whose requests are not inspected
+var ErrNotInspected = errors.New("requests not inspected")
+
+// InspectedRequest is a request the HTTP front passed on to a port exposed with inspect=on. Latency is the time until
+// the response was complete, BytesIn is the size of the request body, BytesOut the one of the response body. The path
+// is escaped and cut to Utils.MAXINSPECTPATH bytes, the query is left out. The latency is in nanoseconds in JSON.
+type InspectedRequest struct {
+	Time     time.Time     `json:"time"`
+	Method   string        `json:"method"`
+	Path     string        `json:"path"`
+	Status   int           `json:"status"`
+	Latency  time.Duration `json:"latency"`
+	BytesIn  int64         `json:"bytesIn"`
+	BytesOut int64         `json:"bytesOut"`
+}
+
+// requestInspector keeps the recent requests of a port exposed under a hostname in a ring buffer, while enabled by
+// RelayConfig.Inspect. It is safe for concurrent use.
+type requestInspector struct {
+	enabled  atomic.Bool
+	mu       sync.Mutex
+	requests [MAXINSPECTED]InspectedRequest
+	// next is the index of the next request, count the number of requests kept
+	next  int
+	count int
+}
+
+// add keeps the request, replacing the oldest one if the buffer is full.
+func (i *requestInspector) add(request InspectedRequest) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.requests[i.next] = request
+	i.next = (i.next + 1) % MAXINSPECTED
+	i.count = min(i.count+1, MAXINSPECTED)
+}
+
+// recent returns the requests kept, oldest first.
+func (i *requestInspector) recent() []InspectedRequest {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	requests := make([]InspectedRequest, 0, i.count)
+	for n := range i.count {
+		requests = append(requests, i.requests[(i.next-i.count+n+MAXINSPECTED)%MAXINSPECTED])
+	}
+	return requests
+}
+
+// inspectWriter records the status and the size of a response of the HTTP front. Unwrap lets the reverse proxy flush
+// and hijack the connection through it.
+type inspectWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *inspectWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *inspectWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *inspectWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// inspectBody counts the bytes read of a request body.
+type inspectBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (b *inspectBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// inspect serves the request with the handler and adds it to the inspector once the response is complete.
+func (i *requestInspector) inspect(w http.ResponseWriter, r *http.Request, handler func(http.ResponseWriter, *http.Request)) {
+	start := time.Now()
+	iw := &inspectWriter{ResponseWriter: w}
+	var body *inspectBody
+	if r.Body != nil && r.Body != http.NoBody {
+		body = &inspectBody{ReadCloser: r.Body}
+		r.Body = body
+	}
+	handler(iw, r)
+	request := InspectedRequest{
+		Time:     start,
+		Method:   r.Method[:min(len(r.Method), MAXINSPECTMETHOD)],
+		Path:     inspectPath(r),
+		Status:   iw.status,
+		Latency:  time.Since(start),
+		BytesOut: iw.bytes,
+	}
+	if body != nil {
+		request.BytesIn = body.bytes
+	}
+	i.add(request)
+}
+
+// inspectPath returns the escaped path of the request, cut to Utils.MAXINSPECTPATH bytes.
+func inspectPath(r *http.Request) string {
+	path := r.URL.EscapedPath()
+	if len(path) > Utils.MAXINSPECTPATH {
+		path = path[:Utils.MAXINSPECTPATH]
+	}
+	return path
+}
+
+// sendInspected answers a CTRLINSPECT frame with the recent requests of the exposed port it names, see
+// Utils.CTRLINSPECT.
+func (c *ClientHandler) sendInspected(ctx context.Context, msg *Utils.CTRLFrame, toclient chan *Utils.CTRLFrame) {
+	port, err := frameInt(msg, 1)
+	if err != nil {
+		c.logger.Error("Invalid inspect frame", slog.String("Func", "sendInspected"), slog.String("Frame", msg.String()))
+		return
+	}
+	network := msg.Data[0]
+	var requests []InspectedRequest
+	if relay := c.tunnels.get(network, port); relay != nil && relay.inspector != nil && relay.inspector.enabled.Load() {
+		requests = relay.inspector.recent()
+	}
+	frames := inspectFrames(network, port, requests)
+	go func() {
+		for _, fr := range frames {
+			select {
+			case toclient <- fr:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// inspectFrames splits the requests into CTRLINSPECT frames of up to INSPECTCHUNK requests each, at least one frame.
+func inspectFrames(network string, port int, requests []InspectedRequest) []*Utils.CTRLFrame {
+	count := max(1, (len(requests)+Utils.INSPECTCHUNK-1)/Utils.INSPECTCHUNK)
+	frames := make([]*Utils.CTRLFrame, 0, count)
+	for i := range count {
+		data := []string{network, strconv.Itoa(port), strconv.Itoa(count - 1 - i)}
+		for _, r := range requests[min(len(requests), i*Utils.INSPECTCHUNK):min(len(requests), (i+1)*Utils.INSPECTCHUNK)] {
+			data = append(data, strconv.FormatInt(r.Time.UnixMilli(), 10)+":"+r.Method+":"+strconv.Itoa(r.Status)+":"+
+				strconv.FormatInt(r.Latency.Milliseconds(), 10)+":"+strconv.FormatInt(r.BytesIn, 10)+":"+
+				strconv.FormatInt(r.BytesOut, 10)+":"+r.Path)
+		}
+		frames = append(frames, Utils.NewCTRLFrame(Utils.CTRLINSPECT, data))
+	}
+	return frames
+}
+
+// InspectedRequests returns the recent requests of the port of the network exposed by the client, oldest first. It
+// fails with ErrNoClient or ErrNoTunnel if the port is not exposed, with ErrNotInspected if it wasn't exposed with
+// inspect=on. Requests are kept while the port is exposed.
+func (s *Server) InspectedRequests(id uint64, network string, port int) ([]InspectedRequest, error) {
+	client, err := s.adminClient(strconv.FormatUint(id, 10))
+	if err != nil {
+		return nil, err
+	}
+	for _, tunnel := range client.Tunnels {
+		if tunnel.Network != network || tunnel.Port != port {
+			continue
+		}
+		if tunnel.inspector == nil || !tunnel.inspector.enabled.Load() {
+			return nil, ErrNotInspected
+		}
+		return tunnel.inspector.recent(), nil
+	}
+	return nil, ErrNoTunnel
+}
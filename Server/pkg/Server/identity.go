@@ -0,0 +1,63 @@
+package Server
+
+import (
+	"Utils"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// HANDSHAKETIMEOUT is how long a client has to complete the TLS or Noise handshake of its control connection.
+const HANDSHAKETIMEOUT = 10 * time.Second
+
+// ClientIdentity is who a client is, taken from the certificate it authenticated with.
+type ClientIdentity struct {
+	// CN is the common name of the certificate, policies like quotas and reserved ports are keyed by it
+	CN string
+	// SANs are the DNS names, email addresses, IP addresses and URIs of the certificate
+	SANs []string
+	// OU are the organizational units of the certificate, one of them may name the tenant of the client
+	OU []string
+	// Auth is how the client authenticated, AUTHCERT or, for clients without certificate, AUTHTOKEN, AUTHJWT or
+	// AUTHNOISE. CN is then the name the token or the Noise key stands for.
+	Auth string
+	// NotAfter is when the certificate expires, zero for clients without certificate
+	NotAfter time.Time
+	// Tenant is the name of the tenant the server assigned the client to, see Config.tenantOf. It is empty for
+	// clients of no tenant.
+	Tenant string
+}
+
+// identify completes the TLS handshake of the control connection and returns the identity of the client.
+// Connections without TLS or without client certificate have an empty identity. Connections of Config.NoiseAddr
+// complete their Noise handshake instead, see identifyNoise.
+func identify(conn net.Conn, config *Config) (ClientIdentity, error) {
+	if noiseConn, ok := conn.(*Utils.NoiseConn); ok {
+		return identifyNoise(noiseConn, config)
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ClientIdentity{}, nil
+	}
+	_ = tlsConn.SetDeadline(time.Now().Add(HANDSHAKETIMEOUT))
+	err := tlsConn.Handshake()
+	_ = tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		return ClientIdentity{}, err
+	}
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ClientIdentity{}, nil
+	}
+	cert := certs[0]
+	identity := ClientIdentity{CN: cert.Subject.CommonName, OU: cert.Subject.OrganizationalUnit, NotAfter: cert.NotAfter}
+	identity.SANs = append(identity.SANs, cert.DNSNames...)
+	identity.SANs = append(identity.SANs, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		identity.SANs = append(identity.SANs, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		identity.SANs = append(identity.SANs, uri.String())
+	}
+	return identity, nil
+}
@@ -0,0 +1,47 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"log/slog"
+	"net"
+)
+
+// inlineMux returns the mux session carried in CTRLDATA frames on the control connection, which is started with the
+// first port exposed with transport=inline. Relays of inline ports open their streams on it, so the client needs
+// neither proxy connections nor a data connection, at the cost of sharing the control connection with the data.
+//
+// Frames of the session are sent through toclient like every other frame, so they are only written by the handle loop.
+func (c *ClientHandler) inlineMux(ctx context.Context, toclient chan *Utils.CTRLFrame) *Utils.MuxSession {
+	if c.inline != nil {
+		return c.inline
+	}
+	send := func(fr *Utils.CTRLFrame) error {
+		select {
+		case toclient <- fr:
+			return nil
+		case <-ctx.Done():
+			return net.ErrClosed
+		}
+	}
+	c.inlineConn = Utils.NewFrameConn(send, c.Conn.LocalAddr(), c.Conn.RemoteAddr())
+	session := Utils.NewMuxSession(c.inlineConn, false)
+	c.inline = session
+	context.AfterFunc(ctx, func() {
+		_ = session.Close()
+	})
+	c.logger.Info("Carrying inline relays on the control connection", slog.String("Func", "inlineMux"))
+	return session
+}
+
+// inlineData passes a CTRLDATA frame of the client to the inline session.
+func (c *ClientHandler) inlineData(msg *Utils.CTRLFrame) {
+	if c.inlineConn == nil {
+		c.logger.Error("Data frame without inline relays", slog.String("Func", "inlineData"))
+		return
+	}
+	err := c.inlineConn.Deliver(msg)
+	if err != nil {
+		c.logger.Error("Error passing data frame to inline session", slog.String("Func", "inlineData"), "Error", err)
+	}
+}
@@ -0,0 +1,162 @@
+package Server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// JWTLEEWAY is the clock skew tolerated when checking the expiry and start of JWTs.
+const JWTLEEWAY = time.Minute
+
+// JWTConfig lets clients authenticate with JWTs, signed with HS256 by Secret or with ES256 or RS256 by the private
+// key of PublicKey. The subject of a token takes the place of the certificate CN. Tokens have to expire.
+type JWTConfig struct {
+	Secret    []byte
+	PublicKey crypto.PublicKey
+	// Issuer and Audience have to match the claims of the tokens, if set
+	Issuer   string
+	Audience string
+}
+
+func (j *JWTConfig) enabled() bool {
+	return len(j.Secret) > 0 || j.PublicKey != nil
+}
+
+// validate checks that the public key is of a supported type and the secret is not too short.
+func (j *JWTConfig) validate() error {
+	switch j.PublicKey.(type) {
+	case nil, *ecdsa.PublicKey, *rsa.PublicKey:
+	default:
+		return errors.New("unsupported JWT public key")
+	}
+	if len(j.Secret) > 0 && len(j.Secret) < 32 {
+		return errors.New("JWT secret shorter than 32 bytes")
+	}
+	return nil
+}
+
+// LoadJWTPublicKey loads the PEM encoded ECDSA or RSA public key JWTs are verified with.
+func LoadJWTPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in " + path)
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	Expires   float64         `json:"exp"`
+	NotBefore float64         `json:"nbf"`
+}
+
+// verify checks the signature and the claims of the token at now and returns its subject.
+func (j *JWTConfig) verify(token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return "", err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed JWT signature")
+	}
+	err = j.checkSignature(header.Alg, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return "", err
+	}
+
+	var claims jwtClaims
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return "", err
+	}
+	if claims.Subject == "" {
+		return "", errors.New("JWT without subject")
+	}
+	if claims.Expires == 0 || now.After(time.Unix(int64(claims.Expires), 0).Add(JWTLEEWAY)) {
+		return "", errors.New("JWT expired")
+	}
+	if claims.NotBefore != 0 && now.Add(JWTLEEWAY).Before(time.Unix(int64(claims.NotBefore), 0)) {
+		return "", errors.New("JWT not valid yet")
+	}
+	if j.Issuer != "" && claims.Issuer != j.Issuer {
+		return "", errors.New("JWT of another issuer")
+	}
+	if j.Audience != "" && !audienceContains(claims.Audience, j.Audience) {
+		return "", errors.New("JWT for another audience")
+	}
+	return claims.Subject, nil
+}
+
+// checkSignature verifies the signature of the signed part with the algorithm of the header, which has to fit the
+// configured key, so a token can't choose a weaker algorithm.
+func (j *JWTConfig) checkSignature(alg string, signed []byte, signature []byte) error {
+	hash := sha256.Sum256(signed)
+	switch key := j.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		if alg == "ES256" && len(signature) == 64 &&
+			ecdsa.Verify(key, hash[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return nil
+		}
+	case *rsa.PublicKey:
+		if alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil {
+			return nil
+		}
+	}
+	if len(j.Secret) > 0 && alg == "HS256" {
+		mac := hmac.New(sha256.New, j.Secret)
+		mac.Write(signed)
+		if hmac.Equal(mac.Sum(nil), signature) {
+			return nil
+		}
+	}
+	return errors.New("invalid JWT signature")
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed JWT")
+	}
+	err = json.Unmarshal(data, v)
+	if err != nil {
+		return errors.New("malformed JWT")
+	}
+	return nil
+}
+
+// audienceContains reports whether the aud claim, a string or a list of strings, contains audience.
+func audienceContains(aud json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(aud, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	return json.Unmarshal(aud, &list) == nil && slices.Contains(list, audience)
+}
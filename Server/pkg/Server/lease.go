@@ -0,0 +1,46 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+const (
+	// DEFAULTPORTLEASE is the default lease time of exposed ports, see Config.PortLease
+	DEFAULTPORTLEASE = 60 * time.Second
+	// MINPORTLEASE is the shortest lease time, the client renews after a third of it
+	MINPORTLEASE = 3 * time.Second
+	// LEASECHECKINTERVAL is how often the leases of a client are checked
+	LEASECHECKINTERVAL = time.Second
+)
+
+// renewLease extends the lease of an exposed port by the lease time of the config.
+func (c *ClientHandler) renewLease(network string, externalPort int) {
+	if c.config().PortLease == 0 {
+		return
+	}
+	relay := c.tunnels.get(network, externalPort)
+	if relay == nil {
+		// the renewal may cross the expiry or the hiding of the port
+		c.logger.Debug("Renewal of port not exposed", slog.String("Func", "renewLease"), slog.String("Network", network), slog.Int("Port", externalPort))
+		return
+	}
+	relay.leaseExpiry = time.Now().Add(c.config().PortLease)
+}
+
+// expireLeases hides the exposed ports whose lease expired, which returns their proxy ports to the queue,
+// and tells the client with a CTRLERROR.
+func (c *ClientHandler) expireLeases(ctx context.Context, now time.Time, toclient chan *Utils.CTRLFrame) {
+	for _, relay := range c.tunnels.all() {
+		if now.Before(relay.leaseExpiry) {
+			continue
+		}
+		network, port := relay.network, relay.externalPort
+		relay.logger.Info("Lease of exposed port expired", slog.String("Func", "expireLeases"))
+		c.hide(network, port)
+		c.reject(ctx, toclient, network, strconv.Itoa(port), Utils.ERRLEASE, "lease expired")
+	}
+}
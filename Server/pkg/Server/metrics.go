@@ -0,0 +1,190 @@
+package Server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// METRICSPATH is the path the Prometheus metrics are served on, see Config.MetricsAddr.
+const METRICSPATH = "/metrics"
+
+// relayTotals sums the traffic counters of relays.
+type relayTotals struct {
+	bytesIn  uint64
+	bytesOut uint64
+	accepted uint64
+}
+
+func (t *relayTotals) add(stats *RelayStats) {
+	if stats == nil {
+		return
+	}
+	t.bytesIn += stats.BytesIn.Load()
+	t.bytesOut += stats.BytesOut.Load()
+	t.accepted += stats.Accepted.Load()
+}
+
+func (t *relayTotals) addTunnels(tunnels []Tunnel) {
+	for _, tunnel := range tunnels {
+		t.add(tunnel.stats)
+	}
+}
+
+// serveMonitoring serves the metrics and the health checks on Config.MetricsAddr until the context is cancelled. If
+// it can't listen, the error is logged and the server runs without.
+func (s *Server) serveMonitoring(ctx context.Context) {
+	l, err := net.Listen("tcp", s.Config.MetricsAddr)
+	if err != nil {
+		s.Logger.Error("Error listening for metrics", slog.String("Func", "serveMonitoring"), slog.String("Address", s.Config.MetricsAddr), "Error", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+METRICSPATH, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = s.WriteMetrics(w)
+	})
+	mux.HandleFunc("GET "+HEALTHPATH, healthHandler(s.Healthy))
+	mux.HandleFunc("GET "+READYPATH, healthHandler(s.Ready))
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		_ = server.Serve(l)
+	}()
+	s.Logger.Info("Serving metrics and health checks", slog.String("Func", "serveMonitoring"), slog.String("Address", l.Addr().String()))
+}
+
+// WriteMetrics writes the metrics of the server in the Prometheus text format: the connected clients, the exposed
+// ports, the relayed connections and bytes, per port and in total, the control connections lost to malformed frames,
+// the events by kind and the proxy ports in use.
+func (s *Server) WriteMetrics(w io.Writer) error {
+	m := &metricsWriter{w: bufio.NewWriter(w)}
+	clients := s.registry.Clients()
+
+	m.family("goexpose_clients", "gauge", "Connected clients.")
+	m.sample("goexpose_clients", nil, uint64(len(clients)))
+
+	relays := map[string]uint64{"tcp": 0, "udp": 0}
+	for _, client := range clients {
+		for _, t := range client.Tunnels {
+			relays[t.Network]++
+		}
+	}
+	m.family("goexpose_relays", "gauge", "Exposed ports.")
+	for _, network := range []string{"tcp", "udp"} {
+		m.sample("goexpose_relays", []string{"network", network}, relays[network])
+	}
+
+	// the connection count and the proxy ports are set up by Run
+	ready := s.poolsReady.Load()
+	active := 0
+	if ready {
+		active = s.ActiveConns()
+	}
+	m.family("goexpose_relayed_connections", "gauge", "Relayed connections and UDP sessions at the moment.")
+	m.sample("goexpose_relayed_connections", nil, uint64(active))
+	totals := s.registry.totals()
+	m.family("goexpose_relayed_connections_total", "counter", "Relayed connections and UDP sessions accepted.")
+	m.sample("goexpose_relayed_connections_total", nil, totals.accepted)
+	m.family("goexpose_relayed_bytes_total", "counter", "Bytes relayed, in from external peers to clients, out from clients to external peers.")
+	m.sample("goexpose_relayed_bytes_total", []string{"direction", "in"}, totals.bytesIn)
+	m.sample("goexpose_relayed_bytes_total", []string{"direction", "out"}, totals.bytesOut)
+
+	m.family("goexpose_tunnel_bytes_total", "counter", "Bytes relayed by an exposed port.")
+	for _, client := range clients {
+		for _, t := range client.Tunnels {
+			if t.stats == nil {
+				continue
+			}
+			labels := tunnelLabels(client, t)
+			m.sample("goexpose_tunnel_bytes_total", append(labels, "direction", "in"), t.stats.BytesIn.Load())
+			m.sample("goexpose_tunnel_bytes_total", append(labels, "direction", "out"), t.stats.BytesOut.Load())
+		}
+	}
+	m.family("goexpose_tunnel_connections", "gauge", "Relayed connections and UDP sessions of an exposed port at the moment.")
+	for _, client := range clients {
+		for _, t := range client.Tunnels {
+			if t.stats != nil {
+				m.sample("goexpose_tunnel_connections", tunnelLabels(client, t), uint64(max(t.stats.Active.Load(), 0)))
+			}
+		}
+	}
+
+	m.family("goexpose_frame_errors_total", "counter", "Control connections lost to malformed frames.")
+	m.sample("goexpose_frame_errors_total", nil, s.frameErrors.Load())
+
+	events := s.eventCounts.snapshot()
+	m.family("goexpose_events_total", "counter", "Events of clients and tunnels by kind.")
+	for _, kind := range EVENTKINDS {
+		m.sample("goexpose_events_total", []string{"kind", kind}, events[kind])
+	}
+	m.family("goexpose_events_dropped_total", "counter", "Events dropped because a subscriber fell behind.")
+	m.sample("goexpose_events_dropped_total", nil, s.events.Dropped())
+
+	// the shared pool is labeled with an empty tenant
+	pools := map[string]*Portqueue{}
+	if ready {
+		pools[""] = s.proxyPorts
+		for name, pq := range s.tenantProxyPorts {
+			pools[name] = pq
+		}
+	}
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	m.family("goexpose_proxy_ports", "gauge", "Proxy ports of the shared pool, or of the pool of a tenant.")
+	for _, name := range names {
+		m.sample("goexpose_proxy_ports", []string{"tenant", name}, uint64(pools[name].Size()))
+	}
+	m.family("goexpose_proxy_ports_available", "gauge", "Proxy ports of the pool that can be handed out.")
+	for _, name := range names {
+		m.sample("goexpose_proxy_ports_available", []string{"tenant", name}, uint64(pools[name].Available()))
+	}
+	return m.w.Flush()
+}
+
+// tunnelLabels identifies an exposed port in the metrics. The client ID tells apart sessions of the same client.
+func tunnelLabels(client ClientInfo, t Tunnel) []string {
+	return []string{"client", client.Identity.CN, "id", strconv.FormatUint(client.ID, 10), "network", t.Network,
+		"port", strconv.Itoa(t.Port), "name", t.Name}
+}
+
+// metricsWriter writes metrics in the Prometheus text format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+// family writes the help and type of the metric with the name. Families have to be written before their samples.
+func (m *metricsWriter) family(name string, typ string, help string) {
+	_, _ = m.w.WriteString("# HELP " + name + " " + help + "\n# TYPE " + name + " " + typ + "\n")
+}
+
+// sample writes a value of the metric with the labels, given as name and value pairs.
+func (m *metricsWriter) sample(name string, labels []string, value uint64) {
+	_, _ = m.w.WriteString(name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		sep := ","
+		if i == 0 {
+			sep = "{"
+		}
+		_, _ = m.w.WriteString(sep + labels[i] + "=\"" + labelEscaper.Replace(labels[i+1]) + "\"")
+	}
+	if len(labels) > 1 {
+		_, _ = m.w.WriteString("}")
+	}
+	_, _ = m.w.WriteString(" " + strconv.FormatUint(value, 10) + "\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,82 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// MUXACCEPTTIMEOUT is how long the server waits for the data connection of a client that asked for multiplexing.
+const MUXACCEPTTIMEOUT = 10 * time.Second
+
+// enableMux answers a CTRLMUX frame: it listens on the data port of the config, tells the client the port and a token, and accepts the data
+// connection presenting the token. Relays of ports exposed afterwards open a stream per relayed connection on it,
+// instead of asking the client for proxy connections. If the data connection is lost, the client is disconnected.
+//
+// The handle loop blocks until the client connected, so EXPOSE frames sent after CTRLMUX already use the data connection.
+// The answer is therefore written to the control connection directly.
+func (c *ClientHandler) enableMux(ctx context.Context, cnl context.CancelFunc) {
+	if c.mux != nil {
+		c.logger.Error("Client is already multiplexing", slog.String("Func", "enableMux"))
+		return
+	}
+	conn := c.acceptMuxConn()
+	if conn == nil {
+		// an answer without data tells the client to keep using proxy ports
+		err := Utils.WriteFrame(c.Conn, Utils.NewCTRLFrame(Utils.CTRLMUX, nil))
+		if err != nil {
+			c.logger.Debug("Error refusing multiplexing", slog.String("Func", "enableMux"), "Error", err)
+		}
+		return
+	}
+	session := Utils.NewMuxSession(conn, false)
+	c.mux = session
+	c.logger.Info("Client is multiplexing relayed connections", slog.String("Func", "enableMux"))
+	go func() {
+		select {
+		case <-session.Done():
+			c.logger.Error("Data connection lost", slog.String("Func", "enableMux"), "Error", session.Err())
+			cnl()
+		case <-ctx.Done():
+			_ = session.Close()
+		}
+	}()
+}
+
+// acceptMuxConn sends the CTRLMUX answer and waits for the data connection, it returns nil if that fails.
+func (c *ClientHandler) acceptMuxConn() net.Conn {
+	token, err := Utils.NewProxyToken()
+	if err != nil {
+		c.logger.Error("Error creating data connection token", slog.String("Func", "acceptMuxConn"), "Error", err)
+		return nil
+	}
+	ctrlIP, _, _ := net.SplitHostPort(c.Conn.RemoteAddr().String())
+	conns, err := c.data.expect(token, ctrlIP)
+	if err != nil {
+		c.logger.Error("Error listening on data port", slog.String("Func", "acceptMuxConn"), slog.Int("Port", c.config().DataPort), "Error", err)
+		return nil
+	}
+	defer c.data.done(token, conns)
+	security := "plain"
+	if c.dataTLS != nil {
+		security = "tls"
+	}
+	err = Utils.WriteFrame(c.Conn, Utils.NewCTRLFrame(Utils.CTRLMUX, []string{strconv.Itoa(c.config().DataPort), token, security}))
+	if err != nil {
+		c.logger.Error("Error answering multiplexing request", slog.String("Func", "acceptMuxConn"), "Error", err)
+		return nil
+	}
+
+	timeout := time.NewTimer(MUXACCEPTTIMEOUT)
+	defer timeout.Stop()
+	select {
+	case conn := <-conns:
+		return conn
+	case <-timeout.C:
+		c.logger.Error("Timeout waiting for the data connection", slog.String("Func", "acceptMuxConn"))
+		return nil
+	}
+}
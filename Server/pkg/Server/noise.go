@@ -0,0 +1,104 @@
+package Server
+
+import (
+	"Utils"
+	"bytes"
+	"errors"
+	"log/slog"
+	"net"
+	"strings"
+	"time"
+)
+
+// ParseNoiseClients parses the public Noise keys of clients in the form "cn=key,cn=key", keys in base64.
+func ParseNoiseClients(s string) (map[string]string, error) {
+	clients := make(map[string]string)
+	if s == "" {
+		return clients, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		// base64 pads with =, the CN ends at the first
+		cn, key, ok := strings.Cut(entry, "=")
+		if !ok || cn == "" {
+			return nil, errors.New("invalid Noise client " + entry)
+		}
+		clients[cn] = key
+	}
+	return clients, nil
+}
+
+// validateNoise checks the Noise listener and the keys of its clients.
+func (c *Config) validateNoise() error {
+	if c.NoiseAddr == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.NoiseAddr); err != nil {
+		return errors.New("invalid Noise address " + c.NoiseAddr)
+	}
+	if c.NoiseKeyFile == "" {
+		return errors.New("Noise listener without key file")
+	}
+	for cn, key := range c.NoiseClients {
+		if cn == "" {
+			return errors.New("Noise key without CN")
+		}
+		if _, err := Utils.DecodeNoiseKey(key); err != nil {
+			return errors.New("invalid Noise key of client " + cn)
+		}
+	}
+	return nil
+}
+
+// noiseClient returns the CN of the client with the public key, false if the key is none of Config.NoiseClients.
+func (c *Config) noiseClient(key []byte) (string, bool) {
+	for cn, encoded := range c.NoiseClients {
+		known, err := Utils.DecodeNoiseKey(encoded)
+		if err == nil && bytes.Equal(known, key) {
+			return cn, true
+		}
+	}
+	return "", false
+}
+
+// identifyNoise completes the Noise handshake of the control connection and returns the identity of the client, the
+// CN its key is registered with.
+func identifyNoise(conn *Utils.NoiseConn, config *Config) (ClientIdentity, error) {
+	_ = conn.SetDeadline(time.Now().Add(HANDSHAKETIMEOUT))
+	err := conn.Handshake()
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return ClientIdentity{}, err
+	}
+	cn, ok := config.noiseClient(conn.RemoteStatic())
+	if !ok {
+		return ClientIdentity{}, errors.New("unknown Noise key " + Utils.EncodeNoiseKey(conn.RemoteStatic()))
+	}
+	return ClientIdentity{CN: cn, Auth: AUTHNOISE}, nil
+}
+
+// noiseListen listens on Config.NoiseAddr with the key of Config.NoiseKeyFile, and passes its connections on to l
+// until it is closed.
+func (s *Server) noiseListen(l *transportListener) error {
+	key, err := Utils.LoadNoiseKey(s.Config.NoiseKeyFile)
+	if err != nil {
+		return err
+	}
+	public, err := Utils.NoisePublicKey(key)
+	if err != nil {
+		return err
+	}
+	nl, err := net.Listen(s.Config.listenNetwork("tcp"), s.Config.NoiseAddr)
+	if err != nil {
+		return err
+	}
+	s.Logger.Info("Accepting Noise control connections", slog.String("Func", "noiseListen"), slog.String("Address", s.Config.NoiseAddr),
+		slog.String("PublicKey", Utils.EncodeNoiseKey(public)))
+	go func() {
+		<-l.done
+		_ = nl.Close()
+	}()
+	go l.serve(nl, func(conn net.Conn) net.Conn {
+		return Utils.NoiseServer(conn, key)
+	}, s.Logger)
+	return nil
+}
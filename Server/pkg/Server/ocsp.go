@@ -0,0 +1,220 @@
+package Server
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// OCSP messages of RFC 6960, only what is needed to ask a responder about a single certificate.
+
+// OCSPMAXRESPONSE is the maximum size of a response of an OCSP responder.
+const OCSPMAXRESPONSE = 1 << 16
+
+var (
+	oidSHA1          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidOCSPBasic     = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	ocspSignatureAlg = map[string]x509.SignatureAlgorithm{
+		"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+		"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+		"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+		"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+		"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+		"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+		"1.3.101.112":           x509.PureEd25519,
+	}
+)
+
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	KeyHash       []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest struct {
+		RequestList []struct {
+			CertID ocspCertID
+		}
+	}
+}
+
+type ocspResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes struct {
+		Type     asn1.ObjectIdentifier
+		Response []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certs              []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version     int `asn1:"optional,explicit,default:0,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+	Extensions  []pkix.Extension `asn1:"optional,explicit,tag:1"`
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag        `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo  `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag        `asn1:"tag:2,optional"`
+	ThisUpdate time.Time        `asn1:"generalized"`
+	NextUpdate time.Time        `asn1:"generalized,explicit,tag:0,optional"`
+	Extensions []pkix.Extension `asn1:"explicit,tag:1,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// ocspStatus is the answer of a responder about a certificate, valid until nextUpdate, which is zero if the
+// responder didn't set it.
+type ocspStatus struct {
+	revoked    bool
+	nextUpdate time.Time
+}
+
+// newCertID identifies the certificate with the serial issued by issuer, with SHA-1 hashes as responders expect.
+func newCertID(serial *big.Int, issuer *x509.Certificate) (ocspCertID, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	_, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki)
+	if err != nil {
+		return ocspCertID{}, err
+	}
+	nameHash := sha1.Sum(issuer.RawSubject)
+	keyHash := sha1.Sum(spki.PublicKey.RightAlign())
+	return ocspCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash[:],
+		KeyHash:       keyHash[:],
+		SerialNumber:  serial,
+	}, nil
+}
+
+// queryOCSP asks the responder at url about the certificate issued by issuer.
+func queryOCSP(client *http.Client, url string, cert *x509.Certificate, issuer *x509.Certificate) (ocspStatus, error) {
+	id, err := newCertID(cert.SerialNumber, issuer)
+	if err != nil {
+		return ocspStatus{}, err
+	}
+	var req ocspRequest
+	req.TBSRequest.RequestList = append(req.TBSRequest.RequestList, struct{ CertID ocspCertID }{id})
+	body, err := asn1.Marshal(req)
+	if err != nil {
+		return ocspStatus{}, err
+	}
+	resp, err := client.Post(url, "application/ocsp-request", bytes.NewReader(body))
+	if err != nil {
+		return ocspStatus{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ocspStatus{}, errors.New("ocsp: responder answered " + resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, OCSPMAXRESPONSE))
+	if err != nil {
+		return ocspStatus{}, err
+	}
+	return parseOCSPResponse(data, id, issuer)
+}
+
+// parseOCSPResponse checks that the response is signed by issuer, or by a responder issuer delegated to, and returns
+// the status of the certificate with id. Responses dated in the future, past their nextUpdate or, without one, older
+// than OCSPMAXAGE are refused.
+func parseOCSPResponse(data []byte, id ocspCertID, issuer *x509.Certificate) (ocspStatus, error) {
+	var resp ocspResponse
+	_, err := asn1.Unmarshal(data, &resp)
+	if err != nil {
+		return ocspStatus{}, err
+	}
+	if resp.Status != 0 {
+		return ocspStatus{}, errors.New("ocsp: responder failed with status " + strconv.Itoa(int(resp.Status)))
+	}
+	if !resp.ResponseBytes.Type.Equal(oidOCSPBasic) {
+		return ocspStatus{}, errors.New("ocsp: unsupported response type")
+	}
+	var basic ocspBasicResponse
+	_, err = asn1.Unmarshal(resp.ResponseBytes.Response, &basic)
+	if err != nil {
+		return ocspStatus{}, err
+	}
+	signer := issuer
+	if len(basic.Certs) > 0 {
+		responder, err := x509.ParseCertificate(basic.Certs[0].FullBytes)
+		if err != nil {
+			return ocspStatus{}, err
+		}
+		if !responder.Equal(issuer) {
+			err = responder.CheckSignatureFrom(issuer)
+			if err != nil {
+				return ocspStatus{}, errors.New("ocsp: responder not authorized by the issuer: " + err.Error())
+			}
+			if !slices.Contains(responder.ExtKeyUsage, x509.ExtKeyUsageOCSPSigning) {
+				return ocspStatus{}, errors.New("ocsp: responder certificate not for OCSP signing")
+			}
+			signer = responder
+		}
+	}
+	alg, ok := ocspSignatureAlg[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return ocspStatus{}, errors.New("ocsp: unsupported signature algorithm " + basic.SignatureAlgorithm.Algorithm.String())
+	}
+	err = signer.CheckSignature(alg, basic.TBSResponseData.FullBytes, basic.Signature.RightAlign())
+	if err != nil {
+		return ocspStatus{}, errors.New("ocsp: invalid signature: " + err.Error())
+	}
+
+	var tbs ocspResponseData
+	_, err = asn1.Unmarshal(basic.TBSResponseData.FullBytes, &tbs)
+	if err != nil {
+		return ocspStatus{}, err
+	}
+	for _, single := range tbs.Responses {
+		if single.CertID.SerialNumber.Cmp(id.SerialNumber) != 0 || !bytes.Equal(single.CertID.NameHash, id.NameHash) ||
+			!bytes.Equal(single.CertID.KeyHash, id.KeyHash) {
+			continue
+		}
+		now := time.Now()
+		if single.ThisUpdate.After(now.Add(OCSPCLOCKSKEW)) {
+			return ocspStatus{}, errors.New("ocsp: response not yet valid")
+		}
+		if !single.NextUpdate.IsZero() && single.NextUpdate.Before(now) {
+			return ocspStatus{}, errors.New("ocsp: response outdated")
+		}
+		if single.NextUpdate.IsZero() && single.ThisUpdate.Before(now.Add(-OCSPMAXAGE)) {
+			return ocspStatus{}, errors.New("ocsp: response stale")
+		}
+		switch {
+		case bool(single.Good):
+			return ocspStatus{nextUpdate: single.NextUpdate}, nil
+		case !single.Revoked.RevocationTime.IsZero():
+			return ocspStatus{revoked: true, nextUpdate: single.NextUpdate}, nil
+		default:
+			return ocspStatus{}, errors.New("ocsp: certificate unknown to the responder")
+		}
+	}
+	return ocspStatus{}, errors.New("ocsp: no response for the certificate")
+}
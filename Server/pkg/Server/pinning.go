@@ -0,0 +1,73 @@
+package Server
+
+import (
+	"Utils"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+)
+
+var errNotPinned = errors.New("client certificate not in the fingerprint allowlist")
+
+// LoadFingerprints loads the allowlist of client certificates from a JSON file holding a list of SHA-256
+// fingerprints in hex, with or without colons, see Utils.ParseFingerprint. An empty path loads no fingerprints.
+func LoadFingerprints(path string) (map[string]bool, error) {
+	fingerprints := make(map[string]bool)
+	if path == "" {
+		return fingerprints, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range list {
+		fp, err := Utils.ParseFingerprint(s)
+		if err != nil {
+			return nil, err
+		}
+		if fingerprints[fp] {
+			return nil, errors.New("duplicate fingerprint " + s)
+		}
+		fingerprints[fp] = true
+	}
+	return fingerprints, nil
+}
+
+// verifyPeer returns the tls.Config.VerifyPeerCertificate of the server, called after the chain of the client
+// certificate was verified with the CA. It refuses certificates missing from the ClientFingerprints of config, if
+// set, so a compromised CA key can't issue certificates the server accepts, and revoked certificates. It returns nil
+// if there is nothing to check.
+func (s *Server) verifyPeer(config *Config, revocation *revocationChecker) func([][]byte, [][]*x509.Certificate) error {
+	fingerprints := config.ClientFingerprints
+	if len(fingerprints) == 0 && revocation == nil {
+		return nil
+	}
+	return func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+		// clients authenticating with a token present no certificate
+		if len(rawCerts) == 0 {
+			return nil
+		}
+		if len(fingerprints) > 0 {
+			fp := Utils.Fingerprint(rawCerts[0])
+			if !fingerprints[fp] {
+				cn := ""
+				if len(chains) > 0 {
+					cn = chains[0][0].Subject.CommonName
+				}
+				s.Logger.Warn("Refused client certificate not in the allowlist", slog.String("Func", "verifyPeer"), slog.String("CN", cn), slog.String("Fingerprint", fp))
+				return errNotPinned
+			}
+		}
+		if revocation != nil {
+			return revocation.verify(rawCerts, chains)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,179 @@
+package Server
+
+import (
+	"Utils"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Quota limits the amount of ports a client can expose at a time, per network. 0 means unlimited.
+type Quota struct {
+	Tcp int
+	Udp int
+}
+
+// ParseQuota parses a quota in the form "tcp/udp", e.g. "10/5".
+func ParseQuota(s string) (Quota, error) {
+	tcp, udp, ok := strings.Cut(s, "/")
+	if !ok {
+		return Quota{}, errors.New("invalid quota " + s)
+	}
+	var q Quota
+	var err error
+	q.Tcp, err = strconv.Atoi(tcp)
+	if err != nil || q.Tcp < 0 {
+		return Quota{}, errors.New("invalid quota " + s)
+	}
+	q.Udp, err = strconv.Atoi(udp)
+	if err != nil || q.Udp < 0 {
+		return Quota{}, errors.New("invalid quota " + s)
+	}
+	return q, nil
+}
+
+// ParseClientQuotas parses quotas of single clients in the form "cn=tcp/udp,cn=tcp/udp".
+func ParseClientQuotas(s string) (map[string]Quota, error) {
+	quotas := make(map[string]Quota)
+	if s == "" {
+		return quotas, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		cn, quota, ok := strings.Cut(entry, "=")
+		if !ok || cn == "" {
+			return nil, errors.New("invalid client quota " + entry)
+		}
+		q, err := ParseQuota(quota)
+		if err != nil {
+			return nil, err
+		}
+		quotas[cn] = q
+	}
+	return quotas, nil
+}
+
+func (q Quota) String() string {
+	return strconv.Itoa(q.Tcp) + "/" + strconv.Itoa(q.Udp)
+}
+
+// limit returns the quota of the network, "tcp" or "udp".
+func (q Quota) limit(network string) int {
+	if network == "udp" {
+		return q.Udp
+	}
+	return q.Tcp
+}
+
+// quota returns the quota of the client with the certificate CN, the default quota if it has none of its own.
+// The quota of a profile takes precedence.
+func (c *Config) quota(cn string) Quota {
+	if p := c.profile(cn); p != nil && p.Quota != nil {
+		return *p.Quota
+	}
+	if q, ok := c.ClientQuotas[cn]; ok {
+		return q
+	}
+	return c.DefaultQuota
+}
+
+// ParseReservedPorts parses ports reserved for single clients in the form "port=cn,port=cn".
+func ParseReservedPorts(s string) (map[int]string, error) {
+	reserved := make(map[int]string)
+	if s == "" {
+		return reserved, nil
+	}
+	for _, entry := range strings.Split(s, ",") {
+		portStr, cn, ok := strings.Cut(entry, "=")
+		port, err := strconv.Atoi(portStr)
+		if !ok || err != nil || !validPort(port) || cn == "" {
+			return nil, errors.New("invalid reserved port " + entry)
+		}
+		reserved[port] = cn
+	}
+	return reserved, nil
+}
+
+// portDenied returns why the client with the certificate CN may not expose port, or an empty string if it may.
+func (c *Config) portDenied(port int, cn string) string {
+	if c.serverPort(port) {
+		return "port reserved"
+	}
+	if inRanges(port, c.DeniedPorts) {
+		return "port denied"
+	}
+	if owner, ok := c.ReservedPorts[port]; ok && owner != cn {
+		return "port reserved for another client"
+	}
+	return ""
+}
+
+// MAXPRIVILEGEDPORT is the highest port only privileged processes can bind, unless the system lowers the limit.
+const MAXPRIVILEGEDPORT = 1023
+
+// ParsePrivilegedClients parses the certificate CNs of the clients that may expose privileged ports, in the form
+// "cn,cn". An empty string allows none.
+func ParsePrivilegedClients(s string) (map[string]bool, error) {
+	clients := make(map[string]bool)
+	if s == "" {
+		return clients, nil
+	}
+	for _, cn := range strings.Split(s, ",") {
+		if cn == "" {
+			return nil, errors.New("invalid privileged clients " + s)
+		}
+		clients[cn] = true
+	}
+	return clients, nil
+}
+
+// checkPort returns the error code and the reason why the client with the certificate CN of the tenant may not expose
+// the public port of the network, or empty strings if it may.
+func (c *Config) checkPort(port int, network string, cn string, tenant string) (string, string) {
+	if !c.ExposedPorts.Contains(port) {
+		return Utils.ERRRANGE, "port out of range"
+	}
+	if code, reason := c.checkTenant(port, tenant); code != "" {
+		return code, reason
+	}
+	if c.profileDenied(port, cn) {
+		return Utils.ERRRANGE, "port not allowed for this client"
+	}
+	if reason := c.portDenied(port, cn); reason != "" {
+		return Utils.ERRRESERVED, reason
+	}
+	if code, reason := c.checkAuthz(port, network, cn, tenant); code != "" {
+		return code, reason
+	}
+	if port <= MAXPRIVILEGEDPORT {
+		if !c.PrivilegedClients[cn] {
+			return Utils.ERRPRIVILEGED, "privileged port not allowed for this client"
+		}
+		if !canBindPrivileged(port) {
+			return Utils.ERRPRIVILEGED, "server lacks the permission to bind privileged ports (CAP_NET_BIND_SERVICE)"
+		}
+	}
+	return "", ""
+}
+
+// mayExpose reports whether the client with the certificate CN of the tenant may expose the public port of the
+// network, see checkPort.
+func (c *Config) mayExpose(port int, network string, cn string, tenant string) bool {
+	code, _ := c.checkPort(port, network, cn, tenant)
+	return code == ""
+}
+
+// hasReserved reports whether a port of the range is reserved for a client.
+func (c *Config) hasReserved(ports PortRange) bool {
+	for port := range c.ReservedPorts {
+		if ports.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientCN returns the common name of the certificate the client authenticated with, or an empty string for
+// connections without client certificate.
+func (c *ClientHandler) clientCN() string {
+	return c.identity.CN
+}
@@ -1,34 +1,110 @@
 package Server
 
+import (
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// PORTPROBATION is how long a port used by another process on the host is skipped before it is tried again.
+const PORTPROBATION = 30 * time.Second
+
+// Portqueue hands out the proxy ports, it is safe for concurrent use by the handlers of several clients.
 type Portqueue struct {
+	mu    sync.Mutex
 	ports []int
+	// size is the amount of ports of the queue, handed out or not
+	size int
+	// random hands out the ports in random order, see SetRandom
+	random bool
+	// probation holds the ports found in use by other processes, with the time they return to the queue
+	probation map[int]time.Time
 }
 
-// NewPortqueue creates a new Portqueue object with a list of ports from TCPPROXYBASE to TCPPROXYBASE+TCPPROXYAMOUNT
+// NewPortqueue creates a new Portqueue object with a list of the ports of the range, without those of the excluded ranges.
 // It functions like a queue, where GetPort returns the first port in the list and removes it from the list.
-// ReturnPort adds a port back to the list. A maximum of TCPPROXYAMOUNT ports can be used to proxy ports at a time.
+// ReturnPort adds a port back to the list. A maximum of ports.Size() ports can be used to proxy ports at a time.
 //
 // GoExpose Server works by proxying external connections to a GoExpose connection. Once the GoExpose client wants to expose a port,
 // the server will assign a proxy port to the external port.
-func NewPortqueue() *Portqueue {
+func NewPortqueue(ports PortRange, exclude ...PortRange) *Portqueue {
 	portQ := &Portqueue{
-		ports: make([]int, 0, 10),
+		ports:     make([]int, 0, ports.Size()),
+		probation: make(map[int]time.Time),
 	}
-	for i := range TCPPROXYAMOUNT {
-		portQ.ports = append(portQ.ports, TCPPROXYBASE+i)
+	for port := ports.First; port <= ports.Last; port++ {
+		if !inRanges(port, exclude) {
+			portQ.ports = append(portQ.ports, port)
+		}
 	}
+	portQ.size = len(portQ.ports)
 	return portQ
 }
 
+// Size returns the amount of ports of the queue, Available those that are neither handed out nor on probation.
+func (pq *Portqueue) Size() int {
+	return pq.size
+}
+
+func (pq *Portqueue) Available() int {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.endProbation(time.Now())
+	return len(pq.ports)
+}
+
+// GetPort returns the first port of the queue that can be bound. Ports used by other processes are put on probation
+// for PORTPROBATION instead of being handed out, so exposing fails only if no port is left.
 func (pq *Portqueue) GetPort() int {
-	if len(pq.ports) == 0 {
-		return 0
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.endProbation(time.Now())
+	for len(pq.ports) > 0 {
+		i := 0
+		if pq.random {
+			i = rand.IntN(len(pq.ports))
+		}
+		port := pq.ports[i]
+		pq.ports = append(pq.ports[:i], pq.ports[i+1:]...)
+		if portFree(port) {
+			return port
+		}
+		pq.probation[port] = time.Now().Add(PORTPROBATION)
 	}
-	port := pq.ports[0]
-	pq.ports = pq.ports[1:]
-	return port
+	return 0
+}
+
+// SetRandom makes GetPort hand out a random port of the queue instead of the first one, so the ports a client
+// is assigned are harder to predict.
+func (pq *Portqueue) SetRandom(random bool) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.random = random
 }
 
 func (pq *Portqueue) ReturnPort(port int) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
 	pq.ports = append(pq.ports, port)
 }
+
+// endProbation returns the ports whose probation ended to the queue.
+func (pq *Portqueue) endProbation(now time.Time) {
+	for port, until := range pq.probation {
+		if now.After(until) {
+			delete(pq.probation, port)
+			pq.ports = append(pq.ports, port)
+		}
+	}
+}
+
+// portFree reports whether the TCP port can be bound, by binding it for a moment.
+func portFree(port int) bool {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+	if err != nil {
+		return false
+	}
+	_ = l.Close()
+	return true
+}
@@ -0,0 +1,52 @@
+package Server
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// PPROFPATH is the path the profiles of net/http/pprof are served below, see Config.PprofAddr.
+const PPROFPATH = "/debug/pprof/"
+
+// isLoopbackAddr tells if the host of addr, host:port, is localhost or a loopback IP address.
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// servePprof serves the profiles of the runtime, e.g. the goroutines of leaking relays or read loops, on
+// Config.PprofAddr until the context is cancelled. If it can't listen, the server runs without.
+func (s *Server) servePprof(ctx context.Context) {
+	l, err := net.Listen("tcp", s.Config.PprofAddr)
+	if err != nil {
+		s.Logger.Error("Error listening for pprof", slog.String("Func", "servePprof"), slog.String("Address", s.Config.PprofAddr), "Error", err)
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(PPROFPATH, pprof.Index)
+	mux.HandleFunc(PPROFPATH+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(PPROFPATH+"profile", pprof.Profile)
+	mux.HandleFunc(PPROFPATH+"symbol", pprof.Symbol)
+	mux.HandleFunc(PPROFPATH+"trace", pprof.Trace)
+	// profiles and traces take as long as asked for with ?seconds=
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	go func() {
+		_ = server.Serve(l)
+	}()
+	s.Logger.Warn("Serving pprof, for debugging only", slog.String("Func", "servePprof"), slog.String("Address", l.Addr().String()))
+}
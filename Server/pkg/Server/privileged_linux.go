@@ -0,0 +1,36 @@
+package Server
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// CAPNETBINDSERVICE is the bit of CAP_NET_BIND_SERVICE in the capability sets of /proc/self/status.
+const CAPNETBINDSERVICE = 10
+
+// canBindPrivileged reports whether the process may bind the privileged port. That is the case for root, with the
+// effective capability CAP_NET_BIND_SERVICE, or if net.ipv4.ip_unprivileged_port_start allows everyone to bind it.
+func canBindPrivileged(port int) bool {
+	if os.Geteuid() == 0 {
+		return true
+	}
+	if start, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start"); err == nil {
+		if first, err := strconv.Atoi(strings.TrimSpace(string(start))); err == nil && port >= first {
+			return true
+		}
+	}
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		caps, ok := strings.CutPrefix(line, "CapEff:")
+		if !ok {
+			continue
+		}
+		eff, err := strconv.ParseUint(strings.TrimSpace(caps), 16, 64)
+		return err == nil && eff&(1<<CAPNETBINDSERVICE) != 0
+	}
+	return false
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package Server
+
+import "os"
+
+// canBindPrivileged reports whether the process may bind the privileged port. Without capabilities only root can,
+// on Windows os.Geteuid returns -1 and there are no privileged ports.
+func canBindPrivileged(port int) bool {
+	euid := os.Geteuid()
+	return euid == 0 || euid == -1
+}
@@ -0,0 +1,127 @@
+package Server
+
+import (
+	"Utils"
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+)
+
+// Profile holds the settings the operator chose for a single client, identified by its certificate CN. They are
+// consulted before every EXPOSE of the client, in addition to the settings of the Config for all clients.
+type Profile struct {
+	CN string
+	// Ports limits the public ports the client may expose to these ranges, which have to be in Config.ExposedPorts
+	// as well. Empty allows every exposed port.
+	Ports []PortRange
+	// DenyUdp rejects every UDP port of the client
+	DenyUdp bool
+	// BandwidthIn and BandwidthOut cap the bytes per second relayed to and from the client, across all of its ports.
+	// 0 means unlimited.
+	BandwidthIn  int64
+	BandwidthOut int64
+	// MaxConns replaces Config.MaxClientConns for the client, if not 0
+	MaxConns int
+	// Quota replaces Config.DefaultQuota and Config.ClientQuotas for the client, if set
+	Quota *Quota
+	// Adopt are the CNs of the clients whose ports the client may take over, see Utils.CTRLADOPT
+	Adopt []string
+	// Tenant assigns the client to the tenant with the name, regardless of the organizational units of its certificate
+	Tenant string
+	// AllowCountries and DenyCountries limit the external peers of all ports of the client by their country, ISO 3166
+	// codes like DE, on top of the lists of the ports, see RelayConfig.AllowCountries
+	AllowCountries []string
+	DenyCountries  []string
+}
+
+// LoadProfiles loads the profiles from a JSON file holding a list of profiles, and returns them by CN.
+// An empty path loads no profiles.
+func LoadProfiles(path string) (map[string]Profile, error) {
+	profiles := make(map[string]Profile)
+	if path == "" {
+		return profiles, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []Profile
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range list {
+		if _, ok := profiles[p.CN]; ok {
+			return nil, errors.New("duplicate profile of client " + p.CN)
+		}
+		profiles[p.CN] = p
+	}
+	return profiles, nil
+}
+
+// validate checks that the ports, bandwidth caps, the quota and the countries of the profile are valid.
+func (p *Profile) validate() error {
+	if p.CN == "" {
+		return errors.New("profile without CN")
+	}
+	for _, r := range p.Ports {
+		if !r.valid() {
+			return errors.New("invalid port range in profile of client " + p.CN)
+		}
+	}
+	if p.BandwidthIn < 0 || p.BandwidthOut < 0 {
+		return errors.New("negative bandwidth in profile of client " + p.CN)
+	}
+	if p.MaxConns < 0 {
+		return errors.New("negative connection limit in profile of client " + p.CN)
+	}
+	if p.Quota != nil && (p.Quota.Tcp < 0 || p.Quota.Udp < 0) {
+		return errors.New("negative quota in profile of client " + p.CN)
+	}
+	for _, code := range append(slices.Clip(p.AllowCountries), p.DenyCountries...) {
+		if !validCountry(code) {
+			return errors.New("invalid country " + code + " in profile of client " + p.CN)
+		}
+	}
+	return nil
+}
+
+// profile returns the profile of the client with the certificate CN, or nil if it has none.
+func (c *Config) profile(cn string) *Profile {
+	p, ok := c.Profiles[cn]
+	if !ok {
+		return nil
+	}
+	return &p
+}
+
+// checkProfile returns the error code and the reason why the profile of the client with the certificate CN doesn't
+// allow it to expose ports of the network, or empty strings if it does.
+func (c *Config) checkProfile(cn string, network string) (string, string) {
+	if p := c.profile(cn); p != nil && p.DenyUdp && network == "udp" {
+		return Utils.ERRRESERVED, "udp not allowed for this client"
+	}
+	return "", ""
+}
+
+// maxConns returns the connection limit of the client with the certificate CN, see Config.MaxClientConns.
+func (c *Config) maxConns(cn string) int {
+	if p := c.profile(cn); p != nil && p.MaxConns != 0 {
+		return p.MaxConns
+	}
+	return c.MaxClientConns
+}
+
+// mayAdopt reports whether the profile of the client with the certificate CN allows it to adopt the ports of the
+// client with the CN other.
+func (c *Config) mayAdopt(cn string, other string) bool {
+	p := c.profile(cn)
+	return p != nil && slices.Contains(p.Adopt, other)
+}
+
+// profileDenied reports whether the profile of the client with the certificate CN doesn't allow the public port.
+func (c *Config) profileDenied(port int, cn string) bool {
+	p := c.profile(cn)
+	return p != nil && len(p.Ports) > 0 && !inRanges(port, p.Ports)
+}
@@ -20,8 +20,8 @@ type Proxy struct {
 	CtrlConn net.Conn
 	NetOut   chan *in.CTRLFrame
 
-	exposedTcpPorts map[int]Relay
-	exposedUdpPorts map[int]Relay
+	exposedTcpPorts map[int]*Relay
+	exposedUdpPorts map[int]*Relay
 	proxyPorts      *Portqueue
 
 	logger *slog.Logger
@@ -34,9 +34,9 @@ func NewProxy(conn net.Conn, logger *slog.Logger) *Proxy {
 		CtrlConn: conn,
 		NetOut:   make(chan *in.CTRLFrame, 100),
 
-		exposedTcpPorts: make(map[int]Relay),
-		exposedUdpPorts: make(map[int]Relay),
-		proxyPorts:      NewPortqueue(),
+		exposedTcpPorts: make(map[int]*Relay),
+		exposedUdpPorts: make(map[int]*Relay),
+		proxyPorts:      NewPortqueue(DefaultConfig().ProxyPorts),
 		logger:          logger,
 	}
 }
@@ -59,7 +59,7 @@ func (p *Proxy) exposeTcpPreChecks(ctx context.Context, externalPort int) {
 	}
 	p.logger.Debug("Starting exposer", "Port", strconv.Itoa(externalPort))
 	portCtx, cnl := context.WithCancel(ctx)
-	p.exposedTcpPorts[externalPort] = Relay{proxyPort: proxyPort, cnl: cnl}
+	p.exposedTcpPorts[externalPort] = &Relay{externalPort: externalPort, proxyPort: proxyPort, cnl: cnl, logger: p.logger}
 	go p.runExposerForPort(portCtx, externalPort, proxyPort)
 }
 
@@ -102,12 +102,12 @@ func (p *Proxy) runExposerForPort(ctx context.Context, externalPort int, proxyPo
 			// Client has 2 seconds to connect to the proxy port
 			err = lProxy.SetDeadline(time.Now().Add(2 * time.Second))
 			if err != nil {
-				p.logger.Error("Error exposer setting deadline:", err)
+				p.logger.Error("Error exposer setting deadline", "Error", err)
 				return
 			}
 			proxConn, err := lProxy.AcceptTCP()
 			if err != nil {
-				p.logger.Error("Error exposer accepting proxy connection:", err)
+				p.logger.Error("Error exposer accepting proxy connection", "Error", err)
 				return
 			}
 
@@ -135,13 +135,15 @@ func (p *Proxy) RelayTcp(dest, src *net.TCPConn, ctx context.Context) {
 		_ = src.Close()
 	}()
 
+	bufp := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(bufp)
+	buf := *bufp
 	for {
 		select {
 		case <-ctx.Done():
 			p.logger.Debug("Context done, closing relay", "Func", "RelayTcp")
 			return
 		default:
-			var buf []byte
 			i, err := src.Read(buf)
 			if err != nil {
 				if !errors.Is(err, io.EOF) {
@@ -174,7 +176,7 @@ func (p *Proxy) ctrlOutgoing(ctx context.Context) {
 				p.logger.Debug("Sending frame to ctrlConn", "Func", "ctrlOutgoing", "Frame type", fr.Typ, "Data", fr.Data[0])
 				err := in.WriteFrame(p.CtrlConn, fr)
 				if err != nil {
-					p.logger.Error("Error writing frame:", err)
+					p.logger.Error("Error writing frame", "Error", err)
 					return
 				}
 				if fr.Typ == in.CTRLUNPAIR {
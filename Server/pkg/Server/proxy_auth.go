@@ -0,0 +1,69 @@
+package Server
+
+import (
+	"Utils"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// PROXYTOKENTTL is how long a token sent in a CTRLCONNECT frame can be redeemed by a proxy connection.
+const PROXYTOKENTTL = 30 * time.Second
+
+// PROXYAUTHTIMEOUT is how long a new proxy connection has to present its token.
+const PROXYAUTHTIMEOUT = 5 * time.Second
+
+// issueToken creates the one-time token for the next proxy connection requested from the client.
+// Tokens that were never redeemed are dropped once they expire.
+func (r *Relay) issueToken() (string, error) {
+	token, err := Utils.NewProxyToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	r.tokensMu.Lock()
+	defer r.tokensMu.Unlock()
+	for t, issued := range r.tokens {
+		if now.Sub(issued) > PROXYTOKENTTL {
+			delete(r.tokens, t)
+		}
+	}
+	r.tokens[token] = now
+	return token, nil
+}
+
+// redeemToken reports whether the token was issued by the relay and has not expired. A token can only be redeemed once.
+func (r *Relay) redeemToken(token string) bool {
+	r.tokensMu.Lock()
+	defer r.tokensMu.Unlock()
+	issued, ok := r.tokens[token]
+	if !ok {
+		return false
+	}
+	delete(r.tokens, token)
+	return time.Since(issued) <= PROXYTOKENTTL
+}
+
+// admitProxyConn reads the token of a new proxy connection and parks the connection in the idle channel if the
+// token is valid. Connections not presenting a valid token within PROXYAUTHTIMEOUT are closed.
+func (r *Relay) admitProxyConn(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(PROXYAUTHTIMEOUT))
+	token, err := Utils.ReadProxyToken(conn)
+	if err != nil {
+		r.logger.Error("Error reading proxy token", slog.String("Func", "admitProxyConn"), "Error", err)
+		_ = conn.Close()
+		return
+	}
+	if !r.redeemToken(token) {
+		r.logger.Error("Rejected proxy connection with invalid token", slog.String("Func", "admitProxyConn"))
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	select {
+	case r.idle <- conn:
+	default:
+		// the client connected more often than asked to
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,322 @@
+package Server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Versions of the PROXY protocol, see RelayConfig.ProxyProtocol and
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	PROXYV1 = "v1"
+	PROXYV2 = "v2"
+)
+
+// PROXYHEADERTIMEOUT is how long a load balancer of Config.ProxyProtocolFrom has to send the PROXY header of a
+// connection.
+const PROXYHEADERTIMEOUT = 5 * time.Second
+
+// proxyV2Signature starts the binary header of version 2, the header of version 1 starts with "PROXY ".
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Longest PROXY headers accepted, the one of version 1 and the addresses and TLVs of version 2.
+const (
+	maxProxyV1Header = 107
+	maxProxyV2Length = 512
+)
+
+// proxyHeader returns the PROXY header of the version announcing a connection from src to dst. Addresses other than
+// TCP ones of the same family are announced as unknown.
+func proxyHeader(version string, src net.Addr, dst net.Addr) []byte {
+	srcTCP, srcOk := src.(*net.TCPAddr)
+	dstTCP, dstOk := dst.(*net.TCPAddr)
+	var srcAddr, dstAddr netip.AddrPort
+	if srcOk && dstOk {
+		srcAddr, dstAddr = srcTCP.AddrPort(), dstTCP.AddrPort()
+		srcAddr = netip.AddrPortFrom(srcAddr.Addr().Unmap(), srcAddr.Port())
+		dstAddr = netip.AddrPortFrom(dstAddr.Addr().Unmap(), dstAddr.Port())
+	}
+	known := srcAddr.IsValid() && dstAddr.IsValid() && srcAddr.Addr().Is4() == dstAddr.Addr().Is4()
+	if version == PROXYV1 {
+		if !known {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		family := "TCP4"
+		if srcAddr.Addr().Is6() {
+			family = "TCP6"
+		}
+		return []byte("PROXY " + family + " " + srcAddr.Addr().String() + " " + dstAddr.Addr().String() + " " +
+			strconv.Itoa(int(srcAddr.Port())) + " " + strconv.Itoa(int(dstAddr.Port())) + "\r\n")
+	}
+	header := append([]byte{}, proxyV2Signature...)
+	// version 2, PROXY command
+	header = append(header, 0x21)
+	if !known {
+		return append(header, 0x00, 0, 0)
+	}
+	addresses := append(srcAddr.Addr().AsSlice(), dstAddr.Addr().AsSlice()...)
+	addresses = binary.BigEndian.AppendUint16(addresses, srcAddr.Port())
+	addresses = binary.BigEndian.AppendUint16(addresses, dstAddr.Port())
+	// TCP over IPv4 or IPv6
+	family := byte(0x11)
+	if srcAddr.Addr().Is6() {
+		family = 0x21
+	}
+	header = append(header, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+// readProxyHeader reads the PROXY header of version 1 or 2 the connection starts with, and returns the addresses of
+// the connection it announces. Both are nil for connections of the load balancer itself and those of unknown
+// protocols. Nothing past the header is read, the caller sets the deadline of the connection.
+func readProxyHeader(conn net.Conn) (net.Addr, net.Addr, error) {
+	start := make([]byte, len(proxyV2Signature))
+	_, err := io.ReadFull(conn, start[:6])
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(start[:6]) == "PROXY " {
+		return readProxyV1(conn)
+	}
+	_, err = io.ReadFull(conn, start[6:])
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(start, proxyV2Signature) {
+		return nil, nil, errors.New("no PROXY header")
+	}
+	return readProxyV2(conn)
+}
+
+// readProxyV1 reads the rest of a header of version 1, byte by byte, so nothing past it is read.
+func readProxyV1(conn net.Conn) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, maxProxyV1Header)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == maxProxyV1Header-6 {
+			return nil, nil, errors.New("PROXY header too long")
+		}
+		_, err := conn.Read(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) > 0 && fields[0] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, nil, errors.New("malformed PROXY header")
+	}
+	src, srcErr := netip.ParseAddr(fields[1])
+	dst, dstErr := netip.ParseAddr(fields[2])
+	srcPort, srcPortErr := strconv.ParseUint(fields[3], 10, 16)
+	dstPort, dstPortErr := strconv.ParseUint(fields[4], 10, 16)
+	if srcErr != nil || dstErr != nil || srcPortErr != nil || dstPortErr != nil || src.Is4() != (fields[0] == "TCP4") {
+		return nil, nil, errors.New("malformed PROXY header")
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, uint16(srcPort))),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, uint16(dstPort))), nil
+}
+
+// readProxyV2 reads the rest of a header of version 2 after its signature, TLVs are skipped.
+func readProxyV2(conn net.Conn) (net.Addr, net.Addr, error) {
+	head := make([]byte, 4)
+	_, err := io.ReadFull(conn, head)
+	if err != nil {
+		return nil, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(head[2:]))
+	if head[0]>>4 != 2 || length > maxProxyV2Length {
+		return nil, nil, errors.New("malformed PROXY header")
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(conn, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	// LOCAL command, e.g. health checks of the load balancer
+	if head[0]&0x0f == 0 {
+		return nil, nil, nil
+	}
+	var size int
+	switch head[1] {
+	case 0x11:
+		size = 4
+	case 0x21:
+		size = 16
+	default:
+		return nil, nil, nil
+	}
+	if length < 2*size+4 {
+		return nil, nil, errors.New("malformed PROXY header")
+	}
+	src, _ := netip.AddrFromSlice(body[:size])
+	dst, _ := netip.AddrFromSlice(body[size : 2*size])
+	srcPort := binary.BigEndian.Uint16(body[2*size:])
+	dstPort := binary.BigEndian.Uint16(body[2*size+2:])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, srcPort)), net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, dstPort)), nil
+}
+
+// proxiedConn is a connection of a load balancer of Config.ProxyProtocolFrom, its addresses are the ones the PROXY
+// header announced.
+type proxiedConn struct {
+	*net.TCPConn
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// acceptProxied reads the PROXY header of the connection if it comes from an address of the prefixes, and returns the
+// connection with the addresses it announced. Other connections are returned as they are.
+func acceptProxied(conn *net.TCPConn, from []netip.Prefix) (net.Conn, error) {
+	if !fromPrefixes(conn.RemoteAddr(), from) {
+		return conn, nil
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(PROXYHEADERTIMEOUT))
+	src, dst, err := readProxyHeader(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if src == nil {
+		return conn, nil
+	}
+	return &proxiedConn{TCPConn: conn, remote: src, local: dst}, nil
+}
+
+// fromPrefixes reports whether the IP of the address is in one of the prefixes.
+func fromPrefixes(addr net.Addr, prefixes []netip.Prefix) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || len(prefixes) == 0 {
+		return false
+	}
+	ip := tcpAddr.AddrPort().Addr().Unmap()
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyPrefixes returns the prefixes of Config.ProxyProtocolFrom, single addresses as prefixes of their full length.
+func (c *Config) proxyPrefixes() ([]netip.Prefix, error) {
+	return parsePrefixes(c.ProxyProtocolFrom, "PROXY protocol source")
+}
+
+// parsePrefixes parses IP addresses and prefixes, single addresses as prefixes of their full length. kind names them
+// in the error.
+func parsePrefixes(values []string, kind string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		if addr, err := netip.ParseAddr(value); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, errors.New("invalid " + kind + " " + value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// proxiedListener reads the PROXY headers of the connections of the load balancers of Config.ProxyProtocolFrom, see
+// the HTTP front. Headers are read on the first use of a connection, so a slow load balancer doesn't hold up Accept.
+type proxiedListener struct {
+	net.Listener
+	from func() []netip.Prefix
+}
+
+func (l *proxiedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || !fromPrefixes(conn.RemoteAddr(), l.from()) {
+		return conn, nil
+	}
+	return &lazyProxiedConn{TCPConn: tcpConn}, nil
+}
+
+// lazyProxiedConn reads its PROXY header before it is first read from or its addresses are asked for, within
+// PROXYHEADERTIMEOUT. The read deadline set before is restored afterwards. A connection with a malformed header fails
+// to read.
+type lazyProxiedConn struct {
+	*net.TCPConn
+	once   sync.Once
+	err    error
+	remote net.Addr
+	local  net.Addr
+	// mu guards deadline, the read deadline set by the user of the connection
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *lazyProxiedConn) readHeader() {
+	c.once.Do(func() {
+		_ = c.TCPConn.SetReadDeadline(time.Now().Add(PROXYHEADERTIMEOUT))
+		c.remote, c.local, c.err = readProxyHeader(c.TCPConn)
+		c.mu.Lock()
+		_ = c.TCPConn.SetReadDeadline(c.deadline)
+		c.mu.Unlock()
+		if c.err != nil {
+			_ = c.TCPConn.Close()
+		}
+		if c.remote == nil {
+			c.remote, c.local = c.TCPConn.RemoteAddr(), c.TCPConn.LocalAddr()
+		}
+	})
+}
+
+func (c *lazyProxiedConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.TCPConn.SetDeadline(t)
+}
+
+func (c *lazyProxiedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.TCPConn.SetReadDeadline(t)
+}
+
+func (c *lazyProxiedConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.TCPConn.Read(b)
+}
+
+func (c *lazyProxiedConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remote
+}
+
+func (c *lazyProxiedConn) LocalAddr() net.Addr {
+	c.readHeader()
+	return c.local
+}
@@ -0,0 +1,38 @@
+package Server
+
+// QUICMAXCIDLEN is the maximum length of a QUIC connection ID, RFC 9000 section 17.2.
+const QUICMAXCIDLEN = 20
+
+// quicLongHeaderIDs returns the destination and source connection IDs of a QUIC long header packet.
+// ok is false if the datagram is not a well-formed long header packet.
+func quicLongHeaderIDs(packet []byte) (dcid []byte, scid []byte, ok bool) {
+	// header form bit, 4 byte version, DCID length
+	if len(packet) < 6 || packet[0]&0x80 == 0 {
+		return nil, nil, false
+	}
+	i := 5
+	dcidLen := int(packet[i])
+	i++
+	if dcidLen > QUICMAXCIDLEN || len(packet) < i+dcidLen+1 {
+		return nil, nil, false
+	}
+	dcid = packet[i : i+dcidLen]
+	i += dcidLen
+	scidLen := int(packet[i])
+	i++
+	if scidLen > QUICMAXCIDLEN || len(packet) < i+scidLen {
+		return nil, nil, false
+	}
+	scid = packet[i : i+scidLen]
+	return dcid, scid, true
+}
+
+// quicShortHeaderDCID returns the destination connection ID of a QUIC short header packet, assuming it has length
+// cidLen. Short headers don't carry the length, the endpoint that chose the ID knows it.
+func quicShortHeaderDCID(packet []byte, cidLen int) ([]byte, bool) {
+	// header form bit unset, fixed bit set
+	if len(packet) < 1+cidLen || packet[0]&0xc0 != 0x40 {
+		return nil, false
+	}
+	return packet[1 : 1+cidLen], true
+}
@@ -0,0 +1,123 @@
+package Server
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// RATELIMITSOURCES is the maximum amount of source IPs a rate limit keeps track of. Once reached, sources that are
+// within their rate again are forgotten, and new sources are refused while none is.
+const RATELIMITSOURCES = 4096
+
+// tokenBucket holds up to a second worth of new connections of a rate, so short bursts pass and floods are smoothed
+// out to the rate.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take refills the bucket for the time passed at rate per second and takes a token, if there is one.
+func (b *tokenBucket) take(rate int, now time.Time) bool {
+	b.refill(rate, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) refill(rate int, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = float64(rate)
+	} else {
+		b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*float64(rate), float64(rate))
+	}
+	b.last = now
+}
+
+// full reports whether the bucket is refilled completely by now, it then holds no more than a new one.
+func (b *tokenBucket) full(rate int, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*float64(rate) >= float64(rate)
+}
+
+// rateLimit caps the new connections per second, of all sources at rate and of a single source IP at perSource,
+// see Config.ConnRate. A rate of 0 doesn't limit. A nil rateLimit limits nothing.
+type rateLimit struct {
+	mu        sync.Mutex
+	rate      int
+	perSource int
+	global    tokenBucket
+	sources   map[netip.Addr]*tokenBucket
+}
+
+func newRateLimit(rate int, perSource int) *rateLimit {
+	return &rateLimit{rate: rate, perSource: perSource, sources: make(map[netip.Addr]*tokenBucket)}
+}
+
+// setRates changes the rates, the tokens saved up so far are kept up to the new rates.
+func (l *rateLimit) setRates(rate int, perSource int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.perSource = perSource
+	if perSource == 0 {
+		clear(l.sources)
+	}
+}
+
+// allow counts a new connection of the peer and reports whether it is within the rates. Peers without IP are
+// only limited by the rate of all sources.
+func (l *rateLimit) allow(peer net.Addr) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var source *tokenBucket
+	if ip, ok := peerIP(peer); ok && l.perSource > 0 {
+		source = l.sources[ip]
+		if source == nil {
+			if len(l.sources) >= RATELIMITSOURCES {
+				l.forget(now)
+			}
+			if len(l.sources) >= RATELIMITSOURCES {
+				return false
+			}
+			source = new(tokenBucket)
+			l.sources[ip] = source
+		}
+		source.refill(l.perSource, now)
+		if source.tokens < 1 {
+			return false
+		}
+	}
+	if l.rate > 0 && !l.global.take(l.rate, now) {
+		return false
+	}
+	if source != nil {
+		source.tokens--
+	}
+	return true
+}
+
+// forget drops the sources that are within their rate again, they start over with a full bucket.
+func (l *rateLimit) forget(now time.Time) {
+	for ip, b := range l.sources {
+		if b.full(l.perSource, now) {
+			delete(l.sources, ip)
+		}
+	}
+}
+
+// admitRate counts a new connection or UDP session of the peer with the rate limit of the relay. If it is beyond,
+// the connection is counted as rejected and false is returned.
+func (r *Relay) admitRate(peer net.Addr) bool {
+	if r.rateLimit.allow(peer) {
+		return true
+	}
+	r.stats.Rejected.Add(1)
+	return false
+}
@@ -0,0 +1,382 @@
+package Server
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Tunnel is a port exposed by a client.
+type Tunnel struct {
+	Network    string
+	Port       int
+	PublicPort int
+	// Name is the name the client gave the port, empty if unnamed
+	Name string
+	// Host is the hostname the port is exposed under, see Config.HTTPAddr, empty if it has a public port. Path is
+	// the path prefix of the requests routed to it.
+	Host string
+	Path string
+	// stats are the traffic counters of the relay of the port, inspector keeps its requests, see InspectedRequests.
+	// relay is the relay itself, for its half-closed connections and their stacks, see stuckStacks.
+	stats     *RelayStats
+	inspector *requestInspector
+	relay     *Relay
+}
+
+// ClientInfo describes a connected client.
+type ClientInfo struct {
+	// ID tells apart the connections of clients with the same identity
+	ID        uint64
+	Identity  ClientIdentity
+	Address   string
+	Connected time.Time
+	Tunnels   []Tunnel
+	// Suspended is set while the control connection of the client is lost and the session waits to be resumed
+	Suspended bool
+}
+
+// Registry tracks the connected clients of a Server with their tunnels, so admins can see who exposes what.
+// The zero value is an empty registry, a nil Registry tracks nothing. It is safe for concurrent use.
+type Registry struct {
+	mu      sync.Mutex
+	nextID  uint64
+	clients map[uint64]*registeredClient
+	// handingOver holds the clients unregistered for another session to take over their ports, until their session ended
+	handingOver map[uint64]*registeredClient
+	// retired sums the traffic counters of the ports no longer exposed, see totals
+	retired relayTotals
+}
+
+// registeredClient is a connected client. takeover asks its session to hand over its public ports, done is closed
+// once the session ended, see Config.DuplicateSessions. A suspended session is continued by sending the connection
+// presenting token on resume, see Config.ResumeGrace.
+type registeredClient struct {
+	info     ClientInfo
+	takeover chan<- takeoverRequest
+	done     chan struct{}
+	token    string
+	resume   chan<- resumption
+	admin    chan<- adminRequest
+	conns    *connLimit
+}
+
+// add registers a connected client and returns its ID.
+func (r *Registry) add(identity ClientIdentity, address string) uint64 {
+	id, _, _ := r.admit(identity, address, DUPLICATEALLOW, nil)
+	return id
+}
+
+// admit registers a connected client according to the duplicate session policy and returns its ID. With
+// DUPLICATEREFUSE it fails if a client with the same CN is connected already. With DUPLICATEREPLACE those clients
+// are unregistered at once and their sessions returned, the caller takes them over, see takeOver.
+// Clients without CN are never duplicates.
+func (r *Registry) admit(identity ClientIdentity, address string, policy string, takeover chan<- takeoverRequest) (uint64, []*registeredClient, error) {
+	if r == nil {
+		return 0, nil, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clients == nil {
+		r.clients = make(map[uint64]*registeredClient)
+	}
+	var replaced []*registeredClient
+	if identity.CN != "" && policy != DUPLICATEALLOW {
+		for id, client := range r.clients {
+			// a suspended session may be the one the client is about to resume, it ends with its grace window otherwise
+			if client.info.Identity.CN != identity.CN || client.info.Suspended {
+				continue
+			}
+			if policy == DUPLICATEREFUSE {
+				return 0, nil, errors.New("client " + identity.CN + " is already connected")
+			}
+			replaced = append(replaced, client)
+			r.handOverLocked(id, client)
+		}
+	}
+	r.nextID++
+	r.clients[r.nextID] = &registeredClient{
+		info:     ClientInfo{ID: r.nextID, Identity: identity, Address: address, Connected: time.Now()},
+		takeover: takeover,
+		done:     make(chan struct{}),
+	}
+	return r.nextID, replaced, nil
+}
+
+// remove unregisters a client once its session ended.
+func (r *Registry) remove(id uint64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client, ok := r.clients[id]; ok {
+		r.retired.addTunnels(client.info.Tunnels)
+		close(client.done)
+		delete(r.clients, id)
+	}
+	if client, ok := r.handingOver[id]; ok {
+		r.retired.addTunnels(client.info.Tunnels)
+		close(client.done)
+		delete(r.handingOver, id)
+	}
+}
+
+// adopt unregisters the sessions of the client with the CN, including suspended ones, and returns them. The client
+// with id takes over their ports, see ClientHandler.adopt. It fails if the client with id is being taken over itself,
+// so two clients adopting each other don't wait for each other.
+func (r *Registry) adopt(id uint64, cn string) ([]*registeredClient, error) {
+	if r == nil {
+		return nil, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.clients[id]; !ok {
+		return nil, errors.New("session is being taken over")
+	}
+	var adopted []*registeredClient
+	for other, client := range r.clients {
+		if client.info.Identity.CN == cn && other != id {
+			adopted = append(adopted, client)
+			r.handOverLocked(other, client)
+		}
+	}
+	return adopted, nil
+}
+
+// handOverLocked unregisters a client whose ports another session takes over. Its done channel is still closed once
+// its session ended, see remove. r.mu must be held.
+func (r *Registry) handOverLocked(id uint64, client *registeredClient) {
+	if r.handingOver == nil {
+		r.handingOver = make(map[uint64]*registeredClient)
+	}
+	delete(r.clients, id)
+	r.handingOver[id] = client
+}
+
+// setResumable lets the session of the client be resumed with the token, see claim.
+func (r *Registry) setResumable(id uint64, token string, resume chan<- resumption) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client, ok := r.clients[id]; ok {
+		client.token = token
+		client.resume = resume
+	}
+}
+
+// setAdmin lets admins disconnect the client and hide its ports through its session, see request.
+func (r *Registry) setAdmin(id uint64, admin chan<- adminRequest) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client, ok := r.clients[id]; ok {
+		client.admin = admin
+	}
+}
+
+// setConns sets the cap of the relayed connections of the client, see limitConns.
+func (r *Registry) setConns(id uint64, conns *connLimit) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client, ok := r.clients[id]; ok {
+		client.conns = conns
+	}
+}
+
+// limitConns caps the relayed connections of the connected clients as the config sets.
+func (r *Registry) limitConns(config *Config) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, client := range r.clients {
+		if client.conns != nil {
+			client.conns.setMax(config.maxConns(client.info.Identity.CN))
+		}
+	}
+}
+
+// request passes the request of an admin to the session of the client and returns its answer.
+func (r *Registry) request(id uint64, req adminRequest) error {
+	if r == nil {
+		return errors.New("no registry")
+	}
+	r.mu.Lock()
+	client, ok := r.clients[id]
+	var admin chan<- adminRequest
+	if ok {
+		admin = client.admin
+	}
+	r.mu.Unlock()
+	if admin == nil {
+		return ErrNoClient
+	}
+	req.reply = make(chan error, 1)
+	select {
+	case admin <- req:
+	case <-client.done:
+		return ErrNoClient
+	}
+	return <-req.reply
+}
+
+// suspend marks the session of the client as waiting to be resumed.
+func (r *Registry) suspend(id uint64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client, ok := r.clients[id]; ok {
+		client.info.Suspended = true
+	}
+}
+
+// claim returns the suspended session of the client with the CN and the resume token, or nil if there is none.
+// The session is no longer suspended afterwards, so it doesn't expire while the caller hands over its connection
+// from the address.
+func (r *Registry) claim(token string, cn string, address string) *registeredClient {
+	if r == nil || token == "" {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, client := range r.clients {
+		if !client.info.Suspended || client.info.Identity.CN != cn || client.resume == nil {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(client.token), []byte(token)) == 1 {
+			client.info.Suspended = false
+			client.info.Address = address
+			return client
+		}
+	}
+	return nil
+}
+
+// expire reports whether the grace window of a suspended session may end it, which is not the case once it was claimed.
+func (r *Registry) expire(id uint64) bool {
+	if r == nil {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client, ok := r.clients[id]
+	return !ok || client.info.Suspended
+}
+
+// addTunnel records a port the client exposed.
+func (r *Registry) addTunnel(id uint64, tunnel Tunnel) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client, ok := r.clients[id]; ok {
+		client.info.Tunnels = append(client.info.Tunnels, tunnel)
+	}
+}
+
+// removeTunnel forgets a port the client hid.
+func (r *Registry) removeTunnel(id uint64, network string, port int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client, ok := r.clients[id]; ok {
+		client.info.Tunnels = slices.DeleteFunc(client.info.Tunnels, func(t Tunnel) bool {
+			if t.Network == network && t.Port == port {
+				r.retired.add(t.stats)
+				return true
+			}
+			return false
+		})
+	}
+}
+
+// Clients returns a snapshot of the connected clients, in the order they connected.
+func (r *Registry) Clients() []ClientInfo {
+	return r.find(func(*ClientInfo) bool { return true })
+}
+
+// ByCN returns the connected clients with the certificate CN, a client can be connected more than once.
+func (r *Registry) ByCN(cn string) []ClientInfo {
+	return r.find(func(client *ClientInfo) bool { return client.Identity.CN == cn })
+}
+
+// ByTenant returns the connected clients of the tenant with the name, see Config.Tenants.
+func (r *Registry) ByTenant(tenant string) []ClientInfo {
+	return r.find(func(client *ClientInfo) bool { return client.Identity.Tenant == tenant })
+}
+
+// tenantTunnels returns the amount of ports of the network all connected clients of the tenant expose.
+func (r *Registry) tenantTunnels(tenant string, network string) int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, client := range r.clients {
+		if client.info.Identity.Tenant != tenant {
+			continue
+		}
+		for _, t := range client.info.Tunnels {
+			if t.Network == network {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// totals returns the traffic counters of all ports exposed since the registry was created.
+func (r *Registry) totals() relayTotals {
+	if r == nil {
+		return relayTotals{}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	totals := r.retired
+	for _, client := range r.clients {
+		totals.addTunnels(client.info.Tunnels)
+	}
+	for _, client := range r.handingOver {
+		totals.addTunnels(client.info.Tunnels)
+	}
+	return totals
+}
+
+// find returns copies of the clients matching, in the order they connected.
+func (r *Registry) find(match func(*ClientInfo) bool) []ClientInfo {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients := make([]ClientInfo, 0, len(r.clients))
+	for _, client := range r.clients {
+		if match(&client.info) {
+			info := client.info
+			info.Tunnels = slices.Clone(client.info.Tunnels)
+			clients = append(clients, info)
+		}
+	}
+	slices.SortFunc(clients, func(a, b ClientInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return clients
+}
@@ -1,12 +1,1007 @@
 package Server
 
-import "context"
+import (
+	"Utils"
+	"container/list"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
 
+// MAXWARMPOOL is the maximum amount of pre-established proxy connections a client can request for a single relay.
+const MAXWARMPOOL = 8
+
+// DEFAULTWARMPOOL is the amount of pre-established proxy connections of a relay, if the client doesn't choose one.
+// Further proxy connections are requested on demand, see takeProxyConn.
+const DEFAULTWARMPOOL = 2
+
+// MINMTU is the smallest MTU a client can configure for a UDP relay, the minimum MTU of IPv4.
+const MINMTU = 68
+
+// relayBufferSize is the size of the buffers used to copy data between relayed connections.
+const relayBufferSize = 32 * 1024
+
+// bufferPool holds the copy buffers of all relays. Buffers are taken for the lifetime of a relayed connection and
+// returned afterwards, so hundreds of concurrent connections don't allocate a new buffer each.
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, relayBufferSize)
+		return &buf
+	},
+}
+
+// RelayConfig holds the parameters of a Relay that the client can choose in its EXPOSE frame.
+// The config of a running relay can be replaced with reconfigure, without dropping its connections.
+type RelayConfig struct {
+	// PoolSize is the amount of warm proxy connections the relay keeps ready, 0 disables the warm pool
+	PoolSize int
+	// SessionTimeout is the time after which idle UDP sessions are expired
+	SessionTimeout time.Duration
+	// MaxSessions is the maximum amount of UDP sessions, 0 means unlimited. It is set by the server, not the client.
+	MaxSessions int
+	// MTU is the largest UDP datagram relayed as a whole, 0 means unlimited. Larger datagrams are dropped and counted,
+	// or split into fragments on the proxy connection if Fragment is set. Both apply to sessions created after a change.
+	MTU      int
+	Fragment bool
+	// QuicAffinity routes UDP datagrams by their QUIC connection ID before their peer address,
+	// so QUIC connections keep their session when the peer migrates to another address, see QUICMIGRATEDATAGRAMS
+	QuicAffinity bool
+	// Inline carries the relayed connections in CTRLDATA frames on the control connection instead of proxy connections,
+	// see ClientHandler.inlineMux. It can't be changed by reconfigure.
+	Inline bool
+	// PublicPort is the port the relay listens on, if the client asked for another one than its own.
+	// AnyPort lets the server choose a free port of the exposed range. Neither can be changed by reconfigure.
+	PublicPort int
+	AnyPort    bool
+	// Name identifies the exposed port among those of the client, so it can be hidden and found in stats without
+	// its port number. It is unique per client and can't be changed by reconfigure, empty if the port is unnamed.
+	Name string
+	// Host is the hostname the HTTP front routes requests of to the port instead of a public port, see
+	// Config.HTTPAddr. It can't be changed by reconfigure, empty if the port has a public port.
+	Host string
+	// Path is the path prefix of the requests of the Host routed to the port, "/" for all of them. It can't be changed
+	// by reconfigure. StripPath removes the prefix from the requests passed on.
+	Path      string
+	StripPath bool
+	// Headers are the rules the HTTP front applies to the requests and responses of the port in order, NoForwarded
+	// leaves the X-Forwarded headers out of the requests. Both need a Host.
+	Headers     []HeaderRule
+	NoForwarded bool
+	// BasicAuth are the users that may visit the port with basic authentication, OIDC the visitors that may after
+	// logging in with the OIDC provider of the server, see oidcAllows. A visitor needs to satisfy either, the port is
+	// open to all if both are empty. Both need a Host.
+	BasicAuth []BasicCredential
+	OIDC      []string
+	// Errors is the format of the error responses of the HTTP front for the port, ERRORSAUTO if empty. Inspect keeps
+	// the recent requests of the port, see InspectedRequests. Cache serves GET responses of the port from the
+	// response cache of the server. All need a Host.
+	Errors  string
+	Inspect bool
+	Cache   bool
+	// ProxyProtocol is the version of the PROXY header sent to the service of the client ahead of the data of each
+	// relayed connection, PROXYV1 or PROXYV2, announcing the external peer. Empty sends none. Only TCP ports with a
+	// public port can send one.
+	ProxyProtocol string
+	// Allow and Deny are the IPs and prefixes of the public peers that may and may not connect to the port, checked
+	// before a connection, UDP session or request of the HTTP front is paired, see admits. Empty lists let all in.
+	Allow []netip.Prefix
+	Deny  []netip.Prefix
+	// AllowCountries and DenyCountries are the ISO 3166 codes of the countries of the public peers that may and may
+	// not connect to the port, looked up in Config.GeoIPFile. Peers of unknown country only pass empty allow lists.
+	AllowCountries []string
+	DenyCountries  []string
+	// PeerConns caps the connections and UDP sessions a single public IP holds on the port at a time, 0 means
+	// unlimited, see acquirePeer
+	PeerConns int
+	// Compress is the preset the relayed connections of a TCP port are compressed with on their proxy connections,
+	// see Utils.CompressedConn. Empty leaves them uncompressed. It can't be changed by reconfigure.
+	Compress string
+}
+
+// parseRelayConfig parses the options of an EXPOSE frame. Options are key=value pairs, unknown keys are rejected.
+func parseRelayConfig(options []string) (*RelayConfig, error) {
+	cfg := &RelayConfig{
+		PoolSize:       DEFAULTWARMPOOL,
+		SessionTimeout: DEFAULTUDPTIMEOUT,
+	}
+	for _, opt := range options {
+		key, value, ok := strings.Cut(opt, "=")
+		if !ok {
+			return nil, errors.New("malformed option " + opt)
+		}
+		switch key {
+		case "pool":
+			size, err := strconv.Atoi(value)
+			if err != nil || size < 0 || size > MAXWARMPOOL {
+				return nil, errors.New("invalid pool size " + value)
+			}
+			cfg.PoolSize = size
+		case "timeout":
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return nil, errors.New("invalid session timeout " + value)
+			}
+			cfg.SessionTimeout = time.Duration(seconds) * time.Second
+		case "compress":
+			if value == "off" {
+				cfg.Compress = ""
+				continue
+			}
+			if _, ok := Utils.CompressionDictionary(value); !ok {
+				return nil, errors.New("invalid compress " + value)
+			}
+			cfg.Compress = value
+		case "peerconns":
+			conns, err := strconv.Atoi(value)
+			if err != nil || conns < 0 {
+				return nil, errors.New("invalid peer connection limit " + value)
+			}
+			cfg.PeerConns = conns
+		case "mtu":
+			mtu, err := strconv.Atoi(value)
+			if err != nil || mtu < MINMTU || mtu > Utils.MAXDATAGRAM {
+				return nil, errors.New("invalid mtu " + value)
+			}
+			cfg.MTU = mtu
+		case "oversize":
+			switch value {
+			case "drop":
+				cfg.Fragment = false
+			case "fragment":
+				cfg.Fragment = true
+			default:
+				return nil, errors.New("invalid oversize policy " + value)
+			}
+		case "affinity":
+			switch value {
+			case "addr":
+				cfg.QuicAffinity = false
+			case "quic":
+				cfg.QuicAffinity = true
+			default:
+				return nil, errors.New("invalid affinity " + value)
+			}
+		case "transport":
+			switch value {
+			case "proxy":
+				cfg.Inline = false
+			case "inline":
+				cfg.Inline = true
+			default:
+				return nil, errors.New("invalid transport " + value)
+			}
+		case "public":
+			if value == "any" {
+				cfg.AnyPort = true
+				continue
+			}
+			port, err := strconv.Atoi(value)
+			if err != nil || !validPort(port) {
+				return nil, errors.New("invalid public port " + value)
+			}
+			cfg.PublicPort = port
+		case "name":
+			if !validTunnelName(value) {
+				return nil, errors.New("invalid name " + value)
+			}
+			cfg.Name = value
+		case "host":
+			host := strings.TrimSuffix(strings.ToLower(value), ".")
+			if !validHostname(host) {
+				return nil, errors.New("invalid host " + value)
+			}
+			cfg.Host = host
+		case "path":
+			path := value
+			if len(path) > 1 {
+				path = strings.TrimSuffix(path, "/")
+			}
+			if !validRoutePath(path) {
+				return nil, errors.New("invalid path " + value)
+			}
+			cfg.Path = path
+		case "strip":
+			switch value {
+			case "on":
+				cfg.StripPath = true
+			case "off":
+				cfg.StripPath = false
+			default:
+				return nil, errors.New("invalid strip " + value)
+			}
+		case "header", "respheader":
+			if len(cfg.Headers) == MAXHEADERRULES {
+				return nil, errors.New("more than " + strconv.Itoa(MAXHEADERRULES) + " header rules")
+			}
+			rule, err := parseHeaderRule(value, key == "respheader")
+			if err != nil {
+				return nil, err
+			}
+			cfg.Headers = append(cfg.Headers, rule)
+		case "basicauth":
+			if len(cfg.BasicAuth) == MAXAUTHRULES {
+				return nil, errors.New("more than " + strconv.Itoa(MAXAUTHRULES) + " basic auth credentials")
+			}
+			credential, err := parseBasicCredential(value)
+			if err != nil {
+				return nil, err
+			}
+			cfg.BasicAuth = append(cfg.BasicAuth, credential)
+		case "oidc":
+			rule := strings.ToLower(value)
+			if len(cfg.OIDC) == MAXAUTHRULES || !validOIDCRule(rule) {
+				return nil, errors.New("invalid oidc rule " + value)
+			}
+			cfg.OIDC = append(cfg.OIDC, rule)
+		case "forwarded":
+			switch value {
+			case "on":
+				cfg.NoForwarded = false
+			case "off":
+				cfg.NoForwarded = true
+			default:
+				return nil, errors.New("invalid forwarded " + value)
+			}
+		case "inspect":
+			switch value {
+			case "on":
+				cfg.Inspect = true
+			case "off":
+				cfg.Inspect = false
+			default:
+				return nil, errors.New("invalid inspect " + value)
+			}
+		case "proxyprotocol":
+			switch value {
+			case PROXYV1, PROXYV2:
+				cfg.ProxyProtocol = value
+			case "off":
+				cfg.ProxyProtocol = ""
+			default:
+				return nil, errors.New("invalid proxyprotocol " + value)
+			}
+		case "cache":
+			switch value {
+			case "on":
+				cfg.Cache = true
+			case "off":
+				cfg.Cache = false
+			default:
+				return nil, errors.New("invalid cache " + value)
+			}
+		case "allow", "deny":
+			list := &cfg.Allow
+			if key == "deny" {
+				list = &cfg.Deny
+			}
+			if len(*list) == MAXSOURCERULES {
+				return nil, errors.New("more than " + strconv.Itoa(MAXSOURCERULES) + " " + key + " rules")
+			}
+			prefixes, err := parsePrefixes([]string{value}, key+" rule")
+			if err != nil {
+				return nil, err
+			}
+			*list = append(*list, prefixes...)
+		case "allowcountry", "denycountry":
+			list := &cfg.AllowCountries
+			if key == "denycountry" {
+				list = &cfg.DenyCountries
+			}
+			if len(*list) == MAXSOURCERULES {
+				return nil, errors.New("more than " + strconv.Itoa(MAXSOURCERULES) + " " + key + " rules")
+			}
+			code := strings.ToUpper(value)
+			if !validCountry(code) {
+				return nil, errors.New("invalid country " + value)
+			}
+			*list = append(*list, code)
+		case "errors":
+			switch value {
+			case ERRORSAUTO, ERRORSHTML, ERRORSJSON:
+				cfg.Errors = value
+			default:
+				return nil, errors.New("invalid errors " + value)
+			}
+		default:
+			return nil, errors.New("unknown option " + key)
+		}
+	}
+	if cfg.Host != "" && (cfg.PublicPort != 0 || cfg.AnyPort) {
+		return nil, errors.New("a port exposed under a host has no public port")
+	}
+	if cfg.Host == "" && (cfg.Path != "" || cfg.StripPath) {
+		return nil, errors.New("a path needs a host")
+	}
+	if cfg.Host == "" && (len(cfg.Headers) > 0 || cfg.NoForwarded) {
+		return nil, errors.New("header rules need a host")
+	}
+	if cfg.Host == "" && (len(cfg.BasicAuth) > 0 || len(cfg.OIDC) > 0) {
+		return nil, errors.New("authentication needs a host")
+	}
+	if cfg.Host == "" && cfg.Errors != "" {
+		return nil, errors.New("error responses need a host")
+	}
+	if cfg.Host == "" && cfg.Inspect {
+		return nil, errors.New("inspection needs a host")
+	}
+	if cfg.Host == "" && cfg.Cache {
+		return nil, errors.New("caching needs a host")
+	}
+	if cfg.Host != "" && cfg.ProxyProtocol != "" {
+		return nil, errors.New("a port exposed under a host sends no PROXY headers")
+	}
+	return cfg, nil
+}
+
+// Relay exposes a single external port of a GoExpose client. It accepts external connections on the external port,
+// asks the client to connect to the proxy port through the control connection and pipes the data between both connections.
+// UDP relays do the same for every external peer, see runUdp.
+//
+// Proxy connections of the client are kept idle until the relay assigns them to an external connection by writing
+// Utils.DATASTART on them. This allows the relay to keep a pool of warm connections, so external connections
+// don't have to wait for the client to connect.
 type Relay struct {
-	proxyPort int
-	cnl       context.CancelFunc
+	// network is either "tcp" or "udp"
+	network string
+	// externalPort is the port of the client the relay exposes, frames refer to the relay by it. The relay listens on
+	// publicPort, which is the same port unless the client asked for another one.
+	externalPort int
+	publicPort   int
+	proxyPort    int
+	cnl          context.CancelFunc
+	// leaseExpiry is when the relay is hidden unless the client renews its lease, see ClientHandler.renewLease.
+	// It is only used by the handle loop of the client.
+	leaseExpiry time.Time
+
+	config atomic.Pointer[RelayConfig]
+	// ctx and toclient are set by start, reconfigure uses them to request connections from the client
+	ctx      context.Context
+	toclient chan<- *Utils.CTRLFrame
+	// ctrlIP is the IP of the control connection, it changes if the client resumes its session from another address
+	ctrlIP atomic.Pointer[string]
+	// started is set once start set up the relay, the HTTP front pairs no connections before, see dialHTTP
+	started atomic.Bool
+
+	// proxyFrom are the load balancers whose connections start with a PROXY header, see Config.ProxyProtocolFrom
+	proxyFrom []netip.Prefix
+	// publicIP and proxyIP are the IP addresses the public and the proxy listener are bound to, all interfaces if nil
+	publicIP net.IP
+	proxyIP  net.IP
+	// family is the address family of the listeners, see Config.AddressFamily
+	family        string
+	listener      *net.TCPListener
+	udpConn       *net.UDPConn
+	proxyListener *net.TCPListener
+	// detached is set by detach, stopped is closed once the accept or read loop of the public listener returned
+	detached atomic.Bool
+	stopped  chan struct{}
+	// tlsConfig secures the proxy connections, nil if they are plaintext
+	tlsConfig *tls.Config
+	idle      chan net.Conn
+	// tracer traces the pairing of relayed connections with connections of the client, nil if unused
+	tracer *tracer
+	// accessLog receives a record per relayed connection and UDP session, see logAccess, nil if unused
+	accessLog *slog.Logger
+	// onError is called with the errors of the relay that fail a relayed connection or stop the relay, nil if unused
+	onError func(error)
+	// onSample is called with the traffic of the relay since the previous sample, if there was any, nil if unused
+	onSample func(bytesIn uint64, bytesOut uint64, conns uint64)
+	// history is the traffic history of the exposed port, nil if unused. sampled holds the counters at the previous
+	// sample, see sampleHistory.
+	history   *trafficHistory
+	sampledMu sync.Mutex
+	sampled   relayTotals
+	// inspector keeps the requests of the HTTP front, nil if the port has no host, see RelayConfig.Inspect
+	inspector *requestInspector
+	// mux is the multiplexed data connection of the client, or its inline session. If set, the relay opens a stream per relayed connection
+	// and has neither a proxy port nor a warm pool.
+	mux *Utils.MuxSession
+
+	// tokens holds the unredeemed proxy tokens with the time they were issued, see issueToken
+	tokensMu sync.Mutex
+	tokens   map[string]time.Time
+
+	// conns holds the relayed connections, the stuck connection detector checks them for long half-closed states
+	connsMu sync.Mutex
+	conns   map[*relayedConn]struct{}
+	// stuckSamples are the stacks of the pipes of the connections force-closed last, see closeStuckConns
+	stuckSamples []string
+
+	// sessions holds the UDP sessions, keyed by the address of the external peer.
+	// sessionLRU orders them from the most to the least recently used.
+	// quicCIDs maps QUIC connection IDs to sessions, quicCIDLens marks the ID lengths seen so far.
+	sessionsMu  sync.Mutex
+	sessions    map[string]*udpSession
+	sessionLRU  *list.List
+	quicCIDs    map[string]*udpSession
+	quicCIDLens [QUICMAXCIDLEN + 1]bool
+
+	// limitIn and limitOut cap the bandwidth of the relay together with the other relays of the client and its tenant,
+	// nil if unlimited
+	limitIn  bandwidthLimits
+	limitOut bandwidthLimits
+	// connLimits cap the relayed connections of the relay together with other relays, see acquireConn
+	connLimits []*connLimit
+	// peerConns counts the relayed connections of every public IP, see acquirePeer
+	peerConnsMu sync.Mutex
+	peerConns   map[netip.Addr]int
+	// rateLimit caps the new relayed connections of the relay per second together with other relays, see admitRate
+	rateLimit *rateLimit
+	// bans refuses the banned source IPs and counts the failures of the peers towards a ban, nil if unused
+	bans *banList
+	// geoip looks up the countries of the peers, countries returns the country lists of the profile of the client,
+	// see admitsCountry
+	geoip     *GeoIP
+	countries func() ([]string, []string)
+
+	stats  RelayStats
+	logger *slog.Logger
+}
+
+// RelayStats holds the traffic counters of a Relay. The counters are updated by the relay goroutines and can be read at any time.
+// BytesIn counts the bytes sent from external peers to the client, BytesOut the bytes sent from the client to external peers.
+type RelayStats struct {
+	BytesIn  atomic.Uint64
+	BytesOut atomic.Uint64
+	// Accepted counts TCP connections, or UDP sessions
+	Accepted atomic.Uint64
+	Active   atomic.Int64
+	// ForceClosed counts the connections closed by the stuck connection detector
+	ForceClosed atomic.Uint64
+	// Evicted counts the UDP sessions evicted because the session limit was reached
+	Evicted atomic.Uint64
+	// Oversized counts the UDP datagrams dropped because they exceeded the MTU of the relay
+	Oversized atomic.Uint64
+	// Rejected counts the connections and UDP sessions refused because a connection limit or rate was reached
+	Rejected atomic.Uint64
+	// Blocked counts the connections, UDP datagrams of new sessions and requests of the HTTP front refused by the
+	// allow and deny lists of the port or by bans of their peers
+	Blocked atomic.Uint64
+	// CompressedIn and CompressedOut count the bytes of BytesIn and BytesOut as sent compressed on the proxy
+	// connections, both stay 0 for ports without RelayConfig.Compress
+	CompressedIn  atomic.Uint64
+	CompressedOut atomic.Uint64
+}
+
+// NewRelay creates a new Relay for the given network ("tcp" or "udp") and external port,
+// using proxyPort for the connections of the client.
+func NewRelay(network string, externalPort int, proxyPort int, config *RelayConfig, logger *slog.Logger) *Relay {
+	r := &Relay{
+		network:      network,
+		externalPort: externalPort,
+		publicPort:   externalPort,
+		proxyPort:    proxyPort,
+		// late proxy connections may be parked next to a full pool, so leave some room
+		idle:       make(chan net.Conn, 2*MAXWARMPOOL),
+		tokens:     make(map[string]time.Time),
+		conns:      make(map[*relayedConn]struct{}),
+		sessions:   make(map[string]*udpSession),
+		sessionLRU: list.New(),
+		quicCIDs:   make(map[string]*udpSession),
+		stopped:    make(chan struct{}),
+		logger:     logger,
+	}
+	r.config.Store(config)
+	if config.Host != "" {
+		r.inspector = &requestInspector{}
+		r.inspector.enabled.Store(config.Inspect)
+	}
+	return r
 }
 
 func (r *Relay) cancel() {
-	r.cnl()
+	if r.cnl != nil {
+		r.cnl()
+	}
+}
+
+// Stats returns the traffic counters of the relay.
+func (r *Relay) Stats() *RelayStats {
+	return &r.stats
+}
+
+// tunnel describes the exposed port of the relay for the registry and events.
+func (r *Relay) tunnel() Tunnel {
+	config := r.config.Load()
+	return Tunnel{Network: r.network, Port: r.externalPort, PublicPort: r.publicPort, Name: config.Name, Host: config.Host, Path: config.Path, stats: &r.stats,
+		inspector: r.inspector, relay: r}
+}
+
+// reportError passes an error of the relay to onError, if set.
+func (r *Relay) reportError(err error) {
+	if r.onError != nil {
+		r.onError(err)
+	}
+}
+
+// statsFrame creates a CTRLSTATS frame containing a snapshot of the relay counters.
+// The data is: network, external port, bytes in, bytes out, accepted connections, active connections,
+// half-closed connections, connections closed by the stuck connection detector, evicted UDP sessions,
+// dropped oversized UDP datagrams, name of the port or an empty string, rejected connections, blocked connections,
+// compressed bytes in, compressed bytes out.
+func (r *Relay) statsFrame() *Utils.CTRLFrame {
+	return Utils.NewCTRLFrame(Utils.CTRLSTATS, []string{
+		r.network,
+		strconv.Itoa(r.externalPort),
+		strconv.FormatUint(r.stats.BytesIn.Load(), 10),
+		strconv.FormatUint(r.stats.BytesOut.Load(), 10),
+		strconv.FormatUint(r.stats.Accepted.Load(), 10),
+		strconv.FormatInt(r.stats.Active.Load(), 10),
+		strconv.Itoa(r.halfClosedConns()),
+		strconv.FormatUint(r.stats.ForceClosed.Load(), 10),
+		strconv.FormatUint(r.stats.Evicted.Load(), 10),
+		strconv.FormatUint(r.stats.Oversized.Load(), 10),
+		r.config.Load().Name,
+		strconv.FormatUint(r.stats.Rejected.Load(), 10),
+		strconv.FormatUint(r.stats.Blocked.Load(), 10),
+		strconv.FormatUint(r.stats.CompressedIn.Load(), 10),
+		strconv.FormatUint(r.stats.CompressedOut.Load(), 10),
+	})
+}
+
+// listen opens the external and the proxy listener of the relay. It is called before start, so errors can be handled by the caller.
+// The external listener of a relay that adopted a held port is open already. A relay of a port exposed under a host
+// has none, the HTTP front passes the requests of the host on to it, see dialHTTP.
+func (r *Relay) listen() error {
+	var err error
+	switch {
+	case r.config.Load().Host != "":
+	case r.network == "udp" && r.udpConn == nil:
+		r.udpConn, err = net.ListenUDP(familyNetwork("udp", r.family), &net.UDPAddr{IP: r.publicIP, Port: r.publicPort})
+	case r.network == "tcp" && r.listener == nil:
+		r.listener, err = net.ListenTCP(familyNetwork("tcp", r.family), &net.TCPAddr{IP: r.publicIP, Port: r.publicPort})
+	}
+	if err != nil {
+		return err
+	}
+	if r.mux != nil {
+		return nil
+	}
+	r.proxyListener, err = net.ListenTCP(familyNetwork("tcp", r.family), &net.TCPAddr{IP: r.proxyIP, Port: r.proxyPort})
+	if err != nil {
+		r.closeListeners()
+		return err
+	}
+	return nil
+}
+
+// closeListeners closes the listeners of a relay that listens, but was never started.
+func (r *Relay) closeListeners() {
+	if r.udpConn != nil {
+		_ = r.udpConn.Close()
+	}
+	if r.listener != nil {
+		_ = r.listener.Close()
+	}
+	if r.proxyListener != nil {
+		_ = r.proxyListener.Close()
+	}
+}
+
+// start runs the relay in the background until ctx is cancelled. Frames for the client are sent through toclient.
+// ctrlIP is the IP of the control connection, proxy connections from other IPs are rejected.
+// If tlsConfig is not nil, proxy connections have to complete a TLS handshake with it.
+func (r *Relay) start(ctx context.Context, ctrlIP string, tlsConfig *tls.Config, toclient chan<- *Utils.CTRLFrame) {
+	r.ctx, r.cnl = context.WithCancel(ctx)
+	r.tlsConfig = tlsConfig
+	r.toclient = toclient
+	r.ctrlIP.Store(&ctrlIP)
+	r.started.Store(true)
+	go r.runHistory(r.ctx)
+	if r.mux == nil {
+		go r.runProxyListener(r.ctx)
+		go r.warmUp()
+	}
+	if r.config.Load().Host != "" {
+		go r.runStuckDetector(r.ctx)
+		return
+	}
+	if r.network == "udp" {
+		go r.runUdp(r.ctx)
+		return
+	}
+	go r.runStuckDetector(r.ctx)
+	go r.run(r.ctx)
+}
+
+// warmUp requests the initial warm pool from the client.
+func (r *Relay) warmUp() {
+	for range r.config.Load().PoolSize {
+		if r.requestConn() != nil {
+			return
+		}
+	}
+}
+
+// reconfigure replaces the config of the running relay. Established connections are not affected,
+// the warm pool is filled up or drained to the new size.
+func (r *Relay) reconfigure(config *RelayConfig) {
+	old := r.config.Swap(config)
+	if r.inspector != nil {
+		r.inspector.enabled.Store(config.Inspect)
+	}
+	if r.mux != nil {
+		return
+	}
+	diff := config.PoolSize - old.PoolSize
+	if diff > 0 {
+		go func() {
+			for range diff {
+				if r.requestConn() != nil {
+					return
+				}
+			}
+		}()
+	}
+	for ; diff < 0; diff++ {
+		select {
+		case conn := <-r.idle:
+			_ = conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// run accepts external connections until the context is cancelled. Every external connection is paired with
+// a proxy connection of the client, and the data is relayed between both. Pairing happens in the goroutine of the
+// connection, so a burst of external connections waits for their proxy connections in parallel.
+func (r *Relay) run(ctx context.Context) {
+	// stopped is closed after stop, so a detached listener is not closed by the cancelled context
+	defer close(r.stopped)
+	stop := context.AfterFunc(ctx, func() {
+		err := r.listener.Close()
+		if err != nil {
+			r.logger.Error("Error closing relay listener", slog.String("Func", "run"), "Error", err)
+		}
+	})
+	defer stop()
+
+	for {
+		extConn, err := r.listener.AcceptTCP()
+		if err != nil {
+			if r.detached.Load() {
+				return
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				r.logger.Error("Error accepting external connection", slog.String("Func", "run"), "Error", err)
+				r.reportError(err)
+			}
+			return
+		}
+		accepted := time.Now()
+		if !r.acquireConn() {
+			r.logger.Debug("Connection limit reached, rejecting external connection", slog.String("Func", "run"),
+				slog.String(Utils.PEERKEY, extConn.RemoteAddr().String()))
+			_ = extConn.Close()
+			r.logAccess(extConn.RemoteAddr(), 0, 0, accepted, CLOSEREJECTED)
+			continue
+		}
+		r.stats.Accepted.Add(1)
+		r.logger.Debug("Accepted external connection", slog.String("Func", "run"),
+			slog.String(Utils.PEERKEY, extConn.RemoteAddr().String()))
+
+		go func() {
+			defer r.releaseConn()
+			conn, err := acceptProxied(extConn, r.proxyFrom)
+			if err != nil {
+				r.logger.Debug("Error reading PROXY header", slog.String("Func", "run"), "Error", err)
+				_ = extConn.Close()
+				r.logAccess(extConn.RemoteAddr(), 0, 0, accepted, CLOSEREJECTED)
+				return
+			}
+			if !r.admitPeer(conn.RemoteAddr()) {
+				_ = conn.Close()
+				r.logAccess(conn.RemoteAddr(), 0, 0, accepted, CLOSEBLOCKED)
+				return
+			}
+			if !r.admitRate(conn.RemoteAddr()) {
+				r.logger.Debug("Connection rate reached, rejecting external connection", slog.String("Func", "run"),
+					slog.String(Utils.PEERKEY, conn.RemoteAddr().String()))
+				_ = conn.Close()
+				r.logAccess(conn.RemoteAddr(), 0, 0, accepted, CLOSEREJECTED)
+				return
+			}
+			if !r.acquirePeer(conn.RemoteAddr()) {
+				r.logger.Debug("Connection limit of peer reached, rejecting external connection", slog.String("Func", "run"),
+					slog.String(Utils.PEERKEY, conn.RemoteAddr().String()))
+				_ = conn.Close()
+				r.logAccess(conn.RemoteAddr(), 0, 0, accepted, CLOSEREJECTED)
+				return
+			}
+			defer r.releasePeer(conn.RemoteAddr())
+			proxConn, err := r.takeProxyConn(ctx)
+			if err != nil {
+				r.logger.Error("Error pairing proxy connection", slog.String("Func", "run"), "Error", err)
+				r.reportError(err)
+				_ = conn.Close()
+				r.logAccess(conn.RemoteAddr(), 0, 0, accepted, CLOSEUNPAIRED)
+				return
+			}
+			r.relayConns(ctx, conn, proxConn, accepted)
+		}()
+	}
+}
+
+// requestConn sends a CTRLCONNECT frame to the client, asking it to connect to the proxy port of the relay.
+// The data is: external port, proxy port, network, the token the proxy connection has to present, and "tls" or "plain".
+func (r *Relay) requestConn() error {
+	token, err := r.issueToken()
+	if err != nil {
+		return err
+	}
+	security := "plain"
+	if r.tlsConfig != nil {
+		security = "tls"
+	}
+	select {
+	case r.toclient <- Utils.NewCTRLFrame(Utils.CTRLCONNECT, []string{strconv.Itoa(r.externalPort), strconv.Itoa(r.proxyPort), r.network, token, security}):
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// runProxyListener accepts the proxy connections of the client and keeps them in the idle channel until they are
+// taken by an external connection. Connections have to present a token first, see admitProxyConn.
+// All idle connections are closed when the context is cancelled.
+func (r *Relay) runProxyListener(ctx context.Context) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = r.proxyListener.Close()
+	})
+	defer stop()
+	// connections still presenting their token are admitted before the idle ones are closed
+	var admitting sync.WaitGroup
+	defer func() {
+		for {
+			select {
+			case conn := <-r.idle:
+				_ = conn.Close()
+			default:
+				return
+			}
+		}
+	}()
+	defer admitting.Wait()
+
+	for {
+		conn, err := r.proxyListener.AcceptTCP()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				r.logger.Error("Error accepting proxy connection", slog.String("Func", "runProxyListener"), "Error", err)
+				r.reportError(err)
+			}
+			return
+		}
+		err = checkProxyIP(conn, *r.ctrlIP.Load())
+		if err != nil {
+			r.logger.Error("Rejected proxy connection", slog.String("Func", "runProxyListener"), "Error", err)
+			_ = conn.Close()
+			continue
+		}
+		var proxConn net.Conn = conn
+		if r.tlsConfig != nil {
+			// the handshake runs with the first read of admitProxyConn, bounded by its deadline
+			proxConn = tls.Server(conn, r.tlsConfig)
+		}
+		admitting.Add(1)
+		go func() {
+			defer admitting.Done()
+			r.admitProxyConn(proxConn)
+		}()
+	}
+}
+
+// takeProxyConn takes an idle proxy connection and requests a replacement from the client, which keeps the warm pool
+// filled, or serves this external connection if the pool is empty. In that case the client has 2 seconds to connect.
+// Relays of a multiplexing client open a stream instead.
+func (r *Relay) takeProxyConn(ctx context.Context) (conn net.Conn, err error) {
+	// a pairing is a trace of its own, not part of the one exposing the port
+	_, span := r.tracer.start(context.Background(), "takeProxyConn", slog.String("Network", r.network), slog.Int("Port", r.externalPort))
+	defer func() {
+		span.finish(err)
+	}()
+	if r.mux != nil {
+		span.set(slog.String("Transport", "mux"))
+		return r.openStream()
+	}
+	timeout := time.NewTimer(2 * time.Second)
+	defer timeout.Stop()
+	for attempt := 1; ; attempt++ {
+		span.set(slog.Int("Attempt", attempt))
+		err := r.requestConn()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case conn := <-r.idle:
+			// the client might have dropped an idle connection in the meantime, in that case try the next one
+			_, err = conn.Write([]byte{Utils.DATASTART})
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			return conn, nil
+		case <-timeout.C:
+			return nil, errors.New("timeout waiting for proxy connection")
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// openStream opens a stream on the multiplexed data connection of the client, headed by the network and the
+// external port, so the client knows which local port to connect.
+func (r *Relay) openStream() (net.Conn, error) {
+	st, err := r.mux.Open()
+	if err != nil {
+		return nil, err
+	}
+	err = Utils.WriteStreamHeader(st, r.network, r.externalPort)
+	if err != nil {
+		_ = st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// checkProxyIP checks if the proxy connection comes from the same IP as the control connection.
+func checkProxyIP(proxConn net.Conn, ctrlIP string) error {
+	ip, _, _ := net.SplitHostPort(proxConn.RemoteAddr().String())
+	if ip != ctrlIP {
+		return errors.New("proxy connection IP " + ip + " does not match control connection IP " + ctrlIP)
+	}
+	return nil
+}
+
+// relayConns pipes the data between an external connection and its proxy connection. When one side is done sending,
+// only that direction is shut down, and the other direction keeps draining. Both connections are closed once both
+// directions are done, a direction fails, or the context is cancelled. The connection is written to the access log
+// then, with the time it was accepted at. A peer that sent nothing before it closed right away fails towards a ban.
+func (r *Relay) relayConns(ctx context.Context, extConn, proxConn net.Conn, accepted time.Time) {
+	r.stats.Active.Add(1)
+	defer r.stats.Active.Add(-1)
+
+	if preset := r.config.Load().Compress; preset != "" {
+		dict, _ := Utils.CompressionDictionary(preset)
+		proxConn = Utils.NewCompressedConn(proxConn, dict, &r.stats.CompressedOut, &r.stats.CompressedIn)
+	}
+	rc := r.track(extConn, proxConn)
+	defer r.untrack(rc)
+	if version := r.config.Load().ProxyProtocol; version != "" {
+		_, err := proxConn.Write(proxyHeader(version, extConn.RemoteAddr(), extConn.LocalAddr()))
+		if err != nil {
+			r.logger.Debug("Error sending PROXY header", slog.String("Func", "relayConns"), "Error", err)
+			rc.close(CLOSEERROR)
+			r.logAccess(extConn.RemoteAddr(), 0, 0, accepted, rc.reason)
+			return
+		}
+	}
+	stop := context.AfterFunc(ctx, func() {
+		rc.close(CLOSESTOPPED)
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.pipe(rc, proxConn, extConn, byteCounters{&r.stats.BytesIn, &rc.bytesIn}, r.limitIn)
+	}()
+	r.pipe(rc, extConn, proxConn, byteCounters{&r.stats.BytesOut, &rc.bytesOut}, r.limitOut)
+	wg.Wait()
+	rc.close(CLOSEDONE)
+	if rc.visitorClosed.Load() && rc.bytesIn.Load() == 0 && time.Since(accepted) < BANIMMEDIATE {
+		r.bans.fail(extConn.RemoteAddr(), FAILDISCONNECT)
+	}
+	r.logAccess(extConn.RemoteAddr(), rc.bytesIn.Load(), rc.bytesOut.Load(), accepted, rc.reason)
+}
+
+// pipe copies from src to dst and adds the copied bytes to the counters, at the rate limit allows. If src is done sending, the write side of dst
+// is shut down, so its peer receives the end of stream as well. On errors, both connections of rc are closed,
+// which also terminates the pipe in the opposite direction. If src is the external connection and ends with EOF or a
+// reset before the other direction ended, the visitor closed the connection, see FAILDISCONNECT.
+// If both connections are plain TCP connections, the data is moved in-kernel, otherwise, e.g. for TLS proxy connections,
+// it is copied through a pooled buffer.
+func (r *Relay) pipe(rc *relayedConn, dst, src net.Conn, counters byteCounters, limit bandwidthLimits) {
+	if src == rc.extConn {
+		rc.pipes[0].Store(goroutineID())
+	} else {
+		rc.pipes[1].Store(goroutineID())
+	}
+	var err error
+	dstTcp, dstOk := tcpConn(dst)
+	srcTcp, srcOk := tcpConn(src)
+	if spliceSupported && dstOk && srcOk {
+		err = spliceCopy(dstTcp, srcTcp, counters, limit)
+	} else {
+		err = bufferedCopy(dst, src, counters, limit)
+	}
+	if rc.ended.CompareAndSwap(false, true) && src == rc.extConn && (err == nil || errors.Is(err, syscall.ECONNRESET)) {
+		rc.visitorClosed.Store(true)
+	}
+	if err != nil {
+		if !errors.Is(err, net.ErrClosed) {
+			r.logger.Debug("Error relaying data", slog.String("Func", "pipe"), "Error", err)
+		}
+		rc.close(CLOSEERROR)
+		return
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok && cw.CloseWrite() == nil {
+		rc.markHalfClosed()
+		return
+	}
+	rc.close(CLOSEDONE)
+}
+
+// tcpConn returns the TCP connection of the connection, also of one of a load balancer, see proxiedConn.
+func tcpConn(conn net.Conn) (*net.TCPConn, bool) {
+	if proxied, ok := conn.(*proxiedConn); ok {
+		return proxied.TCPConn, true
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	return tcp, ok
+}
+
+// byteCounters are the counters the bytes relayed in one direction are added to, those of the relay and of the
+// connection.
+type byteCounters []*atomic.Uint64
+
+func (c byteCounters) add(n int) {
+	for _, counter := range c {
+		counter.Add(uint64(n))
+	}
+}
+
+// spliceChunkSize limits how much data a single splice call moves before the counters are updated.
+const spliceChunkSize = 64 * 1024
+
+// spliceCopy copies from src to dst using the ReadFrom fast path of net.TCPConn, which splices the data in-kernel.
+// The source is read in chunks of spliceChunkSize, so the counters are updated while the connection is alive.
+func spliceCopy(dst, src *net.TCPConn, counters byteCounters, limit bandwidthLimits) error {
+	for {
+		n, err := dst.ReadFrom(&io.LimitedReader{R: src, N: spliceChunkSize})
+		counters.add(int(n))
+		limit.wait(int(n))
+		if err != nil {
+			return err
+		}
+		// a short chunk without error means src reached EOF
+		if n < spliceChunkSize {
+			return nil
+		}
+	}
+}
+
+// bufferedCopy copies from src to dst through a buffer of the shared bufferPool.
+func bufferedCopy(dst, src net.Conn, counters byteCounters, limit bandwidthLimits) error {
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+	// src is wrapped, so io.CopyBuffer can't bypass the pooled buffer through the WriterTo of the connection
+	_, err := io.CopyBuffer(&countingWriter{w: dst, counters: counters, limit: limit}, struct{ io.Reader }{src}, *buf)
+	return err
+}
+
+// countingWriter wraps an io.Writer and counts the bytes written to it. If limit is set, writes are throttled to its rate.
+type countingWriter struct {
+	w        io.Writer
+	counters byteCounters
+	limit    bandwidthLimits
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.counters.add(n)
+	cw.limit.wait(n)
+	return n, err
 }
@@ -0,0 +1,79 @@
+package Server
+
+import (
+	"errors"
+	"log/slog"
+	"reflect"
+)
+
+// RESTARTSETTINGS are the settings of Config that only take effect when the server is restarted, as listeners, port
+// queues and loops were set up with them. ReloadConfig keeps their values.
+var RESTARTSETTINGS = []string{
+	"CtrlPort", "DataPort", "CtrlAddr", "DataAddr", "AddressFamily", "PlaintextData", "ProxyPorts", "RandomPorts", "Tenants",
+	"AssignmentsFile", "PortLease", "CtrlALPN", "DataALPN", "ACME", "MetricsAddr", "PprofAddr",
+	"OTLPEndpoint", "HistoryFile", "AdminAddr", "WebSocketAddr", "NoiseAddr", "NoiseKeyFile", "Webhooks", "StoreDriver", "StoreFile",
+	"HTTPAddr", "HTTPSAddr", "HTTPCertFile", "HTTPKeyFile", "HTTPACME", "HTTPOIDC", "HTTPErrorPage",
+	"HTTPCacheSize", "GeoIPFile",
+}
+
+// ReloadConfig replaces the config in effect without dropping connected clients, and returns the changed settings
+// that require a restart, see RESTARTSETTINGS. Policies, quotas, port ranges and authentication apply to the next
+// request of every client, the limits of relayed connections at once. The bandwidth caps of single clients apply
+// from their next connection. The certificates are reloaded with the new config as well. The changes of the admin
+// API are applied on top of the config, see state. An invalid config is refused and the config in effect is kept.
+func (s *Server) ReloadConfig(config Config) ([]string, error) {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	st, err := loadState(s.stateStore())
+	if err != nil {
+		return nil, err
+	}
+	effective := config
+	err = st.applyTo(&effective)
+	if err == nil {
+		err = effective.Validate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	old := s.current()
+	oldValue, newValue, loadedValue := reflect.ValueOf(old).Elem(), reflect.ValueOf(&effective).Elem(), reflect.ValueOf(&config).Elem()
+	var restart []string
+	for _, name := range RESTARTSETTINGS {
+		if !reflect.DeepEqual(oldValue.FieldByName(name).Interface(), newValue.FieldByName(name).Interface()) {
+			restart = append(restart, name)
+			newValue.FieldByName(name).Set(oldValue.FieldByName(name))
+			loadedValue.FieldByName(name).Set(oldValue.FieldByName(name))
+			s.Logger.Warn("Setting changed, it takes effect after a restart", slog.String("Func", "ReloadConfig"), slog.String("Setting", name))
+		}
+	}
+	s.loaded = &config
+	s.apply(&effective)
+	// the level of the flags was set by the caller, the one of the admin API takes precedence
+	_ = s.applyLogLevel(st)
+	s.Logger.Info("Reloaded config", slog.String("Func", "ReloadConfig"), slog.Int("RestartRequired", len(restart)))
+	if s.tlsConfig.Load() == nil {
+		// not running yet, Run loads the certificates
+		return restart, nil
+	}
+	err = s.ReloadCertificates()
+	if err != nil {
+		return restart, errors.New("config reloaded, but " + err.Error())
+	}
+	return restart, nil
+}
+
+// apply puts the config in effect and caps the relayed connections of all clients and of every client, the rates of
+// new connections and the bans of source IPs, as it sets.
+func (s *Server) apply(config *Config) {
+	s.config.Store(config)
+	s.bans.setPolicy(config, s.Logger)
+	if s.conns != nil {
+		s.conns.setMax(config.MaxConns)
+	}
+	if s.connRate != nil {
+		s.connRate.setRates(config.ConnRate, config.ConnRatePerIP)
+		s.ctrlRate.setRates(config.CtrlRate, config.CtrlRatePerIP)
+	}
+	s.registry.limitConns(config)
+}
@@ -0,0 +1,143 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// resumption is a new control connection of a client resuming its suspended session, with the frames read from it
+// before it was handed over.
+type resumption struct {
+	conn    net.Conn
+	pending []*Utils.CTRLFrame
+}
+
+// startReading reads frames from the control connection into fromclient, until the connection fails or stopReading
+// is called. connDone is closed in both cases.
+func (c *ClientHandler) startReading(ctx context.Context, fromclient chan *Utils.CTRLFrame) {
+	connctx, cnl := context.WithCancel(ctx)
+	readDone := make(chan struct{})
+	c.connDone = connctx.Done()
+	c.connCnl = cnl
+	c.readDone = readDone
+	conn := c.Conn
+	go func() {
+		defer close(readDone)
+		c.readFrames(connctx, conn, fromclient, cnl)
+	}()
+}
+
+// stopReading stops reading frames from the control connection without closing it, and returns the frames read
+// but not digested yet.
+func (c *ClientHandler) stopReading(fromclient chan *Utils.CTRLFrame) []*Utils.CTRLFrame {
+	// a deadline in the past ends the read without consuming anything of the next frame
+	_ = c.Conn.SetReadDeadline(time.Unix(1, 0))
+	var pending []*Utils.CTRLFrame
+wait:
+	for {
+		select {
+		case fr := <-fromclient:
+			pending = append(pending, fr)
+		case <-c.readDone:
+			break wait
+		}
+	}
+	_ = c.Conn.SetReadDeadline(time.Time{})
+	for {
+		select {
+		case fr := <-fromclient:
+			pending = append(pending, fr)
+		default:
+			return pending
+		}
+	}
+}
+
+// resumable reports whether the session outlives its control connection for the grace window of the config.
+// Sessions of multiplexing clients end with their data connection.
+func (c *ClientHandler) resumable() bool {
+	return c.resumeToken != "" && c.mux == nil
+}
+
+// suspend keeps the session alive after its control connection was lost, until the client resumes it or the grace
+// window ends. Relays keep running, so connections relayed through proxy connections survive. Inline relays are
+// carried on the lost connection, they are hidden and exposed again by the client after resuming.
+func (c *ClientHandler) suspend() {
+	_ = c.Conn.Close()
+	for _, relay := range c.tunnels.all() {
+		if relay.config.Load().Inline {
+			c.hide(relay.network, relay.externalPort)
+		}
+	}
+	if c.inline != nil {
+		_ = c.inline.Close()
+		c.inline = nil
+		c.inlineConn = nil
+	}
+	c.registry.suspend(c.clientID)
+	c.graceTimer = time.NewTimer(c.config().ResumeGrace)
+	c.logger.Info("Control connection lost, session suspended", slog.String("Func", "suspend"), slog.Duration("Grace", c.config().ResumeGrace))
+}
+
+// resumed continues the suspended session on the connection of the resumption. The relays accept proxy connections
+// from its IP from now on and their leases are renewed, as the client couldn't renew them while it was gone.
+// The frames read from the connection before it was handed over are returned to be digested.
+func (c *ClientHandler) resumed(ctx context.Context, r resumption, fromclient chan *Utils.CTRLFrame) []*Utils.CTRLFrame {
+	c.Conn = r.conn
+	c.graceTimer.Stop()
+	c.graceTimer = nil
+	c.startReading(ctx, fromclient)
+	ctrlIP, _, _ := net.SplitHostPort(c.Conn.RemoteAddr().String())
+	for _, relay := range c.tunnels.all() {
+		relay.ctrlIP.Store(&ctrlIP)
+		c.renewLease(relay.network, relay.externalPort)
+	}
+	err := Utils.WriteFrame(c.Conn, c.resumeFrame(Utils.RESUMED))
+	if err != nil {
+		c.logger.Error("Error answering resumption", slog.String("Func", "resumed"), "Error", err)
+	}
+	c.logger.Info("Session resumed", slog.String("Func", "resumed"), slog.String("Address", c.Conn.RemoteAddr().String()))
+	return r.pending
+}
+
+// resumeSession hands the control connection over to the suspended session of the client with the resume token
+// of the CTRLRESUME frame. It returns true if this session ends, which leaves the connection open if it was handed
+// over. If there is no session to resume, the client is told with the token of this session.
+func (c *ClientHandler) resumeSession(msg *Utils.CTRLFrame, fromclient chan *Utils.CTRLFrame) bool {
+	// a multiplexing client has set up its data connection with this session already
+	var old *registeredClient
+	if c.mux == nil {
+		old = c.registry.claim(firstData(msg), c.clientCN(), c.Conn.RemoteAddr().String())
+	}
+	if old == nil {
+		c.logger.Info("No session to resume", slog.String("Func", "resumeSession"))
+		err := Utils.WriteFrame(c.Conn, c.resumeFrame(Utils.EXPIRED))
+		if err != nil {
+			c.logger.Error("Error answering resumption", slog.String("Func", "resumeSession"), "Error", err)
+		}
+		return false
+	}
+	pending := c.stopReading(fromclient)
+	select {
+	case old.resume <- resumption{conn: c.Conn, pending: pending}:
+		c.handedOff = true
+		c.logger.Info("Connection handed over to the resumed session", slog.String("Func", "resumeSession"))
+	case <-old.done:
+		// the session ended with the server
+	}
+	return true
+}
+
+// resumeFrame creates the CTRLRESUME frame with the resume token and the grace window of the session, followed by
+// the state if not empty.
+func (c *ClientHandler) resumeFrame(state string) *Utils.CTRLFrame {
+	data := []string{c.resumeToken, strconv.Itoa(int(c.config().ResumeGrace / time.Second))}
+	if state != "" {
+		data = append(data, state)
+	}
+	return Utils.NewCTRLFrame(Utils.CTRLRESUME, data)
+}
@@ -0,0 +1,141 @@
+package Server
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Revocation checking of client certificates, see Config.CRLFile and Config.OCSPResponder.
+const (
+	// OCSPTIMEOUT is how long the handshake of a client waits for the OCSP responder
+	OCSPTIMEOUT = 5 * time.Second
+	// OCSPCACHETIME is how long an answer of the responder is reused, if it doesn't tell itself
+	OCSPCACHETIME = time.Hour
+	// OCSPCLOCKSKEW is how far the clock of the responder may be ahead, answers produced later are refused.
+	// OCSPMAXAGE is how old an answer without nextUpdate may be, older ones are refused as stale.
+	OCSPCLOCKSKEW = 5 * time.Minute
+	OCSPMAXAGE    = 7 * 24 * time.Hour
+)
+
+var errRevoked = errors.New("client certificate revoked")
+
+// revocationChecker refuses client certificates listed in a CRL or reported revoked by an OCSP responder. It is
+// safe for concurrent use by the handshakes of the clients.
+type revocationChecker struct {
+	crl *x509.RevocationList
+	// revoked holds the serials listed by crl
+	revoked   map[string]bool
+	responder string
+	softFail  bool
+	http      *http.Client
+	logger    *slog.Logger
+	mu        sync.Mutex
+	// cache holds the answers of the responder by issuer and serial until they expire
+	cache map[string]cachedStatus
+}
+
+type cachedStatus struct {
+	revoked bool
+	expires time.Time
+}
+
+// newRevocationChecker loads the CRL of the config, it returns nil if neither a CRL nor an OCSP responder is
+// configured.
+func newRevocationChecker(config *Config, logger *slog.Logger) (*revocationChecker, error) {
+	if config.CRLFile == "" && config.OCSPResponder == "" {
+		return nil, nil
+	}
+	r := &revocationChecker{
+		responder: config.OCSPResponder,
+		softFail:  config.OCSPSoftFail,
+		http:      &http.Client{Timeout: OCSPTIMEOUT},
+		logger:    logger,
+		cache:     make(map[string]cachedStatus),
+	}
+	if config.CRLFile != "" {
+		data, err := os.ReadFile(config.CRLFile)
+		if err != nil {
+			return nil, err
+		}
+		// PEM or DER
+		if block, _ := pem.Decode(data); block != nil {
+			data = block.Bytes
+		}
+		r.crl, err = x509.ParseRevocationList(data)
+		if err != nil {
+			return nil, err
+		}
+		if !r.crl.NextUpdate.IsZero() && r.crl.NextUpdate.Before(time.Now()) {
+			logger.Warn("CRL is outdated, reload a current one", slog.String("Func", "newRevocationChecker"), slog.Time("NextUpdate", r.crl.NextUpdate))
+		}
+		r.revoked = make(map[string]bool, len(r.crl.RevokedCertificateEntries))
+		for _, entry := range r.crl.RevokedCertificateEntries {
+			r.revoked[entry.SerialNumber.String()] = true
+		}
+	}
+	return r, nil
+}
+
+// verify checks the client certificate of the verified chains, see Server.verifyPeer.
+func (r *revocationChecker) verify(_ [][]byte, chains [][]*x509.Certificate) error {
+	if len(chains) == 0 || len(chains[0]) < 2 {
+		return nil
+	}
+	cert, issuer := chains[0][0], chains[0][1]
+	if r.crl != nil && bytes.Equal(r.crl.RawIssuer, issuer.RawSubject) {
+		err := r.crl.CheckSignatureFrom(issuer)
+		if err != nil {
+			return errors.New("CRL not signed by the issuer of the client certificate: " + err.Error())
+		}
+		if r.revoked[cert.SerialNumber.String()] {
+			r.logger.Warn("Refused revoked client certificate", slog.String("Func", "verify"), slog.String("CN", cert.Subject.CommonName), slog.String("Serial", cert.SerialNumber.String()), slog.String("Source", "CRL"))
+			return errRevoked
+		}
+	}
+	if r.responder == "" {
+		return nil
+	}
+	revoked, err := r.queryOCSP(cert, issuer)
+	if err != nil {
+		r.logger.Error("Error checking client certificate with OCSP responder", slog.String("Func", "verify"), slog.String("CN", cert.Subject.CommonName), "Error", err)
+		if r.softFail {
+			return nil
+		}
+		return err
+	}
+	if revoked {
+		r.logger.Warn("Refused revoked client certificate", slog.String("Func", "verify"), slog.String("CN", cert.Subject.CommonName), slog.String("Serial", cert.SerialNumber.String()), slog.String("Source", "OCSP"))
+		return errRevoked
+	}
+	return nil
+}
+
+// queryOCSP reports whether the responder has the certificate revoked, reusing its earlier answer if still valid.
+func (r *revocationChecker) queryOCSP(cert *x509.Certificate, issuer *x509.Certificate) (bool, error) {
+	key := string(issuer.RawSubject) + "/" + cert.SerialNumber.String()
+	r.mu.Lock()
+	cached, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.revoked, nil
+	}
+	status, err := queryOCSP(r.http, r.responder, cert, issuer)
+	if err != nil {
+		return false, err
+	}
+	expires := time.Now().Add(OCSPCACHETIME)
+	if !status.nextUpdate.IsZero() && status.nextUpdate.Before(expires) {
+		expires = status.nextUpdate
+	}
+	r.mu.Lock()
+	r.cache[key] = cachedStatus{revoked: status.revoked, expires: expires}
+	r.mu.Unlock()
+	return status.revoked, nil
+}
@@ -1,118 +1,448 @@
 package Server
 
 import (
+	"Utils"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"html/template"
 	"log/slog"
 	"net"
 	"os"
-	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Default ports of the server, see Config.
 const (
-	CTRLPORT       string = "47921"
-	TCPPROXYBASE   int    = 47923
-	TCPPROXYAMOUNT int    = 10
+	CTRLPORT       int = 47921
+	DATAPORT       int = 47922
+	TCPPROXYBASE   int = 47923
+	TCPPROXYAMOUNT int = 10
 )
 
 type Server struct {
-	proxy  *Proxy
+	// Config is the config the server starts with, ReloadConfig replaces the config in effect
+	Config Config
 	Logger *slog.Logger
+	// LogLevel is the level of Logger, the admin API changes it if set, see UpdateSettings
+	LogLevel *slog.LevelVar
+	// AccessLog receives a record per relayed connection and UDP session, with the client, the tunnel, the external
+	// peer, the bytes relayed, the duration and the reason it ended, see CLOSEDONE. Nil disables it.
+	AccessLog *slog.Logger
+	// Transports are the transports clients connect with besides the control port and Config.WebSocketAddr, for
+	// applications embedding the server. They are listened on when Run starts.
+	Transports []Transport
+	// config is the config in effect, see current
+	config      atomic.Pointer[Config]
+	assignments *Assignments
+	// proxyPorts and data are shared by the clients, so they never get the same proxy port. The clients of
+	// tenants with proxy ports of their own take them from tenantProxyPorts instead.
+	proxyPorts       *Portqueue
+	tenantProxyPorts map[string]*Portqueue
+	// tenantLimits are the bandwidth and connection limits the clients of each tenant share, see Tenant.BandwidthIn
+	tenantLimits map[string]*tenantLimits
+	data         *dataListener
+	// conns caps the relayed connections of all clients, see Config.MaxConns
+	conns *connLimit
+	// connRate caps the new relayed connections of all clients per second, ctrlRate the new control connections,
+	// see Config.ConnRate
+	connRate *rateLimit
+	ctrlRate *rateLimit
+	// bans keeps the source IPs banned for their failures, see Config.BanThreshold
+	bans banList
+	// handshakes throttles the source IPs of failing control connections, see Config.HandshakeFailures
+	handshakes handshakeThrottle
+	// geoip looks up the countries of external peers, nil without Config.GeoIPFile
+	geoip *GeoIP
+	// clients tracks the handlers of the connected clients, registry who they are
+	clients  sync.WaitGroup
+	registry Registry
+	// tlsConfig is the config of new TLS connections, replaced by ReloadCertificates
+	tlsConfig atomic.Pointer[tls.Config]
+	// frameErrors counts the control connections lost to malformed frames, see WriteMetrics
+	frameErrors atomic.Uint64
+	// events delivers the events of clients and tunnels to the subscribers, eventCounts counts them for the metrics
+	events      EventBus
+	eventCounts eventCounts
+	// recentEvents keeps the last events for the admin API
+	recentEvents recentEvents
+	// histories keeps the traffic history of the exposed ports, see TrafficHistory
+	histories *trafficHistories
+	// hosts routes the requests of the HTTP front to the ports exposed under their hostname, frontCert is the
+	// certificate of its HTTPS listener, nil to use the one of the server, see Config.HTTPAddr
+	hosts     hostRouter
+	frontCert atomic.Pointer[tls.Certificate]
+	// challenges are the HTTP-01 challenges the HTTP front answers, frontACME obtains its certificates if
+	// Config.HTTPACME is set
+	challenges *httpSolver
+	frontACME  *frontACME
+	// frontAuth authenticates the visitors of the HTTP front, see RelayConfig.BasicAuth
+	frontAuth *frontAuth
+	// errorPage renders the error pages of the HTTP front, see writeFrontError
+	errorPage *template.Template
+	// frontCache keeps the responses of the HTTP front, nil if Config.HTTPCacheSize is 0
+	frontCache *responseCache
+	// tracer exports the spans of control operations and relayed connections, nil if Config.OTLPEndpoint is empty
+	tracer *tracer
+	// settings serializes the changes of the config in effect by ReloadConfig and the admin API, and guards loaded
+	// and store. loaded is the config the server was started or reloaded with, store keeps the state the admin API
+	// changed on top of it, see state.
+	settings sync.Mutex
+	loaded   *Config
+	store    Store
+	// poolsReady is set once Run set up the proxy ports and the connection count, ctrlUp while the control listener
+	// accepts clients and stopped once Run returned, see Ready
+	poolsReady atomic.Bool
+	ctrlUp     atomic.Bool
+	stopped    atomic.Bool
+}
+
+// Clients returns the connected clients with the ports they expose.
+func (s *Server) Clients() []ClientInfo {
+	return s.registry.Clients()
+}
+
+// TenantClients returns the connected clients of the tenant with the name and the ports they expose.
+func (s *Server) TenantClients(tenant string) []ClientInfo {
+	return s.registry.ByTenant(tenant)
+}
+
+// ActiveConns returns the amount of connections and UDP sessions relayed for all clients at the moment.
+func (s *Server) ActiveConns() int {
+	return s.conns.count()
 }
 
 // Run is the main loop of the server. It first initializes the TLS config, then listens for incoming control connections.
-// When a connection is accepted, it is handled in a proxy instance until disconnect.
+// Every accepted connection is handled by a ClientHandler of its own until disconnect, so any amount of clients can
+// be connected at a time. Each client exposes its own ports, a client disconnecting only hides those.
+// When the context is cancelled, Run returns after all clients were disconnected.
 func (s *Server) Run(context context.Context) {
-	config := s.prepareTlsConfig()
-	if config == nil {
-		s.Logger.Error("Error preparing TLS config", slog.String("Func", "Run"))
+	defer s.stopped.Store(true)
+	s.config.CompareAndSwap(nil, &s.Config)
+	err := s.openStore()
+	if err != nil {
+		s.Logger.Error("Error opening store", slog.String("Func", "Run"), slog.String("Path", s.Config.StoreFile), "Error", err)
 		return
 	}
+	defer s.closeStore()
+	if s.Config.GeoIPFile != "" {
+		s.geoip, err = OpenGeoIP(s.Config.GeoIPFile)
+		if err != nil {
+			s.Logger.Error("Error opening GeoIP database", slog.String("Func", "Run"), slog.String("Path", s.Config.GeoIPFile), "Error", err)
+			return
+		}
+	}
+	defer s.Subscribe(&s.eventCounts)()
+	defer s.Subscribe(&s.recentEvents)()
+	for _, hook := range s.Config.Webhooks {
+		defer s.Subscribe(newWebhookSender(context, hook, s.Logger))()
+	}
+	if s.Config.MetricsAddr != "" {
+		s.serveMonitoring(context)
+	}
+	if s.Config.PprofAddr != "" {
+		s.servePprof(context)
+	}
+	if s.Config.ACME.enabled() {
+		// a stored certificate is still used if it can't be renewed
+		_, err := s.renewAcmeCertificate(context)
+		if err != nil {
+			s.Logger.Error("Error obtaining ACME certificate", slog.String("Func", "Run"), "Error", err)
+		}
+	}
+	if s.tlsConfig.Load() == nil {
+		loaded := s.prepareTlsConfig()
+		if loaded == nil {
+			s.Logger.Error("Error preparing TLS config", slog.String("Func", "Run"))
+			return
+		}
+		s.tlsConfig.CompareAndSwap(nil, loaded)
+	}
+	config := s.reloadableTlsConfig(s.Config.CtrlALPN)
+	if s.Config.AdminAddr != "" {
+		s.serveAdmin(context)
+	}
+	if s.Config.routesHosts() {
+		s.serveHTTPFront(context)
+	}
+	if s.Config.ACME.enabled() {
+		go s.acmeLoop(context)
+	}
+	if s.Config.OTLPEndpoint != "" {
+		s.tracer = newTracer(s.Config.OTLPEndpoint, s.Logger)
+		go s.tracer.run(context)
+	}
+	assignments, err := LoadAssignments(s.Config.AssignmentsFile)
+	if s.Config.StoreFile != "" {
+		assignments, err = loadStoredAssignments(s.store)
+	}
+	if err != nil {
+		// the file is overwritten with the next assignment
+		s.Logger.Error("Error loading port assignments", slog.String("Func", "Run"), "Error", err)
+	}
+	s.assignments = assignments
+	histories, err := loadHistories(s.Config.HistoryFile)
+	if s.Config.StoreFile != "" {
+		histories, err = loadStoredHistories(s.store)
+	}
+	if err != nil {
+		// the file is overwritten with the next save
+		s.Logger.Error("Error loading traffic history", slog.String("Func", "Run"), "Error", err)
+	}
+	s.histories = histories
+	go s.histories.run(context, s.Logger)
+	// the history is saved a last time once the relays of all clients were hidden
+	defer func() {
+		err := s.histories.save(time.Now())
+		if err != nil {
+			s.Logger.Error("Error saving traffic history", slog.String("Func", "Run"), "Error", err)
+		}
+	}()
+	if len(s.Config.PrivilegedClients) > 0 && !canBindPrivileged(MAXPRIVILEGEDPORT) {
+		s.Logger.Warn("Privileged clients configured, but the server lacks CAP_NET_BIND_SERVICE", slog.String("Func", "Run"))
+	}
+	dataTLS := s.reloadableTlsConfig(s.Config.DataALPN)
+	if s.Config.PlaintextData {
+		dataTLS = nil
+	}
+	s.proxyPorts = NewPortqueue(s.Config.ProxyPorts, append(s.Config.tenantProxyPorts(), s.Config.DeniedPorts...)...)
+	s.proxyPorts.SetRandom(s.Config.RandomPorts)
+	s.tenantProxyPorts = make(map[string]*Portqueue)
+	s.tenantLimits = make(map[string]*tenantLimits)
+	for name, t := range s.Config.Tenants {
+		s.tenantLimits[name] = newTenantLimits(t)
+		if t.hasProxyPorts() {
+			s.tenantProxyPorts[name] = NewPortqueue(t.ProxyPorts, s.Config.DeniedPorts...)
+			s.tenantProxyPorts[name].SetRandom(s.Config.RandomPorts)
+		}
+	}
+	s.data = newDataListener(s.Config.listenNetwork("tcp"), s.Config.dataAddr(), s.Config.DataPort, dataTLS, s.Logger)
+	s.conns = newConnLimit(s.current().MaxConns)
+	s.connRate = newRateLimit(s.current().ConnRate, s.current().ConnRatePerIP)
+	s.ctrlRate = newRateLimit(s.current().CtrlRate, s.current().CtrlRatePerIP)
+	s.bans.setPolicy(s.current(), s.Logger)
+	s.poolsReady.Store(true)
 
+	l := s.ctrlListen(context, config)
+	s.ctrlUp.Store(true)
+	// the listener is closed before the clients are waited for
+	defer s.clients.Wait()
+	defer s.ctrlUp.Store(false)
 	for {
-		select {
-		case <-context.Done():
-			return
-		default:
-			clientConn := s.ctrlListen(context, config)
-			if clientConn == nil {
-				continue
+		clientConn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
 			}
-			s.Logger.Debug("Accepted control connection", slog.String("Address", clientConn.RemoteAddr().String()))
-			HandleClient(context, clientConn, s.Logger)
+			s.Logger.Debug("TLS error accepting connection", slog.String("Func", "Run"), "Error", err)
+			continue
+		}
+		if s.bans.banned(clientConn.RemoteAddr()) {
+			s.Logger.Debug("Refusing control connection of banned IP", slog.String("Func", "Run"),
+				slog.String("Address", clientConn.RemoteAddr().String()))
+			_ = clientConn.Close()
+			continue
+		}
+		if s.handshakes.throttled(clientConn.RemoteAddr(), s.current().HandshakeFailures) {
+			s.Logger.Debug("Refusing control connection of IP with failed handshakes", slog.String("Func", "Run"),
+				slog.String("Address", clientConn.RemoteAddr().String()))
+			_ = clientConn.Close()
+			continue
 		}
+		if !s.ctrlRate.allow(clientConn.RemoteAddr()) {
+			s.Logger.Debug("Control connection rate reached, refusing connection", slog.String("Func", "Run"),
+				slog.String("Address", clientConn.RemoteAddr().String()))
+			_ = clientConn.Close()
+			continue
+		}
+		s.Logger.Debug("Accepted control connection", slog.String("Address", clientConn.RemoteAddr().String()))
+		s.clients.Add(1)
+		go s.serveClient(context, clientConn, dataTLS)
 	}
 }
 
-// prepareTlsConfig reads the CA certificate, server key and certificate from the user's home directory and creates a tls.Config object.
-func (s *Server) prepareTlsConfig() *tls.Config {
-	homeDir, err := os.UserHomeDir()
+// serveClient identifies a client and handles its control connection until it disconnects. The client is known to
+// the registry meanwhile, and its logs name it. Another session of the client is refused or replaced according
+// to Config.DuplicateSessions. With Config.ResumeGrace, the session can be resumed on a later connection.
+func (s *Server) serveClient(ctx context.Context, conn net.Conn, dataTLS *tls.Config) {
+	defer s.clients.Done()
+	address := conn.RemoteAddr().String()
+	config := s.current()
+	identity, err := identify(conn, config)
 	if err != nil {
-		s.Logger.Error("Error getting home directory", slog.String("Func", "prepareTlsConfig"), "Error", err)
-		return nil
+		s.failHandshake(conn.RemoteAddr(), config, err)
+		_ = conn.Close()
+		return
 	}
-	filePath := filepath.Join(homeDir, "certs", "myCA.pem")
-	caCertData, err := os.ReadFile(filePath)
+	identity, err = config.authenticate(conn, identity)
 	if err != nil {
-		s.Logger.Error("Error reading CA certificate", slog.String("Func", "prepareTlsConfig"), "Error", err)
-		return nil
+		s.Logger.Error("Error authenticating client", slog.String("Func", "serveClient"), slog.String("Address", address), "Error", err)
+		refuseAuth(conn, err)
+		_ = conn.Close()
+		return
+	}
+	identity.Tenant = config.tenantOf(identity)
+	logger := s.Logger.With(slog.String("Client", identity.CN), slog.String("Address", address))
+	if identity.Tenant != "" {
+		logger = logger.With(slog.String("Tenant", identity.Tenant))
 	}
+	takeover := make(chan takeoverRequest)
+	id, replaced, err := s.registry.admit(identity, address, config.DuplicateSessions, takeover)
+	if err != nil {
+		logger.Error("Refused duplicate session", slog.String("Func", "serveClient"), "Error", err)
+		// the network and port of the error are empty, it is about the session and not an exposed port
+		_ = Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLERROR, []string{"", "", err.Error(), Utils.ERRDUPLICATE}))
+		_ = conn.Close()
+		return
+	}
+	defer s.registry.remove(id)
+	logger = logger.With(slog.Uint64("ClientID", id))
+	logger.Info("Client connected", slog.String("Func", "serveClient"))
+	s.events.publish(Event{Kind: EVENTCLIENTCONNECTED, ClientID: id, Client: identity, Address: address})
 
-	caCertPool := x509.NewCertPool()
-	ok := caCertPool.AppendCertsFromPEM(caCertData)
-	if !ok {
-		s.Logger.Error("Error appending CA certificate to pool")
-		return nil
+	proxyPorts := s.proxyPorts
+	if pq, ok := s.tenantProxyPorts[identity.Tenant]; ok {
+		proxyPorts = pq
 	}
-	keyPath := filepath.Join(homeDir, "certs", "server.key")
-	crtPath := filepath.Join(homeDir, "certs", "server.crt")
-	cer, err := tls.LoadX509KeyPair(crtPath, keyPath)
+	ch := newClientHandler(conn, &s.config, dataTLS, proxyPorts, s.data, s.assignments, logger)
+	ch.identity = identity
+	ch.registry = &s.registry
+	ch.clientID = id
+	ch.takeover = takeover
+	ch.admin = make(chan adminRequest)
+	s.registry.setAdmin(id, ch.admin)
+	ch.serverConns = s.conns
+	ch.tenantLimits = s.tenantLimits[identity.Tenant]
+	ch.connRate = s.connRate
+	ch.bans = &s.bans
+	ch.geoip = s.geoip
+	ch.frameErrors = &s.frameErrors
+	ch.tracer = s.tracer
+	ch.histories = s.histories
+	ch.events = &s.events
+	if config.routesHosts() {
+		ch.hosts = &s.hosts
+	}
+	if s.AccessLog != nil {
+		ch.accessLog = s.AccessLog.With(slog.String("Client", identity.CN), slog.Uint64("ClientID", id))
+	}
+	if config.ResumeGrace > 0 {
+		ch.resumeToken, err = Utils.NewProxyToken()
+		if err != nil {
+			logger.Error("Error creating resume token", slog.String("Func", "serveClient"), "Error", err)
+		}
+		ch.resume = make(chan resumption)
+		s.registry.setResumable(id, ch.resumeToken, ch.resume)
+	}
+	ch.takeOver(replaced, false)
+	ch.handle(ctx)
+	if ch.handedOff {
+		logger.Info("Client resumed an earlier session", slog.String("Func", "serveClient"))
+		s.events.publish(Event{Kind: EVENTCLIENTDISCONNECTED, ClientID: id, Client: identity, Address: address, Reason: "resumed an earlier session"})
+		return
+	}
+	logger.Info("Client disconnected", slog.String("Func", "serveClient"))
+	s.events.publish(Event{Kind: EVENTCLIENTDISCONNECTED, ClientID: id, Client: identity, Address: address, Reason: ch.endReason})
+}
+
+// current returns the config in effect, the one the server started with until ReloadConfig replaces it.
+func (s *Server) current() *Config {
+	if config := s.config.Load(); config != nil {
+		return config
+	}
+	return &s.Config
+}
+
+// ReloadCertificates reads the CA certificate, server key and certificate and the certificate of the HTTPS front
+// again, e.g. after they were renewed. New control and proxy connections use them, established ones are kept. If they
+// can't be read, the server keeps using the certificates loaded before and an error is returned.
+func (s *Server) ReloadCertificates() error {
+	config := s.prepareTlsConfig()
+	if config == nil {
+		return errors.New("error preparing TLS config, keeping the old certificates")
+	}
+	s.tlsConfig.Store(config)
+	err := s.loadFrontCertificate()
 	if err != nil {
-		s.Logger.Error("Error loading key pair", slog.String("Func", "prepareTlsConfig"), "Error", err)
-		return nil
+		return errors.New("error loading HTTP front certificate, keeping the old one: " + err.Error())
 	}
+	s.Logger.Info("Reloaded certificates", slog.String("Func", "ReloadCertificates"))
+	return nil
+}
 
-	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{cer},
-		ClientCAs:    caCertPool,
-		// The main purpose of this is to verify the client certificate
-		ClientAuth: tls.RequireAndVerifyClientCert,
+// reloadableTlsConfig returns a tls.Config that hands every handshake the config loaded last, so reloaded
+// certificates take effect without listening again. The handshakes negotiate the ALPN protocol IDs, if any.
+func (s *Server) reloadableTlsConfig(nextProtos []string) *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := s.tlsConfig.Load()
+			if len(nextProtos) > 0 {
+				config = config.Clone()
+				config.NextProtos = nextProtos
+			}
+			return config, nil
+		},
 	}
-	return tlsConfig
 }
 
-// ctrlListen starts a TLS listener with the provided config and listens for incoming connections.
-// If a connection is accepted, it starts a proxy instance with the connection.
-// The function returns the accepted connection and nil if successful, or nil and an error.
-//
-// TODO: make the error handling more specific, panic in case of hard errors
-func (s *Server) ctrlListen(ctx context.Context, config *tls.Config) net.Conn {
-	l, err := tls.Listen("tcp", ":"+CTRLPORT, config)
+// prepareTlsConfig reads the CA certificate, server key and certificate from the paths of the Config and creates a
+// tls.Config object. With Config.SystemCAs, client certificates issued by a CA of the system are accepted as well.
+// Revoked client certificates are refused, see Config.CRLFile.
+func (s *Server) prepareTlsConfig() *tls.Config {
+	config := s.current()
+	caPath, crtPath, keyPath, err := config.certPaths()
 	if err != nil {
-		s.Logger.Error("Error TLS listening", slog.String("Func", "ctrlListen"), slog.String("Port", CTRLPORT), "Error", err)
-		panic(err)
-	}
-	// listening context, to close the listener when the main context is cancelled or terminate the helper goroutine when the listener is closed
-	lctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	// handle a helper goroutine to close the listener when stop is received from console, or when we have accepted a connection
-	go func(ctx context.Context, l net.Listener) {
-		<-ctx.Done()
-		s.Logger.Debug("Closing TLS listener", slog.String("Func", "ctrlListen"))
-		err := l.Close()
+		s.Logger.Error("Error getting home directory", slog.String("Func", "prepareTlsConfig"), "Error", err)
+		return nil
+	}
+
+	caCertPool := x509.NewCertPool()
+	if config.SystemCAs {
+		caCertPool, err = x509.SystemCertPool()
+		if err != nil {
+			s.Logger.Error("Error loading system CA pool", slog.String("Func", "prepareTlsConfig"), "Error", err)
+			return nil
+		}
+	}
+	if caPath != "" {
+		caCertData, err := os.ReadFile(caPath)
 		if err != nil {
-			s.Logger.Debug("Error closing TLS listener", slog.String("Func", "ctrlListen"), "Error", err)
+			s.Logger.Error("Error reading CA certificate", slog.String("Func", "prepareTlsConfig"), slog.String("Path", caPath), "Error", err)
+			return nil
+		}
+		ok := caCertPool.AppendCertsFromPEM(caCertData)
+		if !ok {
+			s.Logger.Error("Error appending CA certificate to pool", slog.String("Func", "prepareTlsConfig"), slog.String("Path", caPath))
+			return nil
 		}
-	}(lctx, l)
+	}
+	cer, err := tls.LoadX509KeyPair(crtPath, keyPath)
+	if err != nil {
+		s.Logger.Error("Error loading key pair", slog.String("Func", "prepareTlsConfig"), slog.String("Certificate", crtPath), slog.String("Key", keyPath), "Error", err)
+		return nil
+	}
 
-	conn, err := l.Accept()
+	revocation, err := newRevocationChecker(config, s.Logger)
 	if err != nil {
-		s.Logger.Debug("TLS error accepting connection", slog.String("Func", "ctrlListen"), "Error", err)
+		s.Logger.Error("Error loading CRL", slog.String("Func", "prepareTlsConfig"), slog.String("Path", config.CRLFile), "Error", err)
 		return nil
 	}
 
-	s.Logger.Debug("Accepted connection, starting proxy", slog.String("Address", conn.RemoteAddr().String()))
-	return conn
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cer},
+		ClientCAs:    caCertPool,
+		// The main purpose of this is to verify the client certificate
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   config.TLSMinVersion,
+		CipherSuites: config.CipherSuites,
+	}
+	if config.tokenAuth() {
+		// clients without certificate authenticate with a token after the handshake
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	tlsConfig.VerifyPeerCertificate = s.verifyPeer(config, revocation)
+	return tlsConfig
 }
@@ -0,0 +1,98 @@
+package Server
+
+import (
+	"Utils"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// MAXSOURCERULES is the maximum amount of allow and of deny rules of an exposed port.
+const MAXSOURCERULES = 32
+
+// peerIP returns the IP of a TCP or UDP address, IPv4-mapped addresses as IPv4.
+func peerIP(addr net.Addr) (netip.Addr, bool) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort().Addr().Unmap(), true
+	case *net.UDPAddr:
+		return a.AddrPort().Addr().Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// containsIP reports whether the IP is in one of the prefixes.
+func containsIP(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// admits reports whether the allow and deny lists of the port let the peer in. Peers in Deny never are, and if Allow
+// is set, only peers in it are. Peers without IP are only let in by ports without lists.
+func (c *RelayConfig) admits(peer net.Addr) bool {
+	if len(c.Allow) == 0 && len(c.Deny) == 0 {
+		return true
+	}
+	ip, ok := peerIP(peer)
+	if !ok || containsIP(c.Deny, ip) {
+		return false
+	}
+	return len(c.Allow) == 0 || containsIP(c.Allow, ip)
+}
+
+// admitPeer checks the public peer of a connection, UDP session or request of the HTTP front against the bans, the
+// allow and deny lists and the country lists of the relay before it is paired, and counts it as blocked if it is refused. Refusals of the
+// lists count towards a ban of the peer.
+func (r *Relay) admitPeer(peer net.Addr) bool {
+	banned := r.bans.banned(peer)
+	if !banned && r.config.Load().admits(peer) && r.admitsCountry(peer) {
+		return true
+	}
+	if !banned {
+		r.bans.fail(peer, FAILBLOCKED)
+	}
+	r.stats.Blocked.Add(1)
+	addr := ""
+	if peer != nil {
+		addr = peer.String()
+	}
+	r.logger.Debug("Blocked peer", slog.String("Func", "admitPeer"), slog.String(Utils.PEERKEY, addr), slog.Bool("Banned", banned))
+	return false
+}
+
+// validCountry reports whether the code is an ISO 3166 alpha-2 code in upper case, e.g. DE.
+func validCountry(code string) bool {
+	return len(code) == 2 && 'A' <= code[0] && code[0] <= 'Z' && 'A' <= code[1] && code[1] <= 'Z'
+}
+
+// countryAdmits reports whether the country lists let a peer of the country in, "" if it is unknown. Countries in
+// deny never are, and if allow is set, only countries in it are.
+func countryAdmits(allow []string, deny []string, country string) bool {
+	if country != "" && slices.Contains(deny, country) {
+		return false
+	}
+	return len(allow) == 0 || slices.Contains(allow, country)
+}
+
+// admitsCountry reports whether the country of the peer passes the country lists of the port and those of the
+// profile of its client. The country is only looked up if there are lists.
+func (r *Relay) admitsCountry(peer net.Addr) bool {
+	config := r.config.Load()
+	var allow, deny []string
+	if r.countries != nil {
+		allow, deny = r.countries()
+	}
+	if len(config.AllowCountries) == 0 && len(config.DenyCountries) == 0 && len(allow) == 0 && len(deny) == 0 {
+		return true
+	}
+	country := ""
+	if ip, ok := peerIP(peer); ok {
+		country = r.geoip.Country(ip)
+	}
+	return countryAdmits(config.AllowCountries, config.DenyCountries, country) && countryAdmits(allow, deny, country)
+}
@@ -0,0 +1,4 @@
+package Server
+
+// spliceSupported reports whether net.TCPConn.ReadFrom moves data between TCP connections in-kernel on this platform.
+const spliceSupported = true
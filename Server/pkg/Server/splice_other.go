@@ -0,0 +1,7 @@
+//go:build !linux
+
+package Server
+
+// spliceSupported reports whether net.TCPConn.ReadFrom moves data between TCP connections in-kernel on this platform.
+// Elsewhere ReadFrom falls back to an unpooled userspace copy, so relays use bufferedCopy instead.
+const spliceSupported = false
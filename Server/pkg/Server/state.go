@@ -0,0 +1,228 @@
+package Server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"maps"
+	"strconv"
+)
+
+// STATESETTINGSKEY is the key of the settings changed through the admin API in STORESETTINGS.
+const STATESETTINGSKEY = "admin"
+
+// state is the config the operator changed through the admin API, kept in the Store of the server and applied on
+// top of the config the server was started or reloaded with, so the changes outlive both.
+type state struct {
+	// settings are the changes of UpdateSettings, merged into one
+	settings AdminSettingsUpdate
+	// profiles replace the profiles of the config with the same CN, reserved the owners of the reserved ports
+	profiles map[string]Profile
+	reserved map[int]string
+}
+
+// loadState reads the state from the store.
+func loadState(store Store) (state, error) {
+	st := state{profiles: make(map[string]Profile), reserved: make(map[int]string)}
+	data, err := store.Get(STORESETTINGS, STATESETTINGSKEY)
+	if err == nil {
+		err = json.Unmarshal(data, &st.settings)
+	}
+	if err != nil && !errors.Is(err, ErrNotStored) {
+		return st, err
+	}
+	profiles, err := store.List(STOREPROFILES)
+	if err != nil {
+		return st, err
+	}
+	for cn, data := range profiles {
+		var p Profile
+		err = json.Unmarshal(data, &p)
+		if err != nil {
+			return st, errors.New("invalid stored profile of client " + cn + ": " + err.Error())
+		}
+		st.profiles[cn] = p
+	}
+	reserved, err := store.List(STORERESERVED)
+	if err != nil {
+		return st, err
+	}
+	for key, data := range reserved {
+		port, err := strconv.Atoi(key)
+		var cn string
+		if err == nil {
+			err = json.Unmarshal(data, &cn)
+		}
+		if err != nil {
+			return st, errors.New("invalid stored reserved port " + key)
+		}
+		st.reserved[port] = cn
+	}
+	return st, nil
+}
+
+// save writes the state to the store.
+func (st state) save(store Store) error {
+	data, err := json.Marshal(st.settings)
+	if err != nil {
+		return err
+	}
+	err = store.Put(STORESETTINGS, STATESETTINGSKEY, data)
+	if err != nil {
+		return err
+	}
+	profiles := make(map[string][]byte, len(st.profiles))
+	for cn, p := range st.profiles {
+		profiles[cn], err = json.Marshal(p)
+		if err != nil {
+			return err
+		}
+	}
+	err = store.Replace(STOREPROFILES, profiles)
+	if err != nil {
+		return err
+	}
+	reserved := make(map[string][]byte, len(st.reserved))
+	for port, cn := range st.reserved {
+		reserved[strconv.Itoa(port)], err = json.Marshal(cn)
+		if err != nil {
+			return err
+		}
+	}
+	return store.Replace(STORERESERVED, reserved)
+}
+
+// applyTo changes the config as the state sets. The maps of the config are replaced, not changed, as they are
+// shared with the config in effect.
+func (st state) applyTo(config *Config) error {
+	err := st.settings.applyTo(config)
+	if err != nil {
+		return err
+	}
+	if len(st.profiles) > 0 {
+		config.Profiles = maps.Clone(config.Profiles)
+		if config.Profiles == nil {
+			config.Profiles = make(map[string]Profile)
+		}
+		maps.Copy(config.Profiles, st.profiles)
+	}
+	if len(st.reserved) > 0 {
+		config.ReservedPorts = maps.Clone(config.ReservedPorts)
+		if config.ReservedPorts == nil {
+			config.ReservedPorts = make(map[int]string)
+		}
+		maps.Copy(config.ReservedPorts, st.reserved)
+	}
+	return nil
+}
+
+// applyLogLevel sets the log level of the state, if it sets one and the server has a LogLevel.
+func (s *Server) applyLogLevel(st state) error {
+	if st.settings.LogLevel == nil || s.LogLevel == nil {
+		return nil
+	}
+	var level slog.Level
+	err := level.UnmarshalText([]byte(*st.settings.LogLevel))
+	if err != nil {
+		return errors.New("invalid log level " + *st.settings.LogLevel)
+	}
+	s.LogLevel.Set(level)
+	return nil
+}
+
+// stateStore returns the store of the state, one in memory until Run opened the one of Config.StoreFile.
+// s.settings must be held.
+func (s *Server) stateStore() Store {
+	if s.store == nil {
+		s.store, _ = openJSONStore("")
+	}
+	return s.store
+}
+
+// base returns the config the server was started or reloaded with, without the state. s.settings must be held.
+func (s *Server) base() Config {
+	if s.loaded == nil {
+		// no state was put into effect yet
+		loaded := *s.current()
+		s.loaded = &loaded
+	}
+	return *s.loaded
+}
+
+// openStore opens the store of Config.StoreFile and puts its state into effect. Without a store file, the state is
+// kept in memory.
+func (s *Server) openStore() error {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	if s.Config.StoreFile == "" {
+		s.stateStore()
+		return nil
+	}
+	store, err := OpenStore(s.Config.StoreDriver, s.Config.StoreFile)
+	if err != nil {
+		return err
+	}
+	s.store = store
+	st, err := loadState(store)
+	if err != nil {
+		return err
+	}
+	config := s.base()
+	err = st.applyTo(&config)
+	if err == nil {
+		err = config.Validate()
+	}
+	if err != nil {
+		return errors.New("stored state doesn't fit the config: " + err.Error())
+	}
+	s.apply(&config)
+	return s.applyLogLevel(st)
+}
+
+// closeStore closes the store once the server stopped.
+func (s *Server) closeStore() {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	err := s.store.Close()
+	if err != nil {
+		s.Logger.Error("Error closing store", slog.String("Func", "closeStore"), "Error", err)
+	}
+}
+
+// updateState changes the state with change, and puts it into effect and saves it if the config stays valid.
+// Otherwise nothing is changed.
+func (s *Server) updateState(change func(st *state) error) error {
+	s.settings.Lock()
+	defer s.settings.Unlock()
+	store := s.stateStore()
+	st, err := loadState(store)
+	if err != nil {
+		return err
+	}
+	err = change(&st)
+	if err != nil {
+		return err
+	}
+	config := s.base()
+	err = st.applyTo(&config)
+	if err != nil {
+		return err
+	}
+	err = config.Validate()
+	if err != nil {
+		return err
+	}
+	if st.settings.LogLevel != nil && s.LogLevel == nil {
+		return errors.New("log level can't be changed")
+	}
+	var level slog.Level
+	if st.settings.LogLevel != nil && level.UnmarshalText([]byte(*st.settings.LogLevel)) != nil {
+		return errors.New("invalid log level " + *st.settings.LogLevel)
+	}
+	err = st.save(store)
+	if err != nil {
+		return err
+	}
+	s.apply(&config)
+	return s.applyLogLevel(st)
+}
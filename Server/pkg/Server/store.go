@@ -0,0 +1,194 @@
+package Server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Store persists the state of the server beyond its config: the settings, profiles and reserved ports changed through
+// the admin API, the public ports assigned to clients and the traffic history of their ports, see Config.StoreFile.
+// Values are JSON documents kept by key in buckets. Implementations are safe for concurrent use.
+type Store interface {
+	// Get returns the value of the key in the bucket, ErrNotStored if there is none
+	Get(bucket string, key string) ([]byte, error)
+	Put(bucket string, key string, value []byte) error
+	// Delete removes the key from the bucket, a missing key is no error
+	Delete(bucket string, key string) error
+	// List returns the values of the bucket by key
+	List(bucket string) (map[string][]byte, error)
+	// Replace replaces the values of the bucket with values at once
+	Replace(bucket string, values map[string][]byte) error
+	Close() error
+}
+
+// Buckets of the Store.
+const (
+	STORESETTINGS    = "settings"
+	STOREPROFILES    = "profiles"
+	STORERESERVED    = "reserved"
+	STOREASSIGNMENTS = "assignments"
+	STOREHISTORY     = "history"
+)
+
+// Drivers of the Store, see Config.StoreDriver. STOREJSON keeps the state in a JSON file, STORESQLITE and STOREBBOLT
+// keep it in a SQLite or bbolt database.
+const (
+	STOREJSON   = "json"
+	STORESQLITE = "sqlite"
+	STOREBBOLT  = "bbolt"
+)
+
+// ErrNotStored is returned by Store.Get for a key that isn't stored.
+var ErrNotStored = errors.New("not stored")
+
+// storeDrivers open the stores of the drivers by the path of their file.
+var storeDrivers = map[string]func(path string) (Store, error){
+	STOREJSON:   openJSONStore,
+	STORESQLITE: openSQLiteStore,
+	STOREBBOLT:  openBoltStore,
+}
+
+// StoreDrivers returns the names of the store drivers, see Config.StoreDriver.
+func StoreDrivers() []string {
+	drivers := make([]string, 0, len(storeDrivers))
+	for driver := range storeDrivers {
+		drivers = append(drivers, driver)
+	}
+	slices.Sort(drivers)
+	return drivers
+}
+
+// OpenStore opens the store of the driver at path, creating it if it doesn't exist.
+func OpenStore(driver string, path string) (Store, error) {
+	open, ok := storeDrivers[driver]
+	if !ok {
+		return nil, errors.New("unknown store driver " + driver)
+	}
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+	return open(path)
+}
+
+// jsonStore keeps the buckets in a JSON object, which is written to a temporary file and renamed on every change, so
+// a crash never leaves a partial file behind. An empty path keeps them in memory only.
+type jsonStore struct {
+	mu      sync.Mutex
+	path    string
+	buckets map[string]map[string]json.RawMessage
+}
+
+// openJSONStore loads the store saved at path. A missing file is no error, the store starts empty then.
+func openJSONStore(path string) (Store, error) {
+	s := &jsonStore{path: path, buckets: make(map[string]map[string]json.RawMessage)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, &s.buckets)
+	if err != nil {
+		return nil, err
+	}
+	for _, bucket := range s.buckets {
+		for key, value := range bucket {
+			// undo the indentation of the file
+			bucket[key], _ = compactJSON(value)
+		}
+	}
+	return s, nil
+}
+
+func (s *jsonStore) Get(bucket string, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.buckets[bucket][key]
+	if !ok {
+		return nil, ErrNotStored
+	}
+	return slices.Clone(value), nil
+}
+
+func (s *jsonStore) Put(bucket string, key string, value []byte) error {
+	compact, err := compactJSON(value)
+	if err != nil {
+		return errors.New("value of " + bucket + "/" + key + " is no JSON")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string]json.RawMessage)
+	}
+	s.buckets[bucket][key] = compact
+	return s.save()
+}
+
+func (s *jsonStore) Delete(bucket string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.buckets[bucket][key]; !ok {
+		return nil
+	}
+	delete(s.buckets[bucket], key)
+	return s.save()
+}
+
+func (s *jsonStore) List(bucket string) (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make(map[string][]byte, len(s.buckets[bucket]))
+	for key, value := range s.buckets[bucket] {
+		values[key] = slices.Clone(value)
+	}
+	return values, nil
+}
+
+func (s *jsonStore) Replace(bucket string, values map[string][]byte) error {
+	replaced := make(map[string]json.RawMessage, len(values))
+	for key, value := range values {
+		compact, err := compactJSON(value)
+		if err != nil {
+			return errors.New("value of " + bucket + "/" + key + " is no JSON")
+		}
+		replaced[key] = compact
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket] = replaced
+	return s.save()
+}
+
+func (s *jsonStore) Close() error {
+	return nil
+}
+
+// save writes the buckets to the file at the path, if one is set. s.mu must be held.
+func (s *jsonStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.buckets, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// compactJSON returns the JSON document without insignificant space, in a slice of its own.
+func compactJSON(value []byte) (json.RawMessage, error) {
+	var compact bytes.Buffer
+	err := json.Compact(&compact, value)
+	return compact.Bytes(), err
+}
@@ -0,0 +1,96 @@
+package Server
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltStore keeps the buckets in buckets of a bbolt database.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (Store, error) {
+	// another server holding the database fails the open instead of blocking it
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Get(bucket string, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			// values are only valid during the transaction
+			value = slices.Clone(b.Get([]byte(key)))
+		}
+		return nil
+	})
+	if err == nil && value == nil {
+		return nil, ErrNotStored
+	}
+	return value, err
+}
+
+func (s *boltStore) Put(bucket string, key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (s *boltStore) Delete(bucket string, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket([]byte(bucket)); b != nil {
+			return b.Delete([]byte(key))
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) List(bucket string) (map[string][]byte, error) {
+	values := make(map[string][]byte)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			values[string(k)] = slices.Clone(v)
+			return nil
+		})
+	})
+	return values, err
+}
+
+func (s *boltStore) Replace(bucket string, values map[string][]byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket([]byte(bucket))
+		if err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+			return err
+		}
+		b, err := tx.CreateBucket([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		for key, value := range values {
+			err = b.Put([]byte(key), value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,96 @@
+package Server
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// sqlStore keeps the buckets in a table of a SQL database, see STORESQLITE. The driver is registered with database/sql
+// by the import of its module.
+type sqlStore struct {
+	db *sql.DB
+}
+
+// openSQLStore opens the database of the database/sql driver with the name and creates the table of the store.
+func openSQLStore(driver string, dsn string) (Store, error) {
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has a single writer, waiting for the connection beats failing with a busy database
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS goexpose_store (
+		bucket TEXT NOT NULL,
+		key TEXT NOT NULL,
+		value BLOB NOT NULL,
+		PRIMARY KEY (bucket, key)
+	)`)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &sqlStore{db: db}, nil
+}
+
+func (s *sqlStore) Get(bucket string, key string) ([]byte, error) {
+	var value []byte
+	err := s.db.QueryRow(`SELECT value FROM goexpose_store WHERE bucket = ? AND key = ?`, bucket, key).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotStored
+	}
+	return value, err
+}
+
+func (s *sqlStore) Put(bucket string, key string, value []byte) error {
+	_, err := s.db.Exec(`INSERT INTO goexpose_store (bucket, key, value) VALUES (?, ?, ?)
+		ON CONFLICT (bucket, key) DO UPDATE SET value = excluded.value`, bucket, key, value)
+	return err
+}
+
+func (s *sqlStore) Delete(bucket string, key string) error {
+	_, err := s.db.Exec(`DELETE FROM goexpose_store WHERE bucket = ? AND key = ?`, bucket, key)
+	return err
+}
+
+func (s *sqlStore) List(bucket string) (map[string][]byte, error) {
+	rows, err := s.db.Query(`SELECT key, value FROM goexpose_store WHERE bucket = ?`, bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make(map[string][]byte)
+	for rows.Next() {
+		var key string
+		var value []byte
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, rows.Err()
+}
+
+func (s *sqlStore) Replace(bucket string, values map[string][]byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	// a no-op once committed
+	defer tx.Rollback()
+	_, err = tx.Exec(`DELETE FROM goexpose_store WHERE bucket = ?`, bucket)
+	if err != nil {
+		return err
+	}
+	for key, value := range values {
+		_, err = tx.Exec(`INSERT INTO goexpose_store (bucket, key, value) VALUES (?, ?, ?)`, bucket, key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
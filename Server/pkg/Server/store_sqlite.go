@@ -0,0 +1,8 @@
+package Server
+
+import _ "modernc.org/sqlite"
+
+func openSQLiteStore(path string) (Store, error) {
+	// concurrent readers and a writer, and a writer waiting for another instead of failing
+	return openSQLStore("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+}
@@ -0,0 +1,208 @@
+package Server
+
+import (
+	"Utils"
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HALFCLOSETIMEOUT is how long a relayed connection may stay half-closed, with one side done sending and the other
+// side never finishing, before the stuck connection detector force-closes it.
+const HALFCLOSETIMEOUT = 5 * time.Minute
+
+// MAXSTUCKSTACKS is how many goroutine stacks of stuck connections a relay keeps and reports, see stuckStacks.
+const MAXSTUCKSTACKS = 8
+
+// relayedConn is an external connection and its proxy connection, relayed by a Relay.
+type relayedConn struct {
+	extConn  net.Conn
+	proxConn net.Conn
+
+	// halfClosedAt is the time in unix nanoseconds the first direction was shut down, 0 while both are open
+	halfClosedAt atomic.Int64
+	closeOnce    sync.Once
+	// reason is why the connection was closed, set by the first close, see CLOSEDONE
+	reason string
+	// bytesIn and bytesOut count the bytes relayed for the connection, for its access log record
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	// ended is set by the first direction to end, visitorClosed if the external side ended it by closing or resetting
+	// its connection, see FAILDISCONNECT
+	ended         atomic.Bool
+	visitorClosed atomic.Bool
+	// pipes are the IDs of the goroutines piping the inbound and the outbound direction, to sample their stacks
+	pipes [2]atomic.Uint64
+}
+
+func (rc *relayedConn) markHalfClosed() {
+	rc.halfClosedAt.CompareAndSwap(0, time.Now().UnixNano())
+}
+
+// halfClosedFor returns how long the connection is half-closed, or 0 if both directions are open.
+func (rc *relayedConn) halfClosedFor(now time.Time) time.Duration {
+	at := rc.halfClosedAt.Load()
+	if at == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, at))
+}
+
+// close closes both connections for the reason. It is safe to call multiple times, the first reason is kept.
+func (rc *relayedConn) close(reason string) {
+	rc.closeOnce.Do(func() {
+		rc.reason = reason
+		_ = rc.extConn.Close()
+		_ = rc.proxConn.Close()
+	})
+}
+
+// track registers a relayed connection with the relay.
+func (r *Relay) track(extConn, proxConn net.Conn) *relayedConn {
+	rc := &relayedConn{extConn: extConn, proxConn: proxConn}
+	r.connsMu.Lock()
+	r.conns[rc] = struct{}{}
+	r.connsMu.Unlock()
+	return rc
+}
+
+func (r *Relay) untrack(rc *relayedConn) {
+	r.connsMu.Lock()
+	delete(r.conns, rc)
+	r.connsMu.Unlock()
+}
+
+// halfClosedConns returns the amount of relayed connections that are currently half-closed.
+func (r *Relay) halfClosedConns() int {
+	now := time.Now()
+	n := 0
+	r.connsMu.Lock()
+	defer r.connsMu.Unlock()
+	for rc := range r.conns {
+		if rc.halfClosedFor(now) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// runStuckDetector periodically force-closes relayed connections that are half-closed for longer than HALFCLOSETIMEOUT.
+// Without it, a peer that never finishes its side would leak both connections until the relay is hidden.
+func (r *Relay) runStuckDetector(ctx context.Context) {
+	ticker := time.NewTicker(HALFCLOSETIMEOUT / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.closeStuckConns(now)
+		}
+	}
+}
+
+// closeStuckConns closes all connections that are half-closed for longer than HALFCLOSETIMEOUT and returns their amount.
+// The stacks of their pipe goroutines are kept before, so they can still be looked at in the admin API.
+func (r *Relay) closeStuckConns(now time.Time) int {
+	var stuck []*relayedConn
+	r.connsMu.Lock()
+	for rc := range r.conns {
+		if rc.halfClosedFor(now) > HALFCLOSETIMEOUT {
+			stuck = append(stuck, rc)
+		}
+	}
+	r.connsMu.Unlock()
+
+	if len(stuck) > 0 {
+		stacks := pipeStacks(stuck)
+		r.connsMu.Lock()
+		r.stuckSamples = append(r.stuckSamples, stacks...)
+		r.stuckSamples = r.stuckSamples[max(len(r.stuckSamples)-MAXSTUCKSTACKS, 0):]
+		r.connsMu.Unlock()
+	}
+	for _, rc := range stuck {
+		r.logger.Warn("Force-closing stuck half-closed connection", slog.String("Func", "closeStuckConns"),
+			slog.Int("Port", r.externalPort), slog.String(Utils.PEERKEY, rc.extConn.RemoteAddr().String()),
+			slog.Duration("HalfClosedFor", rc.halfClosedFor(now)))
+		rc.close(CLOSESTUCK)
+		r.stats.ForceClosed.Add(1)
+	}
+	return len(stuck)
+}
+
+// stuckStacks returns the goroutine stacks of the pipes of the connections that are half-closed right now, followed
+// by those of the connections force-closed last, at most MAXSTUCKSTACKS. It takes a dump of all goroutines, so it
+// is only done if a connection is half-closed or was force-closed.
+func (r *Relay) stuckStacks() []string {
+	now := time.Now()
+	var halfClosed []*relayedConn
+	r.connsMu.Lock()
+	for rc := range r.conns {
+		if rc.halfClosedFor(now) > 0 {
+			halfClosed = append(halfClosed, rc)
+		}
+	}
+	samples := slices.Clone(r.stuckSamples)
+	r.connsMu.Unlock()
+
+	stacks := pipeStacks(halfClosed)
+	stacks = append(stacks, samples...)
+	return stacks[:min(len(stacks), MAXSTUCKSTACKS)]
+}
+
+// pipeStacks returns the stacks of the pipe goroutines of the connections that are still running, at most
+// MAXSTUCKSTACKS.
+func pipeStacks(conns []*relayedConn) []string {
+	if len(conns) == 0 {
+		return nil
+	}
+	ids := make(map[uint64]struct{})
+	for _, rc := range conns {
+		for i := range rc.pipes {
+			if id := rc.pipes[i].Load(); id != 0 {
+				ids[id] = struct{}{}
+			}
+		}
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	var stacks []string
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if _, ok := ids[stackGoroutine(stack)]; ok && len(stacks) < MAXSTUCKSTACKS {
+			stacks = append(stacks, string(stack))
+		}
+	}
+	return stacks
+}
+
+// goroutineID returns the ID of the calling goroutine, taken from the header of its stack.
+func goroutineID() uint64 {
+	var buf [64]byte
+	return stackGoroutine(buf[:runtime.Stack(buf[:], false)])
+}
+
+// stackGoroutine returns the goroutine ID from the header of a stack as formatted by runtime.Stack, like
+// "goroutine 42 [IO wait]:", or 0 if it has none.
+func stackGoroutine(stack []byte) uint64 {
+	header, ok := bytes.CutPrefix(stack, []byte("goroutine "))
+	if !ok {
+		return 0
+	}
+	id, _, _ := bytes.Cut(header, []byte(" "))
+	n, _ := strconv.ParseUint(string(id), 10, 64)
+	return n
+}
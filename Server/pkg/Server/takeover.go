@@ -0,0 +1,193 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Policies for a client connecting while a session with the same certificate CN is still alive, e.g. after a
+// network blip the server didn't notice yet, see Config.DuplicateSessions.
+const (
+	// DUPLICATEALLOW keeps both sessions, each with its own ports
+	DUPLICATEALLOW = "allow"
+	// DUPLICATEREFUSE closes the new connection
+	DUPLICATEREFUSE = "refuse"
+	// DUPLICATEREPLACE closes the old session and hands its public ports over to the new one
+	DUPLICATEREPLACE = "replace"
+)
+
+// HANDOVERTIMEOUT is how long the public ports taken over from a replaced session are held for the new session.
+// Ports the client doesn't expose again in time are closed.
+const HANDOVERTIMEOUT = 30 * time.Second
+
+// takeoverRequest asks a session to hand over its public ports on reply. adopted is set if a client with another
+// identity takes them over, see ClientHandler.adopt, the client of the session is unpaired then.
+type takeoverRequest struct {
+	reply   chan []*heldPort
+	adopted bool
+}
+
+// heldPort is the public listener of a relay of a replaced session, held open until the new session exposes the
+// port again, so no one else can take the port in between.
+type heldPort struct {
+	network      string
+	externalPort int
+	publicPort   int
+	listener     *net.TCPListener
+	udpConn      *net.UDPConn
+}
+
+func (h *heldPort) close() {
+	if h.listener != nil {
+		_ = h.listener.Close()
+	}
+	if h.udpConn != nil {
+		_ = h.udpConn.Close()
+	}
+}
+
+// detach stops a started relay like cancel, but keeps its public listener open and returns it, so a relay of
+// another session can adopt it. Connections arriving meanwhile wait in the backlog of the listener.
+func (r *Relay) detach() *heldPort {
+	r.detached.Store(true)
+	// a deadline in the past unblocks the accept or read loop without closing the listener
+	past := time.Unix(1, 0)
+	if r.udpConn != nil {
+		_ = r.udpConn.SetReadDeadline(past)
+	} else {
+		_ = r.listener.SetDeadline(past)
+	}
+	<-r.stopped
+	r.cancel()
+	if r.udpConn != nil {
+		_ = r.udpConn.SetReadDeadline(time.Time{})
+	} else {
+		_ = r.listener.SetDeadline(time.Time{})
+	}
+	return &heldPort{
+		network:      r.network,
+		externalPort: r.externalPort,
+		publicPort:   r.publicPort,
+		listener:     r.listener,
+		udpConn:      r.udpConn,
+	}
+}
+
+// adopt makes the relay listen on a held port, see listen.
+func (r *Relay) adopt(held *heldPort) {
+	r.publicPort = held.publicPort
+	r.listener = held.listener
+	r.udpConn = held.udpConn
+}
+
+// handOver detaches the relays of a session that is replaced and returns their public listeners. Ports exposed under a
+// host have none, they are hidden and the host is free to expose again.
+func (c *ClientHandler) handOver() []*heldPort {
+	var held []*heldPort
+	for _, relay := range c.tunnels.all() {
+		if relay.config.Load().Host != "" {
+			c.hide(relay.network, relay.externalPort)
+			continue
+		}
+		c.tunnels.remove(relay.network, relay.externalPort)
+		held = append(held, relay.detach())
+		c.returnProxyPort(relay.proxyPort)
+	}
+	return held
+}
+
+// takeOver asks the replaced sessions for their public ports. The new session holds them until it exposes the
+// same ports again, see takeHeld. The ports taken over are returned.
+func (c *ClientHandler) takeOver(replaced []*registeredClient, adopted bool) []*heldPort {
+	var taken []*heldPort
+	for _, old := range replaced {
+		req := takeoverRequest{reply: make(chan []*heldPort, 1), adopted: adopted}
+		select {
+		case old.takeover <- req:
+		case <-old.done:
+			// the old session ended on its own, its ports are closed already
+			continue
+		}
+		for _, held := range <-req.reply {
+			if c.held == nil {
+				c.held = make(map[string]*heldPort)
+			}
+			if other, ok := c.held[heldKey(held.network, held.externalPort)]; ok {
+				// two sessions exposed the same port on different public ports, only one can be exposed again
+				other.close()
+			}
+			c.held[heldKey(held.network, held.externalPort)] = held
+			taken = append(taken, held)
+		}
+	}
+	if len(taken) > 0 {
+		c.logger.Info("Took over the ports of another session", slog.String("Func", "takeOver"), slog.Int("Ports", len(taken)))
+		if c.heldTimer != nil {
+			c.heldTimer.Stop()
+		}
+		c.heldTimer = time.NewTimer(HANDOVERTIMEOUT)
+	}
+	return taken
+}
+
+// adopt takes over the ports of the sessions of the client with the CN other, which may be connected or suspended,
+// so its tunnels move to this client without downtime, e.g. when migrating the client to another host. The client
+// has to be allowed to by its profile, see Profile.Adopt. It holds the public ports until it exposes the same ports
+// again, and gets the public ports assigned to the other client. Ports reserved for the other client stay reserved.
+// The client is answered with a CTRLADOPT frame.
+func (c *ClientHandler) adopt(ctx context.Context, other string, toclient chan *Utils.CTRLFrame) {
+	cn := c.clientCN()
+	if other == "" || other == cn || !c.config().mayAdopt(cn, other) {
+		c.logger.Error("Adoption not allowed", slog.String("Func", "adopt"), slog.String("Other", other))
+		c.respond(ctx, toclient, Utils.NewCTRLFrame(Utils.CTRLADOPT, []string{other, "not allowed to adopt the ports of " + other}))
+		return
+	}
+	adopted, err := c.registry.adopt(c.clientID, other)
+	if err != nil {
+		c.logger.Error("Error adopting ports", slog.String("Func", "adopt"), slog.String("Other", other), "Error", err)
+		c.respond(ctx, toclient, Utils.NewCTRLFrame(Utils.CTRLADOPT, []string{other, err.Error()}))
+		return
+	}
+	data := []string{other, ""}
+	for _, held := range c.takeOver(adopted, true) {
+		data = append(data, held.network+"/"+strconv.Itoa(held.externalPort))
+	}
+	err = c.assignments.Transfer(other, cn)
+	if err != nil {
+		c.logger.Error("Error saving port assignments", slog.String("Func", "adopt"), "Error", err)
+	}
+	c.logger.Info("Adopted the ports of another client", slog.String("Func", "adopt"), slog.String("Other", other), slog.Int("Sessions", len(adopted)))
+	c.respond(ctx, toclient, Utils.NewCTRLFrame(Utils.CTRLADOPT, data))
+}
+
+// takeHeld returns the held port of the port of the client, if its public port is the one asked for. A publicPort
+// of 0 takes any public port.
+func (c *ClientHandler) takeHeld(network string, externalPort int, publicPort int) *heldPort {
+	key := heldKey(network, externalPort)
+	held, ok := c.held[key]
+	if !ok || (publicPort != 0 && publicPort != held.publicPort) {
+		return nil
+	}
+	delete(c.held, key)
+	return held
+}
+
+// releaseHeld closes the held ports the client didn't expose again.
+func (c *ClientHandler) releaseHeld() {
+	for key, held := range c.held {
+		held.close()
+		delete(c.held, key)
+	}
+	if c.heldTimer != nil {
+		c.heldTimer.Stop()
+		c.heldTimer = nil
+	}
+}
+
+func heldKey(network string, port int) string {
+	return network + "/" + strconv.Itoa(port)
+}
@@ -0,0 +1,209 @@
+package Server
+
+import (
+	"Utils"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"os"
+)
+
+// Tenant groups the clients of a team, so a single server can serve several teams without them taking each
+// other's ports. A client belongs to the tenant its profile names, or else to the tenant named like an
+// organizational unit (OU) of its certificate, see Config.tenantOf.
+type Tenant struct {
+	Name string
+	// Ports are the public ports only the clients of the tenant may expose, and the only ones they may expose.
+	// public=any chooses from them instead of Config.AnyPorts. Empty lets the clients expose the ports no tenant has.
+	Ports []PortRange
+	// ProxyPorts are the proxy ports only the clients of the tenant use, they have to be in Config.ProxyPorts.
+	// If not set, the clients share the proxy ports no tenant has.
+	ProxyPorts PortRange
+	// Quota limits the ports all clients of the tenant expose together, 0 means unlimited
+	Quota Quota
+	// BandwidthIn and BandwidthOut cap the bytes per second relayed to and from all clients of the tenant together,
+	// MaxConns their relayed connections and UDP sessions at a time, 0 means unlimited. They apply on top of the
+	// limits of each client and of the server, so the clients of one tenant can't use up the share of another.
+	BandwidthIn  int64
+	BandwidthOut int64
+	MaxConns     int
+}
+
+// tenantLimits are the bandwidth and connection limits the connected clients of a tenant share, see
+// Tenant.BandwidthIn. A nil tenantLimits doesn't limit.
+type tenantLimits struct {
+	limitIn  *bandwidthLimiter
+	limitOut *bandwidthLimiter
+	conns    *connLimit
+}
+
+// newTenantLimits creates the limits of the tenant.
+func newTenantLimits(t Tenant) *tenantLimits {
+	return &tenantLimits{
+		limitIn:  newBandwidthLimiter(t.BandwidthIn),
+		limitOut: newBandwidthLimiter(t.BandwidthOut),
+		conns:    newConnLimit(t.MaxConns),
+	}
+}
+
+// LoadTenants loads the tenants from a JSON file holding a list of tenants, and returns them by name.
+// An empty path loads no tenants.
+func LoadTenants(path string) (map[string]Tenant, error) {
+	tenants := make(map[string]Tenant)
+	if path == "" {
+		return tenants, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list []Tenant
+	err = json.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range list {
+		if _, ok := tenants[t.Name]; ok {
+			return nil, errors.New("duplicate tenant " + t.Name)
+		}
+		tenants[t.Name] = t
+	}
+	return tenants, nil
+}
+
+// hasProxyPorts reports whether the tenant has proxy ports of its own.
+func (t *Tenant) hasProxyPorts() bool {
+	return t.ProxyPorts != PortRange{}
+}
+
+// validateTenants checks the tenants and that the ports of different tenants don't overlap.
+func (c *Config) validateTenants() error {
+	var taken, proxyTaken []PortRange
+	for name, t := range c.Tenants {
+		if name == "" || name != t.Name {
+			return errors.New("tenant " + t.Name + " stored as " + name)
+		}
+		for _, r := range t.Ports {
+			if !r.valid() || overlaps(r, taken) {
+				return errors.New("invalid or overlapping ports of tenant " + name)
+			}
+			taken = append(taken, r)
+		}
+		if t.hasProxyPorts() {
+			if !t.ProxyPorts.valid() || t.ProxyPorts.First < c.ProxyPorts.First || t.ProxyPorts.Last > c.ProxyPorts.Last || overlaps(t.ProxyPorts, proxyTaken) {
+				return errors.New("invalid or overlapping proxy ports of tenant " + name)
+			}
+			proxyTaken = append(proxyTaken, t.ProxyPorts)
+		}
+		if t.Quota.Tcp < 0 || t.Quota.Udp < 0 {
+			return errors.New("negative quota of tenant " + name)
+		}
+		if t.BandwidthIn < 0 || t.BandwidthOut < 0 || t.MaxConns < 0 {
+			return errors.New("negative bandwidth or connection limit of tenant " + name)
+		}
+	}
+	for _, p := range c.Profiles {
+		if _, ok := c.Tenants[p.Tenant]; p.Tenant != "" && !ok {
+			return errors.New("unknown tenant " + p.Tenant + " in profile of client " + p.CN)
+		}
+	}
+	return nil
+}
+
+// overlaps reports whether r overlaps one of the ranges.
+func overlaps(r PortRange, ranges []PortRange) bool {
+	for _, other := range ranges {
+		if r.First <= other.Last && other.First <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantOf returns the name of the tenant of the client, or an empty string if it belongs to none.
+func (c *Config) tenantOf(identity ClientIdentity) string {
+	if p := c.profile(identity.CN); p != nil && p.Tenant != "" {
+		return p.Tenant
+	}
+	for _, ou := range identity.OU {
+		if _, ok := c.Tenants[ou]; ok {
+			return ou
+		}
+	}
+	return ""
+}
+
+// tenantProxyPorts returns the proxy port ranges of all tenants.
+func (c *Config) tenantProxyPorts() []PortRange {
+	var ranges []PortRange
+	for _, t := range c.Tenants {
+		if t.hasProxyPorts() {
+			ranges = append(ranges, t.ProxyPorts)
+		}
+	}
+	return ranges
+}
+
+// checkTenant returns the error code and the reason why a client of the tenant may not expose the public port,
+// or empty strings if it may.
+func (c *Config) checkTenant(port int, tenant string) (string, string) {
+	if t, ok := c.Tenants[tenant]; ok && len(t.Ports) > 0 {
+		if !inRanges(port, t.Ports) {
+			return Utils.ERRRANGE, "port out of the range of the tenant"
+		}
+		return "", ""
+	}
+	for name, t := range c.Tenants {
+		if name != tenant && inRanges(port, t.Ports) {
+			return Utils.ERRRESERVED, "port reserved for another tenant"
+		}
+	}
+	return "", ""
+}
+
+// anyRanges returns the ranges public=any chooses from for the client, those of its tenant if it has any.
+func (c *ClientHandler) anyRanges() []PortRange {
+	if t, ok := c.config().Tenants[c.identity.Tenant]; ok && len(t.Ports) > 0 {
+		return t.Ports
+	}
+	return []PortRange{c.config().anyPorts()}
+}
+
+// tenantQuotaExceeded reports whether exposing n more ports of the network exceeds the quota of the tenant of the
+// client, and returns the quota. The ports of all connected clients of the tenant count.
+func (c *ClientHandler) tenantQuotaExceeded(network string, n int) (int, bool) {
+	t, ok := c.config().Tenants[c.identity.Tenant]
+	if !ok || t.Quota.limit(network) == 0 {
+		return 0, false
+	}
+	used := c.tunnels.count(network)
+	if c.registry != nil {
+		used = c.registry.tenantTunnels(t.Name, network)
+	}
+	return t.Quota.limit(network), used+n > t.Quota.limit(network)
+}
+
+// randomPort returns the first port of a random block of size ports within one of the ranges, or false if the block
+// fits into none of them. Every block that fits is equally likely.
+func randomPort(ranges []PortRange, size int) (int, bool) {
+	blocks := 0
+	for _, r := range ranges {
+		if r.valid() && r.Size() >= size {
+			blocks += r.Size() - size + 1
+		}
+	}
+	if blocks == 0 {
+		return 0, false
+	}
+	n := rand.IntN(blocks)
+	for _, r := range ranges {
+		if !r.valid() || r.Size() < size {
+			continue
+		}
+		if n < r.Size()-size+1 {
+			return r.First + n, true
+		}
+		n -= r.Size() - size + 1
+	}
+	return 0, false
+}
@@ -0,0 +1,113 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// accessRecords collects the JSON records written to the access log.
+type accessRecords struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (a *accessRecords) Write(p []byte) (int, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.buf.Write(p)
+}
+
+// wait returns the raw output and the records once there are at least n, nil if they don't arrive in time.
+func (a *accessRecords) wait(t *testing.T, n int) (string, []map[string]any) {
+	for i := 0; i < 500; i++ {
+		a.mu.Lock()
+		out := a.buf.String()
+		a.mu.Unlock()
+		var records []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+			if line == "" {
+				continue
+			}
+			var record map[string]any
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, record)
+		}
+		if len(records) >= n {
+			return out, records
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return "", nil
+}
+
+func TestAccessLog(t *testing.T) {
+	records := &accessRecords{}
+	handler, err := Utils.NewRedactingHandler(slog.NewJSONHandler(records, nil), Utils.REDACTTRUNCATE, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a credential that ends up with the access log sink has to be left out like the peer address
+	const secret = "Bearer access-log-s3cr3t"
+	_, dir, port, _ := startHTTPFrontServerWith(t, nil, slog.New(handler).With("Authorization", secret))
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	public := freeTestPort(t)
+	if fr := exposeFrame(t, conn, strconv.Itoa(public), "name=web"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+	serveProxyConns(t, dir, conn, echoLines(t))
+
+	c, ok := visit(t, public)
+	if !ok {
+		t.Fatal("Expected the connection to be relayed")
+	}
+	_ = c.Close()
+
+	out, got := records.wait(t, 1)
+	if got == nil {
+		t.Fatal("Expected an access record for the relayed connection")
+	}
+	record := got[0]
+	want := map[string]any{
+		"msg":           "access",
+		"Client":        "alice",
+		"Network":       "tcp",
+		"Port":          float64(public),
+		"PublicPort":    float64(public),
+		"Tunnel":        "web",
+		"BytesIn":       float64(len("ping\n")),
+		"BytesOut":      float64(len("ping\n")),
+		"Authorization": Utils.REDACTEDSECRET,
+	}
+	for key, value := range want {
+		if record[key] != value {
+			t.Error("Expected", key, value, "got", record[key])
+		}
+	}
+	if reason := record["Reason"]; reason != server.CLOSEDONE && reason != server.CLOSESTOPPED {
+		t.Error("Expected the connection to end done, got", reason)
+	}
+	if _, ok := record["ClientID"].(float64); !ok {
+		t.Error("Expected the ID of the client, got", record["ClientID"])
+	}
+	if _, ok := record["Duration"].(float64); !ok {
+		t.Error("Expected the duration of the connection, got", record["Duration"])
+	}
+	// the peer is truncated to its /24, the credential is not written at all
+	if peer, _ := record[Utils.PEERKEY].(string); !strings.HasPrefix(peer, "127.0.0.0:") {
+		t.Error("Expected the truncated peer address, got", record[Utils.PEERKEY])
+	}
+	if strings.Contains(out, "127.0.0.1") || strings.Contains(out, "s3cr3t") {
+		t.Error("Expected the peer address and the credential to be redacted, got", out)
+	}
+}
@@ -0,0 +1,341 @@
+package test
+
+import (
+	server "Server"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeACME is an ACME CA, RFC 8555, with a single account, order and authorization. Each request has to use a nonce
+// the CA issued and not seen yet. It issues the certificates with a key of its own.
+type fakeACME struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+
+	mu sync.Mutex
+	// badNonces is how many orders are refused for a bad nonce before one is accepted, failChallenge makes the
+	// challenge fail
+	badNonces     int
+	failChallenge bool
+	nonces        map[string]bool
+	lastNonce     int
+	orders        int
+	refused       int
+	authzStatus   string
+	orderStatus   string
+	chain         []byte
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &fakeACME{key: key, nonces: make(map[string]bool)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   ca.URL + "/nonce",
+			"newAccount": ca.URL + "/account",
+			"newOrder":   ca.URL + "/order",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+		ca.mu.Lock()
+		defer ca.mu.Unlock()
+		ca.issueNonce(w)
+	})
+	mux.HandleFunc("/", ca.serveSigned)
+	ca.Server = httptest.NewServer(mux)
+	t.Cleanup(ca.Close)
+	return ca
+}
+
+// issueNonce sets a fresh nonce on the response.
+func (ca *fakeACME) issueNonce(w http.ResponseWriter) {
+	ca.lastNonce++
+	nonce := "nonce-" + strconv.Itoa(ca.lastNonce)
+	ca.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+}
+
+// serveSigned answers the signed POST requests of the account, the order and the authorization.
+func (ca *fakeACME) serveSigned(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	var jws struct {
+		Protected string `json:"protected"`
+		Payload   string `json:"payload"`
+	}
+	var header struct {
+		Nonce string `json:"nonce"`
+		URL   string `json:"url"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&jws)
+	if err != nil || r.Method != http.MethodPost {
+		http.Error(w, "malformed", http.StatusBadRequest)
+		return
+	}
+	protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	_ = json.Unmarshal(protected, &header)
+	ca.issueNonce(w)
+	if !ca.nonces[header.Nonce] || header.URL != ca.URL+r.URL.Path || (r.URL.Path == "/order" && ca.badNonces > 0) {
+		if r.URL.Path == "/order" && ca.badNonces > 0 {
+			ca.badNonces--
+		}
+		ca.refused++
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"type":"urn:ietf:params:acme:error:badNonce","detail":"bad nonce"}`))
+		return
+	}
+	delete(ca.nonces, header.Nonce)
+
+	switch r.URL.Path {
+	case "/account":
+		w.Header().Set("Location", ca.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"status":"valid"}`))
+	case "/order":
+		ca.orders++
+		ca.authzStatus, ca.orderStatus, ca.chain = "pending", "pending", nil
+		w.Header().Set("Location", ca.URL+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		ca.writeOrder(w)
+	case "/order/1":
+		ca.writeOrder(w)
+	case "/authz/1":
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"status":     ca.authzStatus,
+			"identifier": map[string]string{"type": "dns", "value": "localhost"},
+			"challenges": []map[string]string{
+				{"type": server.ACMEHTTP01, "url": ca.URL + "/challenge/http", "token": "http-token"},
+				{"type": server.ACMEDNS01, "url": ca.URL + "/challenge/dns", "token": "dns-token"},
+			},
+		})
+	case "/challenge/dns":
+		ca.authzStatus = "valid"
+		if ca.failChallenge {
+			ca.authzStatus = "invalid"
+		}
+		_, _ = w.Write([]byte(`{}`))
+	case "/finalize":
+		var finalize struct {
+			CSR string `json:"csr"`
+		}
+		_ = json.Unmarshal(payload, &finalize)
+		der, _ := base64.RawURLEncoding.DecodeString(finalize.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if ca.authzStatus != "valid" || err != nil || csr.CheckSignature() != nil {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"type":"urn:ietf:params:acme:error:badCSR","detail":"refused"}`))
+			return
+		}
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(ca.orders)),
+			Subject:      pkix.Name{CommonName: csr.Subject.CommonName},
+			Issuer:       pkix.Name{CommonName: "Fake ACME CA"},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		}
+		issuer := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "Fake ACME CA"}}
+		cert, err := x509.CreateCertificate(rand.Reader, template, issuer, csr.PublicKey, ca.key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ca.chain = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})
+		ca.orderStatus = "valid"
+		ca.writeOrder(w)
+	case "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(ca.chain)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (ca *fakeACME) writeOrder(w http.ResponseWriter) {
+	order := map[string]any{
+		"status":         ca.orderStatus,
+		"authorizations": []string{ca.URL + "/authz/1"},
+		"finalize":       ca.URL + "/finalize",
+	}
+	if ca.orderStatus == "valid" {
+		order["certificate"] = ca.URL + "/cert"
+	}
+	_ = json.NewEncoder(w).Encode(order)
+}
+
+// counts returns the orders placed and the requests refused for a bad nonce so far.
+func (ca *fakeACME) counts() (int, int) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.orders, ca.refused
+}
+
+// startACMEServer runs a server that obtains its certificate for localhost from the CA, with DNS-01 challenges
+// answered by a hook that logs its calls, until the test ends. prepare may store files in the ACME directory
+// before. It returns the server, the ACME directory, the path of the log of the hook and a channel closed once Run
+// returned.
+func startACMEServer(t *testing.T, ca *fakeACME, prepare func(acmeDir string)) (*server.Server, string, string, chan struct{}) {
+	dir := t.TempDir()
+	err := server.InitCA(dir, []string{"localhost"}, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acmeDir := filepath.Join(dir, "acme")
+	err = os.MkdirAll(acmeDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prepare != nil {
+		prepare(acmeDir)
+	}
+	hookLog := filepath.Join(dir, "hook.log")
+	hook := filepath.Join(dir, "hook.sh")
+	err = os.WriteFile(hook, []byte("#!/bin/sh\necho \"$1 $2\" >> "+hookLog+"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := server.DefaultConfig()
+	config.CAFile = filepath.Join(dir, server.CAFILE)
+	config.CtrlAddr = "127.0.0.1"
+	config.CtrlPort = freeTestPort(t)
+	config.DataPort = freeTestPort(t)
+	config.ACME = server.ACMEConfig{Domains: []string{"localhost"}, Directory: ca.URL + "/directory", Dir: acmeDir,
+		Challenge: server.ACMEDNS01, DNSHook: hook}
+	s := &server.Server{Config: config, Logger: setupTestLogger()}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	return s, acmeDir, hookLog, stopped
+}
+
+// waitReady waits until the server is ready, or fails the test if Run returns or it takes too long.
+func waitReady(t *testing.T, s *server.Server, stopped chan struct{}) {
+	deadline := time.After(10 * server.ACMEPOLLINTERVAL)
+	for s.Ready() != nil {
+		select {
+		case <-stopped:
+			t.Fatal("Expected the server to run")
+		case <-deadline:
+			t.Fatal("Expected the server to be ready, got", s.Ready())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// storedIssuer returns the common name of the issuer of the certificate in the ACME directory.
+func storedIssuer(t *testing.T, acmeDir string) string {
+	data, err := os.ReadFile(filepath.Join(acmeDir, server.SERVERCERTFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("Expected a PEM certificate, got", string(data))
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert.Issuer.CommonName
+}
+
+func TestACMEObtain(t *testing.T) {
+	ca := newFakeACME(t)
+	// the order is refused for a bad nonce twice, the client retries with the fresh nonces
+	ca.badNonces = 2
+	s, acmeDir, hookLog, stopped := startACMEServer(t, ca, nil)
+	waitReady(t, s, stopped)
+
+	if orders, refused := ca.counts(); orders != 1 || refused != 2 {
+		t.Error("Expected one order after two bad nonces, got", orders, "orders and", refused, "refused requests")
+	}
+	if issuer := storedIssuer(t, acmeDir); issuer != "Fake ACME CA" {
+		t.Error("Expected the certificate of the CA to be stored, got one of", issuer)
+	}
+	if _, err := os.Stat(filepath.Join(acmeDir, "account.key")); err != nil {
+		t.Error("Expected the account key to be stored", err)
+	}
+	calls, _ := os.ReadFile(hookLog)
+	if string(calls) != "present _acme-challenge.localhost\ncleanup _acme-challenge.localhost\n" {
+		t.Errorf("Expected the TXT record to be presented and cleaned up, got %q", calls)
+	}
+}
+
+func TestACMEFailedChallenge(t *testing.T) {
+	ca := newFakeACME(t)
+	ca.failChallenge = true
+	_, acmeDir, hookLog, stopped := startACMEServer(t, ca, nil)
+
+	// without a certificate to fall back to, the server can't start
+	select {
+	case <-stopped:
+	case <-time.After(10 * server.ACMEPOLLINTERVAL):
+		t.Fatal("Expected the server to stop without certificate")
+	}
+	if _, err := os.Stat(filepath.Join(acmeDir, server.SERVERCERTFILE)); !os.IsNotExist(err) {
+		t.Error("Expected no certificate to be stored, got", err)
+	}
+	calls, _ := os.ReadFile(hookLog)
+	if !strings.HasSuffix(string(calls), "cleanup _acme-challenge.localhost\n") {
+		t.Errorf("Expected the TXT record to be cleaned up after the failure, got %q", calls)
+	}
+}
+
+func TestACMERenewal(t *testing.T) {
+	tests := []struct {
+		name     string
+		domain   string
+		validity time.Duration
+		renewed  bool
+	}{
+		{"valid", "localhost", server.ACMERENEWBEFORE + 24*time.Hour, false},
+		{"due", "localhost", server.ACMERENEWBEFORE - 24*time.Hour, true},
+		{"other domain", "example.com", server.ACMERENEWBEFORE + 24*time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca := newFakeACME(t)
+			s, acmeDir, _, stopped := startACMEServer(t, ca, func(acmeDir string) {
+				writeSelfSignedFor(t, tt.domain, tt.validity, filepath.Join(acmeDir, server.SERVERCERTFILE), filepath.Join(acmeDir, server.SERVERKEYFILE))
+			})
+			waitReady(t, s, stopped)
+			orders, _ := ca.counts()
+			if renewed := orders > 0; renewed != tt.renewed {
+				t.Error("Expected renewal", tt.renewed, "got", orders, "orders")
+			}
+			if issuer := storedIssuer(t, acmeDir); (issuer == "Fake ACME CA") != tt.renewed {
+				t.Error("Expected renewal", tt.renewed, "got a certificate of", issuer)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAddressFamily(t *testing.T) {
+	if l, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("No IPv6 loopback", err)
+	} else {
+		_ = l.Close()
+	}
+	for family, families := range map[string]string{server.FAMILYDUAL: "ipv4,ipv6", server.FAMILYIPV4: "ipv4"} {
+		t.Run(family, func(t *testing.T) {
+			_, dir, port, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+				config.AddressFamily = family
+			})
+			conn := dialClient(t, dir, port)
+			defer conn.Close()
+			publicPort := strconv.Itoa(freeTestPort(t))
+			fr := exposeFrame(t, conn, publicPort)
+			if fr.Typ != Utils.CTRLEXPOSED || len(fr.Data) != 6 || fr.Data[5] != families {
+				t.Fatal("Expected the port to be exposed over", families, "got", fr)
+			}
+			for _, ip := range []string{"127.0.0.1", "::1"} {
+				visitor, err := net.DialTimeout("tcp", net.JoinHostPort(ip, publicPort), 5*time.Second)
+				reachable := err == nil
+				if reachable {
+					_ = visitor.Close()
+				}
+				expected := family == server.FAMILYDUAL || ip == "127.0.0.1"
+				if reachable != expected {
+					t.Error("Expected the public port to be reachable on", ip, expected, "got", err)
+				}
+			}
+		})
+	}
+}
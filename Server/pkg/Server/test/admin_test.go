@@ -0,0 +1,528 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func freeTestPort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startAdminServer runs a server with the admin API, the token "secret" and the keys monitoring-key-0123 of the read
+// role and oncall-key-01234567 of the operator role until the test ends and returns it with the
+// directory of its certificates, its control port and the address of the admin API.
+func startAdminServer(t *testing.T) (*server.Server, string, int, string) {
+	dir := t.TempDir()
+	err := server.InitCA(dir, []string{"localhost"}, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.IssueClient(dir, dir, "alice", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := freeTestPort(t)
+	adminAddr := "127.0.0.1:" + strconv.Itoa(freeTestPort(t))
+
+	config := server.DefaultConfig()
+	config.CAFile = filepath.Join(dir, server.CAFILE)
+	config.CertFile = filepath.Join(dir, server.SERVERCERTFILE)
+	config.KeyFile = filepath.Join(dir, server.SERVERKEYFILE)
+	config.CtrlAddr = "127.0.0.1"
+	config.CtrlPort = port
+	// a valid config, so the settings can be changed
+	config.DataPort = freeTestPort(t)
+	config.AdminAddr = adminAddr
+	config.AdminToken = "secret"
+	config.AdminKeys = map[string]server.AdminKey{
+		"monitoring-key-0123": {Name: "monitoring", Role: server.ADMINROLEREAD},
+		"oncall-key-01234567": {Name: "oncall", Role: server.ADMINROLEOPERATOR},
+	}
+	s := &server.Server{Config: config, Logger: setupTestLogger()}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	for s.Ready() != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s, dir, port, adminAddr
+}
+
+// dialClient connects to the server with the certificate of alice.
+func dialClient(t *testing.T, dir string, port int) *tls.Conn {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, server.CLIENTCERTFILE), filepath.Join(dir, server.CLIENTKEYFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port), &tls.Config{Certificates: []tls.Certificate{pair}, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestAdminAPI(t *testing.T) {
+	s, dir, port, adminAddr := startAdminServer(t)
+	events := make(eventRecorder, 10)
+	unsubscribe := s.Subscribe(events)
+	defer unsubscribe()
+
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	select {
+	case <-events:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the client to connect")
+	}
+
+	// admins need no client certificate, only the token
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, Timeout: 5 * time.Second}
+	call := func(method string, path string, token string) *http.Response {
+		req, err := http.NewRequest(method, "https://"+adminAddr+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	for _, token := range []string{"", "wrong"} {
+		resp := call(http.MethodGet, server.ADMINPATH+"clients", token)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Error("Expected a request with token", token, "to be unauthorized, got", resp.Status)
+		}
+	}
+
+	// the dashboard is served without token, it holds no data
+	resp := call(http.MethodGet, server.DASHBOARDPATH, "")
+	page, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !bytes.Contains(page, []byte(server.ADMINPATH)) {
+		t.Error("Expected the dashboard, got", resp.Status, resp.Header)
+	}
+
+	resp = call(http.MethodGet, server.ADMINPATH+"events", "secret")
+	var recent []server.AdminEvent
+	err := json.NewDecoder(resp.Body).Decode(&recent)
+	_ = resp.Body.Close()
+	if err != nil || len(recent) != 1 || recent[0].Kind != server.EVENTCLIENTCONNECTED || recent[0].CN != "alice" {
+		t.Error("Expected the event of alice connecting, got", recent, err)
+	}
+
+	resp = call(http.MethodGet, server.ADMINPATH+"clients", "secret")
+	var clients []server.AdminClient
+	err = json.NewDecoder(resp.Body).Decode(&clients)
+	_ = resp.Body.Close()
+	if err != nil || len(clients) != 1 || clients[0].CN != "alice" {
+		t.Fatal("Expected alice to be listed, got", clients, err)
+	}
+	id := strconv.FormatUint(clients[0].ID, 10)
+
+	// keys may do what their role allows
+	resp = call(http.MethodGet, server.ADMINPATH+"clients/"+id, "monitoring-key-0123")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error("Expected a read key to read the client, got", resp.Status)
+	}
+	for _, token := range []string{"monitoring-key-0123", "oncall-key-01234567"} {
+		resp = call(http.MethodDelete, server.ADMINPATH+"clients/"+id, token)
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Error("Expected the key", token, "not to disconnect clients, got", resp.Status)
+		}
+	}
+	resp = call(http.MethodDelete, server.ADMINPATH+"clients/"+id+"/tunnels/tcp/8080", "monitoring-key-0123")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected a read key not to hide ports, got", resp.Status)
+	}
+
+	resp = call(http.MethodDelete, server.ADMINPATH+"clients/"+id+"/tunnels/tcp/8080", "oncall-key-01234567")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Expected a port not exposed to be not found, got", resp.Status)
+	}
+
+	resp = call(http.MethodDelete, server.ADMINPATH+"clients/"+id+"?reason=maintenance", "secret")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Error("Expected the client to be disconnected, got", resp.Status)
+	}
+	// the client is told to stop instead of reconnecting, and why
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	fr, err := Utils.ReadFrame(conn)
+	if err != nil || fr.Typ != Utils.CTRLUNPAIR || len(fr.Data) != 1 || fr.Data[0] != "maintenance" {
+		t.Error("Expected the client to be unpaired with the reason, got", fr, err)
+	}
+	select {
+	case event := <-events:
+		if event.Kind != server.EVENTCLIENTDISCONNECTED || event.Reason != "maintenance" {
+			t.Error("Expected the client to be disconnected for maintenance, got", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the client to disconnect")
+	}
+
+	for i := 0; i < 100; i++ {
+		resp = call(http.MethodGet, server.ADMINPATH+"clients/"+id, "secret")
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Expected the disconnected client to be not found, got", resp.Status)
+	}
+}
+
+// stallingConn is a proxy connection of a client that never sees the end of its stream, so the port of a service
+// that doesn't answer stays half-closed.
+type stallingConn struct {
+	net.Conn
+	stop chan struct{}
+}
+
+func (c stallingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if errors.Is(err, io.EOF) {
+		<-c.stop
+	}
+	return n, err
+}
+
+func TestAdminStuckConns(t *testing.T) {
+	_, dir, port, adminAddr := startAdminServer(t)
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+
+	// the service holds its connections without answering
+	service, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	go func() {
+		for {
+			c, err := service.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = c.Close() })
+		}
+	}()
+	public := freeTestPort(t)
+	if fr := exposeFrame(t, conn, strconv.Itoa(public)); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	serveProxyConnsWith(t, dir, conn, service.Addr().String(), func(c net.Conn) net.Conn {
+		return stallingConn{Conn: c, stop: stop}
+	})
+
+	visitor, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(public))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	_, _ = io.WriteString(visitor, "hello\n")
+	_ = visitor.(*net.TCPConn).CloseWrite()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, Timeout: 5 * time.Second}
+	var tunnel server.AdminTunnel
+	for i := 0; i < 100 && tunnel.HalfClosed == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+		req, err := http.NewRequest(http.MethodGet, "https://"+adminAddr+server.ADMINPATH+"clients", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var clients []server.AdminClient
+		err = json.NewDecoder(resp.Body).Decode(&clients)
+		_ = resp.Body.Close()
+		if err != nil || len(clients) != 1 || len(clients[0].Tunnels) != 1 {
+			t.Fatal("Expected alice with the port, got", clients, err)
+		}
+		tunnel = clients[0].Tunnels[0]
+	}
+	if tunnel.HalfClosed != 1 || tunnel.ForceClosed != 0 || tunnel.ActiveConns != 1 {
+		t.Fatal("Expected one half-closed connection, got", tunnel)
+	}
+	// the stack of the pipe still waiting for the client is sampled, the finished one is gone
+	if len(tunnel.StuckStacks) != 1 || !strings.Contains(tunnel.StuckStacks[0], "(*Relay).pipe") {
+		t.Error("Expected the stack of the stuck pipe, got", tunnel.StuckStacks)
+	}
+}
+
+// grpcCall calls the method of the admin service with the protobuf message and returns the response, its body is
+// left to be read.
+func grpcCall(t *testing.T, client *http.Client, adminAddr string, method string, token string, msg []byte) *http.Response {
+	body := binary.BigEndian.AppendUint32([]byte{0}, uint32(len(msg)))
+	req, err := http.NewRequest(http.MethodPost, "https://"+adminAddr+"/"+server.GRPCSERVICE+"/"+method, bytes.NewReader(append(body, msg...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// readGRPCMessage reads the next length-prefixed message of a response.
+func readGRPCMessage(t *testing.T, body io.Reader) []byte {
+	var prefix [5]byte
+	_, err := io.ReadFull(body, prefix[:])
+	if err != nil {
+		t.Fatal("Expected a message", err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	_, err = io.ReadFull(body, msg)
+	if err != nil {
+		t.Fatal("Expected a message", err)
+	}
+	return msg
+}
+
+func TestAdminGRPC(t *testing.T) {
+	_, dir, port, adminAddr := startAdminServer(t)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}, Timeout: 5 * time.Second}
+
+	resp := grpcCall(t, client, adminAddr, "Status", "wrong", nil)
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.Trailer.Get("Grpc-Status") != "16" {
+		t.Error("Expected a call with the wrong token to be unauthenticated, got", resp.Proto, resp.Trailer)
+	}
+
+	// WatchEvents of the kind client_connected, field 1 of the request
+	watch := grpcCall(t, &http.Client{Transport: client.Transport}, adminAddr, "WatchEvents", "secret", append([]byte{0x0a, 16}, "client_connected"...))
+	defer watch.Body.Close()
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	event := readGRPCMessage(t, watch.Body)
+	if !bytes.Contains(event, []byte("client_connected")) || !bytes.Contains(event, []byte("alice")) {
+		t.Errorf("Expected an event of alice connecting, got %q", event)
+	}
+
+	resp = grpcCall(t, client, adminAddr, "Status", "secret", nil)
+	status := readGRPCMessage(t, resp.Body)
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	// field 1, clients, is 1
+	if resp.Trailer.Get("Grpc-Status") != "0" || !bytes.HasPrefix(status, []byte{0x08, 1}) {
+		t.Errorf("Expected the status of one client, got %x %v", status, resp.Trailer)
+	}
+
+	resp = grpcCall(t, client, adminAddr, "Disconnect", "monitoring-key-0123", []byte{0x08, 0x7f})
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.Trailer.Get("Grpc-Status") != "7" {
+		t.Error("Expected a read key not to disconnect clients, got", resp.Trailer)
+	}
+
+	resp = grpcCall(t, client, adminAddr, "Disconnect", "secret", []byte{0x08, 0x7f})
+	_, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.Trailer.Get("Grpc-Status") != "5" {
+		t.Error("Expected an unknown client to be not found, got", resp.Trailer)
+	}
+}
+
+func TestAdminEventStream(t *testing.T) {
+	_, dir, port, adminAddr := startAdminServer(t)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	stream := func(query string, token string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "https://"+adminAddr+server.ADMINPATH+"events/stream"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := stream("?kind=client_moved", "secret")
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected an unknown kind to be refused, got", resp.Status)
+	}
+
+	// read keys may follow the events
+	resp = stream("?kind=tunnel_created&kind=client_connected", "monitoring-key-0123")
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Expected an event stream, got", resp.Status, resp.Header)
+	}
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	var got []string
+	for len(got) < 3 {
+		select {
+		case line := <-lines:
+			got = append(got, line)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected an event, got", got)
+		}
+	}
+	var event server.AdminEvent
+	err := json.Unmarshal([]byte(strings.TrimPrefix(got[1], "data: ")), &event)
+	if got[0] != "event: client_connected" || err != nil || event.Kind != server.EVENTCLIENTCONNECTED || event.CN != "alice" || got[2] != "" {
+		t.Error("Expected an event of alice connecting, got", got, err)
+	}
+}
+
+func TestAdminSettings(t *testing.T) {
+	s, _, _, adminAddr := startAdminServer(t)
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, Timeout: 5 * time.Second}
+	patch := func(body string, token string) (*http.Response, server.AdminSettings) {
+		req, err := http.NewRequest(http.MethodPatch, "https://"+adminAddr+server.ADMINPATH+"settings", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var settings server.AdminSettings
+		_ = json.NewDecoder(resp.Body).Decode(&settings)
+		return resp, settings
+	}
+
+	resp, _ := patch(`{"maxConns": 10}`, "oncall-key-01234567")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected an operator key not to change settings, got", resp.Status)
+	}
+	resp, settings := patch(`{"maxConns": 10, "maxClientConns": 2, "defaultQuota": "3/1", "clientQuotas": {"alice": "5/0"}}`, "secret")
+	if resp.StatusCode != http.StatusOK || settings.MaxConns != 10 || settings.MaxClientConns != 2 || settings.DefaultQuota != "3/1" ||
+		settings.ClientQuotas["alice"] != "5/0" {
+		t.Error("Expected the settings to be changed, got", resp.Status, settings)
+	}
+	for _, body := range []string{`{"maxConns": -1}`, `{"defaultQuota": "3"}`, `{"maxconn": 1}`, `{"logLevel": "debug"}`} {
+		resp, _ = patch(body, "secret")
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Error("Expected the update", body, "to be refused, got", resp.Status)
+		}
+	}
+	resp, settings = patch(`{"clientQuotas": {"alice": ""}}`, "secret")
+	if resp.StatusCode != http.StatusOK || len(settings.ClientQuotas) != 0 || settings.MaxConns != 10 {
+		t.Error("Expected the quota of alice to be removed and the rest kept, got", resp.Status, settings)
+	}
+	if settings := s.Settings(); settings.MaxConns != 10 || settings.DefaultQuota != "3/1" {
+		t.Error("Expected the server to use the changed settings, got", settings)
+	}
+
+	send := func(method string, path string, body string, token string) *http.Response {
+		req, err := http.NewRequest(method, "https://"+adminAddr+server.ADMINPATH+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+	for _, c := range []struct {
+		method, path, body, token string
+		status                    int
+	}{
+		{http.MethodPut, "profiles/alice", `{"DenyUdp": true}`, "oncall-key-01234567", http.StatusForbidden},
+		{http.MethodPut, "profiles/alice", `{"CN": "bob"}`, "secret", http.StatusBadRequest},
+		{http.MethodPut, "profiles/alice", `{"DenyUdp": true, "MaxConns": 3}`, "secret", http.StatusOK},
+		{http.MethodPut, "reserved/8080", `{"cn": "alice"}`, "secret", http.StatusNoContent},
+		{http.MethodPut, "reserved/70000", `{"cn": "alice"}`, "secret", http.StatusBadRequest},
+		{http.MethodDelete, "reserved/8081", "", "secret", http.StatusNotFound},
+		{http.MethodGet, "bans", "", "secret", http.StatusOK},
+		{http.MethodDelete, "bans/192.0.2.1", "", "secret", http.StatusNotFound},
+		{http.MethodDelete, "bans/nonsense", "", "secret", http.StatusBadRequest},
+	} {
+		resp := send(c.method, c.path, c.body, c.token)
+		if resp.StatusCode != c.status {
+			t.Error("Expected", c.method, c.path, c.body, "to be answered with", c.status, "got", resp.Status)
+		}
+	}
+	if p := s.Profiles()["alice"]; !p.DenyUdp || p.MaxConns != 3 || s.ReservedPorts()[8080] != "alice" {
+		t.Error("Expected the profile and the reserved port of alice, got", s.Profiles(), s.ReservedPorts())
+	}
+	for _, path := range []string{"profiles/alice", "reserved/8080"} {
+		resp := send(http.MethodDelete, path, "", "secret")
+		if resp.StatusCode != http.StatusNoContent {
+			t.Error("Expected", path, "to be removed, got", resp.Status)
+		}
+	}
+	if len(s.Profiles()) != 0 || len(s.ReservedPorts()) != 0 {
+		t.Error("Expected no profile and reserved port, got", s.Profiles(), s.ReservedPorts())
+	}
+
+	// the log level can only be changed if the server was given its level
+	level := new(slog.LevelVar)
+	s = &server.Server{Config: server.DefaultConfig(), Logger: setupTestLogger(), LogLevel: level}
+	debug := "DEBUG"
+	settings, err := s.UpdateSettings(server.AdminSettingsUpdate{LogLevel: &debug})
+	if err != nil || level.Level() != slog.LevelDebug || settings.LogLevel != "debug" {
+		t.Error("Expected the log level to be debug, got", level.Level(), settings, err)
+	}
+	verbose := "verbose"
+	_, err = s.UpdateSettings(server.AdminSettingsUpdate{LogLevel: &verbose})
+	if err == nil || level.Level() != slog.LevelDebug {
+		t.Error("Expected an error for an unknown log level, got", level.Level(), err)
+	}
+}
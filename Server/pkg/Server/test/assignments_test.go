@@ -0,0 +1,80 @@
+package test
+
+import (
+	server "Server"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAssignmentsPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "assignments.json")
+	a, err := server.LoadAssignments(path)
+	if err != nil {
+		t.Fatal("Error loading missing assignments file", err)
+	}
+	err = a.Set("alice", "tcp", 8080, 40000)
+	if err != nil {
+		t.Fatal("Error saving assignment", err)
+	}
+	err = a.Set("alice", "udp", 8080, 40001)
+	if err != nil {
+		t.Fatal("Error saving assignment", err)
+	}
+
+	// a restarted server gets the assignments back
+	a, err = server.LoadAssignments(path)
+	if err != nil {
+		t.Fatal("Error loading assignments", err)
+	}
+	if port, ok := a.Get("alice", "tcp", 8080); !ok || port != 40000 {
+		t.Error("Expected public port 40000, got", port, ok)
+	}
+	if _, ok := a.Get("bob", "tcp", 8080); ok {
+		t.Error("Expected no assignment for another client")
+	}
+	err = a.Remove("alice", "udp", 8080)
+	if err != nil {
+		t.Fatal("Error removing assignment", err)
+	}
+	a, _ = server.LoadAssignments(path)
+	if _, ok := a.Get("alice", "udp", 8080); ok {
+		t.Error("Expected the removed assignment to be gone")
+	}
+
+	err = os.WriteFile(path, []byte("{"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.LoadAssignments(path)
+	if err == nil {
+		t.Error("Expected an error for a corrupt assignments file")
+	}
+
+	var none *server.Assignments
+	if _, ok := none.Get("alice", "tcp", 8080); ok || none.Set("alice", "tcp", 8080, 1) != nil {
+		t.Error("Expected a nil Assignments to remember nothing")
+	}
+}
+
+func TestAssignmentsTransfer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "assignments.json")
+	a, _ := server.LoadAssignments(path)
+	_ = a.Set("alice", "tcp", 8080, 40000)
+	_ = a.Set("bob", "tcp", 8080, 40001)
+	_ = a.Set("carol", "udp", 27015, 40002)
+	err := a.Transfer("alice", "bob")
+	if err != nil {
+		t.Fatal("Error transferring assignments", err)
+	}
+	a, _ = server.LoadAssignments(path)
+	if port, ok := a.Get("bob", "tcp", 8080); !ok || port != 40000 {
+		t.Error("Expected the public port of alice for bob, got", port, ok)
+	}
+	if _, ok := a.Get("alice", "tcp", 8080); ok {
+		t.Error("Expected alice to have no assignments left")
+	}
+	if port, ok := a.Get("carol", "udp", 27015); !ok || port != 40002 {
+		t.Error("Expected the assignment of carol to be kept, got", port, ok)
+	}
+}
@@ -0,0 +1,80 @@
+package test
+
+import (
+	server "Server"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	err := os.WriteFile(path, []byte(`[
+		{"CN": "alice", "Token": "2f1c0a7e9b6d4c3a8e5f"},
+		{"CN": "bob", "Token": "9d8c7b6a5f4e3d2c1b0a"}
+	]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := server.LoadTokens(path)
+	if err != nil {
+		t.Fatal("Error loading tokens", err)
+	}
+	if tokens["2f1c0a7e9b6d4c3a8e5f"] != "alice" || tokens["9d8c7b6a5f4e3d2c1b0a"] != "bob" {
+		t.Error("Expected the tokens of alice and bob, got", tokens)
+	}
+
+	config := server.DefaultConfig()
+	config.AuthTokens = tokens
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected the tokens to be valid", err)
+	}
+	config.AuthTokens["short"] = "carol"
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a short token")
+	}
+	delete(config.AuthTokens, "short")
+	config.JWT.Secret = []byte("secret")
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a short JWT secret")
+	}
+
+	err = os.WriteFile(path, []byte(`[{"CN": "alice", "Token": "2f1c0a7e9b6d4c3a8e5f"}, {"CN": "bob", "Token": "2f1c0a7e9b6d4c3a8e5f"}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.LoadTokens(path)
+	if err == nil {
+		t.Error("Expected an error for duplicate tokens")
+	}
+}
+
+func TestLoadAdminKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "adminkeys.json")
+	err := os.WriteFile(path, []byte(`[
+		{"Name": "monitoring", "Key": "6b1f0c9e8d7a6b5c4d3e", "Role": "read"},
+		{"Name": "oncall", "Key": "1a2b3c4d5e6f7a8b9c0d", "Role": "operator"}
+	]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := server.LoadAdminKeys(path)
+	if err != nil {
+		t.Fatal("Error loading admin keys", err)
+	}
+	if keys["6b1f0c9e8d7a6b5c4d3e"].Role != server.ADMINROLEREAD || keys["1a2b3c4d5e6f7a8b9c0d"].Name != "oncall" {
+		t.Error("Expected the keys of monitoring and oncall, got", keys)
+	}
+
+	err = os.WriteFile(path, []byte(`[{"Name": "a", "Key": "6b1f0c9e8d7a6b5c4d3e", "Role": "read"}, {"Name": "b", "Key": "6b1f0c9e8d7a6b5c4d3e", "Role": "admin"}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.LoadAdminKeys(path)
+	if err == nil {
+		t.Error("Expected an error for duplicate keys")
+	}
+}
@@ -0,0 +1,48 @@
+package test
+
+import (
+	server "Server"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadAuthzRules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "authz.json")
+	err := os.WriteFile(path, []byte(`[
+		{"Name": "no-ssh", "Ports": [{"First": 47922, "Last": 47922}], "Deny": true},
+		{"Name": "web", "CN": "web-*", "Networks": ["tcp"], "Ports": [{"First": 47900, "Last": 47910}]}
+	]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := server.LoadAuthzRules(path)
+	if err != nil {
+		t.Fatal("Error loading authorization rules", err)
+	}
+	if len(rules) != 2 || rules[0].Name != "no-ssh" || !rules[0].Deny || rules[1].CN != "web-*" {
+		t.Error("Expected the rules in file order, got", rules)
+	}
+
+	config := server.DefaultConfig()
+	config.AuthzRules = rules
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected the rules to be valid", err)
+	}
+	config.AuthzRules = append(rules, server.AuthzRule{Name: "web"})
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a duplicate rule")
+	}
+	config.AuthzRules = []server.AuthzRule{{Name: "quic", Networks: []string{"quic"}}}
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for an unknown network")
+	}
+	config.AuthzRules = []server.AuthzRule{{Name: "pattern", CN: "["}}
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for an invalid CN pattern")
+	}
+}
@@ -0,0 +1,131 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	s, dir, port, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		config.BanThreshold = 2
+	})
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	denied := freeTestPort(t)
+	if fr := exposeFrame(t, conn, strconv.Itoa(denied), "deny=127.0.0.1"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+
+	relayHello(t, denied)
+	if bans := s.Bans(); len(bans) != 0 {
+		t.Fatal("Expected no ban below the threshold, got", bans)
+	}
+	relayHello(t, denied)
+	bans := s.Bans()
+	if len(bans) != 1 || bans[0].IP != "127.0.0.1" || bans[0].Reason != server.FAILBLOCKED || time.Until(bans[0].Until) < 10*time.Minute {
+		t.Fatal("Expected the peer to be banned for its blocked connections, got", bans)
+	}
+
+	// the banned peer can't open control connections either
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, server.CLIENTCERTFILE), filepath.Join(dir, server.CLIENTKEYFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if banned, err := tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port), &tls.Config{Certificates: []tls.Certificate{pair}, InsecureSkipVerify: true}); err == nil {
+		_ = banned.Close()
+		t.Error("Expected the control connection of a banned IP to be refused")
+	}
+
+	if err := s.Unban("127.0.0.1"); err != nil {
+		t.Fatal("Expected the ban to be lifted", err)
+	}
+	if err := s.Unban("127.0.0.1"); !errors.Is(err, server.ErrNotBanned) {
+		t.Error("Expected an error for an IP that isn't banned, got", err)
+	}
+	if err := s.Unban("localhost"); err == nil {
+		t.Error("Expected an error for an invalid IP")
+	}
+	other := dialClient(t, dir, port)
+	_ = other.Close()
+}
+
+// closingService accepts connections and closes them right away, like a service refusing its visitors. It returns
+// the address of the service.
+func closingService(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// visitSilently opens a connection to the port without sending anything, and closes it once the server closed it
+// or right away.
+func visitSilently(t *testing.T, port int, wait bool) {
+	c, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if wait {
+		_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+		_, _ = io.ReadAll(c)
+	}
+}
+
+func TestBanDisconnects(t *testing.T) {
+	s, dir, port, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		config.BanThreshold = 2
+	})
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+
+	// the connections the service closes before the visitor sends anything don't count
+	closing := freeTestPort(t)
+	if fr := exposeFrame(t, conn, strconv.Itoa(closing)); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+	serveProxyConns(t, dir, conn, closingService(t))
+	for i := 0; i < 4; i++ {
+		visitSilently(t, closing, true)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if bans := s.Bans(); len(bans) != 0 {
+		t.Fatal("Expected no ban for connections closed by the service, got", bans)
+	}
+
+	// the connections the visitor closes before sending anything do
+	other := dialClient(t, dir, port)
+	defer other.Close()
+	waiting := freeTestPort(t)
+	if fr := exposeFrame(t, other, strconv.Itoa(waiting)); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+	serveProxyConns(t, dir, other, echoUntilHello(t))
+	for i := 0; i < 50 && len(s.Bans()) == 0; i++ {
+		visitSilently(t, waiting, false)
+		time.Sleep(50 * time.Millisecond)
+	}
+	bans := s.Bans()
+	if len(bans) != 1 || bans[0].Reason != server.FAILDISCONNECT {
+		t.Fatal("Expected the peer to be banned for its disconnects, got", bans)
+	}
+}
@@ -0,0 +1,55 @@
+package test
+
+import (
+	server "Server"
+	"crypto/tls"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInitCAAndIssueClient(t *testing.T) {
+	dir := t.TempDir()
+	err := server.InitCA(dir, []string{"example.com", "127.0.0.1"}, 24*time.Hour, false)
+	if err != nil {
+		t.Fatal("Error creating CA", err)
+	}
+	err = server.InitCA(dir, []string{"example.com"}, 24*time.Hour, false)
+	if err == nil {
+		t.Error("Expected an error replacing the CA without force")
+	}
+	out := filepath.Join(dir, "alice")
+	err = server.IssueClient(dir, out, "alice", []string{"red"}, 24*time.Hour)
+	if err != nil {
+		t.Fatal("Error issuing client certificate", err)
+	}
+
+	ca, _, err := server.LoadCA(dir)
+	if err != nil {
+		t.Fatal("Error loading CA", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	serverPair, err := tls.LoadX509KeyPair(filepath.Join(dir, server.SERVERCERTFILE), filepath.Join(dir, server.SERVERKEYFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCert, _ := x509.ParseCertificate(serverPair.Certificate[0])
+	_, err = serverCert.Verify(x509.VerifyOptions{Roots: roots, DNSName: "example.com"})
+	if err != nil {
+		t.Error("Expected the server certificate to be valid for example.com", err)
+	}
+	clientPair, err := tls.LoadX509KeyPair(filepath.Join(out, server.CLIENTCERTFILE), filepath.Join(out, server.CLIENTKEYFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, _ := x509.ParseCertificate(clientPair.Certificate[0])
+	_, err = clientCert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	if err != nil {
+		t.Error("Expected the client certificate to be valid", err)
+	}
+	if clientCert.Subject.CommonName != "alice" || len(clientCert.Subject.OrganizationalUnit) != 1 || clientCert.Subject.OrganizationalUnit[0] != "red" {
+		t.Error("Expected the subject of alice, got", clientCert.Subject)
+	}
+}
@@ -0,0 +1,142 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// requestCertificate sends the CSR in a CTRLCERT frame and returns the chunks of the answer of the server, up to
+// the one with no more to come.
+func requestCertificate(t *testing.T, conn net.Conn, csr string) []*Utils.CTRLFrame {
+	err := Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLCERT, []string{csr}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var chunks []*Utils.CTRLFrame
+	for {
+		fr, err := Utils.ReadFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr.Typ != Utils.CTRLCERT {
+			continue
+		}
+		chunks = append(chunks, fr)
+		if len(fr.Data) < 2 || fr.Data[1] == "0" {
+			return chunks
+		}
+	}
+}
+
+// newCSR returns the base64 encoded CSR of a new key for the CN, with the key.
+func newCSR(t *testing.T, cn string) (string, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(der), key
+}
+
+func TestCertificateRenewal(t *testing.T) {
+	// enough organizational units that the certificate takes more than one chunk
+	var ous []string
+	for i := 0; i < 8; i++ {
+		ous = append(ous, "unit-"+strings.Repeat(string(rune('a'+i)), 40))
+	}
+	_, dir, port, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		// a certificate that is due for renewal
+		err := server.IssueClient(dir, dir, "alice", ous, server.CERTRENEWWINDOW/2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.CAKeyFile = filepath.Join(dir, server.CAKEYFILE)
+	})
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+
+	csr, key := newCSR(t, "alice")
+	chunks := requestCertificate(t, conn, csr)
+	if len(chunks) < 2 {
+		t.Fatal("Expected the certificate in several chunks, got", chunks)
+	}
+	var encoded string
+	for i, fr := range chunks {
+		// every chunk tells how many are still to come
+		if len(fr.Data) != 2 || fr.Data[0] == "" || len(fr.Data[0]) > Utils.CERTCHUNK || fr.Data[1] != strconv.Itoa(len(chunks)-i-1) {
+			t.Fatal("Expected chunk", i, "of", len(chunks), "got", fr)
+		}
+		encoded += fr.Data[0]
+	}
+	der, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _, err := server.LoadCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok || !pub.Equal(&key.PublicKey) {
+		t.Error("Expected the certificate for the key of the CSR")
+	}
+	// the CN and the organizational units of the current certificate are kept
+	if cert.Subject.CommonName != "alice" || !slices.Equal(cert.Subject.OrganizationalUnit, ous) || cert.CheckSignatureFrom(ca) != nil ||
+		!slices.Contains(cert.ExtKeyUsage, x509.ExtKeyUsageClientAuth) || time.Until(cert.NotAfter) < server.CERTRENEWWINDOW {
+		t.Error("Expected a client certificate of alice issued by the CA, got", cert.Subject, cert.Issuer, cert.ExtKeyUsage, cert.NotAfter)
+	}
+}
+
+func TestCertificateRenewalRefused(t *testing.T) {
+	_, dir, port, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		config.CAKeyFile = filepath.Join(dir, server.CAKEYFILE)
+	})
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+
+	other, _ := newCSR(t, "mallory")
+	valid, _ := newCSR(t, "alice")
+	raw, _ := base64.StdEncoding.DecodeString(valid)
+	// a flipped bit in the signature at the end of the CSR
+	raw[len(raw)-1] ^= 1
+	tests := []struct {
+		name   string
+		csr    string
+		reason string
+	}{
+		{"oversized", strings.Repeat("A", Utils.MAXCSR+4), "CSR longer than"},
+		{"not base64", "not base64!", "malformed CSR"},
+		{"not a CSR", base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0x30}, 64)), "malformed CSR"},
+		{"bad signature", base64.StdEncoding.EncodeToString(raw), "invalid CSR signature"},
+		{"other CN", other, "CSR for another CN"},
+	}
+	for _, tt := range tests {
+		chunks := requestCertificate(t, conn, tt.csr)
+		if len(chunks) != 1 || len(chunks[0].Data) != 3 || chunks[0].Data[0] != "" || chunks[0].Data[1] != "0" ||
+			!strings.HasPrefix(chunks[0].Data[2], tt.reason) {
+			t.Error("Expected the", tt.name, "CSR to be refused with", tt.reason, "got", chunks)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package test
+
+import (
+	server "Server"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir := t.TempDir()
+	err := server.InitCA(dir, []string{"localhost"}, 24*time.Hour, false)
+	if err != nil {
+		t.Fatal("Error creating CA", err)
+	}
+	config := server.DefaultConfig()
+	config.CAFile = filepath.Join(dir, server.CAFILE)
+	config.CertFile = filepath.Join(dir, server.SERVERCERTFILE)
+	config.KeyFile = filepath.Join(dir, server.SERVERKEYFILE)
+	config.CAKeyFile = filepath.Join(dir, server.CAKEYFILE)
+	errs := config.Check()
+	if len(errs) != 0 {
+		t.Error("Expected the config to be fine, got", errs)
+	}
+
+	config.CtrlPort = config.DataPort
+	config.CertFile = filepath.Join(dir, "missing.crt")
+	config.CAKeyFile = filepath.Join(dir, server.SERVERKEYFILE)
+	config.ReservedPorts = map[int]string{config.ProxyPorts.First: "alice"}
+	errs = config.Check()
+	if len(errs) != 4 {
+		t.Error("Expected errors for the ports, the reserved port, the certificate and the CA key, got", errs)
+	}
+}
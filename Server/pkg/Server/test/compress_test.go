@@ -0,0 +1,61 @@
+package test
+
+import (
+	"Utils"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompressedTunnel(t *testing.T) {
+	_, dir, port, _ := startHTTPFrontServer(t, nil)
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	for _, option := range []string{"compress=zstd", "compress=brotli"} {
+		if fr := exposeFrame(t, conn, strconv.Itoa(freeTestPort(t)), option); fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRINVALID {
+			t.Error("Expected", option, "to be rejected, got", fr)
+		}
+	}
+	exposed := freeTestPort(t)
+	if fr := exposeFrame(t, conn, strconv.Itoa(exposed), "compress=json"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+	if fr := exposeFrame(t, conn, strconv.Itoa(exposed), "compress=http"); fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRIMMUTABLE {
+		t.Error("Expected the compression to be immutable, got", fr)
+	}
+	dict, _ := Utils.CompressionDictionary(Utils.COMPRESSJSON)
+	var wireIn atomic.Uint64
+	serveProxyConnsWith(t, dir, conn, echoUntilHello(t), func(c net.Conn) net.Conn {
+		return Utils.NewCompressedConn(c, dict, &wireIn, nil)
+	})
+
+	message := strings.Repeat(`{"id":1,"status":"ok","message":"hello"}`, 20) + "hello\n"
+	c, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(exposed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = c.Write([]byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, len(message))
+	n := 0
+	for n < len(message) {
+		m, err := c.Read(received[n:])
+		if err != nil {
+			t.Fatal("Expected the message to be echoed", err)
+		}
+		n += m
+	}
+	if string(received) != message {
+		t.Errorf("Expected the message to be echoed, got %q", received)
+	}
+	if wire := wireIn.Load(); wire == 0 || wire >= uint64(len(message)) {
+		t.Error("Expected the message to be compressed on the proxy connection, took", wire, "bytes for", len(message))
+	}
+}
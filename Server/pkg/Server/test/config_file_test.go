@@ -0,0 +1,134 @@
+package test
+
+import (
+	"Server/config"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "goexpose.toml")
+	err := os.WriteFile(path, []byte(`# server settings
+loglevel = "debug" # inline comment
+
+[ports]
+ctrlport = 47_921
+deniedports = ["22", "3306",]
+randomports = true
+
+[tls]
+cafile = 'C:\certs\ca #1.pem'
+certfile = "/etc/goexpose/server.crt"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := config.Load(path)
+	if err != nil {
+		t.Fatal("Error loading config file", err)
+	}
+	expected := config.File{
+		"loglevel":          "debug",
+		"ports.ctrlport":    "47921",
+		"ports.deniedports": "22,3306",
+		"ports.randomports": "true",
+		"tls.cafile":        `C:\certs\ca #1.pem`,
+		"tls.certfile":      "/etc/goexpose/server.crt",
+	}
+	for key, value := range expected {
+		if file[key] != value {
+			t.Error("Expected", key, "to be", value, "got", file[key])
+		}
+	}
+
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	logLevel := fs.String("loglevel", "info", "")
+	ctrlPort := fs.Int("ctrlport", 1, "")
+	deniedPorts := fs.String("deniedports", "", "")
+	randomPorts := fs.Bool("randomports", false, "")
+	caFile := fs.String("cafile", "", "")
+	certFile := fs.String("certfile", "", "")
+	err = fs.Parse([]string{"-loglevel", "warn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_GOEXPOSE_CERT_FILE", "/env/server.crt")
+	err = file.Apply(fs, map[string]string{"certfile": "TEST_GOEXPOSE_CERT_FILE", "cafile": "TEST_GOEXPOSE_CA_FILE"})
+	if err != nil {
+		t.Fatal("Error applying config file", err)
+	}
+	if *logLevel != "warn" {
+		t.Error("Expected the command line to take precedence, got", *logLevel)
+	}
+	if *certFile != "" {
+		t.Error("Expected the environment to take precedence, got", *certFile)
+	}
+	if *ctrlPort != 47921 || *deniedPorts != "22,3306" || !*randomPorts || *caFile != `C:\certs\ca #1.pem` {
+		t.Error("Expected the settings of the file, got", *ctrlPort, *deniedPorts, *randomPorts, *caFile)
+	}
+
+	err = config.File{"ports.ctrlprot": "1"}.Apply(fs, nil)
+	if err == nil {
+		t.Error("Expected an error for an unknown setting")
+	}
+	fs = flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.Int("ctrlport", 1, "")
+	err = config.File{"ctrlport": "port"}.Apply(fs, nil)
+	if err == nil {
+		t.Error("Expected an error for an invalid value")
+	}
+	for _, invalid := range []string{"ctrlport = ", "[ports", "ctrlport = 1\nctrlport = 2", "ports = [\"1\"", "name = \"open"} {
+		_, err = config.Parse([]byte(invalid))
+		if err == nil {
+			t.Error("Expected an error for", invalid)
+		}
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	ctrlPort := fs.Int("ctrlport", 1, "")
+	caFile := fs.String("cafile", "", "")
+	systemCAs := fs.Bool("systemcas", false, "")
+	maxConns := fs.Int("maxconns", 0, "")
+	err := fs.Parse([]string{"-maxconns", "10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"cafile": "GOEXPOSE_CA_FILE"}
+	if config.EnvName("ctrlport", env) != "GOEXPOSE_CTRLPORT" || config.EnvName("cafile", env) != "GOEXPOSE_CA_FILE" {
+		t.Error("Expected GOEXPOSE_CTRLPORT and GOEXPOSE_CA_FILE, got", config.EnvName("ctrlport", env), config.EnvName("cafile", env))
+	}
+	t.Setenv("GOEXPOSE_CTRLPORT", "47000")
+	t.Setenv("GOEXPOSE_CA_FILE", "/run/secrets/ca.pem")
+	t.Setenv("GOEXPOSE_SYSTEMCAS", "true")
+	t.Setenv("GOEXPOSE_MAXCONNS", "20")
+	err = config.ApplyEnv(fs, env)
+	if err != nil {
+		t.Fatal("Error applying environment", err)
+	}
+	if *ctrlPort != 47000 || *caFile != "/run/secrets/ca.pem" || !*systemCAs {
+		t.Error("Expected the settings of the environment, got", *ctrlPort, *caFile, *systemCAs)
+	}
+	if *maxConns != 10 {
+		t.Error("Expected the command line to take precedence, got", *maxConns)
+	}
+	err = config.File{"ctrlport": "48000"}.Apply(fs, env)
+	if err != nil || *ctrlPort != 47000 {
+		t.Error("Expected the environment to take precedence over the file, got", *ctrlPort, err)
+	}
+
+	t.Setenv("GOEXPOSE_CTRLPORT", "port")
+	err = config.ApplyEnv(flag.NewFlagSet("server", flag.ContinueOnError), env)
+	if err != nil {
+		t.Error("Expected variables of unknown flags to be ignored", err)
+	}
+	fs = flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.Int("ctrlport", 1, "")
+	err = config.ApplyEnv(fs, env)
+	if err == nil {
+		t.Error("Expected an error for an invalid value")
+	}
+}
@@ -0,0 +1,338 @@
+package test
+
+import (
+	server "Server"
+	"testing"
+	"time"
+)
+
+func TestParsePortRange(t *testing.T) {
+	r, err := server.ParsePortRange("47923-47932")
+	if err != nil || r.First != 47923 || r.Last != 47932 || r.Size() != 10 {
+		t.Error("Expected 47923-47932, got", r, err)
+	}
+	r, err = server.ParsePortRange("8080")
+	if err != nil || !r.Contains(8080) || r.Size() != 1 {
+		t.Error("Expected the single port 8080, got", r, err)
+	}
+	for _, s := range []string{"", "a-b", "2000-1000", "0-10", "1000-70000"} {
+		_, err = server.ParsePortRange(s)
+		if err == nil {
+			t.Error("Expected an error for", s)
+		}
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := server.DefaultConfig()
+	err := config.Validate()
+	if err != nil {
+		t.Error("Expected the default config to be valid", err)
+	}
+	config.DataPort = config.ProxyPorts.First
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a data port inside the proxy port range")
+	}
+	config = server.DefaultConfig()
+	config.ExposedPorts = server.PortRange{First: 1024, Last: 40000}
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a public=any range outside the exposed range")
+	}
+	config = server.DefaultConfig()
+	config.PortLease = time.Second
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a lease shorter than the minimum")
+	}
+	config = server.DefaultConfig()
+	config.DuplicateSessions = "kick"
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for an unknown duplicate session policy")
+	}
+	config = server.DefaultConfig()
+	config.NoiseAddr = "127.0.0.1:7000"
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a Noise listener without key file")
+	}
+	config.NoiseKeyFile = "noise.key"
+	config.NoiseClients = map[string]string{"embedded": "not a key"}
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for an invalid Noise key of a client")
+	}
+	config = server.DefaultConfig()
+	config.AddressFamily = "ipx"
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for an unknown address family")
+	}
+	config = server.DefaultConfig()
+	config.AddressFamily = server.FAMILYIPV6
+	config.PublicAddr = "192.0.2.1"
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a bind address outside the address family")
+	}
+	config.PublicAddr = "::"
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected the unspecified address to be valid in any address family", err)
+	}
+	config = server.DefaultConfig()
+	config.MaxClientConns = -1
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a negative connection limit")
+	}
+	config = server.DefaultConfig()
+	config.CtrlRatePerIP = -1
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a negative connection rate")
+	}
+	config = server.DefaultConfig()
+	config.BanThreshold = 3
+	config.BanDuration = 0
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for bans without duration")
+	}
+	config = server.DefaultConfig()
+	config.Profiles = map[string]server.Profile{"alice": {CN: "alice", AllowCountries: []string{"DE"}}}
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for country lists without GeoIP database")
+	}
+	config.GeoIPFile = "country.mmdb"
+	config.Profiles["alice"] = server.Profile{CN: "alice", AllowCountries: []string{"de"}}
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for an invalid country")
+	}
+	config = server.DefaultConfig()
+	config.CtrlAddr = "10.0.0.1"
+	config.PublicAddr = "::"
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected IPv4 and IPv6 bind addresses to be valid", err)
+	}
+	config.DataAddr = "localhost"
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a bind address that is no IP address")
+	}
+	config = server.DefaultConfig()
+	config.ProxyProtocolFrom = []string{"10.0.0.0/8", "2001:db8::1"}
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected addresses and prefixes of load balancers to be valid", err)
+	}
+	config.ProxyProtocolFrom = []string{"lb.example.com"}
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a load balancer that is no address or prefix")
+	}
+	config = server.DefaultConfig()
+	config.OTLPEndpoint = "http://localhost:4318/v1/traces"
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected an http OTLP endpoint to be valid", err)
+	}
+	config.OTLPEndpoint = "localhost:4318"
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for an OTLP endpoint that is no http URL")
+	}
+	config = server.DefaultConfig()
+	for _, addr := range []string{"localhost:6060", "127.0.0.1:6060", "[::1]:6060"} {
+		config.PprofAddr = addr
+		err = config.Validate()
+		if err != nil {
+			t.Error("Expected a loopback pprof address to be valid", addr, err)
+		}
+	}
+	for _, addr := range []string{":6060", "0.0.0.0:6060", "example.com:6060", "127.0.0.1"} {
+		config.PprofAddr = addr
+		err = config.Validate()
+		if err == nil {
+			t.Error("Expected an error for the pprof address", addr)
+		}
+	}
+	config = server.DefaultConfig()
+	config.AdminAddr = ":8443"
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for an admin API without token")
+	}
+	config.AdminToken = "secret"
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected an admin API with token to be valid", err)
+	}
+	config.AdminToken = ""
+	config.AdminKeys = map[string]server.AdminKey{"monitoring-key-0123": {Name: "monitoring", Role: server.ADMINROLEREAD}}
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected an admin API with keys to be valid", err)
+	}
+	for key, k := range map[string]server.AdminKey{
+		"short":               {Name: "short", Role: server.ADMINROLEREAD},
+		"monitoring-key-0123": {Role: server.ADMINROLEREAD},
+		"oncall-key-01234567": {Name: "oncall", Role: "root"},
+	} {
+		config.AdminKeys = map[string]server.AdminKey{key: k}
+		err = config.Validate()
+		if err == nil {
+			t.Error("Expected an error for the admin key", k)
+		}
+	}
+	config = server.DefaultConfig()
+	config.Webhooks = []server.Webhook{{URL: "https://hooks.example.com/goexpose", Secret: "webhook-secret-0123", Kinds: []string{server.EVENTRELAYERROR}}}
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected a webhook to be valid", err)
+	}
+	for _, w := range []server.Webhook{
+		{URL: "ftp://hooks.example.com", Secret: "webhook-secret-0123"},
+		{URL: "https://hooks.example.com", Secret: "short"},
+		{URL: "https://hooks.example.com", Secret: "webhook-secret-0123", Kinds: []string{"client_kicked"}},
+	} {
+		config.Webhooks = []server.Webhook{w}
+		err = config.Validate()
+		if err == nil {
+			t.Error("Expected an error for the webhook", w)
+		}
+	}
+	config = server.DefaultConfig()
+	config.StoreFile = "state.db"
+	config.StoreDriver = "etcd"
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for an unknown store driver")
+	}
+	config.StoreDriver = server.STOREJSON
+	config.AssignmentsFile = "assignments.json"
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for an assignments file next to the store")
+	}
+	config = server.DefaultConfig()
+	config.HTTPAddr = ":80"
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for an HTTP front without domains")
+	}
+	config.HTTPDomains = []string{"tunnels.example.com"}
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected an HTTP front with domains to be valid", err)
+	}
+	for _, domain := range []string{"Tunnels.example.com", "-tunnels.example.com", "tunnels..example.com"} {
+		config.HTTPDomains = []string{domain}
+		err = config.Validate()
+		if err == nil {
+			t.Error("Expected an error for the HTTP domain", domain)
+		}
+	}
+	config.HTTPDomains = []string{"tunnels.example.com"}
+	config.HTTPCertFile = "front.crt"
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for an HTTP front certificate without key")
+	}
+	config.HTTPCertFile = ""
+	config.HTTPACME = true
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for ACME certificates of the HTTP front without HTTPS address")
+	}
+	config.HTTPSAddr = ":443"
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected ACME certificates of the HTTP front to be valid", err)
+	}
+	config.ACME.Challenge = server.ACMEDNS01
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for an ACME DNS challenge without hook")
+	}
+	config = server.DefaultConfig()
+	config.HTTPOIDC = server.OIDCConfig{Issuer: "https://login.example.com", ClientID: "goexpose"}
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected an OIDC provider to be valid", err)
+	}
+	for _, oidc := range []server.OIDCConfig{{Issuer: "login.example.com", ClientID: "goexpose"}, {Issuer: "https://login.example.com"}} {
+		config.HTTPOIDC = oidc
+		err = config.Validate()
+		if err == nil {
+			t.Error("Expected an error for the OIDC provider", oidc)
+		}
+	}
+}
+
+func TestParseQuotas(t *testing.T) {
+	q, err := server.ParseQuota("10/5")
+	if err != nil || q.Tcp != 10 || q.Udp != 5 {
+		t.Error("Expected 10/5, got", q, err)
+	}
+	for _, s := range []string{"", "10", "a/5", "10/-1"} {
+		_, err = server.ParseQuota(s)
+		if err == nil {
+			t.Error("Expected an error for", s)
+		}
+	}
+	quotas, err := server.ParseClientQuotas("alice=2/0,bob=0/1")
+	if err != nil || quotas["alice"] != (server.Quota{Tcp: 2}) || quotas["bob"] != (server.Quota{Udp: 1}) {
+		t.Error("Expected the quotas of alice and bob, got", quotas, err)
+	}
+	_, err = server.ParseClientQuotas("=1/1")
+	if err == nil {
+		t.Error("Expected an error for a quota without CN")
+	}
+}
+
+func TestParseDeniedAndReservedPorts(t *testing.T) {
+	denied, err := server.ParsePortRanges("1-1023,3306")
+	if err != nil || len(denied) != 2 || !denied[0].Contains(22) || !denied[1].Contains(3306) {
+		t.Error("Expected 1-1023 and 3306, got", denied, err)
+	}
+	denied, err = server.ParsePortRanges("")
+	if err != nil || len(denied) != 0 {
+		t.Error("Expected no ranges, got", denied, err)
+	}
+	_, err = server.ParsePortRanges("22,x")
+	if err == nil {
+		t.Error("Expected an error for an invalid range")
+	}
+
+	reserved, err := server.ParseReservedPorts("8443=alice,25565=bob")
+	if err != nil || reserved[8443] != "alice" || reserved[25565] != "bob" {
+		t.Error("Expected the ports of alice and bob, got", reserved, err)
+	}
+	for _, s := range []string{"8443", "8443=", "x=alice", "70000=alice"} {
+		_, err = server.ParseReservedPorts(s)
+		if err == nil {
+			t.Error("Expected an error for", s)
+		}
+	}
+}
+
+func TestParsePrivilegedClients(t *testing.T) {
+	clients, err := server.ParsePrivilegedClients("alice,bob")
+	if err != nil || !clients["alice"] || !clients["bob"] || clients["carol"] {
+		t.Error("Expected alice and bob, got", clients, err)
+	}
+	clients, err = server.ParsePrivilegedClients("")
+	if err != nil || len(clients) != 0 {
+		t.Error("Expected no clients, got", clients, err)
+	}
+	_, err = server.ParsePrivilegedClients("alice,,bob")
+	if err == nil {
+		t.Error("Expected an error for an empty CN")
+	}
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// egressSession requests egress on the control connection and returns the client side of the inline session, fed
+// with the CTRLDATA frames of the connection. It fails the test if the server refuses.
+func egressSession(t *testing.T, conn net.Conn) *Utils.MuxSession {
+	err := Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLEGRESS, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	fr, err := Utils.ReadFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.Typ != Utils.CTRLEGRESS {
+		t.Fatal("Expected egress to be accepted, got", fr)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	frameConn := Utils.NewFrameConn(func(fr *Utils.CTRLFrame) error {
+		return Utils.WriteFrame(conn, fr)
+	}, conn.LocalAddr(), conn.RemoteAddr())
+	go func() {
+		for {
+			fr, err := Utils.ReadFrame(conn)
+			if err != nil {
+				_ = frameConn.Close()
+				return
+			}
+			if fr.Typ == Utils.CTRLDATA {
+				_ = frameConn.Deliver(fr)
+			}
+		}
+	}()
+	session := Utils.NewMuxSession(frameConn, true)
+	t.Cleanup(func() { _ = session.Close() })
+	return session
+}
+
+// openEgress opens an egress stream to the address and returns it with the answer of the server.
+func openEgress(t *testing.T, session *Utils.MuxSession, address string) (net.Conn, byte) {
+	st, err := session.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Utils.WriteEgressHeader(st, address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = st.SetReadDeadline(time.Now().Add(15 * time.Second))
+	answer := make([]byte, 1)
+	_, err = io.ReadFull(st, answer)
+	if err != nil {
+		t.Fatal("Expected an answer to the egress header", err)
+	}
+	_ = st.SetReadDeadline(time.Time{})
+	return st, answer[0]
+}
+
+func TestEgress(t *testing.T) {
+	service := echoUntilHello(t)
+	_, dir, port, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		config.EgressClients = []string{"alice"}
+		config.EgressNetworks = []string{"127.0.0.0/8"}
+	})
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	session := egressSession(t, conn)
+
+	st, answer := openEgress(t, session, service)
+	if answer != Utils.EGRESSOK {
+		t.Fatal("Expected the egress stream to be connected, got", answer)
+	}
+	_ = st.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.WriteString(st, "hello\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make([]byte, 6)
+	_, err = io.ReadFull(st, received)
+	if err != nil || string(received) != "hello\n" {
+		t.Error("Expected the echo through the egress stream, got", string(received), err)
+	}
+	_ = st.Close()
+
+	_, answer = openEgress(t, session, "127.0.0.1:1")
+	if answer != Utils.EGRESSFAILED {
+		t.Error("Expected a closed port to fail, got", answer)
+	}
+	_, answer = openEgress(t, session, "192.0.2.1:80")
+	if answer != Utils.EGRESSDENIED {
+		t.Error("Expected a destination outside the egress networks to be denied, got", answer)
+	}
+}
+
+func TestEgressForbidden(t *testing.T) {
+	_, dir, port, _ := startHTTPFrontServer(t, nil)
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	err := Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLEGRESS, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	fr, err := Utils.ReadFrame(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr.Typ != Utils.CTRLERROR || len(fr.Data) < 4 || fr.Data[3] != Utils.ERRFORBIDDEN {
+		t.Error("Expected egress of a client not allowed to be refused, got", fr)
+	}
+}
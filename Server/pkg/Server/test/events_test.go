@@ -0,0 +1,101 @@
+package test
+
+import (
+	server "Server"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type eventRecorder chan server.Event
+
+func (r eventRecorder) HandleEvent(event server.Event) {
+	r <- event
+}
+
+func TestClientEvents(t *testing.T) {
+	dir := t.TempDir()
+	err := server.InitCA(dir, []string{"localhost"}, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.IssueClient(dir, dir, "alice", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+
+	config := server.DefaultConfig()
+	config.CAFile = filepath.Join(dir, server.CAFILE)
+	config.CertFile = filepath.Join(dir, server.SERVERCERTFILE)
+	config.KeyFile = filepath.Join(dir, server.SERVERKEYFILE)
+	config.CtrlAddr = "127.0.0.1"
+	config.CtrlPort = port
+	config.DataPort = 0
+	s := server.Server{Config: config, Logger: setupTestLogger()}
+	events := make(eventRecorder, 10)
+	unsubscribe := s.Subscribe(events)
+	defer unsubscribe()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+	for s.Ready() != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, server.CLIENTCERTFILE), filepath.Join(dir, server.CLIENTKEYFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port), &tls.Config{Certificates: []tls.Certificate{pair}, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func(kind string) server.Event {
+		select {
+		case event := <-events:
+			if event.Kind != kind || event.Client.CN != "alice" || event.ClientID == 0 || event.Time.IsZero() {
+				t.Error("Expected a", kind, "event of alice, got", event)
+			}
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a", kind, "event")
+			return server.Event{}
+		}
+	}
+	connected := next(server.EVENTCLIENTCONNECTED)
+	_ = conn.Close()
+	disconnected := next(server.EVENTCLIENTDISCONNECTED)
+	if disconnected.ClientID != connected.ClientID {
+		t.Error("Expected the same session to disconnect, got", connected.ClientID, disconnected.ClientID)
+	}
+
+	// the metrics count the events with a subscriber of their own
+	var metrics bytes.Buffer
+	for i := 0; i < 100 && !strings.Contains(metrics.String(), `goexpose_events_total{kind="client_disconnected"} 1`); i++ {
+		time.Sleep(10 * time.Millisecond)
+		metrics.Reset()
+		err = s.WriteMetrics(&metrics)
+	}
+	if err != nil || !strings.Contains(metrics.String(), `goexpose_events_total{kind="client_connected"} 1`) {
+		t.Error("Expected the connected client to be counted, got", metrics.String(), err)
+	}
+}
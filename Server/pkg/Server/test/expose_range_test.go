@@ -0,0 +1,172 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// freeTestRange returns the first of size consecutive ports that are free.
+func freeTestRange(t *testing.T, size int) int {
+	for attempt := 0; attempt < 20; attempt++ {
+		first := freeTestPort(t)
+		var listeners []net.Listener
+		for port := first; port < first+size; port++ {
+			l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+			if err != nil {
+				break
+			}
+			listeners = append(listeners, l)
+		}
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+		if len(listeners) == size {
+			return first
+		}
+	}
+	t.Fatal("No free range of", size, "ports")
+	return 0
+}
+
+// rangeOf formats the range of size ports starting at first like an EXPOSE frame carries it.
+func rangeOf(first int, size int) string {
+	return strconv.Itoa(first) + "-" + strconv.Itoa(first+size-1)
+}
+
+// listening reports whether the server accepts connections on the public port.
+func listening(port int) bool {
+	c, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(port), time.Second)
+	if err != nil {
+		return false
+	}
+	_ = c.Close()
+	return true
+}
+
+func TestExposeRange(t *testing.T) {
+	_, dir, port, _ := startHTTPFrontServer(t, nil)
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+
+	first := freeTestRange(t, 3)
+	fr := exposeFrame(t, conn, rangeOf(first, 3))
+	// every port of the range is answered on its own, in any order, on the public port of the same offset
+	exposed := make(map[string]string)
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			fr = readAnswer(t, conn)
+		}
+		if fr.Typ != Utils.CTRLEXPOSED {
+			t.Fatal("Expected the ports of the range to be exposed, got", fr)
+		}
+		exposed[fr.Data[1]] = fr.Data[2]
+	}
+	for p := first; p < first+3; p++ {
+		if exposed[strconv.Itoa(p)] != strconv.Itoa(p) || !listening(p) {
+			t.Error("Expected port", p, "to be exposed on the same public port, got", exposed)
+		}
+	}
+
+	// a range overlapping an exposed port is refused as a whole
+	fr = exposeFrame(t, conn, rangeOf(first+2, 2))
+	if fr.Typ != Utils.CTRLERROR || fr.Data[1] != rangeOf(first+2, 2) || fr.Data[3] != Utils.ERRUNAVAILABLE {
+		t.Error("Expected the overlapping range to be unavailable, got", fr)
+	}
+	if fr := exposeFrame(t, conn, rangeOf(first, server.MAXEXPOSERANGE+1)); fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRINVALID {
+		t.Error("Expected a range larger than", server.MAXEXPOSERANGE, "to be invalid, got", fr)
+	}
+	if fr := exposeFrame(t, conn, rangeOf(first+3, 2), "name=game"); fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRINVALID {
+		t.Error("Expected a named range to be invalid, got", fr)
+	}
+
+	// the range is hidden at once
+	err := Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLHIDETCP, []string{rangeOf(first, 3)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 100 && listening(first+i); j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if listening(first + i) {
+			t.Error("Expected port", first+i, "to be hidden")
+		}
+	}
+}
+
+func TestExposeRangePartialFailure(t *testing.T) {
+	_, dir, port, _ := startHTTPFrontServer(t, nil)
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+
+	// the middle port of the range is taken by another process
+	first := freeTestRange(t, 3)
+	taken, err := net.Listen("tcp", ":"+strconv.Itoa(first+1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := exposeFrame(t, conn, rangeOf(first, 3))
+	_ = taken.Close()
+	if fr.Typ != Utils.CTRLERROR || fr.Data[1] != rangeOf(first, 3) {
+		t.Fatal("Expected the range to fail, got", fr)
+	}
+	// the ports prepared before the failure are released
+	for _, p := range []int{first, first + 2} {
+		l, err := net.Listen("tcp", ":"+strconv.Itoa(p))
+		if err != nil {
+			t.Error("Expected port", p, "to be released, got", err)
+			continue
+		}
+		_ = l.Close()
+	}
+
+	// with the port free again, the range can be exposed
+	fr = exposeFrame(t, conn, rangeOf(first, 3))
+	if fr.Typ != Utils.CTRLEXPOSED {
+		t.Error("Expected the range to be exposed, got", fr)
+	}
+}
+
+func TestExposeRangeQuota(t *testing.T) {
+	_, dir, port, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		config.DefaultQuota = server.Quota{Tcp: 3}
+	})
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+
+	single := freeTestPort(t)
+	if fr := exposeFrame(t, conn, strconv.Itoa(single)); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+	// the range counts with all of its ports
+	first := freeTestRange(t, 3)
+	fr := exposeFrame(t, conn, rangeOf(first, 3))
+	if fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRQUOTA {
+		t.Error("Expected the range to exceed the quota, got", fr)
+	}
+	if listening(first) {
+		t.Error("Expected no port of the refused range to be exposed")
+	}
+	fr = exposeFrame(t, conn, rangeOf(first, 2))
+	if fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the range within the quota to be exposed, got", fr)
+	}
+	if fr = readAnswer(t, conn); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the second port of the range to be exposed, got", fr)
+	}
+
+	// hiding the range frees its share of the quota
+	err := Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLHIDETCP, []string{rangeOf(first, 2)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := freeTestRange(t, 2)
+	fr = exposeFrame(t, conn, rangeOf(other, 2))
+	if fr.Typ != Utils.CTRLEXPOSED {
+		t.Error("Expected a range to fit the quota again, got", fr)
+	}
+}
@@ -0,0 +1,156 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"encoding/binary"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// mmdbString encodes a string of the data section of a MaxMind DB file, up to 28 bytes.
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+// mmdbUint encodes an unsigned integer of the data section of a MaxMind DB file as uint32.
+func mmdbUint(v uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{6<<5 | 4}, v)
+}
+
+// writeGeoIP writes a MaxMind DB file of the IP version with record size 24, mapping the prefixes to countries, and
+// returns its path. Prefixes of IPv4 are mapped below ::/96 in a database of IPv6, those of IPv6 are left out of a
+// database of IPv4.
+func writeGeoIP(t *testing.T, ipVersion int, countries map[string]string) string {
+	type node struct{ records [2]int }
+	// records of -1 are empty, below -1 point to the data of country -2-n
+	nodes := []node{{[2]int{-1, -1}}}
+	var data []byte
+	var offsets []int
+	for prefix, country := range countries {
+		p := netip.MustParsePrefix(prefix)
+		if ipVersion == 4 && p.Addr().Is6() {
+			continue
+		}
+		bits, addr := p.Bits(), p.Addr().AsSlice()
+		if ipVersion == 6 && p.Addr().Is4() {
+			addr = append(make([]byte, 12), addr...)
+			bits += 96
+		}
+		offsets = append(offsets, len(data))
+		// {"country": {"iso_code": country}}
+		data = append(data, 7<<5|1)
+		data = append(data, mmdbString("country")...)
+		data = append(data, 7<<5|1)
+		data = append(data, mmdbString("iso_code")...)
+		data = append(data, mmdbString(country)...)
+		n := 0
+		for i := 0; i < bits; i++ {
+			bit := addr[i/8] >> (7 - i%8) & 1
+			if i == bits-1 {
+				nodes[n].records[bit] = -2 - (len(offsets) - 1)
+				break
+			}
+			if nodes[n].records[bit] < 0 {
+				nodes = append(nodes, node{[2]int{-1, -1}})
+				nodes[n].records[bit] = len(nodes) - 1
+			}
+			n = nodes[n].records[bit]
+		}
+	}
+	var db []byte
+	for _, n := range nodes {
+		for _, r := range n.records {
+			value := r
+			if r == -1 {
+				value = len(nodes)
+			} else if r < -1 {
+				value = len(nodes) + 16 + offsets[-2-r]
+			}
+			db = append(db, byte(value>>16), byte(value>>8), byte(value))
+		}
+	}
+	db = append(db, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, server.MMDBMETADATA...)
+	db = append(db, 7<<5|3)
+	db = append(db, mmdbString("node_count")...)
+	db = append(db, mmdbUint(uint32(len(nodes)))...)
+	db = append(db, mmdbString("record_size")...)
+	db = append(db, mmdbUint(24)...)
+	db = append(db, mmdbString("ip_version")...)
+	db = append(db, mmdbUint(uint32(ipVersion))...)
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	err := os.WriteFile(path, db, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGeoIP(t *testing.T) {
+	countries := map[string]string{"127.0.0.0/8": "DE", "192.0.2.0/24": "fr", "2001:db8::/32": "NL"}
+	for _, ipVersion := range []int{4, 6} {
+		g, err := server.OpenGeoIP(writeGeoIP(t, ipVersion, countries))
+		if err != nil {
+			t.Fatal("Expected the database to open", err)
+		}
+		expected := map[string]string{"127.0.0.1": "DE", "::ffff:127.1.2.3": "DE", "192.0.2.200": "FR", "198.51.100.1": ""}
+		if ipVersion == 6 {
+			expected["2001:db8::1"] = "NL"
+			expected["2001:db9::1"] = ""
+		}
+		for ip, country := range expected {
+			if got := g.Country(netip.MustParseAddr(ip)); got != country {
+				t.Error("Expected", ip, "to be in", country, "of the database of IPv"+strconv.Itoa(ipVersion), "got", got)
+			}
+		}
+	}
+	if _, err := server.OpenGeoIP(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("Expected an error for a missing database")
+	}
+}
+
+func TestCountryLists(t *testing.T) {
+	s, dir, port, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		config.GeoIPFile = writeGeoIP(t, 6, map[string]string{"127.0.0.0/8": "DE"})
+	})
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	if fr := exposeFrame(t, conn, strconv.Itoa(freeTestPort(t)), "allowcountry=Germany"); fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRINVALID {
+		t.Error("Expected an invalid country to be rejected, got", fr)
+	}
+	denied, allowed, elsewhere := freeTestPort(t), freeTestPort(t), freeTestPort(t)
+	for p, option := range map[int]string{denied: "denycountry=de", allowed: "allowcountry=DE", elsewhere: "allowcountry=FR"} {
+		if fr := exposeFrame(t, conn, strconv.Itoa(p), option); fr.Typ != Utils.CTRLEXPOSED {
+			t.Fatal("Expected the port to be exposed with", option, "got", fr)
+		}
+	}
+	serveProxyConns(t, dir, conn, echoUntilHello(t))
+	for p, expected := range map[int]string{denied: "", allowed: "hello\n", elsewhere: ""} {
+		if received := relayHello(t, p); received != expected {
+			t.Errorf("Expected %q on port %d, got %q", expected, p, received)
+		}
+	}
+
+	// the lists of the profile apply to all ports of the client
+	err := s.SetProfile(server.Profile{CN: "alice", DenyCountries: []string{"DE"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received := relayHello(t, allowed); received != "" {
+		t.Errorf("Expected the profile to block the peer, got %q", received)
+	}
+}
+
+func TestCountryListsWithoutDatabase(t *testing.T) {
+	_, dir, port, _ := startHTTPFrontServer(t, nil)
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	if fr := exposeFrame(t, conn, strconv.Itoa(freeTestPort(t)), "allowcountry=DE"); fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRINVALID {
+		t.Error("Expected country lists to be rejected without GeoIP database, got", fr)
+	}
+}
@@ -0,0 +1,47 @@
+package test
+
+import (
+	server "Server"
+	"crypto/tls"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHandshakeThrottle(t *testing.T) {
+	s, dir, port, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		config.HandshakeFailures = 2
+		config.BanThreshold = 3
+	})
+	ctrlAddr := "127.0.0.1:" + strconv.Itoa(port)
+	// a scanner speaking no TLS fails the handshake, the server closes the connection
+	scan := func() {
+		c, err := net.Dial("tcp", ctrlAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+		_, _ = io.WriteString(c, "GET / HTTP/1.0\r\n\r\n")
+		_, _ = io.ReadAll(c)
+	}
+	scan()
+	other := dialClient(t, dir, port)
+	_ = other.Close()
+	scan()
+
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, server.CLIENTCERTFILE), filepath.Join(dir, server.CLIENTKEYFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throttled, err := tls.Dial("tcp", ctrlAddr, &tls.Config{Certificates: []tls.Certificate{pair}, InsecureSkipVerify: true}); err == nil {
+		_ = throttled.Close()
+		t.Error("Expected the control connection of a throttled IP to be refused")
+	}
+	if bans := s.Bans(); len(bans) != 0 {
+		t.Error("Expected no ban below the threshold, got", bans)
+	}
+}
@@ -0,0 +1,33 @@
+package test
+
+import (
+	server "Server"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHealthChecks(t *testing.T) {
+	s := server.Server{Config: server.DefaultConfig(), Logger: setupTestLogger()}
+	if err := s.Healthy(); err != nil {
+		t.Error("Expected a server not started yet to be healthy", err)
+	}
+	err := s.Ready()
+	if err == nil || !strings.Contains(err.Error(), "control listener down") {
+		t.Error("Expected a server not started yet not to be ready, got", err)
+	}
+
+	// without certificates Run fails to start
+	dir := t.TempDir()
+	s.Config.CAFile = filepath.Join(dir, "missing.pem")
+	s.Config.CertFile = filepath.Join(dir, "missing.crt")
+	s.Config.KeyFile = filepath.Join(dir, "missing.key")
+	s.Run(context.Background())
+	if err := s.Healthy(); err == nil {
+		t.Error("Expected a server that failed to start to be unhealthy")
+	}
+	if err := s.Ready(); err == nil {
+		t.Error("Expected a server that failed to start not to be ready")
+	}
+}
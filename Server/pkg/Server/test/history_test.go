@@ -0,0 +1,95 @@
+package test
+
+import (
+	server "Server"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrafficHistory(t *testing.T) {
+	dir := t.TempDir()
+	err := server.InitCA(dir, []string{"localhost"}, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a history saved by an earlier run of the server, one minute ago
+	minute := time.Now().Add(-time.Minute).Truncate(time.Minute)
+	saved := []map[string]any{{
+		"CN": "alice", "Network": "tcp", "Port": 8080,
+		"Minutes": []server.TrafficBucket{{Start: minute, BytesIn: 10, BytesOut: 20, Conns: 1}},
+		"Hours":   []server.TrafficBucket{{Start: minute.Truncate(time.Hour), BytesIn: 10, BytesOut: 20, Conns: 1}},
+	}}
+	data, _ := json.Marshal(saved)
+	historyFile := filepath.Join(dir, "history.json")
+	err = os.WriteFile(historyFile, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := server.DefaultConfig()
+	config.CAFile = filepath.Join(dir, server.CAFILE)
+	config.CertFile = filepath.Join(dir, server.SERVERCERTFILE)
+	config.KeyFile = filepath.Join(dir, server.SERVERKEYFILE)
+	config.CtrlAddr = "127.0.0.1"
+	config.CtrlPort = 0
+	config.DataPort = 0
+	config.HistoryFile = historyFile
+	s := server.Server{Config: config, Logger: setupTestLogger()}
+	if _, err := s.TrafficHistory("alice", "tcp", 8080, false); err == nil {
+		t.Error("Expected no history before the server runs")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.Run(ctx)
+	}()
+	for s.Ready() != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	minutes, err := s.TrafficHistory("alice", "tcp", 8080, false)
+	if err != nil || len(minutes) != server.MINUTEBUCKETS {
+		t.Fatal("Expected an hour of minute buckets, got", len(minutes), err)
+	}
+	// the current minute is the last one, the saved minute the one before unless a minute passed since
+	if b := minutes[len(minutes)-2]; b.Start.Equal(minute) && (b.BytesIn != 10 || b.BytesOut != 20 || b.Conns != 1) {
+		t.Error("Expected the saved minute, got", b)
+	}
+	total := server.TrafficBucket{}
+	for i, b := range minutes {
+		if i > 0 && b.Start.Sub(minutes[i-1].Start) != time.Minute {
+			t.Error("Expected consecutive minutes, got", minutes[i-1].Start, b.Start)
+		}
+		total.BytesIn += b.BytesIn
+	}
+	if total.BytesIn != 10 {
+		t.Error("Expected 10 bytes in over the last hour, got", total.BytesIn)
+	}
+	hours, err := s.TrafficHistory("alice", "tcp", 8080, true)
+	if err != nil || len(hours) != server.HOURBUCKETS {
+		t.Fatal("Expected a day of hour buckets, got", len(hours), err)
+	}
+	if _, err := s.TrafficHistory("bob", "tcp", 8080, false); err == nil {
+		t.Error("Expected no history of a port never exposed")
+	}
+
+	cancel()
+	<-stopped
+	data, err = os.ReadFile(historyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resaved []struct {
+		CN      string
+		Minutes []server.TrafficBucket
+	}
+	err = json.Unmarshal(data, &resaved)
+	if err != nil || len(resaved) != 1 || resaved[0].CN != "alice" || len(resaved[0].Minutes) != 1 {
+		t.Error("Expected the history to be saved again when the server stops, got", string(data), err)
+	}
+}
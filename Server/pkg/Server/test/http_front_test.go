@@ -0,0 +1,879 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// exposeFrame sends the EXPOSE frame of the tcp port with the options and returns the answer of the server.
+func exposeFrame(t *testing.T, conn net.Conn, port string, options ...string) *Utils.CTRLFrame {
+	return exposeFrameOf(t, conn, Utils.CTRLEXPOSETCP, port, options...)
+}
+
+// exposeFrameOf is exposeFrame with the type of the EXPOSE frame, Utils.CTRLEXPOSETCP or Utils.CTRLEXPOSEUDP.
+func exposeFrameOf(t *testing.T, conn net.Conn, typ byte, port string, options ...string) *Utils.CTRLFrame {
+	err := Utils.WriteFrame(conn, Utils.NewCTRLFrame(typ, append([]string{port}, options...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return readAnswer(t, conn)
+}
+
+// readAnswer returns the next CTRLEXPOSED or CTRLERROR frame of the server, e.g. of the further ports of a range.
+func readAnswer(t *testing.T, conn net.Conn) *Utils.CTRLFrame {
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		fr, err := Utils.ReadFrame(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr.Typ == Utils.CTRLEXPOSED || fr.Typ == Utils.CTRLERROR {
+			return fr
+		}
+	}
+}
+
+// startHTTPFrontServer runs a server with an HTTP front for subdomains of tunnels.example.com until the test ends and
+// returns it with the directory of its certificates, its control port and the address of the HTTP front. configure
+// may change the config before the server starts.
+func startHTTPFrontServer(t *testing.T, configure func(config *server.Config, dir string)) (*server.Server, string, int, string) {
+	return startHTTPFrontServerWith(t, configure, nil)
+}
+
+// startHTTPFrontServerWith is startHTTPFrontServer with the access log of the server, if set.
+func startHTTPFrontServerWith(t *testing.T, configure func(config *server.Config, dir string), accessLog *slog.Logger) (*server.Server, string, int, string) {
+	dir := t.TempDir()
+	err := server.InitCA(dir, []string{"localhost"}, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.IssueClient(dir, dir, "alice", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := freeTestPort(t)
+	httpAddr := "127.0.0.1:" + strconv.Itoa(freeTestPort(t))
+
+	config := server.DefaultConfig()
+	config.CAFile = filepath.Join(dir, server.CAFILE)
+	config.CertFile = filepath.Join(dir, server.SERVERCERTFILE)
+	config.KeyFile = filepath.Join(dir, server.SERVERKEYFILE)
+	config.CtrlAddr = "127.0.0.1"
+	config.CtrlPort = port
+	config.DataPort = freeTestPort(t)
+	config.HTTPAddr = httpAddr
+	config.HTTPDomains = []string{"tunnels.example.com"}
+	if configure != nil {
+		configure(&config, dir)
+	}
+	s := &server.Server{Config: config, Logger: setupTestLogger(), AccessLog: accessLog}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	for s.Ready() != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s, dir, port, httpAddr
+}
+
+func TestHTTPFront(t *testing.T) {
+	s, dir, port, httpAddr := startHTTPFrontServer(t, nil)
+	_, httpPort, _ := net.SplitHostPort(httpAddr)
+
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	fr := exposeFrame(t, conn, "8080", "host=App.Tunnels.Example.com.")
+	if fr.Typ != Utils.CTRLEXPOSED || len(fr.Data) != 6 || fr.Data[2] != "0" || fr.Data[4] != "http://app.tunnels.example.com:"+httpPort {
+		t.Fatal("Expected the port to be exposed under the host, got", fr)
+	}
+	for options, code := range map[string]string{
+		"host=app.example.org":               Utils.ERRRANGE,
+		"host=tunnels.example.com":           Utils.ERRRANGE,
+		"host=bad_name.tunnels.example.com":  Utils.ERRINVALID,
+		"host=app.tunnels.example.com":       Utils.ERRUNAVAILABLE,
+		"host=api.tunnels.example.com,other": Utils.ERRINVALID,
+	} {
+		fr = exposeFrame(t, conn, "9090", options)
+		if fr.Typ != Utils.CTRLERROR || len(fr.Data) < 4 || fr.Data[3] != code {
+			t.Error("Expected", options, "to be rejected with", code, "got", fr)
+		}
+	}
+	fr = exposeFrame(t, conn, "8080", "host=api.tunnels.example.com")
+	if fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRIMMUTABLE {
+		t.Error("Expected the host of an exposed port to be immutable, got", fr)
+	}
+	fr = exposeFrame(t, conn, "9090", "host=api.tunnels.example.com", "oidc=*")
+	if fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRINVALID {
+		t.Error("Expected a login to be rejected without OIDC provider, got", fr)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	req, err := http.NewRequest(http.MethodGet, "http://"+httpAddr+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "unknown.tunnels.example.com"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Error("Expected a host without tunnel to be not found, got", resp.Status, string(body))
+	}
+	clients := s.Clients()
+	if len(clients) != 1 || len(clients[0].Tunnels) != 1 || clients[0].Tunnels[0].Host != "app.tunnels.example.com" || clients[0].Tunnels[0].PublicPort != 0 {
+		t.Error("Expected the tunnel of the host, got", clients)
+	}
+}
+
+// serveProxyConns answers the CONNECT frames of the server on the control connection like a client does, the proxy
+// connections are piped to the service once the server starts them.
+func serveProxyConns(t *testing.T, dir string, conn net.Conn, service string) {
+	serveProxyConnsWith(t, dir, conn, service, nil)
+}
+
+// serveProxyConnsWith is serveProxyConns with the started proxy connections passed through wrap, if set.
+func serveProxyConnsWith(t *testing.T, dir string, conn net.Conn, service string, wrap func(net.Conn) net.Conn) {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, server.CLIENTCERTFILE), filepath.Join(dir, server.CLIENTKEYFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	go func() {
+		for {
+			fr, err := Utils.ReadFrame(conn)
+			if err != nil {
+				return
+			}
+			if fr.Typ != Utils.CTRLCONNECT || len(fr.Data) < 5 {
+				continue
+			}
+			go func() {
+				pConn, err := net.Dial("tcp", "127.0.0.1:"+fr.Data[1])
+				if err != nil {
+					return
+				}
+				defer pConn.Close()
+				if fr.Data[4] == "tls" {
+					pConn = tls.Client(pConn, &tls.Config{Certificates: []tls.Certificate{pair}, InsecureSkipVerify: true})
+				}
+				start := make([]byte, 1)
+				if Utils.WriteProxyToken(pConn, fr.Data[3]) != nil {
+					return
+				}
+				if _, err := pConn.Read(start); err != nil || start[0] != Utils.DATASTART {
+					return
+				}
+				if wrap != nil {
+					pConn = wrap(pConn)
+				}
+				local, err := net.Dial("tcp", service)
+				if err != nil {
+					return
+				}
+				defer local.Close()
+				go func() {
+					_, _ = io.Copy(local, pConn)
+					_ = local.Close()
+				}()
+				_, _ = io.Copy(pConn, local)
+			}()
+		}
+	}()
+}
+
+func TestHTTPFrontUpgrade(t *testing.T) {
+	_, dir, port, httpAddr := startHTTPFrontServer(t, nil)
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/echo":
+			// a minimal upgrade, the connection echoes lines afterwards
+			if r.Header.Get("Upgrade") != "echo" || !strings.EqualFold(r.Header.Get("Connection"), "upgrade") {
+				http.Error(w, "upgrade expected", http.StatusBadRequest)
+				return
+			}
+			conn, rw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			_ = rw.Flush()
+			for {
+				line, err := rw.ReadString('\n')
+				if err != nil {
+					return
+				}
+				_, _ = rw.WriteString("echo " + line)
+				_ = rw.Flush()
+			}
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			_, _ = io.WriteString(w, "data: first\n\n")
+			http.NewResponseController(w).Flush()
+			// the first event has to arrive while the stream is still open
+			<-r.Context().Done()
+		}
+	}))
+	defer service.Close()
+
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	fr := exposeFrame(t, conn, "8080", "host=app.tunnels.example.com")
+	if fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed under the host, got", fr)
+	}
+	serveProxyConns(t, dir, conn, service.Listener.Addr().String())
+
+	visitor, err := net.Dial("tcp", httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer visitor.Close()
+	_ = visitor.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.WriteString(visitor, "GET /echo HTTP/1.1\r\nHost: app.tunnels.example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(visitor)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "echo" {
+		t.Fatal("Expected the service to switch protocols, got", resp, err)
+	}
+	for _, line := range []string{"hello\n", "world\n"} {
+		_, _ = io.WriteString(visitor, line)
+		echo, err := br.ReadString('\n')
+		if err != nil || echo != "echo "+line {
+			t.Error("Expected the echo of", line, "got", echo, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+httpAddr+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "app.tunnels.example.com"
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	event, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || event != "data: first\n" {
+		t.Error("Expected the first event while the stream is open, got", event, err)
+	}
+}
+
+func TestHTTPFrontACMECertificate(t *testing.T) {
+	httpsAddr := "127.0.0.1:" + strconv.Itoa(freeTestPort(t))
+	_, _, _, _ = startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		// a stored wildcard certificate that is valid long enough is used without asking the CA
+		front := filepath.Join(dir, "acme", "front")
+		err := os.MkdirAll(front, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeSelfSigned(t, "*.tunnels.example.com", filepath.Join(front, "_.tunnels.example.com.crt"), filepath.Join(front, "_.tunnels.example.com.key"))
+		config.HTTPSAddr = httpsAddr
+		config.HTTPACME = true
+		config.ACME.Dir = filepath.Join(dir, "acme")
+		config.ACME.Directory = "http://127.0.0.1:1/directory"
+		config.ACME.Challenge = server.ACMEDNS01
+		config.ACME.DNSHook = "false"
+	})
+
+	var names []string
+	for i := 0; i < 100; i++ {
+		conn, err := tls.Dial("tcp", httpsAddr, &tls.Config{ServerName: "app.tunnels.example.com", InsecureSkipVerify: true})
+		if err == nil {
+			names = conn.ConnectionState().PeerCertificates[0].DNSNames
+			_ = conn.Close()
+			if len(names) == 1 && names[0] == "*.tunnels.example.com" {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected the wildcard certificate of the domain, got", names)
+}
+
+// writeSelfSigned stores a self-signed certificate of the name, valid for 90 days, and its key.
+func writeSelfSigned(t *testing.T, name string, crtPath string, keyPath string) {
+	writeSelfSignedFor(t, name, 90*24*time.Hour, crtPath, keyPath)
+}
+
+// writeSelfSignedFor is writeSelfSigned with the time the certificate stays valid.
+func writeSelfSignedFor(t *testing.T, name string, validity time.Duration, crtPath string, keyPath string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validity),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(crtPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPFrontHeaderRules(t *testing.T) {
+	_, dir, port, httpAddr := startHTTPFrontServer(t, nil)
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "service/1.0")
+		w.Header().Set("X-Env", r.Header.Get("X-Env"))
+		w.Header().Set("X-Cookie", r.Header.Get("Cookie"))
+		w.Header().Set("X-Seen-Forwarded-For", r.Header.Get("X-Forwarded-For"))
+	}))
+	defer service.Close()
+
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	for _, options := range [][]string{
+		{"header=X-Env:prod"},
+		{"host=app.tunnels.example.com", "header=Connection:close"},
+		{"host=app.tunnels.example.com", "header=X Env:prod"},
+		{"host=app.tunnels.example.com", "header=X-Env"},
+	} {
+		fr := exposeFrame(t, conn, "8080", options...)
+		if fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRINVALID {
+			t.Error("Expected", options, "to be rejected, got", fr)
+		}
+	}
+	fr := exposeFrame(t, conn, "8080", "host=app.tunnels.example.com", "header=x-env: prod", "header=-Cookie",
+		"respheader=-Server", "respheader=X-Frame-Options:DENY", "forwarded=off")
+	if fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed under the host, got", fr)
+	}
+	serveProxyConns(t, dir, conn, service.Listener.Addr().String())
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+httpAddr+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "app.tunnels.example.com"
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Env", "dev")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.Header.Get("X-Env") != "prod" || resp.Header.Get("X-Cookie") != "" || resp.Header.Get("X-Seen-Forwarded-For") != "" {
+		t.Error("Expected the request header rules to be applied, got", resp.Header)
+	}
+	if resp.Header.Get("Server") != "" || resp.Header.Get("X-Frame-Options") != "DENY" {
+		t.Error("Expected the response header rules to be applied, got", resp.Header)
+	}
+}
+
+func TestHTTPFrontAuth(t *testing.T) {
+	var provider *httptest.Server
+	var nonce string
+	provider = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]string{"issuer": provider.URL, "authorization_endpoint": provider.URL + "/authorize", "token_endpoint": provider.URL + "/token"})
+		case "/token":
+			if r.FormValue("code") != "code-of-alice" || r.FormValue("client_id") != "goexpose" || r.FormValue("client_secret") != "front-secret" {
+				http.Error(w, "invalid grant", http.StatusBadRequest)
+				return
+			}
+			claims, _ := json.Marshal(map[string]any{"iss": provider.URL, "aud": "goexpose", "sub": "alice", "exp": time.Now().Add(time.Hour).Unix(),
+				"nonce": nonce, "email": "Alice@Example.com", "email_verified": true})
+			_ = json.NewEncoder(w).Encode(map[string]string{"id_token": "e30." + base64.RawURLEncoding.EncodeToString(claims) + ".c2ln"})
+		}
+	}))
+	defer provider.Close()
+	_, dir, port, httpAddr := startHTTPFrontServer(t, func(config *server.Config, _ string) {
+		config.HTTPOIDC = server.OIDCConfig{Issuer: provider.URL, ClientID: "goexpose", ClientSecret: "front-secret"}
+	})
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Authorization", r.Header.Get("Authorization"))
+		w.Header().Set("X-Cookie", r.Header.Get("Cookie"))
+	}))
+	defer service.Close()
+
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	for _, options := range [][]string{
+		{"basicauth=bob:hunter2"},
+		{"host=app.tunnels.example.com", "basicauth=bob"},
+		{"host=app.tunnels.example.com", "oidc=alice"},
+	} {
+		fr := exposeFrame(t, conn, "8080", options...)
+		if fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRINVALID {
+			t.Error("Expected", options, "to be rejected, got", fr)
+		}
+	}
+	fr := exposeFrame(t, conn, "8080", "host=app.tunnels.example.com", "basicauth=bob:hunter2", "oidc=@example.com")
+	if fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed under the host, got", fr)
+	}
+	serveProxyConns(t, dir, conn, service.Listener.Addr().String())
+
+	client := &http.Client{Timeout: 10 * time.Second, CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(path string, prepare func(req *http.Request)) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "http://"+httpAddr+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "app.tunnels.example.com"
+		if prepare != nil {
+			prepare(req)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	resp := get("/", func(req *http.Request) { req.SetBasicAuth("bob", "hunter2") })
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Authorization") != "" {
+		t.Error("Expected bob to pass without his credentials being passed on, got", resp.Status, resp.Header)
+	}
+	resp = get("/private?tab=1", func(req *http.Request) { req.SetBasicAuth("bob", "wrong") })
+	login, err := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || err != nil || !strings.HasPrefix(login.String(), provider.URL+"/authorize") {
+		t.Fatal("Expected a redirect to the provider, got", resp.Status, resp.Header)
+	}
+	if login.Query().Get("redirect_uri") != "http://app.tunnels.example.com"+server.OIDCCALLBACK {
+		t.Error("Expected the callback of the host as redirect URI, got", login.Query().Get("redirect_uri"))
+	}
+	nonce = login.Query().Get("nonce")
+	var state *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == server.STATECOOKIE {
+			state = cookie
+		}
+	}
+	if state == nil {
+		t.Fatal("Expected a state cookie, got", resp.Header)
+	}
+	callback := server.OIDCCALLBACK + "?code=code-of-alice&state=" + url.QueryEscape(login.Query().Get("state"))
+	resp = get(callback, nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected a login without state cookie to be refused, got", resp.Status)
+	}
+	resp = get(callback, func(req *http.Request) { req.AddCookie(state) })
+	var session *http.Cookie
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == server.SESSIONCOOKIE {
+			session = cookie
+		}
+	}
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/private?tab=1" || session == nil {
+		t.Fatal("Expected alice to be logged in and sent back, got", resp.Status, resp.Header)
+	}
+	resp = get("/private?tab=1", func(req *http.Request) {
+		req.AddCookie(session)
+		req.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+	})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Cookie") != "theme=dark" {
+		t.Error("Expected alice to pass without her session being passed on, got", resp.Status, resp.Header)
+	}
+
+	// a login started on a path browsers take for another host returns to the root instead
+	for _, path := range []string{"//evil.example.com/steal", "//evil.example.com", "/\\evil.example.com"} {
+		resp = get(path, nil)
+		login, err = url.Parse(resp.Header.Get("Location"))
+		if resp.StatusCode != http.StatusFound || err != nil {
+			t.Fatal("Expected a redirect to the provider for", path, "got", resp.Status, resp.Header)
+		}
+		nonce = login.Query().Get("nonce")
+		state = nil
+		for _, cookie := range resp.Cookies() {
+			if cookie.Name == server.STATECOOKIE {
+				state = cookie
+			}
+		}
+		if state == nil {
+			t.Fatal("Expected a state cookie for", path, "got", resp.Header)
+		}
+		resp = get(server.OIDCCALLBACK+"?code=code-of-alice&state="+url.QueryEscape(login.Query().Get("state")), func(req *http.Request) { req.AddCookie(state) })
+		// the backslash is sent escaped, which keeps the path on the host
+		if location := resp.Header.Get("Location"); resp.StatusCode != http.StatusFound || (location != "/" && !strings.HasPrefix(location, "/%5C")) {
+			t.Error("Expected the login started on", path, "to return to a path of the host, got", resp.Status, location)
+		}
+	}
+}
+
+func TestHTTPFrontPathRoutes(t *testing.T) {
+	_, dir, port, httpAddr := startHTTPFrontServer(t, nil)
+	services := make([]*httptest.Server, 2)
+	for i := range services {
+		name := []string{"api", "web"}[i]
+		services[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Service", name)
+			w.Header().Set("X-Path", r.URL.Path)
+		}))
+		defer services[i].Close()
+	}
+
+	// two sessions share the host, the api is only open to bob
+	api := dialClient(t, dir, port)
+	defer api.Close()
+	fr := exposeFrame(t, api, "8080", "host=app.tunnels.example.com", "path=/api/", "strip=on", "basicauth=bob:hunter2")
+	if fr.Typ != Utils.CTRLEXPOSED || fr.Data[4] != "http://app.tunnels.example.com:"+strings.Split(httpAddr, ":")[1]+"/api" {
+		t.Fatal("Expected the api to be exposed below /api, got", fr)
+	}
+	web := dialClient(t, dir, port)
+	defer web.Close()
+	fr = exposeFrame(t, web, "8080", "host=app.tunnels.example.com")
+	if fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the web to be exposed, got", fr)
+	}
+	for options, code := range map[string]string{
+		"path=/api":  Utils.ERRUNAVAILABLE,
+		"path=api":   Utils.ERRINVALID,
+		"path=/a/..": Utils.ERRINVALID,
+	} {
+		fr = exposeFrame(t, web, "9090", "host=app.tunnels.example.com", options)
+		if fr.Typ != Utils.CTRLERROR || fr.Data[3] != code {
+			t.Error("Expected", options, "to be rejected with", code, "got", fr)
+		}
+	}
+	fr = exposeFrame(t, api, "8080", "host=app.tunnels.example.com", "path=/v2")
+	if fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRIMMUTABLE {
+		t.Error("Expected the path of an exposed port to be immutable, got", fr)
+	}
+	serveProxyConns(t, dir, api, services[0].Listener.Addr().String())
+	serveProxyConns(t, dir, web, services[1].Listener.Addr().String())
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for path, want := range map[string][2]string{
+		"/api/users": {"api", "/users"},
+		"/api":       {"api", "/"},
+		"/apis":      {"web", "/apis"},
+		"/":          {"web", "/"},
+	} {
+		req, err := http.NewRequest(http.MethodGet, "http://"+httpAddr+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "app.tunnels.example.com"
+		req.SetBasicAuth("bob", "hunter2")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.Header.Get("X-Service") != want[0] || resp.Header.Get("X-Path") != want[1] {
+			t.Error("Expected", path, "to be routed to", want, "got", resp.Status, resp.Header)
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://"+httpAddr+"/api/users", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "app.tunnels.example.com"
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Error("Expected the api to require authentication, got", resp.Status)
+	}
+}
+
+func TestHTTPFrontErrorPages(t *testing.T) {
+	_, dir, port, httpAddr := startHTTPFrontServer(t, nil)
+	// the services of the ports are unreachable
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serviceAddr := l.Addr().String()
+	_ = l.Close()
+
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	for _, options := range [][]string{
+		{"errors=json"},
+		{"host=app.tunnels.example.com", "errors=xml"},
+	} {
+		fr := exposeFrame(t, conn, "8080", options...)
+		if fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRINVALID {
+			t.Error("Expected", options, "to be rejected, got", fr)
+		}
+	}
+	if fr := exposeFrame(t, conn, "8080", "host=app.tunnels.example.com"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed under the host, got", fr)
+	}
+	if fr := exposeFrame(t, conn, "8081", "host=api.tunnels.example.com", "errors=json"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed under the host, got", fr)
+	}
+	serveProxyConns(t, dir, conn, serviceAddr)
+
+	get := func(host string, accept string) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://"+httpAddr+"/status", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = host
+		req.Header.Set("Accept", accept)
+		resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+	isJSON := func(body string, status int) bool {
+		var e struct {
+			Status int    `json:"status"`
+			Host   string `json:"host"`
+		}
+		return json.Unmarshal([]byte(body), &e) == nil && e.Status == status && e.Host != ""
+	}
+
+	resp, body := get("other.tunnels.example.com", "text/html,*/*;q=0.8")
+	if resp.StatusCode != http.StatusNotFound || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(body, "other.tunnels.example.com/status") {
+		t.Error("Expected an HTML page for an unknown host, got", resp.Status, resp.Header, body)
+	}
+	resp, body = get("other.tunnels.example.com", "application/json")
+	if resp.StatusCode != http.StatusNotFound || !isJSON(body, http.StatusNotFound) {
+		t.Error("Expected JSON for a client accepting JSON only, got", resp.Status, body)
+	}
+	resp, body = get("app.tunnels.example.com", "text/html")
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(body, "unreachable") {
+		t.Error("Expected an HTML page for an unreachable service, got", resp.Status, body)
+	}
+	resp, body = get("api.tunnels.example.com", "text/html")
+	if resp.StatusCode != http.StatusBadGateway || !isJSON(body, http.StatusBadGateway) {
+		t.Error("Expected JSON for an unreachable service of a port with errors=json, got", resp.Status, body)
+	}
+
+	// once the client is gone its hosts are offline, not unknown
+	_ = conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, body = get("api.tunnels.example.com", "text/html")
+		if resp.StatusCode == http.StatusServiceUnavailable || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" || !isJSON(body, http.StatusServiceUnavailable) {
+		t.Error("Expected JSON for the offline port with errors=json, got", resp.Status, resp.Header, body)
+	}
+}
+
+func TestHTTPFrontInspect(t *testing.T) {
+	s, dir, port, httpAddr := startHTTPFrontServer(t, nil)
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write(append(body, '!'))
+	}))
+	defer service.Close()
+
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	if fr := exposeFrame(t, conn, "8080", "inspect=on"); fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRINVALID {
+		t.Error("Expected inspection without host to be rejected, got", fr)
+	}
+	if fr := exposeFrame(t, conn, "8080", "host=app.tunnels.example.com", "inspect=on"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed under the host, got", fr)
+	}
+	err := Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLINSPECT, []string{"tcp", "8080"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the frames asking for the warm pool are skipped, the relay asks again once requests come in
+	fr, err := Utils.ReadFrame(conn)
+	for err == nil && fr.Typ == Utils.CTRLCONNECT {
+		fr, err = Utils.ReadFrame(conn)
+	}
+	if err != nil || fr.Typ != Utils.CTRLINSPECT || len(fr.Data) != 3 || fr.Data[2] != "0" {
+		t.Fatal("Expected a single frame without requests, got", fr, err)
+	}
+	serveProxyConns(t, dir, conn, service.Listener.Addr().String())
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+httpAddr+"/items?secret=1", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "app.tunnels.example.com"
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	clients := s.Clients()
+	if len(clients) != 1 {
+		t.Fatal("Expected one client, got", clients)
+	}
+	requests, err := s.InspectedRequests(clients[0].ID, "tcp", 8080)
+	if err != nil || len(requests) != 1 {
+		t.Fatal("Expected the request to be inspected, got", requests, err)
+	}
+	if r := requests[0]; r.Method != http.MethodPost || r.Path != "/items" || r.Status != http.StatusCreated || r.BytesIn != 5 || r.BytesOut != 6 {
+		t.Error("Expected the method, the path without query, the status and the sizes, got", r)
+	}
+	if _, err := s.InspectedRequests(clients[0].ID, "tcp", 9090); !errors.Is(err, server.ErrNoTunnel) {
+		t.Error("Expected a port not exposed to fail, got", err)
+	}
+
+	// inspection can be turned off by exposing the port again
+	err = Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLEXPOSETCP, []string{"8080", "inspect=off"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err = s.InspectedRequests(clients[0].ID, "tcp", 8080)
+		if errors.Is(err, server.ErrNotInspected) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !errors.Is(err, server.ErrNotInspected) {
+		t.Error("Expected the port to be no longer inspected, got", err)
+	}
+}
+
+func TestHTTPFrontCache(t *testing.T) {
+	_, dir, port, httpAddr := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		config.HTTPCacheSize = 1
+	})
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/static":
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		_, _ = w.Write([]byte("content of " + r.URL.Path))
+	}))
+	defer service.Close()
+
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	if fr := exposeFrame(t, conn, "8080", "cache=on"); fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRINVALID {
+		t.Error("Expected caching without host to be rejected, got", fr)
+	}
+	if fr := exposeFrame(t, conn, "8080", "host=app.tunnels.example.com", "cache=on"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed under the host, got", fr)
+	}
+	serveProxyConns(t, dir, conn, service.Listener.Addr().String())
+
+	get := func(method string, path string, header ...string) *http.Response {
+		req, err := http.NewRequest(method, "http://"+httpAddr+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Host = "app.tunnels.example.com"
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != "content of "+path {
+			t.Error("Expected the content of", path, "got", string(body))
+		}
+		return resp
+	}
+	count := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return hits[path]
+	}
+
+	if resp := get(http.MethodGet, "/static"); resp.Header.Get("X-Cache") != "MISS" {
+		t.Error("Expected the first request to miss the cache, got", resp.Header)
+	}
+	resp := get(http.MethodGet, "/static")
+	if resp.Header.Get("X-Cache") != "HIT" || resp.Header.Get("Age") == "" || count("/static") != 1 {
+		t.Error("Expected the second request to be answered from the cache, got", resp.Header, count("/static"))
+	}
+	get(http.MethodGet, "/static", "Cache-Control", "no-cache")
+	get(http.MethodPost, "/static")
+	if count("/static") != 3 {
+		t.Error("Expected requests with no-cache and other methods to pass the cache, got", count("/static"))
+	}
+	get(http.MethodGet, "/private")
+	get(http.MethodGet, "/private")
+	if count("/private") != 2 {
+		t.Error("Expected private responses not to be cached, got", count("/private"))
+	}
+	get(http.MethodGet, "/vary", "Accept-Language", "en")
+	get(http.MethodGet, "/vary", "Accept-Language", "en")
+	get(http.MethodGet, "/vary", "Accept-Language", "de")
+	if count("/vary") != 2 {
+		t.Error("Expected responses to be cached by the headers they vary by, got", count("/vary"))
+	}
+}
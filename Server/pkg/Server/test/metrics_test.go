@@ -0,0 +1,28 @@
+package test
+
+import (
+	server "Server"
+	"strings"
+	"testing"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	var s server.Server
+	var b strings.Builder
+	err := s.WriteMetrics(&b)
+	if err != nil {
+		t.Fatal("Error writing metrics", err)
+	}
+	for _, line := range []string{
+		"# TYPE goexpose_clients gauge",
+		"goexpose_clients 0",
+		`goexpose_relays{network="udp"} 0`,
+		"# TYPE goexpose_relayed_bytes_total counter",
+		`goexpose_relayed_bytes_total{direction="in"} 0`,
+		"goexpose_frame_errors_total 0",
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Error("Expected the metrics to contain", line, "got", b.String())
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// dialNoise opens a control connection to the Noise listener with the key of the client and completes the handshake.
+func dialNoise(t *testing.T, addr string, key []byte, serverKey []byte) *Utils.NoiseConn {
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := Utils.NoiseClient(raw, key, serverKey)
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	err = conn.Handshake()
+	if err != nil {
+		t.Fatal("Error in the Noise handshake", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestNoiseControlConnection(t *testing.T) {
+	noiseAddr := "127.0.0.1:" + strconv.Itoa(freeTestPort(t))
+	serverKey, _ := Utils.GenerateNoiseKey()
+	serverPublic, _ := Utils.NoisePublicKey(serverKey)
+	clientKey, _ := Utils.GenerateNoiseKey()
+	clientPublic, _ := Utils.NoisePublicKey(clientKey)
+	s, _, _, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		config.NoiseAddr = noiseAddr
+		config.NoiseKeyFile = filepath.Join(dir, "noise.key")
+		if err := Utils.WriteNoiseKey(config.NoiseKeyFile, serverKey); err != nil {
+			t.Fatal(err)
+		}
+		config.NoiseClients = map[string]string{"embedded": Utils.EncodeNoiseKey(clientPublic)}
+	})
+
+	conn := dialNoise(t, noiseAddr, clientKey, serverPublic)
+	if fr := exposeFrame(t, conn, strconv.Itoa(freeTestPort(t)), "transport=inline"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed over the Noise connection, got", fr)
+	}
+	clients := s.Clients()
+	if len(clients) != 1 || clients[0].Identity.CN != "embedded" || clients[0].Identity.Auth != server.AUTHNOISE {
+		t.Error("Expected the client to be known by the CN of its key, got", clients)
+	}
+
+	// a key the server doesn't know completes the handshake, but is refused
+	otherKey, _ := Utils.GenerateNoiseKey()
+	other := dialNoise(t, noiseAddr, otherKey, serverPublic)
+	_ = other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := other.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the connection of an unknown key to be closed")
+	}
+}
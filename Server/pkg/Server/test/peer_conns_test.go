@@ -0,0 +1,44 @@
+package test
+
+import (
+	"Utils"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPeerConns(t *testing.T) {
+	_, dir, port, _ := startHTTPFrontServer(t, nil)
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	if fr := exposeFrame(t, conn, strconv.Itoa(freeTestPort(t)), "peerconns=-1"); fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRINVALID {
+		t.Error("Expected a negative limit to be rejected, got", fr)
+	}
+	public := freeTestPort(t)
+	if fr := exposeFrame(t, conn, strconv.Itoa(public), "peerconns=1"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+	serveProxyConns(t, dir, conn, echoUntilHello(t))
+
+	// the first connection is held open, the service waits for its hello
+	held, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(public))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := false
+	for i := 0; i < 50 && !refused; i++ {
+		refused = relayHello(t, public) == ""
+	}
+	if !refused {
+		t.Fatal("Expected a second connection of the peer to be refused")
+	}
+	_ = held.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for relayHello(t, public) != "hello\n" {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a connection to be relayed once the first one closed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
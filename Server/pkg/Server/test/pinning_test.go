@@ -0,0 +1,41 @@
+package test
+
+import (
+	server "Server"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadFingerprints(t *testing.T) {
+	fp := "3F:2A:9C:11:04:7B:D2:E8:55:60:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45:67:89:AB:CD:EF:01:23:45"
+	path := filepath.Join(t.TempDir(), "fingerprints.json")
+	err := os.WriteFile(path, []byte(`["`+fp+`"]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fingerprints, err := server.LoadFingerprints(path)
+	if err != nil {
+		t.Fatal("Error loading fingerprints", err)
+	}
+	if !fingerprints["3f2a9c11047bd2e85560abcdef0123456789abcdef0123456789abcdef012345"] {
+		t.Error("Expected the normalized fingerprint, got", fingerprints)
+	}
+
+	err = os.WriteFile(path, []byte(`["`+fp+`", "3f2a9c11047bd2e85560abcdef0123456789abcdef0123456789abcdef012345"]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.LoadFingerprints(path)
+	if err == nil {
+		t.Error("Expected an error for a duplicate fingerprint")
+	}
+	err = os.WriteFile(path, []byte(`["3f2a9c"]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.LoadFingerprints(path)
+	if err == nil {
+		t.Error("Expected an error for a short fingerprint")
+	}
+}
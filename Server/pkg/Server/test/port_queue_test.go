@@ -0,0 +1,83 @@
+package test
+
+import (
+	server "Server"
+	"net"
+	"testing"
+)
+
+func TestPortqueueSkipsPortsInUse(t *testing.T) {
+	// a port of the range used by another process
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{Port: 40101})
+	if err != nil {
+		t.Fatal("Error listening", err)
+	}
+	defer l.Close()
+
+	pq := server.NewPortqueue(server.PortRange{First: 40100, Last: 40102})
+	var got []int
+	for port := pq.GetPort(); port != 0; port = pq.GetPort() {
+		got = append(got, port)
+	}
+	if len(got) != 2 || got[0] != 40100 || got[1] != 40102 {
+		t.Error("Expected 40100 and 40102, got", got)
+	}
+
+	// the port in use stays on probation, returned ports are handed out again
+	pq.ReturnPort(40100)
+	if port := pq.GetPort(); port != 40100 {
+		t.Error("Expected the returned port 40100, got", port)
+	}
+	if port := pq.GetPort(); port != 0 {
+		t.Error("Expected no port left, got", port)
+	}
+}
+
+func TestPortqueueExcludesDeniedPorts(t *testing.T) {
+	pq := server.NewPortqueue(server.PortRange{First: 40110, Last: 40114}, server.PortRange{First: 40111, Last: 40113})
+	if port := pq.GetPort(); port != 40110 {
+		t.Error("Expected 40110, got", port)
+	}
+	if port := pq.GetPort(); port != 40114 {
+		t.Error("Expected 40114, got", port)
+	}
+	if port := pq.GetPort(); port != 0 {
+		t.Error("Expected no port left, got", port)
+	}
+}
+
+func TestPortqueueRandom(t *testing.T) {
+	pq := server.NewPortqueue(server.PortRange{First: 40120, Last: 40139})
+	pq.SetRandom(true)
+	seen := make(map[int]bool)
+	sequential := true
+	for i := 0; i < 20; i++ {
+		port := pq.GetPort()
+		if port < 40120 || port > 40139 || seen[port] {
+			t.Fatal("Expected a new port of the range, got", port)
+		}
+		seen[port] = true
+		sequential = sequential && port == 40120+i
+	}
+	if sequential {
+		t.Error("Expected the ports in random order")
+	}
+	if port := pq.GetPort(); port != 0 {
+		t.Error("Expected no port left, got", port)
+	}
+}
+
+func TestPortqueueAvailable(t *testing.T) {
+	pq := server.NewPortqueue(server.PortRange{First: 40120, Last: 40124}, server.PortRange{First: 40121, Last: 40121})
+	if pq.Size() != 4 || pq.Available() != 4 {
+		t.Error("Expected 4 ports, got", pq.Size(), pq.Available())
+	}
+	port := pq.GetPort()
+	if pq.Size() != 4 || pq.Available() != 3 {
+		t.Error("Expected 3 of 4 ports available, got", pq.Available(), "of", pq.Size())
+	}
+	pq.ReturnPort(port)
+	if pq.Available() != 4 {
+		t.Error("Expected the returned port to be available, got", pq.Available())
+	}
+}
@@ -0,0 +1,55 @@
+package test
+
+import (
+	server "Server"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadProfiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	err := os.WriteFile(path, []byte(`[
+		{"CN": "alice", "Ports": [{"First": 8000, "Last": 8100}], "DenyUdp": true, "BandwidthIn": 1048576, "Quota": {"Tcp": 2, "Udp": 0}},
+		{"CN": "bob", "BandwidthOut": 65536}
+	]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := server.LoadProfiles(path)
+	if err != nil {
+		t.Fatal("Error loading profiles", err)
+	}
+	alice := profiles["alice"]
+	if len(alice.Ports) != 1 || !alice.Ports[0].Contains(8080) || !alice.DenyUdp || alice.BandwidthIn != 1048576 || alice.Quota == nil || alice.Quota.Tcp != 2 {
+		t.Error("Expected the profile of alice, got", alice)
+	}
+	if profiles["bob"].BandwidthOut != 65536 || profiles["bob"].Quota != nil {
+		t.Error("Expected the profile of bob, got", profiles["bob"])
+	}
+
+	config := server.DefaultConfig()
+	config.Profiles = profiles
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected the profiles to be valid", err)
+	}
+	config.Profiles["carol"] = server.Profile{CN: "carol", BandwidthIn: -1}
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a negative bandwidth")
+	}
+
+	profiles, err = server.LoadProfiles("")
+	if err != nil || len(profiles) != 0 {
+		t.Error("Expected no profiles, got", profiles, err)
+	}
+	err = os.WriteFile(path, []byte(`[{"CN": "alice"}, {"CN": "alice"}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.LoadProfiles(path)
+	if err == nil {
+		t.Error("Expected an error for duplicate profiles")
+	}
+}
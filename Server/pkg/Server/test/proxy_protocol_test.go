@@ -0,0 +1,133 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoUntilHello answers each connection with what it received up to "hello\n", the PROXY header included.
+func echoUntilHello(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var received []byte
+				b := make([]byte, 1)
+				for !bytes.HasSuffix(received, []byte("hello\n")) {
+					if _, err := conn.Read(b); err != nil {
+						return
+					}
+					received = append(received, b[0])
+				}
+				_, _ = conn.Write(received)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestProxyProtocol(t *testing.T) {
+	_, dir, port, httpAddr := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		// the test connects as load balancer
+		config.ProxyProtocolFrom = []string{"127.0.0.0/8"}
+	})
+	service := echoUntilHello(t)
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+
+	if fr := exposeFrame(t, conn, "8080", "host=app.tunnels.example.com", "proxyprotocol=v1"); fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRINVALID {
+		t.Error("Expected PROXY headers of a port exposed under a host to be rejected, got", fr)
+	}
+	v1Port, v2Port := freeTestPort(t), freeTestPort(t)
+	for p, version := range map[int]string{v1Port: "v1", v2Port: "v2"} {
+		if fr := exposeFrame(t, conn, strconv.Itoa(p), "proxyprotocol="+version); fr.Typ != Utils.CTRLEXPOSED {
+			t.Fatal("Expected the port to be exposed, got", fr)
+		}
+	}
+	serveProxyConns(t, dir, conn, service)
+
+	relay := func(port int, header string) []byte {
+		c, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+		_, err = io.WriteString(c, header+"hello\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, _ := io.ReadAll(c)
+		return received
+	}
+	announced := "PROXY TCP4 203.0.113.7 198.51.100.1 40000 443\r\n"
+	if received := string(relay(v1Port, announced)); received != announced+"hello\n" {
+		t.Errorf("Expected the service to receive the announced peer, got %q", received)
+	}
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+	v2 = append(v2, 203, 0, 113, 7, 198, 51, 100, 1)
+	v2 = binary.BigEndian.AppendUint16(v2, 40000)
+	v2 = binary.BigEndian.AppendUint16(v2, 443)
+	if received := relay(v2Port, announced); !bytes.Equal(received, append(v2, "hello\n"...)) {
+		t.Errorf("Expected the service to receive a binary header, got %q", received)
+	}
+	// a header of version 2 from the load balancer is announced as well
+	if received := string(relay(v1Port, string(v2))); received != announced+"hello\n" {
+		t.Errorf("Expected the service to receive the peer of the binary header, got %q", received)
+	}
+	if received := relay(v1Port, "GET / HTTP/1.1\r\n"); len(received) != 0 {
+		t.Errorf("Expected a connection of the load balancer without header to be closed, got %q", received)
+	}
+
+	// the HTTP front takes the peer from the header as well
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer web.Close()
+	_ = conn.Close()
+	webConn := dialClient(t, dir, port)
+	defer webConn.Close()
+	if fr := exposeFrame(t, webConn, "8080", "host=app.tunnels.example.com"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed under the host, got", fr)
+	}
+	serveProxyConns(t, dir, webConn, web.Listener.Addr().String())
+	c, err := net.Dial("tcp", httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.WriteString(c, announced+"GET / HTTP/1.1\r\nHost: app.tunnels.example.com\r\nConnection: close\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if strings.TrimSpace(string(body)) != "203.0.113.7" {
+		t.Error("Expected the service to see the announced peer, got", resp.Status, string(body))
+	}
+}
@@ -3,6 +3,8 @@ package test
 import (
 	server "Server"
 	"context"
+	"errors"
+	"io"
 	"log/slog"
 	"net"
 	"os"
@@ -20,19 +22,16 @@ func createConnPair(port int) (*net.TCPConn, *net.TCPConn) {
 	ln, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
 	if err != nil {
 		panic(err)
-		return nil, nil
 	}
 
 	conn1, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: port})
 	if err != nil {
 		panic(err)
-		return nil, nil
 	}
 
 	conn2, err := ln.AcceptTCP()
 	if err != nil {
 		panic(err)
-		return nil, nil
 	}
 
 	return conn1, conn2
@@ -109,16 +108,11 @@ func TestTcpRelayDouble(t *testing.T) {
 		t.Fatal("Expected error on proxGoExpose read, got nil")
 	}
 
-	_, err = proxExt.Read(buf)
-	if err == nil {
-		t.Fatal("Expected error on proxExt read, got nil")
-	}
+	t.Log("Asserting that RelayTcp closed proxExt with a FIN")
 
-	t.Log("Attempting to write to closed connection on other side")
-
-	_, err = proxExt.Write([]byte("Hello World!"))
-	if err == nil {
-		t.Fatal("Expected error, got nil")
+	_, err = proxExt.Read(buf)
+	if !errors.Is(err, io.EOF) {
+		t.Fatal("Expected EOF on proxExt read, got", err)
 	}
 
 	t.Log("TCP Relay test passed")
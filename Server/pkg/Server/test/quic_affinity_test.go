@@ -0,0 +1,156 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// backendCID is the QUIC connection ID quicBackend chooses for the connections of its peers.
+const backendCID = "backend1"
+
+// quicBackend serves the datagrams of UDP sessions framed on their proxy connections like a QUIC server: long header
+// packets are answered with a long header packet choosing backendCID as connection ID, short header packets are echoed.
+// It returns the address of the service.
+func quicBackend(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				buf := make([]byte, Utils.MAXDATAGRAM)
+				for {
+					n, err := Utils.ReadDatagram(r, buf)
+					if err != nil {
+						return
+					}
+					reply := buf[:n]
+					if buf[0]&0x80 != 0 {
+						// the source connection ID of the peer follows its destination connection ID
+						scid := buf[7+buf[5] : 7+buf[5]+buf[6+buf[5]]]
+						reply = append(append([]byte{0xc0, 0, 0, 0, 1, byte(len(scid))}, scid...), byte(len(backendCID)))
+						reply = append(reply, backendCID...)
+					}
+					if Utils.WriteDatagram(conn, reply) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// quicPeer is an external UDP peer of the relay.
+func quicPeer(t *testing.T, public int) *net.UDPConn {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: public})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+// shortHeader returns a short header packet to the connection ID of the backend with the payload.
+func shortHeader(payload string) []byte {
+	return append(append([]byte{0x40}, backendCID...), payload...)
+}
+
+// receive returns the next datagram of the peer, nil if none arrives within the timeout.
+func receive(peer *net.UDPConn, timeout time.Duration) []byte {
+	buf := make([]byte, 1500)
+	_ = peer.SetReadDeadline(time.Now().Add(timeout))
+	n, err := peer.Read(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[:n]
+}
+
+func TestQuicAffinityMigration(t *testing.T) {
+	_, dir, port, _ := startHTTPFrontServer(t, nil)
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	public := freeTestPort(t)
+	if fr := exposeFrameOf(t, conn, Utils.CTRLEXPOSEUDP, strconv.Itoa(public), "affinity=quic"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+	serveProxyConns(t, dir, conn, quicBackend(t))
+
+	// the handshake of the original peer, the backend chooses its connection ID
+	original := quicPeer(t, public)
+	initial := append(append([]byte{0xc0, 0, 0, 0, 1, 8}, "initial1"...), append([]byte{8}, "client01"...)...)
+	var answer []byte
+	for i := 0; i < 50 && answer == nil; i++ {
+		_, _ = original.Write(initial)
+		answer = receive(original, 100*time.Millisecond)
+	}
+	if !bytes.HasSuffix(answer, []byte(backendCID)) {
+		t.Fatal("Expected the backend to answer the handshake, got", answer)
+	}
+	_, _ = original.Write(shortHeader("ping"))
+	if reply := receive(original, 2*time.Second); !bytes.Equal(reply, shortHeader("ping")) {
+		t.Fatal("Expected the echo of the original peer, got", reply)
+	}
+
+	// a single datagram with the connection ID from another address doesn't redirect the session
+	spoofer := quicPeer(t, public)
+	_, _ = spoofer.Write(shortHeader("spoofed"))
+	if reply := receive(original, 2*time.Second); !bytes.Equal(reply, shortHeader("spoofed")) {
+		t.Error("Expected the reply to go to the original peer, got", reply)
+	}
+	// nor do long header packets with the connection ID
+	handshake := append(append([]byte{0xe0, 0, 0, 0, 1, 8}, backendCID...), append([]byte{8}, "spoofer1"...)...)
+	for i := 0; i < server.QUICMIGRATEDATAGRAMS; i++ {
+		_, _ = spoofer.Write(handshake)
+		if reply := receive(original, 2*time.Second); reply == nil {
+			t.Error("Expected the answer to the handshake to go to the original peer")
+		}
+	}
+	// datagrams of the original peer in between start over
+	for i := 0; i < server.QUICMIGRATEDATAGRAMS; i++ {
+		_, _ = spoofer.Write(shortHeader("spoofed"))
+		_ = receive(original, 2*time.Second)
+		_, _ = original.Write(shortHeader("ping"))
+		_ = receive(original, 2*time.Second)
+	}
+	if reply := receive(spoofer, 200*time.Millisecond); reply != nil {
+		t.Fatal("Expected no reply at the spoofing address, got", reply)
+	}
+
+	// a peer migrating keeps sending from its new address and gets the session
+	migrated := quicPeer(t, public)
+	for i := 1; i < server.QUICMIGRATEDATAGRAMS; i++ {
+		_, _ = migrated.Write(shortHeader("moved"))
+		_ = receive(original, 2*time.Second)
+	}
+	_, _ = migrated.Write(shortHeader("moved"))
+	if reply := receive(migrated, 2*time.Second); !bytes.Equal(reply, shortHeader("moved")) {
+		t.Fatal("Expected the session to migrate, got", reply)
+	}
+	_, _ = migrated.Write(shortHeader("again"))
+	if reply := receive(migrated, 2*time.Second); !bytes.Equal(reply, shortHeader("again")) {
+		t.Error("Expected the migrated peer to keep the session, got", reply)
+	}
+	if reply := receive(original, 200*time.Millisecond); reply != nil {
+		t.Error("Expected nothing for the old address, got", reply)
+	}
+}
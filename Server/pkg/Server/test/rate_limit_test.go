@@ -0,0 +1,46 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"crypto/tls"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestConnectionRate(t *testing.T) {
+	_, dir, port, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		config.ConnRatePerIP = 1
+		config.CtrlRatePerIP = 1
+	})
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+
+	// the second control connection within the second is refused before the TLS handshake
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, server.CLIENTCERTFILE), filepath.Join(dir, server.CLIENTKEYFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, err := tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port), &tls.Config{Certificates: []tls.Certificate{pair}, InsecureSkipVerify: true}); err == nil {
+		_ = second.Close()
+		t.Error("Expected a control connection beyond the rate to be refused")
+	}
+
+	public := freeTestPort(t)
+	if fr := exposeFrame(t, conn, strconv.Itoa(public)); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+	serveProxyConns(t, dir, conn, echoUntilHello(t))
+	if received := relayHello(t, public); received != "hello\n" {
+		t.Fatalf("Expected the first connection to be relayed, got %q", received)
+	}
+	if received := relayHello(t, public); received != "" {
+		t.Errorf("Expected a connection beyond the rate to be closed, got %q", received)
+	}
+	time.Sleep(time.Second)
+	if received := relayHello(t, public); received != "hello\n" {
+		t.Errorf("Expected a connection to be relayed once the rate allows, got %q", received)
+	}
+}
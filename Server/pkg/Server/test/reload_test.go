@@ -0,0 +1,118 @@
+package test
+
+import (
+	"Utils"
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// echoLines answers each connection with the lines it receives, until the connection is closed.
+func echoLines(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// visit connects to the public port and checks that a line is echoed through the relay, it returns the connection
+// and whether the line came back.
+func visit(t *testing.T, port int) (net.Conn, bool) {
+	c, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c, echoes(c)
+}
+
+// echoes reports whether a line sent over the connection comes back.
+func echoes(c net.Conn) bool {
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.WriteString(c, "ping\n")
+	if err != nil {
+		return false
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	return err == nil && line == "ping\n"
+}
+
+func TestReloadConfig(t *testing.T) {
+	s, dir, port, _ := startHTTPFrontServer(t, nil)
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	public := freeTestPort(t)
+	if fr := exposeFrame(t, conn, strconv.Itoa(public)); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+	serveProxyConns(t, dir, conn, echoLines(t))
+
+	first, ok1 := visit(t, public)
+	second, ok2 := visit(t, public)
+	if !ok1 || !ok2 {
+		t.Fatal("Expected both connections to be relayed without a limit")
+	}
+
+	// the new limit applies to the port exposed before, the connections over it are kept
+	config := s.Config
+	config.MaxClientConns = 2
+	config.CtrlPort = freeTestPort(t)
+	restart, err := s.ReloadConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restart) != 1 || restart[0] != "CtrlPort" {
+		t.Error("Expected the control port to need a restart, got", restart)
+	}
+	if _, ok := visit(t, public); ok {
+		t.Error("Expected a third connection to be refused after the reload")
+	}
+	if !echoes(first) || !echoes(second) {
+		t.Error("Expected the connections relayed before the reload to be kept")
+	}
+	if settings := s.Settings(); settings.MaxClientConns != 2 {
+		t.Error("Expected the reloaded limit, got", settings)
+	}
+
+	// an invalid config is refused as a whole, the limit stays
+	invalid := config
+	invalid.MaxClientConns = 0
+	invalid.TLSMinVersion = 1
+	_, err = s.ReloadConfig(invalid)
+	if err == nil {
+		t.Error("Expected an invalid config to be refused")
+	}
+	if settings := s.Settings(); settings.MaxClientConns != 2 {
+		t.Error("Expected the config in effect to be kept, got", settings)
+	}
+	if _, ok := visit(t, public); ok {
+		t.Error("Expected the limit to stay after the invalid config")
+	}
+
+	// a connection that ends frees its place
+	_ = first.Close()
+	for i := 0; i < 100; i++ {
+		if _, ok := visit(t, public); ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Expected a connection to be relayed once another ended")
+}
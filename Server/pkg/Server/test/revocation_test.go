@@ -0,0 +1,315 @@
+package test
+
+import (
+	server "Server"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// OCSP messages of RFC 6960, as far as the responder of the tests needs them.
+type testCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	KeyHash       []byte
+	SerialNumber  *big.Int
+}
+
+type testOCSPRequest struct {
+	TBSRequest struct {
+		RequestList []struct {
+			CertID testCertID
+		}
+	}
+}
+
+type testRevokedInfo struct {
+	RevocationTime time.Time `asn1:"generalized"`
+}
+
+type testSingleResponse struct {
+	CertID     testCertID
+	Good       asn1.Flag       `asn1:"tag:0,optional"`
+	Revoked    testRevokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag       `asn1:"tag:2,optional"`
+	ThisUpdate time.Time       `asn1:"generalized"`
+	NextUpdate time.Time       `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type testResponseData struct {
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []testSingleResponse
+}
+
+type testBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certs              []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type testOCSPResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes struct {
+		Type     asn1.ObjectIdentifier
+		Response []byte
+	} `asn1:"explicit,tag:0,optional"`
+}
+
+// ocspAnswer is how the responder of the tests answers: the status of every certificate, "good", "revoked" or
+// "unknown", its validity, and who signs it. The CA signs if signer is nil, a delegated responder otherwise.
+type ocspAnswer struct {
+	status     string
+	thisUpdate time.Time
+	nextUpdate time.Time
+	signer     *x509.Certificate
+	signerKey  crypto.Signer
+	// corrupt breaks the signature
+	corrupt bool
+}
+
+// startOCSPResponder runs an OCSP responder answering as told until the test ends and returns its URL.
+func startOCSPResponder(t *testing.T, ca *x509.Certificate, caKey crypto.Signer, answer ocspAnswer) string {
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var req testOCSPRequest
+		_, err := asn1.Unmarshal(body, &req)
+		if err != nil || len(req.TBSRequest.RequestList) != 1 {
+			http.Error(w, "malformed", http.StatusBadRequest)
+			return
+		}
+		single := testSingleResponse{CertID: req.TBSRequest.RequestList[0].CertID, ThisUpdate: answer.thisUpdate, NextUpdate: answer.nextUpdate}
+		switch answer.status {
+		case "good":
+			single.Good = true
+		case "revoked":
+			single.Revoked.RevocationTime = time.Now().Add(-time.Hour).UTC()
+		default:
+			single.Unknown = true
+		}
+		signer, key := ca, caKey
+		var certs []asn1.RawValue
+		if answer.signer != nil {
+			signer, key = answer.signer, answer.signerKey
+			certs = []asn1.RawValue{{FullBytes: signer.Raw}}
+		}
+		keyHash := sha256.Sum256(signer.RawSubjectPublicKeyInfo)
+		keyID, _ := asn1.Marshal(keyHash[:20])
+		tbs, err := asn1.Marshal(testResponseData{
+			ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: keyID},
+			ProducedAt:  time.Now().UTC(),
+			Responses:   []testSingleResponse{single},
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		digest := sha256.Sum256(tbs)
+		signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if answer.corrupt {
+			signature[len(signature)-1] ^= 0xff
+		}
+		basic, err := asn1.Marshal(testBasicResponse{
+			TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+			Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+			Certs:              certs,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var resp testOCSPResponse
+		resp.ResponseBytes.Type = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+		resp.ResponseBytes.Response = basic
+		data, _ := asn1.Marshal(resp)
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(responder.Close)
+	return responder.URL
+}
+
+// issueResponder issues a certificate of a delegated OCSP responder with the CA, for OCSP signing if ocspSigning is
+// set, and returns it with its key.
+func issueResponder(t *testing.T, ca *x509.Certificate, caKey crypto.Signer, ocspSigning bool) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(4242),
+		Subject:      pkix.Name{CommonName: "OCSP responder"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if ocspSigning {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// clientSerial returns the serial of the certificate of alice.
+func clientSerial(t *testing.T, dir string) *big.Int {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, server.CLIENTCERTFILE), filepath.Join(dir, server.CLIENTKEYFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber
+}
+
+// handshake connects with the certificate of alice over TLS 1.2, where the handshake only completes once the server
+// verified the certificate, and returns the error of the handshake.
+func handshake(t *testing.T, dir string, port int) error {
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, server.CLIENTCERTFILE), filepath.Join(dir, server.CLIENTKEYFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port), &tls.Config{Certificates: []tls.Certificate{pair},
+		InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestRevocationCRL(t *testing.T) {
+	tests := []struct {
+		name     string
+		revoke   bool
+		forged   bool
+		accepted bool
+	}{
+		{"not listed", false, false, true},
+		{"revoked", true, false, false},
+		{"forged", false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, dir, port, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+				ca, caKey, err := server.LoadCA(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				serial := big.NewInt(1)
+				if tt.revoke {
+					serial = clientSerial(t, dir)
+				}
+				if tt.forged {
+					// a CRL naming the CA as issuer, signed with another key, is refused even without listing the client
+					forger, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+					if err != nil {
+						t.Fatal(err)
+					}
+					forgedCA := *ca
+					forgedCA.PublicKey = &forger.PublicKey
+					ca, caKey = &forgedCA, forger
+				}
+				crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+					Number:     big.NewInt(1),
+					ThisUpdate: time.Now().Add(-time.Hour),
+					NextUpdate: time.Now().Add(time.Hour),
+					RevokedCertificateEntries: []x509.RevocationListEntry{
+						{SerialNumber: serial, RevocationTime: time.Now().Add(-time.Hour)},
+					},
+				}, ca, caKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				config.CRLFile = filepath.Join(dir, "ca.crl")
+				err = os.WriteFile(config.CRLFile, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			})
+			err := handshake(t, dir, port)
+			if (err == nil) != tt.accepted {
+				t.Error("Expected the client to be accepted", tt.accepted, "got", err)
+			}
+		})
+	}
+}
+
+func TestRevocationOCSP(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name      string
+		answer    ocspAnswer
+		delegated int
+		softFail  bool
+		down      bool
+		accepted  bool
+	}{
+		{name: "good", answer: ocspAnswer{status: "good", thisUpdate: now, nextUpdate: now.Add(time.Hour)}, accepted: true},
+		{name: "revoked", answer: ocspAnswer{status: "revoked", thisUpdate: now, nextUpdate: now.Add(time.Hour)}},
+		{name: "unknown", answer: ocspAnswer{status: "unknown", thisUpdate: now, nextUpdate: now.Add(time.Hour)}},
+		{name: "bad signature", answer: ocspAnswer{status: "good", thisUpdate: now, nextUpdate: now.Add(time.Hour), corrupt: true}},
+		{name: "delegated", answer: ocspAnswer{status: "good", thisUpdate: now, nextUpdate: now.Add(time.Hour)}, delegated: 1, accepted: true},
+		{name: "delegated without OCSP signing", answer: ocspAnswer{status: "good", thisUpdate: now, nextUpdate: now.Add(time.Hour)}, delegated: 2},
+		{name: "outdated", answer: ocspAnswer{status: "good", thisUpdate: now.Add(-2 * time.Hour), nextUpdate: now.Add(-time.Hour)}},
+		{name: "not yet valid", answer: ocspAnswer{status: "good", thisUpdate: now.Add(2 * server.OCSPCLOCKSKEW)}},
+		{name: "stale", answer: ocspAnswer{status: "good", thisUpdate: now.Add(-server.OCSPMAXAGE - time.Hour)}},
+		{name: "without next update", answer: ocspAnswer{status: "good", thisUpdate: now.Add(-time.Hour)}, accepted: true},
+		{name: "unreachable", down: true},
+		{name: "unreachable soft fail", down: true, softFail: true, accepted: true},
+		// soft fail only lets clients in the responder can't answer for
+		{name: "revoked soft fail", answer: ocspAnswer{status: "revoked", thisUpdate: now, nextUpdate: now.Add(time.Hour)}, softFail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, dir, port, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+				ca, caKey, err := server.LoadCA(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.delegated > 0 {
+					tt.answer.signer, tt.answer.signerKey = issueResponder(t, ca, caKey, tt.delegated == 1)
+				}
+				// nothing listens on a port that was just free
+				config.OCSPResponder = "http://127.0.0.1:" + strconv.Itoa(freeTestPort(t))
+				if !tt.down {
+					config.OCSPResponder = startOCSPResponder(t, ca, caKey, tt.answer)
+				}
+				config.OCSPSoftFail = tt.softFail
+			})
+			err := handshake(t, dir, port)
+			if (err == nil) != tt.accepted {
+				t.Error("Expected the client to be accepted", tt.accepted, "got", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package test
+
+import (
+	"Utils"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// relayHello sends "hello\n" over the public port and returns what comes back until the connection is closed.
+func relayHello(t *testing.T, port int) string {
+	c, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+	_, _ = io.WriteString(c, "hello\n")
+	received, _ := io.ReadAll(c)
+	return string(received)
+}
+
+func TestSourceFilter(t *testing.T) {
+	_, dir, port, httpAddr := startHTTPFrontServer(t, nil)
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+
+	for _, options := range [][]string{{"allow=localhost"}, {"deny=127.0.0.1/33"}} {
+		if fr := exposeFrame(t, conn, strconv.Itoa(freeTestPort(t)), options...); fr.Typ != Utils.CTRLERROR || fr.Data[3] != Utils.ERRINVALID {
+			t.Error("Expected", options, "to be rejected, got", fr)
+		}
+	}
+
+	denied := freeTestPort(t)
+	if fr := exposeFrame(t, conn, strconv.Itoa(denied), "allow=127.0.0.0/8", "deny=127.0.0.1"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+	if received := relayHello(t, denied); received != "" {
+		t.Errorf("Expected the connection of a denied peer to be closed, got %q", received)
+	}
+	err := Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLSTATSSUB, []string{"1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		fr, err := Utils.ReadFrame(conn)
+		if err != nil {
+			t.Fatal("Expected stats of the port", err)
+		}
+		if fr.Typ == Utils.CTRLSTATS && fr.Data[1] == strconv.Itoa(denied) {
+			if len(fr.Data) < 13 || fr.Data[12] != "1" {
+				t.Error("Expected the stats to count the blocked connection, got", fr)
+			}
+			break
+		}
+	}
+
+	allowed := freeTestPort(t)
+	allowConn := dialClient(t, dir, port)
+	defer allowConn.Close()
+	if fr := exposeFrame(t, allowConn, strconv.Itoa(allowed), "allow=127.0.0.1", "deny=10.0.0.0/8"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+	serveProxyConns(t, dir, allowConn, echoUntilHello(t))
+	if received := relayHello(t, allowed); received != "hello\n" {
+		t.Errorf("Expected the connection of an allowed peer to be relayed, got %q", received)
+	}
+
+	// the HTTP front refuses the requests of denied peers
+	webConn := dialClient(t, dir, port)
+	defer webConn.Close()
+	if fr := exposeFrame(t, webConn, "8080", "host=app.tunnels.example.com", "allow=192.0.2.0/24"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed under the host, got", fr)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://"+httpAddr+"/", nil)
+	req.Host = "app.tunnels.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("Expected the request of a peer outside the allow list to be forbidden, got", resp.Status)
+	}
+}
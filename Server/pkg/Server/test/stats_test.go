@@ -0,0 +1,102 @@
+package test
+
+import (
+	"Utils"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// readStats reads frames until the next CTRLSTATS frame of the port and returns it, nil if none arrives in time.
+func readStats(t *testing.T, conn net.Conn, port int, timeout time.Duration) *Utils.CTRLFrame {
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		fr, err := Utils.ReadFrame(conn)
+		if err != nil {
+			return nil
+		}
+		if fr.Typ == Utils.CTRLSTATS && len(fr.Data) > 1 && fr.Data[1] == strconv.Itoa(port) {
+			return fr
+		}
+	}
+}
+
+func TestStatsQuery(t *testing.T) {
+	_, dir, port, _ := startHTTPFrontServer(t, nil)
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	exposed := freeTestPort(t)
+	if fr := exposeFrame(t, conn, strconv.Itoa(exposed), "name=web"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+
+	err := Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLSTATS, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := readStats(t, conn, exposed, 5*time.Second)
+	if fr == nil {
+		t.Fatal("Expected the stats of the port")
+	}
+	if len(fr.Data) != 15 {
+		t.Fatal("Expected 15 fields in the stats frame, got", fr.Data)
+	}
+	if fr.Data[0] != "tcp" || fr.Data[10] != "web" {
+		t.Error("Expected the network and the name of the port, got", fr.Data)
+	}
+	for i, field := range fr.Data[2:] {
+		if field != "0" && i+2 != 10 {
+			t.Error("Expected counter", i+2, "of an unused port to be 0, got", field)
+		}
+	}
+	// a query is answered once, it doesn't subscribe
+	if fr := readStats(t, conn, exposed, 1500*time.Millisecond); fr != nil {
+		t.Error("Expected no further stats without subscription, got", fr)
+	}
+}
+
+func TestStatsSubscription(t *testing.T) {
+	_, dir, port, _ := startHTTPFrontServer(t, nil)
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	exposed := freeTestPort(t)
+	if fr := exposeFrame(t, conn, strconv.Itoa(exposed)); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+
+	// an invalid interval leaves the subscription alone
+	err := Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLSTATSSUB, []string{"-1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fr := readStats(t, conn, exposed, 1500*time.Millisecond); fr != nil {
+		t.Error("Expected no stats for an invalid interval, got", fr)
+	}
+
+	err = Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLSTATSSUB, []string{"1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if readStats(t, conn, exposed, 3*time.Second) == nil {
+		t.Fatal("Expected the first stats of the subscription")
+	}
+	start := time.Now()
+	if readStats(t, conn, exposed, 3*time.Second) == nil {
+		t.Fatal("Expected the second stats of the subscription")
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Error("Expected the stats about once per second, got them after", elapsed)
+	}
+
+	// an interval of 0 unsubscribes
+	err = Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLSTATSSUB, []string{"0"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a tick may have been sent before the server read the frame
+	_ = readStats(t, conn, exposed, 200*time.Millisecond)
+	if fr := readStats(t, conn, exposed, 2500*time.Millisecond); fr != nil {
+		t.Error("Expected no stats after unsubscribing, got", fr)
+	}
+}
@@ -0,0 +1,176 @@
+package test
+
+import (
+	server "Server"
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStoreDrivers(t *testing.T) {
+	if drivers := server.StoreDrivers(); !slices.Equal(drivers, []string{server.STOREBBOLT, server.STOREJSON, server.STORESQLITE}) {
+		t.Error("Expected the bbolt, JSON and SQLite drivers, got", drivers)
+	}
+	for _, driver := range server.StoreDrivers() {
+		path := filepath.Join(t.TempDir(), "state", "store")
+		store, err := server.OpenStore(driver, path)
+		if err != nil {
+			t.Fatal(driver, err)
+		}
+		_, err = store.Get(server.STOREPROFILES, "alice")
+		if !errors.Is(err, server.ErrNotStored) {
+			t.Error(driver, "Expected a missing key not to be stored, got", err)
+		}
+		for _, key := range []string{"alice", "bob", "carol"} {
+			err = store.Put(server.STOREPROFILES, key, []byte(`{"CN":"`+key+`"}`))
+			if err != nil {
+				t.Fatal(driver, err)
+			}
+		}
+		err = store.Put(server.STORERESERVED, "8080", []byte(`"alice"`))
+		if err != nil {
+			t.Fatal(driver, err)
+		}
+		err = store.Delete(server.STOREPROFILES, "bob")
+		if err != nil {
+			t.Error(driver, "Expected the key to be deleted", err)
+		}
+		err = store.Delete(server.STOREPROFILES, "dave")
+		if err != nil {
+			t.Error(driver, "Expected no error deleting a missing key", err)
+		}
+		err = store.Replace(server.STOREHISTORY, map[string][]byte{"alice/tcp/80": []byte(`{}`)})
+		if err != nil {
+			t.Fatal(driver, err)
+		}
+		err = store.Replace(server.STOREHISTORY, map[string][]byte{"bob/tcp/80": []byte(`{}`)})
+		if err != nil {
+			t.Fatal(driver, err)
+		}
+		err = store.Close()
+		if err != nil {
+			t.Error(driver, err)
+		}
+
+		store, err = server.OpenStore(driver, path)
+		if err != nil {
+			t.Fatal(driver, err)
+		}
+		profiles, err := store.List(server.STOREPROFILES)
+		if err != nil || len(profiles) != 2 || string(profiles["carol"]) != `{"CN":"carol"}` || profiles["bob"] != nil {
+			t.Error(driver, "Expected the profiles of alice and carol to be kept, got", profiles, err)
+		}
+		value, err := store.Get(server.STORERESERVED, "8080")
+		if err != nil || string(value) != `"alice"` {
+			t.Error(driver, "Expected the reserved port to be kept, got", string(value), err)
+		}
+		history, err := store.List(server.STOREHISTORY)
+		if err != nil || len(history) != 1 || history["bob/tcp/80"] == nil {
+			t.Error(driver, "Expected the bucket to be replaced, got", history, err)
+		}
+		_ = store.Close()
+	}
+
+	_, err := server.OpenStore("etcd", filepath.Join(t.TempDir(), "store"))
+	if err == nil {
+		t.Error("Expected an error for an unknown driver")
+	}
+}
+
+func TestStoredState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	start := func(config server.Config) (*server.Server, func()) {
+		s := &server.Server{Config: config, Logger: setupTestLogger()}
+		ctx, cancel := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			s.Run(ctx)
+		}()
+		for s.Ready() != nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+		return s, func() {
+			cancel()
+			<-stopped
+		}
+	}
+	config := server.DefaultConfig()
+	config.CtrlAddr = "127.0.0.1"
+	config.CtrlPort = freeTestPort(t)
+	config.DataPort = freeTestPort(t)
+	config.StoreFile = path
+	dir := t.TempDir()
+	err := server.InitCA(dir, []string{"localhost"}, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.CAFile = filepath.Join(dir, server.CAFILE)
+	config.CertFile = filepath.Join(dir, server.SERVERCERTFILE)
+	config.KeyFile = filepath.Join(dir, server.SERVERKEYFILE)
+	config.ReservedPorts = map[int]string{9000: "bob"}
+
+	s, stop := start(config)
+	maxConns := 20
+	_, err = s.UpdateSettings(server.AdminSettingsUpdate{MaxConns: &maxConns, ClientQuotas: map[string]string{"alice": "2/2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetProfile(server.Profile{CN: "alice", DenyUdp: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.ReservePort(8080, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SetProfile(server.Profile{CN: "bob", MaxConns: -1})
+	if err == nil {
+		t.Error("Expected an error for an invalid profile")
+	}
+	err = s.UnreservePort(9000)
+	if !errors.Is(err, server.ErrNotStored) {
+		t.Error("Expected a reservation of the config not to be removed, got", err)
+	}
+	stop()
+
+	s, stop = start(config)
+	defer stop()
+	check := func(when string) {
+		settings := s.Settings()
+		if settings.MaxConns != 20 || settings.ClientQuotas["alice"] != "2/2" {
+			t.Error("Expected the settings to be kept", when, "got", settings)
+		}
+		if p, ok := s.Profiles()["alice"]; !ok || !p.DenyUdp {
+			t.Error("Expected the profile of alice to be kept", when, "got", s.Profiles())
+		}
+		if reserved := s.ReservedPorts(); reserved[8080] != "alice" || reserved[9000] != "bob" {
+			t.Error("Expected the reserved ports of the store and the config", when, "got", reserved)
+		}
+	}
+	check("after a restart")
+	config.MaxClientConns = 5
+	_, err = s.ReloadConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("after a reload")
+	if s.Settings().MaxClientConns != 5 {
+		t.Error("Expected the reloaded config to apply, got", s.Settings())
+	}
+
+	err = s.RemoveProfile("alice")
+	if err != nil {
+		t.Error("Expected the profile to be removed", err)
+	}
+	err = s.RemoveProfile("alice")
+	if !errors.Is(err, server.ErrNotStored) {
+		t.Error("Expected no profile to be removed twice, got", err)
+	}
+	if _, ok := s.Profiles()["alice"]; ok {
+		t.Error("Expected alice to have no profile, got", s.Profiles())
+	}
+}
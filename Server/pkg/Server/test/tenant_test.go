@@ -0,0 +1,127 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoadTenants(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants.json")
+	err := os.WriteFile(path, []byte(`[
+		{"Name": "red", "Ports": [{"First": 20000, "Last": 20999}], "ProxyPorts": {"First": 47923, "Last": 47927}, "Quota": {"Tcp": 10, "Udp": 2}},
+		{"Name": "blue", "Ports": [{"First": 21000, "Last": 21999}, {"First": 23000, "Last": 23099}]}
+	]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants, err := server.LoadTenants(path)
+	if err != nil {
+		t.Fatal("Error loading tenants", err)
+	}
+	red := tenants["red"]
+	if len(red.Ports) != 1 || !red.Ports[0].Contains(20500) || red.ProxyPorts.First != 47923 || red.Quota.Tcp != 10 {
+		t.Error("Expected the tenant red, got", red)
+	}
+	if len(tenants["blue"].Ports) != 2 {
+		t.Error("Expected the tenant blue, got", tenants["blue"])
+	}
+
+	config := server.DefaultConfig()
+	config.Tenants = tenants
+	config.Profiles = map[string]server.Profile{"alice": {CN: "alice", Tenant: "red"}}
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected the tenants to be valid", err)
+	}
+	config.Profiles["bob"] = server.Profile{CN: "bob", Tenant: "green"}
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a profile of an unknown tenant")
+	}
+	delete(config.Profiles, "bob")
+	config.Tenants["green"] = server.Tenant{Name: "green", Ports: []server.PortRange{{First: 20900, Last: 21100}}}
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for overlapping ports of tenants")
+	}
+	config.Tenants["green"] = server.Tenant{Name: "green", ProxyPorts: server.PortRange{First: 100, Last: 199}}
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for proxy ports out of the proxy port range")
+	}
+	config.Tenants["green"] = server.Tenant{Name: "green", BandwidthIn: -1}
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a negative bandwidth of a tenant")
+	}
+	config.Tenants["green"] = server.Tenant{Name: "green", MaxConns: -1}
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for a negative connection limit of a tenant")
+	}
+
+	tenants, err = server.LoadTenants("")
+	if err != nil || len(tenants) != 0 {
+		t.Error("Expected no tenants, got", tenants, err)
+	}
+	err = os.WriteFile(path, []byte(`[{"Name": "red"}, {"Name": "red"}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = server.LoadTenants(path)
+	if err == nil {
+		t.Error("Expected an error for duplicate tenants")
+	}
+}
+
+func TestTenantLimits(t *testing.T) {
+	_, dir, port, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		config.Tenants = map[string]server.Tenant{"red": {Name: "red", MaxConns: 1, BandwidthOut: 4096}}
+		config.Profiles = map[string]server.Profile{"alice": {CN: "alice", Tenant: "red"}}
+	})
+	conn := dialClient(t, dir, port)
+	defer conn.Close()
+	exposed := freeTestPort(t)
+	if fr := exposeFrame(t, conn, strconv.Itoa(exposed)); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed, got", fr)
+	}
+	serveProxyConns(t, dir, conn, echoUntilHello(t))
+
+	// the open connection takes the only connection of the tenant
+	held, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(exposed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if received := relayHello(t, exposed); received != "" {
+		t.Errorf("Expected the connection above the limit of the tenant to be closed, got %q", received)
+	}
+	_ = held.Close()
+	time.Sleep(200 * time.Millisecond)
+
+	// 4096 bytes are relayed from the burst, the other 8192 at 4096 bytes per second
+	c, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(exposed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(10 * time.Second))
+	start := time.Now()
+	_, err = c.Write(append(make([]byte, 12288), "hello\n"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received, _ := io.ReadAll(c); len(received) != 12288+len("hello\n") {
+		t.Fatal("Expected the data to be echoed, got", len(received), "bytes")
+	}
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Error("Expected the bandwidth of the tenant to be limited, relayed in", elapsed)
+	}
+}
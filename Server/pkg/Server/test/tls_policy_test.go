@@ -0,0 +1,49 @@
+package test
+
+import (
+	server "Server"
+	"crypto/tls"
+	"testing"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	version, err := server.ParseTLSVersion("1.3")
+	if err != nil || version != tls.VersionTLS13 {
+		t.Error("Expected TLS 1.3, got", version, err)
+	}
+	_, err = server.ParseTLSVersion("1.0")
+	if err == nil {
+		t.Error("Expected an error for TLS 1.0")
+	}
+
+	suites, err := server.ParseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+	if err != nil {
+		t.Fatal("Error parsing cipher suites", err)
+	}
+	if len(suites) != 2 || suites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Error("Expected two cipher suites, got", suites)
+	}
+	_, err = server.ParseCipherSuites("TLS_RSA_WITH_RC4_128_SHA")
+	if err == nil {
+		t.Error("Expected an error for an insecure cipher suite")
+	}
+
+	config := server.DefaultConfig()
+	config.CipherSuites = suites
+	config.CtrlALPN = server.ParseALPN("goexpose-ctrl")
+	err = config.Validate()
+	if err != nil {
+		t.Error("Expected the TLS policy to be valid", err)
+	}
+	config.CipherSuites = []uint16{tls.TLS_RSA_WITH_RC4_128_SHA}
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for an insecure cipher suite")
+	}
+	config.CipherSuites = nil
+	config.TLSMinVersion = tls.VersionTLS11
+	err = config.Validate()
+	if err == nil {
+		t.Error("Expected an error for TLS 1.1")
+	}
+}
@@ -0,0 +1,114 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"context"
+	"crypto/tls"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// pipeTransport is a transport of an embedding application, its connections are in-memory pipes.
+type pipeTransport struct {
+	conns chan net.Conn
+}
+
+type pipeListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+}
+
+func (t *pipeTransport) Listen(ctx context.Context) (net.Listener, error) {
+	l := &pipeListener{conns: t.conns, done: make(chan struct{})}
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+	return l, nil
+}
+
+// dial connects to the server through the transport.
+func (t *pipeTransport) dial() net.Conn {
+	client, srv := net.Pipe()
+	t.conns <- srv
+	return client
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	select {
+	case <-l.done:
+	default:
+		close(l.done)
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "pipe"}
+}
+
+func TestCustomTransport(t *testing.T) {
+	dir := t.TempDir()
+	err := server.InitCA(dir, []string{"localhost"}, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.IssueClient(dir, dir, "alice", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := server.DefaultConfig()
+	config.CAFile = filepath.Join(dir, server.CAFILE)
+	config.CertFile = filepath.Join(dir, server.SERVERCERTFILE)
+	config.KeyFile = filepath.Join(dir, server.SERVERKEYFILE)
+	config.CtrlAddr = "127.0.0.1"
+	config.CtrlPort = freeTestPort(t)
+	config.DataPort = freeTestPort(t)
+	transport := &pipeTransport{conns: make(chan net.Conn)}
+	s := &server.Server{Config: config, Logger: setupTestLogger(), Transports: []server.Transport{transport}}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-stopped
+	})
+	for s.Ready() != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, server.CLIENTCERTFILE), filepath.Join(dir, server.CLIENTKEYFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := tls.Client(transport.dial(), &tls.Config{Certificates: []tls.Certificate{pair}, InsecureSkipVerify: true})
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	err = conn.Handshake()
+	if err != nil {
+		t.Fatal("Error in the handshake over the transport", err)
+	}
+	if fr := exposeFrame(t, conn, strconv.Itoa(freeTestPort(t)), "transport=inline"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed over the transport, got", fr)
+	}
+	clients := s.Clients()
+	if len(clients) != 1 || clients[0].Identity.CN != "alice" || clients[0].Address != "pipe" {
+		t.Error("Expected alice connected through the pipe, got", clients)
+	}
+}
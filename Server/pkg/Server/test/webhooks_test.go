@@ -0,0 +1,114 @@
+package test
+
+import (
+	server "Server"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoadWebhooks(t *testing.T) {
+	hooks, err := server.LoadWebhooks("")
+	if err != nil || len(hooks) != 0 {
+		t.Error("Expected no webhooks for an empty path", hooks, err)
+	}
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	err = os.WriteFile(path, []byte(`[{"URL": "https://hooks.example.com", "Secret": "webhook-secret-0123", "Kinds": ["relay_error"]}]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks, err = server.LoadWebhooks(path)
+	if err != nil || len(hooks) != 1 || hooks[0].URL != "https://hooks.example.com" || hooks[0].Kinds[0] != server.EVENTRELAYERROR {
+		t.Error("Expected the webhook of the file", hooks, err)
+	}
+}
+
+type webhookDelivery struct {
+	header  http.Header
+	body    []byte
+	payload server.WebhookPayload
+}
+
+func TestWebhooks(t *testing.T) {
+	const secret = "webhook-secret-0123"
+	deliveries := make(chan webhookDelivery, 10)
+	var refused atomic.Bool
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		d := webhookDelivery{header: r.Header, body: body}
+		_ = json.Unmarshal(body, &d.payload)
+		deliveries <- d
+		if !refused.Swap(true) {
+			// the first delivery is sent again
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer hook.Close()
+
+	dir := t.TempDir()
+	err := server.InitCA(dir, []string{"localhost"}, time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.IssueClient(dir, dir, "alice", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := freeTestPort(t)
+	config := server.DefaultConfig()
+	config.CAFile = filepath.Join(dir, server.CAFILE)
+	config.CertFile = filepath.Join(dir, server.SERVERCERTFILE)
+	config.KeyFile = filepath.Join(dir, server.SERVERKEYFILE)
+	config.CtrlAddr = "127.0.0.1"
+	config.CtrlPort = port
+	config.DataPort = 0
+	config.Webhooks = []server.Webhook{{URL: hook.URL, Secret: secret}}
+	s := server.Server{Config: config, Logger: setupTestLogger()}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		s.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-stopped
+	}()
+	for s.Ready() != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	next := func(kind string) webhookDelivery {
+		select {
+		case d := <-deliveries:
+			if d.payload.Kind != kind || d.header.Get(server.WEBHOOKEVENT) != kind || d.payload.CN != "alice" {
+				t.Error("Expected a", kind, "payload of alice, got", string(d.body))
+			}
+			timestamp, err := strconv.ParseInt(d.header.Get(server.WEBHOOKTIMESTAMP), 10, 64)
+			if err != nil || d.header.Get(server.WEBHOOKSIGNATURE) != server.SignWebhook(secret, timestamp, d.body) {
+				t.Error("Expected a valid signature, got", d.header.Get(server.WEBHOOKSIGNATURE))
+			}
+			return d
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a", kind, "payload")
+		}
+		return webhookDelivery{}
+	}
+	conn := dialClient(t, dir, port)
+	first := next(server.EVENTCLIENTCONNECTED)
+	retried := next(server.EVENTCLIENTCONNECTED)
+	if string(first.body) != string(retried.body) || !strings.HasPrefix(first.payload.Text, "Client alice (") {
+		t.Error("Expected the refused payload to be sent again, got", string(first.body), string(retried.body))
+	}
+	_ = conn.Close()
+	next(server.EVENTCLIENTDISCONNECTED)
+}
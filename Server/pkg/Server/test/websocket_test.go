@@ -0,0 +1,67 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWebSocketControlConnection(t *testing.T) {
+	wsAddr := "127.0.0.1:" + strconv.Itoa(freeTestPort(t))
+	s, dir, port, _ := startHTTPFrontServer(t, func(config *server.Config, dir string) {
+		config.WebSocketAddr = wsAddr
+	})
+	// the control port still accepts clients
+	direct := dialClient(t, dir, port)
+	defer direct.Close()
+
+	insecure := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := insecure.Get("https://" + wsAddr + Utils.WEBSOCKETPATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expected a request without upgrade to be refused, got", resp.Status)
+	}
+
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, server.CLIENTCERTFILE), filepath.Join(dir, server.CLIENTKEYFILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := net.Dial("tcp", wsAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	_ = raw.SetDeadline(time.Now().Add(10 * time.Second))
+	outer := tls.Client(raw, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	ws, err := Utils.ClientWebSocket(outer, wsAddr, Utils.WEBSOCKETPATH)
+	if err != nil {
+		t.Fatal("Error opening WebSocket", err)
+	}
+	conn := tls.Client(ws, &tls.Config{Certificates: []tls.Certificate{pair}, InsecureSkipVerify: true})
+	err = conn.Handshake()
+	if err != nil {
+		t.Fatal("Error in the handshake inside the WebSocket", err)
+	}
+	_ = raw.SetDeadline(time.Time{})
+	defer conn.Close()
+
+	if fr := exposeFrame(t, conn, strconv.Itoa(freeTestPort(t)), "transport=inline"); fr.Typ != Utils.CTRLEXPOSED {
+		t.Fatal("Expected the port to be exposed over the WebSocket, got", fr)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Clients()) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(s.Clients()) != 2 {
+		t.Error("Expected both connections as clients, got", s.Clients())
+	}
+}
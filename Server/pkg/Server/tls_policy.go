@@ -0,0 +1,70 @@
+package Server
+
+import (
+	"crypto/tls"
+	"errors"
+	"strings"
+)
+
+// ParseTLSVersion parses the lowest TLS version to accept, "1.2" or "1.3".
+func ParseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, errors.New("unsupported TLS version " + s)
+}
+
+// ParseCipherSuites parses a comma separated list of the names of TLS 1.2 cipher suites, e.g.
+// "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256". Insecure suites are refused. An empty string is an empty list.
+func ParseCipherSuites(s string) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var suites []uint16
+	for _, name := range strings.Split(s, ",") {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return nil, errors.New("unknown or insecure cipher suite " + name)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// ParseALPN parses a comma separated list of ALPN protocol IDs. An empty string is an empty list.
+func ParseALPN(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
+
+// validateTLSPolicy checks the TLS version and that the cipher suites are secure ones of TLS 1.2.
+func (c *Config) validateTLSPolicy() error {
+	if c.TLSMinVersion != tls.VersionTLS12 && c.TLSMinVersion != tls.VersionTLS13 {
+		return errors.New("unsupported minimum TLS version")
+	}
+	for _, id := range c.CipherSuites {
+		if _, ok := cipherSuiteID(tls.CipherSuiteName(id)); !ok {
+			return errors.New("insecure cipher suite " + tls.CipherSuiteName(id))
+		}
+	}
+	for _, proto := range append(c.CtrlALPN, c.DataALPN...) {
+		if proto == "" || len(proto) > 255 {
+			return errors.New("invalid ALPN protocol ID")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package Server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Tracing of control operations and relayed connections, exported as OpenTelemetry spans with OTLP over HTTP in its
+// JSON encoding to Config.OTLPEndpoint.
+const (
+	// TRACEEXPORTINTERVAL is how often finished spans are sent to the collector
+	TRACEEXPORTINTERVAL = 5 * time.Second
+	// TRACEMAXQUEUE is the maximum amount of finished spans waiting to be sent, further ones are dropped
+	TRACEMAXQUEUE = 2048
+	// TRACESERVICE is the service.name of the spans
+	TRACESERVICE = "goexpose-server"
+)
+
+// tracer collects finished spans and sends them to the collector. A nil tracer traces nothing, its spans are nil.
+// It is safe for concurrent use.
+type tracer struct {
+	endpoint string
+	http     *http.Client
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	queue   []*span
+	dropped int
+}
+
+// span is an operation of a trace. Its methods do nothing on a nil span.
+type span struct {
+	tracer   *tracer
+	name     string
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	start    time.Time
+
+	mu    sync.Mutex
+	end   time.Time
+	attrs []slog.Attr
+	// failure is the reason the operation failed, empty if it succeeded
+	failure string
+}
+
+type spanKey struct{}
+
+func newTracer(endpoint string, logger *slog.Logger) *tracer {
+	return &tracer{endpoint: endpoint, http: &http.Client{Timeout: TRACEEXPORTINTERVAL}, logger: logger}
+}
+
+// start begins a span with the name, a child of the span of ctx if there is one. The returned context carries the new
+// span, finish has to be called once the operation is done.
+func (t *tracer) start(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{tracer: t, name: name, start: time.Now(), attrs: attrs}
+	_, _ = rand.Read(s.spanID[:])
+	if parent := spanFrom(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// spanFrom returns the span carried by ctx, or nil.
+func spanFrom(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// set adds attributes to the span.
+func (s *span) set(attrs ...slog.Attr) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attrs...)
+}
+
+// fail marks the operation of the span as failed for the reason.
+func (s *span) fail(reason string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failure = reason
+}
+
+// finish ends the span, failed if err is set, and queues it for export. Later calls do nothing.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.fail(err.Error())
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.queueSpan(s)
+}
+
+func (t *tracer) queueSpan(s *span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) >= TRACEMAXQUEUE {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, s)
+}
+
+// run exports the finished spans every TRACEEXPORTINTERVAL, and a last time when the context is cancelled.
+func (t *tracer) run(ctx context.Context) {
+	ticker := time.NewTicker(TRACEEXPORTINTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.export()
+		case <-ctx.Done():
+			t.export()
+			return
+		}
+	}
+}
+
+// export sends the queued spans to the collector. Spans that can't be sent are dropped.
+func (t *tracer) export() {
+	t.mu.Lock()
+	spans, dropped := t.queue, t.dropped
+	t.queue, t.dropped = nil, 0
+	t.mu.Unlock()
+	if dropped > 0 {
+		t.logger.Warn("Dropped spans, the export queue was full", slog.String("Func", "export"), slog.Int("Dropped", dropped))
+	}
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(otlpRequest(spans))
+	if err != nil {
+		t.logger.Error("Error encoding spans", slog.String("Func", "export"), "Error", err)
+		return
+	}
+	resp, err := t.http.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err == nil {
+		_ = resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			err = errors.New("collector answered " + resp.Status)
+		}
+	}
+	if err != nil {
+		t.logger.Error("Error exporting spans", slog.String("Func", "export"), slog.Int("Spans", len(spans)), "Error", err)
+	}
+}
+
+// The OTLP JSON encoding of spans, IDs are hex encoded and 64 bit integers are strings.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+// otlpRequest builds the body of an export request for the spans, in a single scope of the server.
+func otlpRequest(spans []*span) map[string]any {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID: hex.EncodeToString(s.traceID[:]),
+			SpanID:  hex.EncodeToString(s.spanID[:]),
+			Name:    s.name,
+			// internal, operations of the server
+			Kind:              1,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttrs(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		if s.failure != "" {
+			// error
+			o.Status = otlpStatus{Code: 2, Message: s.failure}
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, o)
+	}
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource":   map[string]any{"attributes": otlpAttrs([]slog.Attr{slog.String("service.name", TRACESERVICE)})},
+			"scopeSpans": []any{map[string]any{"scope": map[string]any{"name": "goexpose"}, "spans": encoded}},
+		}},
+	}
+}
+
+func otlpAttrs(attrs []slog.Attr) []otlpAttr {
+	encoded := make([]otlpAttr, 0, len(attrs))
+	for _, a := range attrs {
+		var v otlpValue
+		switch a.Value.Kind() {
+		case slog.KindInt64:
+			s := strconv.FormatInt(a.Value.Int64(), 10)
+			v.IntValue = &s
+		case slog.KindUint64:
+			s := strconv.FormatUint(a.Value.Uint64(), 10)
+			v.IntValue = &s
+		case slog.KindFloat64:
+			f := a.Value.Float64()
+			v.DoubleValue = &f
+		case slog.KindBool:
+			b := a.Value.Bool()
+			v.BoolValue = &b
+		default:
+			s := a.Value.String()
+			v.StringValue = &s
+		}
+		encoded = append(encoded, otlpAttr{Key: a.Key, Value: v})
+	}
+	return encoded
+}
@@ -0,0 +1,130 @@
+package Server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Transport carries control connections of clients to the server. The server runs the TLS handshake of the control
+// connection on the connections its listener accepts, and serves the clients on top, so clients authenticate alike on
+// every transport. Clients of transports other than the control port can't be expected to reach proxy ports or the
+// data port, they relay their ports with transport=inline.
+//
+// The server listens on the control port and on Config.WebSocketAddr, applications embedding the server add
+// transports of their own with Server.Transports. There is no QUIC transport, it is declined as the standard library
+// has none. An application bringing a QUIC implementation adds it as a Transport whose listener accepts a stream per
+// control connection.
+type Transport interface {
+	// Listen starts accepting connections, until the listener is closed or the context is cancelled.
+	Listen(ctx context.Context) (net.Listener, error)
+}
+
+// tcpTransport is the control port, Config.CtrlAddr and Config.CtrlPort.
+type tcpTransport struct {
+	s *Server
+}
+
+func (t tcpTransport) Listen(ctx context.Context) (net.Listener, error) {
+	l, err := net.Listen(t.s.Config.listenNetwork("tcp"), net.JoinHostPort(t.s.Config.CtrlAddr, strconv.Itoa(t.s.Config.CtrlPort)))
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+	return l, nil
+}
+
+// transportListener accepts the control connections of all transports, with the TLS handshake of the control
+// connection to run on top. It is closed with the listener of the control port.
+type transportListener struct {
+	net.Listener
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *transportListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *transportListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// serve passes the connections of the listener of a transport on, wrapped for their handshake, until it is closed.
+func (l *transportListener) serve(transport net.Listener, wrap func(net.Conn) net.Conn, logger *slog.Logger) {
+	for {
+		conn, err := transport.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.Debug("Error accepting connection", slog.String("Func", "serve"), "Error", err)
+			continue
+		}
+		select {
+		case l.conns <- wrap(conn):
+		case <-l.done:
+			_ = conn.Close()
+		}
+	}
+}
+
+// ctrlListen listens on the control port, on Config.WebSocketAddr and with Server.Transports, and returns a listener
+// accepting their control connections with the provided TLS config, and those of Config.NoiseAddr with a Noise
+// handshake instead. It is closed when the context is cancelled, which ends the accept loop of Run. Failing to listen
+// on the control port is fatal, a failing transport is only logged.
+func (s *Server) ctrlListen(ctx context.Context, config *tls.Config) net.Listener {
+	ctrl, err := tcpTransport{s: s}.Listen(ctx)
+	if err != nil {
+		s.Logger.Error("Error TLS listening", slog.String("Func", "ctrlListen"), slog.Int("Port", s.Config.CtrlPort), "Error", err)
+		panic(err)
+	}
+	l := &transportListener{Listener: ctrl, conns: make(chan net.Conn), done: make(chan struct{})}
+	withTLS := func(conn net.Conn) net.Conn {
+		return tls.Server(conn, config)
+	}
+	go func() {
+		l.serve(ctrl, withTLS, s.Logger)
+		s.Logger.Debug("Closing TLS listener", slog.String("Func", "ctrlListen"))
+		_ = l.Close()
+	}()
+	transports := s.Transports
+	if s.Config.WebSocketAddr != "" {
+		transports = append([]Transport{webSocketTransport{s: s}}, transports...)
+	}
+	for _, transport := range transports {
+		tl, err := transport.Listen(ctx)
+		if err != nil {
+			s.Logger.Error("Error listening with transport", slog.String("Func", "ctrlListen"), "Error", err)
+			continue
+		}
+		go func() {
+			<-l.done
+			_ = tl.Close()
+		}()
+		go l.serve(tl, withTLS, s.Logger)
+	}
+	if s.Config.NoiseAddr != "" {
+		err = s.noiseListen(l)
+		if err != nil {
+			s.Logger.Error("Error listening for Noise control connections", slog.String("Func", "ctrlListen"), "Error", err)
+		}
+	}
+	return l
+}
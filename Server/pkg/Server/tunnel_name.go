@@ -0,0 +1,47 @@
+package Server
+
+// MAXTUNNELNAME is the longest name a client can give an exposed port.
+const MAXTUNNELNAME = 64
+
+// validTunnelName reports whether name can name an exposed port. Names start with a letter, so a HIDE frame can
+// carry either a port or a name, and consist of letters, digits, '-', '_' and '.'.
+func validTunnelName(name string) bool {
+	if name == "" || len(name) > MAXTUNNELNAME {
+		return false
+	}
+	for i, ch := range name {
+		letter := (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+		if i == 0 && !letter {
+			return false
+		}
+		if !letter && !(ch >= '0' && ch <= '9') && ch != '-' && ch != '_' && ch != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// namedRelay returns the relay of the network the client named name, or nil if there is none.
+func (c *ClientHandler) namedRelay(network string, name string) *Relay {
+	if name == "" {
+		return nil
+	}
+	for _, relay := range c.tunnels.snapshot(network) {
+		if relay.config.Load().Name == name {
+			return relay
+		}
+	}
+	return nil
+}
+
+// nameTaken reports whether the client named another exposed port than the port of the network name already.
+// Names are unique across both networks.
+func (c *ClientHandler) nameTaken(network string, externalPort int, name string) bool {
+	for _, n := range []string{"tcp", "udp"} {
+		relay := c.namedRelay(n, name)
+		if relay != nil && (n != network || relay.externalPort != externalPort) {
+			return true
+		}
+	}
+	return false
+}
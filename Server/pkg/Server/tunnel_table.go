@@ -0,0 +1,95 @@
+package Server
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+)
+
+// tunnelTable holds the relays of the ports a client exposes, by network and port. It is safe for concurrent use,
+// so relay goroutines and snapshots for admins can read it while the handle loop of the client changes it.
+// onAdd and onRemove are called after a relay was added or removed, outside of the lock, e.g. to keep the Registry
+// in sync. Either may be nil.
+type tunnelTable struct {
+	mu       sync.RWMutex
+	tcp      map[int]*Relay
+	udp      map[int]*Relay
+	onAdd    func(*Relay)
+	onRemove func(*Relay)
+}
+
+func newTunnelTable(onAdd func(*Relay), onRemove func(*Relay)) *tunnelTable {
+	return &tunnelTable{
+		tcp:      make(map[int]*Relay),
+		udp:      make(map[int]*Relay),
+		onAdd:    onAdd,
+		onRemove: onRemove,
+	}
+}
+
+// relaysLocked returns the map of the network, "tcp" or "udp". t.mu must be held.
+func (t *tunnelTable) relaysLocked(network string) map[int]*Relay {
+	if network == "udp" {
+		return t.udp
+	}
+	return t.tcp
+}
+
+// add registers the relay of its network and external port, replacing the relay registered for them before.
+func (t *tunnelTable) add(relay *Relay) {
+	t.mu.Lock()
+	t.relaysLocked(relay.network)[relay.externalPort] = relay
+	t.mu.Unlock()
+	if t.onAdd != nil {
+		t.onAdd(relay)
+	}
+}
+
+// remove unregisters the relay of the port of the network and returns it, or nil if the port is not exposed.
+func (t *tunnelTable) remove(network string, port int) *Relay {
+	t.mu.Lock()
+	relays := t.relaysLocked(network)
+	relay, ok := relays[port]
+	delete(relays, port)
+	t.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	if t.onRemove != nil {
+		t.onRemove(relay)
+	}
+	return relay
+}
+
+// get returns the relay of the port of the network, or nil if the port is not exposed.
+func (t *tunnelTable) get(network string, port int) *Relay {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.relaysLocked(network)[port]
+}
+
+// count returns the amount of exposed ports of the network.
+func (t *tunnelTable) count(network string) int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.relaysLocked(network))
+}
+
+// snapshot returns the relays of the network ordered by port. Callers may add and remove relays while iterating it.
+func (t *tunnelTable) snapshot(network string) []*Relay {
+	t.mu.RLock()
+	relays := make([]*Relay, 0, len(t.relaysLocked(network)))
+	for _, relay := range t.relaysLocked(network) {
+		relays = append(relays, relay)
+	}
+	t.mu.RUnlock()
+	slices.SortFunc(relays, func(a, b *Relay) int {
+		return cmp.Compare(a.externalPort, b.externalPort)
+	})
+	return relays
+}
+
+// all returns the relays of both networks, the TCP ones first, see snapshot.
+func (t *tunnelTable) all() []*Relay {
+	return append(t.snapshot("tcp"), t.snapshot("udp")...)
+}
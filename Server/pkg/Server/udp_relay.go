@@ -0,0 +1,446 @@
+package Server
+
+import (
+	"Utils"
+	"bufio"
+	"container/list"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULTUDPTIMEOUT is the time after which idle UDP sessions are expired, if the client doesn't choose one.
+const DEFAULTUDPTIMEOUT = 60 * time.Second
+
+// UDPSESSIONQUEUE is the amount of datagrams queued per session while its proxy connection is set up or busy.
+// Further datagrams are dropped, like a full socket buffer would.
+const UDPSESSIONQUEUE = 64
+
+// udpSession is the state of one external UDP peer. Every session has its own proxy connection to the client,
+// datagrams of the peer are written to it, and datagrams read from it are sent back to the peer.
+// Datagrams of the peer are queued in out and written by the forwarding goroutine of the session, so setting up the
+// proxy connection of a new session doesn't hold up the datagrams of the others.
+// Datagrams are framed with Utils.WriteDatagram on the proxy connection, to keep their boundaries, or with
+// Utils.WriteFragmented if the relay fragments datagrams larger than its MTU.
+type udpSession struct {
+	// peer and key, the string form of peer, change if a QUIC peer migrates, both are guarded by the sessionsMu of the relay
+	peer *net.UDPAddr
+	key  string
+	// proxConn is set by runSessionForward once the proxy connection is established, guarded by the sessionsMu of the relay
+	proxConn net.Conn
+	out      chan []byte
+	// done is closed when the session is closed
+	done chan struct{}
+	// mtu and fragment are taken from the relay config when the session is created, the client frames the
+	// datagrams of the session the same way for its whole lifetime
+	mtu      int
+	fragment bool
+	// lastSeen is the time of the last datagram in either direction, guarded by the sessionsMu of the relay
+	lastSeen time.Time
+	// elem is the element of the session in the LRU list of the relay
+	elem *list.Element
+	// cids are the QUIC connection IDs routed to the session, if the relay has QUIC affinity
+	cids []string
+	// migrateKey is the address the QUIC peer may be migrating to, migrateCount counts the datagrams it sent in a row,
+	// both are guarded by the sessionsMu of the relay
+	migrateKey   string
+	migrateCount int
+	// started is the time of the first datagram, bytesIn and bytesOut count the bytes relayed for the session, for its
+	// access log record
+	started  time.Time
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+}
+
+// QUICMAXCIDS is the maximum amount of QUIC connection IDs tracked per session.
+const QUICMAXCIDS = 8
+
+// QUICMIGRATEDATAGRAMS is how many short header datagrams a new address has to send in a row on the connection IDs of
+// a QUIC session before the session migrates to it. A single datagram with a known connection ID, e.g. a spoofed one,
+// doesn't redirect the session, it is relayed to the client of the session alone.
+const QUICMIGRATEDATAGRAMS = 3
+
+// runUdp reads datagrams from the external UDP port until the context is cancelled. Datagrams are forwarded to the
+// session of their peer, a new session with its own proxy connection is created for unknown peers.
+// With QUIC affinity, datagrams are routed by their QUIC connection ID first, see quicSessionLocked.
+func (r *Relay) runUdp(ctx context.Context) {
+	defer close(r.stopped)
+	stop := context.AfterFunc(ctx, func() {
+		err := r.udpConn.Close()
+		if err != nil {
+			r.logger.Error("Error closing UDP relay socket", slog.String("Func", "runUdp"), "Error", err)
+		}
+	})
+	defer stop()
+	go r.runSessionExpiry(ctx)
+
+	// a single buffer per relay, large enough for any datagram
+	buf := make([]byte, Utils.MAXDATAGRAM)
+	for {
+		n, peer, err := r.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			if r.detached.Load() {
+				return
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				r.logger.Error("Error reading from UDP relay socket", slog.String("Func", "runUdp"), "Error", err)
+				r.reportError(err)
+			}
+			return
+		}
+		session := r.udpSession(ctx, peer, buf[:n])
+		if session == nil {
+			continue
+		}
+		if session.oversized(n) {
+			r.dropOversized(peer, session.mtu, n)
+			continue
+		}
+		select {
+		case session.out <- append([]byte(nil), buf[:n]...):
+		default:
+			r.logger.Debug("Dropping datagram, session queue is full", slog.String("Func", "runUdp"), slog.String(Utils.PEERKEY, peer.String()))
+		}
+	}
+}
+
+// runSessionForward takes the proxy connection of a new session and writes the queued datagrams of the peer to it,
+// until the session is closed.
+func (r *Relay) runSessionForward(ctx context.Context, session *udpSession) {
+	proxConn, err := r.takeProxyConn(ctx)
+	if err != nil {
+		r.logger.Error("Error pairing proxy connection", slog.String("Func", "runSessionForward"), "Error", err)
+		r.reportError(err)
+		r.closeSession(session, CLOSEUNPAIRED)
+		return
+	}
+	r.sessionsMu.Lock()
+	closed := session.elem == nil
+	if !closed {
+		session.proxConn = proxConn
+	}
+	r.sessionsMu.Unlock()
+	if closed {
+		// the session was evicted or expired in the meantime
+		_ = proxConn.Close()
+		return
+	}
+	go r.runSessionReturn(session)
+
+	for {
+		select {
+		case datagram := <-session.out:
+			err = session.writeDatagram(datagram)
+			if err != nil {
+				r.logger.Debug("Error writing datagram to proxy connection", slog.String("Func", "runSessionForward"), "Error", err)
+				r.closeSession(session, CLOSEERROR)
+				return
+			}
+			r.stats.BytesIn.Add(uint64(len(datagram)))
+			session.bytesIn.Add(uint64(len(datagram)))
+			r.limitIn.wait(len(datagram))
+		case <-session.done:
+			return
+		}
+	}
+}
+
+// udpSession returns the session of the datagram and marks it as recently used, or creates a new one, whose proxy
+// connection is taken in the background. If the relay already tracks MaxSessions sessions, the least recently used
+// session is evicted. If the peer is blocked by the allow and deny lists or a connection limit or rate of the relay
+// is reached, no session is created and nil is returned.
+func (r *Relay) udpSession(ctx context.Context, peer *net.UDPAddr, datagram []byte) *udpSession {
+	key := peer.String()
+	cfg := r.config.Load()
+	r.sessionsMu.Lock()
+	var session *udpSession
+	if cfg.QuicAffinity {
+		session = r.quicSessionLocked(datagram)
+		if session != nil {
+			r.trackMigrationLocked(session, peer, key, datagram)
+		}
+	}
+	if session == nil {
+		session = r.sessions[key]
+	}
+	if session != nil {
+		r.touchLocked(session)
+	}
+	r.sessionsMu.Unlock()
+	if session != nil {
+		return session
+	}
+	if !r.admitPeer(peer) {
+		return nil
+	}
+	if !r.admitRate(peer) {
+		r.logger.Debug("Connection rate reached, dropping datagram of new UDP session", slog.String("Func", "udpSession"), slog.String(Utils.PEERKEY, key))
+		return nil
+	}
+	if !r.acquireConn() {
+		r.logger.Debug("Connection limit reached, dropping datagram of new UDP session", slog.String("Func", "udpSession"), slog.String(Utils.PEERKEY, key))
+		return nil
+	}
+	if !r.acquirePeer(peer) {
+		r.releaseConn()
+		r.logger.Debug("Connection limit of peer reached, dropping datagram of new UDP session", slog.String("Func", "udpSession"), slog.String(Utils.PEERKEY, key))
+		return nil
+	}
+
+	session = &udpSession{
+		peer:     peer,
+		key:      key,
+		out:      make(chan []byte, UDPSESSIONQUEUE),
+		done:     make(chan struct{}),
+		mtu:      cfg.MTU,
+		fragment: cfg.Fragment,
+		lastSeen: time.Now(),
+		started:  time.Now(),
+	}
+
+	var evicted *udpSession
+	var evictedKey string
+	r.sessionsMu.Lock()
+	if cfg.MaxSessions > 0 && r.sessionLRU.Len() >= cfg.MaxSessions {
+		evicted = r.sessionLRU.Back().Value.(*udpSession)
+		evictedKey = evicted.key
+	}
+	r.sessions[key] = session
+	session.elem = r.sessionLRU.PushFront(session)
+	r.sessionsMu.Unlock()
+
+	if evicted != nil {
+		r.logger.Debug("Evicting least recently used UDP session", slog.String("Func", "udpSession"), slog.String(Utils.PEERKEY, evictedKey))
+		r.closeSession(evicted, CLOSEEVICTED)
+		r.stats.Evicted.Add(1)
+	}
+	r.stats.Accepted.Add(1)
+	r.stats.Active.Add(1)
+	r.logger.Debug("New UDP session", slog.String("Func", "udpSession"), slog.String(Utils.PEERKEY, key))
+
+	go r.runSessionForward(ctx, session)
+	return session
+}
+
+// touchLocked marks the session as recently used. The caller must hold sessionsMu.
+func (r *Relay) touchLocked(session *udpSession) {
+	session.lastSeen = time.Now()
+	r.sessionLRU.MoveToFront(session.elem)
+}
+
+// runSessionReturn sends the data of the client back to the peer of the session, until its proxy connection is closed.
+func (r *Relay) runSessionReturn(session *udpSession) {
+	reason := CLOSEDONE
+	defer func() {
+		r.closeSession(session, reason)
+	}()
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+	datagram := *buf
+	reader := bufio.NewReader(session.proxConn)
+	for {
+		n, err := session.readDatagram(reader, datagram)
+		if errors.Is(err, Utils.ErrDatagramTooLarge) {
+			r.logger.Debug("Dropping datagram larger than the relay buffer", slog.String("Func", "runSessionReturn"))
+			r.stats.Oversized.Add(1)
+			continue
+		}
+		if err != nil {
+			return
+		}
+		r.sessionsMu.Lock()
+		r.touchLocked(session)
+		peer := session.peer
+		if r.config.Load().QuicAffinity {
+			// the connection IDs the backend chooses are the ones the peer sends in later packets
+			if _, scid, ok := quicLongHeaderIDs(datagram[:n]); ok {
+				r.addCIDLocked(session, scid)
+			}
+		}
+		r.sessionsMu.Unlock()
+		if session.oversized(n) {
+			r.dropOversized(peer, session.mtu, n)
+			continue
+		}
+		_, err = r.udpConn.WriteToUDP(datagram[:n], peer)
+		if err != nil {
+			r.logger.Debug("Error writing datagram to peer", slog.String("Func", "runSessionReturn"), "Error", err)
+			reason = CLOSEERROR
+			return
+		}
+		r.stats.BytesOut.Add(uint64(n))
+		session.bytesOut.Add(uint64(n))
+		r.limitOut.wait(n)
+	}
+}
+
+// oversized reports whether a datagram of length n exceeds the MTU of a session that doesn't fragment.
+func (s *udpSession) oversized(n int) bool {
+	return s.mtu > 0 && n > s.mtu && !s.fragment
+}
+
+// writeDatagram frames the datagram on the proxy connection of the session.
+func (s *udpSession) writeDatagram(datagram []byte) error {
+	if s.fragment && s.mtu > 0 {
+		return Utils.WriteFragmented(s.proxConn, datagram, s.mtu)
+	}
+	return Utils.WriteDatagram(s.proxConn, datagram)
+}
+
+// readDatagram reads a datagram framed by the client from reader, a buffered reader of the proxy connection.
+func (s *udpSession) readDatagram(reader *bufio.Reader, buf []byte) (int, error) {
+	if s.fragment && s.mtu > 0 {
+		return Utils.ReadFragmented(reader, buf)
+	}
+	return Utils.ReadDatagram(reader, buf)
+}
+
+// dropOversized counts and logs a datagram of the peer dropped because it exceeds the MTU of its session.
+func (r *Relay) dropOversized(peer *net.UDPAddr, mtu int, n int) {
+	r.stats.Oversized.Add(1)
+	r.logger.Debug("Dropping datagram larger than the MTU", slog.String("Func", "dropOversized"), slog.String(Utils.PEERKEY, peer.String()), slog.Int("Size", n), slog.Int("MTU", mtu))
+}
+
+// quicSessionLocked returns the session the QUIC connection ID of the datagram is routed to, or nil.
+// Short headers don't carry the length of the connection ID, so every length learned so far is tried.
+// The caller must hold sessionsMu.
+func (r *Relay) quicSessionLocked(datagram []byte) *udpSession {
+	if dcid, _, ok := quicLongHeaderIDs(datagram); ok {
+		return r.quicCIDs[string(dcid)]
+	}
+	for cidLen := 1; cidLen <= QUICMAXCIDLEN; cidLen++ {
+		if !r.quicCIDLens[cidLen] {
+			continue
+		}
+		if dcid, ok := quicShortHeaderDCID(datagram, cidLen); ok {
+			if session, ok := r.quicCIDs[string(dcid)]; ok {
+				return session
+			}
+		}
+	}
+	return nil
+}
+
+// addCIDLocked routes the QUIC connection ID to the session. The caller must hold sessionsMu.
+func (r *Relay) addCIDLocked(session *udpSession, cid []byte) {
+	if len(cid) == 0 || len(session.cids) >= QUICMAXCIDS {
+		return
+	}
+	key := string(cid)
+	if r.quicCIDs[key] == session {
+		return
+	}
+	r.quicCIDs[key] = session
+	r.quicCIDLens[len(cid)] = true
+	session.cids = append(session.cids, key)
+}
+
+// trackMigrationLocked counts the datagrams routed to the session by their QUIC connection ID from another address
+// than the one of its peer, and migrates the session once the address sent QUICMIGRATEDATAGRAMS in a row. A datagram
+// of the current address starts over. Long header packets never migrate a session, QUIC peers only migrate once the
+// handshake is done. The caller must hold sessionsMu.
+func (r *Relay) trackMigrationLocked(session *udpSession, peer *net.UDPAddr, key string, datagram []byte) {
+	if key == session.key {
+		session.migrateKey, session.migrateCount = "", 0
+		return
+	}
+	if _, _, ok := quicLongHeaderIDs(datagram); ok {
+		return
+	}
+	if session.migrateKey != key {
+		session.migrateKey, session.migrateCount = key, 0
+	}
+	session.migrateCount++
+	if session.migrateCount >= QUICMIGRATEDATAGRAMS {
+		r.migrateLocked(session, peer, key)
+	}
+}
+
+// migrateLocked moves the session to the new address of its peer, after a QUIC connection migration or a NAT rebinding.
+// Datagrams of the client are sent to the new address from now on. The caller must hold sessionsMu.
+func (r *Relay) migrateLocked(session *udpSession, peer *net.UDPAddr, key string) {
+	r.logger.Debug("Migrating QUIC session to new peer address", slog.String("Func", "migrateLocked"), slog.String(Utils.PEERKEY, key))
+	if r.sessions[session.key] == session {
+		delete(r.sessions, session.key)
+	}
+	session.peer = peer
+	session.key = key
+	session.migrateKey, session.migrateCount = "", 0
+	r.sessions[key] = session
+}
+
+// closeSession closes the proxy connection of the session and removes it from the session table. The session is
+// written to the access log with the reason. It is safe to call multiple times, only the first call logs.
+func (r *Relay) closeSession(session *udpSession, reason string) {
+	r.sessionsMu.Lock()
+	// a session is in the LRU list until it is closed, even if another session took over its address
+	removed := session.elem != nil
+	if removed {
+		r.sessionLRU.Remove(session.elem)
+		session.elem = nil
+		if r.sessions[session.key] == session {
+			delete(r.sessions, session.key)
+		}
+		for _, cid := range session.cids {
+			if r.quicCIDs[cid] == session {
+				delete(r.quicCIDs, cid)
+			}
+		}
+	}
+	proxConn, peer := session.proxConn, session.peer
+	r.sessionsMu.Unlock()
+	if removed {
+		close(session.done)
+		if proxConn != nil {
+			_ = proxConn.Close()
+		}
+		r.stats.Active.Add(-1)
+		r.releaseConn()
+		r.releasePeer(peer)
+		r.logAccess(peer, session.bytesIn.Load(), session.bytesOut.Load(), session.started, reason)
+	}
+}
+
+// runSessionExpiry periodically closes sessions without traffic for longer than the session timeout of the relay config.
+// All sessions are closed when the context is cancelled.
+func (r *Relay) runSessionExpiry(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.expireSessions(time.Time{})
+			return
+		case now := <-ticker.C:
+			r.expireSessions(now.Add(-r.config.Load().SessionTimeout))
+		}
+	}
+}
+
+// expireSessions closes all sessions last seen before deadline. A zero deadline closes all sessions, as the relay stops.
+// The LRU list is ordered by lastSeen, so only its tail has to be checked.
+func (r *Relay) expireSessions(deadline time.Time) {
+	reason := CLOSEEXPIRED
+	if deadline.IsZero() {
+		reason = CLOSESTOPPED
+	}
+	var expired []*udpSession
+	var keys []string
+	r.sessionsMu.Lock()
+	for e := r.sessionLRU.Back(); e != nil; e = e.Prev() {
+		session := e.Value.(*udpSession)
+		if !deadline.IsZero() && !session.lastSeen.Before(deadline) {
+			break
+		}
+		expired = append(expired, session)
+		keys = append(keys, session.key)
+	}
+	r.sessionsMu.Unlock()
+	for i, session := range expired {
+		r.logger.Debug("Expiring UDP session", slog.String("Func", "expireSessions"), slog.String(Utils.PEERKEY, keys[i]))
+		r.closeSession(session, reason)
+	}
+}
@@ -0,0 +1,196 @@
+package Server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Webhooks post the events of the server as WebhookPayload to the URLs of Config.Webhooks.
+const (
+	// WEBHOOKSIGNATURE is the header of the signature of a payload, sha256= followed by the hex encoded HMAC-SHA256
+	// of the timestamp of WEBHOOKTIMESTAMP, a dot and the body with the secret of the webhook, see SignWebhook.
+	// Receivers should refuse payloads with an old timestamp, so they can't be replayed.
+	WEBHOOKSIGNATURE = "X-Goexpose-Signature"
+	// WEBHOOKTIMESTAMP is the header of the time a payload was sent at, in seconds since the Unix epoch
+	WEBHOOKTIMESTAMP = "X-Goexpose-Timestamp"
+	// WEBHOOKEVENT is the header of the kind of the event of a payload
+	WEBHOOKEVENT = "X-Goexpose-Event"
+	// WEBHOOKTIMEOUT is how long a webhook has to answer
+	WEBHOOKTIMEOUT = 10 * time.Second
+	// WEBHOOKATTEMPTS is how often a payload is sent until the webhook accepts it, WEBHOOKRETRYDELAY the delay before
+	// the first retry, which doubles with every further one. Payloads are only sent again after network errors, server
+	// errors and 429 Too Many Requests.
+	WEBHOOKATTEMPTS   = 3
+	WEBHOOKRETRYDELAY = time.Second
+)
+
+// Webhook is a URL the events of the server are posted to.
+type Webhook struct {
+	URL string
+	// Secret signs the payloads, see WEBHOOKSIGNATURE
+	Secret string
+	// Kinds are the kinds of events posted, e.g. EVENTCLIENTCONNECTED, all but EVENTTRAFFICSAMPLE if empty
+	Kinds []string
+}
+
+// WebhookPayload is the body posted to webhooks, the event and a line of text describing it. The text field makes the
+// payload a message of Slack incoming webhooks as well.
+type WebhookPayload struct {
+	AdminEvent
+	Text string `json:"text"`
+}
+
+// LoadWebhooks loads the webhooks from a JSON file holding a list of Webhook. An empty path loads none.
+func LoadWebhooks(path string) ([]Webhook, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []Webhook
+	err = json.Unmarshal(data, &hooks)
+	if err != nil {
+		return nil, err
+	}
+	return hooks, nil
+}
+
+// validate checks that the webhook has an HTTP URL, a secret long enough and known kinds of events.
+func (w Webhook) validate() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("invalid webhook URL " + w.URL)
+	}
+	if len(w.Secret) < MINTOKENLENGTH {
+		return errors.New("secret of webhook " + u.Host + " shorter than " + strconv.Itoa(MINTOKENLENGTH) + " bytes")
+	}
+	for _, kind := range w.Kinds {
+		if !slices.Contains(EVENTKINDS, kind) {
+			return errors.New("unknown event kind " + kind + " of webhook " + u.Host)
+		}
+	}
+	return nil
+}
+
+// wants reports whether the event is posted to the webhook.
+func (w Webhook) wants(kind string) bool {
+	if len(w.Kinds) == 0 {
+		return kind != EVENTTRAFFICSAMPLE
+	}
+	return slices.Contains(w.Kinds, kind)
+}
+
+// SignWebhook returns the signature of a payload sent at the timestamp, the value of WEBHOOKSIGNATURE.
+func SignWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookSender posts the events to a webhook. Each webhook subscribes on its own, so one that is slow or down doesn't
+// delay the others.
+type webhookSender struct {
+	ctx    context.Context
+	hook   Webhook
+	http   *http.Client
+	logger *slog.Logger
+}
+
+func newWebhookSender(ctx context.Context, hook Webhook, logger *slog.Logger) *webhookSender {
+	return &webhookSender{ctx: ctx, hook: hook, http: &http.Client{Timeout: WEBHOOKTIMEOUT}, logger: logger}
+}
+
+func (w *webhookSender) HandleEvent(event Event) {
+	if !w.hook.wants(event.Kind) {
+		return
+	}
+	body, err := json.Marshal(WebhookPayload{AdminEvent: newAdminEvent(event), Text: eventText(event)})
+	if err != nil {
+		w.logger.Error("Error encoding webhook payload", slog.String("Func", "HandleEvent"), "Error", err)
+		return
+	}
+	delay := WEBHOOKRETRYDELAY
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(event.Kind, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == WEBHOOKATTEMPTS {
+			w.logger.Error("Error posting event to webhook", slog.String("Func", "HandleEvent"), slog.String("URL", w.hook.URL),
+				slog.String("Kind", event.Kind), slog.Int("Attempts", attempt), "Error", err)
+			return
+		}
+		select {
+		case <-time.After(delay):
+			delay *= 2
+		case <-w.ctx.Done():
+			// the server stops, the remaining events are sent once
+			return
+		}
+	}
+}
+
+// post sends the payload once, and reports whether a failed one should be sent again.
+func (w *webhookSender) post(kind string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, w.hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WEBHOOKEVENT, kind)
+	req.Header.Set(WEBHOOKTIMESTAMP, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(WEBHOOKSIGNATURE, SignWebhook(w.hook.Secret, timestamp, body))
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, errors.New("webhook answered " + resp.Status)
+	}
+	return false, nil
+}
+
+// eventText describes the event in a line of text.
+func eventText(event Event) string {
+	client := event.Client.CN + " (" + strconv.FormatUint(event.ClientID, 10) + ")"
+	tunnel := event.Tunnel.Network + "/" + strconv.Itoa(event.Tunnel.Port)
+	var text string
+	switch event.Kind {
+	case EVENTCLIENTCONNECTED:
+		text = "Client " + client + " connected from " + event.Address
+	case EVENTCLIENTDISCONNECTED:
+		text = "Client " + client + " disconnected"
+	case EVENTTUNNELCREATED:
+		text = "Client " + client + " exposed " + tunnel + " on public port " + strconv.Itoa(event.Tunnel.PublicPort)
+	case EVENTTUNNELDESTROYED:
+		text = "Client " + client + " hid " + tunnel + " of public port " + strconv.Itoa(event.Tunnel.PublicPort)
+	case EVENTRELAYERROR:
+		text = "Relay error of " + tunnel + " of client " + client
+	case EVENTTRAFFICSAMPLE:
+		text = "Traffic of " + tunnel + " of client " + client + ": " + strconv.FormatUint(event.BytesIn, 10) + " bytes in, " +
+			strconv.FormatUint(event.BytesOut, 10) + " bytes out, " + strconv.FormatUint(event.Conns, 10) + " connections"
+	default:
+		text = event.Kind + " of client " + client
+	}
+	if event.Reason != "" {
+		text += ": " + event.Reason
+	}
+	return text
+}
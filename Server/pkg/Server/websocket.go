@@ -0,0 +1,102 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// webSocketTransport accepts control connections carried in a WebSocket on Config.WebSocketAddr. The WebSocket is the
+// outer layer, the client runs its usual TLS handshake inside of it.
+type webSocketTransport struct {
+	s *Server
+}
+
+// webSocketListener accepts the WebSockets its HTTPS server upgraded.
+type webSocketListener struct {
+	addr   net.Addr
+	server *http.Server
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (l *webSocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *webSocketListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return l.server.Close()
+}
+
+func (l *webSocketListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Listen serves Config.WebSocketAddr with the certificate of the server, and accepts the WebSockets of
+// Utils.WEBSOCKETPATH.
+func (t webSocketTransport) Listen(ctx context.Context) (net.Listener, error) {
+	s := t.s
+	wl, err := net.Listen(s.Config.listenNetwork("tcp"), s.Config.WebSocketAddr)
+	if err != nil {
+		return nil, err
+	}
+	// a load balancer in front of the WebSocket listener announces the address of the client
+	wl = &proxiedListener{Listener: wl, from: func() []netip.Prefix {
+		prefixes, _ := s.current().proxyPrefixes()
+		return prefixes
+	}}
+	outer := &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			config := s.tlsConfig.Load()
+			if config == nil {
+				return nil, errors.New("no certificate")
+			}
+			// the client presents its certificate in the inner handshake
+			config = config.Clone()
+			config.ClientAuth = tls.NoClientCert
+			config.VerifyPeerCertificate = nil
+			config.NextProtos = []string{"http/1.1"}
+			return config, nil
+		},
+	}
+	l := &webSocketListener{addr: wl.Addr(), conns: make(chan net.Conn), done: make(chan struct{})}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+Utils.WEBSOCKETPATH, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := Utils.AcceptWebSocket(w, r)
+		if err != nil {
+			s.Logger.Debug("Error accepting WebSocket", slog.String("Func", "Listen"), slog.String("Address", r.RemoteAddr), "Error", err)
+			return
+		}
+		select {
+		case l.conns <- ws:
+		case <-l.done:
+			_ = ws.Close()
+		}
+	})
+	l.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = l.Close()
+	}()
+	go func() {
+		_ = l.server.Serve(tls.NewListener(wl, outer))
+	}()
+	s.Logger.Info("Accepting control connections in WebSockets", slog.String("Func", "Listen"), slog.String("Address", wl.Addr().String()))
+	return l, nil
+}
@@ -0,0 +1,235 @@
+package Utils
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Compression presets of the compress option of an EXPOSE frame. COMPRESSFLATE compresses the relayed data with
+// DEFLATE, the others also start from a preset dictionary of the strings common in their protocol. A dictionary helps
+// small messages most, they have little history of their own to refer back to. There is no Zstandard preset, as the
+// standard library has no Zstandard codec.
+const (
+	COMPRESSFLATE = "flate"
+	COMPRESSJSON  = "json"
+	COMPRESSHTTP  = "http"
+	COMPRESSMQTT  = "mqtt"
+)
+
+// COMPRESSLEVEL is the DEFLATE level of CompressedConn, the fastest one of compress/flate that finds matches in
+// small flushed messages and their dictionary, lower levels send them uncompressed.
+const COMPRESSLEVEL = 7
+
+// Preset dictionaries, the most common strings come last, as DEFLATE encodes closer references shorter.
+const (
+	jsonDictionary = `{"id":"type":"name":"value":"data":"items":"status":"error":"message":"code":"result":` +
+		`"created_at":"updated_at":"timestamp":"count":"total":"page":"limit":"offset":"next":"user":"email":` +
+		`null,true,false,[{"id":},{"id":"}],"},{"":"","":[],"":{},"":0,"":1,"":"`
+	httpDictionary = "HTTP/1.1 200 OK\r\nHTTP/1.1 304 Not Modified\r\nHTTP/1.1 404 Not Found\r\n" +
+		"Content-Type: application/json\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: " +
+		"Cache-Control: no-cache\r\nConnection: keep-alive\r\nAccept-Encoding: gzip, deflate, br\r\n" +
+		"Accept-Language: en-US,en;q=0.9\r\nUser-Agent: Mozilla/5.0 \r\nAccept: */*\r\nCookie: " +
+		"Date: Server: ETag: Last-Modified: Location: Set-Cookie: Authorization: Bearer " +
+		"GET / HTTP/1.1\r\nPOST / HTTP/1.1\r\nHost: "
+	mqttDictionary = "MQTT\x04\x02MQIsdp\x03\x02$SYS/broker/clients/connected$SYS/broker/uptime" +
+		"homeassistant/sensor/state/status/config/availability/online/offline/set/get/" +
+		`{"state":"ON"}{"state":"OFF"}{"temperature":{"humidity":{"battery":{"linkquality":`
+)
+
+var compressionDictionaries = map[string][]byte{
+	COMPRESSFLATE: nil,
+	COMPRESSJSON:  []byte(jsonDictionary),
+	COMPRESSHTTP:  []byte(httpDictionary),
+	COMPRESSMQTT:  []byte(mqttDictionary),
+}
+
+// CompressionDictionary returns the preset dictionary of a compression preset, nil for COMPRESSFLATE, or false if
+// the preset is unknown.
+func CompressionDictionary(preset string) ([]byte, bool) {
+	dict, ok := compressionDictionaries[preset]
+	return dict, ok
+}
+
+// compressedChunk is the data decompressed by one read, or the error that ended decompression.
+type compressedChunk struct {
+	data []byte
+	err  error
+}
+
+// CompressedConn compresses the data written to a connection with DEFLATE and decompresses the data read from it,
+// both starting from the same dictionary. Every write is flushed, so the peer can decompress it right away.
+// CloseWrite ends the compressed stream, the peer reads io.EOF then.
+//
+// The data is decompressed in the background, so a read deadline passing doesn't break the stream: read deadlines
+// are kept by the CompressedConn, write deadlines are passed to the connection.
+type CompressedConn struct {
+	net.Conn
+
+	writeMu sync.Mutex
+	w       *flate.Writer
+
+	chunks chan compressedChunk
+	closed chan struct{}
+	once   sync.Once
+	// pending is the rest of the chunk read last, err the error reads return once it is read
+	pending []byte
+	err     error
+
+	deadlineMu sync.Mutex
+	deadline   time.Time
+	// deadlineSet is closed when the read deadline changes, so blocked reads pick it up
+	deadlineSet chan struct{}
+}
+
+// NewCompressedConn wraps conn with compression starting from dict, see CompressionDictionary. The compressed bytes
+// read from and written to conn are added to wireIn and wireOut, unless they are nil.
+func NewCompressedConn(conn net.Conn, dict []byte, wireIn *atomic.Uint64, wireOut *atomic.Uint64) *CompressedConn {
+	c := &CompressedConn{
+		Conn:        conn,
+		chunks:      make(chan compressedChunk, 1),
+		closed:      make(chan struct{}),
+		deadlineSet: make(chan struct{}),
+	}
+	// COMPRESSLEVEL is valid, NewWriterDict can't fail
+	c.w, _ = flate.NewWriterDict(countingWriter{w: conn, counter: wireOut}, COMPRESSLEVEL, dict)
+	go c.decompress(flate.NewReaderDict(countingReader{r: conn, counter: wireIn}, dict))
+	return c
+}
+
+// decompress reads the decompressed data until the stream or the connection ends, or the CompressedConn is closed.
+func (c *CompressedConn) decompress(r io.ReadCloser) {
+	defer r.Close()
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := r.Read(buf)
+		select {
+		case c.chunks <- compressedChunk{data: buf[:n], err: err}:
+		case <-c.closed:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (c *CompressedConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		err := c.await()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// await waits for the next decompressed chunk until the read deadline passes or changes.
+func (c *CompressedConn) await() error {
+	c.deadlineMu.Lock()
+	deadline, deadlineSet := c.deadline, c.deadlineSet
+	c.deadlineMu.Unlock()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case chunk := <-c.chunks:
+		c.pending, c.err = chunk.data, chunk.err
+	case <-c.closed:
+		return net.ErrClosed
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	case <-deadlineSet:
+	}
+	return nil
+}
+
+func (c *CompressedConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+// CloseWrite ends the compressed stream and shuts down the write side of the connection, if it can be.
+func (c *CompressedConn) CloseWrite() error {
+	c.writeMu.Lock()
+	err := c.w.Close()
+	c.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Close closes the connection and stops decompressing.
+func (c *CompressedConn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+func (c *CompressedConn) SetDeadline(t time.Time) error {
+	_ = c.SetReadDeadline(t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func (c *CompressedConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.deadline = t
+	close(c.deadlineSet)
+	c.deadlineSet = make(chan struct{})
+	return nil
+}
+
+// countingWriter adds the bytes written to w to counter, if set.
+type countingWriter struct {
+	w       io.Writer
+	counter *atomic.Uint64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	if cw.counter != nil {
+		cw.counter.Add(uint64(n))
+	}
+	return n, err
+}
+
+// countingReader adds the bytes read from r to counter, if set.
+type countingReader struct {
+	r       io.Reader
+	counter *atomic.Uint64
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if cr.counter != nil {
+		cr.counter.Add(uint64(n))
+	}
+	return n, err
+}
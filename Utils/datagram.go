@@ -0,0 +1,125 @@
+package Utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// MAXDATAGRAM is the largest datagram that can be framed, as its length is encoded in 2 bytes.
+const MAXDATAGRAM = 65535
+
+// ErrDatagramTooLarge is returned if a datagram doesn't fit the frame or the buffer it is read into.
+var ErrDatagramTooLarge = errors.New("datagram too large")
+
+// WriteDatagram writes a single datagram to w, prefixed by its length as a 2 byte big endian integer.
+// UDP relays use this framing on the proxy connections, so datagram boundaries survive the TCP hop.
+func WriteDatagram(w io.Writer, datagram []byte) error {
+	if len(datagram) > MAXDATAGRAM {
+		return ErrDatagramTooLarge
+	}
+	var header [2]byte
+	binary.BigEndian.PutUint16(header[:], uint16(len(datagram)))
+	// net.Buffers writes header and datagram in a single call where possible
+	bufs := net.Buffers{header[:], datagram}
+	_, err := bufs.WriteTo(w)
+	return err
+}
+
+// ReadDatagram reads a single datagram written by WriteDatagram from r into buf and returns its length.
+// If the datagram is larger than buf, it is discarded and ErrDatagramTooLarge is returned.
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if n > len(buf) {
+		_, err = io.CopyN(io.Discard, r, int64(n))
+		if err != nil {
+			return 0, err
+		}
+		return 0, ErrDatagramTooLarge
+	}
+	_, err = io.ReadFull(r, buf[:n])
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+// MAXFRAGMENT is the largest fragment written by WriteFragmented, the top bit of the length marks further fragments.
+const MAXFRAGMENT = 0x7fff
+
+const fragmentMore = 0x8000
+
+// WriteFragmented writes a datagram as fragments of at most mtu bytes. Fragments are framed like WriteDatagram,
+// with the top bit of the length set if more fragments of the same datagram follow. All fragments are written in a
+// single call where possible.
+func WriteFragmented(w io.Writer, datagram []byte, mtu int) error {
+	if len(datagram) > MAXDATAGRAM {
+		return ErrDatagramTooLarge
+	}
+	mtu = min(max(mtu, 1), MAXFRAGMENT)
+	bufs := make(net.Buffers, 0, 2*(len(datagram)/mtu+1))
+	for {
+		n := min(len(datagram), mtu)
+		length := uint16(n)
+		if n < len(datagram) {
+			length |= fragmentMore
+		}
+		header := binary.BigEndian.AppendUint16(nil, length)
+		bufs = append(bufs, header, datagram[:n])
+		datagram = datagram[n:]
+		if len(datagram) == 0 {
+			break
+		}
+	}
+	_, err := bufs.WriteTo(w)
+	return err
+}
+
+// ReadFragmented reads the fragments of a single datagram written by WriteFragmented from r, reassembles them in buf
+// and returns the length of the datagram. If the datagram is larger than buf, all its fragments are discarded
+// and ErrDatagramTooLarge is returned.
+func ReadFragmented(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	total := 0
+	tooLarge := false
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err != nil {
+			if total > 0 && errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		length := binary.BigEndian.Uint16(header[:])
+		n := int(length &^ fragmentMore)
+		if tooLarge || total+n > len(buf) {
+			tooLarge = true
+			_, err = io.CopyN(io.Discard, r, int64(n))
+		} else {
+			_, err = io.ReadFull(r, buf[total:total+n])
+			total += n
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if length&fragmentMore == 0 {
+			break
+		}
+	}
+	if tooLarge {
+		return 0, ErrDatagramTooLarge
+	}
+	return total, nil
+}
@@ -0,0 +1,189 @@
+package Utils
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ExposureState is the lifecycle state of an exposed port.
+type ExposureState int
+
+const (
+	// StateRequested is set when the EXPOSE frame was sent and the server has not answered yet
+	StateRequested ExposureState = iota
+	// StateReady is set when the server listens on the port
+	StateReady
+	// StateDegraded is set when the control connection is lost or relaying a connection failed
+	StateDegraded
+	// StateHidden is set when the port was hidden or the client unpaired
+	StateHidden
+	// StateError is set when the server rejected the port, Exposure.Reason holds why
+	StateError
+)
+
+func (s ExposureState) String() string {
+	switch s {
+	case StateRequested:
+		return "REQUESTED"
+	case StateReady:
+		return "READY"
+	case StateDegraded:
+		return "DEGRADED"
+	case StateHidden:
+		return "HIDDEN"
+	case StateError:
+		return "ERROR"
+	}
+	return "UNKNOWN"
+}
+
+// Exposure is a snapshot of the state of an exposed port.
+type Exposure struct {
+	Network string
+	Port    int
+	State   ExposureState
+	// Reason describes why the port is degraded or failed, it is empty otherwise
+	Reason string
+	// PublicPort is the port the server listens on for the port, 0 until the server exposed it. URL is the one the
+	// server serves the port on instead, if it was exposed under a host.
+	PublicPort int
+	URL        string
+	// Families are the address families the server listens on for the public port, comma-separated, e.g. ipv4,ipv6
+	Families string
+	Since    time.Time
+}
+
+func (e Exposure) String() string {
+	s := e.Network + "/" + strconv.Itoa(e.Port) + " " + e.State.String()
+	if e.PublicPort != 0 && e.PublicPort != e.Port {
+		s += " on public port " + strconv.Itoa(e.PublicPort)
+	}
+	if e.Families != "" {
+		s += " over " + e.Families
+	}
+	if e.URL != "" {
+		s += " on " + e.URL
+	}
+	if e.Reason != "" {
+		s += " (" + e.Reason + ")"
+	}
+	return s
+}
+
+// Exposures tracks the states of all ports a client exposed, so applications embedding the client can render
+// them without parsing logs. The client sets the states, changes are published to subscribers and Snapshot returns
+// the current states.
+type Exposures struct {
+	mu          sync.Mutex
+	exposures   map[string]Exposure
+	subscribers map[chan Exposure]struct{}
+}
+
+func NewExposures() *Exposures {
+	return &Exposures{
+		exposures:   make(map[string]Exposure),
+		subscribers: make(map[chan Exposure]struct{}),
+	}
+}
+
+// Snapshot returns the states of all ports exposed since the client started, hidden ones included.
+func (e *Exposures) Snapshot() []Exposure {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	snapshot := make([]Exposure, 0, len(e.exposures))
+	for _, exp := range e.exposures {
+		snapshot = append(snapshot, exp)
+	}
+	return snapshot
+}
+
+// Subscribe returns a channel receiving every state change, and a function to cancel the subscription.
+// Changes are dropped for subscribers not keeping up, Snapshot can be used to catch up.
+func (e *Exposures) Subscribe() (<-chan Exposure, func()) {
+	ch := make(chan Exposure, 16)
+	e.mu.Lock()
+	e.subscribers[ch] = struct{}{}
+	e.mu.Unlock()
+	return ch, func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		if _, ok := e.subscribers[ch]; ok {
+			delete(e.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// State returns the current state of the port, StateHidden if it is unknown.
+func (e *Exposures) State(network string, port int) ExposureState {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if cur, ok := e.exposures[exposureKey(network, port)]; ok {
+		return cur.State
+	}
+	return StateHidden
+}
+
+// Set changes the state of the port and notifies the subscribers. Setting the current state again is a no-op.
+func (e *Exposures) Set(network string, port int, state ExposureState, reason string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.update(network, port, state, reason)
+}
+
+// SetPublic records the public port the server listens on for the port and its address families, or the URL it
+// serves the port on, and notifies the subscribers.
+func (e *Exposures) SetPublic(network string, port int, publicPort int, url string, families string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	key := exposureKey(network, port)
+	exp, ok := e.exposures[key]
+	if !ok || (exp.PublicPort == publicPort && exp.URL == url && exp.Families == families) {
+		return
+	}
+	exp.PublicPort = publicPort
+	exp.URL = url
+	exp.Families = families
+	e.exposures[key] = exp
+	e.notify(exp)
+}
+
+// SetIf changes the state of the port only if it currently is in state from.
+func (e *Exposures) SetIf(network string, port int, from ExposureState, state ExposureState, reason string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if cur, ok := e.exposures[exposureKey(network, port)]; ok && cur.State == from {
+		e.update(network, port, state, reason)
+	}
+}
+
+// update sets the state and notifies the subscribers, e.mu must be held.
+func (e *Exposures) update(network string, port int, state ExposureState, reason string) {
+	key := exposureKey(network, port)
+	if cur, ok := e.exposures[key]; ok && cur.State == state && cur.Reason == reason {
+		return
+	}
+	exp := Exposure{Network: network, Port: port, State: state, Reason: reason, Since: time.Now()}
+	// where the server exposes the port is kept while the port is reconnected or reconfigured
+	if state != StateHidden && state != StateError {
+		cur := e.exposures[key]
+		exp.PublicPort, exp.URL, exp.Families = cur.PublicPort, cur.URL, cur.Families
+	}
+	e.exposures[key] = exp
+	e.notify(exp)
+}
+
+// notify publishes a change to the subscribers, e.mu must be held.
+func (e *Exposures) notify(exp Exposure) {
+	for ch := range e.subscribers {
+		select {
+		case ch <- exp:
+		default:
+		}
+	}
+}
+
+func exposureKey(network string, port int) string {
+	return network + "/" + strconv.Itoa(port)
+}
@@ -0,0 +1,25 @@
+package Utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Fingerprint returns the SHA-256 fingerprint of a DER encoded certificate in lower case hex, as printed by
+// "openssl x509 -noout -fingerprint -sha256" without the colons.
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseFingerprint normalizes a SHA-256 fingerprint in hex, with or without colons, to the form of Fingerprint.
+func ParseFingerprint(s string) (string, error) {
+	fp := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(s), ":", ""))
+	b, err := hex.DecodeString(fp)
+	if err != nil || len(b) != sha256.Size {
+		return "", errors.New("invalid SHA-256 fingerprint " + s)
+	}
+	return fp, nil
+}
@@ -3,6 +3,8 @@ package Utils
 import (
 	"encoding/json"
 	"net"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -12,16 +14,168 @@ const (
 	CTRLEXPOSEUDP = uint8(203)
 	CTRLHIDEUDP   = uint8(204)
 	CTRLCONNECT   = uint8(205)
+	CTRLSTATS     = uint8(206)
+	CTRLSTATSSUB  = uint8(207)
+	CTRLEXPOSED   = uint8(208)
+	CTRLERROR     = uint8(209)
+	CTRLMUX       = uint8(210)
+	CTRLDATA      = uint8(211)
+	CTRLRENEW     = uint8(212)
+	CTRLRESUME    = uint8(213)
+	CTRLADOPT     = uint8(214)
+	CTRLAUTH      = uint8(215)
+	CTRLCERT      = uint8(216)
+	CTRLHISTORY   = uint8(217)
+	CTRLINSPECT   = uint8(218)
+	CTRLEGRESS    = uint8(219)
 	STOP          = uint8(0)
 )
 
+// CTRLEXPOSED and CTRLERROR answer an EXPOSE frame. Both carry the network and the port of the request,
+// CTRLEXPOSED carries the public port the server listens on as third field, CTRLERROR the reason of the failure.
+// CTRLERROR carries one of the ERR codes as fourth field, so the client can react to the failure without parsing the reason.
+// CTRLEXPOSED carries the lease time in seconds as fourth field, 0 if the server doesn't lease exposed ports, the
+// client has to renew a lease with a CTRLRENEW frame carrying the network and the port before it expires.
+// A port exposed under a host has no public port, its CTRLEXPOSED carries 0 as public port and the URL the HTTP front
+// serves the host on as fifth field, other ports an empty one. The sixth field holds the address families the public
+// port is reachable over, comma-separated, e.g. ipv4,ipv6, empty for ports exposed under a host.
+
+// Error codes of CTRLERROR frames.
+const (
+	// ERRINVALID is sent for malformed ports and options
+	ERRINVALID = "invalid"
+	// ERRRANGE is sent for ports outside the range the server exposes, and hosts outside its domains
+	ERRRANGE = "range"
+	// ERRRESERVED is sent for ports the server uses itself, denied ports and ports reserved for another client
+	ERRRESERVED = "reserved"
+	// ERRUNAVAILABLE is sent if the port is in use or the server has no proxy port left
+	ERRUNAVAILABLE = "unavailable"
+	// ERRIMMUTABLE is sent for options that can't be changed on an exposed port
+	ERRIMMUTABLE = "immutable"
+	// ERRLEASE is sent when the lease of an exposed port expired and the port was hidden
+	ERRLEASE = "lease"
+	// ERRQUOTA is sent if the client already exposes as many ports as its quota allows
+	ERRQUOTA = "quota"
+	// ERRPRIVILEGED is sent for privileged ports if the client may not expose them or the server can't bind them
+	ERRPRIVILEGED = "privileged"
+	// ERRDUPLICATE is sent before the server closes a connection of a client that is connected already. The network
+	// and the port of the frame are empty.
+	ERRDUPLICATE = "duplicate"
+	// ERRNAME is sent if the client named another exposed port the same already
+	ERRNAME = "name"
+	// ERRAUTH is sent before the server closes a connection whose client failed to authenticate with a token. The
+	// network and the port of the frame are empty.
+	ERRAUTH = "auth"
+	// ERRFORBIDDEN is sent if an authorization rule of the server denies the client the port of the network, the
+	// reason names the rule
+	ERRFORBIDDEN = "forbidden"
+	// ERRADMIN is sent when an admin of the server hid the port
+	ERRADMIN = "admin"
+)
+
+// An EXPOSE frame can name the port with the name=<name> option, names are unique among the ports of a client.
+// A TCP port can be exposed under a hostname with the host=<hostname> option instead of on a public port, the HTTP
+// front of the server then passes the HTTP requests of the host on to it. With path=<prefix> only the requests below
+// the path prefix are passed on, the longest prefix of a request wins, strip=on removes the prefix from them. Each
+// prefix of a host is exposed by one client at a time.
+// Such a port can change the headers the front passes on with up to 8 options header=<name>:<value> and
+// header=-<name> for requests, respheader=<name>:<value> and respheader=-<name> for responses, applied in order.
+// forwarded=off leaves out the X-Forwarded headers of the requests. Visitors have to authenticate if the port is
+// exposed with up to 8 options basicauth=<user>:<password>, or with up to 8 options oidc=<email>|@<domain>|* naming
+// who may visit it after logging in with the OpenID Connect provider of the server.
+// The front answers requests it can't pass on with an error page, 503 while the client is offline and 502 while its
+// service doesn't answer. errors=json answers with JSON instead, errors=html always with HTML, errors=auto with JSON
+// for requests accepting JSON but no HTML. inspect=on records the recent requests of the port, see CTRLINSPECT.
+// cache=on lets the front answer GET requests from its cache while the responses are fresh by their Cache-Control or
+// Expires headers, if the server has a cache.
+// A TCP port with a public port can be exposed with proxyprotocol=v1|v2, the server then sends a PROXY header of the
+// version announcing the external peer on each proxy connection, ahead of its data.
+// Up to 32 options allow=<ip|cidr> and deny=<ip|cidr> each limit the external peers of a port: peers in a deny rule
+// are refused, and with allow rules only peers in one of them are let in. The server closes their connections, drops
+// the datagrams of their UDP sessions and answers their requests to the HTTP front with 403, counting them in CTRLSTATS.
+// Up to 32 options allowcountry=<code> and denycountry=<code> each limit them by the ISO 3166 code of their country
+// alike, if the server has a GeoIP database. Peers of unknown country only pass ports without allowcountry.
+// peerconns=<n> caps the connections and UDP sessions a single external IP holds on the port at a time.
+// A TCP port can be exposed with compress=<preset>, the relayed data is then compressed on its proxy connections with
+// the preset, see CompressedConn. CTRLSTATS counts the compressed bytes alongside. It can't be changed later on.
+// HIDE frames carry either a port, a range of ports or the name of a port.
+
+// CTRLAUTH authenticates a client without certificate, if the server accepts tokens. It is the first frame of the
+// client, carrying a pre-shared token or a signed JWT of at most MAXAUTHTOKEN bytes as its only field. The server
+// answers with the name the client is known by, which takes the place of the certificate CN, or with a CTRLERROR
+// of ERRAUTH.
+const MAXAUTHTOKEN = 900
+
+// CTRLCERT renews the certificate of a client before it expires. The client sends a certificate signing request for
+// a new key, base64 encoded DER of at most MAXCSR bytes, as its only field. The server answers with CTRLCERT frames,
+// each carrying a chunk of the base64 encoded DER certificate of at most CERTCHUNK bytes and the number of frames
+// still to come, or with a single frame carrying an empty chunk, "0" and the reason it refused.
+const (
+	MAXCSR    = 900
+	CERTCHUNK = 800
+)
+
+// CTRLHISTORY asks for the traffic history of an exposed port, carrying the network, the port and HISTORYMINUTES or
+// HISTORYHOURS. The server answers with CTRLHISTORY frames carrying the network, the port, the resolution, the number
+// of frames still to come and up to HISTORYCHUNK buckets, oldest first. A bucket is start:bytesin:bytesout:conns,
+// the start in unix seconds. The history covers the last hour by minute or the last day by hour, a single frame
+// without buckets answers for a port that is not exposed.
+const (
+	HISTORYMINUTES = "minutes"
+	HISTORYHOURS   = "hours"
+	HISTORYCHUNK   = 12
+)
+
+// CTRLINSPECT asks for the recent requests the HTTP front passed on to a port exposed with inspect=on, carrying the
+// network and the port. The server answers with CTRLINSPECT frames carrying the network, the port, the number of
+// frames still to come and up to INSPECTCHUNK requests, oldest first. A request is
+// time:method:status:latency:bytesin:bytesout:path, the time in unix milliseconds, the latency in milliseconds until
+// the response was complete and the path escaped and cut to MAXINSPECTPATH bytes. A single frame without requests
+// answers for a port that is not exposed or not inspected.
+const (
+	INSPECTCHUNK   = 2
+	MAXINSPECTPATH = 64
+)
+
+// CTRLEGRESS asks the server to accept egress streams of the client, which reach the network of the server the other
+// way round, see WriteEgressHeader. The server starts the inline session of the client if there is none and answers
+// with a CTRLEGRESS frame without data, or with a CTRLERROR frame with ERRFORBIDDEN and empty network and port if the
+// client may not open egress streams.
+
+// CTRLMUX asks the server to multiplex the relayed connections of the client over a single data connection.
+// The server answers with the data port, the token to present on the data connection and "tls" or "plain",
+// or without data if it refuses.
+
+// CTRLRESUME is sent by the server at the start of a resumable session, carrying the resume token and the grace
+// window in seconds. After reconnecting, the client sends it with the token as only field before anything else.
+// The server answers with the token and the grace window of the session it continues, and "resumed" or "expired"
+// as third field. A resumed session kept its exposed ports, the client exposes them again either way.
+const (
+	RESUMED = "resumed"
+	EXPIRED = "expired"
+)
+
+// CTRLADOPT asks the server to take over the exposed ports of the client with the certificate CN of its only field,
+// if the client may adopt them. The server answers with the CN, the reason if it refused or an empty string, and the
+// adopted ports as network/port. The public ports of the adopted ports are held until the client exposes the same
+// ports again, the other client is unpaired.
+
+// CTRLUNPAIR sent by the server ends the session, the client stops instead of reconnecting. If an admin of the server
+// disconnected the client, it carries the reason as only field.
+
+// CTRLDATA carries a chunk of the inline data connection of a client, base64 encoded as its only field, see FrameConn.
+
+// DATASTART is written by the server on a proxy connection once an external connection is assigned to it.
+// The client keeps proxy connections idle and waits for it before connecting to the local service.
+const DATASTART = uint8(1)
+
 type CTRLFrame struct {
 	Typ  byte
 	Data []string
 }
 
 func (fr *CTRLFrame) String() string {
-	return "Type: " + string(fr.Typ) + " Data: " + fr.Data[0]
+	return "Type: " + strconv.Itoa(int(fr.Typ)) + " Data: " + strings.Join(fr.Data, " ")
 }
 
 func NewCTRLFrame(typ byte, data []string) *CTRLFrame {
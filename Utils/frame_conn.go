@@ -0,0 +1,118 @@
+package Utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// INLINECHUNK is the largest payload of a CTRLDATA frame. Encoded, the frame stays well below the 1024 bytes
+// ReadFrame reads at once.
+const INLINECHUNK = 512
+
+// FrameConn is a connection carried in CTRLDATA frames on the control connection, for clients that can't or don't
+// want to open data connections. It is meant for low-traffic tunnels, every chunk costs a control frame.
+//
+// Written data is split into frames and passed to send, received frames are passed to Deliver by the reader of the
+// control connection. Deliver never blocks, received data is buffered until it is read. Deadlines are not supported,
+// the MuxSession running on top of it has deadlines per stream.
+type FrameConn struct {
+	send          func(*CTRLFrame) error
+	local, remote net.Addr
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+// NewFrameConn creates a FrameConn writing its frames with send. local and remote are the addresses of the control connection.
+func NewFrameConn(send func(*CTRLFrame) error, local net.Addr, remote net.Addr) *FrameConn {
+	c := &FrameConn{send: send, local: local, remote: remote}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Deliver buffers the payload of a CTRLDATA frame received on the control connection.
+func (c *FrameConn) Deliver(fr *CTRLFrame) error {
+	if fr.Typ != CTRLDATA || len(fr.Data) != 1 {
+		return errors.New("malformed data frame")
+	}
+	payload, err := base64.StdEncoding.DecodeString(fr.Data[0])
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.buf.Write(payload)
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *FrameConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.buf.Len() == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		c.cond.Wait()
+	}
+	return c.buf.Read(b)
+}
+
+func (c *FrameConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		c.mu.Lock()
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return written, net.ErrClosed
+		}
+		chunk := b[written:min(written+INLINECHUNK, len(b))]
+		err := c.send(NewCTRLFrame(CTRLDATA, []string{base64.StdEncoding.EncodeToString(chunk)}))
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// Close discards the buffered data and wakes up a pending Read. The control connection stays open.
+func (c *FrameConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.buf.Reset()
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *FrameConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *FrameConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *FrameConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *FrameConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *FrameConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
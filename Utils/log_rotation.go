@@ -0,0 +1,203 @@
+package Utils
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LOGBACKUPTIME is the layout of the time of rotation in the names of rotated log files, which are named after the log
+// file with the time appended, and .gz if compressed.
+const LOGBACKUPTIME = "20060102T150405.000"
+
+// LogRotation limits the disk space taken by a log file. 0 disables a limit.
+type LogRotation struct {
+	// MaxSize is the size in bytes at which the log file is rotated
+	MaxSize int64
+	// MaxAge is how long rotated files are kept, MaxBackups how many of them
+	MaxAge     time.Duration
+	MaxBackups int
+	// Compress gzips rotated files
+	Compress bool
+}
+
+// RotatingFile is an io.Writer appending to a log file, which is renamed and replaced by an empty one once it would
+// grow beyond the MaxSize of its LogRotation. Rotated files are compressed and pruned in the background. It is safe
+// for concurrent use.
+type RotatingFile struct {
+	path     string
+	rotation LogRotation
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+	// cleanupMu serializes the cleanups, cleanups tracks them for Close
+	cleanupMu sync.Mutex
+	cleanups  sync.WaitGroup
+}
+
+// OpenRotatingFile opens the log file at path for appending, creating it if needed, and cleans up the files rotated
+// earlier according to rotation.
+func OpenRotatingFile(path string, rotation LogRotation) (*RotatingFile, error) {
+	if rotation.MaxSize < 0 || rotation.MaxAge < 0 || rotation.MaxBackups < 0 {
+		return nil, errors.New("negative log rotation limit")
+	}
+	r := &RotatingFile{path: path, rotation: rotation}
+	err := r.open()
+	if err != nil {
+		return nil, err
+	}
+	r.cleanup()
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	r.file = file
+	r.size = stat.Size()
+	return nil
+}
+
+// Write appends p to the log file, rotating it first if p would make it exceed MaxSize. A record larger than MaxSize
+// is written to an empty file on its own.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if r.rotation.MaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.rotation.MaxSize {
+		err := r.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the log file after the current time and opens a new one. If the file can't be renamed, it is
+// appended to further. The caller must hold mu.
+func (r *RotatingFile) rotate() error {
+	_ = r.file.Close()
+	r.file = nil
+	renameErr := os.Rename(r.path, r.path+"."+time.Now().UTC().Format(LOGBACKUPTIME))
+	err := r.open()
+	if err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	r.cleanup()
+	return nil
+}
+
+// cleanup compresses and prunes the rotated files in the background.
+func (r *RotatingFile) cleanup() {
+	if r.rotation.MaxAge == 0 && r.rotation.MaxBackups == 0 && !r.rotation.Compress {
+		return
+	}
+	r.cleanups.Add(1)
+	go func() {
+		defer r.cleanups.Done()
+		r.cleanupMu.Lock()
+		defer r.cleanupMu.Unlock()
+		now := time.Now()
+		for i, b := range r.backups() {
+			if (r.rotation.MaxBackups > 0 && i >= r.rotation.MaxBackups) || (r.rotation.MaxAge > 0 && now.Sub(b.rotated) > r.rotation.MaxAge) {
+				_ = os.Remove(b.path)
+			} else if r.rotation.Compress && !strings.HasSuffix(b.path, ".gz") {
+				_ = compressFile(b.path)
+			}
+		}
+	}()
+}
+
+type logBackup struct {
+	path    string
+	rotated time.Time
+}
+
+// backups returns the rotated files of the log file, the most recent first.
+func (r *RotatingFile) backups() []logBackup {
+	dir, name := filepath.Split(r.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var backups []logBackup
+	for _, entry := range entries {
+		suffix, ok := strings.CutPrefix(entry.Name(), name+".")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		rotated, err := time.Parse(LOGBACKUPTIME, strings.TrimSuffix(suffix, ".gz"))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, logBackup{path: filepath.Join(dir, entry.Name()), rotated: rotated})
+	}
+	slices.SortFunc(backups, func(a, b logBackup) int {
+		return b.rotated.Compare(a.rotated)
+	})
+	return backups
+}
+
+// compressFile replaces the file with a gzipped copy named like it with .gz appended.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	if err != nil {
+		_ = in.Close()
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	_ = in.Close()
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close closes the log file and waits for the running cleanups.
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	var err error
+	if r.file != nil {
+		err = r.file.Close()
+		r.file = nil
+	}
+	r.mu.Unlock()
+	r.cleanups.Wait()
+	return err
+}
@@ -1,8 +1,16 @@
 package Utils
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io"
+	"log/slog"
+	"net"
 	"os"
+	"slices"
 	"time"
 )
 
@@ -38,3 +46,130 @@ func SetupLoggerWriter(path string, name string, console bool) io.Writer {
 
 	return io.MultiWriter(writers...)
 }
+
+// Modes of the RedactingHandler.
+const (
+	REDACTOFF      = "off"
+	REDACTTRUNCATE = "truncate"
+	REDACTHASH     = "hash"
+)
+
+// PEERKEY is the attribute key used for addresses of external peers in log records. These are redacted by the RedactingHandler.
+const PEERKEY = "Peer"
+
+// SECRETKEYS are the attribute keys of tokens and credentials, the RedactingHandler replaces their values with
+// REDACTEDSECRET in every mode.
+var SECRETKEYS = []string{"Token", "Password", "Secret", "Authorization", "Cookie"}
+
+const REDACTEDSECRET = "[redacted]"
+
+// RedactingHandler is a slog.Handler that redacts the IP addresses in attributes with one of its keys before passing
+// the record on. In truncate mode, the host part of the IP is cut off (/24 for IPv4, /48 for IPv6), in hash mode the IP
+// is replaced by a salted HMAC, which keeps the addresses of one peer correlatable without revealing them.
+// The values of SECRETKEYS are left out in off mode as well.
+type RedactingHandler struct {
+	next slog.Handler
+	mode string
+	salt []byte
+	keys map[string]bool
+}
+
+// NewRedactingHandler wraps next in a RedactingHandler. If no keys are given, PEERKEY is redacted.
+// The salt is only used in hash mode, where it must not be empty.
+func NewRedactingHandler(next slog.Handler, mode string, salt []byte, keys ...string) (*RedactingHandler, error) {
+	switch mode {
+	case REDACTOFF, REDACTTRUNCATE:
+	case REDACTHASH:
+		if len(salt) == 0 {
+			return nil, errors.New("hash mode requires a salt")
+		}
+	default:
+		return nil, errors.New("unknown redaction mode " + mode)
+	}
+	if len(keys) == 0 {
+		keys = []string{PEERKEY}
+	}
+	h := &RedactingHandler{
+		next: next,
+		mode: mode,
+		salt: salt,
+		keys: make(map[string]bool, len(keys)),
+	}
+	for _, key := range keys {
+		h.keys[key] = true
+	}
+	return h, nil
+}
+
+func (h *RedactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *RedactingHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *RedactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		redacted = append(redacted, h.redactAttr(a))
+	}
+	return &RedactingHandler{next: h.next.WithAttrs(redacted), mode: h.mode, salt: h.salt, keys: h.keys}
+}
+
+func (h *RedactingHandler) WithGroup(name string) slog.Handler {
+	return &RedactingHandler{next: h.next.WithGroup(name), mode: h.mode, salt: h.salt, keys: h.keys}
+}
+
+func (h *RedactingHandler) redactAttr(a slog.Attr) slog.Attr {
+	if a.Value.Kind() == slog.KindGroup {
+		group := a.Value.Group()
+		redacted := make([]any, 0, len(group))
+		for _, ga := range group {
+			redacted = append(redacted, h.redactAttr(ga))
+		}
+		return slog.Group(a.Key, redacted...)
+	}
+	if slices.Contains(SECRETKEYS, a.Key) {
+		return slog.String(a.Key, REDACTEDSECRET)
+	}
+	if h.mode == REDACTOFF || !h.keys[a.Key] {
+		return a
+	}
+	return slog.String(a.Key, h.RedactAddr(a.Value.Resolve().String()))
+}
+
+// RedactAddr redacts the IP of an address in the form ip, ip:port or [ip]:port. The port is kept.
+// Values that don't contain an IP are returned unchanged.
+func (h *RedactingHandler) RedactAddr(addr string) string {
+	if h.mode == REDACTOFF {
+		return addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return addr
+	}
+	var redacted string
+	if h.mode == REDACTHASH {
+		mac := hmac.New(sha256.New, h.salt)
+		mac.Write(ip)
+		redacted = "ip-" + hex.EncodeToString(mac.Sum(nil))[:16]
+	} else if ip4 := ip.To4(); ip4 != nil {
+		redacted = ip4.Mask(net.CIDRMask(24, 32)).String()
+	} else {
+		redacted = ip.Mask(net.CIDRMask(48, 128)).String()
+	}
+	if port == "" {
+		return redacted
+	}
+	return net.JoinHostPort(redacted, port)
+}
@@ -0,0 +1,573 @@
+package Utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MUXWINDOW is the amount of unread data a stream buffers. A sender has to wait for a window update of the receiver
+// once it sent this much, so a slow stream doesn't block the others sharing the connection.
+const MUXWINDOW = 256 * 1024
+
+// MUXMAXFRAME is the largest payload of a single data frame.
+const MUXMAXFRAME = 16 * 1024
+
+// MUXBACKLOG is the amount of streams opened by the peer that can wait to be accepted.
+const MUXBACKLOG = 64
+
+// Frame types of the mux protocol. Every frame starts with a header of the stream ID (4 bytes), the type (1 byte) and
+// a length (4 bytes). The length is the payload size of data frames, the window increment of window frames,
+// and 0 otherwise.
+const (
+	muxSyn uint8 = iota
+	muxData
+	muxWindow
+	muxFin
+	muxRst
+)
+
+const muxHeaderLen = 9
+
+// ErrMuxClosed is returned by streams of a closed MuxSession.
+var ErrMuxClosed = errors.New("mux session closed")
+
+// ErrStreamReset is returned if the peer reset the stream.
+var ErrStreamReset = errors.New("mux stream reset")
+
+// MuxSession multiplexes streams over a single connection, so a client needs one data connection for all relayed
+// connections. Both sides can open streams, the client uses odd stream IDs and the server even ones.
+type MuxSession struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*MuxStream
+	nextID  uint32
+
+	accept    chan *MuxStream
+	done      chan struct{}
+	closeOnce sync.Once
+	// err is the reason the session was closed, it is set before done is closed
+	err error
+}
+
+// NewMuxSession starts a mux session on conn. client selects the side of the session, one side must be the client.
+func NewMuxSession(conn net.Conn, client bool) *MuxSession {
+	s := &MuxSession{
+		conn:    conn,
+		streams: make(map[uint32]*MuxStream),
+		nextID:  2,
+		accept:  make(chan *MuxStream, MUXBACKLOG),
+		done:    make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	go s.recvLoop()
+	return s
+}
+
+// Open opens a new stream to the peer.
+func (s *MuxSession) Open() (*MuxStream, error) {
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID += 2
+	st := newMuxStream(s, id)
+	s.streams[id] = st
+	s.mu.Unlock()
+	err := s.writeFrame(id, muxSyn, 0, nil)
+	if err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the next stream opened by the peer.
+func (s *MuxSession) Accept() (*MuxStream, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// Close closes the session, its connection and all of its streams.
+func (s *MuxSession) Close() error {
+	s.closeWithErr(ErrMuxClosed)
+	return nil
+}
+
+// Done returns a channel that is closed when the session is closed, Err returns the reason afterwards.
+func (s *MuxSession) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *MuxSession) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+func (s *MuxSession) closeWithErr(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		_ = s.conn.Close()
+	})
+}
+
+// writeFrame writes a single frame. Frames of all streams are serialized here.
+func (s *MuxSession) writeFrame(id uint32, typ uint8, length uint32, payload []byte) error {
+	header := make([]byte, muxHeaderLen)
+	binary.BigEndian.PutUint32(header[0:4], id)
+	header[4] = typ
+	binary.BigEndian.PutUint32(header[5:9], length)
+	bufs := net.Buffers{header, payload}
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	select {
+	case <-s.done:
+		return s.err
+	default:
+	}
+	_, err := bufs.WriteTo(s.conn)
+	if err != nil {
+		s.closeWithErr(err)
+	}
+	return err
+}
+
+func (s *MuxSession) stream(id uint32) *MuxStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *MuxSession) remove(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// recvLoop reads frames and dispatches them to their streams until the connection fails. It never writes to the
+// connection itself, a peer blocked on writing could otherwise never be read from again.
+func (s *MuxSession) recvLoop() {
+	reader := bufio.NewReaderSize(s.conn, 2*MUXMAXFRAME)
+	header := make([]byte, muxHeaderLen)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err != nil {
+			s.closeWithErr(err)
+			return
+		}
+		id := binary.BigEndian.Uint32(header[0:4])
+		typ := header[4]
+		length := binary.BigEndian.Uint32(header[5:9])
+
+		switch typ {
+		case muxSyn:
+			st := newMuxStream(s, id)
+			s.mu.Lock()
+			_, exists := s.streams[id]
+			if !exists {
+				s.streams[id] = st
+			}
+			s.mu.Unlock()
+			if exists {
+				s.closeWithErr(errors.New("mux stream opened twice"))
+				return
+			}
+			select {
+			case s.accept <- st:
+			default:
+				// the backlog is full, refuse the stream
+				s.remove(id)
+				go func() {
+					_ = s.writeFrame(id, muxRst, 0, nil)
+				}()
+			}
+		case muxData:
+			if length > MUXMAXFRAME {
+				s.closeWithErr(errors.New("mux frame too large"))
+				return
+			}
+			st := s.stream(id)
+			if st == nil {
+				// data of a stream that was reset in the meantime
+				_, err = reader.Discard(int(length))
+				if err != nil {
+					s.closeWithErr(err)
+					return
+				}
+				continue
+			}
+			payload := make([]byte, length)
+			_, err = io.ReadFull(reader, payload)
+			if err != nil {
+				s.closeWithErr(err)
+				return
+			}
+			err = st.receive(payload)
+			if err != nil {
+				s.closeWithErr(err)
+				return
+			}
+		case muxWindow:
+			if st := s.stream(id); st != nil {
+				st.grant(length)
+			}
+		case muxFin:
+			if st := s.stream(id); st != nil {
+				st.remoteClose()
+			}
+		case muxRst:
+			if st := s.stream(id); st != nil {
+				st.resetByPeer()
+			}
+		default:
+			s.closeWithErr(errors.New("unknown mux frame type"))
+			return
+		}
+	}
+}
+
+// MuxStream is a stream of a MuxSession. It implements net.Conn, CloseWrite half-closes the stream.
+type MuxStream struct {
+	id      uint32
+	session *MuxSession
+
+	mu sync.Mutex
+	// buf holds received data not read yet, unacked counts the bytes read since the last window update
+	buf        []byte
+	unacked    uint32
+	sendWindow uint32
+	// finSent is set when this side is done writing, remoteFin when the peer is, closed when this side closed the stream
+	finSent   bool
+	remoteFin bool
+	closed    bool
+	reset     bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// readNotify and writeNotify wake up a blocked Read or Write to check the state of the stream again
+	readNotify  chan struct{}
+	writeNotify chan struct{}
+}
+
+func newMuxStream(s *MuxSession, id uint32) *MuxStream {
+	return &MuxStream{
+		id:          id,
+		session:     s,
+		sendWindow:  MUXWINDOW,
+		readNotify:  make(chan struct{}, 1),
+		writeNotify: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ch is notified, the deadline passes or the session is closed.
+func (st *MuxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-st.session.done:
+		return st.session.err
+	}
+}
+
+// receive buffers a data frame of the peer. Data for a stream closed by this side is discarded, but its window is
+// still granted, so the peer doesn't block until it learns about the close.
+func (st *MuxStream) receive(payload []byte) error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		go func() {
+			_ = st.session.writeFrame(st.id, muxWindow, uint32(len(payload)), nil)
+		}()
+		return nil
+	}
+	if len(st.buf)+len(payload) > MUXWINDOW {
+		st.mu.Unlock()
+		return errors.New("mux window exceeded")
+	}
+	st.buf = append(st.buf, payload...)
+	st.mu.Unlock()
+	notify(st.readNotify)
+	return nil
+}
+
+func (st *MuxStream) grant(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += n
+	st.mu.Unlock()
+	notify(st.writeNotify)
+}
+
+func (st *MuxStream) remoteClose() {
+	st.mu.Lock()
+	st.remoteFin = true
+	st.mu.Unlock()
+	notify(st.readNotify)
+	st.removeIfDone()
+}
+
+func (st *MuxStream) resetByPeer() {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+	notify(st.readNotify)
+	notify(st.writeNotify)
+	st.session.remove(st.id)
+}
+
+// removeIfDone removes the stream from its session once both sides are done writing.
+func (st *MuxStream) removeIfDone() {
+	st.mu.Lock()
+	done := st.finSent && st.remoteFin
+	st.mu.Unlock()
+	if done {
+		st.session.remove(st.id)
+	}
+}
+
+// Read reads data of the stream. Buffered data is returned even after the peer reset the stream.
+func (st *MuxStream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if len(st.buf) > 0 {
+			n := copy(b, st.buf)
+			st.buf = st.buf[n:]
+			if len(st.buf) == 0 {
+				st.buf = nil
+			}
+			st.unacked += uint32(n)
+			var grant uint32
+			if st.unacked >= MUXWINDOW/2 {
+				grant, st.unacked = st.unacked, 0
+			}
+			st.mu.Unlock()
+			if grant > 0 {
+				_ = st.session.writeFrame(st.id, muxWindow, grant, nil)
+			}
+			return n, nil
+		}
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		case st.reset:
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		case st.remoteFin:
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		err := st.wait(st.readNotify, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write writes data to the stream, blocking while the window of the peer is exhausted.
+func (st *MuxStream) Write(b []byte) (int, error) {
+	total := 0
+	for len(b) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.closed || st.finSent:
+			st.mu.Unlock()
+			return total, net.ErrClosed
+		case st.reset:
+			st.mu.Unlock()
+			return total, ErrStreamReset
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			err := st.wait(st.writeNotify, deadline)
+			if err != nil {
+				return total, err
+			}
+			continue
+		}
+		n := min(len(b), int(st.sendWindow), MUXMAXFRAME)
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+		err := st.session.writeFrame(st.id, muxData, uint32(n), b[:n])
+		if err != nil {
+			return total, err
+		}
+		total += n
+		b = b[n:]
+	}
+	return total, nil
+}
+
+// CloseWrite signals the peer that this side is done writing, the peer reads io.EOF after the remaining data.
+func (st *MuxStream) CloseWrite() error {
+	st.mu.Lock()
+	if st.finSent || st.closed || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.mu.Unlock()
+	err := st.session.writeFrame(st.id, muxFin, 0, nil)
+	st.removeIfDone()
+	return err
+}
+
+// Close closes the stream. Unread data is discarded, the peer reads io.EOF once it read the data sent before.
+func (st *MuxStream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	sendFin := !st.finSent && !st.reset
+	st.finSent = true
+	// the discarded data is granted back, the peer may still be writing
+	grant := st.unacked + uint32(len(st.buf))
+	st.buf = nil
+	st.unacked = 0
+	st.mu.Unlock()
+	notify(st.readNotify)
+	notify(st.writeNotify)
+
+	var err error
+	if sendFin {
+		err = st.session.writeFrame(st.id, muxFin, 0, nil)
+	}
+	if grant > 0 {
+		_ = st.session.writeFrame(st.id, muxWindow, grant, nil)
+	}
+	st.removeIfDone()
+	return err
+}
+
+func (st *MuxStream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+func (st *MuxStream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+func (st *MuxStream) SetDeadline(t time.Time) error {
+	_ = st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+func (st *MuxStream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readNotify)
+	return nil
+}
+
+func (st *MuxStream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeNotify)
+	return nil
+}
+
+// WriteStreamHeader writes the header the server sends first on every stream it opens: the network of the
+// relayed connection, 0 for TCP and 1 for UDP, and the exposed port it belongs to.
+func WriteStreamHeader(w io.Writer, network string, port int) error {
+	header := make([]byte, 3)
+	if network == "udp" {
+		header[0] = 1
+	}
+	binary.BigEndian.PutUint16(header[1:], uint16(port))
+	_, err := w.Write(header)
+	return err
+}
+
+// ReadStreamHeader reads the header written by WriteStreamHeader.
+func ReadStreamHeader(r io.Reader) (string, int, error) {
+	header := make([]byte, 3)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return "", 0, err
+	}
+	network := "tcp"
+	if header[0] == 1 {
+		network = "udp"
+	}
+	return network, int(binary.BigEndian.Uint16(header[1:])), nil
+}
+
+// Answers of the server to the header of an egress stream, see WriteEgressHeader.
+const (
+	EGRESSOK = uint8(iota)
+	// EGRESSDENIED is sent for destinations outside the networks the server lets clients reach
+	EGRESSDENIED
+	// EGRESSFAILED is sent if the server could not connect to the destination
+	EGRESSFAILED
+)
+
+// MAXEGRESSADDR is the longest destination of an egress stream.
+const MAXEGRESSADDR = 255
+
+// WriteEgressHeader writes the header the client sends first on every egress stream it opens on the inline session,
+// the destination the server connects the stream to, host:port, prefixed by its length. The server answers with a
+// single byte, EGRESSOK or the reason it closes the stream.
+func WriteEgressHeader(w io.Writer, address string) error {
+	if len(address) > MAXEGRESSADDR {
+		return errors.New("egress destination too long")
+	}
+	_, err := w.Write(append([]byte{byte(len(address))}, address...))
+	return err
+}
+
+// ReadEgressHeader reads the header written by WriteEgressHeader.
+func ReadEgressHeader(r io.Reader) (string, error) {
+	length := make([]byte, 1)
+	_, err := io.ReadFull(r, length)
+	if err != nil {
+		return "", err
+	}
+	address := make([]byte, length[0])
+	_, err = io.ReadFull(r, address)
+	if err != nil {
+		return "", err
+	}
+	return string(address), nil
+}
@@ -0,0 +1,465 @@
+package Utils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NOISEPROTOCOL is the Noise protocol, noiseprotocol.org, of control connections authenticated with static keys
+// instead of certificates, for clients where managing an X.509 PKI is overkill. The client knows the static key of
+// the server beforehand and sends its own in the first message, see NoiseConn.
+const NOISEPROTOCOL = "Noise_IK_25519_AESGCM_SHA256"
+
+// NOISEKEYSIZE is the size of the Curve25519 keys of NOISEPROTOCOL, which are written in base64, see EncodeNoiseKey.
+const NOISEKEYSIZE = 32
+
+const (
+	// noisePrologue binds the handshake to this application
+	noisePrologue = "goexpose"
+	// noiseMaxMessage is the maximum size of a Noise message, noiseTagSize that of the tag of AES-GCM
+	noiseMaxMessage = 65535
+	noiseTagSize    = 16
+)
+
+// GenerateNoiseKey returns a new private Curve25519 key.
+func GenerateNoiseKey() ([]byte, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return key.Bytes(), nil
+}
+
+// NoisePublicKey returns the public key of the private key.
+func NoisePublicKey(private []byte) ([]byte, error) {
+	key, err := ecdh.X25519().NewPrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return key.PublicKey().Bytes(), nil
+}
+
+// EncodeNoiseKey returns the key in base64, as Noise keys are written in files, flags and configs.
+func EncodeNoiseKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// DecodeNoiseKey parses a key written with EncodeNoiseKey.
+func DecodeNoiseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != NOISEKEYSIZE {
+		return nil, errors.New("Noise key of invalid size")
+	}
+	return key, nil
+}
+
+// LoadNoiseKey reads a private key written with WriteNoiseKey.
+func LoadNoiseKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeNoiseKey(strings.TrimSpace(string(data)))
+}
+
+// WriteNoiseKey writes the private key to a file only its owner may read.
+func WriteNoiseKey(path string, key []byte) error {
+	return os.WriteFile(path, []byte(EncodeNoiseKey(key)+"\n"), 0600)
+}
+
+// NoiseConn is a connection encrypted and authenticated with NOISEPROTOCOL. Every message is sent with its length in
+// two bytes, as the Noise specification suggests, the messages of the data written are read as one stream. The
+// handshake is run by the first Read or Write, or by Handshake.
+//
+// Reads time out with the deadlines of the underlying connection and can be retried, a message read in part is kept
+// until the next Read.
+type NoiseConn struct {
+	conn net.Conn
+	// client is set on the initiator of the handshake
+	client bool
+	static []byte
+	// remote is the static key of the peer, known to the client beforehand and learned by the server
+	remote []byte
+
+	// hmu guards the handshake, which is only run once
+	hmu           sync.Mutex
+	handshakeDone bool
+	handshakeErr  error
+
+	// rmu guards the message being read and the decrypted data not read yet
+	rmu     sync.Mutex
+	recv    *noiseCipher
+	buf     [4096]byte
+	raw     []byte
+	plain   []byte
+	readErr error
+
+	wmu  sync.Mutex
+	send *noiseCipher
+}
+
+// NoiseClient creates the client side of a NoiseConn on conn, with the private key of the client and the public key
+// of the server. The handshake fails if the server doesn't have the private key of server.
+func NoiseClient(conn net.Conn, static []byte, server []byte) *NoiseConn {
+	return &NoiseConn{conn: conn, client: true, static: static, remote: server}
+}
+
+// NoiseServer creates the server side of a NoiseConn on conn, with the private key of the server. Any client
+// completes the handshake, the server authorizes it by its key, see RemoteStatic.
+func NoiseServer(conn net.Conn, static []byte) *NoiseConn {
+	return &NoiseConn{conn: conn, static: static}
+}
+
+// RemoteStatic returns the static public key of the peer, that of a client once the handshake is done.
+func (c *NoiseConn) RemoteStatic() []byte {
+	return c.remote
+}
+
+// Handshake runs the handshake unless it was run before, and returns its error.
+func (c *NoiseConn) Handshake() error {
+	c.hmu.Lock()
+	defer c.hmu.Unlock()
+	if c.handshakeDone {
+		return c.handshakeErr
+	}
+	c.handshakeDone = true
+	if c.client {
+		c.handshakeErr = c.clientHandshake()
+	} else {
+		c.handshakeErr = c.serverHandshake()
+	}
+	return c.handshakeErr
+}
+
+// clientHandshake sends -> e, es, s, ss and reads <- e, ee, se of the IK pattern, both without payload.
+func (c *NoiseConn) clientHandshake() error {
+	static, err := ecdh.X25519().NewPrivateKey(c.static)
+	if err != nil {
+		return err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	s := newNoiseSymmetric()
+	s.mixHash(c.remote)
+	msg := ephemeral.PublicKey().Bytes()
+	s.mixHash(msg)
+	if err = s.mixDH(ephemeral, c.remote); err != nil {
+		return err
+	}
+	msg = append(msg, s.encryptAndHash(static.PublicKey().Bytes())...)
+	if err = s.mixDH(static, c.remote); err != nil {
+		return err
+	}
+	msg = append(msg, s.encryptAndHash(nil)...)
+	if err = c.writeMessage(msg); err != nil {
+		return err
+	}
+	reply, err := c.readMessage()
+	if err != nil {
+		return err
+	}
+	if len(reply) != NOISEKEYSIZE+noiseTagSize {
+		return errors.New("invalid Noise handshake message")
+	}
+	remoteEphemeral := reply[:NOISEKEYSIZE]
+	s.mixHash(remoteEphemeral)
+	if err = s.mixDH(ephemeral, remoteEphemeral); err != nil {
+		return err
+	}
+	if err = s.mixDH(static, remoteEphemeral); err != nil {
+		return err
+	}
+	if _, err = s.decryptAndHash(reply[NOISEKEYSIZE:]); err != nil {
+		return err
+	}
+	c.send, c.recv, err = s.split()
+	return err
+}
+
+// serverHandshake reads -> e, es, s, ss and answers <- e, ee, se of the IK pattern, both without payload.
+func (c *NoiseConn) serverHandshake() error {
+	static, err := ecdh.X25519().NewPrivateKey(c.static)
+	if err != nil {
+		return err
+	}
+	s := newNoiseSymmetric()
+	s.mixHash(static.PublicKey().Bytes())
+	msg, err := c.readMessage()
+	if err != nil {
+		return err
+	}
+	if len(msg) != 2*NOISEKEYSIZE+2*noiseTagSize {
+		return errors.New("invalid Noise handshake message")
+	}
+	remoteEphemeral := msg[:NOISEKEYSIZE]
+	s.mixHash(remoteEphemeral)
+	if err = s.mixDH(static, remoteEphemeral); err != nil {
+		return err
+	}
+	remote, err := s.decryptAndHash(msg[NOISEKEYSIZE : 2*NOISEKEYSIZE+noiseTagSize])
+	if err != nil {
+		return err
+	}
+	if err = s.mixDH(static, remote); err != nil {
+		return err
+	}
+	if _, err = s.decryptAndHash(msg[2*NOISEKEYSIZE+noiseTagSize:]); err != nil {
+		return err
+	}
+	c.remote = remote
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	reply := ephemeral.PublicKey().Bytes()
+	s.mixHash(reply)
+	if err = s.mixDH(ephemeral, remoteEphemeral); err != nil {
+		return err
+	}
+	if err = s.mixDH(ephemeral, remote); err != nil {
+		return err
+	}
+	reply = append(reply, s.encryptAndHash(nil)...)
+	if err = c.writeMessage(reply); err != nil {
+		return err
+	}
+	c.recv, c.send, err = s.split()
+	return err
+}
+
+// readMessage returns the next message. The message read so far is kept if reading fails, e.g. on a timeout.
+func (c *NoiseConn) readMessage() ([]byte, error) {
+	for {
+		if len(c.raw) >= 2 {
+			size := 2 + int(binary.BigEndian.Uint16(c.raw))
+			if len(c.raw) >= size {
+				msg := c.raw[2:size]
+				c.raw = c.raw[size:]
+				return msg, nil
+			}
+		}
+		n, err := c.conn.Read(c.buf[:])
+		c.raw = append(c.raw, c.buf[:n]...)
+		if err != nil && n == 0 {
+			return nil, err
+		}
+	}
+}
+
+// writeMessage sends the message with its length.
+func (c *NoiseConn) writeMessage(msg []byte) error {
+	data := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	_, err := c.conn.Write(append(data, msg...))
+	return err
+}
+
+func (c *NoiseConn) Read(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for len(c.plain) == 0 {
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		msg, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.plain, err = c.recv.open(msg[:0], nil, msg)
+		if err != nil {
+			// the stream can't be read on after a message failed to decrypt
+			c.readErr = err
+			return 0, err
+		}
+	}
+	n := copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+func (c *NoiseConn) Write(b []byte) (int, error) {
+	if err := c.Handshake(); err != nil {
+		return 0, err
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), noiseMaxMessage-noiseTagSize)]
+		msg := make([]byte, 2, 2+len(chunk)+noiseTagSize)
+		msg = c.send.seal(msg, nil, chunk)
+		binary.BigEndian.PutUint16(msg, uint16(len(msg)-2))
+		_, err := c.conn.Write(msg)
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		b = b[len(chunk):]
+	}
+	return written, nil
+}
+
+func (c *NoiseConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *NoiseConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *NoiseConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *NoiseConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *NoiseConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *NoiseConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// noiseCipher is the CipherState of the Noise specification, AES-GCM with a counter as nonce.
+type noiseCipher struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newNoiseCipher(key []byte) (*noiseCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &noiseCipher{aead: aead}, nil
+}
+
+// nextNonce returns the nonce of the next message, the counter big-endian after four zero bytes.
+func (c *noiseCipher) nextNonce() []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], c.nonce)
+	c.nonce++
+	return nonce
+}
+
+func (c *noiseCipher) seal(dst []byte, ad []byte, plaintext []byte) []byte {
+	return c.aead.Seal(dst, c.nextNonce(), plaintext, ad)
+}
+
+func (c *noiseCipher) open(dst []byte, ad []byte, ciphertext []byte) ([]byte, error) {
+	return c.aead.Open(dst, c.nextNonce(), ciphertext, ad)
+}
+
+// noiseSymmetric is the SymmetricState of the Noise specification, the chaining key and the handshake hash.
+type noiseSymmetric struct {
+	ck     [sha256.Size]byte
+	h      [sha256.Size]byte
+	cipher *noiseCipher
+}
+
+// newNoiseSymmetric initializes the state with NOISEPROTOCOL and the prologue.
+func newNoiseSymmetric() *noiseSymmetric {
+	s := &noiseSymmetric{}
+	copy(s.h[:], NOISEPROTOCOL)
+	s.ck = s.h
+	s.mixHash([]byte(noisePrologue))
+	return s
+}
+
+func (s *noiseSymmetric) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(s.h[:])
+	h.Write(data)
+	h.Sum(s.h[:0])
+}
+
+// mixDH mixes the Diffie-Hellman of the private and the public key into the chaining key.
+func (s *noiseSymmetric) mixDH(private *ecdh.PrivateKey, public []byte) error {
+	key, err := ecdh.X25519().NewPublicKey(public)
+	if err != nil {
+		return err
+	}
+	shared, err := private.ECDH(key)
+	if err != nil {
+		return err
+	}
+	ck, k := noiseHKDF(s.ck[:], shared)
+	s.ck = ck
+	s.cipher, err = newNoiseCipher(k[:])
+	return err
+}
+
+func (s *noiseSymmetric) encryptAndHash(plaintext []byte) []byte {
+	ciphertext := plaintext
+	if s.cipher != nil {
+		ciphertext = s.cipher.seal(nil, s.h[:], plaintext)
+	}
+	s.mixHash(ciphertext)
+	return ciphertext
+}
+
+func (s *noiseSymmetric) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext := ciphertext
+	if s.cipher != nil {
+		var err error
+		plaintext, err = s.cipher.open(nil, s.h[:], ciphertext)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split returns the ciphers of the messages of the initiator and of the responder.
+func (s *noiseSymmetric) split() (*noiseCipher, *noiseCipher, error) {
+	k1, k2 := noiseHKDF(s.ck[:], nil)
+	initiator, err := newNoiseCipher(k1[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	responder, err := newNoiseCipher(k2[:])
+	return initiator, responder, err
+}
+
+// noiseHKDF derives two keys from the chaining key and the input key material.
+func noiseHKDF(ck []byte, ikm []byte) ([sha256.Size]byte, [sha256.Size]byte) {
+	var out1, out2 [sha256.Size]byte
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{0x01})
+	mac.Sum(out1[:0])
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(out1[:])
+	mac.Write([]byte{0x02})
+	mac.Sum(out2[:0])
+	return out1, out2
+}
@@ -0,0 +1,121 @@
+package test
+
+import (
+	"Utils"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a TCP connection over the loopback.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	return a, b
+}
+
+// compressedWire sends the message through a CompressedConn of the preset and returns the compressed bytes it took.
+func compressedWire(t *testing.T, preset string, message string) uint64 {
+	dict, ok := Utils.CompressionDictionary(preset)
+	if !ok {
+		t.Fatal("Expected the preset", preset)
+	}
+	a, b := tcpPair(t)
+	var wire atomic.Uint64
+	sender := Utils.NewCompressedConn(a, dict, nil, &wire)
+	receiver := Utils.NewCompressedConn(b, dict, nil, nil)
+	_, err := sender.Write([]byte(message))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(message))
+	_ = receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(receiver, buf)
+	if err != nil || string(buf) != message {
+		t.Fatalf("Expected %q, got %q %v", message, buf, err)
+	}
+	return wire.Load()
+}
+
+func TestCompressedConn(t *testing.T) {
+	a, b := tcpPair(t)
+	dict, _ := Utils.CompressionDictionary(Utils.COMPRESSJSON)
+	var wireIn, wireOut atomic.Uint64
+	client := Utils.NewCompressedConn(a, dict, nil, &wireOut)
+	server := Utils.NewCompressedConn(b, dict, &wireIn, nil)
+
+	// a read deadline passing doesn't break the stream
+	_ = server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 64)
+	if _, err := server.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("Expected the read deadline to pass, got", err)
+	}
+	_ = server.SetReadDeadline(time.Time{})
+
+	messages := []string{`{"id":1,"status":"ok"}`, `{"id":2,"status":"ok"}`}
+	for _, m := range messages {
+		_, err := client.Write([]byte(m))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := client.CloseWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal("Expected the end of the stream, got", err)
+	}
+	if string(received) != messages[0]+messages[1] {
+		t.Errorf("Expected the messages, got %q", received)
+	}
+	if wireIn.Load() == 0 || wireIn.Load() != wireOut.Load() {
+		t.Error("Expected the compressed bytes to be counted on both sides, got", wireIn.Load(), wireOut.Load())
+	}
+
+	// the other direction is still open after the half-close
+	_, err = server.Write([]byte("reply"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := client.Read(buf)
+	if err != nil || string(buf[:n]) != "reply" {
+		t.Errorf("Expected the reply, got %q %v", buf[:n], err)
+	}
+}
+
+func TestCompressionDictionaries(t *testing.T) {
+	if _, ok := Utils.CompressionDictionary("zstd"); ok {
+		t.Error("Expected an unknown preset")
+	}
+	message := `{"id":42,"type":"event","name":"door","status":"open","timestamp":1700000000}`
+	plain, json := compressedWire(t, Utils.COMPRESSFLATE, message), compressedWire(t, Utils.COMPRESSJSON, message)
+	if json >= plain {
+		t.Error("Expected the JSON dictionary to compress a small JSON message better, got", json, "bytes against", plain)
+	}
+	request := "GET / HTTP/1.1\r\nHost: app.example.com\r\nAccept: */*\r\nUser-Agent: Mozilla/5.0 \r\n\r\n"
+	if http := compressedWire(t, Utils.COMPRESSHTTP, request); http >= compressedWire(t, Utils.COMPRESSFLATE, request) {
+		t.Error("Expected the HTTP dictionary to compress a request better, got", http)
+	}
+}
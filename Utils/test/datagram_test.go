@@ -0,0 +1,94 @@
+package test
+
+import (
+	"Utils"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	datagrams := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{0xab}, 1500), []byte("last")}
+
+	var stream bytes.Buffer
+	for _, d := range datagrams {
+		err := Utils.WriteDatagram(&stream, d)
+		if err != nil {
+			t.Fatal("Error writing datagram", err)
+		}
+	}
+
+	buf := make([]byte, Utils.MAXDATAGRAM)
+	for i, d := range datagrams {
+		n, err := Utils.ReadDatagram(&stream, buf)
+		if err != nil {
+			t.Fatal("Error reading datagram", i, err)
+		}
+		if !bytes.Equal(buf[:n], d) {
+			t.Error("Datagram mismatch", i, "Expected", len(d), "bytes, got", n)
+		}
+	}
+
+	_, err := Utils.ReadDatagram(&stream, buf)
+	if !errors.Is(err, io.EOF) {
+		t.Error("Expected EOF after the last datagram, got", err)
+	}
+}
+
+func TestDatagramTooLarge(t *testing.T) {
+	err := Utils.WriteDatagram(io.Discard, make([]byte, Utils.MAXDATAGRAM+1))
+	if !errors.Is(err, Utils.ErrDatagramTooLarge) {
+		t.Error("Expected ErrDatagramTooLarge on write, got", err)
+	}
+
+	var stream bytes.Buffer
+	_ = Utils.WriteDatagram(&stream, make([]byte, 100))
+	_ = Utils.WriteDatagram(&stream, []byte("next"))
+
+	buf := make([]byte, 10)
+	_, err = Utils.ReadDatagram(&stream, buf)
+	if !errors.Is(err, Utils.ErrDatagramTooLarge) {
+		t.Error("Expected ErrDatagramTooLarge on read, got", err)
+	}
+	// the oversized datagram is skipped, the stream stays usable
+	n, err := Utils.ReadDatagram(&stream, buf)
+	if err != nil || string(buf[:n]) != "next" {
+		t.Error("Expected the next datagram after an oversized one, got", string(buf[:n]), err)
+	}
+}
+
+func TestDatagramFragments(t *testing.T) {
+	datagrams := [][]byte{[]byte("small"), {}, bytes.Repeat([]byte{0xcd}, 1000), bytes.Repeat([]byte{0xef}, 3000)}
+
+	var stream bytes.Buffer
+	for _, d := range datagrams {
+		err := Utils.WriteFragmented(&stream, d, 1000)
+		if err != nil {
+			t.Fatal("Error writing fragmented datagram", err)
+		}
+	}
+
+	buf := make([]byte, Utils.MAXDATAGRAM)
+	for i, d := range datagrams {
+		n, err := Utils.ReadFragmented(&stream, buf)
+		if err != nil {
+			t.Fatal("Error reading fragmented datagram", i, err)
+		}
+		if !bytes.Equal(buf[:n], d) {
+			t.Error("Datagram mismatch", i, "Expected", len(d), "bytes, got", n)
+		}
+	}
+
+	// a reassembled datagram larger than the buffer is skipped as a whole
+	_ = Utils.WriteFragmented(&stream, make([]byte, 300), 100)
+	_ = Utils.WriteFragmented(&stream, []byte("next"), 100)
+	_, err := Utils.ReadFragmented(&stream, buf[:200])
+	if !errors.Is(err, Utils.ErrDatagramTooLarge) {
+		t.Error("Expected ErrDatagramTooLarge on read, got", err)
+	}
+	n, err := Utils.ReadFragmented(&stream, buf[:200])
+	if err != nil || string(buf[:n]) != "next" {
+		t.Error("Expected the next datagram after an oversized one, got", string(buf[:n]), err)
+	}
+}
@@ -0,0 +1,119 @@
+package test
+
+import (
+	"Utils"
+	"testing"
+	"time"
+)
+
+// nextChange returns the next change of the subscription, or fails if none arrives in time.
+func nextChange(t *testing.T, changes <-chan Utils.Exposure) Utils.Exposure {
+	t.Helper()
+	select {
+	case exp := <-changes:
+		return exp
+	case <-time.After(time.Second):
+		t.Fatal("Expected a state change")
+	}
+	return Utils.Exposure{}
+}
+
+func TestExposureLifecycle(t *testing.T) {
+	e := Utils.NewExposures()
+	changes, cancel := e.Subscribe()
+	defer cancel()
+	if e.State("tcp", 8080) != Utils.StateHidden {
+		t.Error("Expected an unknown port to be hidden")
+	}
+
+	e.Set("tcp", 8080, Utils.StateRequested, "")
+	if exp := nextChange(t, changes); exp.State != Utils.StateRequested || exp.Port != 8080 || exp.Network != "tcp" {
+		t.Error("Expected the port to be requested, got", exp)
+	}
+	e.Set("tcp", 8080, Utils.StateReady, "")
+	nextChange(t, changes)
+	e.SetPublic("tcp", 8080, 0, "https://app.example.com", "ipv4,ipv6")
+	if exp := nextChange(t, changes); exp.URL != "https://app.example.com" || exp.Families != "ipv4,ipv6" {
+		t.Error("Expected the URL of the port, got", exp)
+	}
+
+	// where the port is exposed survives the connection being lost and restored
+	e.Set("tcp", 8080, Utils.StateDegraded, "control connection lost")
+	if exp := nextChange(t, changes); exp.URL != "https://app.example.com" || exp.Reason != "control connection lost" {
+		t.Error("Expected the degraded port to keep its URL, got", exp)
+	}
+	e.SetIf("tcp", 8080, Utils.StateDegraded, Utils.StateReady, "")
+	exp := nextChange(t, changes)
+	if exp.State != Utils.StateReady || exp.URL != "https://app.example.com" || exp.Families != "ipv4,ipv6" || exp.Reason != "" {
+		t.Error("Expected the ready port to keep its URL and families, got", exp)
+	}
+	if exp.String() != "tcp/8080 READY over ipv4,ipv6 on https://app.example.com" {
+		t.Error("Unexpected description", exp.String())
+	}
+
+	// SetIf leaves ports in other states alone, setting the current state again changes nothing
+	e.SetIf("tcp", 8080, Utils.StateDegraded, Utils.StateError, "unexpected")
+	e.Set("tcp", 8080, Utils.StateReady, "")
+	e.SetPublic("tcp", 8080, 0, "https://app.example.com", "ipv4,ipv6")
+	select {
+	case exp := <-changes:
+		t.Error("Expected no change, got", exp)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// hidden ports forget where they were exposed
+	e.Set("tcp", 8080, Utils.StateHidden, "")
+	if exp := nextChange(t, changes); exp.URL != "" || exp.Families != "" {
+		t.Error("Expected the hidden port to forget its URL, got", exp)
+	}
+	e.Set("udp", 5353, Utils.StateRequested, "")
+	nextChange(t, changes)
+	e.Set("udp", 5353, Utils.StateReady, "")
+	nextChange(t, changes)
+	e.SetPublic("udp", 15353, 15353, "", "")
+	if e.State("udp", 15353) != Utils.StateHidden {
+		t.Error("Expected no public port to be recorded for an unknown port")
+	}
+	e.SetPublic("udp", 5353, 15353, "", "ipv4")
+	nextChange(t, changes)
+	e.Set("udp", 5353, Utils.StateError, "port taken")
+	if exp := nextChange(t, changes); exp.PublicPort != 0 || exp.Reason != "port taken" {
+		t.Error("Expected the failed port to forget its public port, got", exp)
+	}
+
+	snapshot := e.Snapshot()
+	if len(snapshot) != 2 {
+		t.Fatal("Expected both ports in the snapshot, got", snapshot)
+	}
+	for _, exp := range snapshot {
+		if exp.Network == "tcp" && exp.State != Utils.StateHidden || exp.Network == "udp" && exp.State != Utils.StateError {
+			t.Error("Unexpected state in the snapshot", exp)
+		}
+	}
+}
+
+func TestExposureSubscription(t *testing.T) {
+	e := Utils.NewExposures()
+	changes, cancel := e.Subscribe()
+	// a subscriber not keeping up misses changes, but doesn't block the client
+	for port := 1; port <= 100; port++ {
+		e.Set("tcp", port, Utils.StateRequested, "")
+	}
+	received := 0
+	for len(changes) > 0 {
+		<-changes
+		received++
+	}
+	if received == 0 || received == 100 {
+		t.Error("Expected some of the changes to be dropped, got", received)
+	}
+	if len(e.Snapshot()) != 100 {
+		t.Error("Expected the snapshot to hold all ports")
+	}
+	cancel()
+	cancel()
+	if _, ok := <-changes; ok {
+		t.Error("Expected the channel to be closed")
+	}
+	e.Set("tcp", 1, Utils.StateReady, "")
+}
@@ -0,0 +1,31 @@
+package test
+
+import (
+	"Utils"
+	"strings"
+	"testing"
+)
+
+func TestParseFingerprint(t *testing.T) {
+	fp := Utils.Fingerprint([]byte("certificate"))
+	var pairs []string
+	for i := 0; i < len(fp); i += 2 {
+		pairs = append(pairs, strings.ToUpper(fp[i:i+2]))
+	}
+	parsed, err := Utils.ParseFingerprint(fp)
+	if err != nil || parsed != fp {
+		t.Error("Expected the fingerprint unchanged, got", parsed, err)
+	}
+	parsed, err = Utils.ParseFingerprint(strings.Join(pairs, ":"))
+	if err != nil || parsed != fp {
+		t.Error("Expected the fingerprint with colons to be normalized, got", parsed, err)
+	}
+	_, err = Utils.ParseFingerprint("ab:cd")
+	if err == nil {
+		t.Error("Expected an error for a short fingerprint")
+	}
+	_, err = Utils.ParseFingerprint(fp[:62] + "zz")
+	if err == nil {
+		t.Error("Expected an error for a fingerprint that isn't hex")
+	}
+}
@@ -0,0 +1,83 @@
+package test
+
+import (
+	"Utils"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// framePair connects two FrameConns, the frames sent by one are encoded and decoded like on a control connection.
+func framePair(t *testing.T) (*Utils.FrameConn, *Utils.FrameConn) {
+	var a, b *Utils.FrameConn
+	relay := func(to **Utils.FrameConn) func(*Utils.CTRLFrame) error {
+		return func(fr *Utils.CTRLFrame) error {
+			by, err := Utils.ToByteArray(fr)
+			if err != nil {
+				return err
+			}
+			if len(by) > 1024 {
+				t.Error("Data frame larger than ReadFrame reads", len(by))
+			}
+			decoded, err := Utils.FromByteArray(by)
+			if err != nil {
+				return err
+			}
+			return (*to).Deliver(decoded)
+		}
+	}
+	a = Utils.NewFrameConn(relay(&b), nil, nil)
+	b = Utils.NewFrameConn(relay(&a), nil, nil)
+	return a, b
+}
+
+func TestFrameConnMux(t *testing.T) {
+	a, b := framePair(t)
+	client := Utils.NewMuxSession(a, true)
+	server := Utils.NewMuxSession(b, false)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		st, err := client.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(st, st)
+		_ = st.CloseWrite()
+	}()
+
+	st, err := server.Open()
+	if err != nil {
+		t.Fatal("Error opening stream", err)
+	}
+	data := bytes.Repeat([]byte("inline"), 1000)
+	go func() {
+		_, _ = st.Write(data)
+		_ = st.CloseWrite()
+	}()
+	echo, err := io.ReadAll(st)
+	if err != nil {
+		t.Fatal("Error reading echo", err)
+	}
+	if !bytes.Equal(echo, data) {
+		t.Error("Echo mismatch, got", len(echo), "bytes")
+	}
+}
+
+func TestFrameConnClose(t *testing.T) {
+	a, _ := framePair(t)
+	_ = a.Close()
+	_, err := a.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Error("Expected EOF after close, got", err)
+	}
+	_, err = a.Write([]byte("x"))
+	if err == nil {
+		t.Error("Expected an error writing to a closed FrameConn")
+	}
+	err = a.Deliver(Utils.NewCTRLFrame(Utils.CTRLDATA, []string{"not base64!"}))
+	if err == nil {
+		t.Error("Expected an error delivering a malformed frame")
+	}
+}
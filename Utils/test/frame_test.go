@@ -37,6 +37,37 @@ func TestFrameToJsonAndBack(t *testing.T) {
 	}
 }
 
+func TestStatsFramesToJsonAndBack(t *testing.T) {
+	frames := []*Utils.CTRLFrame{
+		Utils.NewCTRLFrame(Utils.CTRLSTATS, nil),
+		Utils.NewCTRLFrame(Utils.CTRLSTATS, []string{"tcp", "8080", "1024", "2048", "3", "1", "0", "0", "0", "0", "web", "2", "1", "512", "1024"}),
+		Utils.NewCTRLFrame(Utils.CTRLSTATS, []string{"udp", "5353", "18446744073709551615", "0", "0", "-1", "0", "0", "7", "4", "", "0", "0", "0", "0"}),
+		Utils.NewCTRLFrame(Utils.CTRLSTATSSUB, []string{"5"}),
+		Utils.NewCTRLFrame(Utils.CTRLSTATSSUB, []string{"0"}),
+	}
+	for _, fr := range frames {
+		jsonBytes, err := Utils.ToByteArray(fr)
+		if err != nil {
+			t.Fatal("Error converting frame to json", err)
+		}
+		fr2, err := Utils.FromByteArray(jsonBytes)
+		if err != nil {
+			t.Fatal("Error converting json to frame", err)
+		}
+		if fr.Typ != fr2.Typ {
+			t.Error("Frame type mismatch", fr.Typ, fr2.Typ)
+		}
+		if len(fr.Data) != len(fr2.Data) {
+			t.Fatal("Frame data length mismatch", fr.Data, fr2.Data)
+		}
+		for i := range fr.Data {
+			if fr.Data[i] != fr2.Data[i] {
+				t.Error("Frame data mismatch", "Expected", fr.Data[i], "Got", fr2.Data[i])
+			}
+		}
+	}
+}
+
 func FuzzFrameJson(f *testing.F) {
 	for _, seed := range [][]byte{{}, {0}, {9}, {0xa}, {0xf}, {1, 2, 3, 4}} {
 		f.Add(seed)
@@ -0,0 +1,55 @@
+package test
+
+import (
+	"Utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.log")
+	// a backup older than MaxAge is pruned when the file is opened
+	old := path + "." + time.Now().Add(-48*time.Hour).UTC().Format(Utils.LOGBACKUPTIME)
+	err := os.WriteFile(old, []byte("old\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := Utils.OpenRotatingFile(path, Utils.LogRotation{MaxSize: 10, MaxAge: 24 * time.Hour, MaxBackups: 1, Compress: true})
+	if err != nil {
+		t.Fatal("Error opening log file", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n"} {
+		_, err = f.Write([]byte(line))
+		if err != nil {
+			t.Fatal("Error writing log file", err)
+		}
+		// rotated files are named after the time of rotation in milliseconds
+		time.Sleep(2 * time.Millisecond)
+	}
+	err = f.Close()
+	if err != nil {
+		t.Error("Error closing log file", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "third\n" {
+		t.Error("Expected the log file to hold the last line only, got", string(data), err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backups []string
+	for _, entry := range entries {
+		if entry.Name() != "server.log" {
+			backups = append(backups, entry.Name())
+		}
+	}
+	if len(backups) != 1 || !strings.HasSuffix(backups[0], ".gz") {
+		t.Error("Expected a single compressed backup, got", backups)
+	}
+}
@@ -2,6 +2,10 @@ package test
 
 import (
 	"Utils"
+	"bytes"
+	"log/slog"
+	"net"
+	"strings"
 	"testing"
 )
 
@@ -12,3 +16,43 @@ func TestSetupLoggerWriter(t *testing.T) {
 	Utils.SetupLoggerWriter(dir, "client", false)
 	t.Log("SetupLoggerWriter test done")
 }
+
+func TestRedactingHandler(t *testing.T) {
+	tests := []struct {
+		mode     string
+		addr     string
+		contains string
+	}{
+		{Utils.REDACTOFF, "203.0.113.57:4242", "Peer=203.0.113.57:4242"},
+		{Utils.REDACTTRUNCATE, "203.0.113.57:4242", "Peer=203.0.113.0:4242"},
+		{Utils.REDACTTRUNCATE, "[2001:db8:abcd:12::1]:4242", "Peer=[2001:db8:abcd::]:4242"},
+		{Utils.REDACTHASH, "203.0.113.57:4242", "Peer=ip-"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		handler, err := Utils.NewRedactingHandler(slog.NewTextHandler(&buf, nil), tt.mode, []byte("salt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		logger := slog.New(handler).With("Token", "s3cr3t-token")
+		logger.Info("test", Utils.PEERKEY, tt.addr, "Port", 4242, slog.Group("Request", "Authorization", "Bearer s3cr3t"))
+		out := buf.String()
+		if !strings.Contains(out, tt.contains) {
+			t.Error("Mode", tt.mode, "expected", tt.contains, "got", out)
+		}
+		// credentials are left out in every mode
+		if strings.Contains(out, "s3cr3t") || !strings.Contains(out, "Token="+Utils.REDACTEDSECRET) ||
+			!strings.Contains(out, "Request.Authorization="+Utils.REDACTEDSECRET) {
+			t.Error("Mode", tt.mode, "leaked a credential:", out)
+		}
+		host, _, _ := net.SplitHostPort(tt.addr)
+		if tt.mode != Utils.REDACTOFF && strings.Contains(out, host) {
+			t.Error("Mode", tt.mode, "leaked the peer address:", out)
+		}
+	}
+
+	_, err := Utils.NewRedactingHandler(slog.NewTextHandler(&bytes.Buffer{}, nil), Utils.REDACTHASH, nil)
+	if err == nil {
+		t.Error("Expected an error for hash mode without salt")
+	}
+}
@@ -0,0 +1,130 @@
+package test
+
+import (
+	"Utils"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func muxPair(t *testing.T) (*Utils.MuxSession, *Utils.MuxSession) {
+	c1, c2 := net.Pipe()
+	client := Utils.NewMuxSession(c1, true)
+	server := Utils.NewMuxSession(c2, false)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+func TestMuxStreams(t *testing.T) {
+	client, server := muxPair(t)
+
+	// echo every accepted stream until its writer is done
+	go func() {
+		for {
+			st, err := client.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(st, st)
+				_ = st.CloseWrite()
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st, err := server.Open()
+			if err != nil {
+				t.Error("Error opening stream", err)
+				return
+			}
+			defer st.Close()
+			// more than a window, so the writer has to wait for window updates
+			data := bytes.Repeat([]byte{byte(i)}, 3*Utils.MUXWINDOW)
+			go func() {
+				_, _ = st.Write(data)
+				_ = st.CloseWrite()
+			}()
+			echo, err := io.ReadAll(st)
+			if err != nil {
+				t.Error("Error reading echo", i, err)
+				return
+			}
+			if !bytes.Equal(echo, data) {
+				t.Error("Echo mismatch on stream", i, "got", len(echo), "bytes")
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMuxStreamHeaderAndDeadline(t *testing.T) {
+	client, server := muxPair(t)
+
+	st, err := server.Open()
+	if err != nil {
+		t.Fatal("Error opening stream", err)
+	}
+	err = Utils.WriteStreamHeader(st, "udp", 27015)
+	if err != nil {
+		t.Fatal("Error writing stream header", err)
+	}
+	accepted, err := client.Accept()
+	if err != nil {
+		t.Fatal("Error accepting stream", err)
+	}
+	network, port, err := Utils.ReadStreamHeader(accepted)
+	if err != nil || network != "udp" || port != 27015 {
+		t.Error("Expected udp/27015, got", network, port, err)
+	}
+
+	_ = accepted.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err = accepted.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("Expected a deadline error, got", err)
+	}
+
+	_ = server.Close()
+	_ = accepted.SetReadDeadline(time.Time{})
+	_, err = accepted.Read(make([]byte, 1))
+	if err == nil {
+		t.Error("Expected an error after the session was closed")
+	}
+}
+
+func TestMuxEgressHeader(t *testing.T) {
+	client, server := muxPair(t)
+
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal("Error opening stream", err)
+	}
+	err = Utils.WriteEgressHeader(st, "db.internal:5432")
+	if err != nil {
+		t.Fatal("Error writing egress header", err)
+	}
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal("Error accepting stream", err)
+	}
+	address, err := Utils.ReadEgressHeader(accepted)
+	if err != nil || address != "db.internal:5432" {
+		t.Error("Expected db.internal:5432, got", address, err)
+	}
+	if Utils.WriteEgressHeader(st, strings.Repeat("a", Utils.MAXEGRESSADDR+1)) == nil {
+		t.Error("Expected a too long destination to be refused")
+	}
+}
@@ -0,0 +1,145 @@
+package test
+
+import (
+	"Utils"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// noiseKeys returns a new private key and its public key.
+func noiseKeys(t *testing.T) ([]byte, []byte) {
+	private, err := Utils.GenerateNoiseKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := Utils.NoisePublicKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private, public
+}
+
+// noisePair connects a Noise client expecting the server key serverKey to a Noise server with the private key server,
+// over TCP so reads can time out, and returns both ends with the errors of their handshakes.
+func noisePair(t *testing.T, clientKey []byte, serverKey []byte, server []byte) (*Utils.NoiseConn, *Utils.NoiseConn, error, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Utils.NoiseClient(conn, clientKey, serverKey)
+	srv := Utils.NoiseServer(<-accepted, server)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = srv.Close()
+	})
+	serverErr := make(chan error, 1)
+	go func() {
+		err := srv.Handshake()
+		if err != nil {
+			// the client waits for the answer otherwise
+			_ = srv.Close()
+		}
+		serverErr <- err
+	}()
+	clientErr := client.Handshake()
+	return client, srv, clientErr, <-serverErr
+}
+
+func TestNoiseStream(t *testing.T) {
+	clientKey, clientPublic := noiseKeys(t)
+	serverKey, serverPublic := noiseKeys(t)
+	client, server, clientErr, serverErr := noisePair(t, clientKey, serverPublic, serverKey)
+	if clientErr != nil || serverErr != nil {
+		t.Fatal("Expected the handshake to succeed", clientErr, serverErr)
+	}
+	if !bytes.Equal(server.RemoteStatic(), clientPublic) {
+		t.Error("Expected the server to learn the key of the client")
+	}
+	// messages up to and beyond the maximum size, in both directions
+	for _, size := range []int{1, 4000, 70000, 200000} {
+		payload := bytes.Repeat([]byte{byte(size)}, size)
+		go func() {
+			_, _ = client.Write(payload)
+		}()
+		got := make([]byte, size)
+		_, err := io.ReadFull(server, got)
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Fatal("Client payload not received", size, err)
+		}
+		go func() {
+			_, _ = server.Write(payload)
+		}()
+		_, err = io.ReadFull(client, got)
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Fatal("Server payload not received", size, err)
+		}
+	}
+
+	// a read timing out is retried
+	_ = server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := server.Read(make([]byte, 1))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatal("Expected the read to time out, got", err)
+	}
+	_ = server.SetReadDeadline(time.Time{})
+	_, _ = client.Write([]byte("after"))
+	got := make([]byte, 5)
+	_, err = io.ReadFull(server, got)
+	if err != nil || string(got) != "after" {
+		t.Error("Expected the stream to go on after a timeout, got", string(got), err)
+	}
+}
+
+func TestNoiseWrongServerKey(t *testing.T) {
+	clientKey, _ := noiseKeys(t)
+	serverKey, _ := noiseKeys(t)
+	_, otherPublic := noiseKeys(t)
+	_, _, clientErr, serverErr := noisePair(t, clientKey, otherPublic, serverKey)
+	if serverErr == nil {
+		t.Error("Expected the server to refuse a client expecting another key")
+	}
+	if clientErr == nil {
+		t.Error("Expected the client handshake to fail")
+	}
+}
+
+func TestNoiseKeyFile(t *testing.T) {
+	key, public := noiseKeys(t)
+	path := filepath.Join(t.TempDir(), "noise.key")
+	err := Utils.WriteNoiseKey(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Error("Expected the key file to be private", err)
+	}
+	loaded, err := Utils.LoadNoiseKey(path)
+	if err != nil || !bytes.Equal(loaded, key) {
+		t.Fatal("Expected the key to be loaded", err)
+	}
+	decoded, err := Utils.DecodeNoiseKey(Utils.EncodeNoiseKey(public))
+	if err != nil || !bytes.Equal(decoded, public) {
+		t.Error("Expected the public key to survive encoding", err)
+	}
+	if _, err = Utils.DecodeNoiseKey(Utils.EncodeNoiseKey(public[:16])); err == nil {
+		t.Error("Expected a short key to be refused")
+	}
+}
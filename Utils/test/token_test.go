@@ -0,0 +1,32 @@
+package test
+
+import (
+	"Utils"
+	"bytes"
+	"testing"
+)
+
+func TestProxyToken(t *testing.T) {
+	token, err := Utils.NewProxyToken()
+	if err != nil {
+		t.Fatal("Error creating token", err)
+	}
+	other, _ := Utils.NewProxyToken()
+	if token == other {
+		t.Error("Expected distinct tokens")
+	}
+
+	var stream bytes.Buffer
+	err = Utils.WriteProxyToken(&stream, token)
+	if err != nil {
+		t.Fatal("Error writing token", err)
+	}
+	read, err := Utils.ReadProxyToken(&stream)
+	if err != nil || read != token {
+		t.Error("Expected", token, "got", read, err)
+	}
+
+	if Utils.WriteProxyToken(&stream, "short") != Utils.ErrInvalidToken {
+		t.Error("Expected ErrInvalidToken for a malformed token")
+	}
+}
@@ -0,0 +1,133 @@
+package test
+
+import (
+	"Utils"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// webSocketPair opens a WebSocket to an HTTP server accepting it, and returns both ends.
+func webSocketPair(t *testing.T) (*Utils.WebSocketConn, *Utils.WebSocketConn) {
+	accepted := make(chan *Utils.WebSocketConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != Utils.WEBSOCKETPATH {
+			http.NotFound(w, r)
+			return
+		}
+		conn, err := Utils.AcceptWebSocket(w, r)
+		if err != nil {
+			t.Error("Error accepting WebSocket", err)
+			return
+		}
+		accepted <- conn
+	}))
+	t.Cleanup(srv.Close)
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Utils.ClientWebSocket(conn, srv.Listener.Addr().String(), Utils.WEBSOCKETPATH)
+	if err != nil {
+		t.Fatal("Error opening WebSocket", err)
+	}
+	server := <-accepted
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+func TestWebSocketStream(t *testing.T) {
+	client, server := webSocketPair(t)
+	// frames of all three payload length encodings, in both directions
+	for _, size := range []int{1, 125, 126, 4000, 70000} {
+		payload := bytes.Repeat([]byte{byte(size)}, size)
+		go func() {
+			_, _ = client.Write(payload)
+		}()
+		got := make([]byte, size)
+		_, err := io.ReadFull(server, got)
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Fatal("Client payload not received", size, err)
+		}
+		go func() {
+			_, _ = server.Write(payload)
+		}()
+		_, err = io.ReadFull(client, got)
+		if err != nil || !bytes.Equal(got, payload) {
+			t.Fatal("Server payload not received", size, err)
+		}
+	}
+}
+
+func TestWebSocketDeadline(t *testing.T) {
+	client, server := webSocketPair(t)
+	_ = server.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := server.Read(make([]byte, 10))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatal("Expected a timeout", err)
+	}
+	// the stream is still intact after the timeout
+	_ = server.SetReadDeadline(time.Time{})
+	_, err = client.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	_, err = io.ReadFull(server, got)
+	if err != nil || string(got) != "hello" {
+		t.Fatal("Unexpected data after timeout", string(got), err)
+	}
+}
+
+func TestWebSocketClose(t *testing.T) {
+	client, server := webSocketPair(t)
+	go func() {
+		_ = client.Close()
+	}()
+	_, err := server.Read(make([]byte, 10))
+	if err != io.EOF {
+		t.Fatal("Expected EOF after close", err)
+	}
+}
+
+func TestWebSocketRefused(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// upgrades are refused, as by a server without WebSocket listener
+		if r.Header.Get("Upgrade") != "" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		_, err := Utils.AcceptWebSocket(w, r)
+		if err == nil {
+			t.Error("Accepted a request without upgrade")
+		}
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + Utils.WEBSOCKETPATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400", resp.StatusCode)
+	}
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = Utils.ClientWebSocket(conn, srv.Listener.Addr().String(), Utils.WEBSOCKETPATH)
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatal("Expected the refusal", err)
+	}
+}
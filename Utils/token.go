@@ -0,0 +1,44 @@
+package Utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+// PROXYTOKENLEN is the length of a proxy token, 16 random bytes in hex.
+const PROXYTOKENLEN = 32
+
+// ErrInvalidToken is returned if a proxy token is malformed.
+var ErrInvalidToken = errors.New("invalid proxy token")
+
+// NewProxyToken creates a random one-time token. The server sends it in a CTRLCONNECT frame and the client presents it
+// as the first bytes of the proxy connection, so only the paired client can take over the data path of a relay.
+func NewProxyToken() (string, error) {
+	b := make([]byte, PROXYTOKENLEN/2)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// WriteProxyToken presents the token on a proxy connection.
+func WriteProxyToken(w io.Writer, token string) error {
+	if len(token) != PROXYTOKENLEN {
+		return ErrInvalidToken
+	}
+	_, err := io.WriteString(w, token)
+	return err
+}
+
+// ReadProxyToken reads the token the client presents on a proxy connection.
+func ReadProxyToken(r io.Reader) (string, error) {
+	buf := make([]byte, PROXYTOKENLEN)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
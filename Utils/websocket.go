@@ -0,0 +1,364 @@
+package Utils
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WEBSOCKETPATH is the path the server accepts control connections carried in a WebSocket on, for clients behind
+// networks that only let HTTPS out. The client runs its usual TLS control connection inside the WebSocket, see
+// WebSocketConn, and relays its ports inline.
+const WEBSOCKETPATH = "/tunnel"
+
+// WEBSOCKETPROTOCOL is the subprotocol of the WebSocket, Sec-WebSocket-Protocol.
+const WEBSOCKETPROTOCOL = "goexpose"
+
+// webSocketGUID is appended to the key of the client to compute Sec-WebSocket-Accept, see RFC 6455 section 1.3.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes of the frames of RFC 6455.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// WebSocketConn is a byte stream carried in the binary messages of a WebSocket, RFC 6455. Written data is sent as a
+// binary frame per Write, the frames of received messages are read as one stream, so message boundaries don't
+// matter. Pings are answered, a close frame ends the stream with io.EOF.
+//
+// Reads time out with the deadlines of the underlying connection and can be retried, a frame header read in part is
+// kept until the next Read.
+type WebSocketConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// client masks the frames it writes, as RFC 6455 requires of clients
+	client bool
+
+	// rmu guards the state of the frame being read
+	rmu    sync.Mutex
+	head   []byte
+	buf    [14]byte
+	inside bool
+	opcode byte
+	// remaining is the length of the payload not read yet, pos the offset in it of the next byte for unmasking
+	remaining int64
+	pos       int64
+	masked    bool
+	mask      [4]byte
+	control   []byte
+	eof       bool
+
+	wmu       sync.Mutex
+	closeOnce sync.Once
+}
+
+// NewWebSocketConn creates a WebSocketConn on a connection whose handshake is done. r reads from conn and may hold
+// bytes already received, client is set on the side that opened the WebSocket.
+func NewWebSocketConn(conn net.Conn, r *bufio.Reader, client bool) *WebSocketConn {
+	return &WebSocketConn{conn: conn, r: r, client: client}
+}
+
+// AcceptWebSocket answers the upgrade request of a client with WEBSOCKETPROTOCOL and takes over its connection.
+// Requests that are no WebSocket upgrade are answered with 400.
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request) (*WebSocketConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		http.Error(w, "WebSocket upgrade expected", http.StatusBadRequest)
+		return nil, errors.New("no WebSocket upgrade")
+	}
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// the deadlines of the HTTP server don't apply to the stream
+	_ = conn.SetDeadline(time.Time{})
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + webSocketAccept(key) + "\r\n"
+	if headerContains(r.Header, "Sec-WebSocket-Protocol", WEBSOCKETPROTOCOL) {
+		response += "Sec-WebSocket-Protocol: " + WEBSOCKETPROTOCOL + "\r\n"
+	}
+	_, err = conn.Write([]byte(response + "\r\n"))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return NewWebSocketConn(conn, rw.Reader, false), nil
+}
+
+// ClientWebSocket opens a WebSocket with WEBSOCKETPROTOCOL on the path of the host over the connection, which is
+// connected to the server already. The caller sets the deadline of the handshake.
+func ClientWebSocket(conn net.Conn, host string, path string) (*WebSocketConn, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Protocol", WEBSOCKETPROTOCOL)
+	err = req.Write(conn)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("WebSocket refused: " + resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != webSocketAccept(key) {
+		return nil, errors.New("invalid Sec-WebSocket-Accept")
+	}
+	return NewWebSocketConn(conn, r, true), nil
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept of the key of a client.
+func webSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerContains reports whether one of the comma-separated values of the header is the token, ignoring case.
+func headerContains(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (c *WebSocketConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	for {
+		if c.eof {
+			return 0, io.EOF
+		}
+		if !c.inside {
+			err := c.readHeader()
+			if err != nil {
+				return 0, err
+			}
+			if c.opcode == wsText {
+				return 0, errors.New("unexpected text message on WebSocket")
+			}
+			if c.opcode >= wsClose {
+				if c.remaining > 125 {
+					return 0, errors.New("WebSocket control frame too long")
+				}
+				c.control = c.control[:0]
+			}
+		}
+		if c.opcode >= wsClose {
+			err := c.readControl()
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if c.remaining == 0 {
+			c.inside = false
+			continue
+		}
+		if len(b) == 0 {
+			return 0, nil
+		}
+		n, err := c.r.Read(b[:min(int64(len(b)), c.remaining)])
+		c.unmask(b[:n])
+		c.remaining -= int64(n)
+		if c.remaining == 0 {
+			c.inside = false
+		}
+		if n > 0 {
+			return n, nil
+		}
+		return 0, err
+	}
+}
+
+// readHeader reads the header of the next frame, keeping what was read if it fails.
+func (c *WebSocketConn) readHeader() error {
+	for {
+		need := 2
+		if len(c.head) >= 2 {
+			switch c.head[1] & 0x7f {
+			case 126:
+				need += 2
+			case 127:
+				need += 8
+			}
+			if c.head[1]&0x80 != 0 {
+				need += 4
+			}
+		}
+		if len(c.head) == need {
+			break
+		}
+		n, err := c.r.Read(c.buf[len(c.head):need])
+		c.head = c.buf[:len(c.head)+n]
+		if err != nil {
+			return err
+		}
+	}
+	c.opcode = c.head[0] & 0x0f
+	c.masked = c.head[1]&0x80 != 0
+	offset := 2
+	switch length := c.head[1] & 0x7f; length {
+	case 126:
+		c.remaining = int64(binary.BigEndian.Uint16(c.head[2:]))
+		offset = 4
+	case 127:
+		c.remaining = int64(binary.BigEndian.Uint64(c.head[2:]) & (1<<63 - 1))
+		offset = 10
+	default:
+		c.remaining = int64(length)
+	}
+	if c.masked {
+		copy(c.mask[:], c.head[offset:])
+	}
+	c.head = nil
+	c.pos = 0
+	c.inside = true
+	switch c.opcode {
+	case wsContinuation, wsText, wsBinary, wsClose, wsPing, wsPong:
+		return nil
+	}
+	return errors.New("invalid WebSocket opcode")
+}
+
+// readControl reads the payload of a control frame and answers it.
+func (c *WebSocketConn) readControl() error {
+	for c.remaining > 0 {
+		start := len(c.control)
+		c.control = append(c.control, make([]byte, c.remaining)...)
+		n, err := c.r.Read(c.control[start:])
+		c.control = c.control[:start+n]
+		c.unmask(c.control[start:])
+		c.remaining -= int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	c.inside = false
+	switch c.opcode {
+	case wsPing:
+		return c.writeFrame(wsPong, c.control)
+	case wsClose:
+		c.eof = true
+		_ = c.writeFrame(wsClose, nil)
+	}
+	return nil
+}
+
+// unmask unmasks the bytes read of the current payload.
+func (c *WebSocketConn) unmask(b []byte) {
+	if !c.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= c.mask[(c.pos+int64(i))%4]
+	}
+	c.pos += int64(len(b))
+}
+
+func (c *WebSocketConn) Write(b []byte) (int, error) {
+	err := c.writeFrame(wsBinary, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeFrame writes a single frame with the payload, masked if written by the client.
+func (c *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 2, 14+len(payload))
+	frame[0] = 0x80 | opcode
+	switch {
+	case len(payload) < 126:
+		frame[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if !c.client {
+		frame = append(frame, payload...)
+	} else {
+		frame[1] |= 0x80
+		var mask [4]byte
+		_, err := rand.Read(mask[:])
+		if err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame and closes the connection.
+func (c *WebSocketConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		// normal closure
+		_ = c.writeFrame(wsClose, []byte{0x03, 0xe8})
+		err = c.conn.Close()
+	})
+	return err
+}
+
+func (c *WebSocketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *WebSocketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *WebSocketConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}